@@ -0,0 +1,213 @@
+// access.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessEvent records someone reading a dataset: viewing it, exporting it,
+// opening it through a share link or fetching it through the API.
+type AccessEvent struct {
+	At        time.Time `json:"at"`
+	Dataset   string    `json:"dataset"`
+	Kind      string    `json:"kind"` // view, export, share or api
+	Detail    string    `json:"detail,omitempty"`
+	Principal string    `json:"principal"`
+	IP        string    `json:"ip,omitempty"`
+}
+
+type AccessEvents []AccessEvent
+
+func (list AccessEvents) Table() ([]string, [][]string) {
+	headers := []string{"at", "dataset", "kind", "detail", "principal", "ip"}
+	rows := make([][]string, len(list))
+	for i, e := range list {
+		rows[i] = []string{e.At.Format(time.RFC3339), e.Dataset, e.Kind, e.Detail, e.Principal, e.IP}
+	}
+	return headers, rows
+}
+
+// maxAccessEvents is how many events are kept per dataset; older ones are
+// dropped as new ones come in.
+const maxAccessEvents = 500
+
+// recentAccessShown is how many events the display page lists.
+const recentAccessShown = 5
+
+// accessFlushInterval is how often new events are written out. Reads are
+// logged on every page view, so they are batched rather than each rewriting
+// the file; a crash loses at most this much.
+const accessFlushInterval = 5 * time.Second
+
+type AccessLog struct {
+	mu     sync.Mutex
+	path   string
+	events map[string][]AccessEvent // by dataset, oldest first
+	dirty  bool                     // events has changes not yet written
+}
+
+var accessLog = newAccessLog(dataPath("access_log.json"))
+
+func newAccessLog(path string) *AccessLog {
+	l := &AccessLog{path: path, events: make(map[string][]AccessEvent)}
+	l.load()
+	watchDataFile(path, l.load)
+	go func() {
+		for range time.Tick(accessFlushInterval) {
+			l.flush()
+		}
+	}()
+	return l
+}
+
+// load reads the access log file, replacing what is in memory unless there
+// are events still to be written, which the next flush will save over it.
+func (l *AccessLog) load() {
+	events := make(map[string][]AccessEvent)
+	if err := readJSONFile(l.path, &events); err != nil {
+		log.Printf("Could not load the access log: %v", err)
+		return
+	}
+	l.mu.Lock()
+	if !l.dirty {
+		l.events = events
+	}
+	l.mu.Unlock()
+}
+
+// flush writes the log out if it changed, without holding the lock while it
+// does. Events only ever get appended to or dropped from a dataset's list,
+// never changed in place, so a shallow copy of the map is a snapshot.
+func (l *AccessLog) flush() {
+	l.mu.Lock()
+	if !l.dirty {
+		l.mu.Unlock()
+		return
+	}
+	events := maps.Clone(l.events)
+	l.dirty = false
+	l.mu.Unlock()
+	if err := writeJSONFile(l.path, events); err != nil {
+		log.Printf("Could not save the access log: %v", err)
+		l.mu.Lock()
+		l.dirty = true
+		l.mu.Unlock()
+	}
+}
+
+// Forget drops a purged dataset's events.
+func (l *AccessLog) Forget(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.events[id]; ok {
+		delete(l.events, id)
+		l.dirty = true
+	}
+}
+
+// accessPrincipal names who is behind r: the share link it came through,
+// the API key, or the signed-in user.
+func accessPrincipal(r *http.Request) string {
+	if link, ok := r.Context().Value(shareLinkKey{}).(ShareLink); ok {
+		return "share link " + link.ID
+	}
+	u := currentUser(r)
+	switch {
+	case u == nil || u.Via == "anonymous":
+		return "anonymous"
+	case u.Via == "apikey":
+		return fmt.Sprintf("API key %s (%s)", u.Name, u.Email)
+	}
+	return ownerID(u)
+}
+
+// Record logs an access to dataset id. Through a share link the event is
+// logged against the dataset behind the link, as kind share.
+func (l *AccessLog) Record(r *http.Request, id, kind, detail string) {
+	if link, ok := r.Context().Value(shareLinkKey{}).(ShareLink); ok {
+		id, kind = link.Dataset, "share"
+	}
+	if id == "" {
+		return
+	}
+	e := AccessEvent{At: time.Now(), Dataset: id, Kind: kind, Detail: detail, Principal: accessPrincipal(r), IP: clientIP(r)}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := append(l.events[id], e)
+	if len(list) > maxAccessEvents {
+		list = list[len(list)-maxAccessEvents:]
+	}
+	l.events[id] = list
+	l.dirty = true
+}
+
+// RecordShare logs a visit to a share link's pages.
+func (l *AccessLog) RecordShare(r *http.Request, link ShareLink, detail string) {
+	r = r.WithContext(context.WithValue(r.Context(), shareLinkKey{}, link))
+	l.Record(r, link.Dataset, "share", detail)
+}
+
+// For returns a dataset's events, newest first.
+func (l *AccessLog) For(id string) AccessEvents {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := l.events[id]
+	out := make(AccessEvents, len(list))
+	for i, e := range list {
+		out[len(list)-1-i] = e
+	}
+	return out
+}
+
+// canSeeAccessLog lets a dataset's owner and the workspace's admins read
+// who accessed it.
+func canSeeAccessLog(r *http.Request, data Spreadsheet) bool {
+	u := currentUser(r)
+	return u.HasRole(RoleAdmin) || (data.Owner != "" && ownerID(u) == data.Owner)
+}
+
+func accessLogAPIHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := teamDataset(r, r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Unknown dataset")
+		return
+	}
+	if !canSeeAccessLog(r, data) {
+		writeAPIError(w, http.StatusForbidden, "Only the dataset's owner or an admin can see its access log")
+		return
+	}
+	events := accessLog.For(data.ID)
+	offset, limit, end, err := parsePaging(r, len(events))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeAPIData(w, r, newPage(offset, limit, end, len(events), events[offset:end]))
+}
+
+// accessLogHandler shows who viewed, exported or fetched a dataset.
+func accessLogHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := teamDataset(r, r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Unknown dataset", http.StatusNotFound)
+		return
+	}
+	if !canSeeAccessLog(r, data) {
+		http.Error(w, "Only the dataset's owner or an admin can see its access log", http.StatusForbidden)
+		return
+	}
+	events := accessLog.For(data.ID)
+	section := ReportSection{Title: "Access Log", Headers: []string{"When", "Who", "Access", "Detail", "IP"}}
+	for _, e := range events {
+		section.Rows = append(section.Rows, []string{e.At.Format("2006-01-02 15:04:05"), e.Principal, e.Kind, e.Detail, e.IP})
+	}
+	section.Notes = []string{strconv.Itoa(len(events)) + " events, newest first. The last " + strconv.Itoa(maxAccessEvents) + " are kept."}
+	renderReport(w, ReportPage{Title: data.FileName, Subtitle: "Who viewed or exported this dataset", Sections: []ReportSection{section}})
+}
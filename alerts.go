@@ -0,0 +1,518 @@
+// alerts.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var alertComparators = []string{">", ">=", "<", "<=", "=", "!="}
+
+var snoozeDurations = map[string]time.Duration{
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+	"1w": 7 * 24 * time.Hour,
+}
+
+const maxAlertEvents = 500
+
+// AlertRule notifies Delivery when a calculation over the latest upload of
+// Source crosses Threshold. Rules are checked whenever the source is
+// uploaded or reinterpreted, and also every Interval when one is set.
+type AlertRule struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Team         string    `json:"team"`
+	Owner        string    `json:"owner,omitempty"`
+	Source       string    `json:"source"`
+	Column       string    `json:"column"`
+	Operation    string    `json:"operation"`
+	Params       OpParams  `json:"params,omitempty"`
+	Comparator   string    `json:"comparator"`
+	Threshold    float64   `json:"threshold"`
+	Delivery     Delivery  `json:"delivery"`
+	Interval     string    `json:"interval,omitempty"` // "" checks on upload only
+	NextRun      time.Time `json:"next_run,omitempty"`
+	SnoozedUntil time.Time `json:"snoozed_until,omitempty"`
+	LastChecked  time.Time `json:"last_checked,omitempty"`
+	LastValue    string    `json:"last_value,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Condition reads like "Sum of Refunds > 50000".
+func (a AlertRule) Condition() string {
+	label := a.Operation
+	if op, ok := lookupOperation(a.Operation); ok {
+		label = op.Label
+		if p := describeParams(op, a.Params); p != "" {
+			label += " (" + p + ")"
+		}
+	}
+	return fmt.Sprintf("%s of %s %s %s", label, a.Column, a.Comparator, strconv.FormatFloat(a.Threshold, 'f', -1, 64))
+}
+
+func (a AlertRule) Snoozed(now time.Time) bool {
+	return now.Before(a.SnoozedUntil)
+}
+
+// AlertEvent records a rule that fired, was snoozed while firing, or could
+// not be evaluated or delivered.
+type AlertEvent struct {
+	Rule    string    `json:"rule"`
+	Name    string    `json:"name"`
+	Team    string    `json:"team"`
+	At      time.Time `json:"at"`
+	Trigger string    `json:"trigger"` // upload, reinterpret, schedule or manual
+	Dataset string    `json:"dataset,omitempty"`
+	Value   string    `json:"value,omitempty"`
+	Status  string    `json:"status"` // notified, snoozed or failed
+	Detail  string    `json:"detail"`
+}
+
+type AlertStore struct {
+	mu     sync.RWMutex
+	path   string
+	rules  map[string]AlertRule
+	events []AlertEvent // oldest first, capped at maxAlertEvents
+}
+
+type alertStoreFile struct {
+	Rules  []AlertRule  `json:"rules"`
+	Events []AlertEvent `json:"events"`
+}
+
+var alerts = newAlertStore(dataPath("alerts.json"))
+
+func newAlertStore(path string) *AlertStore {
+	s := &AlertStore{path: path, rules: make(map[string]AlertRule)}
+	s.load()
+	watchDataFile(path, s.load)
+	return s
+}
+
+// load reads the rules file, replacing what is in memory.
+func (s *AlertStore) load() {
+	var file alertStoreFile
+	if err := readJSONFile(s.path, &file); err != nil {
+		log.Printf("Could not load alert rules: %v", err)
+		return
+	}
+	rules := make(map[string]AlertRule)
+	for _, rule := range file.Rules {
+		rules[rule.ID] = rule
+	}
+	s.mu.Lock()
+	s.rules, s.events = rules, file.Events
+	s.mu.Unlock()
+}
+
+func (s *AlertStore) List(team string) []AlertRule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []AlertRule
+	for _, rule := range s.rules {
+		if rule.Team == team {
+			list = append(list, rule)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (s *AlertStore) Get(id string) (AlertRule, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rule, ok := s.rules[id]
+	return rule, ok
+}
+
+// ForSource returns the team's rules watching the named file.
+func (s *AlertStore) ForSource(team, source string) []AlertRule {
+	var list []AlertRule
+	for _, rule := range s.List(team) {
+		if rule.Source == source {
+			list = append(list, rule)
+		}
+	}
+	return list
+}
+
+func (s *AlertStore) Save(rule AlertRule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules[rule.ID] = rule
+	return s.flush()
+}
+
+func (s *AlertStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rules, id)
+	return s.flush()
+}
+
+// Checked stores the outcome of an evaluation on the rule, if it still
+// exists, and appends event to the history when there is one.
+func (s *AlertStore) Checked(id string, at time.Time, value string, event *AlertEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rule, ok := s.rules[id]; ok {
+		rule.LastChecked, rule.LastValue = at, value
+		s.rules[id] = rule
+	}
+	if event != nil {
+		s.events = append(s.events, *event)
+		if len(s.events) > maxAlertEvents {
+			s.events = s.events[len(s.events)-maxAlertEvents:]
+		}
+	}
+	return s.flush()
+}
+
+// Claim returns the scheduled rules due at now and moves their NextRun past
+// now, as ReportStore.Claim does for reports.
+func (s *AlertStore) Claim(now time.Time) []AlertRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []AlertRule
+	for id, rule := range s.rules {
+		every := scheduleIntervals[rule.Interval]
+		if every <= 0 || rule.NextRun.After(now) {
+			continue
+		}
+		due = append(due, rule)
+		for !rule.NextRun.After(now) {
+			rule.NextRun = rule.NextRun.Add(every)
+		}
+		s.rules[id] = rule
+	}
+	if len(due) > 0 {
+		if err := s.flush(); err != nil {
+			log.Printf("Could not save alert rules: %v", err)
+		}
+	}
+	return due
+}
+
+// Events returns the team's alert history, newest first. An empty rule ID
+// returns events of every rule.
+func (s *AlertStore) Events(team, rule string) []AlertEvent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []AlertEvent
+	for i := len(s.events) - 1; i >= 0; i-- {
+		event := s.events[i]
+		if event.Team == team && (rule == "" || event.Rule == rule) {
+			list = append(list, event)
+		}
+	}
+	return list
+}
+
+// flush must be called with the lock held.
+func (s *AlertStore) flush() error {
+	file := alertStoreFile{Rules: make([]AlertRule, 0, len(s.rules)), Events: s.events}
+	for _, rule := range s.rules {
+		file.Rules = append(file.Rules, rule)
+	}
+	sort.Slice(file.Rules, func(i, j int) bool { return file.Rules[i].ID < file.Rules[j].ID })
+	return writeJSONFile(s.path, file)
+}
+
+// evaluateAlert checks rule against data and notifies when it fires. It
+// returns the event recorded, or nil when the condition did not hold.
+func evaluateAlert(rule AlertRule, data Spreadsheet, trigger string) *AlertEvent {
+	now := time.Now()
+	event := &AlertEvent{Rule: rule.ID, Name: rule.Name, Team: rule.Team, At: now, Trigger: trigger, Dataset: data.ID, Status: "failed"}
+	value := ""
+	if col := columnIndex(data.Headers, rule.Column); col == -1 {
+		event.Detail = fmt.Sprintf("%s has no %q column", data.FileName, rule.Column)
+	} else if result, err := memoizedCalculation(data, col, rule.Operation, rule.Params); err != nil {
+		event.Detail = err.Error()
+	} else {
+		value = formatStat(result)
+		event.Value = value
+		if !compareValues(rule.Comparator, result, rule.Threshold) {
+			event = nil
+		} else if rule.Snoozed(now) {
+			event.Status = "snoozed"
+			event.Detail = "Not sent; snoozed until " + rule.SnoozedUntil.Format("2006-01-02 15:04")
+		} else if err := notifyAlert(rule, data, value); err != nil {
+			event.Detail = err.Error()
+		} else {
+			event.Status = "notified"
+			event.Detail = "Sent to " + rule.Delivery.String()
+		}
+	}
+	if err := alerts.Checked(rule.ID, now, value, event); err != nil {
+		log.Printf("Could not record alert: %v", err)
+	}
+	return event
+}
+
+func notifyAlert(rule AlertRule, data Spreadsheet, value string) error {
+	text := fmt.Sprintf("🚨 %s: %s (value %s) in %s uploaded %s",
+		rule.Name, rule.Condition(), value, data.FileName, data.UploadTime.Format("2006-01-02 15:04"))
+	if rule.Delivery.Kind == "email" {
+		return deliver(rule.Delivery, "Alert: "+rule.Name, "text/plain; charset=utf-8", []byte(text+"\n"))
+	}
+	// "text" makes the payload readable by Slack-style incoming webhooks.
+	body, err := json.Marshal(map[string]interface{}{
+		"text":      text,
+		"alert":     rule.Name,
+		"condition": rule.Condition(),
+		"value":     value,
+		"source":    data.FileName,
+		"dataset":   data.ID,
+	})
+	if err != nil {
+		return err
+	}
+	return deliver(rule.Delivery, rule.Name, "application/json", body)
+}
+
+// checkAlerts evaluates the rules watching data's source file. Derived
+// datasets are not watched.
+func checkAlerts(data Spreadsheet, trigger string) {
+	if data.ParentID != "" {
+		return
+	}
+	for _, rule := range alerts.ForSource(datasetTeam(data), data.FileName) {
+		evaluateAlert(rule, data, trigger)
+	}
+}
+
+// checkScheduledAlerts evaluates due rules against their latest upload.
+func checkScheduledAlerts(now time.Time) {
+	for _, rule := range alerts.Claim(now) {
+		data, ok := latestUpload(rule.Team, rule.Source)
+		if !ok {
+			continue
+		}
+		evaluateAlert(rule, data, "schedule")
+	}
+}
+
+func parseThreshold(s string) (float64, error) {
+	v, ok := parseFinite(strings.NewReplacer(",", "", "_", "", " ", "").Replace(s))
+	if !ok {
+		return 0, fmt.Errorf("threshold %q is not a number", s)
+	}
+	return v, nil
+}
+
+// alertRuleFromForm validates the new-alert form.
+func alertRuleFromForm(r *http.Request) (AlertRule, error) {
+	rule := AlertRule{
+		Name:       strings.TrimSpace(r.FormValue("name")),
+		Source:     strings.TrimSpace(r.FormValue("source")),
+		Column:     strings.TrimSpace(r.FormValue("column")),
+		Operation:  r.FormValue("operation"),
+		Comparator: r.FormValue("comparator"),
+		Interval:   r.FormValue("interval"),
+		Delivery:   Delivery{Kind: r.FormValue("delivery"), Target: strings.TrimSpace(r.FormValue("target"))},
+	}
+	if rule.Name == "" || rule.Source == "" || rule.Column == "" {
+		return rule, fmt.Errorf("name, source file and column are required")
+	}
+	op, ok := lookupOperation(rule.Operation)
+	if !ok {
+		return rule, fmt.Errorf("unsupported operation")
+	}
+	params, err := op.ResolveParams(parseKeyValueLines(r.FormValue("params")))
+	if err != nil {
+		return rule, fmt.Errorf("invalid parameters: %v", err)
+	}
+	rule.Params = params
+	valid := false
+	for _, c := range alertComparators {
+		valid = valid || c == rule.Comparator
+	}
+	if !valid {
+		return rule, fmt.Errorf("unsupported comparison %q", rule.Comparator)
+	}
+	if rule.Threshold, err = parseThreshold(r.FormValue("threshold")); err != nil {
+		return rule, err
+	}
+	if rule.Delivery.Kind != "webhook" && rule.Delivery.Kind != "email" {
+		return rule, fmt.Errorf("alerts are sent by webhook or email")
+	}
+	if err := rule.Delivery.validate(); err != nil {
+		return rule, err
+	}
+	rule.CreatedAt = time.Now()
+	if rule.Interval != "" {
+		every, ok := scheduleIntervals[rule.Interval]
+		if !ok {
+			return rule, fmt.Errorf("unsupported interval %q", rule.Interval)
+		}
+		rule.NextRun = rule.CreatedAt.Add(every)
+	}
+	return rule, nil
+}
+
+// alertsHandler lists the team's alert rules and creates, checks, snoozes
+// and deletes them.
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	team := currentTeam(r).ID
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		switch r.FormValue("action") {
+		case "create":
+			rule, err := alertRuleFromForm(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rule.ID, rule.Team, rule.Owner = newID(), team, ownerID(currentUser(r))
+			if err := alerts.Save(rule); err != nil {
+				http.Error(w, fmt.Sprintf("Could not save alert: %v", err), http.StatusInternalServerError)
+				return
+			}
+		case "check", "snooze", "unsnooze", "delete":
+			rule, ok := alerts.Get(r.FormValue("rule"))
+			if !ok || rule.Team != team {
+				http.Error(w, "Unknown alert", http.StatusNotFound)
+				return
+			}
+			var err error
+			switch r.FormValue("action") {
+			case "check":
+				data, ok := latestUpload(team, rule.Source)
+				if !ok {
+					http.Error(w, fmt.Sprintf("No upload of %s is available", rule.Source), http.StatusNotFound)
+					return
+				}
+				evaluateAlert(rule, data, "manual")
+			case "snooze":
+				d, ok := snoozeDurations[r.FormValue("for")]
+				if !ok {
+					http.Error(w, "Invalid snooze duration", http.StatusBadRequest)
+					return
+				}
+				rule.SnoozedUntil = time.Now().Add(d)
+				err = alerts.Save(rule)
+			case "unsnooze":
+				rule.SnoozedUntil = time.Time{}
+				err = alerts.Save(rule)
+			default:
+				err = alerts.Delete(rule.ID)
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Could not save alert: %v", err), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "Invalid action", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/alerts", http.StatusSeeOther)
+		return
+	}
+
+	now := time.Now()
+	section := ReportSection{Title: "Alert Rules", Headers: []string{"Name", "Source", "Condition", "Checked", "Last Value", "Notify", "Status"}}
+	var options []FormOption
+	for _, rule := range alerts.List(team) {
+		checked := "on upload"
+		if rule.Interval != "" {
+			checked += ", " + rule.Interval
+		}
+		status := "active"
+		if rule.Snoozed(now) {
+			status = "snoozed until " + rule.SnoozedUntil.Format("2006-01-02 15:04")
+		}
+		last := rule.LastValue
+		if !rule.LastChecked.IsZero() {
+			last += " at " + rule.LastChecked.Format("2006-01-02 15:04")
+		}
+		section.Rows = append(section.Rows, []string{rule.Name, rule.Source, rule.Condition(), checked, last, rule.Delivery.String(), status})
+		section.Links = append(section.Links, ReportLink{Label: "🕘 " + rule.Name + " history", URL: "/alerts/history?rule=" + rule.ID})
+		options = append(options, FormOption{Value: rule.ID, Label: rule.Name})
+	}
+	if len(section.Rows) == 0 {
+		section.Notes = []string{"No alerts are defined yet."}
+	}
+	section.Links = append(section.Links, ReportLink{Label: "📜 All alerts", URL: "/alerts/history"})
+	sections := []ReportSection{section}
+	if currentUser(r).HasRole(RoleEditor) {
+		var opOptions []FormOption
+		for _, op := range operations {
+			opOptions = append(opOptions, FormOption{Value: op.Name, Label: op.Icon + " " + op.Label})
+		}
+		var cmpOptions []FormOption
+		for _, c := range alertComparators {
+			cmpOptions = append(cmpOptions, FormOption{Value: c, Label: c})
+		}
+		sections = append(sections, ReportSection{Title: "New Alert", Notes: []string{"Rules are checked each time the source file is uploaded in this workspace, and on the chosen schedule."}, Form: &ReportForm{Action: "/alerts", Submit: "➕ Create", Fields: []FormField{
+			{Name: "action", Type: "hidden", Value: "create"},
+			{Name: "name", Label: "Name", Placeholder: "e.g. Refunds spike"},
+			{Name: "source", Label: "Source file", Placeholder: "e.g. refunds.csv"},
+			{Name: "operation", Label: "Operation", Type: "select", Options: opOptions},
+			{Name: "column", Label: "Column", Placeholder: "e.g. Refunds"},
+			{Name: "params", Label: "Parameters", Type: "textarea", Placeholder: "one per line, e.g. p=95"},
+			{Name: "comparator", Label: "Fires when", Type: "select", Options: cmpOptions},
+			{Name: "threshold", Label: "Threshold", Placeholder: "e.g. 50,000"},
+			{Name: "interval", Label: "Also check", Type: "select", Options: []FormOption{
+				{Value: "", Label: "Only on upload"}, {Value: "hourly", Label: "Every hour"}, {Value: "daily", Label: "Every day"}, {Value: "weekly", Label: "Every week"},
+			}},
+			{Name: "delivery", Label: "Notify by", Type: "select", Options: []FormOption{
+				{Value: "webhook", Label: "🪝 Webhook"}, {Value: "email", Label: "📧 Email"},
+			}},
+			{Name: "target", Label: "Notify", Placeholder: "webhook URL or email address"},
+		}}})
+		if len(options) > 0 {
+			sections = append(sections, ReportSection{Title: "Manage", Notes: []string{"A snoozed alert is still checked and logged, but sends nothing."}, Form: &ReportForm{Action: "/alerts", Submit: "Apply", Fields: []FormField{
+				{Name: "rule", Label: "Alert", Type: "select", Options: options},
+				{Name: "action", Label: "Action", Type: "select", Options: []FormOption{
+					{Value: "check", Label: "🔍 Check now"},
+					{Value: "snooze", Label: "😴 Snooze"},
+					{Value: "unsnooze", Label: "🔔 Unsnooze"},
+					{Value: "delete", Label: "🗑️ Delete"},
+				}},
+				{Name: "for", Label: "Snooze for", Type: "select", Options: []FormOption{
+					{Value: "1h", Label: "1 hour"}, {Value: "1d", Label: "1 day"}, {Value: "1w", Label: "1 week"},
+				}},
+			}}})
+		}
+	}
+	renderReport(w, ReportPage{Title: "Alerts", Subtitle: currentTeam(r).Name, Sections: sections})
+}
+
+// alertHistoryHandler shows the team's alert events, optionally for one rule.
+func alertHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	team := currentTeam(r).ID
+	id := r.URL.Query().Get("rule")
+	title := "All Alerts"
+	if id != "" {
+		rule, ok := alerts.Get(id)
+		if !ok || rule.Team != team {
+			http.Error(w, "Unknown alert", http.StatusNotFound)
+			return
+		}
+		title = rule.Name + ": " + rule.Condition()
+	}
+	section := ReportSection{Title: "Events", Headers: []string{"When", "Alert", "Trigger", "Value", "Status", "Detail"}}
+	for _, event := range alerts.Events(team, id) {
+		status := map[string]string{"notified": "🚨 notified", "snoozed": "😴 snoozed"}[event.Status]
+		if status == "" {
+			status = "❌ failed"
+		}
+		section.Rows = append(section.Rows, []string{event.At.Format("2006-01-02 15:04:05"), event.Name, event.Trigger, event.Value, status, event.Detail})
+	}
+	if len(section.Rows) == 0 {
+		section.Notes = []string{"No alerts have fired yet."}
+	}
+	section.Links = []ReportLink{{Label: "⬅️ Alerts", URL: "/alerts"}}
+	renderReport(w, ReportPage{Title: "Alert History", Subtitle: title, Sections: []ReportSection{section}})
+}
@@ -0,0 +1,189 @@
+// aliases.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// canonicalHeader returns the template column h stands for: the alias map
+// key when h is one of its aliases, otherwise h itself. Comparison ignores
+// case and surrounding space like the rest of template matching.
+func (t MappingTemplate) canonicalHeader(h string) (string, bool) {
+	key := headerKey(h)
+	for canonical, aliases := range t.Aliases {
+		for _, a := range aliases {
+			if headerKey(a) == key {
+				return canonical, true
+			}
+		}
+	}
+	return h, false
+}
+
+// applyAliases renames aliased headers to the template's names so the rest
+// of the template (renames, types, date formats) can refer to one name.
+func applyAliases(data *Spreadsheet, t MappingTemplate) {
+	for i, h := range data.Headers {
+		canonical, ok := t.canonicalHeader(h)
+		if !ok || columnIndex(data.Headers, canonical) != -1 {
+			continue
+		}
+		data.Lineage = renameLineage(data.Lineage, h, canonical)
+		data.Headers[i] = canonical
+		data.Notes = append(data.Notes, fmt.Sprintf("Matched %q to template column %q", h, canonical))
+	}
+}
+
+func parseAliasLines(text string) map[string][]string {
+	out := make(map[string][]string)
+	for canonical, list := range parseKeyValueLines(text) {
+		if aliases := splitList(list); len(aliases) > 0 {
+			out[canonical] = aliases
+		}
+	}
+	return out
+}
+
+func formatAliasLines(m map[string][]string) string {
+	flat := make(map[string]string, len(m))
+	for canonical, aliases := range m {
+		flat[canonical] = strings.Join(aliases, ", ")
+	}
+	return formatKeyValueLines(flat)
+}
+
+type AliasResolution struct {
+	Column string `json:"column"`
+	Header string `json:"header"`
+	Via    string `json:"via"` // exact or alias
+}
+
+// AliasReport is the result of trying a template's columns against a set of
+// incoming headers without importing anything.
+type AliasReport struct {
+	Template   string            `json:"template"`
+	Matches    bool              `json:"matches_layout"`
+	Resolved   []AliasResolution `json:"resolved"`
+	Unresolved []string          `json:"unresolved"` // template columns needing manual mapping
+	Unmapped   []string          `json:"unmapped"`   // incoming headers the template doesn't know
+}
+
+// dryRunAliases reports which template columns the headers satisfy, either
+// directly or through an alias, and which need mapping by hand.
+func dryRunAliases(t MappingTemplate, headers []string) AliasReport {
+	report := AliasReport{Template: t.Name, Matches: t.Matches(Spreadsheet{Headers: headers}), Resolved: []AliasResolution{}, Unresolved: []string{}, Unmapped: []string{}}
+	columns := append([]string(nil), t.MatchHeaders...)
+	var extra []string
+	for canonical := range t.Aliases {
+		if !containsHeader(columns, canonical) {
+			extra = append(extra, canonical)
+		}
+	}
+	sort.Strings(extra)
+	columns = append(columns, extra...)
+
+	used := make(map[int]bool)
+	for _, col := range columns {
+		found := false
+		for i, h := range headers {
+			if !used[i] && headerKey(h) == headerKey(col) {
+				report.Resolved = append(report.Resolved, AliasResolution{Column: col, Header: h, Via: "exact"})
+				used[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			for i, h := range headers {
+				if canonical, ok := t.canonicalHeader(h); ok && !used[i] && headerKey(canonical) == headerKey(col) {
+					report.Resolved = append(report.Resolved, AliasResolution{Column: col, Header: h, Via: "alias"})
+					used[i], found = true, true
+					break
+				}
+			}
+		}
+		if !found {
+			report.Unresolved = append(report.Unresolved, col)
+		}
+	}
+	for i, h := range headers {
+		if !used[i] {
+			report.Unmapped = append(report.Unmapped, h)
+		}
+	}
+	return report
+}
+
+func containsHeader(headers []string, name string) bool {
+	for _, h := range headers {
+		if headerKey(h) == headerKey(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// mappingDryRunAPIHandler tries a template against the headers in the body,
+// or against a stored dataset's headers.
+func mappingDryRunAPIHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := mappings.Get(currentTeam(r).ID, r.PathValue("name"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Unknown template")
+		return
+	}
+	var in struct {
+		Headers []string `json:"headers"`
+		Dataset string   `json:"dataset"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if in.Dataset != "" {
+		data, ok := teamDataset(r, in.Dataset)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "Unknown dataset")
+			return
+		}
+		in.Headers = data.Headers
+	}
+	if len(in.Headers) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "headers or dataset is required")
+		return
+	}
+	writeAPIData(w, r, dryRunAliases(t, in.Headers))
+}
+
+func renderDryRun(w http.ResponseWriter, report AliasReport) {
+	resolved := ReportSection{Title: "Resolved Columns", Headers: []string{"Template Column", "Incoming Header", "Matched By"}}
+	for _, res := range report.Resolved {
+		resolved.Rows = append(resolved.Rows, []string{res.Column, res.Header, res.Via})
+	}
+	layout := "✅ The headers match the template layout, so it will be applied automatically."
+	if !report.Matches {
+		layout = "⚠️ The headers don't match the template layout; choose the template on upload to apply it."
+	}
+	resolved.Notes = []string{layout}
+	resolved.Links = []ReportLink{{Label: "⬅️ Back to templates", URL: "/mappings"}}
+	manual := ReportSection{Title: "Needs Manual Mapping", Headers: []string{"Template Column"}}
+	for _, col := range report.Unresolved {
+		manual.Rows = append(manual.Rows, []string{col})
+	}
+	if len(report.Unresolved) == 0 {
+		manual.Notes = []string{"Every template column was found."}
+	}
+	unmapped := ReportSection{Title: "Headers Not In Template", Headers: []string{"Incoming Header"}}
+	for _, h := range report.Unmapped {
+		unmapped.Rows = append(unmapped.Rows, []string{h})
+	}
+	renderReport(w, ReportPage{
+		Title:    "Template Dry Run",
+		Subtitle: report.Template,
+		Sections: []ReportSection{resolved, manual, unmapped},
+	})
+}
@@ -0,0 +1,389 @@
+// analyze.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type DerivedColumn struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+}
+
+type AnalyzeMetric struct {
+	Column    string                     `json:"column"`
+	Operation string                     `json:"operation"`
+	Params    map[string]json.RawMessage `json:"params,omitempty"`
+	As        string                     `json:"as,omitempty"`
+}
+
+// AnalyzeSpec describes a full analysis: derived columns are added first,
+// then filters narrow the rows, then metrics are computed per group.
+type AnalyzeSpec struct {
+	Dataset string          `json:"dataset,omitempty"`
+	Derived []DerivedColumn `json:"derived,omitempty"`
+	Filters []string        `json:"filters,omitempty"`
+	GroupBy []string        `json:"group_by,omitempty"`
+	Metrics []AnalyzeMetric `json:"metrics"`
+	Match   string          `json:"match,omitempty"`  // exact (default) or loose column matching
+	Strict  bool            `json:"strict,omitempty"` // fail instead of skipping values that aren't numbers
+	Format  string          `json:"format,omitempty"` // json (default) or csv
+}
+
+type AnalyzeGroup struct {
+	Key    map[string]string   `json:"key,omitempty"`
+	Rows   int                 `json:"rows"`
+	Values map[string]*float64 `json:"values"`
+	Errors map[string]string   `json:"errors,omitempty"`
+
+	Diagnostics map[string]ColumnDiagnostics `json:"diagnostics,omitempty"`
+}
+
+type AnalyzeResult struct {
+	Dataset     string          `json:"dataset"`
+	FileName    string          `json:"file_name"`
+	RowsIn      int             `json:"rows_in"`
+	RowsMatched int             `json:"rows_matched"`
+	GroupBy     []string        `json:"group_by,omitempty"`
+	Metrics     []string        `json:"metrics"`
+	Groups      []AnalyzeGroup  `json:"groups"`
+	Lineage     []ColumnLineage `json:"lineage,omitempty"`
+	Matched     []ColumnMatch   `json:"matched_columns,omitempty"`
+
+	// Incomplete says the time budget ran out; groups after the last one
+	// calculated have no values and say so in Errors.
+	Incomplete bool   `json:"incomplete,omitempty"`
+	Budget     string `json:"budget,omitempty"`
+}
+
+type RowGroup struct {
+	Key  []string
+	Rows [][]string
+}
+
+// addDerivedColumns appends one column per definition. Later definitions may
+// refer to earlier ones.
+func addDerivedColumns(data Spreadsheet, derived []DerivedColumn) (Spreadsheet, error) {
+	if len(derived) == 0 {
+		return data, nil
+	}
+	headers := append([]string(nil), data.Headers...)
+	lineage := data.Lineage
+	rows := make([][]string, len(data.Rows))
+	for i, row := range data.Rows {
+		rows[i] = make([]string, len(headers), len(headers)+len(derived))
+		copy(rows[i], row)
+	}
+	for _, d := range derived {
+		name := strings.TrimSpace(d.Name)
+		if name == "" {
+			return data, fmt.Errorf("derived column needs a name")
+		}
+		if columnIndex(headers, name) != -1 {
+			return data, fmt.Errorf("derived column %q already exists", name)
+		}
+		expr, err := compileExpr(d.Expr, headers)
+		if err != nil {
+			return data, fmt.Errorf("derived column %q: %v", name, err)
+		}
+		for i, row := range rows {
+			rows[i] = append(row, valueString(expr.Eval(row)))
+		}
+		headers = append(headers, name)
+		lineage = withLineage(lineage, ColumnLineage{Column: name, Sources: expr.Columns, Operation: "derived", Detail: expr.Source})
+	}
+	out := data
+	out.Headers = headers
+	out.Rows = rows
+	out.Lineage = lineage
+	out.NumericCols = detectNumericColumns(out)
+	return out, nil
+}
+
+// filterRows keeps the rows that satisfy every filter expression.
+func filterRows(data Spreadsheet, filters []string) (Spreadsheet, error) {
+	var exprs []*Expr
+	for _, f := range filters {
+		if strings.TrimSpace(f) == "" {
+			continue
+		}
+		expr, err := compileExpr(f, data.Headers)
+		if err != nil {
+			return data, fmt.Errorf("filter %q: %v", f, err)
+		}
+		exprs = append(exprs, expr)
+	}
+	if len(exprs) == 0 {
+		return data, nil
+	}
+	out := data
+	out.Rows = nil
+	for _, row := range data.Rows {
+		keep := true
+		for _, expr := range exprs {
+			if !expr.Match(row) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			out.Rows = append(out.Rows, row)
+		}
+	}
+	return out, nil
+}
+
+// groupRows buckets rows by the values in keyCols, in first-seen order. With
+// no key columns every row lands in a single group.
+func groupRows(rows [][]string, keyCols []int) []RowGroup {
+	index := make(map[string]int)
+	var groups []RowGroup
+	for _, row := range rows {
+		key := make([]string, len(keyCols))
+		for k, col := range keyCols {
+			key[k] = cellValue(row, col)
+		}
+		joined := strings.Join(key, "\x1f")
+		idx, ok := index[joined]
+		if !ok {
+			idx = len(groups)
+			index[joined] = idx
+			groups = append(groups, RowGroup{Key: key})
+		}
+		groups[idx].Rows = append(groups[idx].Rows, row)
+	}
+	if len(groups) == 0 && len(keyCols) == 0 {
+		groups = append(groups, RowGroup{})
+	}
+	return groups
+}
+
+type resolvedMetric struct {
+	name   string
+	col    int
+	op     Operation
+	params OpParams
+}
+
+func runAnalysis(data Spreadsheet, spec AnalyzeSpec, budget calcBudget) (AnalyzeResult, error) {
+	result := AnalyzeResult{Dataset: data.ID, FileName: data.FileName, RowsIn: len(data.Rows)}
+	if len(spec.Metrics) == 0 {
+		return result, fmt.Errorf("at least one metric is required")
+	}
+	loose, err := parseMatchMode(spec.Match)
+	if err != nil {
+		return result, err
+	}
+	// resolve records loose matches once each so callers can check them
+	resolve := func(data Spreadsheet, ref string) (int, error) {
+		col, m, err := matchColumn(data, ref, loose)
+		if err == nil && m.Loose() && !slices.Contains(result.Matched, m) {
+			result.Matched = append(result.Matched, m)
+		}
+		return col, err
+	}
+
+	data, err = addDerivedColumns(data, spec.Derived)
+	if err != nil {
+		return result, err
+	}
+	data, err = filterRows(data, spec.Filters)
+	if err != nil {
+		return result, err
+	}
+	result.RowsMatched = len(data.Rows)
+
+	var keyCols []int
+	for _, ref := range spec.GroupBy {
+		col, err := resolve(data, ref)
+		if err != nil {
+			return result, fmt.Errorf("group_by: %v", err)
+		}
+		keyCols = append(keyCols, col)
+		result.GroupBy = append(result.GroupBy, data.Headers[col])
+	}
+
+	var metrics []resolvedMetric
+	seen := make(map[string]bool)
+	for _, m := range spec.Metrics {
+		col, err := resolve(data, m.Column)
+		if err != nil {
+			return result, err
+		}
+		column := data.Headers[col]
+		op, ok := lookupOperation(m.Operation)
+		if !ok {
+			return result, fmt.Errorf("unsupported operation %q", m.Operation)
+		}
+		raw, err := jsonParams(m.Params)
+		if err != nil {
+			return result, fmt.Errorf("%s: %v", m.Operation, err)
+		}
+		params, err := op.ResolveParams(raw)
+		if err != nil {
+			return result, fmt.Errorf("%s: %v", m.Operation, err)
+		}
+		name := m.As
+		if name == "" {
+			name = op.Name + "(" + column + ")"
+			if desc := describeParams(op, params); desc != "" {
+				name = op.Name + "(" + column + ", " + desc + ")"
+			}
+		}
+		if seen[name] {
+			return result, fmt.Errorf("duplicate metric name %q; set \"as\" to tell them apart", name)
+		}
+		seen[name] = true
+		metrics = append(metrics, resolvedMetric{name: name, col: col, op: op, params: params})
+		result.Metrics = append(result.Metrics, name)
+	}
+
+	if spec.Strict {
+		for _, m := range metrics {
+			if err := diagnoseColumn(data, m.col, parsesFloat).strictError(data.Headers[m.col]); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	result.Lineage = analysisLineage(data, spec, keyCols, metrics)
+
+	for _, g := range groupRows(data.Rows, keyCols) {
+		group := AnalyzeGroup{Rows: len(g.Rows), Values: make(map[string]*float64), Diagnostics: make(map[string]ColumnDiagnostics)}
+		if len(keyCols) > 0 {
+			group.Key = make(map[string]string, len(keyCols))
+			for k, name := range result.GroupBy {
+				group.Key[name] = g.Key[k]
+			}
+		}
+		if result.Incomplete || budget.Spent() {
+			result.Incomplete, result.Budget = true, budget.String()
+			group.Errors = make(map[string]string)
+			for _, m := range metrics {
+				group.Values[m.name] = nil
+				group.Errors[m.name] = "not calculated: the " + budget.String() + " ran out"
+			}
+			result.Groups = append(result.Groups, group)
+			continue
+		}
+		subset := Spreadsheet{Headers: data.Headers, Rows: g.Rows}
+		for _, m := range metrics {
+			group.Diagnostics[m.name] = diagnoseColumn(subset, m.col, parsesFloat)
+			value, err := performCalculation(subset, m.col, m.op.Name, m.params)
+			if err != nil {
+				if group.Errors == nil {
+					group.Errors = make(map[string]string)
+				}
+				group.Errors[m.name] = err.Error()
+				group.Values[m.name] = nil
+				continue
+			}
+			group.Values[m.name] = finitePtr(value)
+		}
+		result.Groups = append(result.Groups, group)
+	}
+	return result, nil
+}
+
+// analysisLineage describes each output column, followed by the derived
+// columns the metrics were computed from so the chain back to the source
+// file is complete.
+func analysisLineage(data Spreadsheet, spec AnalyzeSpec, keyCols []int, metrics []resolvedMetric) []ColumnLineage {
+	known := lineageFor(data)
+	var filtered string
+	if len(spec.Filters) > 0 {
+		filtered = "rows where " + strings.Join(spec.Filters, " and ")
+	}
+	var out []ColumnLineage
+	for _, col := range keyCols {
+		out = append(out, known[col])
+	}
+	out = append(out, ColumnLineage{Column: "rows", Operation: "count", Detail: filtered})
+	var upstream []ColumnLineage
+	for _, m := range metrics {
+		detail := describeParams(m.op, m.params)
+		if filtered != "" {
+			detail = strings.TrimPrefix(detail+"; "+filtered, "; ")
+		}
+		out = append(out, ColumnLineage{Column: m.name, Sources: []string{data.Headers[m.col]}, Operation: m.op.Name, Detail: detail})
+		if l := known[m.col]; l.Operation != "source" {
+			upstream = withLineage(upstream, l)
+		}
+	}
+	return append(out, upstream...)
+}
+
+// Table flattens the result to one row per group for CSV output.
+func (res AnalyzeResult) Table() ([]string, [][]string) {
+	headers := append(append([]string(nil), res.GroupBy...), "rows")
+	headers = append(headers, res.Metrics...)
+	var rows [][]string
+	for _, g := range res.Groups {
+		var row []string
+		for _, name := range res.GroupBy {
+			row = append(row, g.Key[name])
+		}
+		row = append(row, strconv.Itoa(g.Rows))
+		for _, name := range res.Metrics {
+			if v := g.Values[name]; v != nil {
+				row = append(row, strconv.FormatFloat(*v, 'f', -1, 64))
+			} else {
+				row = append(row, "")
+			}
+		}
+		rows = append(rows, row)
+	}
+	return headers, rows
+}
+
+func analyzeAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var spec AnalyzeSpec
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid spec: %v", err))
+		return
+	}
+
+	data := activeDataset(r)
+	if spec.Dataset != "" {
+		var ok bool
+		if data, ok = teamDataset(r, spec.Dataset); !ok {
+			writeAPIError(w, http.StatusNotFound, "Unknown dataset")
+			return
+		}
+	}
+	if len(data.Headers) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "No dataset loaded")
+		return
+	}
+
+	result, err := runAnalysis(data, spec, newCalcBudget(r.Context()))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch spec.Format {
+	case "":
+		writeAPIData(w, r, result)
+	case "json":
+		w.Header().Set("Content-Type", mimeJSON)
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Data: result})
+	case "csv":
+		headers, rows := result.Table()
+		w.Header().Set("Content-Type", "text/csv")
+		writeCSV(w, headers, rows)
+	default:
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported format %q", spec.Format))
+	}
+}
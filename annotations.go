@@ -0,0 +1,152 @@
+// annotations.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Annotations are user notes kept with a dataset, one for the dataset as a
+// whole and one per column keyed by header name.
+type Annotations struct {
+	Dataset string            `json:"dataset,omitempty"`
+	Columns map[string]string `json:"columns,omitempty"`
+}
+
+const maxAnnotationLength = 2000
+
+// With returns a copy of a with the note for column set (or cleared when
+// note is empty). An empty column names the dataset note.
+func (a Annotations) With(column, note string) Annotations {
+	note = strings.TrimSpace(note)
+	if column == "" {
+		a.Dataset = note
+		return a
+	}
+	cols := make(map[string]string, len(a.Columns)+1)
+	for k, v := range a.Columns {
+		cols[k] = v
+	}
+	if note == "" {
+		delete(cols, column)
+	} else {
+		cols[column] = note
+	}
+	a.Columns = cols
+	if len(cols) == 0 {
+		a.Columns = nil
+	}
+	return a
+}
+
+// checkAnnotation validates a note and resolves its column reference (an ID
+// or a header name) to the header name annotations are keyed by.
+func checkAnnotation(data Spreadsheet, ref, note string) (string, error) {
+	if len(note) > maxAnnotationLength {
+		return "", fmt.Errorf("notes are limited to %d characters", maxAnnotationLength)
+	}
+	if ref == "" {
+		return "", nil
+	}
+	col := columnRef(data, ref)
+	if col == -1 {
+		return "", fmt.Errorf("unknown column %q", ref)
+	}
+	return data.Headers[col], nil
+}
+
+// annotateDataset stores annotations on a dataset and keeps the active
+// dataset in step.
+func annotateDataset(data Spreadsheet, a Annotations) (Spreadsheet, error) {
+	data.Annotations = a
+	if err := workspace.Update(&data); err != nil {
+		return Spreadsheet{}, err
+	}
+	return data, nil
+}
+
+func annotationsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := teamDataset(r, r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Unknown dataset")
+		return
+	}
+	writeAPIData(w, r, data.Annotations)
+}
+
+// putAnnotationsAPIHandler replaces all of a dataset's annotations. Empty
+// notes are dropped.
+func putAnnotationsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := teamDataset(r, r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Unknown dataset")
+		return
+	}
+	if err := checkVersion(r, data); err != nil {
+		writeAPIError(w, updateErrorStatus(w, err), err.Error())
+		return
+	}
+	var in Annotations
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid annotations: %v", err))
+		return
+	}
+	if _, err := checkAnnotation(data, "", in.Dataset); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	a := Annotations{}.With("", in.Dataset)
+	for ref, note := range in.Columns {
+		column, err := checkAnnotation(data, ref, note)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		a = a.With(column, note)
+	}
+	data, err := annotateDataset(data, a)
+	if err != nil {
+		writeAPIError(w, updateErrorStatus(w, err), err.Error())
+		return
+	}
+	w.Header().Set("ETag", strconv.Quote(strconv.Itoa(data.Version)))
+	writeAPIData(w, r, data.Annotations)
+}
+
+// annotateHandler sets a single note from the display page.
+func annotateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	data, ok := teamDataset(r, r.FormValue("dataset"))
+	if !ok {
+		http.Error(w, "Unknown dataset", http.StatusNotFound)
+		return
+	}
+	if err := checkVersion(r, data); err != nil {
+		http.Error(w, err.Error(), updateErrorStatus(w, err))
+		return
+	}
+	note := r.FormValue("note")
+	column, err := checkAnnotation(data, r.FormValue("column"), note)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err = annotateDataset(data, data.Annotations.With(column, note))
+	if err != nil {
+		http.Error(w, err.Error(), updateErrorStatus(w, err))
+		return
+	}
+	renderDisplay(w, r, data)
+}
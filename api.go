@@ -3,10 +3,15 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const appVersion = "1.0.0"
+
 func validateFileHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method != http.MethodPost {
@@ -21,6 +26,97 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status":    "healthy",
 		"timestamp": time.Now().Format(time.RFC3339),
-		"version":   "1.0.0",
+		"version":   appVersion,
 	})
-}
\ No newline at end of file
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(APIResponse{Success: false, Error: msg})
+}
+
+// tabular is implemented by API payloads that can also be served as CSV.
+type tabular interface {
+	Table() ([]string, [][]string)
+}
+
+const (
+	mimeJSON    = "application/json"
+	mimeCSV     = "text/csv"
+	mimeMsgpack = "application/msgpack"
+)
+
+// negotiate picks the response type from the Accept header, honouring
+// q-values. An absent header or */* gets JSON; "" means nothing acceptable.
+func negotiate(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return mimeJSON
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		media := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, f := range fields[1:] {
+			if k, v, ok := strings.Cut(strings.TrimSpace(f), "="); ok && strings.TrimSpace(k) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		var mime string
+		switch media {
+		case "application/json", "application/*", "*/*":
+			mime = mimeJSON
+		case "text/csv", "text/*":
+			mime = mimeCSV
+		case "application/msgpack", "application/x-msgpack", "application/vnd.msgpack":
+			mime = mimeMsgpack
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = mime, q
+		}
+	}
+	return best
+}
+
+func tableOf(data interface{}) ([]string, [][]string, bool) {
+	if page, ok := data.(Page); ok {
+		data = page.Items
+	}
+	if t, ok := data.(tabular); ok {
+		headers, rows := t.Table()
+		return headers, rows, true
+	}
+	return nil, nil, false
+}
+
+// writeAPIData sends data in the format the client asked for. CSV is only
+// offered for tabular payloads.
+func writeAPIData(w http.ResponseWriter, r *http.Request, data interface{}) {
+	w.Header().Add("Vary", "Accept")
+	switch negotiate(r) {
+	case mimeJSON:
+		w.Header().Set("Content-Type", mimeJSON)
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Data: data})
+	case mimeMsgpack:
+		w.Header().Set("Content-Type", mimeMsgpack)
+		if err := writeMsgpack(w, APIResponse{Success: true, Data: data}); err != nil {
+			log.Printf("msgpack encode failed: %v", err)
+		}
+	case mimeCSV:
+		headers, rows, ok := tableOf(data)
+		if !ok {
+			writeAPIError(w, http.StatusNotAcceptable, "This resource is not available as CSV")
+			return
+		}
+		w.Header().Set("Content-Type", mimeCSV)
+		writeCSV(w, headers, rows)
+	default:
+		writeAPIError(w, http.StatusNotAcceptable, "Supported types: application/json, text/csv, application/msgpack")
+	}
+}
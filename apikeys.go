@@ -0,0 +1,201 @@
+// apikeys.go
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKey lets machine clients call the API without a browser session. Only
+// a hash of the secret is stored; the key itself is shown once on creation.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Prefix    string    `json:"prefix"`
+	Hash      string    `json:"hash"`
+	Role      string    `json:"role"`
+	Owner     string    `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type APIKeyStore struct {
+	mu   sync.RWMutex
+	path string
+	keys map[string]APIKey
+}
+
+var apiKeys = newAPIKeyStore(dataPath("api_keys.json"))
+
+func newAPIKeyStore(path string) *APIKeyStore {
+	s := &APIKeyStore{path: path, keys: make(map[string]APIKey)}
+	s.load()
+	watchDataFile(path, s.load)
+	return s
+}
+
+// load reads the keys file, replacing what is in memory.
+func (s *APIKeyStore) load() {
+	var list []APIKey
+	if err := readJSONFile(s.path, &list); err != nil {
+		log.Printf("Could not load API keys: %v", err)
+		return
+	}
+	keys := make(map[string]APIKey)
+	for _, k := range list {
+		keys[k.ID] = k
+	}
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create issues a new key and returns the secret, which is not stored.
+func (s *APIKeyStore) Create(name, role, owner string) (APIKey, string, error) {
+	secret := "drk_" + newID() + newID()
+	k := APIKey{
+		ID:        newID(),
+		Name:      name,
+		Prefix:    secret[:8],
+		Hash:      hashAPIKey(secret),
+		Role:      role,
+		Owner:     owner,
+		CreatedAt: time.Now(),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.ID] = k
+	return k, secret, s.flush()
+}
+
+func (s *APIKeyStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, id)
+	return s.flush()
+}
+
+func (s *APIKeyStore) List() []APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Authenticate returns the user a key acts as, or nil for unknown keys.
+func (s *APIKeyStore) Authenticate(secret string) *User {
+	hash := []byte(hashAPIKey(secret))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare(hash, []byte(k.Hash)) == 1 {
+			return &User{ID: "apikey:" + k.ID, Email: k.Owner, Name: k.Name, Role: k.Role, Via: "apikey"}
+		}
+	}
+	return nil
+}
+
+// flush must be called with the lock held.
+func (s *APIKeyStore) flush() error {
+	list := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return writeJSONFile(s.path, list)
+}
+
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+func apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	var created string
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		if id := r.FormValue("revoke"); id != "" {
+			if err := apiKeys.Revoke(id); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to revoke key: %v", err), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+			return
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		role := r.FormValue("role")
+		if name == "" || !validRole(role) {
+			http.Error(w, "A name and a valid role are required", http.StatusBadRequest)
+			return
+		}
+		_, secret, err := apiKeys.Create(name, role, ownerID(currentUser(r)))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to save key: %v", err), http.StatusInternalServerError)
+			return
+		}
+		created = secret
+	}
+
+	list := ReportSection{
+		Title:   "API Keys",
+		Headers: []string{"Name", "Prefix", "Role", "Owner", "Created", "ID"},
+		Notes:   []string{"Send keys as \"Authorization: Bearer <key>\" or \"X-API-Key: <key>\"."},
+	}
+	for _, k := range apiKeys.List() {
+		list.Rows = append(list.Rows, []string{k.Name, k.Prefix + "…", k.Role, k.Owner, k.CreatedAt.Format("2006-01-02 15:04"), k.ID})
+	}
+	if created != "" {
+		list.Notes = append(list.Notes, "🔑 New key (copy it now, it will not be shown again): "+created)
+	}
+	var roles []FormOption
+	for _, role := range []string{RoleViewer, RoleEditor, RoleAdmin} {
+		roles = append(roles, FormOption{Value: role, Label: role, Selected: role == RoleViewer})
+	}
+	sections := []ReportSection{
+		list,
+		{
+			Title: "Create Key",
+			Form: &ReportForm{
+				Action: "/admin/api-keys",
+				Submit: "🔑 Create Key",
+				Fields: []FormField{
+					{Name: "name", Label: "Name", Placeholder: "nightly-import"},
+					{Name: "role", Label: "Role", Type: "select", Options: roles},
+				},
+			},
+		},
+		{
+			Title: "Revoke Key",
+			Form: &ReportForm{
+				Action: "/admin/api-keys",
+				Submit: "🗑️ Revoke",
+				Fields: []FormField{{Name: "revoke", Label: "Key ID"}},
+			},
+		},
+	}
+	renderReport(w, ReportPage{Title: "API Keys", Subtitle: "Machine access to the API", Sections: sections})
+}
@@ -0,0 +1,176 @@
+// append.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Appending is the upload mode for rolling datasets such as daily extracts:
+// instead of becoming a dataset of its own, the file's rows are added to the
+// end of an existing upload. Its headers must name the same columns, in any
+// order and matched loosely, and each row is tagged with the file it came
+// from in a column added by the first append.
+
+// sourceFileColumn is the column that tags appended rows with their file.
+const sourceFileColumn = "Source File"
+
+// sourceColumn returns the column tagging data's rows with the file they
+// were appended from, found by its lineage so a renamed one still counts,
+// or -1 when data wasn't appended to.
+func sourceColumn(data Spreadsheet) int {
+	for col, l := range lineageFor(data) {
+		if l.Operation == "append" {
+			return col
+		}
+	}
+	return -1
+}
+
+// matchAppendColumns returns, for each of data's columns, the incoming
+// column holding its values, or -1 for the source file column when the
+// incoming file doesn't have one. Columns missing on either side are an
+// error naming them all.
+func matchAppendColumns(data, incoming Spreadsheet) ([]int, error) {
+	match := make([]int, len(data.Headers))
+	for i := range match {
+		match[i] = -1
+	}
+	used := make([]bool, len(incoming.Headers))
+	pass := func(same func(a, b string) bool) {
+		for col, header := range data.Headers {
+			if match[col] != -1 {
+				continue
+			}
+			for in, name := range incoming.Headers {
+				if !used[in] && same(header, name) {
+					match[col], used[in] = in, true
+					break
+				}
+			}
+		}
+	}
+	pass(func(a, b string) bool { return a == b })
+	pass(func(a, b string) bool { return columnKey(a) == columnKey(b) })
+
+	var missing, unexpected []string
+	tag := sourceColumn(data)
+	for col, in := range match {
+		if in == -1 && col != tag {
+			missing = append(missing, strconv.Quote(data.Headers[col]))
+		}
+	}
+	for in, ok := range used {
+		if !ok {
+			unexpected = append(unexpected, strconv.Quote(incoming.Headers[in]))
+		}
+	}
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "the file has no "+strings.Join(missing, ", ")+" column(s)")
+	}
+	if len(unexpected) > 0 {
+		problems = append(problems, "the dataset has no "+strings.Join(unexpected, ", ")+" column(s)")
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("the headers don't match: %s", strings.Join(problems, "; "))
+	}
+	return match, nil
+}
+
+// appendRows adds incoming's rows to the end of data, tagging each with
+// incoming's file name, and returns how many were added.
+func appendRows(data *Spreadsheet, incoming Spreadsheet) (int, error) {
+	tag := sourceColumn(*data)
+	if tag == -1 {
+		// The first append tags the rows already there with the original file.
+		tag = len(data.Headers)
+		data.ColumnIDs = append(append([]string(nil), data.ColumnIDs...), nextColumnID(*data))
+		data.Headers = append(append([]string(nil), data.Headers...), sourceFileColumn)
+		rows := make([][]string, len(data.Rows), len(data.Rows)+len(incoming.Rows))
+		for i, row := range data.Rows {
+			out := make([]string, len(data.Headers))
+			copy(out, row)
+			out[tag] = data.FileName
+			rows[i] = out
+		}
+		data.Rows = rows
+		data.Lineage = withLineage(data.Lineage, ColumnLineage{Column: sourceFileColumn, Operation: "append", Detail: "the file each row was uploaded in"})
+	}
+	match, err := matchAppendColumns(*data, incoming)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkRowLimit(len(data.Rows) + len(incoming.Rows)); err != nil {
+		return 0, err
+	}
+	rows := make([][]string, len(data.Rows), len(data.Rows)+len(incoming.Rows))
+	copy(rows, data.Rows)
+	for _, row := range incoming.Rows {
+		out := make([]string, len(data.Headers))
+		for col, in := range match {
+			if in != -1 {
+				out[col] = cellValue(row, in)
+			}
+		}
+		if match[tag] == -1 {
+			out[tag] = incoming.FileName
+		}
+		rows = append(rows, out)
+	}
+	data.Rows = rows
+	data.FileSize += incoming.FileSize
+	data.NumericCols = detectNumericColumns(*data)
+	data.Notes = append(data.Notes, fmt.Sprintf("Appended %d row(s) from %s", len(incoming.Rows), incoming.FileName))
+	data.Pipeline = appendStep(data.Pipeline, "append_rows", map[string]string{
+		"file": incoming.FileName,
+		"rows": strconv.Itoa(len(incoming.Rows)),
+	})
+	return len(incoming.Rows), nil
+}
+
+// receiveAppend is receiveUpload in append mode: it reads the upload and
+// appends its rows to the upload id names.
+func receiveAppend(r *http.Request, id string) (Spreadsheet, error) {
+	data, ok := teamDataset(r, id)
+	if !ok {
+		return Spreadsheet{}, withStatus(http.StatusNotFound, errors.New("Unknown dataset"))
+	}
+	if data.ParentID != "" {
+		return Spreadsheet{}, errors.New("Rows can only be appended to uploads, not datasets derived from them")
+	}
+	if err := checkVersion(r, data); err != nil {
+		return Spreadsheet{}, withStatus(http.StatusConflict, err)
+	}
+	incoming, err := readUpload(r)
+	if err != nil {
+		return Spreadsheet{}, err
+	}
+	if _, err := appendRows(&data, incoming); err != nil {
+		return Spreadsheet{}, fmt.Errorf("Append rejected: %w", err)
+	}
+	if err := checkGrowth(data.Owner, datasetBytes(incoming)); err != nil {
+		return Spreadsheet{}, withStatus(http.StatusForbidden, fmt.Errorf("Append rejected: %w", err))
+	}
+	if err := workspace.Update(&data); err != nil {
+		if errors.Is(err, errUnknownDataset) {
+			return Spreadsheet{}, withStatus(http.StatusNotFound, err)
+		}
+		return Spreadsheet{}, withStatus(http.StatusConflict, err)
+	}
+	uploadLedger.Record(ownerID(currentUser(r)), incoming.FileSize)
+	go checkAlerts(data, "append")
+	return data, nil
+}
+
+// receiveFile stores a parsed multipart upload as a new dataset or, when
+// the form names one in append_to, appends it to that dataset.
+func receiveFile(r *http.Request) (Spreadsheet, error) {
+	if id := r.FormValue("append_to"); id != "" {
+		return receiveAppend(r, id)
+	}
+	return receiveUpload(r)
+}
@@ -0,0 +1,332 @@
+// arrow.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Apache Arrow IPC file format, which is what Feather V2 is. Like msgpack.go
+// it's written by hand rather than pulling in a library: one record batch,
+// no compression, no dictionaries. pandas and Polars read it with the column
+// types intact.
+
+const (
+	arrowMagic = "ARROW1"
+	mimeArrow  = "application/vnd.apache.arrow.file"
+)
+
+const (
+	arrowMetadataV5 = 4
+
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+
+	arrowTypeInt           = 2
+	arrowTypeFloatingPoint = 3
+	arrowTypeUtf8          = 5
+	arrowTypeDate          = 8
+	arrowTypeTimestamp     = 10
+
+	arrowPrecisionDouble = 2
+	arrowDateDay         = 0
+	arrowTimeMillisecond = 1
+)
+
+// arrowColumn is one column ready to write. Every column is nullable; blank
+// cells are null.
+type arrowColumn struct {
+	name      string
+	typeID    byte
+	typeTable fbTable
+	nulls     int
+	buffers   [][]byte // validity first
+}
+
+// arrowColumns lays out each column in its storage type.
+func arrowColumns(data Spreadsheet) []arrowColumn {
+	n := len(data.Rows)
+	cols := make([]arrowColumn, len(data.Headers))
+	for c, typ := range storageTypes(data) {
+		col := arrowColumn{name: data.Headers[c]}
+		validity := make([]byte, (n+7)/8)
+		for i, row := range data.Rows {
+			if strings.TrimSpace(cellValue(row, c)) == "" {
+				col.nulls++
+			} else {
+				validity[i/8] |= 1 << (i % 8)
+			}
+		}
+		values := func(size int, put func(b []byte, v string)) []byte {
+			b := make([]byte, n*size)
+			for i, row := range data.Rows {
+				if v := strings.TrimSpace(cellValue(row, c)); v != "" {
+					put(b[i*size:], v)
+				}
+			}
+			return b
+		}
+		switch typ {
+		case storeInt:
+			col.typeID, col.typeTable = arrowTypeInt, fbTable{fbInt32(64), fbBool(true)}
+			col.buffers = [][]byte{validity, values(8, func(b []byte, v string) {
+				i, _ := strconv.ParseInt(v, 10, 64)
+				binary.LittleEndian.PutUint64(b, uint64(i))
+			})}
+		case storeFloat:
+			col.typeID, col.typeTable = arrowTypeFloatingPoint, fbTable{fbInt16(arrowPrecisionDouble)}
+			col.buffers = [][]byte{validity, values(8, func(b []byte, v string) {
+				f, _ := parseFinite(v)
+				binary.LittleEndian.PutUint64(b, math.Float64bits(f))
+			})}
+		case storeDate:
+			col.typeID, col.typeTable = arrowTypeDate, fbTable{fbInt16(arrowDateDay)}
+			col.buffers = [][]byte{validity, values(4, func(b []byte, v string) {
+				t, _ := parseDate(v)
+				binary.LittleEndian.PutUint32(b, uint32(int32(t.Unix()/86400)))
+			})}
+		case storeDateTime:
+			col.typeID, col.typeTable = arrowTypeTimestamp, fbTable{fbInt16(arrowTimeMillisecond), fbString("UTC")}
+			col.buffers = [][]byte{validity, values(8, func(b []byte, v string) {
+				t, _ := parseDate(v)
+				binary.LittleEndian.PutUint64(b, uint64(t.UnixMilli()))
+			})}
+		default:
+			offsets := make([]byte, 4*(n+1))
+			var text bytes.Buffer
+			for i, row := range data.Rows {
+				if validity[i/8]&(1<<(i%8)) != 0 {
+					text.WriteString(cellValue(row, c))
+				}
+				binary.LittleEndian.PutUint32(offsets[4*(i+1):], uint32(text.Len()))
+			}
+			col.typeID, col.typeTable = arrowTypeUtf8, fbTable{}
+			col.buffers = [][]byte{validity, offsets, text.Bytes()}
+		}
+		cols[c] = col
+	}
+	return cols
+}
+
+func arrowSchema(cols []arrowColumn) fbTable {
+	fields := make(fbTables, len(cols))
+	for i, col := range cols {
+		// name, nullable, type_type, type, dictionary, children
+		fields[i] = fbTable{fbString(col.name), fbBool(true), fbUint8(col.typeID), col.typeTable, nil, fbTables{}}
+	}
+	// endianness (little), fields
+	return fbTable{fbInt16(0), fields}
+}
+
+// writeArrowFile writes data as an Arrow IPC file: the magic, the schema
+// message, one record batch and a footer indexing them.
+func writeArrowFile(w io.Writer, data Spreadsheet) error {
+	cols := arrowColumns(data)
+	var out bytes.Buffer
+	out.WriteString(arrowMagic + "\x00\x00")
+	writeArrowMessage(&out, fbTable{fbInt16(arrowMetadataV5), fbUint8(arrowHeaderSchema), arrowSchema(cols), fbInt64(0)}, nil)
+
+	var body bytes.Buffer
+	var nodes, buffers []byte
+	for _, col := range cols {
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(len(data.Rows)))
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(col.nulls))
+		for _, b := range col.buffers {
+			buffers = binary.LittleEndian.AppendUint64(buffers, uint64(body.Len()))
+			buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(b)))
+			body.Write(b)
+			body.Write(make([]byte, (8-body.Len()%8)%8))
+		}
+	}
+	// length, nodes, buffers
+	batch := fbTable{fbInt64(int64(len(data.Rows))), fbStructs{16, nodes}, fbStructs{16, buffers}}
+	offset := out.Len()
+	metaLen := writeArrowMessage(&out, fbTable{fbInt16(arrowMetadataV5), fbUint8(arrowHeaderRecordBatch), batch, fbInt64(int64(body.Len()))}, body.Bytes())
+
+	var block []byte
+	block = binary.LittleEndian.AppendUint64(block, uint64(offset))
+	block = binary.LittleEndian.AppendUint32(block, uint32(metaLen))
+	block = binary.LittleEndian.AppendUint32(block, 0)
+	block = binary.LittleEndian.AppendUint64(block, uint64(body.Len()))
+	// version, schema, dictionaries, recordBatches
+	footer := fbFinish(fbTable{fbInt16(arrowMetadataV5), arrowSchema(cols), fbStructs{24, nil}, fbStructs{24, block}})
+	out.Write(footer)
+	out.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(footer))))
+	out.WriteString(arrowMagic)
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// datasetArrowAPIHandler serves a dataset as an Arrow IPC (Feather) file.
+func datasetArrowAPIHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := teamDataset(r, r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Unknown dataset")
+		return
+	}
+	accessLog.Record(r, data.ID, "export", "arrow")
+	w.Header().Set("Content-Type", mimeArrow)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.arrow"`, exportBaseName(data.FileName)))
+	w.Header().Set("ETag", strconv.Quote(strconv.Itoa(data.Version)))
+	if err := writeArrowFile(w, data); err != nil {
+		log.Printf("Arrow export error: %v", err)
+	}
+}
+
+// writeArrowMessage writes an encapsulated message: a continuation marker,
+// the metadata length, the Message flatbuffer padded to 8 bytes and the
+// body. It returns the length of everything before the body.
+func writeArrowMessage(out *bytes.Buffer, message fbTable, body []byte) int {
+	meta := fbFinish(message)
+	meta = append(meta, make([]byte, (8-len(meta)%8)%8)...)
+	out.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF})
+	out.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(meta))))
+	out.Write(meta)
+	out.Write(body)
+	return 8 + len(meta)
+}
+
+// A minimal FlatBuffers encoder for the Arrow metadata. Unlike the usual
+// builder it writes front to back: every object comes after whatever points
+// at it, so offsets are always forward, and tables start 8-byte aligned so
+// their fields are naturally aligned.
+
+// fbTable holds a table's fields by field ID; nil leaves a field unset.
+// Fields are fbScalar, or fbTable, fbString, fbTables or fbStructs, which
+// are stored as offsets.
+type fbTable []interface{}
+
+type fbScalar struct {
+	size int
+	bits uint64
+}
+
+type fbString string
+
+type fbTables []fbTable
+
+// fbStructs is a vector of 8-byte aligned structs of size bytes each,
+// already encoded.
+type fbStructs struct {
+	size int
+	data []byte
+}
+
+func fbBool(v bool) fbScalar {
+	if v {
+		return fbScalar{1, 1}
+	}
+	return fbScalar{1, 0}
+}
+
+func fbUint8(v byte) fbScalar  { return fbScalar{1, uint64(v)} }
+func fbInt16(v int16) fbScalar { return fbScalar{2, uint64(uint16(v))} }
+func fbInt32(v int32) fbScalar { return fbScalar{4, uint64(uint32(v))} }
+func fbInt64(v int64) fbScalar { return fbScalar{8, uint64(v)} }
+
+type fbBuilder struct {
+	buf []byte
+}
+
+func fbFinish(root fbTable) []byte {
+	b := &fbBuilder{}
+	b.grow(4)
+	b.link(0, b.write(root))
+	return b.buf
+}
+
+func (b *fbBuilder) grow(n int) int {
+	pos := len(b.buf)
+	b.buf = append(b.buf, make([]byte, n)...)
+	return pos
+}
+
+// align pads so that the next byte written, plus skip, is aligned.
+func (b *fbBuilder) align(n, skip int) {
+	for (len(b.buf)+skip)%n != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+// link points the uoffset at slot to target.
+func (b *fbBuilder) link(slot, target int) {
+	binary.LittleEndian.PutUint32(b.buf[slot:], uint32(target-slot))
+}
+
+func (b *fbBuilder) write(v interface{}) int {
+	switch v := v.(type) {
+	case fbTable:
+		return b.writeTable(v)
+	case fbString:
+		b.align(4, 0)
+		pos := b.grow(4 + len(v) + 1)
+		binary.LittleEndian.PutUint32(b.buf[pos:], uint32(len(v)))
+		copy(b.buf[pos+4:], v)
+		return pos
+	case fbTables:
+		b.align(4, 0)
+		pos := b.grow(4 + 4*len(v))
+		binary.LittleEndian.PutUint32(b.buf[pos:], uint32(len(v)))
+		for i, t := range v {
+			b.link(pos+4+4*i, b.write(t))
+		}
+		return pos
+	case fbStructs:
+		b.align(8, 4)
+		pos := b.grow(4 + len(v.data))
+		binary.LittleEndian.PutUint32(b.buf[pos:], uint32(len(v.data)/v.size))
+		copy(b.buf[pos+4:], v.data)
+		return pos
+	}
+	panic("flatbuffers: unsupported value")
+}
+
+func (b *fbBuilder) writeTable(t fbTable) int {
+	offsets := make([]uint16, len(t))
+	size := 4 // the vtable offset
+	for i, f := range t {
+		n := 4
+		switch f := f.(type) {
+		case nil:
+			continue
+		case fbScalar:
+			n = f.size
+		}
+		for size%n != 0 {
+			size++
+		}
+		offsets[i] = uint16(size)
+		size += n
+	}
+
+	b.align(2, 0)
+	vtable := b.grow(4 + 2*len(t))
+	binary.LittleEndian.PutUint16(b.buf[vtable:], uint16(4+2*len(t)))
+	binary.LittleEndian.PutUint16(b.buf[vtable+2:], uint16(size))
+	for i, o := range offsets {
+		binary.LittleEndian.PutUint16(b.buf[vtable+4+2*i:], o)
+	}
+	b.align(8, 0)
+	pos := b.grow(size)
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(int32(pos-vtable)))
+	for i, f := range t {
+		if s, ok := f.(fbScalar); ok {
+			for j := 0; j < s.size; j++ {
+				b.buf[pos+int(offsets[i])+j] = byte(s.bits >> (8 * j))
+			}
+		}
+	}
+	for i, f := range t {
+		if _, ok := f.(fbScalar); f != nil && !ok {
+			b.link(pos+int(offsets[i]), b.write(f))
+		}
+	}
+	return pos
+}
@@ -0,0 +1,277 @@
+// arrow_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The export is read back with a reader written from the Arrow and
+// FlatBuffers specs rather than from arrow.go, so a mistake in the encoder
+// isn't mirrored by the test.
+
+type fbReader []byte
+
+func (b fbReader) u16(pos int) int { return int(binary.LittleEndian.Uint16(b[pos:])) }
+func (b fbReader) u32(pos int) int { return int(binary.LittleEndian.Uint32(b[pos:])) }
+func (b fbReader) i64(pos int) int64 {
+	return int64(binary.LittleEndian.Uint64(b[pos:]))
+}
+
+// deref follows the uoffset at pos.
+func (b fbReader) deref(pos int) int { return pos + b.u32(pos) }
+
+// field returns where field id of the table at pos is stored, or -1.
+func (b fbReader) field(table, id int) int {
+	vtable := table - int(int32(b.u32(table)))
+	if 4+2*id >= b.u16(vtable) {
+		return -1
+	}
+	if off := b.u16(vtable + 4 + 2*id); off != 0 {
+		return table + off
+	}
+	return -1
+}
+
+func (b fbReader) string(pos int) string {
+	pos = b.deref(pos)
+	return string(b[pos+4 : pos+4+b.u32(pos)])
+}
+
+// vector returns the length and first element of the vector at pos.
+func (b fbReader) vector(pos int) (int, int) {
+	pos = b.deref(pos)
+	return b.u32(pos), pos + 4
+}
+
+type arrowField struct {
+	name      string
+	typeID    int
+	bitWidth  int
+	signed    bool
+	unit      int
+	precision int
+	timezone  string
+}
+
+func readArrowSchema(t *testing.T, b fbReader, schema int) []arrowField {
+	t.Helper()
+	if end := b.field(schema, 0); end != -1 && b.u16(end) != 0 {
+		t.Fatalf("schema isn't little-endian")
+	}
+	n, first := b.vector(b.field(schema, 1))
+	fields := make([]arrowField, n)
+	for i := range fields {
+		f := b.deref(first + 4*i)
+		typ := b.deref(b.field(f, 3))
+		fields[i] = arrowField{name: b.string(b.field(f, 0)), typeID: int(b[b.field(f, 2)])}
+		switch fields[i].typeID {
+		case arrowTypeInt:
+			fields[i].bitWidth, fields[i].signed = b.u32(b.field(typ, 0)), b[b.field(typ, 1)] == 1
+		case arrowTypeFloatingPoint:
+			fields[i].precision = b.u16(b.field(typ, 0))
+		case arrowTypeDate:
+			if p := b.field(typ, 0); p != -1 {
+				fields[i].unit = b.u16(p)
+			} else {
+				fields[i].unit = 1 // the spec's default, milliseconds
+			}
+		case arrowTypeTimestamp:
+			fields[i].unit, fields[i].timezone = b.u16(b.field(typ, 0)), b.string(b.field(typ, 1))
+		}
+		if p := b.field(f, 1); p == -1 || b[p] != 1 {
+			t.Errorf("field %s isn't nullable", fields[i].name)
+		}
+	}
+	return fields
+}
+
+// readArrowFile decodes an Arrow IPC file of one record batch into the
+// text each cell should have come from.
+func readArrowFile(t *testing.T, file []byte) ([]arrowField, [][]string) {
+	t.Helper()
+	b := fbReader(file)
+	if !bytes.HasPrefix(file, []byte("ARROW1\x00\x00")) || !bytes.HasSuffix(file, []byte("ARROW1")) {
+		t.Fatal("missing the magic")
+	}
+	footerLen := b.u32(len(file) - 10)
+	footerStart := len(file) - 10 - footerLen
+	footer := fbReader(file[footerStart : len(file)-10])
+	root := footer.deref(0)
+	fields := readArrowSchema(t, footer, footer.deref(footer.field(root, 1)))
+
+	// The schema message right after the magic must agree with the footer.
+	if b.u32(8) != 0xFFFFFFFF {
+		t.Fatal("schema message has no continuation marker")
+	}
+	schemaMeta := fbReader(file[16 : 16+b.u32(12)])
+	msg := schemaMeta.deref(0)
+	if schemaMeta[schemaMeta.field(msg, 1)] != arrowHeaderSchema {
+		t.Fatal("first message isn't the schema")
+	}
+	if got := readArrowSchema(t, schemaMeta, schemaMeta.deref(schemaMeta.field(msg, 2))); fmt.Sprint(got) != fmt.Sprint(fields) {
+		t.Fatalf("schema message %v, footer %v", got, fields)
+	}
+
+	blocks, first := footer.vector(footer.field(root, 3))
+	if blocks != 1 {
+		t.Fatalf("%d record batches", blocks)
+	}
+	offset, metaLen, bodyLen := int(footer.i64(first)), footer.u32(first+8), int(footer.i64(first+16))
+	if offset%8 != 0 || metaLen%8 != 0 || b.u32(offset) != 0xFFFFFFFF || b.u32(offset+4) != metaLen-8 {
+		t.Fatalf("bad block: offset %d, metadata %d", offset, metaLen)
+	}
+	meta := fbReader(file[offset+8 : offset+metaLen])
+	body := file[offset+metaLen : offset+metaLen+bodyLen]
+	msg = meta.deref(0)
+	if meta.u16(meta.field(msg, 0)) != arrowMetadataV5 || meta[meta.field(msg, 1)] != arrowHeaderRecordBatch || int(meta.i64(meta.field(msg, 3))) != bodyLen {
+		t.Fatal("bad record batch message")
+	}
+	batch := meta.deref(meta.field(msg, 2))
+	rows := int(meta.i64(meta.field(batch, 0)))
+	nNodes, nodes := meta.vector(meta.field(batch, 1))
+	nBuffers, buffers := meta.vector(meta.field(batch, 2))
+	if nNodes != len(fields) {
+		t.Fatalf("%d nodes for %d fields", nNodes, len(fields))
+	}
+	if nodes%8 != 0 || buffers%8 != 0 {
+		t.Errorf("struct vectors aren't 8-byte aligned")
+	}
+	buffer := func(i int) []byte {
+		if i >= nBuffers {
+			t.Fatalf("only %d buffers", nBuffers)
+		}
+		off, n := int(meta.i64(buffers+16*i)), int(meta.i64(buffers+16*i+8))
+		if off%8 != 0 || off+n > len(body) {
+			t.Fatalf("buffer %d at %d+%d of a %d-byte body", i, off, n, len(body))
+		}
+		return body[off : off+n]
+	}
+
+	cells := make([][]string, rows)
+	for i := range cells {
+		cells[i] = make([]string, len(fields))
+	}
+	next := 0
+	for c, f := range fields {
+		if length := int(meta.i64(nodes + 16*c)); length != rows {
+			t.Fatalf("column %s has %d rows of %d", f.name, length, rows)
+		}
+		validity, values := buffer(next), buffer(next+1)
+		next += 2
+		var text []byte
+		if f.typeID == arrowTypeUtf8 {
+			text = buffer(next)
+			next++
+		}
+		nulls := 0
+		for i := range rows {
+			if validity[i/8]&(1<<(i%8)) == 0 {
+				nulls++
+				continue
+			}
+			switch f.typeID {
+			case arrowTypeInt:
+				cells[i][c] = strconv.FormatInt(int64(binary.LittleEndian.Uint64(values[8*i:])), 10)
+			case arrowTypeFloatingPoint:
+				cells[i][c] = strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(values[8*i:])), 'f', -1, 64)
+			case arrowTypeDate:
+				days := int32(binary.LittleEndian.Uint32(values[4*i:]))
+				cells[i][c] = time.Unix(int64(days)*86400, 0).UTC().Format("2006-01-02")
+			case arrowTypeTimestamp:
+				ms := int64(binary.LittleEndian.Uint64(values[8*i:]))
+				cells[i][c] = time.UnixMilli(ms).UTC().Format(time.RFC3339)
+			case arrowTypeUtf8:
+				start, end := binary.LittleEndian.Uint32(values[4*i:]), binary.LittleEndian.Uint32(values[4*i+4:])
+				cells[i][c] = string(text[start:end])
+			}
+		}
+		if want := int(meta.i64(nodes + 16*c + 8)); nulls != want {
+			t.Errorf("column %s has %d nulls, its node says %d", f.name, nulls, want)
+		}
+	}
+	if next != nBuffers {
+		t.Errorf("%d buffers, read %d", nBuffers, next)
+	}
+	return fields, cells
+}
+
+func arrowTestData(rows int) Spreadsheet {
+	data := Spreadsheet{Headers: []string{"ID", "Price", "Name", "Day", "When", "Empty"}}
+	for i := range rows {
+		price := fmt.Sprintf("%d.%d", i*3-40, i%10)
+		if i%4 == 3 {
+			price = ""
+		}
+		name := "n" + strings.Repeat("é", i%5) + fmt.Sprint(i)
+		if i%6 == 5 {
+			name = ""
+		}
+		data.Rows = append(data.Rows, []string{
+			fmt.Sprint(i - 2), price, name,
+			fmt.Sprintf("%d-%02d-%02d", 1960+i%80, i%12+1, i%28+1),
+			fmt.Sprintf("2024-03-%02d %02d:%02d:07", i%28+1, i%24, i%60),
+			"",
+		})
+	}
+	return data
+}
+
+func TestArrowRoundTrip(t *testing.T) {
+	wantTypes := []int{arrowTypeInt, arrowTypeFloatingPoint, arrowTypeUtf8, arrowTypeDate, arrowTypeTimestamp, arrowTypeUtf8}
+	for _, rows := range []int{1, 7, 8, 9, 1000} {
+		data := arrowTestData(rows)
+		var buf bytes.Buffer
+		if err := writeArrowFile(&buf, data); err != nil {
+			t.Fatal(err)
+		}
+		fields, cells := readArrowFile(t, buf.Bytes())
+		for c, f := range fields {
+			if f.name != data.Headers[c] || f.typeID != wantTypes[c] {
+				t.Fatalf("%d rows: field %d is %+v", rows, c, f)
+			}
+		}
+		if f := fields[0]; f.bitWidth != 64 || !f.signed {
+			t.Errorf("ID is %+v, want signed 64-bit", f)
+		}
+		if f := fields[1]; f.precision != arrowPrecisionDouble {
+			t.Errorf("Price is %+v, want a double", f)
+		}
+		if f := fields[3]; f.unit != arrowDateDay {
+			t.Errorf("Day is %+v, want days", f)
+		}
+		if f := fields[4]; f.unit != arrowTimeMillisecond || f.timezone != "UTC" {
+			t.Errorf("When is %+v, want UTC milliseconds", f)
+		}
+		for i, row := range data.Rows {
+			want := slices.Clone(row)
+			if want[1] != "" {
+				f, _ := strconv.ParseFloat(want[1], 64)
+				want[1] = strconv.FormatFloat(f, 'f', -1, 64)
+			}
+			when, _ := parseDate(want[4])
+			want[4] = when.UTC().Format(time.RFC3339)
+			if got := cells[i]; strings.Join(got, "|") != strings.Join(want, "|") {
+				t.Fatalf("%d rows: row %d = %q, want %q", rows, i, got, want)
+			}
+		}
+	}
+}
+
+func TestArrowEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeArrowFile(&buf, Spreadsheet{Headers: []string{"A", "B"}}); err != nil {
+		t.Fatal(err)
+	}
+	fields, cells := readArrowFile(t, buf.Bytes())
+	if len(fields) != 2 || len(cells) != 0 {
+		t.Errorf("read %d fields and %d rows", len(fields), len(cells))
+	}
+}
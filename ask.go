@@ -0,0 +1,460 @@
+// ask.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Questions are parsed by a small word grammar rather than a model:
+//
+//	question  = [lead-in] metric {"and" metric} {clause}
+//	metric    = aggregate ["of"] [the] column | "how many" [rows]
+//	clause    = ("by" | "per" | "for each") column {"and" column}
+//	          | ("in" | "during") month [year] | ("in" | "during") year
+//	          | ("where" | "with" | "and" | "for" | "in") condition
+//	condition = column comparison value | category value
+//
+// Anything the grammar doesn't cover is an error naming the word it stopped
+// at, so a question is never silently answered as something else.
+
+var askWordPattern = regexp.MustCompile(`[<>=!]+|[^\s,?<>=!]+`)
+
+var askAggregates = map[string]string{
+	"sum": "sum", "total": "sum",
+	"average": "average", "avg": "average", "mean": "average",
+	"min": "min", "minimum": "min", "lowest": "min", "smallest": "min",
+	"max": "max", "maximum": "max", "highest": "max", "largest": "max",
+	"median": "median", "std": "std", "stddev": "std", "count": "count",
+}
+
+var askLeadIns = []string{"what is", "what was", "what are", "what's", "show me", "show", "give me", "tell me", "compute", "calculate", "find", "get", "the"}
+
+var askComparisons = []struct {
+	words string
+	op    string
+}{
+	{"isn't", "!="}, {"not", "!="}, {"!=", "!="},
+	{"greater than or equal to", ">="}, {"at least", ">="}, {">=", ">="},
+	{"less than or equal to", "<="}, {"at most", "<="}, {"<=", "<="},
+	{"greater than", ">"}, {"more than", ">"}, {"over", ">"}, {"above", ">"}, {">", ">"},
+	{"less than", "<"}, {"fewer than", "<"}, {"under", "<"}, {"below", "<"},
+	{"<", "<"}, {"equals", "=="}, {"equal to", "=="}, {"==", "=="}, {"=", "=="},
+}
+
+var askMonths = map[string]int{
+	"january": 1, "jan": 1, "february": 2, "feb": 2, "march": 3, "mar": 3, "april": 4, "apr": 4,
+	"may": 5, "june": 6, "jun": 6, "july": 7, "jul": 7, "august": 8, "aug": 8,
+	"september": 9, "sep": 9, "sept": 9, "october": 10, "oct": 10, "november": 11, "nov": 11, "december": 12, "dec": 12,
+}
+
+type askParser struct {
+	words []string
+	pos   int
+	data  Spreadsheet
+	spec  AnalyzeSpec
+	said  []string // the interpretation, clause by clause
+}
+
+// parseQuestion turns a question into an analysis spec over data, plus a
+// plain restatement of how it was read.
+func parseQuestion(data Spreadsheet, question string) (AnalyzeSpec, string, error) {
+	p := &askParser{words: askWordPattern.FindAllString(question, -1), data: data}
+	if len(p.words) == 0 {
+		return p.spec, "", fmt.Errorf("the question is empty")
+	}
+	for p.acceptAny(askLeadIns...) {
+	}
+	if err := p.metrics(); err != nil {
+		return p.spec, "", err
+	}
+	for !p.done() {
+		if err := p.clause(); err != nil {
+			return p.spec, "", err
+		}
+	}
+	return p.spec, strings.Join(p.said, ", "), nil
+}
+
+func (p *askParser) done() bool { return p.pos >= len(p.words) }
+
+// accept consumes phrase (space-separated words, matched case-insensitively)
+// when it comes next.
+func (p *askParser) accept(phrase string) bool {
+	parts := strings.Fields(phrase)
+	if p.pos+len(parts) > len(p.words) {
+		return false
+	}
+	for i, part := range parts {
+		if !strings.EqualFold(p.words[p.pos+i], part) {
+			return false
+		}
+	}
+	p.pos += len(parts)
+	return true
+}
+
+func (p *askParser) acceptAny(phrases ...string) bool {
+	for _, phrase := range phrases {
+		if p.accept(phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *askParser) errorf(format string, args ...interface{}) error {
+	at := "the end of the question"
+	if !p.done() {
+		at = strconv.Quote(p.words[p.pos])
+	}
+	return fmt.Errorf("could not understand the question at %s: %s", at, fmt.Sprintf(format, args...))
+}
+
+// column matches the longest run of upcoming words that names a column,
+// ignoring case, spacing and a plural "s".
+func (p *askParser) column() (string, bool) {
+	for n := askSpan(len(p.words) - p.pos); n > 0; n-- {
+		key := columnKey(strings.Join(p.words[p.pos:p.pos+n], " "))
+		for _, h := range p.data.Headers {
+			hk := columnKey(h)
+			if hk == key || hk+"s" == key {
+				p.pos += n
+				return h, true
+			}
+		}
+	}
+	return "", false
+}
+
+// askSpan caps how many words a column name or value may span.
+func askSpan(n int) int {
+	if n > 4 {
+		return 4
+	}
+	return n
+}
+
+func (p *askParser) metrics() error {
+	if err := p.metric(); err != nil {
+		return err
+	}
+	for {
+		save := p.pos
+		if !p.accept("and") || p.done() {
+			p.pos = save
+			return nil
+		}
+		// "sum of Amount and Tax" repeats the aggregate for Tax.
+		if col, ok := p.column(); ok {
+			m := p.spec.Metrics[len(p.spec.Metrics)-1]
+			if m.As == "" {
+				m.Column = col
+				p.spec.Metrics = append(p.spec.Metrics, m)
+				p.said = append(p.said, strings.SplitN(p.said[len(p.said)-1], " of ", 2)[0]+" of "+col)
+				continue
+			}
+			p.pos = save
+			return nil
+		}
+		if !p.startsMetric() {
+			p.pos = save
+			return nil
+		}
+		if err := p.metric(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *askParser) startsMetric() bool {
+	w := strings.ToLower(p.words[p.pos])
+	_, ok := askAggregates[w]
+	return ok || w == "how" || w == "number" || w == "the" || ordinalPattern.MatchString(w)
+}
+
+var ordinalPattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)(?:st|nd|rd|th)?$`)
+
+func (p *askParser) metric() error {
+	p.accept("the")
+	var m AnalyzeMetric
+	var label string
+	switch {
+	case p.accept("how many"), p.accept("number of"):
+		m.Operation = "count"
+		p.accept("of")
+		if col, ok := p.column(); ok {
+			m.Column = col
+			p.spec.Metrics = append(p.spec.Metrics, m)
+			p.said = append(p.said, "count of "+col)
+			return nil
+		}
+		// "how many rows/orders": every group reports its row count, so any
+		// column will do; count the first numeric one and call it rows.
+		if !p.done() && !p.startsClause() {
+			p.pos++
+		}
+		if len(p.data.NumericCols) == 0 {
+			return p.errorf("there are no numeric columns to count")
+		}
+		m.Column, m.As, label = p.data.Headers[p.data.NumericCols[0]], "rows", "row count"
+		p.spec.Metrics = append(p.spec.Metrics, m)
+		p.said = append(p.said, label)
+		return nil
+	default:
+		if p.done() {
+			return p.errorf("expected an aggregate such as sum, average or count")
+		}
+		w := strings.ToLower(p.words[p.pos])
+		if sub := ordinalPattern.FindStringSubmatch(w); sub != nil && p.pos+1 < len(p.words) && strings.EqualFold(p.words[p.pos+1], "percentile") {
+			p.pos += 2
+			m.Operation = "percentile"
+			m.Params = map[string]json.RawMessage{"p": json.RawMessage(sub[1])}
+			label = sub[1] + "th percentile"
+		} else if p.accept("standard deviation") {
+			m.Operation, label = "std", "standard deviation"
+		} else if op, ok := askAggregates[w]; ok {
+			p.pos++
+			m.Operation, label = op, op
+		} else {
+			return p.errorf("expected an aggregate such as sum, average or count")
+		}
+	}
+	p.acceptAny("of", "for")
+	p.accept("the")
+	col, ok := p.column()
+	if !ok {
+		return p.errorf("expected a column name after %q", label)
+	}
+	m.Column = col
+	p.spec.Metrics = append(p.spec.Metrics, m)
+	p.said = append(p.said, label+" of "+col)
+	return nil
+}
+
+func (p *askParser) startsClause() bool {
+	switch strings.ToLower(p.words[p.pos]) {
+	case "by", "per", "for", "in", "during", "where", "with", "and":
+		return true
+	}
+	return false
+}
+
+func (p *askParser) clause() error {
+	switch {
+	case p.acceptAny("grouped by", "broken down by", "split by", "for each", "by", "per"):
+		for {
+			p.accept("the")
+			col, ok := p.column()
+			if !ok {
+				return p.errorf("expected a column to group by")
+			}
+			p.spec.GroupBy = append(p.spec.GroupBy, col)
+			p.said = append(p.said, "grouped by "+col)
+			if !p.accept("and") {
+				return nil
+			}
+		}
+	case p.acceptAny("in", "during", "for"):
+		if ok, err := p.period(); ok || err != nil {
+			return err
+		}
+		return p.condition()
+	case p.acceptAny("where", "with", "when", "and", "if"):
+		return p.condition()
+	}
+	return p.errorf("expected \"by\", \"in\" or \"where\"")
+}
+
+// period reads a month and/or year and filters the first date column on it.
+func (p *askParser) period() (bool, error) {
+	if p.done() {
+		return false, nil
+	}
+	month, isMonth := askMonths[strings.ToLower(p.words[p.pos])]
+	year, yerr := strconv.Atoi(p.words[p.pos])
+	isYear := yerr == nil && year >= 1000 && year <= 9999
+	if !isMonth && !isYear {
+		return false, nil
+	}
+	dates := detectDateColumns(p.data)
+	if len(dates) == 0 {
+		return true, p.errorf("the dataset has no date column to filter on")
+	}
+	date := exprColumn(p.data.Headers[dates[0]])
+	p.pos++
+	if isMonth {
+		p.spec.Filters = append(p.spec.Filters, fmt.Sprintf("month(%s) == %d", date, month))
+		said := "in " + time.Month(month).String()
+		if !p.done() {
+			if y, err := strconv.Atoi(p.words[p.pos]); err == nil && y >= 1000 && y <= 9999 {
+				p.pos++
+				p.spec.Filters = append(p.spec.Filters, fmt.Sprintf("year(%s) == %d", date, y))
+				said += " " + strconv.Itoa(y)
+			}
+		}
+		p.said = append(p.said, said+" ("+p.data.Headers[dates[0]]+")")
+		return true, nil
+	}
+	p.spec.Filters = append(p.spec.Filters, fmt.Sprintf("year(%s) == %d", date, year))
+	p.said = append(p.said, fmt.Sprintf("in %d (%s)", year, p.data.Headers[dates[0]]))
+	return true, nil
+}
+
+// condition reads "column comparison value", or a bare value that appears
+// in exactly one text column ("in West" means Region is West).
+func (p *askParser) condition() error {
+	p.accept("the")
+	if col, ok := p.column(); ok {
+		// "is" may lead another comparison ("is over 2") or stand alone.
+		op := ""
+		if p.accept("is") {
+			op = "=="
+		}
+		for _, c := range askComparisons {
+			if p.accept(c.words) {
+				op = c.op
+				break
+			}
+		}
+		if op == "" {
+			return p.errorf("expected a comparison such as \"is\", \"over\" or \"below\" after %s", col)
+		}
+		p.accept("than")
+		if p.done() {
+			return p.errorf("expected a value to compare %s with", col)
+		}
+		value := p.value()
+		p.spec.Filters = append(p.spec.Filters, fmt.Sprintf("%s %s %s", exprColumn(col), op, value))
+		p.said = append(p.said, fmt.Sprintf("where %s %s %s", col, op, value))
+		return nil
+	}
+	for n := askSpan(len(p.words) - p.pos); n > 0; n-- {
+		text := strings.Join(p.words[p.pos:p.pos+n], " ")
+		if col, cell, ok := p.category(text); ok {
+			p.pos += n
+			p.spec.Filters = append(p.spec.Filters, fmt.Sprintf("%s == %s", exprColumn(col), strconv.Quote(cell)))
+			p.said = append(p.said, fmt.Sprintf("where %s is %s", col, cell))
+			return nil
+		}
+	}
+	return p.errorf("expected a column or a value from the data")
+}
+
+// value reads the rest of a comparison: a number, or words up to the next
+// clause keyword as text.
+func (p *askParser) value() string {
+	w := strings.TrimPrefix(strings.ReplaceAll(p.words[p.pos], ",", ""), "$")
+	if _, err := strconv.ParseFloat(w, 64); err == nil {
+		p.pos++
+		return w
+	}
+	start := p.pos
+	for p.pos++; !p.done() && !p.startsClause(); p.pos++ {
+	}
+	return strconv.Quote(strings.Trim(strings.Join(p.words[start:p.pos], " "), `"'`))
+}
+
+// category finds the text column holding text, ignoring case. A value found
+// in several columns is ambiguous and not matched.
+func (p *askParser) category(text string) (string, string, bool) {
+	numeric := make(map[int]bool)
+	for _, c := range p.data.NumericCols {
+		numeric[c] = true
+	}
+	col, cell := -1, ""
+	for c := range p.data.Headers {
+		if numeric[c] {
+			continue
+		}
+		for _, row := range p.data.Rows {
+			if v := cellValue(row, c); strings.EqualFold(v, text) {
+				if col != -1 && col != c {
+					return "", "", false
+				}
+				col, cell = c, v
+				break
+			}
+		}
+	}
+	if col == -1 {
+		return "", "", false
+	}
+	return p.data.Headers[col], cell, true
+}
+
+// exprColumn writes a column name for a filter expression.
+func exprColumn(name string) string {
+	if strings.ContainsAny(name, " `[]()+-*/<>=!&|,\"'") {
+		return "[" + name + "]"
+	}
+	return name
+}
+
+type AskAnswer struct {
+	Question    string        `json:"question"`
+	Interpreted string        `json:"interpreted"`
+	Spec        AnalyzeSpec   `json:"spec"`
+	Result      AnalyzeResult `json:"result"`
+}
+
+func (a AskAnswer) Table() ([]string, [][]string) {
+	return a.Result.Table()
+}
+
+type askRequest struct {
+	Question string `json:"question"`
+	Dataset  string `json:"dataset,omitempty"`
+}
+
+// askAPIHandler answers a plain-English question about a dataset. The parsed
+// spec is returned with the answer so callers can check how it was read, and
+// can be posted to /api/v1/analyze as-is.
+func askAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var req askRequest
+	switch r.Method {
+	case http.MethodGet:
+		req.Question, req.Dataset = r.URL.Query().Get("q"), r.URL.Query().Get("dataset")
+	case http.MethodPost:
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+			return
+		}
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	data := activeDataset(r)
+	if req.Dataset != "" {
+		var ok bool
+		if data, ok = teamDataset(r, req.Dataset); !ok {
+			writeAPIError(w, http.StatusNotFound, "Unknown dataset")
+			return
+		}
+	}
+	if len(data.Headers) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "No dataset loaded")
+		return
+	}
+
+	spec, interpreted, err := parseQuestion(data, req.Question)
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	spec.Dataset = data.ID
+	result, err := runAnalysis(data, spec, newCalcBudget(r.Context()))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeAPIData(w, r, AskAnswer{Question: req.Question, Interpreted: interpreted, Spec: spec, Result: result})
+}
@@ -0,0 +1,210 @@
+// auth.go
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleAdmin: 3}
+
+func validRole(role string) bool {
+	return roleRank[role] > 0
+}
+
+type User struct {
+	ID     string   `json:"id"`
+	Email  string   `json:"email,omitempty"`
+	Name   string   `json:"name,omitempty"`
+	Role   string   `json:"role"`
+	Groups []string `json:"groups,omitempty"`
+	Via    string   `json:"via"` // oidc, apikey or anonymous
+}
+
+func (u *User) HasRole(role string) bool {
+	return u != nil && roleRank[u.Role] >= roleRank[role]
+}
+
+// anonymousUser is used for every request while sign-on is not configured,
+// which keeps single-user installs working exactly as before.
+var anonymousUser = &User{Name: "anonymous", Role: RoleAdmin, Via: "anonymous"}
+
+func authEnabled() bool {
+	return config.OIDC.Issuer != ""
+}
+
+type userKey struct{}
+
+func currentUser(r *http.Request) *User {
+	if u, ok := r.Context().Value(userKey{}).(*User); ok {
+		return u
+	}
+	if !authEnabled() {
+		return anonymousUser
+	}
+	return nil
+}
+
+// signedInUser returns the SSO user for page headers, or nil when sign-on is
+// off.
+func signedInUser(r *http.Request) *User {
+	if u := currentUser(r); u != nil && u.Via == "oidc" {
+		return u
+	}
+	return nil
+}
+
+// ownerID is what gets recorded as a dataset's owner.
+func ownerID(u *User) string {
+	if u == nil || u.Via == "anonymous" {
+		return ""
+	}
+	if u.Email != "" {
+		return u.Email
+	}
+	return u.ID
+}
+
+// SessionStore keeps signed-in users in the state backend, so any replica
+// can serve any session.
+type SessionStore struct{}
+
+var sessions = &SessionStore{}
+
+const sessionCookie = "dr_session"
+
+func (s *SessionStore) Create(u *User) string {
+	id := newID() + newID()
+	if err := setStateJSON("session/"+id, u, config.OIDC.SessionTTL); err != nil {
+		log.Printf("Could not save session: %v", err)
+	}
+	return id
+}
+
+func (s *SessionStore) Get(id string) *User {
+	var u User
+	if err := getStateJSON("session/"+id, &u); err != nil {
+		if !errors.Is(err, errStateMissing) {
+			log.Printf("Could not read session: %v", err)
+		}
+		return nil
+	}
+	return &u
+}
+
+func (s *SessionStore) Delete(id string) {
+	if err := state.Delete("session/" + id); err != nil {
+		log.Printf("Could not delete session: %v", err)
+	}
+}
+
+// publicPaths are reachable without signing in.
+var publicPaths = map[string]bool{
+	"/login":          true,
+	"/auth/callback":  true,
+	"/logout":         true,
+	"/health":         true,
+	"/upload.css":     true,
+	"/display.css":    true,
+	"/results.css":    true,
+	"/duskrose.woff2": true,
+}
+
+func isAPIPath(path string) bool {
+	return strings.HasPrefix(path, "/api/")
+}
+
+// authenticate resolves the caller from an API key or session cookie and
+// scopes the request to their selected workspace. When sign-on is enabled,
+// anonymous API calls get 401 and browsers are sent to /login.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() {
+			serveInTeam(w, r, anonymousUser, next)
+			return
+		}
+		var user *User
+		if key := apiKeyFromRequest(r); key != "" {
+			if user = apiKeys.Authenticate(key); user == nil {
+				writeAPIError(w, http.StatusUnauthorized, "Invalid API key")
+				return
+			}
+		} else if c, err := r.Cookie(sessionCookie); err == nil {
+			user = sessions.Get(c.Value)
+		}
+		if user == nil && !publicPaths[r.URL.Path] && !strings.HasPrefix(r.URL.Path, "/shared/") && !strings.HasPrefix(r.URL.Path, "/api/v1/shared/") && !strings.HasPrefix(r.URL.Path, "/inbound/") && !strings.HasPrefix(r.URL.Path, "/integrations/") {
+			if isAPIPath(r.URL.Path) {
+				writeAPIError(w, http.StatusUnauthorized, "Authentication required")
+				return
+			}
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		if user == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		serveInTeam(w, r, user, next)
+	})
+}
+
+func serveInTeam(w http.ResponseWriter, r *http.Request, user *User, next http.Handler) {
+	team, err := selectTeam(r, user)
+	if err != nil {
+		writeAPIError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	next.ServeHTTP(w, withTeam(r, user, team))
+}
+
+// requireRole guards a handler with a minimum role.
+func requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !currentUser(r).HasRole(role) {
+			if isAPIPath(r.URL.Path) {
+				writeAPIError(w, http.StatusForbidden, "This action requires the "+role+" role")
+				return
+			}
+			http.Error(w, "This action requires the "+role+" role", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireRoleToModify lets any signed-in user read but requires role for
+// other methods.
+func requireRoleToModify(role string, next http.HandlerFunc) http.HandlerFunc {
+	guarded := requireRole(role, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		guarded(w, r)
+	}
+}
+
+// roleForGroups picks the highest role any of the user's groups maps to.
+func roleForGroups(groups []string) string {
+	role := config.OIDC.DefaultRole
+	for _, g := range groups {
+		if mapped, ok := config.OIDC.RoleMap[g]; ok && roleRank[mapped] > roleRank[role] {
+			role = mapped
+		}
+	}
+	return role
+}
+
+func meAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIData(w, r, currentUser(r))
+}
@@ -0,0 +1,274 @@
+// automation.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The automation API is for no-code platforms such as Zapier and Make: a
+// handful of endpoints under /api/v1/automation that always take an API key
+// and answer with flat JSON objects (or arrays of them), no envelope and no
+// nesting, so every field maps straight onto a step's inputs. Presets are the
+// workspace's scheduled reports, run on demand.
+
+const maxAutomationResults = 50
+
+func automationError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", mimeJSON)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// requireAPIKey admits only API-key callers with at least role, even when
+// sign-on is off, since these endpoints are meant to be reached from outside.
+func requireAPIKey(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if u := currentUser(r); u == nil || u.Via != "apikey" {
+			key := apiKeyFromRequest(r)
+			if key == "" {
+				automationError(w, http.StatusUnauthorized, "Send an API key in the X-API-Key header")
+				return
+			}
+			if u = apiKeys.Authenticate(key); u == nil {
+				automationError(w, http.StatusUnauthorized, "Invalid API key")
+				return
+			}
+			t, err := selectTeam(r, u)
+			if err != nil {
+				automationError(w, http.StatusForbidden, err.Error())
+				return
+			}
+			r = withTeam(r, u, t)
+		}
+		if !currentUser(r).HasRole(role) {
+			automationError(w, http.StatusForbidden, "This action requires the "+role+" role")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// automationKey makes a column name usable as a field name: "Unit Price"
+// becomes "unit_price".
+func automationKey(name string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if underscore && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+			underscore = false
+		} else {
+			underscore = true
+		}
+	}
+	return b.String()
+}
+
+func automationDataset(r *http.Request, data Spreadsheet) map[string]interface{} {
+	return map[string]interface{}{
+		"dataset_id":      data.ID,
+		"file_name":       data.FileName,
+		"rows":            len(data.Rows),
+		"columns":         strings.Join(data.Headers, ", "),
+		"numeric_columns": strings.Join(numericHeaders(data), ", "),
+		"uploaded_at":     data.UploadTime.UTC().Format(time.RFC3339),
+		"workspace":       datasetTeam(data),
+		"link":            inboundBaseURL(r) + "/display?dataset=" + data.ID,
+	}
+}
+
+func numericHeaders(data Spreadsheet) []string {
+	names := make([]string, 0, len(data.NumericCols))
+	for _, col := range data.NumericCols {
+		if col < len(data.Headers) {
+			names = append(names, data.Headers[col])
+		}
+	}
+	return names
+}
+
+// automationRun flattens a run: each calculated column becomes a
+// value_<column> field. The id is stable, for platforms that deduplicate
+// polled items.
+func automationRun(run ReportRun) map[string]interface{} {
+	out := map[string]interface{}{
+		"id":         fmt.Sprintf("%s-%d", run.Report, run.At.UnixNano()),
+		"preset_id":  run.Report,
+		"preset":     run.Name,
+		"status":     run.Status,
+		"detail":     run.Detail,
+		"trigger":    run.Trigger,
+		"ran_at":     run.At.UTC().Format(time.RFC3339),
+		"dataset_id": run.Dataset,
+		"file_name":  run.FileName,
+		"rows":       run.Rows,
+	}
+	for col, v := range run.Values {
+		out["value_"+automationKey(col)] = v
+	}
+	return out
+}
+
+// automationPreset finds a scheduled report by ID or name.
+func automationPreset(r *http.Request) (ScheduledReport, bool) {
+	team, ref := currentTeam(r).ID, r.PathValue("preset")
+	if rep, ok := schedules.Get(ref); ok && rep.Team == team {
+		return rep, true
+	}
+	for _, rep := range schedules.List(team) {
+		if strings.EqualFold(rep.Name, ref) {
+			return rep, true
+		}
+	}
+	return ScheduledReport{}, false
+}
+
+// automationMeAPIHandler lets a platform test the connection.
+func automationMeAPIHandler(w http.ResponseWriter, r *http.Request) {
+	u, t := currentUser(r), currentTeam(r)
+	writeJSON(w, map[string]interface{}{"key": u.Name, "owner": u.Email, "role": u.Role, "workspace": t.ID, "workspace_name": t.Name})
+}
+
+// automationUploadAPIHandler imports a CSV or Excel file from a URL, taken
+// as JSON or form fields: url, and optionally file_name when the URL doesn't
+// end in one.
+func automationUploadAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL      string `json:"url"`
+		FileName string `json:"file_name"`
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == mimeJSON {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			automationError(w, http.StatusBadRequest, fmt.Sprintf("Invalid JSON: %v", err))
+			return
+		}
+	} else {
+		req.URL, req.FileName = r.FormValue("url"), r.FormValue("file_name")
+	}
+	u, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		automationError(w, http.StatusBadRequest, "url must be an http or https link to a CSV or Excel file")
+		return
+	}
+	name := strings.TrimSpace(req.FileName)
+	if name == "" {
+		name = path.Base(u.Path)
+	}
+	if !isInboundAttachment(name) {
+		automationError(w, http.StatusBadRequest, fmt.Sprintf("%q isn't a CSV or Excel file name; set file_name", name))
+		return
+	}
+	a, err := downloadChatFile(chatFile{name: name, url: u.String()})
+	if err != nil {
+		automationError(w, http.StatusBadGateway, fmt.Sprintf("Could not download the file: %v", err))
+		return
+	}
+	owner := ownerID(currentUser(r))
+	data, err := ingestAttachment(a, owner, currentTeam(r).ID, "Imported from "+u.Host+" by automation")
+	if err != nil {
+		automationError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, automationDataset(r, data))
+}
+
+// automationPresetsAPIHandler lists the presets, for choosing one in a step.
+func automationPresetsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	list := []map[string]interface{}{}
+	for _, rep := range schedules.List(currentTeam(r).ID) {
+		list = append(list, map[string]interface{}{
+			"id":        rep.ID,
+			"name":      rep.Name,
+			"source":    rep.Source,
+			"operation": rep.Operation,
+			"columns":   strings.Join(rep.Columns, ", "),
+			"interval":  rep.Interval,
+		})
+	}
+	writeJSON(w, list)
+}
+
+// automationRunAPIHandler runs a preset against the latest upload of its
+// source and returns the values. Nothing is delivered; the result is kept in
+// the report's history.
+func automationRunAPIHandler(w http.ResponseWriter, r *http.Request) {
+	rep, ok := automationPreset(r)
+	if !ok {
+		automationError(w, http.StatusNotFound, "Unknown preset")
+		return
+	}
+	run := ReportRun{Report: rep.ID, Name: rep.Name, Team: rep.Team, At: time.Now(), Trigger: "automation", Status: "failed"}
+	out, err := calculateReport(rep)
+	if err != nil {
+		run.Detail = err.Error()
+	} else {
+		run.Status, run.Detail = "success", "Returned to automation"
+		if len(out.Skipped) > 0 {
+			run.Detail += "; skipped " + strings.Join(out.Skipped, "; ")
+		}
+		run.recordOutcome(out)
+	}
+	if err := schedules.Record(run); err != nil {
+		automationError(w, http.StatusInternalServerError, fmt.Sprintf("Could not record the run: %v", err))
+		return
+	}
+	if run.Status != "success" {
+		automationError(w, http.StatusUnprocessableEntity, run.Detail)
+		return
+	}
+	writeJSON(w, automationRun(run))
+}
+
+// automationLatestAPIHandler returns a preset's most recent successful run,
+// whether it ran on schedule, by hand or from automation.
+func automationLatestAPIHandler(w http.ResponseWriter, r *http.Request) {
+	rep, ok := automationPreset(r)
+	if !ok {
+		automationError(w, http.StatusNotFound, "Unknown preset")
+		return
+	}
+	for _, run := range schedules.Runs(rep.Team, rep.ID) {
+		if run.Status == "success" && run.Values != nil {
+			writeJSON(w, automationRun(run))
+			return
+		}
+	}
+	automationError(w, http.StatusNotFound, "The preset has no results yet")
+}
+
+// automationResultsAPIHandler lists successful runs newest first, optionally
+// for one preset, for platforms that poll for new items.
+func automationResultsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	preset := ""
+	if ref := r.URL.Query().Get("preset"); ref != "" {
+		r.SetPathValue("preset", ref)
+		rep, ok := automationPreset(r)
+		if !ok {
+			automationError(w, http.StatusNotFound, "Unknown preset")
+			return
+		}
+		preset = rep.ID
+	}
+	list := []map[string]interface{}{}
+	for _, run := range schedules.Runs(currentTeam(r).ID, preset) {
+		if len(list) == maxAutomationResults {
+			break
+		}
+		if run.Status == "success" && run.Values != nil {
+			list = append(list, automationRun(run))
+		}
+	}
+	writeJSON(w, list)
+}
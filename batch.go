@@ -0,0 +1,273 @@
+// batch.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxBatchFiles    = 20
+	maxBatchRuleRows = 20
+	watchSettleTime  = 10 * time.Second // leave files alone while they may still be copying
+	validationSuffix = ".validation.json"
+)
+
+// BatchResult is the outcome of checking one file against a mapping
+// template: its layout, type overrides and validation rules.
+type BatchResult struct {
+	File       string            `json:"file"`
+	Template   string            `json:"template"`
+	CheckedAt  time.Time         `json:"checked_at"`
+	Passed     bool              `json:"passed"`
+	Rows       int               `json:"rows"`
+	Errors     []string          `json:"errors,omitempty"`
+	Rules      []BatchRuleResult `json:"rules,omitempty"`
+	Detections DetectionReport   `json:"detections,omitempty"` // how the file was read
+}
+
+type BatchRuleResult struct {
+	Rule       string `json:"rule"`
+	Violations int    `json:"violations"`
+	FirstRows  []int  `json:"first_rows,omitempty"` // 1-based
+}
+
+type BatchReport []BatchResult
+
+func (b BatchReport) Table() ([]string, [][]string) {
+	headers := []string{"File", "Template", "Passed", "Rows", "Errors", "Rule Violations"}
+	rows := make([][]string, len(b))
+	for i, res := range b {
+		var violations []string
+		for _, rule := range res.Rules {
+			if rule.Violations > 0 {
+				violations = append(violations, fmt.Sprintf("%s: %d", rule.Rule, rule.Violations))
+			}
+		}
+		rows[i] = []string{res.File, res.Template, strconv.FormatBool(res.Passed), strconv.Itoa(res.Rows),
+			strings.Join(res.Errors, "; "), strings.Join(violations, "; ")}
+	}
+	return headers, rows
+}
+
+type spreadsheetFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+func isSpreadsheetName(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv", ".xlsx", ".xls", ".dbf":
+		return true
+	}
+	return isFixedWidthFile(name)
+}
+
+// readSpreadsheet parses a file the way an upload with default options is
+// parsed.
+func readSpreadsheet(name string, file spreadsheetFile) (Spreadsheet, error) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return Spreadsheet{}, err
+	}
+	if err := checkMemoryBudget(name, file, size); err != nil {
+		return Spreadsheet{}, err
+	}
+	switch ext := strings.ToLower(filepath.Ext(name)); {
+	case ext == ".csv":
+		return processCSV(file, CSVOptions{})
+	case ext == ".dbf":
+		return processDBF(file, parseRowLimit())
+	case isFixedWidthFile(name):
+		data, _, err := processFixedWidth(file, FixedWidthOptions{}, parseRowLimit())
+		return data, err
+	}
+	if isCompoundFile(file) {
+		return processXLS(file)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return Spreadsheet{}, err
+	}
+	return processExcel(file, ExcelOptions{})
+}
+
+// validateFile checks one file against template t.
+func validateFile(name string, file spreadsheetFile, t MappingTemplate) BatchResult {
+	res := BatchResult{File: filepath.Base(name), Template: t.Name, CheckedAt: time.Now()}
+	data, err := readSpreadsheet(name, file)
+	if err != nil {
+		res.Errors = append(res.Errors, "unreadable: "+err.Error())
+		return res
+	}
+	data.FileName = res.File
+	removeRepeatedHeaders(&data)
+	res.Rows = len(data.Rows)
+	if err := checkRowLimit(len(data.Rows)); err != nil {
+		res.Errors = append(res.Errors, err.Error())
+		return res
+	}
+	if !t.Matches(data) {
+		res.Errors = append(res.Errors, fmt.Sprintf("headers %s don't match the template's %s",
+			strings.Join(data.Headers, ", "), strings.Join(t.MatchHeaders, ", ")))
+		return res
+	}
+	overrides, err := applyMapping(&data, t)
+	if err != nil {
+		res.Errors = append(res.Errors, err.Error())
+		return res
+	}
+	res.Rows = len(data.Rows)
+	data.NumericCols = applyTypeOverrides(detectNumericColumns(data), overrides)
+	res.Detections = append(data.Detections, columnDetections(data, overrides)...)
+	for col, typ := range overrides {
+		bad := 0
+		for _, row := range data.Rows {
+			v := cellValue(row, col)
+			switch {
+			case v == "":
+			case typ == "numeric" && !parsesFloat(v):
+				bad++
+			case typ == "date":
+				if _, ok := parseDate(v); !ok {
+					bad++
+				}
+			}
+		}
+		if bad > 0 {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: %d value(s) aren't %s", data.Headers[col], bad, typ))
+		}
+	}
+	passed := len(res.Errors) == 0
+	for _, rule := range data.Rules {
+		rr := runRule(data, rule, false)
+		if rr.Err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("rule %q: %v", rule.Name, rr.Err))
+			passed = false
+			continue
+		}
+		out := BatchRuleResult{Rule: rule.Name, Violations: rr.Violated}
+		for _, i := range rr.Violations {
+			if len(out.FirstRows) == maxBatchRuleRows {
+				break
+			}
+			out.FirstRows = append(out.FirstRows, i+1)
+		}
+		if rr.Violated > 0 {
+			passed = false
+		}
+		res.Rules = append(res.Rules, out)
+	}
+	res.Passed = passed
+	return res
+}
+
+// batchValidateAPIHandler validates every uploaded "file" part against the
+// template named by "template" without importing anything.
+func batchValidateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(MaxFileSize); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Expected a multipart upload")
+		return
+	}
+	t, ok := mappings.Get(currentTeam(r).ID, r.FormValue("template"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Unknown template")
+		return
+	}
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "Attach one or more files as \"file\"")
+		return
+	}
+	if len(files) > maxBatchFiles {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("At most %d files per batch", maxBatchFiles))
+		return
+	}
+	report := make(BatchReport, 0, len(files))
+	for _, fh := range files {
+		if !isSpreadsheetName(fh.Filename) {
+			report = append(report, BatchResult{File: fh.Filename, Template: t.Name, CheckedAt: time.Now(), Errors: []string{"not a CSV, XLSX or XLS file"}})
+			continue
+		}
+		f, err := fh.Open()
+		if err != nil {
+			report = append(report, BatchResult{File: fh.Filename, Template: t.Name, CheckedAt: time.Now(), Errors: []string{"unreadable: " + err.Error()}})
+			continue
+		}
+		report = append(report, validateFile(fh.Filename, f, t))
+		f.Close()
+	}
+	writeAPIData(w, r, report)
+}
+
+// runWatchFolder validates files dropped into config.Watch.Dir against the
+// configured template. Each result is written next to its file as
+// <file>.validation.json and, when a webhook is set, posted to it. A file is
+// checked again only after it changes.
+func runWatchFolder() {
+	wc := config.Watch
+	if wc.Interval <= 0 {
+		wc.Interval = time.Minute
+	}
+	log.Printf("👀 Watching %s for files to validate against %q", wc.Dir, wc.Template)
+	for {
+		// The folder may be shared by every replica; one scan is enough.
+		if isLeader("watch", 3*wc.Interval) {
+			scanWatchFolder(wc)
+		}
+		time.Sleep(wc.Interval)
+	}
+}
+
+func scanWatchFolder(wc WatchConfig) {
+	t, ok := mappings.Get(wc.Team, wc.Template)
+	if !ok {
+		log.Printf("Watch folder: template %q not found in workspace %q", wc.Template, wc.Team)
+		return
+	}
+	entries, err := os.ReadDir(wc.Dir)
+	if err != nil {
+		log.Printf("Watch folder: %v", err)
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() || !isSpreadsheetName(e.Name()) {
+			continue
+		}
+		path := filepath.Join(wc.Dir, e.Name())
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < watchSettleTime {
+			continue
+		}
+		if done, err := os.Stat(path + validationSuffix); err == nil && !done.ModTime().Before(info.ModTime()) {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			log.Printf("Watch folder: %v", err)
+			continue
+		}
+		res := validateFile(path, f, t)
+		f.Close()
+		if err := writeJSONFile(path+validationSuffix, res); err != nil {
+			log.Printf("Watch folder: writing result for %s: %v", e.Name(), err)
+		}
+		if wc.Webhook != "" {
+			body, _ := json.Marshal(res)
+			if err := deliver(Delivery{Kind: "webhook", Target: wc.Webhook}, res.File, "application/json", body); err != nil {
+				log.Printf("Watch folder: webhook for %s failed: %v", e.Name(), err)
+			}
+		}
+	}
+}
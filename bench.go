@@ -0,0 +1,336 @@
+// bench.go
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /admin/bench runs the upload pipeline and common calculations over
+// synthetic datasets generated from a fixed seed, so numbers from different
+// releases on the same hardware can be compared. Each stage runs once to warm
+// up before the timed runs.
+
+const (
+	maxBenchRows = 1_000_000
+	maxBenchRuns = 20
+	benchSeed    = 20240601
+)
+
+var defaultBenchSizes = []int{1_000, 10_000, 200_000}
+
+// benchRunning keeps two benchmarks from skewing each other's numbers.
+var benchRunning sync.Mutex
+
+type BenchStage struct {
+	Size       int     `json:"rows"`
+	Stage      string  `json:"stage"`
+	Runs       int     `json:"runs"`
+	MedianMS   float64 `json:"median_ms"`
+	BestMS     float64 `json:"best_ms"`
+	RowsPerSec float64 `json:"rows_per_sec"`
+	MBPerSec   float64 `json:"mb_per_sec,omitempty"` // parsing only
+	AllocBytes uint64  `json:"alloc_bytes_per_run"`
+	Allocs     uint64  `json:"allocs_per_run"`
+}
+
+type BenchReport struct {
+	StartedAt  time.Time    `json:"started_at"`
+	Duration   string       `json:"duration"`
+	GoVersion  string       `json:"go_version"`
+	Revision   string       `json:"revision,omitempty"`
+	CPUs       int          `json:"cpus"`
+	HeapInUse  uint64       `json:"heap_in_use_bytes"`
+	Stages     []BenchStage `json:"stages"`
+	Seed       int64        `json:"seed"`
+	Sizes      []int        `json:"sizes"`
+	RunsPerSet int          `json:"runs"`
+}
+
+func (rep BenchReport) Table() ([]string, [][]string) {
+	headers := []string{"rows", "stage", "runs", "median_ms", "best_ms", "rows_per_sec", "mb_per_sec", "alloc_bytes_per_run", "allocs_per_run"}
+	rows := make([][]string, len(rep.Stages))
+	for i, s := range rep.Stages {
+		rows[i] = []string{strconv.Itoa(s.Size), s.Stage, strconv.Itoa(s.Runs), benchFloat(s.MedianMS), benchFloat(s.BestMS),
+			benchFloat(s.RowsPerSec), benchFloat(s.MBPerSec), strconv.FormatUint(s.AllocBytes, 10), strconv.FormatUint(s.Allocs, 10)}
+	}
+	return headers, rows
+}
+
+func benchFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// syntheticCSV makes a dataset shaped like a typical upload: an ID, a date,
+// two categories, three numeric measures (one with gaps) and free text.
+func syntheticCSV(rows int) []byte {
+	rng := rand.New(rand.NewSource(benchSeed))
+	regions := []string{"Gauteng", "Western Cape", "KwaZulu-Natal", "Eastern Cape", "Limpopo", "Free State"}
+	products := []string{"Widget", "Gadget", "Sprocket", "Flange", "Bracket", "Gasket", "Valve", "Coupling"}
+	words := []string{"urgent", "repeat", "order", "client", "delayed", "priority", "standard", "return", "bulk", "sample"}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"ID", "Date", "Region", "Product", "Quantity", "Price", "Discount", "Comment"})
+	for i := 0; i < rows; i++ {
+		discount := ""
+		if rng.Intn(4) > 0 {
+			discount = strconv.FormatFloat(rng.Float64()*0.3, 'f', 3, 64)
+		}
+		comment := words[rng.Intn(len(words))] + " " + words[rng.Intn(len(words))]
+		w.Write([]string{
+			strconv.Itoa(i + 1),
+			start.AddDate(0, 0, rng.Intn(1500)).Format("2006-01-02"),
+			regions[rng.Intn(len(regions))],
+			products[rng.Intn(len(products))],
+			strconv.Itoa(1 + rng.Intn(50)),
+			strconv.FormatFloat(5+rng.ExpFloat64()*120, 'f', 2, 64),
+			discount,
+			comment,
+		})
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// benchStage runs fn once to warm up and then runs times, measuring each.
+func benchStage(size int, name string, runs int, bytesIn int, fn func() error) (BenchStage, error) {
+	if err := fn(); err != nil {
+		return BenchStage{}, fmt.Errorf("%s at %d rows: %w", name, size, err)
+	}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	times := make([]float64, runs)
+	for i := range times {
+		t := time.Now()
+		if err := fn(); err != nil {
+			return BenchStage{}, fmt.Errorf("%s at %d rows: %w", name, size, err)
+		}
+		times[i] = float64(time.Since(t)) / float64(time.Millisecond)
+	}
+	runtime.ReadMemStats(&after)
+	slices.Sort(times)
+	s := BenchStage{Size: size, Stage: name, Runs: runs, MedianMS: times[len(times)/2], BestMS: times[0],
+		AllocBytes: (after.TotalAlloc - before.TotalAlloc) / uint64(runs), Allocs: (after.Mallocs - before.Mallocs) / uint64(runs)}
+	if s.MedianMS > 0 {
+		s.RowsPerSec = float64(size) / (s.MedianMS / 1000)
+		if bytesIn > 0 {
+			s.MBPerSec = float64(bytesIn) / (1 << 20) / (s.MedianMS / 1000)
+		}
+	}
+	return s, nil
+}
+
+func runBench(sizes []int, runs int) (BenchReport, error) {
+	rep := BenchReport{StartedAt: time.Now(), GoVersion: runtime.Version(), CPUs: runtime.GOMAXPROCS(0),
+		Seed: benchSeed, Sizes: sizes, RunsPerSet: runs}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				rep.Revision = s.Value
+			}
+		}
+	}
+	add := func(s BenchStage, err error) error {
+		if err == nil {
+			rep.Stages = append(rep.Stages, s)
+		}
+		return err
+	}
+	for _, size := range sizes {
+		raw := syntheticCSV(size)
+		var data Spreadsheet
+		parse := func() error {
+			var err error
+			data, err = processCSV(bytes.NewReader(raw), CSVOptions{})
+			if err != nil {
+				return err
+			}
+			removeRepeatedHeaders(&data)
+			normalizeNumbers(&data, NumberFormat{})
+			data.NumericCols = detectNumericColumns(data)
+			return nil
+		}
+		if err := add(benchStage(size, "parse", runs, len(raw), parse)); err != nil {
+			return rep, err
+		}
+		data.ID, data.Version = "bench", 1
+		profile := func() error {
+			computeProfile(data, nil)
+			return nil
+		}
+		if err := add(benchStage(size, "profile", runs, 0, profile)); err != nil {
+			return rep, err
+		}
+		// "calculate" parses the column each time, as calculations on
+		// unsaved data do; "kernel" is the statistic alone, on a column
+		// already parsed, as for stored datasets.
+		price := columnRef(data, "Price")
+		column := func() error {
+			numericValues(data, price)
+			return nil
+		}
+		if err := add(benchStage(size, "parse column", runs, 0, column)); err != nil {
+			return rep, err
+		}
+		values := numericValues(data, price)
+		for _, op := range []string{"sum", "average", "min", "median", "std", "percentile"} {
+			calc := func() error {
+				_, err := performCalculation(data, price, op, nil)
+				return err
+			}
+			if err := add(benchStage(size, "calculate "+op, runs, 0, calc)); err != nil {
+				return rep, err
+			}
+			kernel := func() error {
+				_, err := calculateValues(values, op, nil)
+				return err
+			}
+			if err := add(benchStage(size, "kernel "+op, runs, 0, kernel)); err != nil {
+				return rep, err
+			}
+		}
+		spec := AnalyzeSpec{
+			Derived: []DerivedColumn{{Name: "Revenue", Expr: "Quantity * Price"}},
+			Filters: []string{"Quantity > 5"},
+			GroupBy: []string{"Region", "Product"},
+			Metrics: []AnalyzeMetric{{Column: "Revenue", Operation: "sum"}, {Column: "Price", Operation: "median"}},
+		}
+		analyze := func() error {
+			_, err := runAnalysis(data, spec, calcBudget{})
+			return err
+		}
+		if err := add(benchStage(size, "analyze", runs, 0, analyze)); err != nil {
+			return rep, err
+		}
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	rep.HeapInUse = mem.HeapInuse
+	rep.Duration = time.Since(rep.StartedAt).Round(time.Millisecond).String()
+	return rep, nil
+}
+
+func parseBenchSizes(s string) ([]int, error) {
+	if strings.TrimSpace(s) == "" {
+		return defaultBenchSizes, nil
+	}
+	var sizes []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.ReplaceAll(strings.TrimSpace(part), "_", "")
+		if part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 1 || n > maxBenchRows {
+			return nil, fmt.Errorf("sizes must be row counts between 1 and %d", maxBenchRows)
+		}
+		sizes = append(sizes, n)
+	}
+	if len(sizes) == 0 {
+		return defaultBenchSizes, nil
+	}
+	return sizes, nil
+}
+
+// benchHandler shows the form and, on POST, runs the benchmark. Add
+// format=json (or csv) to get the numbers for comparing releases.
+func benchHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	sizesText := r.FormValue("sizes")
+	runsText := r.FormValue("runs")
+	if runsText == "" {
+		runsText = "5"
+	}
+	var sections []ReportSection
+	if r.Method == http.MethodPost {
+		sizes, err := parseBenchSizes(sizesText)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		runs, err := strconv.Atoi(runsText)
+		if err != nil || runs < 1 || runs > maxBenchRuns {
+			http.Error(w, fmt.Sprintf("Runs must be between 1 and %d", maxBenchRuns), http.StatusBadRequest)
+			return
+		}
+		if !benchRunning.TryLock() {
+			http.Error(w, "A benchmark is already running", http.StatusConflict)
+			return
+		}
+		rep, err := runBench(sizes, runs)
+		benchRunning.Unlock()
+		if err != nil {
+			http.Error(w, "Benchmark failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if f := r.FormValue("format"); f == "json" || f == "csv" {
+			if f == "csv" {
+				r.Header.Set("Accept", mimeCSV)
+			} else {
+				r.Header.Set("Accept", mimeJSON)
+			}
+			writeAPIData(w, r, rep)
+			return
+		}
+		revision := rep.Revision
+		if revision == "" {
+			revision = "unknown"
+		}
+		results := ReportSection{
+			Title:   "Results",
+			Headers: []string{"Rows", "Stage", "Median", "Best", "Rows/s", "MB/s", "Alloc/run", "Allocs/run"},
+			Notes: []string{fmt.Sprintf("%s, %d CPUs, revision %s. %d timed runs per stage after one warm-up run; took %s. Heap in use afterwards: %s.",
+				rep.GoVersion, rep.CPUs, revision, rep.RunsPerSet, rep.Duration, formatFileSize(int64(rep.HeapInUse)))},
+		}
+		for _, s := range rep.Stages {
+			mbps := ""
+			if s.MBPerSec > 0 {
+				mbps = strconv.FormatFloat(s.MBPerSec, 'f', 1, 64)
+			}
+			results.Rows = append(results.Rows, []string{strconv.Itoa(s.Size), s.Stage,
+				strconv.FormatFloat(s.MedianMS, 'f', 2, 64) + " ms", strconv.FormatFloat(s.BestMS, 'f', 2, 64) + " ms",
+				strconv.FormatFloat(s.RowsPerSec, 'f', 0, 64), mbps, formatFileSize(int64(s.AllocBytes)), strconv.FormatUint(s.Allocs, 10)})
+		}
+		sections = append(sections, results)
+	}
+	if sizesText == "" {
+		var parts []string
+		for _, n := range defaultBenchSizes {
+			parts = append(parts, strconv.Itoa(n))
+		}
+		sizesText = strings.Join(parts, ",")
+	}
+	sections = append(sections, ReportSection{
+		Title: "Run Benchmark",
+		Notes: []string{"Parses, profiles, calculates and analyzes synthetic sales data generated from a fixed seed, so runs are comparable between releases on the same machine. It uses this server's CPU while it runs."},
+		Form: &ReportForm{
+			Action: "/admin/bench",
+			Submit: "⏱️ Run",
+			Fields: []FormField{
+				{Name: "sizes", Label: "Dataset sizes (rows, comma-separated)", Value: sizesText},
+				{Name: "runs", Label: "Timed runs per stage", Type: "number", Value: runsText},
+				{Name: "format", Label: "Output", Type: "select", Options: []FormOption{
+					{Value: "", Label: "Page", Selected: r.FormValue("format") == ""},
+					{Value: "json", Label: "JSON", Selected: r.FormValue("format") == "json"},
+					{Value: "csv", Label: "CSV", Selected: r.FormValue("format") == "csv"},
+				}},
+			},
+		},
+	})
+	renderReport(w, ReportPage{Title: "Benchmark", Subtitle: "Parsing and calculation throughput", Sections: sections})
+}
@@ -0,0 +1,46 @@
+// budget.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// calcBudget is how long one request may spend calculating before it stops
+// and returns what it has, marked incomplete. It is checked between steps (a
+// column, a group), so one slow step can overrun it; the route's Timeout
+// still bounds the whole request.
+type calcBudget struct {
+	deadline time.Time
+	limit    time.Duration
+}
+
+// budgetMargin leaves time under a request's deadline to render what was
+// calculated.
+const budgetMargin = 2 * time.Second
+
+// newCalcBudget starts config.CalcBudget, cut short to fit ctx's deadline.
+// A zero CalcBudget means no budget beyond that deadline.
+func newCalcBudget(ctx context.Context) calcBudget {
+	b := calcBudget{limit: config.CalcBudget}
+	if b.limit > 0 {
+		b.deadline = time.Now().Add(b.limit)
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		dl = dl.Add(-budgetMargin)
+		if b.deadline.IsZero() || dl.Before(b.deadline) {
+			b.deadline = dl
+			b.limit = time.Until(dl).Round(time.Second)
+		}
+	}
+	return b
+}
+
+func (b calcBudget) Spent() bool {
+	return !b.deadline.IsZero() && !time.Now().Before(b.deadline)
+}
+
+func (b calcBudget) String() string {
+	return fmt.Sprintf("time budget of %s", b.limit)
+}
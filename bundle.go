@@ -0,0 +1,97 @@
+// bundle.go
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+type Provenance struct {
+	DatasetID   string    `json:"dataset_id"`
+	ParentID    string    `json:"parent_id,omitempty"`
+	Derivation  string    `json:"derivation,omitempty"`
+	SourceFile  string    `json:"source_file"`
+	SourceSize  int64     `json:"source_size_bytes"`
+	SHA256      string    `json:"source_sha256"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+	GeneratedAt time.Time `json:"generated_at"`
+	AppVersion  string    `json:"app_version"`
+	Rows        int       `json:"rows"`
+	Columns     int       `json:"columns"`
+}
+
+// writeBundle writes a ZIP archive holding everything needed to reproduce
+// an analysis: the data as currently held, its profile, the latest results,
+// the transformation pipeline and where the data came from.
+func writeBundle(w io.Writer, data Spreadsheet, results ResultPage) error {
+	zw := zip.NewWriter(w)
+
+	add := func(name string, write func(io.Writer) error) error {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		return write(f)
+	}
+	addJSON := func(name string, v interface{}) error {
+		return add(name, func(f io.Writer) error {
+			enc := json.NewEncoder(f)
+			enc.SetIndent("", "  ")
+			return enc.Encode(v)
+		})
+	}
+
+	if err := add("dataset.csv", func(f io.Writer) error {
+		return writeCSV(f, data.Headers, data.Rows)
+	}); err != nil {
+		return err
+	}
+	if err := addJSON("profile.json", profileFor(data)); err != nil {
+		return err
+	}
+	if err := add("dictionary.csv", func(f io.Writer) error {
+		headers, rows := dataDictionary(data)
+		return writeCSV(f, headers, rows)
+	}); err != nil {
+		return err
+	}
+	if len(results.Results) > 0 {
+		headers, rows := resultsTable(results)
+		if err := add("results.csv", func(f io.Writer) error {
+			return writeCSV(f, headers, rows)
+		}); err != nil {
+			return err
+		}
+		if err := add("results_dictionary.csv", func(f io.Writer) error {
+			headers, rows := resultsDictionary(results)
+			return writeCSV(f, headers, rows)
+		}); err != nil {
+			return err
+		}
+	}
+	pipeline := data.Pipeline
+	if pipeline == nil {
+		pipeline = []TransformStep{}
+	}
+	if err := addJSON("pipeline.json", pipeline); err != nil {
+		return err
+	}
+	if err := addJSON("provenance.json", Provenance{
+		DatasetID:   data.ID,
+		ParentID:    data.ParentID,
+		Derivation:  data.Derivation,
+		SourceFile:  data.FileName,
+		SourceSize:  data.FileSize,
+		SHA256:      data.Checksum,
+		UploadedAt:  data.UploadTime,
+		GeneratedAt: time.Now(),
+		AppVersion:  appVersion,
+		Rows:        len(data.Rows),
+		Columns:     len(data.Headers),
+	}); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,359 @@
+// calcapi.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// The upload, calculate and results API lets scripts do what the upload and
+// display pages do: POST /api/v1/upload takes the same multipart form as the
+// upload page, POST /api/v1/calculate runs operations over an upload's
+// columns, and GET /api/v1/results/{id}/export downloads a calculation's
+// results. Calculations are kept in state for config.ResultTTL.
+
+// UploadedFile describes a stored upload to the API.
+type UploadedFile struct {
+	ID             string          `json:"file_id"`
+	FileName       string          `json:"file_name"`
+	Rows           int             `json:"rows"`
+	Headers        []string        `json:"headers"`
+	ColumnIDs      []string        `json:"column_ids"`
+	NumericColumns []string        `json:"numeric_columns"`
+	Tier           RowTier         `json:"tier"`
+	Version        int             `json:"version"`
+	Notes          []string        `json:"notes,omitempty"`
+	Detections     DetectionReport `json:"detections,omitempty"`
+}
+
+func uploadedFile(data Spreadsheet) UploadedFile {
+	return UploadedFile{
+		ID:             data.ID,
+		FileName:       data.FileName,
+		Rows:           len(data.Rows),
+		Headers:        data.Headers,
+		ColumnIDs:      data.ColumnIDs,
+		NumericColumns: numericHeaders(data),
+		Tier:           datasetTier(data),
+		Version:        data.Version,
+		Notes:          data.Notes,
+		Detections:     data.Detections,
+	}
+}
+
+func uploadAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(MaxFileSize); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Expected a multipart upload of at most "+formatFileSize(MaxFileSize))
+		return
+	}
+	data, err := receiveFile(r)
+	if err != nil {
+		writeAPIError(w, errorStatus(err, http.StatusBadRequest), err.Error())
+		return
+	}
+	writeAPIData(w, r, uploadedFile(data))
+}
+
+// CalculateOperation is one operation of a calculate request, written as
+// its name alone or as {"operation": ..., "params": {...}}.
+type CalculateOperation struct {
+	Operation string                     `json:"operation"`
+	Params    map[string]json.RawMessage `json:"params,omitempty"`
+}
+
+func (o *CalculateOperation) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &o.Operation)
+	}
+	type plain CalculateOperation
+	return json.Unmarshal(b, (*plain)(o))
+}
+
+type CalculateRequest struct {
+	FileID     string               `json:"file_id"`
+	Columns    []string             `json:"columns"`
+	Operations []CalculateOperation `json:"operations"`
+	Decimal    string               `json:"decimal,omitempty"`  // on, off or auto (default)
+	Rounding   string               `json:"rounding,omitempty"` // policy for exact decimal results
+	Places     *int                 `json:"places,omitempty"`
+	Strict     bool                 `json:"strict,omitempty"`
+}
+
+// CalculatedValue is one operation on one column. Value is null when the
+// result isn't a finite number.
+type CalculatedValue struct {
+	Column      string            `json:"column"`
+	Operation   string            `json:"operation"`
+	Params      OpParams          `json:"params,omitempty"`
+	Value       *float64          `json:"value"`
+	Exact       string            `json:"exact,omitempty"`
+	Diagnostics ColumnDiagnostics `json:"diagnostics"`
+}
+
+// CalculationRun is the outcome of a calculate request, kept under ID.
+type CalculationRun struct {
+	ID         string            `json:"id"`
+	FileID     string            `json:"file_id"`
+	FileName   string            `json:"file_name"`
+	Version    int               `json:"version"`
+	Workspace  string            `json:"workspace"`
+	CreatedAt  time.Time         `json:"created_at"`
+	ExpiresAt  time.Time         `json:"expires_at"`
+	Results    []CalculatedValue `json:"results"`
+	Warnings   []string          `json:"warnings,omitempty"`
+	Rounding   []string          `json:"rounding,omitempty"`
+	Incomplete []string          `json:"incomplete,omitempty"` // "operation(column)" not reached within the time budget
+	Budget     string            `json:"budget,omitempty"`
+	Export     string            `json:"export"`
+}
+
+func (run CalculationRun) Table() ([]string, [][]string) {
+	headers := []string{"column", "operation", "params", "value", "exact"}
+	rows := make([][]string, len(run.Results))
+	for i, res := range run.Results {
+		var params, value string
+		if op, ok := lookupOperation(res.Operation); ok {
+			params = describeParams(op, res.Params)
+		}
+		if res.Value != nil {
+			value = strconv.FormatFloat(*res.Value, 'f', -1, 64)
+		}
+		rows[i] = []string{res.Column, res.Operation, params, value, res.Exact}
+	}
+	return headers, rows
+}
+
+func calculateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var req CalculateRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if req.FileID == "" || len(req.Columns) == 0 || len(req.Operations) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "file_id, columns and operations are required")
+		return
+	}
+	data, ok := teamDataset(r, req.FileID)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Unknown file")
+		return
+	}
+	for _, ref := range req.Columns {
+		if columnRef(data, ref) == -1 {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Unknown column %q", ref))
+			return
+		}
+	}
+	places := -1
+	if req.Places != nil {
+		places = *req.Places
+	}
+	rounding, err := newRounding(req.Rounding, places)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	decimal := req.Decimal
+	switch decimal {
+	case "on", "off":
+	case "", "auto":
+		decimal = ""
+	default:
+		writeAPIError(w, http.StatusBadRequest, "decimal must be on, off or auto")
+		return
+	}
+
+	calcs := make([]Calculation, len(req.Operations))
+	for i, o := range req.Operations {
+		calc := Calculation{Columns: req.Columns, Decimal: decimal, Rounding: rounding, Strict: req.Strict}
+		if calc.Operation, ok = lookupOperation(o.Operation); !ok {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported operation %q", o.Operation))
+			return
+		}
+		raw, err := jsonParams(o.Params)
+		if err == nil {
+			calc.Params, err = calc.Operation.ResolveParams(raw)
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("%s: %v", o.Operation, err))
+			return
+		}
+		calcs[i] = calc
+	}
+
+	run := CalculationRun{ID: newID() + newID(), FileID: data.ID, FileName: data.FileName, Version: data.Version,
+		Workspace: datasetTeam(data), CreatedAt: time.Now()}
+	run.ExpiresAt = run.CreatedAt.Add(config.ResultTTL)
+	run.Export = "/api/v1/results/" + run.ID + "/export"
+	budget := newCalcBudget(r.Context())
+	for _, calc := range calcs {
+		page, err := runCalculation(data, calc, budget)
+		if errorStatus(err, 0) == http.StatusUnprocessableEntity {
+			writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		run.addPage(page)
+	}
+	if len(run.Results) == 0 && len(run.Incomplete) == 0 {
+		msg := "No valid calculations"
+		if len(run.Warnings) > 0 {
+			msg += ": " + strings.Join(run.Warnings, "; ")
+		}
+		writeAPIError(w, http.StatusBadRequest, msg)
+		return
+	}
+	if err := setStateJSON("results/"+run.ID, run, config.ResultTTL); err != nil {
+		log.Printf("Could not keep calculation %s: %v", run.ID, err)
+		run.Export = ""
+	}
+	accessLog.Record(r, data.ID, "api", fmt.Sprintf("calculated %d operations on %d columns", len(calcs), len(req.Columns)))
+	writeAPIData(w, r, run)
+}
+
+// addPage adds one operation's results, naming the operation in its
+// warnings and incomplete columns.
+func (run *CalculationRun) addPage(page ResultPage) {
+	for _, res := range page.Results {
+		v := &res.Value
+		if math.IsNaN(res.Value) || math.IsInf(res.Value, 0) {
+			v = nil
+		}
+		run.Results = append(run.Results, CalculatedValue{Column: res.Col, Operation: page.OpName, Params: page.ParamValues,
+			Value: v, Exact: res.Exact, Diagnostics: res.Diagnostics})
+	}
+	for _, warning := range page.Warnings {
+		run.Warnings = append(run.Warnings, page.OpName+": "+warning)
+	}
+	if page.Rounding != "" {
+		run.Rounding = append(run.Rounding, page.OpName+": "+page.Rounding)
+	}
+	for _, col := range page.Incomplete {
+		run.Incomplete = append(run.Incomplete, page.OpName+"("+col+")")
+	}
+	if page.Budget != "" {
+		run.Budget = page.Budget
+	}
+}
+
+// calculationRun loads a kept calculation of the request's workspace.
+func calculationRun(r *http.Request, id string) (CalculationRun, bool) {
+	var run CalculationRun
+	if err := getStateJSON("results/"+id, &run); err != nil {
+		if !errors.Is(err, errStateMissing) {
+			log.Printf("Could not read calculation %s: %v", id, err)
+		}
+		return run, false
+	}
+	return run, run.Workspace == currentTeam(r).ID
+}
+
+func resultsExportAPIHandler(w http.ResponseWriter, r *http.Request) {
+	run, ok := calculationRun(r, r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Unknown or expired results")
+		return
+	}
+	base := exportBaseName(run.FileName) + "_results"
+	attach := func(ext string) {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, base, ext))
+	}
+	format := r.URL.Query().Get("format")
+	accessLog.Record(r, run.FileID, "export", exportLabel(format)+" of results")
+	switch format {
+	case "", "csv":
+		headers, rows := run.Table()
+		w.Header().Set("Content-Type", mimeCSV)
+		attach("csv")
+		if err := writeCSV(w, headers, rows); err != nil {
+			log.Printf("Export error: %v", err)
+		}
+	case "json":
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(run); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Failed to encode results")
+			return
+		}
+		w.Header().Set("Content-Type", mimeJSON)
+		attach("json")
+		w.Write(buf.Bytes())
+	case "xlsx":
+		f, err := buildResultsXLSX(run)
+		if err != nil {
+			log.Printf("Export error: %v", err)
+			writeAPIError(w, http.StatusInternalServerError, "Failed to build workbook")
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		attach("xlsx")
+		if _, err := f.WriteTo(w); err != nil {
+			log.Printf("Export error: %v", err)
+		}
+	default:
+		writeAPIError(w, http.StatusBadRequest, "format must be csv, xlsx or json")
+	}
+}
+
+// buildResultsXLSX lays out a calculation's results as the Summary sheet of
+// the styled export does, one row per operation and column.
+func buildResultsXLSX(run CalculationRun) (*excelize.File, error) {
+	f := excelize.NewFile()
+	if err := f.SetSheetName("Sheet1", summarySheet); err != nil {
+		return nil, err
+	}
+	info := [][]interface{}{
+		{"File", run.FileName},
+		{"Version", run.Version},
+		{"Calculated", run.CreatedAt.Format("January 2, 2006 at 3:04 PM")},
+	}
+	for i, row := range info {
+		cell, _ := excelize.CoordinatesToCellName(1, i+1)
+		if err := f.SetSheetRow(summarySheet, cell, &row); err != nil {
+			return nil, err
+		}
+	}
+	headerStyle, err := f.NewStyle(&excelize.Style{
+		Font: &excelize.Font{Bold: true, Color: "FFFFFF"},
+		Fill: excelize.Fill{Type: "pattern", Color: []string{"667EEA"}, Pattern: 1},
+	})
+	if err != nil {
+		return nil, err
+	}
+	start := len(info) + 2
+	cell, _ := excelize.CoordinatesToCellName(1, start)
+	if err := f.SetSheetRow(summarySheet, cell, &[]interface{}{"Column", "Operation", "Params", "Value", "Exact"}); err != nil {
+		return nil, err
+	}
+	if err := f.SetCellStyle(summarySheet, cell, "E"+strconv.Itoa(start), headerStyle); err != nil {
+		return nil, err
+	}
+	_, rows := run.Table()
+	for i, res := range run.Results {
+		values := []interface{}{rows[i][0], rows[i][1], rows[i][2], nil, res.Exact}
+		if res.Value != nil {
+			values[3] = *res.Value
+		}
+		cell, _ := excelize.CoordinatesToCellName(1, start+i+1)
+		if err := f.SetSheetRow(summarySheet, cell, &values); err != nil {
+			return nil, err
+		}
+	}
+	if err := f.SetColWidth(summarySheet, "A", "E", 20); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
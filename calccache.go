@@ -0,0 +1,63 @@
+// calccache.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Calculations on a stored dataset are memoized by dataset ID and version
+// for config.CalcCacheTTL, so reopening a result, a dashboard refresh or a
+// scheduled report doesn't redo the work. Entries live in the state backend:
+// with Redis, replicas share them and they survive restarts. Only call this
+// with a dataset as stored; a filtered or derived copy keeps its parent's ID
+// and version but not its rows.
+
+func calcCacheKey(data Spreadsheet, col int, op string, params OpParams) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\x00%d\x00%d\x00%s\x00%s", data.ID, data.Version, col, data.Headers[col], op)
+	for _, name := range names {
+		fmt.Fprintf(&b, "\x00%s=%v", name, params[name])
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return "calc/" + data.ID + "/" + hex.EncodeToString(sum[:16])
+}
+
+// memoizedCalculation is performCalculation with the cache in front, and
+// the parsed column cache behind it. Failures aren't cached. Operations the
+// column summary answers (see colstats.go) skip both.
+func memoizedCalculation(data Spreadsheet, col int, op string, params OpParams) (float64, error) {
+	if col < 0 || col >= len(data.Headers) {
+		return performCalculation(data, col, op, params)
+	}
+	if v, ok := summaryCalculation(data, col, op); ok {
+		return v, nil
+	}
+	if config.CalcCacheTTL <= 0 || data.ID == "" {
+		return calculateValues(storedValues(data, col), op, params)
+	}
+	key := calcCacheKey(data, col, op, params)
+	if b, err := state.Get(key); err == nil {
+		if v, err := strconv.ParseFloat(string(b), 64); err == nil {
+			return v, nil
+		}
+	}
+	v, err := calculateValues(storedValues(data, col), op, params)
+	if err != nil {
+		return v, err
+	}
+	if err := state.Set(key, []byte(strconv.FormatFloat(v, 'g', -1, 64)), config.CalcCacheTTL); err != nil {
+		log.Printf("Could not cache %s of %s: %v", op, data.ID, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,117 @@
+// calcqueue.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Heavy analyses run at most config.CalcPerUser at a time for each user (or
+// client address while sign-on is off), across every route marked Queued.
+// Further requests wait their turn, up to config.CalcQueue of them for
+// config.CalcQueueWait; beyond that the user is told their previous analysis
+// is still running. A slot is held until the handler really returns, so
+// resubmitting after a timeout doesn't start the same work twice.
+
+type calcGate struct {
+	slots   chan struct{}
+	waiting int
+	refs    int
+}
+
+type calcQueue struct {
+	mu    sync.Mutex
+	gates map[string]*calcGate
+}
+
+var calcJobs = &calcQueue{gates: make(map[string]*calcGate)}
+
+// clientKey identifies who a request is counted against: the signed-in
+// user, or the client address.
+func clientKey(r *http.Request) string {
+	if u := currentUser(r); u != nil && u.Via != "anonymous" {
+		return u.ID
+	}
+	return clientIP(r)
+}
+
+func (q *calcQueue) gate(key string) *calcGate {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	g, ok := q.gates[key]
+	if !ok {
+		n := config.CalcPerUser
+		if n < 1 {
+			n = 1
+		}
+		g = &calcGate{slots: make(chan struct{}, n)}
+		q.gates[key] = g
+	}
+	g.refs++
+	return g
+}
+
+func (q *calcQueue) done(key string, g *calcGate) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if g.refs--; g.refs == 0 {
+		delete(q.gates, key)
+	}
+}
+
+// acquire waits for one of the caller's slots and returns the func that
+// gives it back, or ok false when the queue is full, the wait ran out or the
+// client went away.
+func (q *calcQueue) acquire(r *http.Request) (release func(), ok bool) {
+	key := clientKey(r)
+	g := q.gate(key)
+	release = func() {
+		<-g.slots
+		q.done(key, g)
+	}
+	select {
+	case g.slots <- struct{}{}:
+		return release, true
+	default:
+	}
+	q.mu.Lock()
+	if g.waiting >= config.CalcQueue {
+		q.mu.Unlock()
+		q.done(key, g)
+		return nil, false
+	}
+	g.waiting++
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		g.waiting--
+		q.mu.Unlock()
+	}()
+	timer := time.NewTimer(config.CalcQueueWait)
+	defer timer.Stop()
+	select {
+	case g.slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	q.done(key, g)
+	return nil, false
+}
+
+// refuseCalculation answers a request that couldn't get a slot.
+func refuseCalculation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(config.CalcQueueWait.Seconds())+1))
+	msg := "Your previous analysis is still running; try again once it has finished"
+	if config.CalcPerUser > 1 {
+		msg = fmt.Sprintf("Your previous %d analyses are still running; try again once one has finished", config.CalcPerUser)
+	}
+	if isAPIPath(r.URL.Path) {
+		writeAPIError(w, http.StatusTooManyRequests, msg)
+	} else {
+		http.Error(w, msg, http.StatusTooManyRequests)
+	}
+}
@@ -3,63 +3,126 @@ package main
 
 import (
     "strings"   
-    "strconv"   
     "math"
 	"fmt"     
+	"slices"
 )
 
-func performCalculation(data Spreadsheet, colIndex int, op string) (float64, error) {
-	var values []float64
+func performCalculation(data Spreadsheet, colIndex int, op string, params OpParams) (float64, error) {
+	return calculateValues(numericValues(data, colIndex), op, params)
+}
+
+// calculateValues runs op on a parsed column.
+func calculateValues(values []float64, op string, params OpParams) (float64, error) {
+	operation, ok := lookupOperation(op)
+	if !ok {
+		return 0, fmt.Errorf("unsupported operation")
+	}
+	if params == nil {
+		var err error
+		if params, err = operation.ResolveParams(nil); err != nil {
+			return 0, err
+		}
+	}
+	if len(values) == 0 {
+		return 0, fmt.Errorf("no numeric values")
+	}
+	result, err := operation.Compute(values, params)
+	if err == nil && (math.IsNaN(result) || math.IsInf(result, 0)) {
+		return 0, fmt.Errorf("result is out of range for %s", op)
+	}
+	return result, err
+}
+
+// numericValues parses a column into a contiguous slice, skipping cells
+// that aren't finite numbers.
+func numericValues(data Spreadsheet, colIndex int) []float64 {
+	values := make([]float64, 0, len(data.Rows))
 	for _, row := range data.Rows {
 		if colIndex >= len(row) {
 			continue
 		}
-		val := strings.TrimSpace(row[colIndex])
+		val := row[colIndex]
+		if val != "" && (val[0] <= ' ' || val[len(val)-1] <= ' ') {
+			val = strings.TrimSpace(val)
+		}
 		if val == "" {
 			continue
 		}
-		num, err := strconv.ParseFloat(val, 64)
-		if err != nil {
+		num, ok := parseFinite(val)
+		if !ok {
 			continue
 		}
 		values = append(values, num)
 	}
-	if len(values) == 0 {
-		return 0, fmt.Errorf("no numeric values")
+	return values
+}
+
+// The kernels below work on a column already parsed into a contiguous
+// []float64 and never write to it, so callers may share one parsed column
+// (see columncache.go). They run four lanes per loop, which keeps the
+// dependency chains short and leaves one bounds check per block.
+
+// sum uses Neumaier's compensated summation so long columns don't lose the
+// low-order digits that plain accumulation drops. Each lane compensates on
+// its own and the lanes are combined the same way.
+func sum(vals []float64) float64 {
+	var s, c [4]float64
+	i := 0
+	for ; i+4 <= len(vals); i += 4 {
+		v := vals[i : i+4 : i+4]
+		for k := range 4 {
+			t := s[k] + v[k]
+			if math.Abs(s[k]) >= math.Abs(v[k]) {
+				c[k] += (s[k] - t) + v[k]
+			} else {
+				c[k] += (v[k] - t) + s[k]
+			}
+			s[k] = t
+		}
 	}
-	switch op {
-	case "sum":
-		return sum(values), nil
-	case "average":
-		return avg(values), nil
-	case "median":
-		return median(values), nil
-	case "min":
-		return min(values), nil
-	case "max":
-		return max(values), nil
-	case "count":
-		return float64(len(values)), nil
-	case "std":
-		return std(values), nil
-	default:
-		return 0, fmt.Errorf("unsupported operation")
+	for ; i < len(vals); i++ {
+		t := s[0] + vals[i]
+		if math.Abs(s[0]) >= math.Abs(vals[i]) {
+			c[0] += (s[0] - t) + vals[i]
+		} else {
+			c[0] += (vals[i] - t) + s[0]
+		}
+		s[0] = t
+	}
+	return combineLanes(s, c)
+}
+
+// combineLanes adds up the lanes' sums and compensations, compensated too.
+func combineLanes(s, c [4]float64) float64 {
+	total, comp := 0.0, 0.0
+	for k := range 4 {
+		for _, v := range [2]float64{s[k], c[k]} {
+			t := total + v
+			if math.Abs(total) >= math.Abs(v) {
+				comp += (total - t) + v
+			} else {
+				comp += (v - t) + total
+			}
+			total = t
+		}
 	}
+	return total + comp
 }
 
-func sum(vals []float64) float64 { s := 0.0; for _, v := range vals { s += v }; return s }
 func avg(vals []float64) float64 { return sum(vals) / float64(len(vals)) }
 
-func median(vals []float64) float64 {
+// sortedCopy is vals sorted, for the order statistics.
+func sortedCopy(vals []float64) []float64 {
 	sorted := make([]float64, len(vals))
 	copy(sorted, vals)
-	for i := 0; i < len(sorted); i++ {
-		for j := 0; j < len(sorted)-1-i; j++ {
-			if sorted[j] > sorted[j+1] {
-				sorted[j], sorted[j+1] = sorted[j+1], sorted[j]
-			}
-		}
-	}
+	slices.Sort(sorted)
+	return sorted
+}
+
+func median(vals []float64) float64 { return medianSorted(sortedCopy(vals)) }
+
+func medianSorted(sorted []float64) float64 {
 	n := len(sorted)
 	if n%2 == 0 {
 		return (sorted[n/2-1] + sorted[n/2]) / 2
@@ -67,13 +130,78 @@ func median(vals []float64) float64 {
 	return sorted[n/2]
 }
 
-func min(vals []float64) float64 { m := vals[0]; for _, v := range vals[1:] { if v < m { m = v } }; return m }
-func max(vals []float64) float64 { m := vals[0]; for _, v := range vals[1:] { if v > m { m = v } }; return m }
+func min(vals []float64) float64 {
+	m := [4]float64{vals[0], vals[0], vals[0], vals[0]}
+	i := 0
+	for ; i+4 <= len(vals); i += 4 {
+		v := vals[i : i+4 : i+4]
+		for k := range 4 {
+			if v[k] < m[k] {
+				m[k] = v[k]
+			}
+		}
+	}
+	for ; i < len(vals); i++ {
+		if vals[i] < m[0] {
+			m[0] = vals[i]
+		}
+	}
+	return math.Min(math.Min(m[0], m[1]), math.Min(m[2], m[3]))
+}
+
+func max(vals []float64) float64 {
+	m := [4]float64{vals[0], vals[0], vals[0], vals[0]}
+	i := 0
+	for ; i+4 <= len(vals); i += 4 {
+		v := vals[i : i+4 : i+4]
+		for k := range 4 {
+			if v[k] > m[k] {
+				m[k] = v[k]
+			}
+		}
+	}
+	for ; i < len(vals); i++ {
+		if vals[i] > m[0] {
+			m[0] = vals[i]
+		}
+	}
+	return math.Max(math.Max(m[0], m[1]), math.Max(m[2], m[3]))
+}
 
+// std is the sample standard deviation, from the squared deviations about
+// the mean summed with the same compensation as sum, without a scratch
+// slice for them.
 func std(vals []float64) float64 {
-	if len(vals) <= 1 { return 0 }
+	if len(vals) <= 1 {
+		return 0
+	}
 	mean := avg(vals)
-	sumSq := 0.0
-	for _, v := range vals { d := v - mean; sumSq += d * d }
-	return math.Sqrt(sumSq / float64(len(vals)-1))
-}
\ No newline at end of file
+	var s, c [4]float64
+	i := 0
+	for ; i+4 <= len(vals); i += 4 {
+		v := vals[i : i+4 : i+4]
+		for k := range 4 {
+			d := v[k] - mean
+			sq := d * d
+			t := s[k] + sq
+			if s[k] >= sq {
+				c[k] += (s[k] - t) + sq
+			} else {
+				c[k] += (sq - t) + s[k]
+			}
+			s[k] = t
+		}
+	}
+	for ; i < len(vals); i++ {
+		d := vals[i] - mean
+		sq := d * d
+		t := s[0] + sq
+		if s[0] >= sq {
+			c[0] += (s[0] - t) + sq
+		} else {
+			c[0] += (sq - t) + s[0]
+		}
+		s[0] = t
+	}
+	return math.Sqrt(combineLanes(s, c) / float64(len(vals)-1))
+}
@@ -0,0 +1,153 @@
+// calculations_test.go
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// benchColumn is a parsed column the size of a large upload.
+func benchColumn(n int) []float64 {
+	rng := rand.New(rand.NewSource(benchSeed))
+	vals := make([]float64, n)
+	for i := range vals {
+		vals[i] = rng.NormFloat64()*1000 + 50
+	}
+	return vals
+}
+
+func naiveSum(vals []float64) float64 {
+	total := 0.0
+	for _, v := range vals {
+		total += v
+	}
+	return total
+}
+
+func naiveMin(vals []float64) float64 {
+	m := vals[0]
+	for _, v := range vals[1:] {
+		m = math.Min(m, v)
+	}
+	return m
+}
+
+func naiveMax(vals []float64) float64 {
+	m := vals[0]
+	for _, v := range vals[1:] {
+		m = math.Max(m, v)
+	}
+	return m
+}
+
+func naiveStd(vals []float64) float64 {
+	if len(vals) <= 1 {
+		return 0
+	}
+	mean := naiveSum(vals) / float64(len(vals))
+	ss := 0.0
+	for _, v := range vals {
+		ss += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(ss / float64(len(vals)-1))
+}
+
+func closeTo(got, want float64) bool {
+	return math.Abs(got-want) <= 1e-9*math.Max(1, math.Abs(want))
+}
+
+func TestKernels(t *testing.T) {
+	kernels := []struct {
+		name        string
+		fn, naive   func([]float64) float64
+		exact, zero bool // exact: no rounding difference; zero: defined when empty
+	}{
+		{"sum", sum, naiveSum, false, true},
+		{"min", min, naiveMin, true, false},
+		{"max", max, naiveMax, true, false},
+		{"std", std, naiveStd, false, true},
+	}
+	col := benchColumn(1031)
+	// Every length around the four-lane block, so the tail loop runs with
+	// zero to three values left over.
+	lengths := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 12, 13, 1029, 1030, 1031}
+	for _, k := range kernels {
+		for _, n := range lengths {
+			vals := col[:n]
+			if got, want := k.fn(vals), k.naive(vals); k.exact && got != want || !closeTo(got, want) {
+				t.Errorf("%s of %d values = %v, want %v", k.name, n, got, want)
+			}
+		}
+		if k.zero {
+			if got := k.fn(nil); got != 0 {
+				t.Errorf("%s of no values = %v, want 0", k.name, got)
+			}
+		}
+	}
+}
+
+// The extreme value in each lane and in the tail must win.
+func TestMinMaxEveryPosition(t *testing.T) {
+	for n := 1; n <= 11; n++ {
+		for at := range n {
+			vals := make([]float64, n)
+			vals[at] = -5
+			if got := min(vals); got != -5 {
+				t.Errorf("min with -5 at %d of %d = %v", at, n, got)
+			}
+			vals[at] = 5
+			if got := max(vals); got != 5 {
+				t.Errorf("max with 5 at %d of %d = %v", at, n, got)
+			}
+		}
+	}
+}
+
+func TestSumCompensated(t *testing.T) {
+	// Plain accumulation loses every 1 added to 1e16.
+	vals := []float64{1e16, 1, 1, 1, 1, 1, 1, 1, 1, -1e16}
+	if got := sum(vals); got != 8 {
+		t.Errorf("sum = %v, want 8", got)
+	}
+}
+
+func TestNumericValuesSkipsNonFinite(t *testing.T) {
+	data := Spreadsheet{Headers: []string{"Amount"}}
+	for _, v := range []string{"1", "NaN", "nan", "Inf", "+Inf", "-Inf", "Infinity", "1e400", "", " 2 ", "x", "3.5"} {
+		data.Rows = append(data.Rows, []string{v})
+	}
+	data.Rows = append(data.Rows, []string{})
+	vals := numericValues(data, 0)
+	want := []float64{1, 2, 3.5}
+	if len(vals) != len(want) {
+		t.Fatalf("numericValues = %v, want %v", vals, want)
+	}
+	for i := range want {
+		if vals[i] != want[i] {
+			t.Fatalf("numericValues = %v, want %v", vals, want)
+		}
+	}
+}
+
+func TestCalculateValuesEmpty(t *testing.T) {
+	for _, op := range []string{"sum", "min", "max", "std"} {
+		if _, err := calculateValues(nil, op, nil); err == nil {
+			t.Errorf("%s of no values: want an error", op)
+		}
+	}
+}
+
+func benchKernel(b *testing.B, fn func([]float64) float64) {
+	vals := benchColumn(200_000)
+	b.SetBytes(int64(8 * len(vals)))
+	b.ReportAllocs()
+	for b.Loop() {
+		fn(vals)
+	}
+}
+
+func BenchmarkSum(b *testing.B) { benchKernel(b, sum) }
+func BenchmarkMin(b *testing.B) { benchKernel(b, min) }
+func BenchmarkMax(b *testing.B) { benchKernel(b, max) }
+func BenchmarkStd(b *testing.B) { benchKernel(b, std) }
@@ -0,0 +1,132 @@
+// chart.go
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"strings"
+)
+
+const (
+	chartWidth  = 640
+	chartHeight = 220
+	chartPad    = 30
+)
+
+// ChartSeries is one line on a chart. NaN values leave a gap.
+type ChartSeries struct {
+	Name   string
+	Color  string
+	Values []float64
+	Dashed bool
+}
+
+// ChartBand shades the area between Lower and Upper, e.g. a confidence
+// interval. NaN entries are left unshaded.
+type ChartBand struct {
+	Lower []float64
+	Upper []float64
+}
+
+// lineChart draws series over shared x labels as an inline SVG with a
+// legend, the y range and the first and last labels on the axes.
+func lineChart(title string, labels []string, series []ChartSeries, band *ChartBand) template.HTML {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	extend := func(vals []float64) {
+		for _, v := range vals {
+			if !math.IsNaN(v) && !math.IsInf(v, 0) {
+				lo, hi = math.Min(lo, v), math.Max(hi, v)
+			}
+		}
+	}
+	for _, s := range series {
+		extend(s.Values)
+	}
+	if band != nil {
+		extend(band.Lower)
+		extend(band.Upper)
+	}
+	if len(labels) < 2 || lo > hi {
+		return ""
+	}
+	if lo == hi {
+		lo, hi = lo-1, hi+1
+	}
+	x := func(i int) float64 {
+		return chartPad + float64(i)*(chartWidth-2*chartPad)/float64(len(labels)-1)
+	}
+	y := func(v float64) float64 {
+		return chartPad/2 + (hi-v)/(hi-lo)*(chartHeight-chartPad*1.5)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#cbd5e0"/>`, chartPad, y(lo), chartWidth-chartPad, y(lo))
+	if lo < 0 && hi > 0 {
+		fmt.Fprintf(&body, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#e2e8f0" stroke-dasharray="2 2"/>`, chartPad, y(0), chartWidth-chartPad, y(0))
+	}
+	if band != nil {
+		for _, run := range chartRuns(band.Lower, band.Upper) {
+			var pts []string
+			for i := run[0]; i < run[1]; i++ {
+				pts = append(pts, fmt.Sprintf("%.1f,%.1f", x(i), y(band.Upper[i])))
+			}
+			for i := run[1] - 1; i >= run[0]; i-- {
+				pts = append(pts, fmt.Sprintf("%.1f,%.1f", x(i), y(band.Lower[i])))
+			}
+			fmt.Fprintf(&body, `<polygon points="%s" fill="#667eea" fill-opacity="0.15"/>`, strings.Join(pts, " "))
+		}
+	}
+	for _, s := range series {
+		dash := ""
+		if s.Dashed {
+			dash = ` stroke-dasharray="5 3"`
+		}
+		for _, run := range chartRuns(s.Values, s.Values) {
+			var pts []string
+			for i := run[0]; i < run[1]; i++ {
+				pts = append(pts, fmt.Sprintf("%.1f,%.1f", x(i), y(s.Values[i])))
+			}
+			if len(pts) == 1 {
+				fmt.Fprintf(&body, `<circle cx="%.1f" cy="%.1f" r="2" fill="%s"/>`, x(run[0]), y(s.Values[run[0]]), s.Color)
+				continue
+			}
+			fmt.Fprintf(&body, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"%s/>`, strings.Join(pts, " "), s.Color, dash)
+		}
+	}
+
+	text := func(x, y float64, anchor, s string) {
+		fmt.Fprintf(&body, `<text x="%.1f" y="%.1f" font-size="10" fill="#718096" text-anchor="%s">%s</text>`, x, y, anchor, template.HTMLEscapeString(s))
+	}
+	text(chartPad-4, y(hi)+4, "end", formatStat(hi))
+	text(chartPad-4, y(lo), "end", formatStat(lo))
+	text(x(0), chartHeight-4, "start", labels[0])
+	text(x(len(labels)-1), chartHeight-4, "end", labels[len(labels)-1])
+	legendX := float64(chartPad)
+	for _, s := range series {
+		fmt.Fprintf(&body, `<rect x="%.1f" y="2" width="10" height="3" fill="%s"/>`, legendX, s.Color)
+		text(legendX+14, 8, "start", s.Name)
+		legendX += 14 + 7*float64(len([]rune(s.Name))) + 16
+	}
+
+	return template.HTML(fmt.Sprintf(`<svg class="chart" width="%d" height="%d" viewBox="0 0 %d %d" role="img"><title>%s</title>%s</svg>`,
+		chartWidth, chartHeight, chartWidth, chartHeight, template.HTMLEscapeString(title), body.String()))
+}
+
+// chartRuns returns the [start, end) index ranges where both a and b are
+// finite.
+func chartRuns(a, b []float64) [][2]int {
+	var runs [][2]int
+	start := -1
+	for i := 0; i <= len(a); i++ {
+		ok := i < len(a) && i < len(b) && !math.IsNaN(a[i]) && !math.IsNaN(b[i]) && !math.IsInf(a[i], 0) && !math.IsInf(b[i], 0)
+		switch {
+		case ok && start == -1:
+			start = i
+		case !ok && start != -1:
+			runs = append(runs, [2]int{start, i})
+			start = -1
+		}
+	}
+	return runs
+}
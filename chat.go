@@ -0,0 +1,394 @@
+// chat.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chat integrations answer questions from Slack (a slash command) and
+// Microsoft Teams (an outgoing webhook). The message is an optional dataset,
+// then a question in the /api/v1/ask grammar:
+//
+//	/stats sales.csv sum Amount by Region
+//	@Stats 3f2a9c0d1e average Price per Category
+//
+// The dataset is an ID or file name in config.Chat.Team, or a file shared
+// in the message, which is imported first; without one the workspace's most
+// recent upload is used.
+
+const (
+	maxChatGroups      = 25
+	slackRequestMaxAge = 5 * time.Minute
+	teamsFileInfo      = "application/vnd.microsoft.teams.file.download.info"
+)
+
+var chatClient = &http.Client{Timeout: 30 * time.Second}
+
+// slackLinkPattern matches Slack's <url> and <url|label> link markup.
+var slackLinkPattern = regexp.MustCompile(`^<(https://[^|>]+)(?:\|([^>]*))?>$`)
+
+// teamsMentionPattern matches the bot's own @mention, which Teams includes
+// in the text.
+var teamsMentionPattern = regexp.MustCompile(`<at>[^<]*</at>`)
+
+type chatFile struct {
+	name string
+	url  string
+	auth string // Authorization header for the download, if any
+}
+
+// chatAnswer runs a chat question and returns the reply, and whether it's an
+// answer rather than help or an error. user is recorded as the owner of any
+// file imported on the way; bold is the platform's bold markup.
+func chatAnswer(text, user string, file *chatFile, bold string) (string, bool) {
+	text = strings.TrimSpace(text)
+	if file == nil && (text == "" || strings.EqualFold(text, "help")) {
+		return chatHelp(), false
+	}
+	team := config.Chat.Team
+
+	var data Spreadsheet
+	if file != nil {
+		a, err := downloadChatFile(*file)
+		if err == nil {
+			data, err = ingestAttachment(a, user, team, "Shared in chat by "+user)
+		}
+		if err != nil {
+			return fmt.Sprintf("Couldn't import %s: %v", file.name, err), false
+		}
+	} else {
+		word, rest, _ := strings.Cut(text, " ")
+		if d, ok := chatDataset(team, strings.Trim(word, "`:")); ok {
+			data, text = d, strings.TrimSpace(rest)
+		} else if d, ok := latestChatDataset(team); ok {
+			data = d
+		} else {
+			return "There are no datasets in this workspace yet. Upload one, or share a CSV or Excel file with your question.", false
+		}
+	}
+	if text == "" {
+		return fmt.Sprintf("%s has %d rows with columns %s. Ask something like \"sum %s\".",
+			data.FileName, len(data.Rows), strings.Join(data.Headers, ", "), data.Headers[0]), false
+	}
+
+	spec, interpreted, err := parseQuestion(data, text)
+	if err != nil {
+		return fmt.Sprintf("%s (asked of %s)", err, data.FileName), false
+	}
+	spec.Dataset = data.ID
+	result, err := runAnalysis(data, spec, newCalcBudget(context.Background()))
+	if err != nil {
+		return fmt.Sprintf("%s (asked of %s)", err, data.FileName), false
+	}
+	return fmt.Sprintf("%s%s%s from %s (%d of %d rows)\n%s", bold, interpreted, bold, data.FileName, result.RowsMatched, result.RowsIn, chatTable(result)), true
+}
+
+func chatHelp() string {
+	var b strings.Builder
+	b.WriteString("Ask a question about a dataset, optionally starting with its file name or ID:\n")
+	b.WriteString("• `sum Amount by Region`\n• `sales.csv average Price per Category where Year = 2024`\n")
+	b.WriteString("• share a CSV or Excel file with the question to import it first\n")
+	var names []string
+	seen := make(map[string]bool)
+	list := workspace.List()
+	for i := len(list) - 1; i >= 0 && len(names) < 5; i-- {
+		d := list[i]
+		if datasetTeam(d) == config.Chat.Team && d.ParentID == "" && !seen[d.FileName] {
+			seen[d.FileName] = true
+			names = append(names, "`"+d.FileName+"`")
+		}
+	}
+	if len(names) > 0 {
+		b.WriteString("Recent datasets: " + strings.Join(names, ", "))
+	}
+	return b.String()
+}
+
+// chatDataset finds a dataset by ID, or the latest upload of a file name.
+func chatDataset(team, ref string) (Spreadsheet, bool) {
+	if ref == "" {
+		return Spreadsheet{}, false
+	}
+	if data, ok := workspace.Get(ref); ok && datasetTeam(data) == team {
+		return data, true
+	}
+	return latestUpload(team, ref)
+}
+
+func latestChatDataset(team string) (Spreadsheet, bool) {
+	var latest Spreadsheet
+	found := false
+	for _, data := range workspace.List() {
+		if data.ParentID == "" && datasetTeam(data) == team && (!found || !data.UploadTime.Before(latest.UploadTime)) {
+			latest, found = data, true
+		}
+	}
+	return latest, found
+}
+
+func downloadChatFile(f chatFile) (inboundAttachment, error) {
+	if !isInboundAttachment(f.name) {
+		return inboundAttachment{}, fmt.Errorf("only CSV and Excel files can be imported")
+	}
+	req, err := http.NewRequest(http.MethodGet, f.url, nil)
+	if err != nil {
+		return inboundAttachment{}, err
+	}
+	if f.auth != "" {
+		req.Header.Set("Authorization", f.auth)
+	}
+	resp, err := chatClient.Do(req)
+	if err != nil {
+		return inboundAttachment{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return inboundAttachment{}, fmt.Errorf("download returned %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, MaxFileSize+1))
+	if err != nil {
+		return inboundAttachment{}, err
+	}
+	return inboundAttachment{name: f.name, data: b}, nil
+}
+
+func chatNumber(v float64) string {
+	if math.Abs(v) >= 1e15 {
+		return strconv.FormatFloat(v, 'g', 6, 64)
+	}
+	s := strconv.FormatFloat(v, 'f', 2, 64)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+// chatTable lays the result out as a monospaced table in a code block, which
+// both Slack and Teams render.
+func chatTable(res AnalyzeResult) string {
+	headers := append(append([]string(nil), res.GroupBy...), res.Metrics...)
+	var rows [][]string
+	for i, g := range res.Groups {
+		if i == maxChatGroups {
+			break
+		}
+		var row []string
+		for _, name := range res.GroupBy {
+			row = append(row, g.Key[name])
+		}
+		for _, name := range res.Metrics {
+			switch {
+			case g.Values[name] != nil:
+				row = append(row, chatNumber(*g.Values[name]))
+			case res.Incomplete && len(g.Diagnostics) == 0:
+				row = append(row, "…")
+			case g.Errors[name] != "":
+				row = append(row, "error")
+			default:
+				row = append(row, "")
+			}
+		}
+		rows = append(rows, row)
+	}
+	widths := make([]int, len(headers))
+	for _, row := range append([][]string{headers}, rows...) {
+		for i, v := range row {
+			if n := len([]rune(v)); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	var b strings.Builder
+	b.WriteString("```\n")
+	for r, row := range append([][]string{headers}, rows...) {
+		for i, v := range row {
+			pad := strings.Repeat(" ", widths[i]-len([]rune(v)))
+			if i > 0 {
+				b.WriteString("  ")
+			}
+			if i >= len(res.GroupBy) {
+				b.WriteString(pad + v) // numbers line up on the right
+			} else {
+				b.WriteString(v + pad)
+			}
+		}
+		b.WriteString("\n")
+		if r == 0 {
+			for i, w := range widths {
+				if i > 0 {
+					b.WriteString("  ")
+				}
+				b.WriteString(strings.Repeat("-", w))
+			}
+			b.WriteString("\n")
+		}
+	}
+	if len(res.Groups) > maxChatGroups {
+		fmt.Fprintf(&b, "… and %d more\n", len(res.Groups)-maxChatGroups)
+	}
+	b.WriteString("```")
+	if res.Incomplete {
+		fmt.Fprintf(&b, "\nIncomplete: the %s ran out; … marks groups not calculated.", res.Budget)
+	}
+	return b.String()
+}
+
+// verifySlack checks Slack's request signature: an HMAC of the timestamp and
+// body under the app's signing secret.
+func verifySlack(r *http.Request, body []byte) bool {
+	ts := r.Header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(sec, 0)).Abs() > slackRequestMaxAge {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(config.Chat.SlackSigningSecret))
+	fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(want), []byte(r.Header.Get("X-Slack-Signature")))
+}
+
+// slackCommandHandler serves the slash command. The answer goes to the
+// channel; help and errors go only to the person who asked. A question about
+// a shared file is acknowledged at once and answered through response_url,
+// since Slack gives up after three seconds.
+func slackCommandHandler(w http.ResponseWriter, r *http.Request) {
+	if config.Chat.SlackSigningSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+	if !verifySlack(r, body) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	user := form.Get("user_name")
+	text := strings.TrimSpace(form.Get("text"))
+
+	var file *chatFile
+	if word, rest, _ := strings.Cut(text, " "); slackLinkPattern.MatchString(word) {
+		m := slackLinkPattern.FindStringSubmatch(word)
+		if u, err := url.Parse(m[1]); err == nil && u.Host == "files.slack.com" && config.Chat.SlackBotToken != "" {
+			file = &chatFile{name: path.Base(u.Path), url: m[1], auth: "Bearer " + config.Chat.SlackBotToken}
+			text = rest
+		}
+	}
+
+	reply := func(answer string, ok bool) map[string]string {
+		kind := "ephemeral"
+		if ok {
+			kind = "in_channel"
+		}
+		return map[string]string{"response_type": kind, "text": answer}
+	}
+	responseURL := form.Get("response_url")
+	if file != nil && strings.HasPrefix(responseURL, "https://hooks.slack.com/") {
+		writeJSON(w, map[string]string{"response_type": "ephemeral", "text": "Importing " + file.name + "…"})
+		go func() {
+			msg, _ := json.Marshal(reply(chatAnswer(text, user, file, "*")))
+			if err := deliverHTTP(http.MethodPost, responseURL, "chat answer", mimeJSON, msg); err != nil {
+				log.Printf("Slack: answering %s failed: %v", user, err)
+			}
+		}()
+		return
+	}
+	writeJSON(w, reply(chatAnswer(text, user, file, "*")))
+}
+
+type teamsActivity struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+	From struct {
+		Name string `json:"name"`
+	} `json:"from"`
+	Attachments []struct {
+		ContentType string `json:"contentType"`
+		Name        string `json:"name"`
+		Content     struct {
+			DownloadURL string `json:"downloadUrl"`
+		} `json:"content"`
+	} `json:"attachments"`
+}
+
+// verifyTeams checks an outgoing webhook's "HMAC <signature>" header against
+// the security token Teams issued, which is base64.
+func verifyTeams(r *http.Request, body []byte) bool {
+	key, err := base64.StdEncoding.DecodeString(config.Chat.TeamsSecret)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	want := "HMAC " + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(want), []byte(r.Header.Get("Authorization")))
+}
+
+// teamsWebhookHandler serves the Teams outgoing webhook, which must answer
+// within five seconds in the response itself.
+func teamsWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if config.Chat.TeamsSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+	if !verifyTeams(r, body) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var act teamsActivity
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&act); err != nil {
+		http.Error(w, "Invalid activity", http.StatusBadRequest)
+		return
+	}
+	text := teamsMentionPattern.ReplaceAllString(act.Text, "")
+	text = strings.TrimSpace(strings.ReplaceAll(text, "&nbsp;", " "))
+
+	var file *chatFile
+	for _, a := range act.Attachments {
+		if a.ContentType != teamsFileInfo {
+			continue
+		}
+		// The download URL is pre-authorised and short-lived; only fetch
+		// from SharePoint, where Teams keeps shared files.
+		if u, err := url.Parse(a.Content.DownloadURL); err == nil && u.Scheme == "https" && strings.HasSuffix(u.Hostname(), ".sharepoint.com") {
+			file = &chatFile{name: a.Name, url: a.Content.DownloadURL}
+			break
+		}
+	}
+	answer, _ := chatAnswer(text, act.From.Name, file, "**")
+	writeJSON(w, map[string]string{"type": "message", "text": answer})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", mimeJSON)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,77 @@
+// clientip.go
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePeerIP returns the address of the directly connected peer.
+func resolvePeerIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// resolveClientIP returns the address of the real client. X-Forwarded-For is
+// only believed when the direct peer is a trusted proxy, and is walked from
+// the right so a client can't spoof its address by prepending entries.
+func resolveClientIP(r *http.Request) net.IP {
+	ip := resolvePeerIP(r)
+	if ip == nil || !inNets(ip, config.TrustedProxies) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !inNets(hop, config.TrustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// clientIP returns the address resolved by ipFilter for this request.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(net.IP); ok && ip != nil {
+		return ip.String()
+	}
+	if ip := resolveClientIP(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// ipFilter rejects clients outside ALLOW_CIDRS (when set) or inside
+// DENY_CIDRS, and records the resolved client address on the request.
+func ipFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := resolveClientIP(r)
+		if ip == nil ||
+			len(config.AllowCIDRs) > 0 && !inNets(ip, config.AllowCIDRs) ||
+			inNets(ip, config.DenyCIDRs) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
@@ -0,0 +1,230 @@
+// cohort.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const maxCohortOffsets = 120
+
+// Cohort is the entities whose first activity fell in the period starting
+// at Start. Active and Values are indexed by periods since Start.
+type Cohort struct {
+	Start  time.Time
+	Size   int
+	Active []int
+	Values []float64
+}
+
+// periodsBetween counts whole periods from a to b, both period starts.
+func periodsBetween(a, b time.Time, period string) int {
+	switch period {
+	case "month":
+		return (b.Year()-a.Year())*12 + int(b.Month()) - int(a.Month())
+	case "week":
+		return int(b.Sub(a).Hours()/24) / 7
+	}
+	return int(b.Sub(a).Hours() / 24)
+}
+
+// buildCohorts groups entities by the period of their first dated row and
+// counts, for every later period, how many of them were active and the total
+// of valueCol (when valueCol >= 0) across their rows.
+func buildCohorts(data Spreadsheet, dateCol, entityCol, valueCol int, period string) ([]Cohort, int, error) {
+	type activity struct {
+		entity string
+		at     time.Time
+		value  float64
+	}
+	var rows []activity
+	var last time.Time
+	first := make(map[string]time.Time)
+	for _, row := range data.Rows {
+		entity := cellValue(row, entityCol)
+		at, ok := parseDate(cellValue(row, dateCol))
+		if entity == "" || !ok {
+			continue
+		}
+		a := activity{entity: entity, at: periodStart(at, period)}
+		if valueCol >= 0 {
+			a.value, _ = parseFinite(cellValue(row, valueCol))
+		}
+		rows = append(rows, a)
+		if a.at.After(last) {
+			last = a.at
+		}
+		if f, seen := first[entity]; !seen || a.at.Before(f) {
+			first[entity] = a.at
+		}
+	}
+	if len(rows) == 0 {
+		return nil, 0, fmt.Errorf("no rows have both a date in %s and a value in %s", data.Headers[dateCol], data.Headers[entityCol])
+	}
+
+	byStart := make(map[time.Time]*Cohort)
+	width := 0
+	for _, f := range first {
+		c, ok := byStart[f]
+		if !ok {
+			c = &Cohort{Start: f}
+			byStart[f] = c
+		}
+		c.Size++
+	}
+	active := make(map[time.Time]map[int]map[string]bool)
+	for _, a := range rows {
+		start := first[a.entity]
+		offset := periodsBetween(start, a.at, period)
+		if offset >= maxCohortOffsets {
+			continue
+		}
+		if offset+1 > width {
+			width = offset + 1
+		}
+		c := byStart[start]
+		for len(c.Values) <= offset {
+			c.Values = append(c.Values, 0)
+		}
+		c.Values[offset] += a.value
+		if active[start] == nil {
+			active[start] = make(map[int]map[string]bool)
+		}
+		if active[start][offset] == nil {
+			active[start][offset] = make(map[string]bool)
+		}
+		active[start][offset][a.entity] = true
+	}
+
+	cohorts := make([]Cohort, 0, len(byStart))
+	for start, c := range byStart {
+		// Periods up to the latest in the data are known to be quiet, so
+		// they show as zero rather than blank.
+		for n := periodsBetween(start, last, period) + 1; len(c.Values) < n && len(c.Values) < maxCohortOffsets; {
+			c.Values = append(c.Values, 0)
+		}
+		c.Active = make([]int, len(c.Values))
+		for offset, entities := range active[start] {
+			c.Active[offset] = len(entities)
+		}
+		cohorts = append(cohorts, *c)
+	}
+	sort.Slice(cohorts, func(i, j int) bool { return cohorts[i].Start.Before(cohorts[j].Start) })
+	return cohorts, width, nil
+}
+
+var cohortMeasures = map[string]string{
+	"retention": "Retention %",
+	"active":    "Active entities",
+	"value":     "Total value",
+}
+
+// cohortHandler renders the cohort matrix: one row per first-activity
+// period, one column per period since then.
+func cohortHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	data := activeDataset(r)
+	if id := q.Get("dataset"); id != "" {
+		var ok bool
+		if data, ok = teamDataset(r, id); !ok {
+			http.Error(w, "Unknown dataset", http.StatusNotFound)
+			return
+		}
+	}
+	if len(data.Headers) == 0 {
+		http.Error(w, "No dataset loaded", http.StatusBadRequest)
+		return
+	}
+	entityCol := columnRef(data, q.Get("entity"))
+	if entityCol == -1 {
+		http.Error(w, "Choose the column that identifies each customer or entity", http.StatusBadRequest)
+		return
+	}
+	dateCol := -1
+	if ref := q.Get("date"); ref != "" {
+		dateCol = columnRef(data, ref)
+	} else if dates := detectDateColumns(data); len(dates) > 0 {
+		dateCol = dates[0]
+	}
+	if dateCol == -1 {
+		http.Error(w, "Cohorts need a date column", http.StatusBadRequest)
+		return
+	}
+	period := q.Get("period")
+	if period == "" {
+		period = "month"
+	}
+	if period != "day" && period != "week" && period != "month" {
+		http.Error(w, "period must be day, week or month", http.StatusBadRequest)
+		return
+	}
+	measure := q.Get("measure")
+	if measure == "" {
+		measure = "retention"
+	}
+	if _, ok := cohortMeasures[measure]; !ok {
+		http.Error(w, "measure must be retention, active or value", http.StatusBadRequest)
+		return
+	}
+	valueCol := -1
+	if ref := q.Get("value"); ref != "" {
+		if valueCol = columnRef(data, ref); valueCol == -1 {
+			http.Error(w, "Unknown value column", http.StatusBadRequest)
+			return
+		}
+	}
+	if measure == "value" && valueCol == -1 {
+		http.Error(w, "Choose a value column to total", http.StatusBadRequest)
+		return
+	}
+
+	cohorts, width, err := buildCohorts(data, dateCol, entityCol, valueCol, period)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	label := PeriodSeries{Period: period}.Label
+	headers := []string{"Cohort", "Size"}
+	for i := 0; i < width; i++ {
+		headers = append(headers, fmt.Sprintf("%s %d", period, i))
+	}
+	var rows [][]string
+	for _, c := range cohorts {
+		row := []string{label(c.Start), strconv.Itoa(c.Size)}
+		for i := 0; i < width; i++ {
+			switch {
+			case i >= len(c.Active):
+				row = append(row, "")
+			case measure == "retention":
+				row = append(row, formatStat(float64(c.Active[i])*100/float64(c.Size))+"%")
+			case measure == "active":
+				row = append(row, strconv.Itoa(c.Active[i]))
+			default:
+				row = append(row, formatStat(c.Values[i]))
+			}
+		}
+		rows = append(rows, row)
+	}
+	if q.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_cohorts.csv"`, exportBaseName(data.FileName)))
+		writeCSV(w, headers, rows)
+		return
+	}
+
+	notes := []string{fmt.Sprintf("Each %s is grouped by the %s of its first row in %s; %s 0 is that first %s.",
+		data.Headers[entityCol], period, data.Headers[dateCol], period, period)}
+	if measure == "value" {
+		notes = append(notes, fmt.Sprintf("Cells total %s for the cohort in each %s.", data.Headers[valueCol], period))
+	}
+	if width == maxCohortOffsets {
+		notes = append(notes, fmt.Sprintf("⚠️ Only the first %d %ss of each cohort are shown.", maxCohortOffsets, period))
+	}
+	q.Set("format", "csv")
+	section := ReportSection{Title: cohortMeasures[measure], Notes: notes, Headers: headers, Rows: rows,
+		Links: []ReportLink{{Label: "📊 Export Cohorts (CSV)", URL: "/cohorts?" + q.Encode()}}}
+	renderReport(w, ReportPage{Title: "Cohort Analysis", Subtitle: data.FileName, Sections: []ReportSection{section}})
+}
@@ -0,0 +1,364 @@
+// colstats.go
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+)
+
+// A ColumnSummary holds the running statistics of one column: its cell
+// counts and, over the cells that are finite numbers, the min, max, sum and
+// Welford's mean and M2 (sum of squared deviations, for the variance). CSV
+// uploads build them while the file is parsed; other datasets build one the
+// first time it is asked for. In-place edits update them cell by cell (see
+// Carry), so the header stats, the profile and the simple calculations read
+// them instead of parsing the column again.
+type ColumnSummary struct {
+	Cells     int // rows read, counting missing cells as empty
+	Empty     int
+	NonFinite int // NaN, Inf or out of float64's range
+	Count     int // cells used as numbers
+	Min, Max  float64
+	Mean, M2  float64
+	Sum       float64
+	comp      float64 // Neumaier compensation for Sum
+}
+
+// cellNumber reads a cell the way numericValues does.
+func cellNumber(cell string) (float64, bool) {
+	if cell != "" && (cell[0] <= ' ' || cell[len(cell)-1] <= ' ') {
+		cell = strings.TrimSpace(cell)
+	}
+	return parseFinite(cell)
+}
+
+func (s *ColumnSummary) AddCell(cell string) {
+	s.Cells++
+	if v, ok := cellNumber(cell); ok {
+		s.Add(v)
+		return
+	}
+	switch {
+	case cell == "":
+		s.Empty++
+	case isNonFinite(cell):
+		s.NonFinite++
+	}
+}
+
+// RemoveCell takes cell back out of the summary. It returns false, leaving
+// s as it was, when cell holds the column's min or max: what replaces it is
+// only known by reading the column again.
+func (s *ColumnSummary) RemoveCell(cell string) bool {
+	if v, ok := cellNumber(cell); ok {
+		if !s.Remove(v) {
+			return false
+		}
+		s.Cells--
+		return true
+	}
+	s.Cells--
+	switch {
+	case cell == "":
+		s.Empty--
+	case isNonFinite(cell):
+		s.NonFinite--
+	}
+	return true
+}
+
+func (s *ColumnSummary) Add(v float64) {
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	d := v - s.Mean
+	s.Mean += d / float64(s.Count)
+	s.M2 += d * (v - s.Mean)
+	s.addSum(v)
+}
+
+// Remove is Add undone; see RemoveCell.
+func (s *ColumnSummary) Remove(v float64) bool {
+	if s.Count > 1 && s.Min < s.Max && (v <= s.Min || v >= s.Max) {
+		return false
+	}
+	if s.Count <= 1 {
+		*s = ColumnSummary{Cells: s.Cells, Empty: s.Empty, NonFinite: s.NonFinite}
+		return true
+	}
+	s.Count--
+	d := v - s.Mean
+	s.Mean -= d / float64(s.Count)
+	s.M2 -= d * (v - s.Mean)
+	if s.M2 < 0 {
+		s.M2 = 0
+	}
+	s.addSum(-v)
+	return true
+}
+
+func (s *ColumnSummary) addSum(v float64) {
+	t := s.Sum + v
+	if math.Abs(s.Sum) >= math.Abs(v) {
+		s.comp += (s.Sum - t) + v
+	} else {
+		s.comp += (v - t) + s.Sum
+	}
+	s.Sum = t
+}
+
+// Total is the compensated sum of the numbers.
+func (s ColumnSummary) Total() float64 {
+	return s.Sum + s.comp
+}
+
+// Std is the sample standard deviation, as std computes it.
+func (s ColumnSummary) Std() float64 {
+	if s.Count <= 1 {
+		return 0
+	}
+	return math.Sqrt(s.M2 / float64(s.Count-1))
+}
+
+// Excluded counts the non-empty cells that aren't used as numbers.
+func (s ColumnSummary) Excluded() int {
+	return s.Cells - s.Empty - s.Count
+}
+
+func summarizeColumn(data Spreadsheet, col int) ColumnSummary {
+	var s ColumnSummary
+	for _, row := range data.Rows {
+		s.AddCell(cellValue(row, col))
+	}
+	return s
+}
+
+// summarizedOps are the operations a summary answers without the values.
+var summarizedOps = map[string]func(ColumnSummary) float64{
+	"sum":     ColumnSummary.Total,
+	"average": func(s ColumnSummary) float64 { return s.Total() / float64(s.Count) },
+	"min":     func(s ColumnSummary) float64 { return s.Min },
+	"max":     func(s ColumnSummary) float64 { return s.Max },
+	"count":   func(s ColumnSummary) float64 { return float64(s.Count) },
+	"std":     ColumnSummary.Std,
+}
+
+// summaryCalculation answers op on col from its summary, or returns false
+// for operations (and results) that need the values themselves.
+func summaryCalculation(data Spreadsheet, col int, op string) (float64, bool) {
+	f, ok := summarizedOps[op]
+	if !ok {
+		return 0, false
+	}
+	s := columnSummary(data, col)
+	if s.Count == 0 {
+		return 0, false
+	}
+	v := f(s)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false
+	}
+	return v, true
+}
+
+// SummaryStore keeps the summaries of each stored dataset's latest version,
+// by column ID. Like the column cache it checks the rows an entry was made
+// from, so a filtered copy that kept its parent's ID isn't given the
+// parent's summaries.
+type SummaryStore struct {
+	mu      sync.Mutex
+	entries map[string]*datasetSummaries
+}
+
+type datasetSummaries struct {
+	version int
+	rows    *[]string
+	n       int
+	columns map[string]ColumnSummary
+}
+
+var columnSummaries = &SummaryStore{entries: make(map[string]*datasetSummaries)}
+
+func rowsKey(data Spreadsheet) *[]string {
+	if len(data.Rows) == 0 {
+		return nil
+	}
+	return &data.Rows[0]
+}
+
+func columnID(data Spreadsheet, col int) string {
+	if col < len(data.ColumnIDs) {
+		return data.ColumnIDs[col]
+	}
+	return ""
+}
+
+// entry returns the summaries held for data, with the lock held.
+func (st *SummaryStore) entry(data Spreadsheet) *datasetSummaries {
+	e, ok := st.entries[data.ID]
+	if !ok || e.version != data.Version || e.rows != rowsKey(data) || e.n != len(data.Rows) {
+		return nil
+	}
+	return e
+}
+
+// columnSummary returns col's summary, building and keeping it if need be.
+func columnSummary(data Spreadsheet, col int) ColumnSummary {
+	if col < len(data.summaries) {
+		if s := data.summaries[col]; s != nil && s.Cells == len(data.Rows) {
+			return *s
+		}
+	}
+	id := columnID(data, col)
+	if data.ID == "" || id == "" {
+		return summarizeColumn(data, col)
+	}
+	columnSummaries.mu.Lock()
+	if e := columnSummaries.entry(data); e != nil {
+		if s, ok := e.columns[id]; ok {
+			columnSummaries.mu.Unlock()
+			return s
+		}
+	}
+	columnSummaries.mu.Unlock()
+	s := summarizeColumn(data, col)
+	columnSummaries.put(data, map[string]ColumnSummary{id: s})
+	return s
+}
+
+// put adds columns to data's entry, replacing an entry for an older version.
+func (st *SummaryStore) put(data Spreadsheet, columns map[string]ColumnSummary) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	e := st.entry(data)
+	if e == nil {
+		if cur, ok := st.entries[data.ID]; ok && cur.version > data.Version {
+			return
+		}
+		e = &datasetSummaries{version: data.Version, rows: rowsKey(data), n: len(data.Rows), columns: make(map[string]ColumnSummary)}
+		st.entries[data.ID] = e
+	}
+	for id, s := range columns {
+		e.columns[id] = s
+	}
+}
+
+// Seed keeps the summaries made while data was parsed, when they still
+// describe its rows. It is called once data has its ID and column IDs.
+func (st *SummaryStore) Seed(data Spreadsheet) {
+	if len(data.summaries) != len(data.Headers) || len(data.ColumnIDs) != len(data.Headers) {
+		return
+	}
+	columns := make(map[string]ColumnSummary, len(data.summaries))
+	for col, s := range data.summaries {
+		if s != nil && s.Cells == len(data.Rows) {
+			columns[data.ColumnIDs[col]] = *s
+		}
+	}
+	st.put(data, columns)
+}
+
+// Carry brings the summaries of old forward to updated, its next version.
+// Each column is compared with its old cells and only the cells that differ
+// are taken out and put in again; rows appended at the end are added. A
+// column that lost rows, or lost its min or max, is left to be read again
+// when next asked for.
+func (st *SummaryStore) Carry(old, updated Spreadsheet) {
+	st.mu.Lock()
+	e := st.entry(old)
+	var prev map[string]ColumnSummary
+	if e != nil {
+		prev = make(map[string]ColumnSummary, len(e.columns))
+		for id, s := range e.columns {
+			prev[id] = s
+		}
+	}
+	st.mu.Unlock()
+	if len(prev) == 0 || len(updated.Rows) < len(old.Rows) {
+		return
+	}
+	oldCol := make(map[string]int, len(old.ColumnIDs))
+	for i, id := range old.ColumnIDs {
+		oldCol[id] = i
+	}
+	columns := make(map[string]ColumnSummary, len(prev))
+	for col, id := range updated.ColumnIDs {
+		s, ok := prev[id]
+		if !ok {
+			continue
+		}
+		if s, ok = carryColumn(s, old, oldCol[id], updated, col); ok {
+			columns[id] = s
+		}
+	}
+	st.put(updated, columns)
+}
+
+func carryColumn(s ColumnSummary, old Spreadsheet, oc int, updated Spreadsheet, col int) (ColumnSummary, bool) {
+	for i, row := range old.Rows {
+		before, after := cellValue(row, oc), cellValue(updated.Rows[i], col)
+		if before == after {
+			continue
+		}
+		if !s.RemoveCell(before) {
+			return s, false
+		}
+		s.AddCell(after)
+	}
+	for _, row := range updated.Rows[len(old.Rows):] {
+		s.AddCell(cellValue(row, col))
+	}
+	return s, true
+}
+
+func (st *SummaryStore) Forget(id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.entries, id)
+}
+
+// Summaries made while parsing travel on the Spreadsheet, by column, until
+// Seed stores them. Steps that change cells before then keep them in step
+// or drop them.
+
+// ingestSummaries pads the summaries of a parse to the dataset's columns,
+// counting the cells short rows didn't have as empty.
+func ingestSummaries(summaries []ColumnSummary, columns, rows int) []*ColumnSummary {
+	out := make([]*ColumnSummary, columns)
+	for col := range out {
+		s := &ColumnSummary{}
+		if col < len(summaries) {
+			*s = summaries[col]
+		}
+		s.Empty += rows - s.Cells
+		s.Cells = rows
+		out[col] = s
+	}
+	return out
+}
+
+// unsummarizeRow takes a removed row out of data's summaries.
+func unsummarizeRow(data *Spreadsheet, row []string) {
+	for col, s := range data.summaries {
+		if s != nil && !s.RemoveCell(cellValue(row, col)) {
+			data.summaries[col] = nil
+		}
+	}
+}
+
+// resummarizeCell records that a cell of col changed from before to after.
+func resummarizeCell(data *Spreadsheet, col int, before, after string) {
+	if col >= len(data.summaries) || data.summaries[col] == nil {
+		return
+	}
+	if s := data.summaries[col]; s.RemoveCell(before) {
+		s.AddCell(after)
+	} else {
+		data.summaries[col] = nil
+	}
+}
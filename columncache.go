@@ -0,0 +1,99 @@
+// columncache.go
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Parsing a column's text into numbers costs far more than any statistic
+// computed from the result, so stored datasets keep their parsed numeric
+// columns here for the calculations, header stats and column stats that
+// follow. Entries are keyed by the exact rows they were parsed from as well
+// as the dataset's ID and version, so a filtered copy that kept its parent's
+// ID never reads its parent's column. The least recently used columns are
+// dropped once maxCachedValues numbers are held. Callers must not modify the
+// slices they get.
+
+const maxCachedValues = 8 << 20 // 64 MB of float64
+
+type parsedColumnKey struct {
+	id      string
+	version int
+	col     int
+	rows    *[]string // the first row, standing for the rows slice
+	n       int
+}
+
+type cachedColumn struct {
+	key    parsedColumnKey
+	values []float64
+}
+
+type ColumnCache struct {
+	mu      sync.Mutex
+	entries map[parsedColumnKey]*list.Element
+	order   *list.List // front is most recently used
+	size    int
+}
+
+var parsedColumns = &ColumnCache{entries: make(map[parsedColumnKey]*list.Element), order: list.New()}
+
+// storedValues is numericValues through the cache, for datasets with an ID.
+func storedValues(data Spreadsheet, col int) []float64 {
+	if data.ID == "" || len(data.Rows) == 0 {
+		return numericValues(data, col)
+	}
+	key := parsedColumnKey{id: data.ID, version: data.Version, col: col, rows: &data.Rows[0], n: len(data.Rows)}
+	if values, ok := parsedColumns.get(key); ok {
+		return values
+	}
+	values := numericValues(data, col)
+	parsedColumns.put(key, values)
+	return values
+}
+
+func (c *ColumnCache) get(key parsedColumnKey) ([]float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cachedColumn).values, true
+}
+
+func (c *ColumnCache) put(key parsedColumnKey, values []float64) {
+	if len(values) > maxCachedValues/4 {
+		return // one column shouldn't push out everything else
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cachedColumn{key: key, values: values})
+	c.size += len(values)
+	for c.size > maxCachedValues {
+		last := c.order.Back()
+		old := c.order.Remove(last).(*cachedColumn)
+		delete(c.entries, old.key)
+		c.size -= len(old.values)
+	}
+}
+
+// Forget drops a dataset's columns, when it is deleted.
+func (c *ColumnCache) Forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		if col := el.Value.(*cachedColumn); col.key.id == id {
+			c.order.Remove(el)
+			delete(c.entries, col.key)
+			c.size -= len(col.values)
+		}
+		el = next
+	}
+}
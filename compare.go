@@ -0,0 +1,187 @@
+// compare.go
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// ReportComparison is one scheduled report's calculation run against two
+// datasets, e.g. the April and May uploads.
+type ReportComparison struct {
+	Report  ScheduledReport
+	Base    Spreadsheet
+	Current Spreadsheet
+	Rows    []ComparisonRow
+	Skipped []string
+}
+
+type ComparisonRow struct {
+	Column  string
+	Base    *float64
+	Current *float64
+}
+
+// Change is the absolute and percentage change from Base to Current. The
+// percentage is NaN when Base is zero.
+func (c ComparisonRow) Change() (float64, float64, bool) {
+	if c.Base == nil || c.Current == nil {
+		return 0, 0, false
+	}
+	diff := *c.Current - *c.Base
+	if *c.Base == 0 {
+		return diff, math.NaN(), true
+	}
+	return diff, diff * 100 / math.Abs(*c.Base), true
+}
+
+func compareReport(rep ScheduledReport, base, current Spreadsheet) ReportComparison {
+	cmp := ReportComparison{Report: rep, Base: base, Current: current}
+	baseResults, baseSkipped := reportResults(rep, base)
+	currentResults, currentSkipped := reportResults(rep, current)
+	byColumn := func(results []CalculationResult) map[string]float64 {
+		m := make(map[string]float64, len(results))
+		for _, res := range results {
+			m[res.Col] = res.Value
+		}
+		return m
+	}
+	baseValues, currentValues := byColumn(baseResults), byColumn(currentResults)
+	for _, name := range rep.Columns {
+		row := ComparisonRow{Column: name}
+		if v, ok := baseValues[name]; ok {
+			row.Base = &v
+		}
+		if v, ok := currentValues[name]; ok {
+			row.Current = &v
+		}
+		cmp.Rows = append(cmp.Rows, row)
+	}
+	for _, s := range baseSkipped {
+		cmp.Skipped = append(cmp.Skipped, datasetLabel(base)+" – "+s)
+	}
+	for _, s := range currentSkipped {
+		cmp.Skipped = append(cmp.Skipped, datasetLabel(current)+" – "+s)
+	}
+	return cmp
+}
+
+func (cmp ReportComparison) Table() ([]string, [][]string) {
+	headers := []string{"Column", "Statistic", datasetLabel(cmp.Base), datasetLabel(cmp.Current), "Change", "% Change"}
+	statistic := cmp.Report.Operation
+	if op, ok := lookupOperation(cmp.Report.Operation); ok {
+		statistic = op.Label
+		if p := describeParams(op, cmp.Report.Params); p != "" {
+			statistic += " (" + p + ")"
+		}
+	}
+	value := func(v *float64) string {
+		if v == nil {
+			return "–"
+		}
+		return formatStat(*v)
+	}
+	rows := make([][]string, len(cmp.Rows))
+	for i, c := range cmp.Rows {
+		row := []string{c.Column, statistic, value(c.Base), value(c.Current), "–", "–"}
+		if diff, pct, ok := c.Change(); ok {
+			row[4] = fmt.Sprintf("%+g", math.Round(diff*100)/100)
+			if !math.IsNaN(pct) {
+				row[5] = fmt.Sprintf("%+.1f%%", pct)
+			}
+		}
+		rows[i] = row
+	}
+	return headers, rows
+}
+
+// datasetLabel tells uploads of the same file apart by upload time.
+func datasetLabel(data Spreadsheet) string {
+	return data.FileName + " (" + data.UploadTime.Format("2006-01-02 15:04:05") + ")"
+}
+
+// teamUploads lists the team's uploads, newest first.
+func teamUploads(team string) []Spreadsheet {
+	var list []Spreadsheet
+	for _, data := range workspace.List() {
+		if data.ParentID == "" && datasetTeam(data) == team {
+			list = append(list, data)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].UploadTime.After(list[j].UploadTime) })
+	return list
+}
+
+// reportCompareHandler runs a scheduled report's calculation against two
+// datasets side by side. Without base and current it compares the two most
+// recent uploads of the report's source file.
+func reportCompareHandler(w http.ResponseWriter, r *http.Request) {
+	team := currentTeam(r).ID
+	q := r.URL.Query()
+	rep, ok := schedules.Get(q.Get("report"))
+	if !ok || rep.Team != team {
+		http.Error(w, "Unknown report", http.StatusNotFound)
+		return
+	}
+	uploads := teamUploads(team)
+	var previous []Spreadsheet
+	for _, data := range uploads {
+		if data.FileName == rep.Source {
+			previous = append(previous, data)
+		}
+	}
+	pick := func(param string, fallback int) (Spreadsheet, bool) {
+		if id := q.Get(param); id != "" {
+			return teamDataset(r, id)
+		}
+		if fallback < len(previous) {
+			return previous[fallback], true
+		}
+		return Spreadsheet{}, false
+	}
+	current, haveCurrent := pick("current", 0)
+	base, haveBase := pick("base", 1)
+
+	options := func(selected Spreadsheet) []FormOption {
+		opts := make([]FormOption, len(uploads))
+		for i, data := range uploads {
+			opts[i] = FormOption{Value: data.ID, Label: datasetLabel(data), Selected: data.ID == selected.ID}
+		}
+		return opts
+	}
+	choose := ReportSection{Title: "Choose Datasets", Form: &ReportForm{Action: "/reports/compare", Method: "get", Submit: "⚖️ Compare", Fields: []FormField{
+		{Name: "report", Type: "hidden", Value: rep.ID},
+		{Name: "base", Label: "Before", Type: "select", Options: options(base)},
+		{Name: "current", Label: "After", Type: "select", Options: options(current)},
+	}}}
+	back := []ReportLink{{Label: "⬅️ Scheduled reports", URL: "/reports"}}
+	if !haveBase || !haveCurrent {
+		if q.Get("base") != "" || q.Get("current") != "" {
+			http.Error(w, "Unknown dataset", http.StatusNotFound)
+			return
+		}
+		choose.Notes = []string{fmt.Sprintf("There aren't two uploads of %s yet; pick the datasets to compare.", rep.Source)}
+		choose.Links = back
+		renderReport(w, ReportPage{Title: "Compare Runs", Subtitle: rep.Name, Sections: []ReportSection{choose}})
+		return
+	}
+
+	cmp := compareReport(rep, base, current)
+	headers, rows := cmp.Table()
+	if q.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_comparison.csv"`, exportBaseName(rep.Name)))
+		writeCSV(w, headers, rows)
+		return
+	}
+	export := url.Values{"report": {rep.ID}, "base": {base.ID}, "current": {current.ID}, "format": {"csv"}}
+	section := ReportSection{Title: "Comparison", Headers: headers, Rows: rows,
+		Links: append([]ReportLink{{Label: "📊 Export Comparison (CSV)", URL: "/reports/compare?" + export.Encode()}}, back...)}
+	if len(cmp.Skipped) > 0 {
+		section.Notes = append([]string{"⚠️ Some values couldn't be calculated:"}, cmp.Skipped...)
+	}
+	renderReport(w, ReportPage{Title: "Compare Runs", Subtitle: rep.Name, Sections: []ReportSection{section, choose}})
+}
@@ -0,0 +1,288 @@
+// config.go
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Addr            string
+	DataDir         string
+	IdempotencyTTL  time.Duration
+	AllowCIDRs      []*net.IPNet
+	DenyCIDRs       []*net.IPNet
+	TrustedProxies  []*net.IPNet
+	OIDC            OIDCConfig
+	QuotaDatasets   int   // per owner, 0 = unlimited
+	QuotaBytes      int64 // per owner, 0 = unlimited
+	MemoryBudget    int64 // heap a parse may grow to, 0 = unchecked (see memory.go)
+	InteractiveRows int   // datasets above this many rows are analysis-only (see tiers.go)
+	MaxRows         int   // hard cap on rows per dataset
+	TrashRetention  time.Duration
+	SMTP            SMTPConfig
+	Watch           WatchConfig
+	Inbound         InboundConfig
+	Chat            ChatConfig
+	Encryption      EncryptionConfig
+	Rounding        string // default rounding policy for exact decimal results
+	StateBackend    string // see state.go
+	BlobDir         string // large datasets go here as files with the Postgres backend
+	CalcCacheTTL    time.Duration
+	CalcPerUser     int            // analyses running at once per user
+	CalcQueue       int            // analyses per user waiting behind those
+	CalcQueueWait   time.Duration  // how long one waits before giving up
+	CalcBudget      time.Duration  // time one analysis may take before returning partial results
+	ResultTTL       time.Duration  // how long API calculation results can be exported
+	RateLimit       int            // requests per minute per client and route, 0 = unlimited
+	RateLimits      map[string]int // per route, overriding RateLimit
+
+	// Upload sessions (see uploads.go)
+	UploadTTL         time.Duration // since last use
+	UploadsPerSession int           // recent datasets kept per session
+	UploadMemory      int64         // held across sessions before the least recently used are evicted
+}
+
+// WatchConfig enables the watch folder when Dir and Template are set: files
+// dropped into Dir are validated against the template and the results
+// written alongside them.
+type WatchConfig struct {
+	Dir      string
+	Template string
+	Team     string
+	Webhook  string
+	Interval time.Duration
+}
+
+// InboundConfig enables email-in when Token is set: the mail provider posts
+// to /inbound/email/<Token>. Senders lists the addresses and "@domain"s
+// allowed to send; BaseURL is how reply links reach this server.
+type InboundConfig struct {
+	Token   string
+	Team    string
+	Senders []string
+	BaseURL string
+}
+
+// ChatConfig enables the Slack slash command when SlackSigningSecret is set
+// and the Teams outgoing webhook when TeamsSecret is. SlackBotToken lets the
+// command fetch files shared in Slack. Questions are answered from Team.
+type ChatConfig struct {
+	SlackSigningSecret string
+	SlackBotToken      string
+	TeamsSecret        string
+	Team               string
+}
+
+// EncryptionConfig turns on encryption at rest when one of Key, KeyFile or
+// KeyCommand gives a master key (see crypt.go). OldKeys are earlier master
+// keys, kept so data written before a rotation can still be read.
+type EncryptionConfig struct {
+	Key        string
+	KeyFile    string
+	KeyCommand string
+	OldKeys    []string
+}
+
+// SMTPConfig is used to email scheduled reports. Email delivery is
+// unavailable until Addr and From are set.
+type SMTPConfig struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// OIDCConfig enables single sign-on when Issuer is set. RoleMap maps IdP
+// group names to viewer, editor or admin.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	GroupsClaim  string
+	RoleMap      map[string]string
+	DefaultRole  string
+	SessionTTL   time.Duration
+}
+
+var config = loadConfig()
+
+func loadConfig() Config {
+	return Config{
+		Addr:            envOr("ADDR", ":8080"),
+		DataDir:         envOr("DATA_DIR", "data"),
+		IdempotencyTTL:  envDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+		AllowCIDRs:      envCIDRs("ALLOW_CIDRS"),
+		DenyCIDRs:       envCIDRs("DENY_CIDRS"),
+		TrustedProxies:  envCIDRs("TRUSTED_PROXIES"),
+		QuotaDatasets:   int(envInt("QUOTA_DATASETS", 200)),
+		QuotaBytes:      envInt("QUOTA_BYTES", 1<<30),
+		MemoryBudget:    envInt("MEMORY_BUDGET", 1<<30),
+		InteractiveRows: int(envInt("INTERACTIVE_ROWS", 10000)),
+		MaxRows:         int(envInt("MAX_ROWS", 250000)),
+		TrashRetention:  time.Duration(envInt("TRASH_DAYS", 30)) * 24 * time.Hour,
+		Rounding:        envOr("ROUNDING_POLICY", "half_up"),
+		StateBackend:    envOr("STATE_BACKEND", "memory"),
+		BlobDir:         os.Getenv("BLOB_DIR"),
+		CalcCacheTTL:    envDuration("CALC_CACHE_TTL", 10*time.Minute),
+		CalcPerUser:     int(envInt("CALC_PER_USER", 2)),
+		CalcQueue:       int(envInt("CALC_QUEUE", 2)),
+		CalcQueueWait:   envDuration("CALC_QUEUE_WAIT", 15*time.Second),
+		CalcBudget:      envDuration("CALC_BUDGET", 20*time.Second),
+		ResultTTL:       envDuration("RESULT_TTL", 24*time.Hour),
+		RateLimit:       int(envInt("RATE_LIMIT", 0)),
+		RateLimits:      envIntMap("RATE_LIMITS"),
+
+		UploadTTL:         envDuration("UPLOAD_TTL", 12*time.Hour),
+		UploadsPerSession: int(envInt("UPLOADS_PER_SESSION", 5)),
+		UploadMemory:      envInt("UPLOAD_MEMORY", 64<<20),
+
+		SMTP: SMTPConfig{
+			Addr:     os.Getenv("SMTP_ADDR"),
+			From:     os.Getenv("SMTP_FROM"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		},
+		Watch: WatchConfig{
+			Dir:      os.Getenv("WATCH_DIR"),
+			Template: os.Getenv("WATCH_TEMPLATE"),
+			Team:     envOr("WATCH_WORKSPACE", defaultTeamID),
+			Webhook:  os.Getenv("WATCH_WEBHOOK"),
+			Interval: envDuration("WATCH_INTERVAL", time.Minute),
+		},
+		Inbound: InboundConfig{
+			Token:   os.Getenv("INBOUND_TOKEN"),
+			Team:    envOr("INBOUND_WORKSPACE", defaultTeamID),
+			Senders: envList("INBOUND_SENDERS"),
+			BaseURL: os.Getenv("BASE_URL"),
+		},
+		Chat: ChatConfig{
+			SlackSigningSecret: os.Getenv("SLACK_SIGNING_SECRET"),
+			SlackBotToken:      os.Getenv("SLACK_BOT_TOKEN"),
+			TeamsSecret:        os.Getenv("TEAMS_WEBHOOK_SECRET"),
+			Team:               envOr("CHAT_WORKSPACE", defaultTeamID),
+		},
+		Encryption: EncryptionConfig{
+			Key:        os.Getenv("ENCRYPTION_KEY"),
+			KeyFile:    os.Getenv("ENCRYPTION_KEY_FILE"),
+			KeyCommand: os.Getenv("ENCRYPTION_KEY_COMMAND"),
+			OldKeys:    envList("ENCRYPTION_OLD_KEYS"),
+		},
+		OIDC: OIDCConfig{
+			Issuer:       strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/"),
+			ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+			GroupsClaim:  envOr("OIDC_GROUPS_CLAIM", "groups"),
+			RoleMap:      envMap("OIDC_ROLE_MAP"),
+			DefaultRole:  envOr("OIDC_DEFAULT_ROLE", RoleViewer),
+			SessionTTL:   envDuration("SESSION_TTL", 12*time.Hour),
+		},
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Ignoring %s=%q: %v", key, v, err)
+		return fallback
+	}
+	return d
+}
+
+func envInt(key string, fallback int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Printf("Ignoring %s=%q: %v", key, v, err)
+		return fallback
+	}
+	return n
+}
+
+// envList parses a comma-separated list.
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envMap parses "key=value,key=value".
+func envMap(key string) map[string]string {
+	m := make(map[string]string)
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		k, v, ok := strings.Cut(item, "=")
+		if ok && strings.TrimSpace(k) != "" {
+			m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return m
+}
+
+// envIntMap parses "key=number,key=number".
+func envIntMap(key string) map[string]int {
+	m := make(map[string]int)
+	for k, v := range envMap(key) {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Printf("Ignoring %s entry %s=%q: %v", key, k, v, err)
+			continue
+		}
+		m[k] = n
+	}
+	return m
+}
+
+// envCIDRs parses a comma-separated list of CIDRs or bare addresses. A bad
+// entry is fatal: silently dropping part of an allowlist is worse than not
+// starting.
+func envCIDRs(key string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			log.Fatalf("Invalid %s entry %q: %v", key, item, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func dataPath(name string) string {
+	return filepath.Join(config.DataDir, name)
+}
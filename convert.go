@@ -0,0 +1,184 @@
+// convert.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// UnitConversion turns a value v into v*Factor + Offset.
+type UnitConversion struct {
+	Name   string
+	Label  string
+	Factor float64
+	Offset float64
+}
+
+var unitConversions = []UnitConversion{
+	{Name: "cents_rands", Label: "Cents → Rands", Factor: 0.01},
+	{Name: "rands_cents", Label: "Rands → Cents", Factor: 100},
+	{Name: "g_kg", Label: "Grams → Kilograms", Factor: 0.001},
+	{Name: "kg_g", Label: "Kilograms → Grams", Factor: 1000},
+	{Name: "lb_kg", Label: "Pounds → Kilograms", Factor: 0.45359237},
+	{Name: "kg_lb", Label: "Kilograms → Pounds", Factor: 1 / 0.45359237},
+	{Name: "ft_m", Label: "Feet → Metres", Factor: 0.3048},
+	{Name: "m_ft", Label: "Metres → Feet", Factor: 1 / 0.3048},
+	{Name: "in_cm", Label: "Inches → Centimetres", Factor: 2.54},
+	{Name: "cm_in", Label: "Centimetres → Inches", Factor: 1 / 2.54},
+	{Name: "mi_km", Label: "Miles → Kilometres", Factor: 1.609344},
+	{Name: "km_mi", Label: "Kilometres → Miles", Factor: 1 / 1.609344},
+	{Name: "f_c", Label: "Fahrenheit → Celsius", Factor: 5.0 / 9, Offset: -32 * 5.0 / 9},
+	{Name: "c_f", Label: "Celsius → Fahrenheit", Factor: 9.0 / 5, Offset: 32},
+}
+
+func lookupConversion(name string) (UnitConversion, bool) {
+	for _, c := range unitConversions {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return UnitConversion{}, false
+}
+
+// Describe is the lineage detail, e.g. "Cents → Rands (×0.01)".
+func (c UnitConversion) Describe() string {
+	s := fmt.Sprintf("×%.6g", c.Factor)
+	if c.Offset != 0 {
+		s += fmt.Sprintf(" %+.6g", c.Offset)
+	}
+	return c.Label + " (" + s + ")"
+}
+
+func (c UnitConversion) Apply(v float64) string {
+	return formatComputed(v*c.Factor + c.Offset)
+}
+
+// formatComputed writes a computed cell value rounded to 12 significant
+// digits, so factors like 0.01 don't leave binary noise such as
+// 12.340000000000002 in the cell.
+func formatComputed(v float64) string {
+	out, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'g', 12, 64), 64)
+	return strconv.FormatFloat(out, 'f', -1, 64)
+}
+
+// convertColumn converts the numbers in col. With into empty the column is
+// converted in place and non-numeric cells are kept; otherwise the results go
+// in a new column named into, blank where the source isn't a number. It
+// returns how many cells were converted.
+func convertColumn(data *Spreadsheet, col int, conv UnitConversion, into string) (int, error) {
+	source := data.Headers[col]
+	target := col
+	if into != "" {
+		if columnIndex(data.Headers, into) != -1 {
+			return 0, fmt.Errorf("column %q already exists", into)
+		}
+		target = len(data.Headers)
+		data.ColumnIDs = append(append([]string(nil), data.ColumnIDs...), nextColumnID(*data))
+		data.Headers = append(append([]string(nil), data.Headers...), into)
+	}
+	width := len(data.Headers)
+	rows := make([][]string, len(data.Rows))
+	converted := 0
+	for i, row := range data.Rows {
+		out := make([]string, width)
+		copy(out, row)
+		if v, ok := parseFinite(cellValue(row, col)); ok {
+			out[target] = conv.Apply(v)
+			converted++
+		} else if target != col {
+			out[target] = ""
+		}
+		rows[i] = out
+	}
+	if converted == 0 {
+		return 0, fmt.Errorf("%s has no numbers to convert", source)
+	}
+	name := data.Headers[target]
+	entry := ColumnLineage{Column: name, Sources: []string{source}, Operation: "convert", Detail: conv.Describe()}
+	if target == col {
+		// Converting in place keeps whatever history the column already had.
+		switch prev := lineageFor(*data)[col]; prev.Operation {
+		case "source":
+		case "convert":
+			entry.Sources = prev.Sources
+			entry.Detail = prev.Detail + "; then " + entry.Detail
+		default:
+			entry.Sources = prev.Sources
+			entry.Detail = prev.Operation + ": " + prev.Detail + "; then " + entry.Detail
+		}
+	}
+	data.Rows = rows
+	data.NumericCols = detectNumericColumns(*data)
+	data.Lineage = withLineage(data.Lineage, entry)
+	data.Pipeline = appendStep(data.Pipeline, "convert_units", map[string]string{
+		"column": source,
+		"into":   name,
+		"factor": strconv.FormatFloat(conv.Factor, 'g', -1, 64),
+		"offset": strconv.FormatFloat(conv.Offset, 'g', -1, 64),
+	})
+	return converted, nil
+}
+
+// convertHandler applies a preset or custom unit conversion to a numeric
+// column from the display page.
+func convertHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	data, ok := teamDataset(r, r.FormValue("dataset"))
+	if !ok {
+		http.Error(w, "Unknown dataset", http.StatusNotFound)
+		return
+	}
+	if err := checkVersion(r, data); err != nil {
+		http.Error(w, err.Error(), updateErrorStatus(w, err))
+		return
+	}
+	col := columnRef(data, r.FormValue("column"))
+	if col == -1 {
+		http.Error(w, "Unknown column", http.StatusBadRequest)
+		return
+	}
+	var conv UnitConversion
+	if name := r.FormValue("conversion"); name == "custom" {
+		factor, errF := strconv.ParseFloat(strings.TrimSpace(r.FormValue("factor")), 64)
+		offset := 0.0
+		var errO error
+		if v := strings.TrimSpace(r.FormValue("offset")); v != "" {
+			offset, errO = strconv.ParseFloat(v, 64)
+		}
+		if errF != nil || errO != nil || factor == 0 {
+			http.Error(w, "A custom conversion needs a non-zero factor and an optional offset", http.StatusBadRequest)
+			return
+		}
+		conv = UnitConversion{Name: "custom", Label: "Custom", Factor: factor, Offset: offset}
+	} else if conv, ok = lookupConversion(name); !ok {
+		http.Error(w, fmt.Sprintf("Unknown conversion %q", name), http.StatusBadRequest)
+		return
+	}
+	into := ""
+	if r.FormValue("mode") == "add" {
+		if into = strings.TrimSpace(r.FormValue("into")); into == "" {
+			into = data.Headers[col] + " (converted)"
+		}
+	}
+
+	converted, err := convertColumn(&data, col, conv, into)
+	if err != nil {
+		http.Error(w, "Conversion error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	data.Notes = append(data.Notes, fmt.Sprintf("Converted %q: %s (%d value(s))", data.Headers[col], conv.Describe(), converted))
+	if err := workspace.Update(&data); err != nil {
+		http.Error(w, err.Error(), updateErrorStatus(w, err))
+		return
+	}
+	renderDisplay(w, r, data)
+}
@@ -0,0 +1,269 @@
+// crosstab.go
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const maxCrosstabCategories = 200
+
+// Crosstab counts rows by the values of two columns. Empty cells are
+// counted under "(blank)".
+type Crosstab struct {
+	RowLabels []string
+	ColLabels []string
+	Counts    [][]int
+	RowTotals []int
+	ColTotals []int
+	Total     int
+}
+
+func buildCrosstab(data Spreadsheet, rowCol, colCol int) (Crosstab, error) {
+	var ct Crosstab
+	rowIndex, colIndex := make(map[string]int), make(map[string]int)
+	type pair struct{ r, c string }
+	counts := make(map[pair]int)
+	label := func(row []string, col int) string {
+		if v := cellValue(row, col); v != "" {
+			return v
+		}
+		return "(blank)"
+	}
+	for _, row := range data.Rows {
+		r, c := label(row, rowCol), label(row, colCol)
+		if _, ok := rowIndex[r]; !ok {
+			rowIndex[r] = len(ct.RowLabels)
+			ct.RowLabels = append(ct.RowLabels, r)
+		}
+		if _, ok := colIndex[c]; !ok {
+			colIndex[c] = len(ct.ColLabels)
+			ct.ColLabels = append(ct.ColLabels, c)
+		}
+		counts[pair{r, c}]++
+	}
+	if len(ct.RowLabels) > maxCrosstabCategories || len(ct.ColLabels) > maxCrosstabCategories {
+		return ct, fmt.Errorf("crosstabs are limited to %d values per column; %s has %d and %s has %d",
+			maxCrosstabCategories, data.Headers[rowCol], len(ct.RowLabels), data.Headers[colCol], len(ct.ColLabels))
+	}
+	sort.SliceStable(ct.RowLabels, func(i, j int) bool { return compareCells(ct.RowLabels[i], ct.RowLabels[j]) < 0 })
+	sort.SliceStable(ct.ColLabels, func(i, j int) bool { return compareCells(ct.ColLabels[i], ct.ColLabels[j]) < 0 })
+	ct.Counts = make([][]int, len(ct.RowLabels))
+	ct.RowTotals, ct.ColTotals = make([]int, len(ct.RowLabels)), make([]int, len(ct.ColLabels))
+	for i, r := range ct.RowLabels {
+		ct.Counts[i] = make([]int, len(ct.ColLabels))
+		for j, c := range ct.ColLabels {
+			n := counts[pair{r, c}]
+			ct.Counts[i][j] = n
+			ct.RowTotals[i] += n
+			ct.ColTotals[j] += n
+			ct.Total += n
+		}
+	}
+	return ct, nil
+}
+
+type ChiSquare struct {
+	Statistic float64
+	DF        int
+	P         float64
+	CramersV  float64
+	LowCells  int // cells with an expected count below 5
+}
+
+// chiSquare tests whether the two columns are independent.
+func (ct Crosstab) chiSquare() (ChiSquare, bool) {
+	r, c := len(ct.RowLabels), len(ct.ColLabels)
+	if r < 2 || c < 2 || ct.Total == 0 {
+		return ChiSquare{}, false
+	}
+	var res ChiSquare
+	for i := range ct.Counts {
+		for j, n := range ct.Counts[i] {
+			expected := float64(ct.RowTotals[i]) * float64(ct.ColTotals[j]) / float64(ct.Total)
+			if expected < 5 {
+				res.LowCells++
+			}
+			d := float64(n) - expected
+			res.Statistic += d * d / expected
+		}
+	}
+	res.DF = (r - 1) * (c - 1)
+	res.P = chiSquareSurvival(res.Statistic, float64(res.DF))
+	k := r
+	if c < k {
+		k = c
+	}
+	res.CramersV = math.Sqrt(res.Statistic / (float64(ct.Total) * float64(k-1)))
+	return res, true
+}
+
+// chiSquareSurvival is P(X > x) for a chi-square distribution with df
+// degrees of freedom: the regularized upper incomplete gamma Q(df/2, x/2).
+func chiSquareSurvival(x, df float64) float64 {
+	a, x := df/2, x/2
+	if x <= 0 {
+		return 1
+	}
+	lg, _ := math.Lgamma(a)
+	front := math.Exp(-x + a*math.Log(x) - lg)
+	if x < a+1 {
+		// series for the lower gamma P, then Q = 1 − P
+		sum, term := 1/a, 1/a
+		for n := 1; n < 500; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if math.Abs(term) < math.Abs(sum)*1e-14 {
+				break
+			}
+		}
+		return 1 - front*sum
+	}
+	// continued fraction for Q
+	const tiny = 1e-300
+	b := x + 1 - a
+	c, d := 1/tiny, 1/b
+	h := d
+	for n := 1; n < 500; n++ {
+		an := -float64(n) * (float64(n) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+		if math.Abs(d*c-1) < 1e-14 {
+			break
+		}
+	}
+	return front * h
+}
+
+var crosstabViews = map[string]string{
+	"counts": "Counts",
+	"row":    "Row %",
+	"col":    "Column %",
+	"total":  "Total %",
+}
+
+// table renders the crosstab with totals in the given view.
+func (ct Crosstab) table(corner, view string) ([]string, [][]string) {
+	headers := append([]string{corner}, ct.ColLabels...)
+	headers = append(headers, "Total")
+	cell := func(n, rowTotal, colTotal int) string {
+		var base int
+		switch view {
+		case "row":
+			base = rowTotal
+		case "col":
+			base = colTotal
+		case "total":
+			base = ct.Total
+		default:
+			return strconv.Itoa(n)
+		}
+		if base == 0 {
+			return "–"
+		}
+		return formatStat(float64(n)*100/float64(base)) + "%"
+	}
+	var rows [][]string
+	for i, label := range ct.RowLabels {
+		row := []string{label}
+		for j, n := range ct.Counts[i] {
+			row = append(row, cell(n, ct.RowTotals[i], ct.ColTotals[j]))
+		}
+		rows = append(rows, append(row, cell(ct.RowTotals[i], ct.RowTotals[i], ct.Total)))
+	}
+	totals := []string{"Total"}
+	for j, n := range ct.ColTotals {
+		totals = append(totals, cell(n, ct.Total, ct.ColTotals[j]))
+	}
+	rows = append(rows, append(totals, cell(ct.Total, ct.Total, ct.Total)))
+	return headers, rows
+}
+
+// crosstabHandler renders a contingency table of two columns as counts or
+// percentages, optionally with a chi-square test of independence.
+func crosstabHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	data := activeDataset(r)
+	if id := q.Get("dataset"); id != "" {
+		var ok bool
+		if data, ok = teamDataset(r, id); !ok {
+			http.Error(w, "Unknown dataset", http.StatusNotFound)
+			return
+		}
+	}
+	if len(data.Headers) == 0 {
+		http.Error(w, "No dataset loaded", http.StatusBadRequest)
+		return
+	}
+	rowCol, colCol := columnRef(data, q.Get("rows")), columnRef(data, q.Get("cols"))
+	if rowCol == -1 || colCol == -1 {
+		http.Error(w, "Choose a row column and a column column", http.StatusBadRequest)
+		return
+	}
+	view := q.Get("view")
+	if view == "" {
+		view = "counts"
+	}
+	if _, ok := crosstabViews[view]; !ok {
+		http.Error(w, "view must be counts, row, col or total", http.StatusBadRequest)
+		return
+	}
+	ct, err := buildCrosstab(data, rowCol, colCol)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	corner := data.Headers[rowCol] + " \\ " + data.Headers[colCol]
+	headers, rows := ct.table(corner, view)
+	if q.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_crosstab.csv"`, exportBaseName(data.FileName)))
+		writeCSV(w, headers, rows)
+		return
+	}
+
+	var links []ReportLink
+	for _, v := range []string{"counts", "row", "col", "total"} {
+		if v != view {
+			q.Set("view", v)
+			links = append(links, ReportLink{Label: "Show " + crosstabViews[v], URL: "/crosstab?" + q.Encode()})
+		}
+	}
+	q.Set("view", view)
+	q.Set("format", "csv")
+	links = append(links, ReportLink{Label: "📊 Export " + crosstabViews[view] + " (CSV)", URL: "/crosstab?" + q.Encode()})
+	sections := []ReportSection{{Title: crosstabViews[view], Headers: headers, Rows: rows, Links: links,
+		Notes: []string{fmt.Sprintf("%d row(s) by %s (rows) and %s (columns).", ct.Total, data.Headers[rowCol], data.Headers[colCol])}}}
+
+	if q.Get("chi") == "1" {
+		section := ReportSection{Title: "Chi-Square Test of Independence"}
+		if chi, ok := ct.chiSquare(); ok {
+			verdict := "no evidence at the 5% level that the columns are related"
+			if chi.P < 0.05 {
+				verdict = "the columns are related (significant at the 5% level)"
+			}
+			section.Headers = []string{"χ²", "df", "p-value", "Cramér's V"}
+			section.Rows = [][]string{{fmt.Sprintf("%.3f", chi.Statistic), strconv.Itoa(chi.DF), fmt.Sprintf("%.4g", chi.P), fmt.Sprintf("%.3f", chi.CramersV)}}
+			section.Notes = []string{"Result: " + verdict + "."}
+			if cells := len(ct.RowLabels) * len(ct.ColLabels); chi.LowCells*5 > cells {
+				section.Notes = append(section.Notes, fmt.Sprintf("⚠️ %d of %d cells expect fewer than 5 rows, so the test may be unreliable.", chi.LowCells, cells))
+			}
+		} else {
+			section.Notes = []string{"The test needs at least two values in each column."}
+		}
+		sections = append(sections, section)
+	}
+	renderReport(w, ReportPage{Title: "Crosstab", Subtitle: data.FileName, Sections: sections})
+}
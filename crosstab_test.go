@@ -0,0 +1,36 @@
+// crosstab_test.go
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestChiSquareSurvival(t *testing.T) {
+	tests := []struct {
+		x, df, want float64
+	}{
+		// critical values from a chi-square table
+		{3.841459, 1, 0.05},
+		{6.634897, 1, 0.01},
+		{5.991465, 2, 0.05},
+		{11.070498, 5, 0.05},
+		{18.307038, 10, 0.05},
+		{23.209251, 10, 0.01},
+		{124.342113, 100, 0.05},
+		{0.454936, 1, 0.5}, // the median
+		// closed forms: Q = erfc(√(x/2)) for one degree of freedom and
+		// e^(−x/2) for two
+		{0.1, 1, math.Erfc(math.Sqrt(0.05))},
+		{30, 1, math.Erfc(math.Sqrt(15))},
+		{2, 2, math.Exp(-1)},
+		{40, 2, math.Exp(-20)},
+		{0, 3, 1},
+	}
+	for _, tt := range tests {
+		got := chiSquareSurvival(tt.x, tt.df)
+		if math.Abs(got-tt.want) > 1e-6*tt.want {
+			t.Errorf("chiSquareSurvival(%v, %v) = %.8g, want %.8g", tt.x, tt.df, got, tt.want)
+		}
+	}
+}
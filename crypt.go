@@ -0,0 +1,228 @@
+// crypt.go
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Datasets, wherever the state backend keeps them, and the files written
+// under DATA_DIR are encrypted at rest once a master key is configured. Each
+// value is sealed with its own random data key using AES-256-GCM, and the
+// data key is sealed with the master key (envelope encryption). Rotating the
+// master key means moving the old one to ENCRYPTION_OLD_KEYS; values are
+// rewritten under the new key as they change.
+//
+// The master key is 32 bytes, base64 encoded, taken from ENCRYPTION_KEY,
+// from ENCRYPTION_KEY_FILE (say, a secret a KMS agent mounts) or from the
+// output of ENCRYPTION_KEY_COMMAND (say, "aws kms decrypt ..."), which runs
+// once at start.
+//
+// A sealed value is
+//
+//	sealMagic | key id (8) | nonce (12) | sealed data key (48) | nonce (12) | sealed data
+//
+// and anything without sealMagic in front is read as plaintext, so data
+// written before encryption was turned on stays readable. The Postgres
+// backend's documents stay plain JSON for the presets view to read; its
+// datasets are sealed like everywhere else.
+
+const sealMagic = "DRSEAL1\x00"
+
+const (
+	sealKeyIDSize = 8
+	sealNonceSize = 12
+	sealDEKSize   = 32 + 16 // data key plus GCM tag
+	sealHeadSize  = len(sealMagic) + sealKeyIDSize + sealNonceSize + sealDEKSize
+)
+
+var errNoKey = errors.New("data is encrypted but no key for it is configured")
+
+type keyring struct {
+	current []byte
+	id      string            // fingerprint of current
+	keys    map[string][]byte // every master key by fingerprint
+}
+
+// atRest is nil when encryption is off.
+var atRest = loadKeyring(config.Encryption)
+
+func loadKeyring(cfg EncryptionConfig) *keyring {
+	var encoded string
+	switch {
+	case cfg.Key != "":
+		encoded = cfg.Key
+	case cfg.KeyFile != "":
+		b, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			log.Fatalf("ENCRYPTION_KEY_FILE: %v", err)
+		}
+		encoded = string(b)
+	case cfg.KeyCommand != "":
+		cmd := exec.Command("sh", "-c", cfg.KeyCommand)
+		cmd.Stderr = os.Stderr
+		b, err := cmd.Output()
+		if err != nil {
+			log.Fatalf("ENCRYPTION_KEY_COMMAND: %v", err)
+		}
+		encoded = string(b)
+	default:
+		if len(cfg.OldKeys) > 0 {
+			log.Fatalf("ENCRYPTION_OLD_KEYS is set without a current key")
+		}
+		return nil
+	}
+	current, err := parseMasterKey(encoded)
+	if err != nil {
+		log.Fatalf("Encryption key: %v", err)
+	}
+	k := &keyring{current: current, id: keyFingerprint(current), keys: map[string][]byte{}}
+	k.keys[k.id] = current
+	for i, old := range cfg.OldKeys {
+		key, err := parseMasterKey(old)
+		if err != nil {
+			log.Fatalf("ENCRYPTION_OLD_KEYS entry %d: %v", i+1, err)
+		}
+		k.keys[keyFingerprint(key)] = key
+	}
+	log.Printf("Encryption at rest is on (key %s)", k.id)
+	return k
+}
+
+func parseMasterKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		key, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("not base64")
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("need 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(append([]byte("clientweb master key\x00"), key...))
+	return hex.EncodeToString(sum[:sealKeyIDSize])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealAtRest encrypts b for storage, or returns it as is when encryption
+// is off.
+func sealAtRest(b []byte) ([]byte, error) {
+	if atRest == nil {
+		return b, nil
+	}
+	dek := make([]byte, 32)
+	nonces := make([]byte, 2*sealNonceSize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonces); err != nil {
+		return nil, err
+	}
+	kek, err := newGCM(atRest.current)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := hex.DecodeString(atRest.id)
+	out := make([]byte, 0, sealHeadSize+sealNonceSize+len(b)+16)
+	out = append(out, sealMagic...)
+	out = append(out, id...)
+	out = append(out, nonces[:sealNonceSize]...)
+	out = kek.Seal(out, nonces[:sealNonceSize], dek, id)
+	out = append(out, nonces[sealNonceSize:]...)
+	data, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	// The header is authenticated along with the data, so it can't be
+	// swapped for another value's.
+	head := append([]byte{}, out[:sealHeadSize]...)
+	return data.Seal(out, nonces[sealNonceSize:], b, head), nil
+}
+
+// openAtRest decrypts what sealAtRest stored. Plaintext passes through.
+func openAtRest(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, []byte(sealMagic)) {
+		return b, nil
+	}
+	if len(b) < sealHeadSize+sealNonceSize {
+		return nil, fmt.Errorf("encrypted data is truncated")
+	}
+	p := len(sealMagic)
+	id := b[p : p+sealKeyIDSize]
+	p += sealKeyIDSize
+	if atRest == nil {
+		return nil, errNoKey
+	}
+	master, ok := atRest.keys[hex.EncodeToString(id)]
+	if !ok {
+		return nil, fmt.Errorf("%w (key %x)", errNoKey, id)
+	}
+	kek, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	dek, err := kek.Open(nil, b[p:p+sealNonceSize], b[p+sealNonceSize:sealHeadSize], id)
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap data key: %w", err)
+	}
+	data, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := b[sealHeadSize : sealHeadSize+sealNonceSize]
+	plain, err := data.Open(nil, nonce, b[sealHeadSize+sealNonceSize:], b[:sealHeadSize])
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt: %w", err)
+	}
+	return plain, nil
+}
+
+// getSealedJSON and setSealedJSON are getStateJSON and setStateJSON for
+// values that hold dataset contents.
+func getSealedJSON(key string, v interface{}) error {
+	b, err := state.Get(key)
+	if err != nil {
+		return err
+	}
+	if b, err = openAtRest(b); err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return json.Unmarshal(b, v)
+}
+
+func setSealedJSON(key string, v interface{}, ttl time.Duration) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if b, err = sealAtRest(b); err != nil {
+		return err
+	}
+	return state.Set(key, b, ttl)
+}
@@ -0,0 +1,176 @@
+// crypt_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var (
+	testKeyOld = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x11}, 32))
+	testKeyNew = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x22}, 32))
+)
+
+// useKeys switches encryption at rest to cfg for the rest of the test.
+func useKeys(t *testing.T, cfg EncryptionConfig) {
+	saved := atRest
+	atRest = loadKeyring(cfg)
+	t.Cleanup(func() { atRest = saved })
+}
+
+func seal(t *testing.T, b []byte) []byte {
+	t.Helper()
+	sealed, err := sealAtRest(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	useKeys(t, EncryptionConfig{Key: testKeyOld})
+	for _, plain := range []string{"", `{"id":"abc"}`, strings.Repeat("dataset row,", 10000)} {
+		sealed := seal(t, []byte(plain))
+		if len(sealed) != sealHeadSize+sealNonceSize+len(plain)+16 {
+			t.Errorf("%d bytes sealed to %d", len(plain), len(sealed))
+		}
+		if len(plain) > 0 && bytes.Contains(sealed, []byte(plain)) {
+			t.Error("the plaintext is in the sealed value")
+		}
+		got, err := openAtRest(sealed)
+		if err != nil || string(got) != plain {
+			t.Errorf("%.20q opened as %.20q, %v", plain, got, err)
+		}
+	}
+	// Each value has its own data key and nonces.
+	if a, b := seal(t, []byte("same")), seal(t, []byte("same")); bytes.Equal(a[len(sealMagic)+sealKeyIDSize:], b[len(sealMagic)+sealKeyIDSize:]) {
+		t.Error("sealing twice gave the same bytes")
+	}
+}
+
+// The documented layout, unwrapped by hand rather than by openAtRest.
+func TestSealLayout(t *testing.T) {
+	useKeys(t, EncryptionConfig{Key: testKeyOld})
+	sealed := seal(t, []byte("hello"))
+	if !bytes.HasPrefix(sealed, []byte("DRSEAL1\x00")) {
+		t.Fatalf("starts %q", sealed[:8])
+	}
+	id := sealed[8:16]
+	// The key id is the first 8 bytes of SHA-256("clientweb master key\x00" + key).
+	if got := keyFingerprint(bytes.Repeat([]byte{0x11}, 32)); got != "2ff953f9eef157c0" || !bytes.Equal(id, mustHex(got)) {
+		t.Fatalf("key id %x, fingerprint %s", id, got)
+	}
+	kek, _ := newGCM(bytes.Repeat([]byte{0x11}, 32))
+	dek, err := kek.Open(nil, sealed[16:28], sealed[28:76], id)
+	if err != nil || len(dek) != 32 {
+		t.Fatalf("data key: %d bytes, %v", len(dek), err)
+	}
+	data, _ := newGCM(dek)
+	plain, err := data.Open(nil, sealed[76:88], sealed[88:], sealed[:76])
+	if err != nil || string(plain) != "hello" {
+		t.Errorf("opened %q, %v", plain, err)
+	}
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestSealRotation(t *testing.T) {
+	useKeys(t, EncryptionConfig{Key: testKeyOld})
+	old := seal(t, []byte("written before rotation"))
+
+	useKeys(t, EncryptionConfig{Key: testKeyNew, OldKeys: []string{testKeyOld}})
+	if got, err := openAtRest(old); err != nil || string(got) != "written before rotation" {
+		t.Errorf("old value opened as %q, %v", got, err)
+	}
+	fresh := seal(t, []byte("written after"))
+	if !bytes.Equal(fresh[8:16], mustHex(atRest.id)) || bytes.Equal(fresh[8:16], old[8:16]) {
+		t.Errorf("new value sealed under key %x, old under %x", fresh[8:16], old[8:16])
+	}
+
+	// Once the old key is dropped its values can't be read, and say why.
+	useKeys(t, EncryptionConfig{Key: testKeyNew})
+	if _, err := openAtRest(old); !errors.Is(err, errNoKey) {
+		t.Errorf("without the old key: %v", err)
+	}
+	if got, err := openAtRest(fresh); err != nil || string(got) != "written after" {
+		t.Errorf("new value opened as %q, %v", got, err)
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	useKeys(t, EncryptionConfig{Key: testKeyOld})
+	sealed := seal(t, []byte(`{"rows":[["a","b"]]}`))
+	// Changing any byte after the magic, in the header or the data, must
+	// fail rather than return something else.
+	for i := len(sealMagic); i < len(sealed); i++ {
+		b := bytes.Clone(sealed)
+		b[i] ^= 0x01
+		if got, err := openAtRest(b); err == nil {
+			t.Errorf("byte %d changed, opened as %q", i, got)
+		}
+	}
+	// A header can't be moved onto another value's data.
+	other := seal(t, []byte(`{"rows":[["c","d"]]}`))
+	swapped := append(bytes.Clone(other[:sealHeadSize]), sealed[sealHeadSize:]...)
+	if _, err := openAtRest(swapped); err == nil {
+		t.Error("opened a value under another value's header")
+	}
+	for _, n := range []int{len(sealMagic) + 1, sealHeadSize, sealHeadSize + sealNonceSize + 3} {
+		if _, err := openAtRest(sealed[:n]); err == nil {
+			t.Errorf("opened the first %d bytes", n)
+		}
+	}
+}
+
+func TestOpenPlaintext(t *testing.T) {
+	useKeys(t, EncryptionConfig{})
+	if atRest != nil {
+		t.Fatal("encryption is on without a key")
+	}
+	if got := seal(t, []byte(`{"a":1}`)); string(got) != `{"a":1}` {
+		t.Errorf("sealed %q with encryption off", got)
+	}
+
+	useKeys(t, EncryptionConfig{Key: testKeyOld})
+	sealed := seal(t, []byte("secret"))
+	// Data from before encryption was turned on reads as it is.
+	for _, plain := range []string{"", `{"a":1}`, "DRSEAL0 not ours"} {
+		if got, err := openAtRest([]byte(plain)); err != nil || string(got) != plain {
+			t.Errorf("%q opened as %q, %v", plain, got, err)
+		}
+	}
+
+	useKeys(t, EncryptionConfig{})
+	if _, err := openAtRest(sealed); !errors.Is(err, errNoKey) {
+		t.Errorf("sealed value with encryption off: %v", err)
+	}
+}
+
+func TestParseMasterKey(t *testing.T) {
+	raw := bytes.Repeat([]byte{0xfb}, 32)
+	for _, s := range []string{
+		base64.StdEncoding.EncodeToString(raw),
+		base64.URLEncoding.EncodeToString(raw),
+		base64.RawURLEncoding.EncodeToString(raw),
+		"  " + base64.StdEncoding.EncodeToString(raw) + "\n",
+	} {
+		if key, err := parseMasterKey(s); err != nil || !bytes.Equal(key, raw) {
+			t.Errorf("%q: %x, %v", s, key, err)
+		}
+	}
+	for _, s := range []string{"", "not base64!", base64.StdEncoding.EncodeToString(raw[:16])} {
+		if _, err := parseMasterKey(s); err == nil {
+			t.Errorf("%q: want an error", s)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// csvformat.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+const sniffBytes = 16 << 10
+
+// CSVOptions says how to read a CSV file. An empty Delimiter or Encoding is
+// detected from the start of the file.
+type CSVOptions struct {
+	Delimiter string // a csvDelimiters name
+	Encoding  string // a csvEncodings name
+	Columns   columnProjection
+	Detected  DetectionReport // how the settings left empty were chosen
+}
+
+var csvDelimiters = []struct {
+	Name  string
+	Comma rune
+	Label string
+}{
+	{"comma", ',', "Comma (,)"},
+	{"semicolon", ';', "Semicolon (;)"},
+	{"tab", '\t', "Tab"},
+	{"pipe", '|', "Pipe (|)"},
+}
+
+var csvEncodings = map[string]encoding.Encoding{
+	"utf-8":        unicode.UTF8BOM,
+	"utf-16le":     unicode.UTF16(unicode.LittleEndian, unicode.UseBOM),
+	"utf-16be":     unicode.UTF16(unicode.BigEndian, unicode.UseBOM),
+	"windows-1252": charmap.Windows1252,
+	"iso-8859-1":   charmap.ISO8859_1,
+}
+
+// csvOptionsFromForm reads the delimiter and encoding fields of an upload
+// form; "auto" or nothing leaves them to be detected.
+func csvOptionsFromForm(r *http.Request) (CSVOptions, error) {
+	var opts CSVOptions
+	if v := r.FormValue("delimiter"); v != "" && v != "auto" {
+		if delimiterRune(v) == 0 {
+			return opts, fmt.Errorf("unknown delimiter %q", v)
+		}
+		opts.Delimiter = v
+	}
+	if v := strings.ToLower(r.FormValue("encoding")); v != "" && v != "auto" {
+		if _, ok := csvEncodings[v]; !ok {
+			return opts, fmt.Errorf("unknown encoding %q", v)
+		}
+		opts.Encoding = v
+	}
+	return opts, nil
+}
+
+func delimiterRune(name string) rune {
+	for _, d := range csvDelimiters {
+		if d.Name == name {
+			return d.Comma
+		}
+	}
+	return 0
+}
+
+// newCSVReader decodes file and returns a reader for it, along with the
+// options it settled on.
+func newCSVReader(file io.Reader, opts CSVOptions) (*csv.Reader, CSVOptions, error) {
+	decoded, encoding, found, err := decodeText(file, opts.Encoding)
+	if err != nil {
+		return nil, opts, err
+	}
+	opts.Encoding = encoding
+	opts.Detected = append(opts.Detected, found...)
+	if opts.Delimiter == "" {
+		sample, err := decoded.Peek(sniffBytes)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			return nil, opts, fmt.Errorf("not valid %s: %w", opts.Encoding, err)
+		}
+		d := sniffDelimiter(sample, len(sample) == sniffBytes)
+		opts.Delimiter = d.Value
+		opts.Detected = append(opts.Detected, d)
+	}
+	reader := csv.NewReader(decoded)
+	reader.Comma = delimiterRune(opts.Delimiter)
+	reader.FieldsPerRecord = -1
+	return reader, opts, nil
+}
+
+// decodeText returns file decoded to UTF-8 from encoding, a csvEncodings
+// name, or from the encoding detected when that's empty, along with how it
+// was detected.
+func decodeText(file io.Reader, encoding string) (*bufio.Reader, string, DetectionReport, error) {
+	raw := bufio.NewReaderSize(file, sniffBytes)
+	var found DetectionReport
+	if encoding == "" {
+		sample, err := raw.Peek(sniffBytes)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			return nil, encoding, nil, err
+		}
+		d := sniffEncoding(sample)
+		encoding = d.Value
+		found = append(found, d)
+	}
+	return bufio.NewReaderSize(csvEncodings[encoding].NewDecoder().Reader(raw), sniffBytes), encoding, found, nil
+}
+
+// sniffEncoding goes by the byte order mark, then by whether the sample is
+// valid UTF-8. Anything else is taken to be Windows-1252, which is what
+// spreadsheet programs on Windows write as "ANSI".
+func sniffEncoding(sample []byte) Detection {
+	d := Detection{Subject: "Encoding", Confidence: 1}
+	switch {
+	case bytes.HasPrefix(sample, []byte{0xEF, 0xBB, 0xBF}):
+		d.Value, d.Evidence = "utf-8", "the file starts with the UTF-8 byte order mark"
+		return d
+	case bytes.HasPrefix(sample, []byte{0xFF, 0xFE}):
+		d.Value, d.Evidence = "utf-16le", "the file starts with the UTF-16 little-endian byte order mark"
+		return d
+	case bytes.HasPrefix(sample, []byte{0xFE, 0xFF}):
+		d.Value, d.Evidence = "utf-16be", "the file starts with the UTF-16 big-endian byte order mark"
+		return d
+	}
+	// UTF-16 without a BOM: ASCII text leaves every other byte zero.
+	var evenZeros, oddZeros int
+	for i, b := range sample {
+		if b == 0 {
+			if i%2 == 0 {
+				evenZeros++
+			} else {
+				oddZeros++
+			}
+		}
+	}
+	if half := len(sample) / 2; half > 0 {
+		zeros := func(n int, order string) Detection {
+			d.Value = "utf-16" + order
+			d.Confidence = float64(n) / float64(half)
+			d.Evidence = fmt.Sprintf("%d%% of the %s bytes are zero, as in text saved as UTF-16 without a byte order mark",
+				n*100/half, map[string]string{"le": "odd", "be": "even"}[order])
+			return d
+		}
+		if oddZeros > half*3/4 {
+			return zeros(oddZeros, "le")
+		}
+		if evenZeros > half*3/4 {
+			return zeros(evenZeros, "be")
+		}
+	}
+	// The sample may end partway through a character.
+	for cut := 0; cut < utf8.UTFMax && cut <= len(sample); cut++ {
+		if utf8.Valid(sample[:len(sample)-cut]) {
+			d.Value = "utf-8"
+			if n := nonASCII(sample); n > 0 {
+				d.Confidence = 0.95
+				d.Evidence = fmt.Sprintf("%d non-ASCII byte(s) in the first %s, all valid UTF-8", n, formatFileSize(int64(len(sample))))
+			} else {
+				d.Evidence = fmt.Sprintf("the first %s is plain ASCII, which reads the same in every encoding offered", formatFileSize(int64(len(sample))))
+			}
+			return d
+		}
+	}
+	d.Value, d.Confidence = "windows-1252", 0.6
+	d.Evidence = fmt.Sprintf("byte %d isn't valid UTF-8, so Windows-1252 (\"ANSI\") is assumed; "+
+		"if accented letters, € or quotes look wrong, choose the encoding on upload", firstInvalidUTF8(sample))
+	return d
+}
+
+func nonASCII(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			n++
+		}
+	}
+	return n
+}
+
+// firstInvalidUTF8 is the 1-based offset of the first byte that isn't part
+// of a valid UTF-8 sequence.
+func firstInvalidUTF8(b []byte) int {
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size == 1 {
+			return i + 1
+		}
+		i += size
+	}
+	return len(b)
+}
+
+// sniffDelimiter picks the delimiter that splits the first lines into the
+// same number of fields, preferring more fields. Delimiters inside quotes
+// don't count. A truncated sample's last line is ignored.
+func sniffDelimiter(sample []byte, truncated bool) Detection {
+	lines := strings.Split(strings.ReplaceAll(string(sample), "\r\n", "\n"), "\n")
+	if truncated && len(lines) > 1 {
+		lines = lines[:len(lines)-1]
+	}
+	var nonBlank []string
+	for _, l := range lines {
+		if strings.TrimSpace(l) != "" {
+			nonBlank = append(nonBlank, l)
+		}
+		if len(nonBlank) == 20 {
+			break
+		}
+	}
+	type candidate struct {
+		label        string
+		agree, count int
+	}
+	var candidates []candidate
+	best, bestAgree, bestCount, bestLabel := "comma", 0, 0, ""
+	for _, d := range csvDelimiters {
+		var counts []int
+		for _, l := range nonBlank {
+			n, quoted := 0, false
+			for _, c := range l {
+				switch {
+				case c == '"':
+					quoted = !quoted
+				case c == d.Comma && !quoted:
+					n++
+				}
+			}
+			counts = append(counts, n)
+		}
+		if len(counts) == 0 || counts[0] == 0 {
+			continue
+		}
+		agree := 0
+		for _, n := range counts {
+			if n == counts[0] {
+				agree++
+			}
+		}
+		candidates = append(candidates, candidate{d.Label, agree, counts[0]})
+		if agree > bestAgree || agree == bestAgree && counts[0] > bestCount {
+			best, bestAgree, bestCount, bestLabel = d.Name, agree, counts[0], d.Label
+		}
+	}
+	found := Detection{Subject: "Delimiter", Value: best}
+	if bestAgree == 0 {
+		found.Confidence = 0.5
+		found.Evidence = "no comma, semicolon, tab or pipe outside quotes on the first line, so the file is read as a single column"
+		return found
+	}
+	found.Confidence = float64(bestAgree) / float64(len(nonBlank))
+	found.Evidence = fmt.Sprintf("%d of the first %d lines split into %d fields on %s", bestAgree, len(nonBlank), bestCount+1, strings.ToLower(bestLabel))
+	for _, c := range candidates {
+		if c.label == bestLabel {
+			continue
+		}
+		if c.agree == bestAgree {
+			// Only the field count decided it.
+			found.Confidence *= 0.75
+		}
+		found.Evidence += fmt.Sprintf("; %s gives %d fields on %d", strings.ToLower(c.label), c.count+1, c.agree)
+	}
+	return found
+}
@@ -0,0 +1,386 @@
+// dashboards.go
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DashboardWidget is a result or chart pinned to a dashboard. It names the
+// source file rather than a dataset, so it always shows the latest upload.
+type DashboardWidget struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"` // result or chart
+	Source    string    `json:"source"`
+	Column    string    `json:"column"`
+	Operation string    `json:"operation,omitempty"`
+	Params    OpParams  `json:"params,omitempty"`
+	PinnedAt  time.Time `json:"pinned_at"`
+}
+
+type Dashboard struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Team       string            `json:"team"`
+	Owner      string            `json:"owner,omitempty"`
+	ShareToken string            `json:"share_token,omitempty"` // anyone with the link can view
+	Widgets    []DashboardWidget `json:"widgets"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+func (d Dashboard) ShareURL() string {
+	if d.ShareToken == "" {
+		return ""
+	}
+	return "/shared/dashboards/" + d.ShareToken
+}
+
+type DashboardStore struct {
+	mu         sync.RWMutex
+	path       string
+	dashboards map[string]Dashboard
+}
+
+var dashboards = newDashboardStore(dataPath("dashboards.json"))
+
+func newDashboardStore(path string) *DashboardStore {
+	s := &DashboardStore{path: path, dashboards: make(map[string]Dashboard)}
+	s.load()
+	watchDataFile(path, s.load)
+	return s
+}
+
+// load reads the dashboards file, replacing what is in memory.
+func (s *DashboardStore) load() {
+	var list []Dashboard
+	if err := readJSONFile(s.path, &list); err != nil {
+		log.Printf("Could not load dashboards: %v", err)
+		return
+	}
+	dashboards := make(map[string]Dashboard)
+	for _, d := range list {
+		dashboards[d.ID] = d
+	}
+	s.mu.Lock()
+	s.dashboards = dashboards
+	s.mu.Unlock()
+}
+
+func (s *DashboardStore) List(team string) []Dashboard {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []Dashboard
+	for _, d := range s.dashboards {
+		if d.Team == team {
+			list = append(list, d)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (s *DashboardStore) Get(id string) (Dashboard, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.dashboards[id]
+	return d, ok
+}
+
+// ByName finds a team's dashboard by name, ignoring case.
+func (s *DashboardStore) ByName(team, name string) (Dashboard, bool) {
+	for _, d := range s.List(team) {
+		if strings.EqualFold(d.Name, name) {
+			return d, true
+		}
+	}
+	return Dashboard{}, false
+}
+
+func (s *DashboardStore) ByToken(token string) (Dashboard, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, d := range s.dashboards {
+		if d.ShareToken != "" && subtle.ConstantTimeCompare([]byte(d.ShareToken), []byte(token)) == 1 {
+			return d, true
+		}
+	}
+	return Dashboard{}, false
+}
+
+func (s *DashboardStore) Save(d Dashboard) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dashboards[d.ID] = d
+	return s.flush()
+}
+
+func (s *DashboardStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.dashboards, id)
+	return s.flush()
+}
+
+// flush must be called with the lock held.
+func (s *DashboardStore) flush() error {
+	list := make([]Dashboard, 0, len(s.dashboards))
+	for _, d := range s.dashboards {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return writeJSONFile(s.path, list)
+}
+
+// latestUpload returns the team's most recent upload of the named file.
+func latestUpload(team, source string) (Spreadsheet, bool) {
+	var latest Spreadsheet
+	found := false
+	for _, data := range workspace.List() {
+		if data.ParentID != "" || data.FileName != source || datasetTeam(data) != team {
+			continue
+		}
+		if !found || !data.UploadTime.Before(latest.UploadTime) {
+			latest, found = data, true
+		}
+	}
+	return latest, found
+}
+
+// widgetSection renders a widget against the latest upload of its source.
+func widgetSection(w DashboardWidget, team string) ReportSection {
+	section := ReportSection{Title: w.Column}
+	if op, ok := lookupOperation(w.Operation); ok && w.Kind == "result" {
+		section.Title = op.Label + " of " + w.Column
+		if p := describeParams(op, w.Params); p != "" {
+			section.Title += " (" + p + ")"
+		}
+	} else if w.Kind == "chart" {
+		section.Title = "Chart of " + w.Column
+	}
+	data, ok := latestUpload(team, w.Source)
+	if !ok {
+		section.Notes = []string{fmt.Sprintf("⚠️ No upload of %s is available.", w.Source)}
+		return section
+	}
+	section.Notes = []string{fmt.Sprintf("From %s uploaded %s", data.FileName, data.UploadTime.Format("2006-01-02 15:04"))}
+	col := columnIndex(data.Headers, w.Column)
+	if col == -1 {
+		section.Notes = append(section.Notes, fmt.Sprintf("⚠️ The latest upload has no %q column.", w.Column))
+		return section
+	}
+	if w.Kind == "chart" {
+		dateCol := -1
+		if dates := detectDateColumns(data); len(dates) > 0 {
+			dateCol = dates[0]
+		}
+		section.Figure = sparkline(data, col, dateCol)
+		return section
+	}
+	value, err := memoizedCalculation(data, col, w.Operation, w.Params)
+	if err != nil {
+		section.Notes = append(section.Notes, fmt.Sprintf("⚠️ %v", err))
+		return section
+	}
+	section.Headers = []string{"Value", "Rows"}
+	section.Rows = [][]string{{formatStat(value), fmt.Sprint(len(data.Rows))}}
+	return section
+}
+
+func dashboardPage(d Dashboard, manage bool) ReportPage {
+	page := ReportPage{Title: d.Name, Subtitle: "Dashboard"}
+	for _, w := range d.Widgets {
+		section := widgetSection(w, d.Team)
+		if manage {
+			section.Form = &ReportForm{Action: "/dashboards/" + d.ID, Submit: "📌 Unpin", Fields: []FormField{
+				{Name: "action", Type: "hidden", Value: "unpin"},
+				{Name: "widget", Type: "hidden", Value: w.ID},
+			}}
+		}
+		page.Sections = append(page.Sections, section)
+	}
+	if len(d.Widgets) == 0 {
+		page.Sections = append(page.Sections, ReportSection{Notes: []string{"Nothing is pinned yet. Pin results from the results page."}})
+	}
+	return page
+}
+
+// dashboardsHandler lists the team's dashboards and creates, shares and
+// deletes them.
+func dashboardsHandler(w http.ResponseWriter, r *http.Request) {
+	team := currentTeam(r).ID
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		switch r.FormValue("action") {
+		case "create":
+			if name == "" {
+				http.Error(w, "Dashboard name is required", http.StatusBadRequest)
+				return
+			}
+			if _, exists := dashboards.ByName(team, name); exists {
+				http.Error(w, "A dashboard with that name already exists", http.StatusConflict)
+				return
+			}
+			d := Dashboard{ID: newID(), Name: name, Team: team, Owner: ownerID(currentUser(r)), CreatedAt: time.Now()}
+			if err := dashboards.Save(d); err != nil {
+				http.Error(w, fmt.Sprintf("Could not save dashboard: %v", err), http.StatusInternalServerError)
+				return
+			}
+		case "share", "unshare", "delete":
+			d, ok := dashboards.Get(r.FormValue("dashboard"))
+			if !ok || d.Team != team {
+				http.Error(w, "Unknown dashboard", http.StatusNotFound)
+				return
+			}
+			var err error
+			switch r.FormValue("action") {
+			case "share":
+				d.ShareToken = newID() + newID()
+				err = dashboards.Save(d)
+			case "unshare":
+				d.ShareToken = ""
+				err = dashboards.Save(d)
+			default:
+				err = dashboards.Delete(d.ID)
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Could not save dashboard: %v", err), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "Invalid action", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/dashboards", http.StatusSeeOther)
+		return
+	}
+
+	list := dashboards.List(team)
+	section := ReportSection{Title: "Dashboards", Headers: []string{"Name", "Widgets", "Created", "Share Link"}}
+	var options []FormOption
+	for _, d := range list {
+		share := "not shared"
+		if u := d.ShareURL(); u != "" {
+			share = u
+		}
+		section.Rows = append(section.Rows, []string{d.Name, fmt.Sprint(len(d.Widgets)), d.CreatedAt.Format("2006-01-02"), share})
+		section.Links = append(section.Links, ReportLink{Label: "📈 " + d.Name, URL: "/dashboards/" + d.ID})
+		options = append(options, FormOption{Value: d.ID, Label: d.Name})
+	}
+	sections := []ReportSection{section}
+	if currentUser(r).HasRole(RoleEditor) {
+		sections = append(sections, ReportSection{Title: "New Dashboard", Form: &ReportForm{Action: "/dashboards", Submit: "➕ Create", Fields: []FormField{
+			{Name: "action", Type: "hidden", Value: "create"},
+			{Name: "name", Label: "Name", Placeholder: "e.g. Monthly refunds"},
+		}}})
+		if len(options) > 0 {
+			sections = append(sections, ReportSection{Title: "Manage", Notes: []string{"Sharing creates a link anyone can open without signing in; unsharing revokes it."}, Form: &ReportForm{Action: "/dashboards", Submit: "Apply", Fields: []FormField{
+				{Name: "dashboard", Label: "Dashboard", Type: "select", Options: options},
+				{Name: "action", Label: "Action", Type: "select", Options: []FormOption{
+					{Value: "share", Label: "🔗 Create a new share link"},
+					{Value: "unshare", Label: "🚫 Revoke the share link"},
+					{Value: "delete", Label: "🗑️ Delete the dashboard"},
+				}},
+			}}})
+		}
+	}
+	renderReport(w, ReportPage{Title: "Dashboards", Subtitle: currentTeam(r).Name, Sections: sections})
+}
+
+// dashboardHandler shows a dashboard against the latest data and unpins
+// widgets from it.
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	d, ok := dashboards.Get(r.PathValue("id"))
+	if !ok || d.Team != currentTeam(r).ID {
+		http.Error(w, "Unknown dashboard", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		if r.FormValue("action") != "unpin" {
+			http.Error(w, "Invalid action", http.StatusBadRequest)
+			return
+		}
+		widgets := make([]DashboardWidget, 0, len(d.Widgets))
+		for _, wd := range d.Widgets {
+			if wd.ID != r.FormValue("widget") {
+				widgets = append(widgets, wd)
+			}
+		}
+		d.Widgets = widgets
+		if err := dashboards.Save(d); err != nil {
+			http.Error(w, fmt.Sprintf("Could not save dashboard: %v", err), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/dashboards/"+d.ID, http.StatusSeeOther)
+		return
+	}
+	renderReport(w, dashboardPage(d, currentUser(r).HasRole(RoleEditor)))
+}
+
+// sharedDashboardHandler serves a dashboard to anyone holding its share
+// token. It is reachable without signing in.
+func sharedDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	d, ok := dashboards.ByToken(r.PathValue("token"))
+	if !ok {
+		http.Error(w, "Unknown or revoked link", http.StatusNotFound)
+		return
+	}
+	renderReport(w, dashboardPage(d, false))
+}
+
+// pinHandler pins the last calculation's results, and optionally a chart of
+// each column, to a dashboard, creating the dashboard if needed.
+func pinHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	lastResult := uploads.Result(r)
+	if len(lastResult.Results) == 0 {
+		http.Error(w, "No results to pin", http.StatusBadRequest)
+		return
+	}
+	if len(lastResult.Filters) > 0 {
+		// Widgets calculate over every row of the latest upload.
+		http.Error(w, "Results of a filtered calculation can't be pinned", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("dashboard"))
+	if name == "" {
+		http.Error(w, "Dashboard name is required", http.StatusBadRequest)
+		return
+	}
+	team := currentTeam(r).ID
+	d, ok := dashboards.ByName(team, name)
+	if !ok {
+		d = Dashboard{ID: newID(), Name: name, Team: team, Owner: ownerID(currentUser(r)), CreatedAt: time.Now()}
+	}
+	charts := r.FormValue("charts") == "1"
+	for _, res := range lastResult.Results {
+		widget := DashboardWidget{Kind: "result", Source: lastResult.FileName, Column: res.Col, Operation: lastResult.OpName, Params: lastResult.ParamValues, PinnedAt: time.Now()}
+		widget.ID = newID()
+		d.Widgets = append(d.Widgets, widget)
+		if charts {
+			widget.ID, widget.Kind, widget.Operation, widget.Params = newID(), "chart", "", nil
+			d.Widgets = append(d.Widgets, widget)
+		}
+	}
+	if err := dashboards.Save(d); err != nil {
+		http.Error(w, fmt.Sprintf("Could not save dashboard: %v", err), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/dashboards/"+d.ID, http.StatusSeeOther)
+}
@@ -0,0 +1,226 @@
+// datasets_api.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+type DatasetSummary struct {
+	ID       string    `json:"id"`
+	ParentID string    `json:"parent_id,omitempty"`
+	Name     string    `json:"name"`
+	Rows     int       `json:"rows"`
+	Columns  int       `json:"columns"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	Owner    string    `json:"owner"`
+	Version  int       `json:"version"`
+	Tier     RowTier   `json:"tier"`
+}
+
+type DatasetMeta struct {
+	DatasetSummary
+	Derivation string          `json:"derivation,omitempty"`
+	Checksum   string          `json:"checksum,omitempty"`
+	Notes      []string        `json:"notes,omitempty"`
+	Annotation string          `json:"annotation,omitempty"`
+	Pipeline   []TransformStep `json:"pipeline,omitempty"`
+	Schema     []ColumnProfile `json:"schema"`
+	Lineage    []ColumnLineage `json:"lineage"`
+	Detections DetectionReport `json:"detections,omitempty"`
+	Drift      *SchemaDrift    `json:"drift,omitempty"` // set when the upload replaced another
+	// ProfileStatus is "updating" while the profile is recomputed after a
+	// change; Schema then describes ProfileVersion, the previous version,
+	// and ProfileProgress says how far the recomputation has got.
+	ProfileStatus   string          `json:"profile_status"`
+	ProfileVersion  int             `json:"profile_version"`
+	ProfileProgress *ProgressStatus `json:"profile_progress,omitempty"`
+}
+
+type DatasetSummaries []DatasetSummary
+
+func (list DatasetSummaries) Table() ([]string, [][]string) {
+	headers := []string{"id", "parent_id", "name", "rows", "columns", "size", "created", "owner", "version"}
+	rows := make([][]string, len(list))
+	for i, d := range list {
+		rows[i] = []string{d.ID, d.ParentID, d.Name, strconv.Itoa(d.Rows), strconv.Itoa(d.Columns),
+			strconv.FormatInt(d.Size, 10), d.Created.Format(time.RFC3339), d.Owner, strconv.Itoa(d.Version)}
+	}
+	return headers, rows
+}
+
+type Page struct {
+	Offset     int         `json:"offset"`
+	Limit      int         `json:"limit"`
+	Total      int         `json:"total"`
+	NextOffset *int        `json:"next_offset,omitempty"`
+	Items      interface{} `json:"items"`
+}
+
+type RowsPage struct {
+	Headers   []string `json:"headers"`
+	ColumnIDs []string `json:"column_ids"`
+	Page
+}
+
+func (p RowsPage) Table() ([]string, [][]string) {
+	return p.Headers, p.Items.([][]string)
+}
+
+func summarizeDataset(data Spreadsheet) DatasetSummary {
+	return DatasetSummary{
+		ID:       data.ID,
+		ParentID: data.ParentID,
+		Name:     data.FileName,
+		Rows:     len(data.Rows),
+		Columns:  len(data.Headers),
+		Size:     data.FileSize,
+		Created:  data.UploadTime,
+		Owner:    data.Owner,
+		Version:  data.Version,
+		Tier:     datasetTier(data),
+	}
+}
+
+// parsePaging reads offset and limit from the query string and returns the
+// bounds of the requested window within total items.
+func parsePaging(r *http.Request, total int) (offset, limit, end int, err error) {
+	offset, limit = 0, defaultPageLimit
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxPageLimit {
+			return 0, 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+	}
+	if offset > total {
+		offset = total
+	}
+	end = offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, limit, end, nil
+}
+
+func newPage(offset, limit, end, total int, items interface{}) Page {
+	page := Page{Offset: offset, Limit: limit, Total: total, Items: items}
+	if end < total {
+		page.NextOffset = &end
+	}
+	return page
+}
+
+func listDatasetsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var datasets []Spreadsheet
+	team := currentTeam(r).ID
+	for _, data := range workspace.List() {
+		if datasetTeam(data) == team {
+			datasets = append(datasets, data)
+		}
+	}
+	offset, limit, end, err := parsePaging(r, len(datasets))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	items := make(DatasetSummaries, 0, end-offset)
+	for _, data := range datasets[offset:end] {
+		items = append(items, summarizeDataset(data))
+	}
+	writeAPIData(w, r, newPage(offset, limit, end, len(datasets), items))
+}
+
+func datasetAPIHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := teamDataset(r, r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Unknown dataset")
+		return
+	}
+	accessLog.Record(r, data.ID, "api", "metadata")
+	w.Header().Set("ETag", strconv.Quote(strconv.Itoa(data.Version)))
+	profile, current := profiles.Lookup(data)
+	status := "ready"
+	var progress *ProgressStatus
+	if !current {
+		status = "updating"
+		if p, ok := profiles.Progress(data.ID); ok {
+			progress = &p
+		}
+	}
+	writeAPIData(w, r, DatasetMeta{
+		DatasetSummary:  summarizeDataset(data),
+		Derivation:      data.Derivation,
+		Checksum:        data.Checksum,
+		Notes:           data.Notes,
+		Annotation:      data.Annotations.Dataset,
+		Pipeline:        data.Pipeline,
+		Schema:          profile.Profile.Columns,
+		Lineage:         lineageFor(data),
+		Detections:      data.Detections,
+		Drift:           data.Drift,
+		ProfileStatus:   status,
+		ProfileVersion:  profile.Version,
+		ProfileProgress: progress,
+	})
+}
+
+func datasetRowsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := teamDataset(r, r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Unknown dataset")
+		return
+	}
+	offset, limit, end, err := parsePaging(r, len(data.Rows))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	accessLog.Record(r, data.ID, "api", fmt.Sprintf("rows %d-%d", offset, end))
+	page := newPage(offset, limit, end, len(data.Rows), data.Rows[offset:end])
+	writeAPIData(w, r, RowsPage{Headers: data.Headers, ColumnIDs: data.ColumnIDs, Page: page})
+}
+
+func columnStatsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := teamDataset(r, r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Unknown dataset")
+		return
+	}
+	loose, err := parseMatchMode(r.URL.Query().Get("match"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	col, match, err := matchColumn(data, r.PathValue("name"), loose)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	accessLog.Record(r, data.ID, "api", "stats of "+data.Headers[col])
+	bins := 10
+	if v := r.URL.Query().Get("bins"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			writeAPIError(w, http.StatusBadRequest, "bins must be between 1 and 100")
+			return
+		}
+		bins = n
+	}
+	stats := columnStats(data, col, bins)
+	if match.Loose() {
+		stats.Matched = &match
+	}
+	writeAPIData(w, r, stats)
+}
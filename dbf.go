@@ -0,0 +1,234 @@
+// dbf.go
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// dBase tables (.dbf): a header, one descriptor per field, then fixed-length
+// records. This covers dBase III to 7 and Visual FoxPro. Memo fields live in
+// a separate .dbt/.fpt file, which an upload doesn't have.
+
+// dbfCodePages maps the header's language driver ID to its code page.
+var dbfCodePages = map[byte]encoding.Encoding{
+	0x01: charmap.CodePage437,
+	0x02: charmap.CodePage850,
+	0x03: charmap.Windows1252,
+	0x26: charmap.CodePage866,
+	0x57: charmap.Windows1252,
+	0x58: charmap.Windows1252,
+	0x59: charmap.Windows1252,
+	0x64: charmap.CodePage852,
+	0x65: charmap.CodePage866,
+	0x66: charmap.CodePage865,
+	0xC8: charmap.Windows1250,
+	0xC9: charmap.Windows1251,
+	0xCA: charmap.Windows1254,
+	0xCB: charmap.Windows1253,
+}
+
+// dbfVersions are the first bytes of the dBase variants.
+const dbfVersions = "\x02\x03\x04\x05\x30\x31\x32\x43\x63\x83\x8B\x8C\x8E\xCB\xF5\xFB"
+
+type dbfField struct {
+	name     string
+	kind     byte
+	offset   int // within the record, after the deletion flag
+	length   int
+	decimals int
+}
+
+// processDBF reads at most limit records, leaving out deleted ones.
+func processDBF(file io.ReaderAt, limit int) (Spreadsheet, error) {
+	var data Spreadsheet
+	header := make([]byte, 32)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return data, fmt.Errorf("not a dBase file")
+	}
+	version := header[0]
+	records := int(binary.LittleEndian.Uint32(header[4:]))
+	headerLen := int(binary.LittleEndian.Uint16(header[8:]))
+	recordLen := int(binary.LittleEndian.Uint16(header[10:]))
+	if strings.IndexByte(dbfVersions, version) == -1 || headerLen < 33 || recordLen < 1 {
+		return data, fmt.Errorf("not a dBase file")
+	}
+	foxPro := version == 0x30 || version == 0x31 || version == 0x32
+	level7 := version&0x07 == 4 // dBase 7 has longer field descriptors
+	descStart, descLen, nameLen := 32, 32, 11
+	if level7 {
+		descStart, descLen, nameLen = 68, 48, 32
+	}
+	desc := make([]byte, headerLen)
+	if _, err := file.ReadAt(desc, 0); err != nil {
+		return data, fmt.Errorf("truncated dBase header")
+	}
+
+	var fields []dbfField
+	var memos []string
+	offset := 0
+	for pos := descStart; pos+descLen <= headerLen && desc[pos] != 0x0D; pos += descLen {
+		d := desc[pos : pos+descLen]
+		f := dbfField{name: strings.TrimRight(string(d[:nameLen]), "\x00 "), kind: d[nameLen], offset: offset}
+		if level7 {
+			f.length, f.decimals = int(d[33]), int(d[34])
+		} else {
+			f.length, f.decimals = int(d[16]), int(d[17])
+			if f.kind == 'C' && !foxPro {
+				f.length += int(d[17]) << 8 // Clipper's long character fields
+			}
+		}
+		offset += f.length
+		if foxPro && d[18]&0x01 != 0 {
+			continue // a system column such as _NullFlags
+		}
+		switch f.kind {
+		case 'M', 'G', 'P':
+			memos = append(memos, f.name)
+		case 'B':
+			if !foxPro {
+				memos = append(memos, f.name) // dBase's binary memo; FoxPro's is a double
+			}
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 {
+		return data, fmt.Errorf("the dBase file has no fields")
+	}
+	if offset+1 > recordLen {
+		return data, fmt.Errorf("corrupt dBase header: fields overrun the record length")
+	}
+
+	decoder := dbfCodePages[header[29]]
+	text := func(b []byte) string {
+		b = []byte(strings.TrimRight(string(b), "\x00 "))
+		dec := decoder
+		if dec == nil {
+			if utf8.Valid(b) {
+				return string(b)
+			}
+			dec = charmap.Windows1252
+		}
+		s, _ := dec.NewDecoder().Bytes(b)
+		return string(s)
+	}
+
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = text([]byte(f.name))
+	}
+	data.Headers = dedupeHeaders(normalizeHeaders(names))
+	record := make([]byte, recordLen)
+	deleted := 0
+	for i := 0; i < records && len(data.Rows) < limit; i++ {
+		n, err := file.ReadAt(record, int64(headerLen)+int64(i)*int64(recordLen))
+		if n < recordLen {
+			if err == io.EOF {
+				break // the record count overstates what's there
+			}
+			return data, err
+		}
+		if record[0] == 0x1A {
+			break
+		}
+		if record[0] == '*' {
+			deleted++
+			continue
+		}
+		row := make([]string, len(fields))
+		for c, f := range fields {
+			row[c] = dbfValue(f, record[1+f.offset:1+f.offset+f.length], foxPro, text)
+		}
+		data.Rows = append(data.Rows, row)
+	}
+	if deleted > 0 {
+		data.Notes = append(data.Notes, fmt.Sprintf("Left out %d deleted records", deleted))
+	}
+	if len(memos) > 0 {
+		data.Notes = append(data.Notes, fmt.Sprintf("Memo fields are kept in a separate file, so %s came through blank", strings.Join(memos, ", ")))
+	}
+	return data, nil
+}
+
+// dbfValue formats one field of a record as cell text.
+func dbfValue(f dbfField, b []byte, foxPro bool, text func([]byte) string) string {
+	switch f.kind {
+	case 'C', 'V':
+		return text(b)
+	case 'N', 'F':
+		v := strings.TrimSpace(string(b))
+		if strings.Trim(v, "*") == "" {
+			return "" // blank, or asterisks for a value that overflowed
+		}
+		return v
+	case 'D':
+		if t, err := time.Parse("20060102", strings.TrimSpace(string(b))); err == nil {
+			return t.Format("2006-01-02")
+		}
+		return ""
+	case 'L':
+		if len(b) == 0 {
+			return ""
+		}
+		switch b[0] {
+		case 'T', 't', 'Y', 'y':
+			return "TRUE"
+		case 'F', 'f', 'N', 'n':
+			return "FALSE"
+		}
+		return ""
+	case 'I':
+		if len(b) == 4 {
+			return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b))))
+		}
+	case '+':
+		// dBase 7 autoincrement: big-endian with the sign bit flipped
+		if len(b) == 4 {
+			return strconv.Itoa(int(int32(binary.BigEndian.Uint32(b) ^ 0x80000000)))
+		}
+	case 'O':
+		// dBase 7 double: big-endian, sign bit flipped for positives,
+		// every bit flipped for negatives, so the bytes sort as numbers
+		if len(b) == 8 {
+			bits := binary.BigEndian.Uint64(b)
+			if bits&(1<<63) != 0 {
+				bits ^= 1 << 63
+			} else {
+				bits = ^bits
+			}
+			return strconv.FormatFloat(math.Float64frombits(bits), 'f', -1, 64)
+		}
+	case 'B':
+		if foxPro && len(b) == 8 {
+			return strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)), 'f', -1, 64)
+		}
+		return ""
+	case 'Y':
+		if len(b) == 8 {
+			return strconv.FormatFloat(float64(int64(binary.LittleEndian.Uint64(b)))/10000, 'f', -1, 64)
+		}
+	case 'T':
+		// Julian day and milliseconds since midnight
+		if len(b) == 8 {
+			day := int64(binary.LittleEndian.Uint32(b))
+			ms := int64(binary.LittleEndian.Uint32(b[4:]))
+			if day == 0 {
+				return ""
+			}
+			t := time.Unix((day-2440588)*86400, ms*int64(time.Millisecond)).UTC()
+			return t.Format("2006-01-02 15:04:05")
+		}
+	case 'M', 'G', 'P':
+		return ""
+	}
+	return text(b)
+}
@@ -0,0 +1,190 @@
+// decimal.go
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// Decimal mode aggregates with exact rational arithmetic so currency
+// columns don't drift by cents the way float64 sums do.
+
+var decimalOps = map[string]bool{
+	"sum": true, "average": true, "median": true, "min": true, "max": true, "count": true,
+}
+
+// Rounding is how decimal-mode results are brought to Places fractional
+// digits. Places of -1 keeps the column's own precision.
+type Rounding struct {
+	Policy string // half_up, half_even or truncate
+	Places int
+}
+
+var roundingLabels = map[string]string{
+	"half_up":   "half-up",
+	"half_even": "banker's rounding (half to even)",
+	"truncate":  "truncation",
+}
+
+// roundingOptions lists the policies with the server default selected.
+func roundingOptions() []FormOption {
+	var opts []FormOption
+	for _, p := range []string{"half_up", "half_even", "truncate"} {
+		opts = append(opts, FormOption{Value: p, Label: "Round: " + roundingLabels[p], Selected: p == config.Rounding})
+	}
+	return opts
+}
+
+func (r Rounding) Describe() string {
+	places := "the column's precision"
+	if r.Places >= 0 {
+		places = fmt.Sprintf("%d decimal place(s)", r.Places)
+	}
+	return fmt.Sprintf("Exact results are rounded to %s using %s.", places, roundingLabels[r.Policy])
+}
+
+// roundRat renders r with places fractional digits under policy. half_up
+// rounds halves away from zero, like big.Rat.FloatString.
+func roundRat(r *big.Rat, places int, policy string) string {
+	num := new(big.Int).Mul(r.Num(), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(places)), nil))
+	q, rem := new(big.Int).QuoRem(num, r.Denom(), new(big.Int))
+	if rem.Sign() != 0 && policy != "truncate" {
+		twice := new(big.Int).Abs(rem)
+		twice.Lsh(twice, 1)
+		c := twice.Cmp(r.Denom())
+		if c > 0 || (c == 0 && (policy == "half_up" || q.Bit(0) == 1)) {
+			q.Add(q, big.NewInt(int64(r.Sign())))
+		}
+	}
+	neg := q.Sign() < 0
+	digits := new(big.Int).Abs(q).String()
+	if places > 0 {
+		if len(digits) <= places {
+			digits = strings.Repeat("0", places-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-places] + "." + digits[len(digits)-places:]
+	}
+	if neg {
+		digits = "-" + digits
+	}
+	return digits
+}
+
+func parseDecimal(s string) (*big.Rat, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, false
+	}
+	r, ok := new(big.Rat).SetString(s)
+	return r, ok
+}
+
+// decimalPlaces returns the largest number of fractional digits written in
+// the column, which is the precision results are reported at.
+func decimalPlaces(data Spreadsheet, col int) int {
+	places := 0
+	for _, row := range data.Rows {
+		val := cellValue(row, col)
+		if _, ok := parseDecimal(val); !ok {
+			continue
+		}
+		if i := strings.IndexByte(val, '.'); i >= 0 && !strings.ContainsAny(val, "eE") {
+			if n := len(val) - i - 1; n > places {
+				places = n
+			}
+		}
+	}
+	return places
+}
+
+// isCurrencyColumn treats a numeric column as money when its values carry
+// decimals but never more than two of them.
+func isCurrencyColumn(data Spreadsheet, col int) bool {
+	hasDecimals := false
+	for _, row := range data.Rows {
+		val := cellValue(row, col)
+		if _, ok := parseDecimal(val); !ok {
+			continue
+		}
+		if strings.ContainsAny(val, "eE") {
+			return false
+		}
+		if i := strings.IndexByte(val, '.'); i >= 0 {
+			if len(val)-i-1 > 2 {
+				return false
+			}
+			hasDecimals = true
+		}
+	}
+	return hasDecimals
+}
+
+func useDecimalMode(data Spreadsheet, col int, op, mode string) bool {
+	if !decimalOps[op] {
+		return false
+	}
+	switch mode {
+	case "on":
+		return true
+	case "off":
+		return false
+	}
+	return isCurrencyColumn(data, col)
+}
+
+// performDecimalCalculation mirrors performCalculation using big.Rat and
+// returns the result rendered under rounding.
+func performDecimalCalculation(data Spreadsheet, colIndex int, op string, rounding Rounding) (*big.Rat, string, error) {
+	var values []*big.Rat
+	for _, row := range data.Rows {
+		if v, ok := parseDecimal(cellValue(row, colIndex)); ok {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return nil, "", fmt.Errorf("no numeric values")
+	}
+	scale := decimalPlaces(data, colIndex)
+	if scale < 2 {
+		scale = 2
+	}
+
+	result := new(big.Rat)
+	switch op {
+	case "sum", "average":
+		for _, v := range values {
+			result.Add(result, v)
+		}
+		if op == "average" {
+			result.Quo(result, new(big.Rat).SetInt64(int64(len(values))))
+			scale += 2
+		}
+	case "median":
+		sort.Slice(values, func(i, j int) bool { return values[i].Cmp(values[j]) < 0 })
+		n := len(values)
+		if n%2 == 0 {
+			result.Add(values[n/2-1], values[n/2])
+			result.Quo(result, big.NewRat(2, 1))
+		} else {
+			result.Set(values[n/2])
+		}
+	case "min", "max":
+		result.Set(values[0])
+		for _, v := range values[1:] {
+			if (op == "min" && v.Cmp(result) < 0) || (op == "max" && v.Cmp(result) > 0) {
+				result.Set(v)
+			}
+		}
+	case "count":
+		result.SetInt64(int64(len(values)))
+		scale = 0
+	default:
+		return nil, "", fmt.Errorf("unsupported operation")
+	}
+	if rounding.Places >= 0 && op != "count" {
+		scale = rounding.Places
+	}
+	return result, roundRat(result, scale, rounding.Policy), nil
+}
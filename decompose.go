@@ -0,0 +1,180 @@
+// decompose.go
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// defaultSeasons is the usual cycle length for each period: a week of days,
+// a year of weeks or a year of months.
+var defaultSeasons = map[string]int{"day": 7, "week": 52, "month": 12}
+
+type Decomposition struct {
+	Season   int
+	Trend    []float64 // NaN for the half season at each end
+	Seasonal []float64
+	Residual []float64
+}
+
+// decompose splits values into trend, seasonal and residual parts
+// additively: the trend is a centred moving average over one season, the
+// seasonal part is the mean detrended value at each position in the season
+// (adjusted to sum to zero), and the residual is what is left.
+func decompose(values []float64, season int) (Decomposition, error) {
+	n := len(values)
+	if season < 2 {
+		return Decomposition{}, fmt.Errorf("the season must be at least 2 periods")
+	}
+	if n < 2*season {
+		return Decomposition{}, fmt.Errorf("decomposition needs at least two full seasons (%d periods), found %d", 2*season, n)
+	}
+	d := Decomposition{Season: season, Trend: make([]float64, n), Seasonal: make([]float64, n), Residual: make([]float64, n)}
+	half := season / 2
+	for t := range values {
+		d.Trend[t] = math.NaN()
+		if t < half || t+half >= n {
+			continue
+		}
+		sum := 0.0
+		if season%2 == 1 {
+			for k := t - half; k <= t+half; k++ {
+				sum += values[k]
+			}
+			d.Trend[t] = sum / float64(season)
+			continue
+		}
+		// An even season needs a 2×season average to stay centred: the two
+		// end points get half weight.
+		for k := t - half + 1; k < t+half; k++ {
+			sum += values[k]
+		}
+		sum += (values[t-half] + values[t+half]) / 2
+		d.Trend[t] = sum / float64(season)
+	}
+
+	totals, counts := make([]float64, season), make([]int, season)
+	for t, v := range values {
+		if !math.IsNaN(d.Trend[t]) {
+			totals[t%season] += v - d.Trend[t]
+			counts[t%season]++
+		}
+	}
+	means := make([]float64, season)
+	overall := 0.0
+	for i := range means {
+		if counts[i] > 0 {
+			means[i] = totals[i] / float64(counts[i])
+		}
+		overall += means[i]
+	}
+	overall /= float64(season)
+	for t, v := range values {
+		d.Seasonal[t] = means[t%season] - overall
+		d.Residual[t] = v - d.Trend[t] - d.Seasonal[t]
+	}
+	return d, nil
+}
+
+// decomposeHandler shows a numeric column's per-period totals split into
+// trend, seasonal and residual charts.
+func decomposeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	data := activeDataset(r)
+	if id := q.Get("dataset"); id != "" {
+		var ok bool
+		if data, ok = teamDataset(r, id); !ok {
+			http.Error(w, "Unknown dataset", http.StatusNotFound)
+			return
+		}
+	}
+	if len(data.Headers) == 0 {
+		http.Error(w, "No dataset loaded", http.StatusBadRequest)
+		return
+	}
+	col := columnRef(data, q.Get("column"))
+	if col == -1 {
+		http.Error(w, "Unknown column", http.StatusBadRequest)
+		return
+	}
+	dateCol := -1
+	if ref := q.Get("date"); ref != "" {
+		dateCol = columnRef(data, ref)
+	} else if dates := detectDateColumns(data); len(dates) > 0 {
+		dateCol = dates[0]
+	}
+	if dateCol == -1 {
+		http.Error(w, "Decomposition needs a date column", http.StatusBadRequest)
+		return
+	}
+	period := q.Get("period")
+	if period == "" {
+		period = "month"
+	}
+	season, ok := defaultSeasons[period]
+	if !ok {
+		http.Error(w, "period must be day, week or month", http.StatusBadRequest)
+		return
+	}
+	if v := q.Get("season"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 2 || n > 366 {
+			http.Error(w, "season must be between 2 and 366 periods", http.StatusBadRequest)
+			return
+		}
+		season = n
+	}
+
+	series, err := periodTotals(data, col, dateCol, period)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	d, err := decompose(series.Values, season)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	cell := func(v float64) string {
+		if math.IsNaN(v) {
+			return ""
+		}
+		return formatStat(v)
+	}
+	headers := []string{"Period", "Observed", "Trend", "Seasonal", "Residual"}
+	var rows [][]string
+	for i, t := range series.Starts {
+		rows = append(rows, []string{series.Label(t), cell(series.Values[i]), cell(d.Trend[i]), cell(d.Seasonal[i]), cell(d.Residual[i])})
+	}
+	if q.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_decomposition.csv"`, exportBaseName(data.FileName)))
+		writeCSV(w, headers, rows)
+		return
+	}
+
+	name := data.Headers[col]
+	labels := series.Labels()
+	component := func(title, color string, values []float64) ReportSection {
+		return ReportSection{Title: title, Figure: lineChart(title+" of "+name, labels, []ChartSeries{{Name: title, Color: color, Values: values}}, nil)}
+	}
+	observed := component("Observed", "#2d3748", series.Values)
+	observed.Notes = []string{fmt.Sprintf("%s totalled per %s of %s, with a season of %d %ss.", name, period, data.Headers[dateCol], season, period)}
+	if series.Empty > 0 {
+		observed.Notes = append(observed.Notes, fmt.Sprintf("⚠️ %d %s(s) had no rows and count as 0.", series.Empty, period))
+	}
+	q.Set("format", "csv")
+	table := ReportSection{Title: "Components", Headers: headers, Rows: rows,
+		Notes: []string{"The trend is a centred moving average, so it is blank for half a season at each end."},
+		Links: []ReportLink{{Label: "📊 Export Components (CSV)", URL: "/decompose?" + q.Encode()}}}
+	renderReport(w, ReportPage{Title: "Decomposition of " + name, Subtitle: data.FileName, Sections: []ReportSection{
+		observed,
+		component("Trend", "#667eea", d.Trend),
+		component("Seasonal", "#38a169", d.Seasonal),
+		component("Residual", "#e53e3e", d.Residual),
+		table,
+	}})
+}
@@ -0,0 +1,55 @@
+// decompose_test.go
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDecompose(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name     string
+		values   []float64
+		season   int
+		trend    []float64
+		seasonal []float64 // one season's worth, repeated
+		residual []float64
+	}{
+		// A line plus a pattern summing to zero comes apart exactly: the
+		// centred averages recover the line and nothing is left over.
+		{"quarterly", []float64{13, 11, 10, 18, 21, 19, 18, 26, 29, 27, 26, 34}, 4,
+			[]float64{nan, nan, 14, 16, 18, 20, 22, 24, 26, 28, nan, nan},
+			[]float64{3, -1, -4, 2},
+			[]float64{nan, nan, 0, 0, 0, 0, 0, 0, 0, 0, nan, nan}},
+		{"odd season", []float64{100, 97, 103, 103, 100, 106, 106, 103, 109}, 3,
+			[]float64{nan, 100, 101, 102, 103, 104, 105, 106, nan},
+			[]float64{1, -3, 2},
+			[]float64{nan, 0, 0, 0, 0, 0, 0, 0, nan}},
+		// With noise, worked by hand: the 2×2 average gives the trend and
+		// each position's mean detrended value the season.
+		{"noisy", []float64{1, 3, 2, 6, 3, 5}, 2,
+			[]float64{nan, 2.25, 3.25, 4.25, 4.25, nan},
+			[]float64{-1.25, 1.25},
+			[]float64{nan, -0.5, 0, 0.5, 0, nan}},
+	}
+	same := func(a, b float64) bool {
+		return math.IsNaN(a) && math.IsNaN(b) || math.Abs(a-b) < 1e-9
+	}
+	for _, tt := range tests {
+		d, err := decompose(tt.values, tt.season)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for i := range tt.values {
+			if !same(d.Trend[i], tt.trend[i]) || !same(d.Seasonal[i], tt.seasonal[i%tt.season]) || !same(d.Residual[i], tt.residual[i]) {
+				t.Errorf("%s: period %d split as %v + %v + %v, want %v + %v + %v", tt.name, i,
+					d.Trend[i], d.Seasonal[i], d.Residual[i], tt.trend[i], tt.seasonal[i%tt.season], tt.residual[i])
+			}
+		}
+	}
+
+	if _, err := decompose([]float64{1, 2, 3, 4, 5, 6, 7}, 4); err == nil {
+		t.Error("decomposed less than two seasons")
+	}
+}
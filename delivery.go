@@ -0,0 +1,103 @@
+// delivery.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Delivery says where a scheduled report is sent. Target is an email
+// address, a webhook URL, or a presigned S3 PUT URL, so S3 delivery needs no
+// AWS credentials on this server.
+type Delivery struct {
+	Kind   string `json:"kind"` // email, webhook or s3
+	Target string `json:"target"`
+}
+
+var deliveryClient = &http.Client{Timeout: 30 * time.Second}
+
+func (d Delivery) String() string {
+	if d.Kind == "s3" {
+		// Presigned URLs carry a signature in the query; don't show it.
+		if u, err := url.Parse(d.Target); err == nil {
+			return "s3 " + u.Host + u.Path
+		}
+	}
+	return d.Kind + " " + d.Target
+}
+
+func (d Delivery) validate() error {
+	switch d.Kind {
+	case "email":
+		if !strings.Contains(d.Target, "@") || strings.ContainsAny(d.Target, "\r\n") {
+			return fmt.Errorf("%q is not an email address", d.Target)
+		}
+		return nil
+	case "webhook", "s3":
+		u, err := url.Parse(d.Target)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("%s delivery needs an http or https URL", d.Kind)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown delivery %q", d.Kind)
+}
+
+// deliver sends a rendered report. name is used as the email subject or the
+// X-Report-Name header.
+func deliver(d Delivery, name, contentType string, body []byte) error {
+	switch d.Kind {
+	case "email":
+		return deliverEmail(d.Target, name, contentType, body)
+	case "webhook":
+		return deliverHTTP(http.MethodPost, d.Target, name, contentType, body)
+	case "s3":
+		return deliverHTTP(http.MethodPut, d.Target, name, contentType, body)
+	}
+	return fmt.Errorf("unknown delivery %q", d.Kind)
+}
+
+func deliverHTTP(method, target, name, contentType string, body []byte) error {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Report-Name", name)
+	resp, err := deliveryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if detail := strings.TrimSpace(string(msg)); detail != "" {
+			return fmt.Errorf("%s returned %s: %s", method, resp.Status, detail)
+		}
+		return fmt.Errorf("%s returned %s", method, resp.Status)
+	}
+	return nil
+}
+
+func deliverEmail(to, subject, contentType string, body []byte) error {
+	smtpConf := config.SMTP
+	if smtpConf.Addr == "" || smtpConf.From == "" {
+		return fmt.Errorf("email delivery is not configured (set SMTP_ADDR and SMTP_FROM)")
+	}
+	var auth smtp.Auth
+	if smtpConf.Username != "" {
+		host, _, _ := strings.Cut(smtpConf.Addr, ":")
+		auth = smtp.PlainAuth("", smtpConf.Username, smtpConf.Password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: %s\r\n\r\n",
+		smtpConf.From, to, strings.NewReplacer("\r", " ", "\n", " ").Replace(subject), contentType)
+	msg.Write(body)
+	return smtp.SendMail(smtpConf.Addr, auth, smtpConf.From, []string{to}, msg.Bytes())
+}
@@ -0,0 +1,173 @@
+// detection.go
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Detection is one thing the server guessed about an upload rather than
+// being told: the delimiter, the encoding, a column's type or its number
+// format. Confidence runs from 0 to 1 and Evidence says what the guess was
+// based on, so a wrong one can be caught before anyone trusts the results.
+type Detection struct {
+	Subject    string  `json:"subject"`
+	Column     string  `json:"column,omitempty"`
+	Value      string  `json:"value"`
+	Confidence float64 `json:"confidence"`
+	Evidence   string  `json:"evidence"`
+}
+
+// Level buckets Confidence for display.
+func (d Detection) Level() string {
+	switch {
+	case d.Confidence >= 0.95:
+		return "high"
+	case d.Confidence >= 0.75:
+		return "medium"
+	}
+	return "low"
+}
+
+func (d Detection) Percent() string {
+	return fmt.Sprintf("%.0f%%", d.Confidence*100)
+}
+
+// DetectionReport is everything detected about one file, in the order it
+// was read: the file's settings, then its columns.
+type DetectionReport []Detection
+
+// Doubtful reports whether any guess is low-confidence, in which case the
+// page opens the report.
+func (r DetectionReport) Doubtful() bool {
+	return slices.ContainsFunc(r, func(d Detection) bool { return d.Level() == "low" })
+}
+
+// dateSample is how many non-empty cells of a column are tried as dates
+// for the report; parsing dates is too slow to try every cell again.
+const dateSample = 500
+
+// maxTypeExamples is how many cells that don't fit a column's type are
+// quoted in its evidence.
+const maxTypeExamples = 2
+
+// columnDetections explains the type each column was given, and the number
+// format of columns that read differently with a decimal comma. Columns
+// whose type a mapping template set (overrides) weren't detected.
+func columnDetections(data Spreadsheet, overrides map[int]string) DetectionReport {
+	var out DetectionReport
+	for col, header := range data.Headers {
+		if _, ok := overrides[col]; ok {
+			continue
+		}
+		out = append(out, typeDetection(data, col, header))
+	}
+	for _, p := range parsePreviews(data) {
+		out = append(out, numberFormatDetection(p))
+	}
+	return out
+}
+
+func typeDetection(data Spreadsheet, col int, header string) Detection {
+	d := Detection{Subject: "Column type", Column: header}
+	s := columnSummary(data, col)
+	values := s.Cells - s.Empty
+	if values == 0 {
+		d.Value, d.Confidence, d.Evidence = "empty", 1, "every cell is empty"
+		return d
+	}
+	numbers := s.Count + s.NonFinite
+	numberShare := float64(numbers) / float64(values)
+	if slices.Contains(data.NumericCols, col) {
+		d.Value, d.Confidence = "number", numberShare
+		d.Evidence = fmt.Sprintf("%d of %d values are numbers", numbers, values)
+		if numbers < values {
+			d.Evidence += "; the rest are skipped in calculations, e.g. " + strings.Join(notNumbers(data, col), ", ")
+		}
+		return d
+	}
+	dates, tried := 0, 0
+	for _, row := range data.Rows {
+		v := cellValue(row, col)
+		if v == "" {
+			continue
+		}
+		if _, ok := parseDate(v); ok {
+			dates++
+		}
+		if tried++; tried == dateSample {
+			break
+		}
+	}
+	dateShare := float64(dates) / float64(tried)
+	if dateShare >= 0.8 {
+		d.Value, d.Confidence = "date", dateShare
+		d.Evidence = fmt.Sprintf("%d of the first %d values are dates", dates, tried)
+		return d
+	}
+	// Text is certain when nothing looks like a number or a date, and
+	// doubtful as either nears the 80% that would have decided otherwise.
+	d.Value = "text"
+	d.Confidence = 1 - max([]float64{numberShare, dateShare})*0.5/0.8
+	switch {
+	case numbers > 0 && numberShare >= dateShare:
+		d.Evidence = fmt.Sprintf("only %d of %d values are numbers; 80%% are needed to calculate with the column", numbers, values)
+	case dates > 0:
+		d.Evidence = fmt.Sprintf("only %d of the first %d values are dates", dates, tried)
+	default:
+		d.Evidence = "no values are numbers or dates"
+	}
+	return d
+}
+
+// notNumbers returns a few of col's non-empty cells that aren't numbers.
+func notNumbers(data Spreadsheet, col int) []string {
+	var out []string
+	for _, row := range data.Rows {
+		v := cellValue(row, col)
+		if v == "" || slices.Contains(out, strconv.Quote(v)) {
+			continue
+		}
+		if _, ok := cellNumber(v); !ok && !isNonFinite(v) {
+			if out = append(out, strconv.Quote(v)); len(out) == maxTypeExamples {
+				break
+			}
+		}
+	}
+	return out
+}
+
+// numberFormatDetection weighs the two ways a column's numbers can be read:
+// the style that reads more of its cells wins, by as much as it reads more.
+func numberFormatDetection(p ParsePreview) Detection {
+	d := Detection{Subject: "Number format", Column: p.Column}
+	style, more, fewer := styleGrouping, p.Grouping, p.DecimalComma
+	if p.DecimalComma > p.Grouping {
+		style, more, fewer = styleDecimalComma, p.DecimalComma, p.Grouping
+	}
+	d.Value = styleLabel(style)
+	if more+fewer > 0 {
+		d.Confidence = float64(more) / float64(more+fewer)
+	}
+	d.Evidence = fmt.Sprintf("%d of %d values read as numbers with comma thousands and %d with a decimal comma",
+		p.Grouping, p.Total, p.DecimalComma)
+	if len(p.Samples) > 0 {
+		sample := p.Samples[0]
+		d.Evidence += fmt.Sprintf("; %q is %s one way and %s the other", sample.Raw, orNotANumber(sample.Grouping), orNotANumber(sample.DecimalComma))
+	}
+	// Cells as uploaded already read with a decimal point.
+	if current := cmp.Or(p.Style, styleGrouping); current != style {
+		d.Evidence += "; the column is currently read " + p.StyleLabel
+	}
+	return d
+}
+
+func orNotANumber(s string) string {
+	if s == "" {
+		return "not a number"
+	}
+	return s
+}
@@ -0,0 +1,146 @@
+// diagnostics.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// SkippedCell is a value a calculation ignored. Rows are numbered from 1 for
+// the first row under the header, as on the display page.
+type SkippedCell struct {
+	Row    int    `json:"row"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// ColumnDiagnostics accounts for every cell a calculation looked at, so a
+// result can be trusted or investigated.
+type ColumnDiagnostics struct {
+	Considered int           `json:"considered"`
+	Used       int           `json:"used"`
+	Empty      int           `json:"empty"`
+	Skipped    int           `json:"skipped"`    // present but not a number
+	NonFinite  int           `json:"non_finite"` // NaN, Inf or too large for float64
+	Examples   []SkippedCell `json:"examples,omitempty"`
+}
+
+const maxSkippedExamples = 5
+
+// parseFinite parses s as a float64, rejecting NaN, infinities and values
+// that overflow, none of which can take part in a meaningful statistic.
+func parseFinite(s string) (float64, bool) {
+	if !mayBeNumber(s) {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
+
+// mayBeNumber rules out, by its first byte, text that ParseFloat would
+// reject, sparing the error it allocates; text columns would otherwise
+// allocate once per cell.
+func mayBeNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	switch c := s[0]; {
+	case c >= '0' && c <= '9', c == '+', c == '-', c == '.':
+		return true
+	case c == 'i', c == 'I', c == 'n', c == 'N': // inf, nan
+		return true
+	}
+	return false
+}
+
+// isNonFinite reports whether s is a well-formed number that float64 can't
+// hold as a finite value: "NaN", "Inf", "-Infinity" or something like 1e400.
+func isNonFinite(s string) bool {
+	if !mayBeNumber(s) {
+		return false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return math.IsInf(f, 0)
+	}
+	return err == nil && (math.IsNaN(f) || math.IsInf(f, 0))
+}
+
+func parsesFloat(s string) bool {
+	_, ok := parseFinite(s)
+	return ok
+}
+
+func parsesDecimal(s string) bool {
+	_, ok := parseDecimal(s)
+	return ok
+}
+
+// diagnoseColumn classifies the cells of col the way a calculation using
+// parses would see them.
+func diagnoseColumn(data Spreadsheet, col int, parses func(string) bool) ColumnDiagnostics {
+	d := ColumnDiagnostics{Considered: len(data.Rows)}
+	for i, row := range data.Rows {
+		val := cellValue(row, col)
+		switch {
+		case val == "":
+			d.Empty++
+		case parses(val):
+			d.Used++
+		case isNonFinite(val):
+			d.NonFinite++
+			if len(d.Examples) < maxSkippedExamples {
+				d.Examples = append(d.Examples, SkippedCell{Row: i + 1, Value: val, Reason: "not finite"})
+			}
+		default:
+			d.Skipped++
+			if len(d.Examples) < maxSkippedExamples {
+				d.Examples = append(d.Examples, SkippedCell{Row: i + 1, Value: val, Reason: "not a number"})
+			}
+		}
+	}
+	return d
+}
+
+// Excluded counts the non-empty cells left out of the calculation.
+func (d ColumnDiagnostics) Excluded() int {
+	return d.Skipped + d.NonFinite
+}
+
+// strictError explains why a strict calculation on column can't go ahead,
+// or returns nil when every non-empty cell parsed.
+func (d ColumnDiagnostics) strictError(column string) error {
+	bad := d.Excluded()
+	if bad == 0 {
+		return nil
+	}
+	cells := make([]string, len(d.Examples))
+	for i, c := range d.Examples {
+		cells[i] = fmt.Sprintf("row %d: %q %s", c.Row, c.Value, c.Reason)
+	}
+	more := ""
+	if bad > len(d.Examples) {
+		more = fmt.Sprintf(" and %d more", bad-len(d.Examples))
+	}
+	return fmt.Errorf("strict mode: column %q has %d value(s) that can't be used (%s%s)", column, bad, strings.Join(cells, "; "), more)
+}
+
+func (d ColumnDiagnostics) String() string {
+	parts := []string{fmt.Sprintf("%d of %d cells used", d.Used, d.Considered)}
+	if d.Empty > 0 {
+		parts = append(parts, fmt.Sprintf("%d empty", d.Empty))
+	}
+	if d.Skipped > 0 {
+		parts = append(parts, fmt.Sprintf("%d skipped as non-numeric", d.Skipped))
+	}
+	if d.NonFinite > 0 {
+		parts = append(parts, fmt.Sprintf("⚠️ %d excluded as NaN, infinite or out of range", d.NonFinite))
+	}
+	return strings.Join(parts, " · ")
+}
@@ -0,0 +1,161 @@
+// duplicates.go
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type KeyCollision struct {
+	Key      []string
+	Rows     []int // indexes into Spreadsheet.Rows
+	DiffCols []int // non-key columns whose values differ between the rows
+}
+
+// findKeyCollisions groups rows by the values of keyCols and returns every
+// group where more than one row shares a key. Groups whose rows are identical
+// in all other fields are still returned, with an empty DiffCols.
+func findKeyCollisions(data Spreadsheet, keyCols []int) []KeyCollision {
+	groups := make(map[string]int)
+	var collisions []KeyCollision
+	for i, row := range data.Rows {
+		key := make([]string, len(keyCols))
+		for k, col := range keyCols {
+			key[k] = cellValue(row, col)
+		}
+		joined := strings.Join(key, "\x1f")
+		if idx, ok := groups[joined]; ok {
+			collisions[idx].Rows = append(collisions[idx].Rows, i)
+			continue
+		}
+		groups[joined] = len(collisions)
+		collisions = append(collisions, KeyCollision{Key: key, Rows: []int{i}})
+	}
+
+	isKey := make(map[int]bool, len(keyCols))
+	for _, col := range keyCols {
+		isKey[col] = true
+	}
+
+	var result []KeyCollision
+	for _, c := range collisions {
+		if len(c.Rows) < 2 {
+			continue
+		}
+		first := data.Rows[c.Rows[0]]
+		for col := range data.Headers {
+			if isKey[col] {
+				continue
+			}
+			for _, r := range c.Rows[1:] {
+				if cellValue(data.Rows[r], col) != cellValue(first, col) {
+					c.DiffCols = append(c.DiffCols, col)
+					break
+				}
+			}
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+func duplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	data, ok := sessionDataset(r)
+	keys := r.Form["keys"]
+	if len(keys) == 0 || !ok {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var keyCols []int
+	for _, name := range keys {
+		col := columnIndex(data.Headers, name)
+		if col == -1 {
+			http.Error(w, fmt.Sprintf("Unknown column: %s", name), http.StatusBadRequest)
+			return
+		}
+		keyCols = append(keyCols, col)
+	}
+
+	collisions := findKeyCollisions(data, keyCols)
+	conflicting := 0
+	for _, c := range collisions {
+		if len(c.DiffCols) > 0 {
+			conflicting++
+		}
+	}
+	includeExact := r.FormValue("exact") == "1"
+
+	if r.FormValue("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="key_collisions.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write(append([]string{"Group", "Row", "Differing Columns"}, data.Headers...))
+		for g, c := range collisions {
+			if len(c.DiffCols) == 0 && !includeExact {
+				continue
+			}
+			diff := make([]string, len(c.DiffCols))
+			for i, col := range c.DiffCols {
+				diff[i] = data.Headers[col]
+			}
+			for _, rowIdx := range c.Rows {
+				row := make([]string, len(data.Headers))
+				copy(row, data.Rows[rowIdx])
+				cw.Write(append([]string{strconv.Itoa(g + 1), strconv.Itoa(rowIdx + 2), strings.Join(diff, "; ")}, row...))
+			}
+		}
+		cw.Flush()
+		return
+	}
+
+	section := ReportSection{
+		Title:   "Key Collisions",
+		Headers: []string{"Key", "Rows", "Occurrences", "Differing Columns"},
+		Notes: []string{
+			fmt.Sprintf("Business key: %s", strings.Join(keys, " + ")),
+			fmt.Sprintf("%d key(s) appear more than once; %d of them differ in other fields.", len(collisions), conflicting),
+		},
+	}
+	for _, c := range collisions {
+		if len(c.DiffCols) == 0 && !includeExact {
+			continue
+		}
+		rowNums := make([]string, len(c.Rows))
+		for i, rowIdx := range c.Rows {
+			// +2: one for the header row, one for 1-based numbering
+			rowNums[i] = strconv.Itoa(rowIdx + 2)
+		}
+		diff := make([]string, len(c.DiffCols))
+		for i, col := range c.DiffCols {
+			diff[i] = data.Headers[col]
+		}
+		if len(diff) == 0 {
+			diff = []string{"(exact duplicate)"}
+		}
+		section.Rows = append(section.Rows, []string{
+			strings.Join(c.Key, " | "),
+			strings.Join(rowNums, ", "),
+			strconv.Itoa(len(c.Rows)),
+			strings.Join(diff, ", "),
+		})
+	}
+
+	query := r.Form
+	query.Set("format", "csv")
+	section.Links = []ReportLink{{Label: "📊 Export Conflicting Rows (CSV)", URL: "/duplicates?" + query.Encode()}}
+
+	page := ReportPage{
+		Title:    "Duplicate Key Report",
+		Subtitle: data.FileName,
+		Sections: []ReportSection{section},
+	}
+	renderReport(w, page)
+}
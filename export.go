@@ -0,0 +1,533 @@
+// export.go
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	dataSheet    = "Data"
+	summarySheet = "Summary"
+)
+
+// Storage types for the typed export formats (Arrow, SQLite).
+const (
+	storeText = iota
+	storeInt
+	storeFloat
+	storeDate     // dates without a time of day
+	storeDateTime // dates, some with a time of day
+)
+
+// storageTypes types each column by what all of its non-blank cells parse
+// as, so a typed export never loses a value: whole numbers, other numbers,
+// dates, or text for everything else, including columns that are all blank.
+func storageTypes(data Spreadsheet) []int {
+	types := make([]int, len(data.Headers))
+	for c := range data.Headers {
+		ints, floats, dates, midnight, seen := true, true, true, true, false
+		for _, row := range data.Rows {
+			v := strings.TrimSpace(cellValue(row, c))
+			if v == "" {
+				continue
+			}
+			seen = true
+			if ints {
+				_, err := strconv.ParseInt(v, 10, 64)
+				ints = err == nil
+			}
+			if floats {
+				_, floats = parseFinite(v)
+			}
+			if dates {
+				var t time.Time
+				t, dates = parseDate(v)
+				midnight = midnight && t.Equal(t.Truncate(24*time.Hour))
+			}
+		}
+		switch {
+		case !seen:
+		case ints:
+			types[c] = storeInt
+		case floats:
+			types[c] = storeFloat
+		case dates && midnight:
+			types[c] = storeDate
+		case dates:
+			types[c] = storeDateTime
+		}
+	}
+	return types
+}
+
+type XLSXOptions struct {
+	HighlightOutliers bool
+	OutlierSigma      float64
+}
+
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := sessionDataset(r)
+	if !ok {
+		http.Error(w, "No dataset loaded", http.StatusBadRequest)
+		return
+	}
+	// The session's latest calculation, if it was on this dataset
+	lastResult := uploads.Result(r)
+	if lastResult.DatasetID != data.ID {
+		lastResult = ResultPage{}
+	}
+	base := exportBaseName(data.FileName)
+	format := r.URL.Query().Get("format")
+
+	// scope=results exports the latest calculation instead of the dataset
+	headers, rows := data.Headers, data.Rows
+	results := r.URL.Query().Get("scope") == "results"
+	if results {
+		if len(lastResult.Results) == 0 {
+			http.Error(w, "No results to export", http.StatusBadRequest)
+			return
+		}
+		if format == "xlsx" || format == "bundle" || format == "sqlite" {
+			http.Error(w, "Results are included in the full dataset export", http.StatusBadRequest)
+			return
+		}
+		headers, rows = resultsTable(lastResult)
+		if len(lastResult.Groups) > 0 {
+			headers, rows = groupsTable(lastResult)
+		}
+		base += "_" + lastResult.OpName + "_results"
+	}
+	attach := func(ext string) {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, base, ext))
+	}
+	if results {
+		accessLog.Record(r, data.ID, "export", exportLabel(format)+" of results")
+	} else {
+		accessLog.Record(r, data.ID, "export", exportLabel(format))
+	}
+
+	switch format {
+	case "", "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		attach("csv")
+		if err := writeCSV(w, headers, rows); err != nil {
+			log.Printf("Export error: %v", err)
+		}
+	case "tsv":
+		w.Header().Set("Content-Type", "text/tab-separated-values; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		writeTSV(w, headers, rows)
+	case "markdown", "md":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		if r.URL.Query().Get("download") == "1" {
+			attach("md")
+		}
+		writeMarkdownTable(w, headers, rows)
+	case "html":
+		if !results && datasetTier(data) != TierInteractive {
+			http.Error(w, "An analysis-only dataset is too large for an HTML table; export it as CSV instead", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.URL.Query().Get("download") == "1" {
+			attach("html")
+		}
+		writeHTMLTable(w, headers, rows)
+	case "dictionary":
+		dictHeaders, dictRows := dataDictionary(data)
+		if results {
+			dictHeaders, dictRows = resultsDictionary(lastResult)
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_dictionary.csv"`, base))
+		if err := writeCSV(w, dictHeaders, dictRows); err != nil {
+			log.Printf("Export error: %v", err)
+		}
+	case "arrow", "feather":
+		w.Header().Set("Content-Type", mimeArrow)
+		attach(format)
+		if err := writeArrowFile(w, Spreadsheet{Headers: headers, Rows: rows}); err != nil {
+			log.Printf("Export error: %v", err)
+		}
+	case "sqlite":
+		// results=1 adds the latest calculation as a second table
+		var page *ResultPage
+		if r.URL.Query().Get("results") == "1" && len(lastResult.Results) > 0 {
+			page = &lastResult
+		}
+		tables, err := sqliteTables(r, data, page)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", mimeSQLite)
+		attach("sqlite")
+		if err := writeSQLite(w, tables); err != nil {
+			log.Printf("Export error: %v", err)
+		}
+	case "bundle":
+		w.Header().Set("Content-Type", "application/zip")
+		attach("zip")
+		if err := writeBundle(w, data, lastResult); err != nil {
+			log.Printf("Export error: %v", err)
+		}
+	case "xlsx":
+		opts := XLSXOptions{HighlightOutliers: r.URL.Query().Get("outliers") == "1", OutlierSigma: 3}
+		if sigma, err := strconv.ParseFloat(r.URL.Query().Get("sigma"), 64); err == nil && sigma > 0 {
+			opts.OutlierSigma = sigma
+		}
+		f, err := buildStyledXLSX(data, lastResult, opts)
+		if err != nil {
+			log.Printf("Export error: %v", err)
+			http.Error(w, "Failed to build workbook", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.xlsx"`, base))
+		if _, err := f.WriteTo(w); err != nil {
+			log.Printf("Export error: %v", err)
+		}
+	default:
+		http.Error(w, "Unsupported export format", http.StatusBadRequest)
+	}
+}
+
+func exportLabel(format string) string {
+	if format == "" {
+		return "csv"
+	}
+	return format
+}
+
+func exportBaseName(fileName string) string {
+	base := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	if base == "" {
+		return "dataset"
+	}
+	return strings.NewReplacer(`"`, "", "/", "_", `\`, "_").Replace(base)
+}
+
+func resultsTable(page ResultPage) ([]string, [][]string) {
+	headers := []string{"Column", page.Operation + " Result"}
+	rows := make([][]string, len(page.Results))
+	for i, res := range page.Results {
+		value := res.Exact
+		if value == "" {
+			value = fmt.Sprintf("%.2f", res.Value)
+		}
+		rows[i] = []string{res.Col, value}
+	}
+	return headers, rows
+}
+
+func writeCSV(w io.Writer, headers []string, rows [][]string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(headers); err != nil {
+		return err
+	}
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+var tsvEscaper = strings.NewReplacer("\t", " ", "\r\n", " ", "\n", " ", "\r", " ")
+
+// writeTSV writes one line per row with tabs between cells. Tabs and line
+// breaks inside cells are flattened to spaces so a paste into Excel or
+// Sheets lands every value in its original column.
+func writeTSV(w io.Writer, headers []string, rows [][]string) {
+	line := func(cells []string) {
+		for i := range headers {
+			if i > 0 {
+				io.WriteString(w, "\t")
+			}
+			io.WriteString(w, tsvEscaper.Replace(cellValue(cells, i)))
+		}
+		io.WriteString(w, "\n")
+	}
+	line(headers)
+	for _, row := range rows {
+		line(row)
+	}
+}
+
+var markdownEscaper = strings.NewReplacer("|", `\|`, "\r\n", "<br>", "\n", "<br>")
+
+// writeMarkdownTable writes a GitHub-flavoured markdown table.
+func writeMarkdownTable(w io.Writer, headers []string, rows [][]string) {
+	line := func(cells []string) {
+		io.WriteString(w, "|")
+		for i := range headers {
+			io.WriteString(w, " "+markdownEscaper.Replace(cellValue(cells, i))+" |")
+		}
+		io.WriteString(w, "\n")
+	}
+	line(headers)
+	io.WriteString(w, "|")
+	for range headers {
+		io.WriteString(w, " --- |")
+	}
+	io.WriteString(w, "\n")
+	for _, row := range rows {
+		line(row)
+	}
+}
+
+// writeHTMLTable writes a bare <table> fragment suitable for pasting into
+// wikis and emails.
+func writeHTMLTable(w io.Writer, headers []string, rows [][]string) {
+	io.WriteString(w, "<table>\n<thead>\n<tr>")
+	for _, h := range headers {
+		io.WriteString(w, "<th>"+html.EscapeString(h)+"</th>")
+	}
+	io.WriteString(w, "</tr>\n</thead>\n<tbody>\n")
+	for _, row := range rows {
+		io.WriteString(w, "<tr>")
+		for i := range headers {
+			io.WriteString(w, "<td>"+html.EscapeString(cellValue(row, i))+"</td>")
+		}
+		io.WriteString(w, "</tr>\n")
+	}
+	io.WriteString(w, "</tbody>\n</table>\n")
+}
+
+// buildStyledXLSX produces a presentation-ready workbook: typed cells with
+// number formats, a frozen and filterable header row, fitted column widths
+// and, when results are given, a summary sheet.
+func buildStyledXLSX(data Spreadsheet, results ResultPage, opts XLSXOptions) (*excelize.File, error) {
+	f := excelize.NewFile()
+	if err := f.SetSheetName("Sheet1", dataSheet); err != nil {
+		return nil, err
+	}
+
+	numeric := make(map[int]bool)
+	integer := make(map[int]bool)
+	for _, col := range data.NumericCols {
+		numeric[col] = true
+		integer[col] = isColumnInteger(data, col)
+	}
+	dates := make(map[int]bool)
+	for _, col := range detectDateColumns(data) {
+		dates[col] = !numeric[col]
+	}
+
+	header := make([]interface{}, len(data.Headers))
+	widths := make([]int, len(data.Headers))
+	for i, h := range data.Headers {
+		header[i] = h
+		widths[i] = len(h)
+	}
+	if err := f.SetSheetRow(dataSheet, "A1", &header); err != nil {
+		return nil, err
+	}
+
+	for r, row := range data.Rows {
+		values := make([]interface{}, len(data.Headers))
+		for c := range data.Headers {
+			val := cellValue(row, c)
+			if len(val) > widths[c] {
+				widths[c] = len(val)
+			}
+			values[c] = val
+			if val == "" {
+				values[c] = nil
+				continue
+			}
+			if numeric[c] {
+				if num, ok := parseFinite(val); ok {
+					values[c] = num
+				}
+			} else if dates[c] {
+				if t, ok := parseDate(val); ok {
+					values[c] = t
+				}
+			}
+		}
+		cell, _ := excelize.CoordinatesToCellName(1, r+2)
+		if err := f.SetSheetRow(dataSheet, cell, &values); err != nil {
+			return nil, err
+		}
+	}
+
+	headerStyle, err := f.NewStyle(&excelize.Style{
+		Font:      &excelize.Font{Bold: true, Color: "FFFFFF"},
+		Fill:      excelize.Fill{Type: "pattern", Color: []string{"667EEA"}, Pattern: 1},
+		Alignment: &excelize.Alignment{Vertical: "center"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	intStyle, err := f.NewStyle(&excelize.Style{NumFmt: 3})
+	if err != nil {
+		return nil, err
+	}
+	decimalStyle, err := f.NewStyle(&excelize.Style{NumFmt: 4})
+	if err != nil {
+		return nil, err
+	}
+	dateFormat := "yyyy-mm-dd"
+	dateStyle, err := f.NewStyle(&excelize.Style{CustomNumFmt: &dateFormat})
+	if err != nil {
+		return nil, err
+	}
+
+	lastCol, _ := excelize.ColumnNumberToName(len(data.Headers))
+	lastRow := len(data.Rows) + 1
+	if err := f.SetCellStyle(dataSheet, "A1", lastCol+"1", headerStyle); err != nil {
+		return nil, err
+	}
+	for c := range data.Headers {
+		name, _ := excelize.ColumnNumberToName(c + 1)
+		width := float64(widths[c] + 2)
+		if width > 50 {
+			width = 50
+		}
+		if width < 8 {
+			width = 8
+		}
+		if err := f.SetColWidth(dataSheet, name, name, width); err != nil {
+			return nil, err
+		}
+		if len(data.Rows) == 0 {
+			continue
+		}
+		style := 0
+		switch {
+		case numeric[c] && integer[c]:
+			style = intStyle
+		case numeric[c]:
+			style = decimalStyle
+		case dates[c]:
+			style = dateStyle
+		}
+		if style != 0 {
+			if err := f.SetCellStyle(dataSheet, name+"2", name+strconv.Itoa(lastRow), style); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := f.SetPanes(dataSheet, &excelize.Panes{
+		Freeze:      true,
+		YSplit:      1,
+		TopLeftCell: "A2",
+		ActivePane:  "bottomLeft",
+	}); err != nil {
+		return nil, err
+	}
+	if err := f.AutoFilter(dataSheet, "A1:"+lastCol+strconv.Itoa(lastRow), nil); err != nil {
+		return nil, err
+	}
+
+	if opts.HighlightOutliers && len(data.Rows) > 0 {
+		if err := highlightOutliers(f, data, opts.OutlierSigma); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(results.Results) > 0 {
+		if err := writeSummarySheet(f, data, results, headerStyle, decimalStyle); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func isColumnInteger(data Spreadsheet, col int) bool {
+	for _, row := range data.Rows {
+		val := cellValue(row, col)
+		if val == "" {
+			continue
+		}
+		if num, err := strconv.ParseFloat(val, 64); err == nil && num != float64(int64(num)) {
+			return false
+		}
+	}
+	return true
+}
+
+// highlightOutliers marks numeric cells further than sigma standard
+// deviations from their column mean.
+func highlightOutliers(f *excelize.File, data Spreadsheet, sigma float64) error {
+	format, err := f.NewConditionalStyle(&excelize.Style{
+		Font: &excelize.Font{Color: "9C0006"},
+		Fill: excelize.Fill{Type: "pattern", Color: []string{"FFC7CE"}, Pattern: 1},
+	})
+	if err != nil {
+		return err
+	}
+	for _, col := range data.NumericCols {
+		mean, err := performCalculation(data, col, "average", nil)
+		if err != nil {
+			continue
+		}
+		sd, err := performCalculation(data, col, "std", nil)
+		if err != nil || sd == 0 {
+			continue
+		}
+		name, _ := excelize.ColumnNumberToName(col + 1)
+		rangeRef := fmt.Sprintf("%s2:%s%d", name, name, len(data.Rows)+1)
+		if err := f.SetConditionalFormat(dataSheet, rangeRef, []excelize.ConditionalFormatOptions{{
+			Type:     "cell",
+			Criteria: "not between",
+			Format:   &format,
+			MinValue: strconv.FormatFloat(mean-sigma*sd, 'f', -1, 64),
+			MaxValue: strconv.FormatFloat(mean+sigma*sd, 'f', -1, 64),
+		}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSummarySheet(f *excelize.File, data Spreadsheet, results ResultPage, headerStyle, valueStyle int) error {
+	if _, err := f.NewSheet(summarySheet); err != nil {
+		return err
+	}
+	info := [][]interface{}{
+		{"File", data.FileName},
+		{"Rows", len(data.Rows)},
+		{"Columns", len(data.Headers)},
+		{"Operation", results.Operation},
+		{"Calculated", results.Timestamp},
+	}
+	for i, row := range info {
+		cell, _ := excelize.CoordinatesToCellName(1, i+1)
+		if err := f.SetSheetRow(summarySheet, cell, &row); err != nil {
+			return err
+		}
+	}
+
+	start := len(info) + 2
+	cell, _ := excelize.CoordinatesToCellName(1, start)
+	if err := f.SetSheetRow(summarySheet, cell, &[]interface{}{"Column", results.Operation + " Result"}); err != nil {
+		return err
+	}
+	if err := f.SetCellStyle(summarySheet, cell, "B"+strconv.Itoa(start), headerStyle); err != nil {
+		return err
+	}
+	for i, res := range results.Results {
+		cell, _ := excelize.CoordinatesToCellName(1, start+i+1)
+		if err := f.SetSheetRow(summarySheet, cell, &[]interface{}{res.Col, res.Value}); err != nil {
+			return err
+		}
+	}
+	end := start + len(results.Results)
+	if err := f.SetCellStyle(summarySheet, "B"+strconv.Itoa(start+1), "B"+strconv.Itoa(end), valueStyle); err != nil {
+		return err
+	}
+	return f.SetColWidth(summarySheet, "A", "B", 24)
+}
@@ -0,0 +1,540 @@
+// expr.go
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Expr is a compiled row expression used by filters and derived columns.
+// Column names are bare words (Amount), or quoted with backticks or square
+// brackets when they contain spaces (`Unit Price`, [Unit Price]).
+//
+// Values are float64, string, bool or nil. Empty cells are nil; cells that
+// parse as numbers are float64. Arithmetic on nil yields nil and comparisons
+// against nil are false, so "Amount > 0" skips blanks.
+type Expr struct {
+	Source  string
+	Columns []string // columns referenced, in order of first use
+	eval    func(row []string) interface{}
+}
+
+func (e *Expr) Eval(row []string) interface{} {
+	return e.eval(row)
+}
+
+// Match reports whether the expression is truthy for row.
+func (e *Expr) Match(row []string) bool {
+	return truthy(e.eval(row))
+}
+
+type exprToken struct {
+	kind   string // num, str, ident, op, eof
+	text   string
+	pos    int
+	quoted bool // ident written as `name` or [name]
+}
+
+func tokenizeExpr(src string) ([]exprToken, error) {
+	var toks []exprToken
+	i := 0
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			start := i
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.' || src[i] == 'e' || src[i] == 'E' ||
+				(src[i] == '-' || src[i] == '+') && (src[i-1] == 'e' || src[i-1] == 'E')) {
+				i++
+			}
+			toks = append(toks, exprToken{kind: "num", text: src[start:i], pos: start})
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			var sb strings.Builder
+			for i < len(src) && rune(src[i]) != c {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				sb.WriteByte(src[i])
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string at position %d", start+1)
+			}
+			i++
+			toks = append(toks, exprToken{kind: "str", text: sb.String(), pos: start})
+		case c == '`' || c == '[':
+			closing := byte('`')
+			if c == '[' {
+				closing = ']'
+			}
+			start := i
+			end := strings.IndexByte(src[i+1:], closing)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated column name at position %d", start+1)
+			}
+			toks = append(toks, exprToken{kind: "ident", text: src[i+1 : i+1+end], pos: start, quoted: true})
+			i += end + 2
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] >= 0x80 || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			toks = append(toks, exprToken{kind: "ident", text: src[start:i], pos: start})
+		default:
+			two := ""
+			if i+1 < len(src) {
+				two = src[i : i+2]
+			}
+			switch two {
+			case "==", "!=", "<=", ">=", "<>", "&&", "||":
+				toks = append(toks, exprToken{kind: "op", text: two, pos: i})
+				i += 2
+				continue
+			}
+			if !strings.ContainsRune("+-*/%<>=!(),", c) {
+				return nil, fmt.Errorf("unexpected %q at position %d", c, i+1)
+			}
+			toks = append(toks, exprToken{kind: "op", text: string(c), pos: i})
+			i++
+		}
+	}
+	return append(toks, exprToken{kind: "eof", pos: len(src)}), nil
+}
+
+type exprParser struct {
+	toks    []exprToken
+	pos     int
+	headers []string
+	cols    []string
+}
+
+// compileExpr parses src and binds column references against headers.
+func compileExpr(src string, headers []string) (*Expr, error) {
+	toks, err := tokenizeExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks, headers: headers}
+	eval, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != "eof" {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos+1)
+	}
+	return &Expr{Source: src, Columns: p.cols, eval: eval}, nil
+}
+
+type evalFunc = func(row []string) interface{}
+
+func (p *exprParser) peek() exprToken { return p.toks[p.pos] }
+
+func (p *exprParser) next() exprToken {
+	tok := p.toks[p.pos]
+	if tok.kind != "eof" {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is one of the given operators or
+// keywords (keywords match case-insensitively).
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	tok := p.peek()
+	for _, op := range ops {
+		if tok.kind == "op" && tok.text == op || tok.kind == "ident" && !tok.quoted && strings.EqualFold(tok.text, op) && isExprKeyword(op) {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func isExprKeyword(s string) bool {
+	switch strings.ToLower(s) {
+	case "and", "or", "not", "contains":
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) parseOr() (evalFunc, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("or", "||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(row []string) interface{} { return truthy(l(row)) || truthy(right(row)) }
+	}
+}
+
+func (p *exprParser) parseAnd() (evalFunc, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("and", "&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(row []string) interface{} { return truthy(l(row)) && truthy(right(row)) }
+	}
+}
+
+func (p *exprParser) parseNot() (evalFunc, error) {
+	if _, ok := p.accept("not", "!"); ok {
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(row []string) interface{} { return !truthy(inner(row)) }, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *exprParser) parseCompare() (evalFunc, error) {
+	left, err := p.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "=", "!=", "<>", "<=", ">=", "<", ">", "contains")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+	return func(row []string) interface{} { return compareValues(op, left(row), right(row)) }, nil
+}
+
+func (p *exprParser) parseAdd() (evalFunc, error) {
+	left, err := p.parseMul()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseMul()
+		if err != nil {
+			return nil, err
+		}
+		left = arith(op, left, right)
+	}
+}
+
+func (p *exprParser) parseMul() (evalFunc, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("*", "/", "%")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = arith(op, left, right)
+	}
+}
+
+func (p *exprParser) parseUnary() (evalFunc, error) {
+	if _, ok := p.accept("-"); ok {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return arith("-", func([]string) interface{} { return 0.0 }, inner), nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (evalFunc, error) {
+	tok := p.next()
+	switch tok.kind {
+	case "num":
+		v, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at position %d", tok.text, tok.pos+1)
+		}
+		return func([]string) interface{} { return v }, nil
+	case "str":
+		s := tok.text
+		return func([]string) interface{} { return s }, nil
+	case "op":
+		if tok.text == "(" {
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := p.accept(")"); !ok {
+				return nil, fmt.Errorf("missing ) at position %d", p.peek().pos+1)
+			}
+			return inner, nil
+		}
+	case "ident":
+		// backtick/bracket names are never keywords or functions
+		if !tok.quoted {
+			switch strings.ToLower(tok.text) {
+			case "true":
+				return func([]string) interface{} { return true }, nil
+			case "false":
+				return func([]string) interface{} { return false }, nil
+			case "null":
+				return func([]string) interface{} { return nil }, nil
+			}
+			if _, ok := p.accept("("); ok {
+				return p.parseCall(tok)
+			}
+		}
+		col := columnIndex(p.headers, tok.text)
+		if col == -1 {
+			return nil, fmt.Errorf("unknown column %q", tok.text)
+		}
+		if !slices.Contains(p.cols, p.headers[col]) {
+			p.cols = append(p.cols, p.headers[col])
+		}
+		return func(row []string) interface{} { return cellToValue(cellValue(row, col)) }, nil
+	case "eof":
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos+1)
+}
+
+var exprFuncs = map[string]func(args []interface{}) interface{}{
+	"abs": func(a []interface{}) interface{} {
+		if f, ok := a[0].(float64); ok {
+			return math.Abs(f)
+		}
+		return nil
+	},
+	"round": func(a []interface{}) interface{} {
+		f, ok := a[0].(float64)
+		if !ok {
+			return nil
+		}
+		places := 0.0
+		if len(a) > 1 {
+			places, _ = a[1].(float64)
+		}
+		scale := math.Pow(10, places)
+		return math.Round(f*scale) / scale
+	},
+	"lower": func(a []interface{}) interface{} { return strings.ToLower(valueString(a[0])) },
+	"upper": func(a []interface{}) interface{} { return strings.ToUpper(valueString(a[0])) },
+	"len": func(a []interface{}) interface{} {
+		if a[0] == nil {
+			return 0.0
+		}
+		return float64(len([]rune(valueString(a[0]))))
+	},
+	"year": func(a []interface{}) interface{} {
+		return datePart(a[0], func(t time.Time) int { return t.Year() })
+	},
+	"month": func(a []interface{}) interface{} {
+		return datePart(a[0], func(t time.Time) int { return int(t.Month()) })
+	},
+	"isnull": func(a []interface{}) interface{} { return a[0] == nil },
+	"coalesce": func(a []interface{}) interface{} {
+		for _, v := range a {
+			if v != nil {
+				return v
+			}
+		}
+		return nil
+	},
+}
+
+// datePart applies part to a date cell, or returns nil when v isn't a date.
+func datePart(v interface{}, part func(time.Time) int) interface{} {
+	if v == nil {
+		return nil
+	}
+	t, ok := parseDate(valueString(v))
+	if !ok {
+		return nil
+	}
+	return float64(part(t))
+}
+
+func (p *exprParser) parseCall(name exprToken) (evalFunc, error) {
+	fn, ok := exprFuncs[strings.ToLower(name.text)]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q", name.text)
+	}
+	var args []evalFunc
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if _, ok := p.accept(","); ok {
+				continue
+			}
+			if _, ok := p.accept(")"); !ok {
+				return nil, fmt.Errorf("missing ) after arguments to %s", name.text)
+			}
+			break
+		}
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s needs at least one argument", name.text)
+	}
+	return func(row []string) interface{} {
+		vals := make([]interface{}, len(args))
+		for i, arg := range args {
+			vals[i] = arg(row)
+		}
+		return fn(vals)
+	}, nil
+}
+
+func arith(op string, left, right evalFunc) evalFunc {
+	return func(row []string) interface{} {
+		lv, rv := left(row), right(row)
+		l, lok := lv.(float64)
+		r, rok := rv.(float64)
+		if !lok || !rok {
+			if op == "+" {
+				// + concatenates when either side is text
+				if lv != nil && rv != nil {
+					return valueString(lv) + valueString(rv)
+				}
+			}
+			return nil
+		}
+		switch op {
+		case "+":
+			return l + r
+		case "-":
+			return l - r
+		case "*":
+			return l * r
+		case "/":
+			if r == 0 {
+				return nil
+			}
+			return l / r
+		case "%":
+			if r == 0 {
+				return nil
+			}
+			return math.Mod(l, r)
+		}
+		return nil
+	}
+}
+
+func compareValues(op string, l, r interface{}) bool {
+	if op == "contains" {
+		return l != nil && r != nil && strings.Contains(strings.ToLower(valueString(l)), strings.ToLower(valueString(r)))
+	}
+	if l == nil || r == nil {
+		switch op {
+		case "==", "=":
+			return l == nil && r == nil
+		case "!=", "<>":
+			return (l == nil) != (r == nil)
+		}
+		return false
+	}
+	var cmp int
+	lf, lok := l.(float64)
+	rf, rok := r.(float64)
+	switch {
+	case lok && rok:
+		switch {
+		case lf < rf:
+			cmp = -1
+		case lf > rf:
+			cmp = 1
+		}
+	default:
+		cmp = strings.Compare(valueString(l), valueString(r))
+	}
+	switch op {
+	case "==", "=":
+		return cmp == 0
+	case "!=", "<>":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func cellToValue(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return s
+}
+
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case float64:
+		return t != 0
+	case string:
+		return t != ""
+	}
+	return false
+}
+
+// valueString formats an expression value for storage in a cell.
+func valueString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case bool:
+		return strconv.FormatBool(t)
+	case float64:
+		if math.IsNaN(t) || math.IsInf(t, 0) {
+			return ""
+		}
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case string:
+		return t
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,196 @@
+// extract.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultExtractPreview = 10
+	maxExtractPreview     = 100
+)
+
+// compileExtractPattern compiles a user pattern for extraction. The first
+// capture group is what gets extracted, so the pattern must have one.
+func compileExtractPattern(pattern string) (*regexp.Regexp, error) {
+	if strings.TrimSpace(pattern) == "" {
+		return nil, fmt.Errorf("enter a pattern with a capture group, e.g. (INV-\\d+)")
+	}
+	if len(pattern) > maxTextPatternLen {
+		return nil, fmt.Errorf("the pattern must be at most %d characters", maxTextPatternLen)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+	if re.NumSubexp() == 0 {
+		return nil, fmt.Errorf("the pattern needs a capture group around the part to extract, e.g. (INV-\\d+)")
+	}
+	return re, nil
+}
+
+// extractValue returns the first capture group of the first match in v.
+func extractValue(re *regexp.Regexp, v string) (string, bool) {
+	m := re.FindStringSubmatch(v)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// nextColumnID returns a column ID not yet used by data.
+func nextColumnID(data Spreadsheet) string {
+	n := len(data.ColumnIDs)
+	for _, id := range data.ColumnIDs {
+		if k, err := strconv.Atoi(strings.TrimPrefix(id, "c")); err == nil && k > n {
+			n = k
+		}
+	}
+	return "c" + strconv.Itoa(n+1)
+}
+
+// extractColumn appends a column holding what re captures from col in each
+// row. Rows without a match get a blank. It returns the number of matches.
+func extractColumn(data *Spreadsheet, col int, re *regexp.Regexp, name string) (int, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, fmt.Errorf("the new column needs a name")
+	}
+	if columnIndex(data.Headers, name) != -1 {
+		return 0, fmt.Errorf("column %q already exists", name)
+	}
+	width := len(data.Headers)
+	rows := make([][]string, len(data.Rows))
+	matched := 0
+	for i, row := range data.Rows {
+		out := make([]string, width+1)
+		copy(out, row)
+		v, ok := extractValue(re, cellValue(row, col))
+		if ok {
+			matched++
+		}
+		out[width] = v
+		rows[i] = out
+	}
+	source := data.Headers[col]
+	data.ColumnIDs = append(append([]string(nil), data.ColumnIDs...), nextColumnID(*data))
+	data.Headers = append(append([]string(nil), data.Headers...), name)
+	data.Rows = rows
+	data.NumericCols = detectNumericColumns(*data)
+	data.Lineage = withLineage(data.Lineage, ColumnLineage{Column: name, Sources: []string{source}, Operation: "extract", Detail: re.String()})
+	data.Pipeline = appendStep(data.Pipeline, "extract", map[string]string{
+		"column":  source,
+		"pattern": re.String(),
+		"into":    name,
+	})
+	data.Notes = append(data.Notes, fmt.Sprintf("Extracted %q from %q (%d of %d rows matched)", name, source, matched, len(rows)))
+	return matched, nil
+}
+
+// extractHandler previews a regex extraction on GET and adds the extracted
+// column to the dataset on POST.
+func extractHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	data := activeDataset(r)
+	if id := r.FormValue("dataset"); id != "" {
+		var ok bool
+		if data, ok = teamDataset(r, id); !ok {
+			http.Error(w, "Unknown dataset", http.StatusNotFound)
+			return
+		}
+	}
+	if len(data.Headers) == 0 {
+		http.Error(w, "No dataset loaded", http.StatusBadRequest)
+		return
+	}
+	col := columnRef(data, r.FormValue("column"))
+	if col == -1 {
+		http.Error(w, "Unknown column", http.StatusBadRequest)
+		return
+	}
+	re, err := compileExtractPattern(r.FormValue("pattern"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		name = data.Headers[col] + " (extracted)"
+	}
+
+	if r.Method == http.MethodPost {
+		if err := checkVersion(r, data); err != nil {
+			http.Error(w, err.Error(), updateErrorStatus(w, err))
+			return
+		}
+		if _, err := extractColumn(&data, col, re, name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := workspace.Update(&data); err != nil {
+			http.Error(w, err.Error(), updateErrorStatus(w, err))
+			return
+		}
+		renderDisplay(w, r, data)
+		return
+	}
+
+	limit := defaultExtractPreview
+	if v := r.FormValue("preview"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxExtractPreview {
+			http.Error(w, fmt.Sprintf("preview must be between 1 and %d rows", maxExtractPreview), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	preview := ReportSection{Title: "First Matches", Headers: []string{"Row", data.Headers[col], name}}
+	var misses [][]string
+	matched, blank := 0, 0
+	for i, row := range data.Rows {
+		v := cellValue(row, col)
+		if v == "" {
+			blank++
+			continue
+		}
+		got, ok := extractValue(re, v)
+		switch {
+		case ok:
+			matched++
+			if len(preview.Rows) < limit {
+				preview.Rows = append(preview.Rows, []string{strconv.Itoa(i + 1), v, got})
+			}
+		case len(misses) < 5:
+			misses = append(misses, []string{strconv.Itoa(i + 1), v})
+		}
+	}
+	total := len(data.Rows) - blank
+	summary := ReportSection{Title: "Summary", Notes: []string{
+		fmt.Sprintf("%s matches %d of %d non-blank value(s) in %s; other rows will be blank in %s.", re.String(), matched, total, data.Headers[col], name),
+	}}
+	if columnIndex(data.Headers, name) != -1 {
+		summary.Notes = append(summary.Notes, fmt.Sprintf("⚠️ A column named %q already exists; choose another name to add it.", name))
+	}
+	summary.Form = &ReportForm{Action: "/extract", Submit: "➕ Add Column", Fields: []FormField{
+		{Name: "dataset", Type: "hidden", Value: data.ID},
+		{Name: "version", Type: "hidden", Value: strconv.Itoa(data.Version)},
+		{Name: "column", Type: "hidden", Value: r.FormValue("column")},
+		{Name: "pattern", Type: "hidden", Value: re.String()},
+		{Name: "name", Label: "New column name", Value: name},
+	}}
+	sections := []ReportSection{summary, preview}
+	if len(preview.Rows) == 0 {
+		sections[1].Notes = []string{"No values match the pattern."}
+	}
+	if len(misses) > 0 {
+		sections = append(sections, ReportSection{Title: "Values Without a Match", Headers: []string{"Row", data.Headers[col]}, Rows: misses})
+	}
+	renderReport(w, ReportPage{Title: "Extract from " + data.Headers[col], Subtitle: data.FileName, Sections: sections})
+}
@@ -0,0 +1,176 @@
+// fixedwidth.go
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Fixed-width text: every column takes the same number of characters on
+// each line, padded with spaces, as mainframe and billing system exports
+// (and "Formatted Text (Space delimited)" .prn files) lay them out.
+
+var fixedWidthExts = []string{".txt", ".prn", ".fwf", ".dat"}
+
+const fixedWidthSampleLines = 200
+
+func isFixedWidthFile(filename string) bool {
+	for _, ext := range fixedWidthExts {
+		if strings.HasSuffix(strings.ToLower(filename), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// FixedWidthOptions says how to read a fixed-width file. No Widths means
+// they're detected, and an empty Encoding is detected as for CSV.
+type FixedWidthOptions struct {
+	Widths   []int
+	Encoding string
+}
+
+// fixedWidthOptionsFromForm reads the "widths" field, character counts
+// separated by commas or spaces, and the CSV encoding field.
+func fixedWidthOptionsFromForm(r *http.Request) (FixedWidthOptions, error) {
+	var opts FixedWidthOptions
+	csvOpts, err := csvOptionsFromForm(r)
+	if err != nil {
+		return opts, err
+	}
+	opts.Encoding = csvOpts.Encoding
+	spec := strings.TrimSpace(r.FormValue("widths"))
+	if spec == "" || strings.EqualFold(spec, "auto") {
+		return opts, nil
+	}
+	for _, f := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("column widths must be whole numbers above zero, got %q", f)
+		}
+		opts.Widths = append(opts.Widths, n)
+	}
+	return opts, nil
+}
+
+func formatWidths(widths []int) string {
+	parts := make([]string, len(widths))
+	for i, w := range widths {
+		parts[i] = strconv.Itoa(w)
+	}
+	return strings.Join(parts, ",")
+}
+
+// detectWidths finds the character positions that are blank on every line
+// and starts a column after each run of them. A single blank only counts
+// when a header word starts after it, so values like "Mr Smith" stay whole.
+func detectWidths(lines [][]rune) []int {
+	var used []bool
+	for _, line := range lines {
+		for len(used) < len(line) {
+			used = append(used, false)
+		}
+		for i, r := range line {
+			if !unicode.IsSpace(r) {
+				used[i] = true
+			}
+		}
+	}
+	header := lines[0]
+	headerWord := func(i int) bool {
+		return i < len(header) && !unicode.IsSpace(header[i]) && (i == 0 || unicode.IsSpace(header[i-1]))
+	}
+	starts := []int{0} // leading padding belongs to the first column
+	for i := 1; i < len(used); i++ {
+		if !used[i] || used[i-1] || !slices.Contains(used[:i], true) {
+			continue
+		}
+		if gap := !used[i-2]; gap || headerWord(i) {
+			starts = append(starts, i)
+		}
+	}
+	widths := make([]int, len(starts))
+	for i := range starts {
+		end := len(used)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		widths[i] = end - starts[i]
+	}
+	return widths
+}
+
+// splitFixed cuts a line into columns; the last one takes the rest of the
+// line.
+func splitFixed(line []rune, widths []int) []string {
+	row := make([]string, len(widths))
+	pos := 0
+	for i, w := range widths {
+		if pos >= len(line) {
+			break
+		}
+		end := pos + w
+		if i == len(widths)-1 || end > len(line) {
+			end = len(line)
+		}
+		row[i] = strings.TrimSpace(string(line[pos:end]))
+		pos = end
+	}
+	return row
+}
+
+// processFixedWidth reads the header line and at most limit rows, and
+// returns the options it settled on.
+func processFixedWidth(file io.Reader, opts FixedWidthOptions, limit int) (Spreadsheet, FixedWidthOptions, error) {
+	var data Spreadsheet
+	decoded, encoding, found, err := decodeText(file, opts.Encoding)
+	if err != nil {
+		return data, opts, err
+	}
+	opts.Encoding = encoding
+	data.Detections = found
+	scanner := bufio.NewScanner(decoded)
+	scanner.Buffer(make([]byte, 64<<10), MaxFileSize)
+	var lines [][]rune
+	for len(lines) <= limit && scanner.Scan() {
+		line := []rune(strings.TrimRight(scanner.Text(), "\r"))
+		if strings.TrimSpace(string(line)) == "" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return data, opts, fmt.Errorf("not valid %s: %w", encoding, err)
+	}
+	if len(lines) == 0 {
+		return data, opts, fmt.Errorf("empty file")
+	}
+
+	detected := len(opts.Widths) == 0
+	if detected {
+		sample := lines
+		if len(sample) > fixedWidthSampleLines {
+			sample = sample[:fixedWidthSampleLines]
+		}
+		opts.Widths = detectWidths(sample)
+		if len(opts.Widths) < 2 {
+			return data, opts, fmt.Errorf("no column boundaries found; give the column widths")
+		}
+	}
+	data.Headers = dedupeHeaders(normalizeHeaders(splitFixed(lines[0], opts.Widths)))
+	for _, line := range lines[1:] {
+		data.Rows = append(data.Rows, splitFixed(line, opts.Widths))
+	}
+	how := "given"
+	if detected {
+		how = "detected"
+	}
+	data.Notes = append(data.Notes, fmt.Sprintf("Read as fixed-width %s columns of %s characters (%s)", encoding, formatWidths(opts.Widths), how))
+	return data, opts, nil
+}
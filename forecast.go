@@ -0,0 +1,339 @@
+// forecast.go
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	maxForecastPeriods = 60
+	maxSeriesPeriods   = 5000
+	forecastZ          = 1.96 // 95% band
+)
+
+// PeriodSeries is a numeric column totalled per calendar period, with every
+// period between the first and last present. Periods without rows total 0.
+type PeriodSeries struct {
+	Period string // day, week or month
+	Starts []time.Time
+	Values []float64
+	Empty  int // periods with no rows
+}
+
+func (s PeriodSeries) Label(t time.Time) string {
+	if s.Period == "month" {
+		return t.Format("2006-01")
+	}
+	return t.Format("2006-01-02")
+}
+
+func (s PeriodSeries) Labels() []string {
+	labels := make([]string, len(s.Starts))
+	for i, t := range s.Starts {
+		labels[i] = s.Label(t)
+	}
+	return labels
+}
+
+// periodStart truncates t to the start of its day, Monday-based week or month.
+func periodStart(t time.Time, period string) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case "week":
+		return t.AddDate(0, 0, -(int(t.Weekday())+6)%7)
+	case "month":
+		return t.AddDate(0, 0, 1-t.Day())
+	}
+	return t
+}
+
+func nextPeriod(t time.Time, period string) time.Time {
+	switch period {
+	case "week":
+		return t.AddDate(0, 0, 7)
+	case "month":
+		return t.AddDate(0, 1, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// periodTotals sums col per period of dateCol. Rows without both a date and
+// a number are skipped.
+func periodTotals(data Spreadsheet, col, dateCol int, period string) (PeriodSeries, error) {
+	series := PeriodSeries{Period: period}
+	totals := make(map[time.Time]float64)
+	for _, row := range data.Rows {
+		at, ok := parseDate(cellValue(row, dateCol))
+		if !ok {
+			continue
+		}
+		if v, ok := parseFinite(cellValue(row, col)); ok {
+			totals[periodStart(at, period)] += v
+		}
+	}
+	if len(totals) == 0 {
+		return series, fmt.Errorf("no rows have both a date in %s and a number in %s", data.Headers[dateCol], data.Headers[col])
+	}
+	starts := make([]time.Time, 0, len(totals))
+	for t := range totals {
+		starts = append(starts, t)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	for t := starts[0]; !t.After(starts[len(starts)-1]); t = nextPeriod(t, period) {
+		if len(series.Starts) == maxSeriesPeriods {
+			return series, fmt.Errorf("the dates span more than %d %ss; use a longer period", maxSeriesPeriods, period)
+		}
+		v, ok := totals[t]
+		if !ok {
+			series.Empty++
+		}
+		series.Starts = append(series.Starts, t)
+		series.Values = append(series.Values, v)
+	}
+	return series, nil
+}
+
+type ForecastPoint struct {
+	Start time.Time
+	Value float64
+	Lower float64
+	Upper float64
+}
+
+// Forecast is an exponential smoothing fit: simple (level only) or Holt's
+// linear method (level and trend).
+type Forecast struct {
+	Method string
+	Alpha  float64
+	Beta   float64
+	Sigma  float64   // standard deviation of one-step-ahead errors
+	Fitted []float64 // one-step-ahead fit; NaN where there is none
+	Points []ForecastPoint
+}
+
+// smooth runs exponential smoothing over values, returning the one-step
+// fitted values, the final level and trend, and the squared error sum.
+func smooth(values []float64, alpha, beta float64, trend bool) ([]float64, float64, float64, float64) {
+	fitted := make([]float64, len(values))
+	fitted[0] = math.NaN()
+	level, slope := values[0], 0.0
+	start := 1
+	if trend {
+		slope = values[1] - values[0]
+		fitted[1] = math.NaN()
+		level, start = values[1], 2
+	}
+	sse := 0.0
+	for t := start; t < len(values); t++ {
+		f := level + slope
+		fitted[t] = f
+		sse += (values[t] - f) * (values[t] - f)
+		prev := level
+		level = alpha*values[t] + (1-alpha)*(level+slope)
+		if trend {
+			slope = beta*(level-prev) + (1-beta)*slope
+		}
+	}
+	return fitted, level, slope, sse
+}
+
+// forecastSeries fits the smoothing parameters by grid search on one-step
+// errors and projects horizon periods with a 95% band.
+func forecastSeries(series PeriodSeries, method string, horizon int) (Forecast, error) {
+	trend := method == "holt"
+	need := 3
+	if trend {
+		need = 4
+	}
+	if len(series.Values) < need {
+		return Forecast{}, fmt.Errorf("%s needs at least %d periods of data, found %d", forecastMethods[method], need, len(series.Values))
+	}
+	best := Forecast{Method: method}
+	bestSSE := math.Inf(1)
+	var level, slope float64
+	betas := []float64{0}
+	if trend {
+		betas = nil
+		for b := 0.05; b < 1; b += 0.05 {
+			betas = append(betas, b)
+		}
+	}
+	for a := 0.05; a < 1; a += 0.05 {
+		for _, b := range betas {
+			fitted, l, s, sse := smooth(series.Values, a, b, trend)
+			if sse < bestSSE {
+				bestSSE, level, slope = sse, l, s
+				best.Alpha, best.Beta, best.Fitted = a, b, fitted
+			}
+		}
+	}
+	params, fittedCount := 1, len(series.Values)-1
+	if trend {
+		params, fittedCount = 2, len(series.Values)-2
+	}
+	dof := fittedCount - params
+	if dof < 1 {
+		dof = 1
+	}
+	best.Sigma = math.Sqrt(bestSSE / float64(dof))
+
+	at := series.Starts[len(series.Starts)-1]
+	variance := 0.0
+	for h := 1; h <= horizon; h++ {
+		at = nextPeriod(at, series.Period)
+		// h-step error variance grows with the weight later periods put on
+		// the same unknown shocks.
+		if h == 1 {
+			variance = 1
+		} else {
+			c := best.Alpha * (1 + float64(h-1)*best.Beta)
+			variance += c * c
+		}
+		value := level + float64(h)*slope
+		width := forecastZ * best.Sigma * math.Sqrt(variance)
+		best.Points = append(best.Points, ForecastPoint{Start: at, Value: value, Lower: value - width, Upper: value + width})
+	}
+	return best, nil
+}
+
+var forecastMethods = map[string]string{
+	"ses":  "Simple exponential smoothing",
+	"holt": "Holt's linear trend",
+}
+
+// forecastHandler projects a numeric column forward from its per-period
+// totals and shows the history, the forecast and its band as a chart and
+// table.
+func forecastHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	data := activeDataset(r)
+	if id := q.Get("dataset"); id != "" {
+		var ok bool
+		if data, ok = teamDataset(r, id); !ok {
+			http.Error(w, "Unknown dataset", http.StatusNotFound)
+			return
+		}
+	}
+	if len(data.Headers) == 0 {
+		http.Error(w, "No dataset loaded", http.StatusBadRequest)
+		return
+	}
+	col := columnRef(data, q.Get("column"))
+	if col == -1 {
+		http.Error(w, "Unknown column", http.StatusBadRequest)
+		return
+	}
+	dateCol := -1
+	if ref := q.Get("date"); ref != "" {
+		dateCol = columnRef(data, ref)
+	} else if dates := detectDateColumns(data); len(dates) > 0 {
+		dateCol = dates[0]
+	}
+	if dateCol == -1 {
+		http.Error(w, "Forecasting needs a date column", http.StatusBadRequest)
+		return
+	}
+	period := q.Get("period")
+	if period == "" {
+		period = "month"
+	}
+	if period != "day" && period != "week" && period != "month" {
+		http.Error(w, "period must be day, week or month", http.StatusBadRequest)
+		return
+	}
+	method := q.Get("method")
+	if method == "" {
+		method = "holt"
+	}
+	if _, ok := forecastMethods[method]; !ok {
+		http.Error(w, "method must be ses or holt", http.StatusBadRequest)
+		return
+	}
+	horizon := 6
+	if v := q.Get("periods"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxForecastPeriods {
+			http.Error(w, fmt.Sprintf("periods must be between 1 and %d", maxForecastPeriods), http.StatusBadRequest)
+			return
+		}
+		horizon = n
+	}
+
+	series, err := periodTotals(data, col, dateCol, period)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	fc, err := forecastSeries(series, method, horizon)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	headers := []string{"Period", "Actual", "Fitted", "Forecast", "Lower 95%", "Upper 95%"}
+	var rows [][]string
+	for i, t := range series.Starts {
+		fitted := ""
+		if !math.IsNaN(fc.Fitted[i]) {
+			fitted = formatStat(fc.Fitted[i])
+		}
+		rows = append(rows, []string{series.Label(t), formatStat(series.Values[i]), fitted, "", "", ""})
+	}
+	for _, p := range fc.Points {
+		rows = append(rows, []string{series.Label(p.Start), "", "", formatStat(p.Value), formatStat(p.Lower), formatStat(p.Upper)})
+	}
+	if q.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_forecast.csv"`, exportBaseName(data.FileName)))
+		writeCSV(w, headers, rows)
+		return
+	}
+
+	n := len(series.Values)
+	labels := series.Labels()
+	actual, fitted, projected := series.Values, fc.Fitted, make([]float64, n+horizon)
+	lower, upper := make([]float64, n+horizon), make([]float64, n+horizon)
+	for i := range projected {
+		projected[i], lower[i], upper[i] = math.NaN(), math.NaN(), math.NaN()
+	}
+	// Start the projection at the last actual value so the lines join.
+	projected[n-1], lower[n-1], upper[n-1] = actual[n-1], actual[n-1], actual[n-1]
+	for i, p := range fc.Points {
+		labels = append(labels, series.Label(p.Start))
+		projected[n+i], lower[n+i], upper[n+i] = p.Value, p.Lower, p.Upper
+	}
+	pad := func(vals []float64) []float64 {
+		out := append([]float64(nil), vals...)
+		for len(out) < n+horizon {
+			out = append(out, math.NaN())
+		}
+		return out
+	}
+	name := data.Headers[col]
+	chart := lineChart(fmt.Sprintf("%s per %s with a %d-%s forecast", name, period, horizon, period), labels, []ChartSeries{
+		{Name: "Actual", Color: "#2d3748", Values: pad(actual)},
+		{Name: "Fitted", Color: "#a0aec0", Values: pad(fitted), Dashed: true},
+		{Name: "Forecast", Color: "#667eea", Values: projected, Dashed: true},
+	}, &ChartBand{Lower: lower, Upper: upper})
+
+	notes := []string{
+		fmt.Sprintf("%s of %s totalled per %s of %s.", forecastMethods[method], name, period, data.Headers[dateCol]),
+		fmt.Sprintf("Fitted α=%.2f", fc.Alpha),
+	}
+	if method == "holt" {
+		notes[1] += fmt.Sprintf(", β=%.2f", fc.Beta)
+	}
+	notes[1] += fmt.Sprintf("; one-step error σ=%s. The shaded band is a 95%% interval.", formatStat(fc.Sigma))
+	if series.Empty > 0 {
+		notes = append(notes, fmt.Sprintf("⚠️ %d %s(s) had no rows and count as 0.", series.Empty, period))
+	}
+	q.Set("format", "csv")
+	section := ReportSection{Title: "Forecast", Notes: notes, Figure: chart, Headers: headers, Rows: rows,
+		Links: []ReportLink{{Label: "📊 Export Forecast (CSV)", URL: "/forecast?" + q.Encode()}}}
+	renderReport(w, ReportPage{Title: "Forecast of " + name, Subtitle: data.FileName, Sections: []ReportSection{section}})
+}
@@ -0,0 +1,79 @@
+// forecast_test.go
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// monthlySeries starts in January 2024.
+func monthlySeries(values ...float64) PeriodSeries {
+	s := PeriodSeries{Period: "month", Values: values}
+	for i := range values {
+		s.Starts = append(s.Starts, time.Date(2024, time.Month(1+i), 1, 0, 0, 0, 0, time.UTC))
+	}
+	return s
+}
+
+func TestForecastSeries(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		values []float64
+		alpha  float64
+		beta   float64
+		sigma  float64
+		want   []ForecastPoint // Start is checked separately
+	}{
+		// Series smoothing fits exactly carry on as they were, with no band,
+		// whatever the parameters.
+		{"constant", "ses", []float64{7, 7, 7, 7, 7}, 0, 0, 0,
+			[]ForecastPoint{{Value: 7, Lower: 7, Upper: 7}, {Value: 7, Lower: 7, Upper: 7}}},
+		{"linear", "holt", []float64{5, 8, 11, 14, 17, 20}, 0, 0, 0,
+			[]ForecastPoint{{Value: 23, Lower: 23, Upper: 23}, {Value: 26, Lower: 26, Upper: 26}}},
+		// A rising quarterly pattern, 10 + 2t + (3, −1, −4, 2), worked
+		// through the smoothing recurrences and the error variance sums
+		// separately. Neither method models the season, so it ends up in
+		// the band.
+		{"seasonal", "holt", []float64{13, 11, 10, 18, 21, 19, 18, 26, 29, 27, 26, 34}, 0.95, 0.2, 5.662013563750209,
+			[]ForecastPoint{
+				{Value: 35.70090652610423, Lower: 24.60335994115382, Upper: 46.798453111054634},
+				{Value: 37.7612849870267, Lower: 20.932485854119136, Upper: 54.59008411993426},
+				{Value: 39.82166344794917, Lower: 17.437331531972077, Upper: 62.20599536392626},
+			}},
+		{"alternating", "ses", []float64{10, 20, 10, 20, 10, 20, 10, 20, 10, 20, 10, 20}, 0.2, 0, 6.509704046899487,
+			[]ForecastPoint{
+				{Value: 15.173780684800004, Lower: 2.41476075287701, Upper: 27.932800616723},
+				{Value: 15.173780684800004, Lower: 2.162082363361076, Upper: 28.185479006238932},
+				{Value: 15.173780684800004, Lower: 1.914218218675229, Upper: 28.433343150924777},
+			}},
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b)) }
+	for _, tt := range tests {
+		series := monthlySeries(tt.values...)
+		f, err := forecastSeries(series, tt.method, len(tt.want))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !near(f.Sigma, tt.sigma) || tt.sigma != 0 && (!near(f.Alpha, tt.alpha) || !near(f.Beta, tt.beta)) {
+			t.Errorf("%s: alpha %v, beta %v, sigma %v; want %v, %v, %v", tt.name, f.Alpha, f.Beta, f.Sigma, tt.alpha, tt.beta, tt.sigma)
+		}
+		if len(f.Points) != len(tt.want) {
+			t.Fatalf("%s: %d points, want %d", tt.name, len(f.Points), len(tt.want))
+		}
+		at := series.Starts[len(series.Starts)-1]
+		for i, p := range f.Points {
+			at = at.AddDate(0, 1, 0)
+			w := tt.want[i]
+			if !p.Start.Equal(at) || !near(p.Value, w.Value) || !near(p.Lower, w.Lower) || !near(p.Upper, w.Upper) {
+				t.Errorf("%s: point %d is %s %v [%v, %v], want %s %v [%v, %v]", tt.name, i+1,
+					p.Start.Format("2006-01"), p.Value, p.Lower, p.Upper, at.Format("2006-01"), w.Value, w.Lower, w.Upper)
+			}
+		}
+	}
+
+	if _, err := forecastSeries(monthlySeries(1, 2, 3), "holt", 2); err == nil {
+		t.Error("Holt's method ran on 3 periods")
+	}
+}
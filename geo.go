@@ -0,0 +1,306 @@
+// geo.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// geoRegions lists each region's canonical name followed by the variants
+// seen in vendor files. Matching ignores case, punctuation and spacing.
+var geoRegions = map[string][][]string{
+	"province": {
+		{"Eastern Cape", "EC", "E Cape", "E-Cape", "Oos-Kaap"},
+		{"Free State", "FS", "Freestate", "OFS", "Orange Free State", "Vrystaat"},
+		{"Gauteng", "GP", "GT", "GAU", "Gautng"},
+		{"KwaZulu-Natal", "KZN", "KZ-N", "KwaZulu Natal", "Kwazulu", "Natal"},
+		{"Limpopo", "LP", "LIM", "Northern Province"},
+		{"Mpumalanga", "MP", "MPU"},
+		{"Northern Cape", "NC", "N Cape", "Noord-Kaap"},
+		{"North West", "NW", "North-West", "Northwest", "Noordwes"},
+		{"Western Cape", "WC", "W Cape", "W-Cape", "Wes-Kaap", "Westen Cape"},
+	},
+	"country": {
+		{"South Africa", "ZA", "ZAF", "RSA", "SA", "Suid-Afrika", "Republic of South Africa"},
+		{"Namibia", "NA", "NAM"},
+		{"Botswana", "BW", "BWA"},
+		{"Zimbabwe", "ZW", "ZWE"},
+		{"Mozambique", "MZ", "MOZ"},
+		{"Lesotho", "LS", "LSO"},
+		{"Eswatini", "SZ", "SWZ", "Swaziland"},
+		{"Zambia", "ZM", "ZMB"},
+		{"Malawi", "MW", "MWI"},
+		{"Angola", "AO", "AGO"},
+		{"Kenya", "KE", "KEN"},
+		{"Tanzania", "TZ", "TZA"},
+		{"Uganda", "UG", "UGA"},
+		{"Nigeria", "NG", "NGA"},
+		{"Ghana", "GH", "GHA"},
+		{"Egypt", "EG", "EGY"},
+		{"Mauritius", "MU", "MUS"},
+		{"United Kingdom", "GB", "GBR", "UK", "Great Britain", "England", "Britain"},
+		{"Ireland", "IE", "IRL"},
+		{"United States", "US", "USA", "United States of America", "America"},
+		{"Canada", "CA", "CAN"},
+		{"Australia", "AU", "AUS"},
+		{"New Zealand", "NZ", "NZL"},
+		{"Germany", "DE", "DEU", "Deutschland"},
+		{"France", "FR", "FRA"},
+		{"Netherlands", "NL", "NLD", "Holland", "The Netherlands"},
+		{"Belgium", "BE", "BEL"},
+		{"Switzerland", "CH", "CHE"},
+		{"Spain", "ES", "ESP"},
+		{"Portugal", "PT", "PRT"},
+		{"Italy", "IT", "ITA"},
+		{"Sweden", "SE", "SWE"},
+		{"India", "IN", "IND"},
+		{"China", "CN", "CHN"},
+		{"Japan", "JP", "JPN"},
+		{"United Arab Emirates", "AE", "ARE", "UAE"},
+		{"Brazil", "BR", "BRA"},
+	},
+}
+
+var geoKindLabels = map[string]string{"province": "Province", "country": "Country"}
+
+// geoIndex maps a normalised variant to its canonical name, per kind.
+var geoIndex = func() map[string]map[string]string {
+	index := make(map[string]map[string]string)
+	for kind, regions := range geoRegions {
+		index[kind] = make(map[string]string)
+		for _, names := range regions {
+			for _, name := range names {
+				index[kind][geoKey(name)] = names[0]
+			}
+		}
+	}
+	return index
+}()
+
+// geoKey folds case and drops punctuation, so "W. Cape", "w-cape" and
+// "W Cape" all become "w cape".
+func geoKey(s string) string {
+	s = strings.ToLower(s)
+	s = strings.NewReplacer(".", " ", "-", " ", "_", " ", "'", "", ",", " ").Replace(s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func normalizeRegion(kind, v string) (string, bool) {
+	name, ok := geoIndex[kind][geoKey(v)]
+	return name, ok
+}
+
+// detectGeoKind reports whether the distinct values of a column are mostly
+// SA provinces or countries: at least 80% of them must be recognised.
+func detectGeoKind(values map[string]bool) string {
+	if len(values) == 0 {
+		return ""
+	}
+	best, bestHits := "", 0
+	for _, kind := range []string{"province", "country"} {
+		hits := 0
+		for v := range values {
+			if _, ok := normalizeRegion(kind, v); ok {
+				hits++
+			}
+		}
+		if hits > bestHits {
+			best, bestHits = kind, hits
+		}
+	}
+	if bestHits*5 < len(values)*4 {
+		return ""
+	}
+	return best
+}
+
+type GeoCleanup struct {
+	Original   string
+	Normalized string // empty when unrecognised
+	Rows       int
+}
+
+type GeoRollup struct {
+	Region string
+	Rows   int
+	Values []float64
+}
+
+// geoRollup groups rows by the normalised region in col. Unrecognised values
+// are kept as their own group so nothing drops out of the totals.
+func geoRollup(data Spreadsheet, col, valueCol int, kind string) ([]GeoRollup, []GeoCleanup) {
+	groups := make(map[string]*GeoRollup)
+	cleanup := make(map[string]*GeoCleanup)
+	for _, row := range data.Rows {
+		v := cellValue(row, col)
+		region := v
+		if v == "" {
+			region = "(blank)"
+		} else {
+			c, ok := cleanup[v]
+			if !ok {
+				c = &GeoCleanup{Original: v}
+				c.Normalized, _ = normalizeRegion(kind, v)
+				cleanup[v] = c
+			}
+			c.Rows++
+			if c.Normalized != "" {
+				region = c.Normalized
+			}
+		}
+		g, ok := groups[region]
+		if !ok {
+			g = &GeoRollup{Region: region}
+			groups[region] = g
+		}
+		g.Rows++
+		if valueCol >= 0 {
+			if n, ok := parseFinite(cellValue(row, valueCol)); ok {
+				g.Values = append(g.Values, n)
+			}
+		}
+	}
+	rollup := make([]GeoRollup, 0, len(groups))
+	for _, g := range groups {
+		rollup = append(rollup, *g)
+	}
+	sort.Slice(rollup, func(i, j int) bool {
+		if rollup[i].Rows != rollup[j].Rows {
+			return rollup[i].Rows > rollup[j].Rows
+		}
+		return rollup[i].Region < rollup[j].Region
+	})
+	var changes []GeoCleanup
+	for _, c := range cleanup {
+		if c.Normalized != c.Original {
+			changes = append(changes, *c)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Normalized != changes[j].Normalized {
+			return changes[i].Normalized < changes[j].Normalized
+		}
+		return changes[i].Original < changes[j].Original
+	})
+	return rollup, changes
+}
+
+// geoHandler rolls a province or country column up by normalised region and
+// reports which spellings were folded together. view=cleanup with format=csv
+// exports the cleanup list instead of the rollup.
+func geoHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	data := activeDataset(r)
+	if id := q.Get("dataset"); id != "" {
+		var ok bool
+		if data, ok = teamDataset(r, id); !ok {
+			http.Error(w, "Unknown dataset", http.StatusNotFound)
+			return
+		}
+	}
+	if len(data.Headers) == 0 {
+		http.Error(w, "No dataset loaded", http.StatusBadRequest)
+		return
+	}
+	col := columnRef(data, q.Get("column"))
+	if col == -1 {
+		http.Error(w, "Unknown column", http.StatusBadRequest)
+		return
+	}
+	kind := q.Get("kind")
+	if kind == "" {
+		seen := make(map[string]bool)
+		for _, row := range data.Rows {
+			if v := cellValue(row, col); v != "" {
+				seen[v] = true
+			}
+		}
+		if kind = detectGeoKind(seen); kind == "" {
+			http.Error(w, fmt.Sprintf("%s doesn't look like a province or country column; choose the kind explicitly", data.Headers[col]), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if _, ok := geoKindLabels[kind]; !ok {
+		http.Error(w, "kind must be province or country", http.StatusBadRequest)
+		return
+	}
+	valueCol := -1
+	var op Operation
+	var params OpParams
+	if ref := q.Get("value"); ref != "" {
+		if valueCol = columnRef(data, ref); valueCol == -1 {
+			http.Error(w, "Unknown value column", http.StatusBadRequest)
+			return
+		}
+		name := q.Get("operation")
+		if name == "" {
+			name = "sum"
+		}
+		var ok bool
+		if op, ok = lookupOperation(name); !ok {
+			http.Error(w, "Unknown operation", http.StatusBadRequest)
+			return
+		}
+		params, _ = op.ResolveParams(nil)
+	}
+
+	rollup, changes := geoRollup(data, col, valueCol, kind)
+	headers := []string{"Region", "Rows"}
+	if valueCol >= 0 {
+		headers = append(headers, op.Label+" of "+data.Headers[valueCol])
+	}
+	var rows [][]string
+	unrecognised := 0
+	for _, g := range rollup {
+		row := []string{g.Region, strconv.Itoa(g.Rows)}
+		if valueCol >= 0 {
+			cell := ""
+			if len(g.Values) > 0 {
+				if v, err := op.Compute(g.Values, params); err == nil {
+					cell = formatStat(v)
+				}
+			}
+			row = append(row, cell)
+		}
+		rows = append(rows, row)
+	}
+	cleanupHeaders := []string{"Original", "Normalized To", "Rows"}
+	var cleanupRows [][]string
+	for _, c := range changes {
+		to := c.Normalized
+		if to == "" {
+			to = "(unrecognised)"
+			unrecognised++
+		}
+		cleanupRows = append(cleanupRows, []string{c.Original, to, strconv.Itoa(c.Rows)})
+	}
+	if q.Get("format") == "csv" {
+		name, h, out := "geo_rollup", headers, rows
+		if q.Get("view") == "cleanup" {
+			name, h, out = "geo_cleanup", cleanupHeaders, cleanupRows
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_%s.csv"`, exportBaseName(data.FileName), name))
+		writeCSV(w, h, out)
+		return
+	}
+
+	q.Set("format", "csv")
+	q.Del("view")
+	summary := ReportSection{Title: "Rollup by " + geoKindLabels[kind], Headers: headers, Rows: rows,
+		Notes: []string{fmt.Sprintf("%s read as %s names.", data.Headers[col], kind)},
+		Links: []ReportLink{{Label: "📊 Export Rollup (CSV)", URL: "/geo?" + q.Encode()}}}
+	q.Set("view", "cleanup")
+	cleanup := ReportSection{Title: "Cleanup", Headers: cleanupHeaders, Rows: cleanupRows,
+		Links: []ReportLink{{Label: "📊 Export Cleanup Report (CSV)", URL: "/geo?" + q.Encode()}}}
+	switch {
+	case len(cleanupRows) == 0:
+		cleanup.Notes = []string{"✅ Every value already uses its canonical name."}
+	case unrecognised > 0:
+		cleanup.Notes = []string{fmt.Sprintf("⚠️ %d value(s) weren't recognised and are rolled up as they are.", unrecognised)}
+	}
+	renderReport(w, ReportPage{Title: "Geographic Rollup of " + data.Headers[col], Subtitle: data.FileName, Sections: []ReportSection{summary, cleanup}})
+}
@@ -2,15 +2,17 @@ module clientweb
 
 go 1.24.3
 
-require github.com/xuri/excelize/v2 v2.9.1
+require (
+	github.com/richardlehane/mscfb v1.0.4
+	github.com/xuri/excelize/v2 v2.9.1
+	golang.org/x/text v0.25.0
+)
 
 require (
-	github.com/richardlehane/mscfb v1.0.4 // indirect
 	github.com/richardlehane/msoleps v1.0.4 // indirect
 	github.com/tiendc/go-deepcopy v1.6.0 // indirect
 	github.com/xuri/efp v0.0.1 // indirect
 	github.com/xuri/nfp v0.0.1 // indirect
 	golang.org/x/crypto v0.38.0 // indirect
 	golang.org/x/net v0.40.0 // indirect
-	golang.org/x/text v0.25.0 // indirect
 )
@@ -0,0 +1,174 @@
+// groups.go
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// A calculation can also be broken down by a categorical column: its
+// columns are calculated again over the rows sharing each of that column's
+// values, after any filters, e.g. the sum of Sales per Region.
+
+// maxGroups is the most values a column may have to be grouped by.
+const maxGroups = 100
+
+// A GroupCell is one column's result for one group.
+type GroupCell struct {
+	Value   float64
+	Exact   string // decimal-mode result, as in CalculationResult
+	Err     string // why the group has no result for the column
+	Skipped int    // the group's non-empty cells that weren't numbers
+}
+
+// A GroupResult is the calculation over the rows with one group-by value.
+type GroupResult struct {
+	Key   string
+	Rows  int
+	Cells []GroupCell // in the order of the page's Results
+}
+
+// detectCategoricalColumns returns the columns that can be grouped by: the
+// ones that aren't numeric and have at most maxGroups values.
+func detectCategoricalColumns(data Spreadsheet) []int {
+	var cols []int
+	for col := range data.Headers {
+		if slices.Contains(data.NumericCols, col) {
+			continue
+		}
+		if n, ok := distinctValues(data, col, maxGroups); ok && n > 0 {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+// distinctValues counts col's different non-empty values, giving up with
+// false once there are more than limit.
+func distinctValues(data Spreadsheet, col, limit int) (int, bool) {
+	seen := make(map[string]bool)
+	for _, row := range data.Rows {
+		v := cellValue(row, col)
+		if v == "" || seen[v] {
+			continue
+		}
+		if seen[v] = true; len(seen) > limit {
+			return len(seen), false
+		}
+	}
+	return len(seen), true
+}
+
+// calculateColumn runs calc's operation on col, exactly in decimal mode.
+func calculateColumn(data Spreadsheet, col int, calc Calculation, decimal bool) (CalculationResult, error) {
+	res := CalculationResult{Col: data.Headers[col]}
+	if decimal {
+		exact, text, err := performDecimalCalculation(data, col, calc.Operation.Name, calc.Rounding)
+		if err != nil {
+			return res, err
+		}
+		res.Value, _ = exact.Float64()
+		res.Exact = text
+		return res, nil
+	}
+	value, err := memoizedCalculation(data, col, calc.Operation.Name, calc.Params)
+	res.Value = value
+	return res, err
+}
+
+// calculateGroups calculates the columns of results again for each group of
+// data's rows by groupCol, in the order the groups first appear, the same
+// way each column was calculated over all of them. It returns false if the
+// budget ran out before the last group.
+func calculateGroups(data Spreadsheet, groupCol int, results []CalculationResult, calc Calculation, budget calcBudget) ([]GroupResult, bool) {
+	var groups []GroupResult
+	for _, g := range groupRows(data.Rows, []int{groupCol}) {
+		if budget.Spent() {
+			return groups, false
+		}
+		// Like the filtered rows, a group has no ID to share cached results.
+		subset := Spreadsheet{Headers: data.Headers, Rows: g.Rows, NumericCols: data.NumericCols}
+		group := GroupResult{Key: g.Key[0], Rows: len(g.Rows)}
+		for _, res := range results {
+			col, decimal := columnIndex(data.Headers, res.Col), res.Exact != ""
+			parses := parsesFloat
+			if decimal {
+				parses = parsesDecimal
+			}
+			cell := GroupCell{Skipped: diagnoseColumn(subset, col, parses).Excluded()}
+			r, err := calculateColumn(subset, col, calc, decimal)
+			if err != nil {
+				cell.Err = err.Error()
+			} else {
+				cell.Value, cell.Exact = r.Value, r.Exact
+			}
+			group.Cells = append(group.Cells, cell)
+		}
+		groups = append(groups, group)
+	}
+	return groups, true
+}
+
+// A GroupTable is what the results page shows of a grouped calculation.
+type GroupTable struct {
+	By        string
+	Operation string
+	Results   []CalculationResult
+	Groups    []GroupResult
+	Rows      int
+}
+
+// Doubtful reports whether a group has cells that weren't used or no result.
+func (t GroupTable) Doubtful() bool {
+	for _, g := range t.Groups {
+		for _, c := range g.Cells {
+			if c.Err != "" || c.Skipped > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GroupTable is the page's breakdown by its group-by column.
+func (p ResultPage) GroupTable() GroupTable {
+	return GroupTable{By: p.GroupBy, Operation: p.Operation, Results: p.Results, Groups: p.Groups, Rows: p.RowsMatched}
+}
+
+// SourceTable is the page's breakdown by the file each row was appended from.
+func (p ResultPage) SourceTable() GroupTable {
+	return GroupTable{By: p.SourceCol, Operation: p.Operation, Results: p.Results, Groups: p.Sources, Rows: p.RowsMatched}
+}
+
+// groupsTable is resultsTable for a grouped calculation: a row per group, a
+// column per calculated column, and the results over all rows last.
+func groupsTable(page ResultPage) ([]string, [][]string) {
+	headers := []string{page.GroupBy, "Rows"}
+	for _, res := range page.Results {
+		headers = append(headers, res.Col+" "+page.Operation)
+	}
+	var rows [][]string
+	for _, g := range page.Groups {
+		row := []string{g.Key, fmt.Sprint(g.Rows)}
+		for _, c := range g.Cells {
+			row = append(row, c.String())
+		}
+		rows = append(rows, row)
+	}
+	total := []string{"All", fmt.Sprint(page.RowsMatched)}
+	for _, res := range page.Results {
+		total = append(total, GroupCell{Value: res.Value, Exact: res.Exact}.String())
+	}
+	return headers, append(rows, total)
+}
+
+// String formats the cell as resultsTable does, leaving failed cells blank.
+func (c GroupCell) String() string {
+	switch {
+	case c.Err != "":
+		return ""
+	case c.Exact != "":
+		return c.Exact
+	}
+	return fmt.Sprintf("%.2f", c.Value)
+}
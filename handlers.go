@@ -3,19 +3,20 @@
 package main
 
 import (
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
     "fmt"
+    "io"
     "log"
     "net/http"
+    "strconv"
     "strings"
     "time"
 )
 
-// GLOBAL in-memory storage for the last uploaded spreadsheet
-var lastSpreadsheet Spreadsheet
-
 const (
 	MaxFileSize = 10 << 20 // 10MB
-	MaxRows     = 10000
 )
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
@@ -24,7 +25,17 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Cache-Control", "no-cache")
-	if err := uploadTemplate.Execute(w, nil); err != nil {
+	var targets []DatasetSummary
+	for _, data := range teamUploads(currentTeam(r).ID) {
+		targets = append(targets, summarizeDataset(data))
+	}
+	if err := uploadTemplate.Execute(w, UploadPage{
+		Mappings:   mappings.List(currentTeam(r).ID),
+		User:       signedInUser(r),
+		Usage:      usageFor(ownerID(currentUser(r))),
+		Workspaces: teamSummaries(r),
+		Uploads:    targets,
+	}); err != nil {
 		log.Printf("Template error: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
@@ -40,64 +51,228 @@ func displayHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "File too large", http.StatusBadRequest)
 		return
 	}
+	data, err := receiveFile(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	renderDisplay(w, r, data)
+}
+
+// receiveUpload reads, checks and stores the file in a parsed multipart
+// upload's "file" field, with the options the upload page sends alongside
+// it. Its errors carry the status to answer with when it isn't 400.
+func receiveUpload(r *http.Request) (Spreadsheet, error) {
+	data, err := readUpload(r)
+	if err != nil {
+		return Spreadsheet{}, err
+	}
+	return storeUpload(r, data)
+}
 
+// readUpload is receiveUpload up to storing the dataset.
+func readUpload(r *http.Request) (Spreadsheet, error) {
 	file, header, err := r.FormFile("file")
 	if err != nil {
-		http.Error(w, "Failed to read file", http.StatusBadRequest)
-		return
+		return Spreadsheet{}, errors.New("Failed to read file")
 	}
 	defer file.Close()
 
 	filename := strings.ToLower(header.Filename)
 	if !strings.HasSuffix(filename, ".csv") &&
 		!strings.HasSuffix(filename, ".xlsx") &&
-		!strings.HasSuffix(filename, ".xls") {
-		http.Error(w, "Invalid file type", http.StatusBadRequest)
-		return
+		!strings.HasSuffix(filename, ".xls") &&
+		!strings.HasSuffix(filename, ".dbf") &&
+		!strings.HasSuffix(filename, ".pdf") &&
+		!isDatabaseFile(filename) &&
+		!isFixedWidthFile(filename) {
+		return Spreadsheet{}, errors.New("Invalid file type")
 	}
 
-	var data Spreadsheet
-	data.FileName = header.Filename
-	data.UploadTime = time.Now()
-	data.FileSize = header.Size
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return Spreadsheet{}, errors.New("Failed to read file")
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return Spreadsheet{}, errors.New("Failed to read file")
+	}
+	if err := checkMemoryBudget(filename, file, header.Size); err != nil {
+		return Spreadsheet{}, withStatus(http.StatusRequestEntityTooLarge, fmt.Errorf("Upload rejected: %w", err))
+	}
 
+	var data Spreadsheet
 	if strings.HasSuffix(filename, ".csv") {
-		data, err = processCSV(file)
+		csvOpts, err := csvOptionsFromForm(r)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("CSV error: %v", err), http.StatusBadRequest)
-			return
+			return Spreadsheet{}, fmt.Errorf("CSV error: %w", err)
+		}
+		csvOpts.Columns = columnsFromForm(r)
+		data, err = processCSV(file, csvOpts)
+		if err != nil {
+			return Spreadsheet{}, fmt.Errorf("CSV error: %w", err)
+		}
+	} else if strings.HasSuffix(filename, ".dbf") {
+		data, err = processDBF(file, parseRowLimit())
+		if err == nil {
+			err = columnsFromForm(r).apply(&data)
+		}
+		if err != nil {
+			return Spreadsheet{}, fmt.Errorf("dBase error: %w", err)
+		}
+	} else if isFixedWidthFile(filename) {
+		var fwOpts FixedWidthOptions
+		fwOpts, err = fixedWidthOptionsFromForm(r)
+		if err == nil {
+			data, _, err = processFixedWidth(file, fwOpts, parseRowLimit())
+		}
+		if err == nil {
+			err = columnsFromForm(r).apply(&data)
+		}
+		if err != nil {
+			return Spreadsheet{}, fmt.Errorf("Fixed-width error: %w", err)
+		}
+	} else if strings.HasSuffix(filename, ".pdf") {
+		data, _, err = processPDF(file, r.FormValue("table"), parseRowLimit())
+		if err == nil {
+			err = columnsFromForm(r).apply(&data)
+		}
+		if err != nil {
+			return Spreadsheet{}, fmt.Errorf("PDF error: %w", err)
+		}
+	} else if isDatabaseFile(filename) {
+		data, _, err = processSQLite(file, r.FormValue("table"), parseRowLimit())
+		if err == nil {
+			err = columnsFromForm(r).apply(&data)
+		}
+		if err != nil {
+			return Spreadsheet{}, fmt.Errorf("Database error: %w", err)
+		}
+	} else if isCompoundFile(file) {
+		data, err = processXLS(file)
+		if err == nil {
+			err = columnsFromForm(r).apply(&data)
+		}
+		if err != nil {
+			return Spreadsheet{}, fmt.Errorf("Excel error: %w", err)
 		}
 	} else {
-		data, err = processExcel(file)
+		headerRows, _ := strconv.Atoi(r.FormValue("header_rows"))
+		data, err = processExcel(file, ExcelOptions{
+			HeaderRows:    headerRows,
+			IncludeHidden:    r.FormValue("include_hidden") == "1",
+			EvaluateFormulas: r.FormValue("formulas") == "evaluate",
+			Annotations:      r.FormValue("annotations") == "1",
+		})
+		if err == nil {
+			err = columnsFromForm(r).apply(&data)
+		}
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Excel error: %v", err), http.StatusBadRequest)
-			return
+			return Spreadsheet{}, fmt.Errorf("Excel error: %w", err)
 		}
 	}
 
-	if len(data.Rows) > MaxRows {
-		http.Error(w, fmt.Sprintf("Too many rows (> %d)", MaxRows), http.StatusBadRequest)
-		return
+	data.FileName = header.Filename
+	data.UploadTime = time.Now()
+	data.FileSize = header.Size
+	data.Checksum = hex.EncodeToString(hash.Sum(nil))
+
+	if err := checkRowLimit(len(data.Rows)); err != nil {
+		return Spreadsheet{}, fmt.Errorf("Upload rejected: %w", err)
+	}
+
+	removeRepeatedHeaders(&data)
+	data.Team = currentTeam(r).ID
+
+	var overrides map[int]string
+	if t, ok := selectMapping(data, r.FormValue("mapping")); ok {
+		overrides, err = applyMapping(&data, t)
+		if err != nil {
+			return Spreadsheet{}, fmt.Errorf("Mapping error: %w", err)
+		}
+		data.Notes = append(data.Notes, fmt.Sprintf("Applied mapping template %q", t.Name))
 	}
+	normalizeNumbers(&data, numberFormatFromForm(r))
 
-	data.NumericCols = detectNumericColumns(data)
+	data.NumericCols = applyTypeOverrides(detectNumericColumns(data), overrides)
 	if len(data.NumericCols) == 0 {
-		http.Error(w, "No numeric columns found", http.StatusBadRequest)
-		return
+		return Spreadsheet{}, errors.New("No numeric columns found")
+	}
+	data.Detections = append(data.Detections, columnDetections(data, overrides)...)
+	return data, nil
+}
+
+// storeUpload adds a read upload to the workspace, if it fits in the
+// uploader's quota.
+func storeUpload(r *http.Request, data Spreadsheet) (Spreadsheet, error) {
+	data.Owner = ownerID(currentUser(r))
+	data, err := workspace.Add(data)
+	if errors.Is(err, errOverQuota) {
+		return Spreadsheet{}, withStatus(http.StatusForbidden, fmt.Errorf("Upload rejected: %w", err))
+	}
+	if err != nil {
+		return Spreadsheet{}, fmt.Errorf("Upload not saved: %w", err)
 	}
+	uploadLedger.Record(data.Owner, data.FileSize)
+	go checkAlerts(data, "upload")
+	return data, nil
+}
 
-	lastSpreadsheet = data
+func renderReport(w http.ResponseWriter, page ReportPage) {
+	if err := reportTemplate.Execute(w, page); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Failed to render report", http.StatusInternalServerError)
+	}
+}
 
+func renderDisplay(w http.ResponseWriter, r *http.Request, data Spreadsheet) {
+	uploads.Remember(w, r, data)
 	displayData := DisplayData{
+		DatasetID:   data.ID,
+		Derivation:  data.Derivation,
+		Notes:       data.Notes,
+		Annotations: data.Annotations,
 		Headers:     data.Headers,
-		Rows:        data.Rows,
+		ColumnIDs:   data.ColumnIDs,
 		NumericCols: data.NumericCols,
+		FormulaCols: data.FormulaCols,
+		Operations:  operations,
+		Conversions: unitConversions,
 		FileName:    data.FileName,
 		FileSize:    formatFileSize(data.FileSize),
 		RowCount:    len(data.Rows),
 	}
+	displayData.Tier = datasetTier(data)
+	displayData.Detections = data.Detections
+	displayData.TierNote = tierNote(data)
+	if displayData.Tier == TierInteractive {
+		displayData.Window = rowWindow(data, 0, displayWindow)
+	}
+	displayData.ParsePreviews = parsePreviews(data)
+	displayData.CategoricalCols = detectCategoricalColumns(data)
+	displayData.RoundingPolicies = roundingOptions()
+	displayData.Version = data.Version
+	displayData.Drift = data.Drift
+	displayData.Replaced, displayData.ReplacedBy = versions(r, data)
+	for _, other := range uploads.Recent(r) {
+		if other.ID != data.ID {
+			displayData.RecentUploads = append(displayData.RecentUploads, summarizeDataset(other))
+		}
+	}
+	stats, ready := headerStatsFor(data)
+	displayData.HeaderStats = stats
+	displayData.ProfileUpdating = !ready
+	if p, ok := profiles.Progress(data.ID); ok && !ready {
+		displayData.ProfileProgress = p.String()
+	}
+	accessLog.Record(r, data.ID, "view", "display")
+	if displayData.ShowAccess = canSeeAccessLog(r, data); displayData.ShowAccess {
+		displayData.RecentAccess = accessLog.For(data.ID)
+		if len(displayData.RecentAccess) > recentAccessShown {
+			displayData.RecentAccess = displayData.RecentAccess[:recentAccessShown]
+		}
+	}
 
-	if err := displayTemplate.Execute(w, displayData); err != nil {
+	if err := renderPage(w, r, displayTemplate, displayData); err != nil {
 		log.Printf("Template error: %v", err)
 		http.Error(w, "Failed to display data", http.StatusInternalServerError)
 	}
@@ -114,47 +289,226 @@ func calculateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cols := r.Form["cols"]
-	op := r.FormValue("operation")
+	places := -1
+	if v := strings.TrimSpace(r.FormValue("places")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Decimal places must be between 0 and 10", http.StatusBadRequest)
+			return
+		}
+		places = n
+	}
+	rounding, err := newRounding(r.FormValue("rounding"), places)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	calc := Calculation{
+		Columns:  r.Form["cols"],
+		Decimal:  r.FormValue("decimal"),
+		Rounding: rounding,
+		Strict:   r.FormValue("strict") == "1",
+		SegmentA: strings.TrimSpace(r.FormValue("segment_a")),
+		SegmentB: strings.TrimSpace(r.FormValue("segment_b")),
+		GroupBy:  r.FormValue("group_by"),
+	}
+	for _, f := range r.Form["filter"] {
+		if f = strings.TrimSpace(f); f != "" {
+			calc.Filters = append(calc.Filters, f)
+		}
+	}
+	if (calc.SegmentA == "") != (calc.SegmentB == "") {
+		http.Error(w, "Comparing segments needs both filters", http.StatusBadRequest)
+		return
+	}
 
-	if len(cols) == 0 || op == "" || len(lastSpreadsheet.Headers) == 0 {
+	data, ok := sessionDataset(r)
+	op := r.FormValue("operation")
+	if len(calc.Columns) == 0 || op == "" || !ok {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	if calc.Operation, ok = lookupOperation(op); !ok {
+		http.Error(w, "Unsupported operation", http.StatusBadRequest)
+		return
+	}
+	calc.Params, err = calc.Operation.ResolveParams(formParams(calc.Operation, r.Form))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid parameters: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	page, err := runCalculation(data, calc, newCalcBudget(r.Context()))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	uploads.SetResult(w, r, page)
+
+	if err := renderPage(w, r, resultTemplate, page); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Failed to render results", http.StatusInternalServerError)
+	}
+}
 
+// newRounding is the rounding a calculation asked for; an empty policy is
+// the configured default and places -1 the column's own precision.
+func newRounding(policy string, places int) (Rounding, error) {
+	rounding := Rounding{Policy: config.Rounding, Places: places}
+	if policy != "" {
+		rounding.Policy = policy
+	}
+	if _, ok := roundingLabels[rounding.Policy]; !ok {
+		return rounding, errors.New("Unknown rounding policy")
+	}
+	if places < -1 || places > 10 {
+		return rounding, errors.New("Decimal places must be between 0 and 10")
+	}
+	return rounding, nil
+}
+
+// Calculation is one operation over some columns, as the calculate form
+// and the calculate API ask for it.
+type Calculation struct {
+	Columns   []string // names or IDs
+	Operation Operation
+	Params    OpParams
+	Decimal   string // "on", "off" or "" to decide by column (see useDecimalMode)
+	Rounding  Rounding
+	Strict    bool
+	SegmentA  string // filters for comparing two segments, both or neither
+	SegmentB  string
+	Filters   []string // expressions every row calculated must satisfy
+	GroupBy   string   // name or ID of a column to also calculate per value of
+}
+
+// runCalculation runs calc over data. Columns that can't be calculated are
+// skipped with a warning, unless calc.Strict, when the first one fails it
+// with 422; columns left when budget runs out are listed as incomplete. If
+// nothing was calculated the page still holds the warnings saying why.
+func runCalculation(data Spreadsheet, calc Calculation, budget calcBudget) (ResultPage, error) {
+	op := calc.Operation.Name
+	id := data.ID
+	groupCol := -1
+	if calc.GroupBy != "" {
+		if groupCol = columnRef(data, calc.GroupBy); groupCol == -1 {
+			return ResultPage{}, errors.New("Unknown group-by column")
+		}
+		if _, ok := distinctValues(data, groupCol, maxGroups); !ok {
+			return ResultPage{}, fmt.Errorf("%s has more than %d different values to group by", data.Headers[groupCol], maxGroups)
+		}
+	}
+	sourceCol := sourceColumn(data)
+	rowsMatched := len(data.Rows)
+	if len(calc.Filters) > 0 {
+		filtered, err := filterRows(data, calc.Filters)
+		if err != nil {
+			return ResultPage{}, err
+		}
+		if rowsMatched = len(filtered.Rows); rowsMatched == 0 {
+			return ResultPage{}, errors.New("No rows match the filters")
+		}
+		// The matching rows are calculated as a dataset of their own, so
+		// they aren't given the cached results of all the rows.
+		data = Spreadsheet{Headers: data.Headers, ColumnIDs: data.ColumnIDs, Rows: filtered.Rows, NumericCols: data.NumericCols, FileName: data.FileName}
+	}
 	var results []CalculationResult
-	for _, colName := range cols {
-		colIndex := -1
-		for i, h := range lastSpreadsheet.Headers {
-			if h == colName {
-				colIndex = i
-				break
+	var comparisons []SegmentComparison
+	var warnings []string
+	rounded := false
+	var incomplete []string
+	for i, ref := range calc.Columns {
+		if budget.Spent() {
+			for _, ref := range calc.Columns[i:] {
+				if colIndex := columnRef(data, ref); colIndex != -1 {
+					incomplete = append(incomplete, data.Headers[colIndex])
+				}
 			}
+			break
 		}
+		colIndex := columnRef(data, ref)
 		if colIndex == -1 {
 			continue
 		}
-		result, err := performCalculation(lastSpreadsheet, colIndex, op)
+		colName := data.Headers[colIndex]
+		if calc.SegmentA != "" {
+			c, err := compareSegments(data, colIndex, calc.SegmentA, calc.SegmentB)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("%s not compared: %v", colName, err))
+			} else {
+				comparisons = append(comparisons, c)
+			}
+		}
+		decimal := useDecimalMode(data, colIndex, op, calc.Decimal)
+		parses := parsesFloat
+		if decimal {
+			parses = parsesDecimal
+		}
+		diag := diagnoseColumn(data, colIndex, parses)
+		if err := diag.strictError(colName); calc.Strict && err != nil {
+			return ResultPage{}, withStatus(http.StatusUnprocessableEntity, err)
+		}
+		result, err := calculateColumn(data, colIndex, calc, decimal)
 		if err != nil {
+			if calc.Strict && !decimal {
+				return ResultPage{}, withStatus(http.StatusUnprocessableEntity, fmt.Errorf("strict mode: column %q: %v", colName, err))
+			}
+			warnings = append(warnings, fmt.Sprintf("%s skipped: %v", colName, err))
 			continue
 		}
-		results = append(results, CalculationResult{Col: colName, Value: result})
+		rounded = rounded || decimal
+		result.Diagnostics = diag
+		results = append(results, result)
 	}
 
-	if len(results) == 0 {
-		http.Error(w, "No valid calculations", http.StatusBadRequest)
-		return
+	var groups []GroupResult
+	if groupCol != -1 && len(results) > 0 {
+		var done bool
+		if groups, done = calculateGroups(data, groupCol, results, calc, budget); !done {
+			warnings = append(warnings, fmt.Sprintf("Only %d groups were calculated before the %s ran out", len(groups), budget))
+		}
+	}
+	// Datasets built up from several files are also broken down by file, so
+	// a result that looks wrong can be traced to the file behind it.
+	var sources []GroupResult
+	if sourceCol != -1 && sourceCol != groupCol && len(results) > 0 {
+		var done bool
+		if sources, done = calculateGroups(data, sourceCol, results, calc, budget); !done || len(sources) < 2 {
+			sources = nil
+		}
 	}
 
 	page := ResultPage{
-		Operation: strings.Title(op),
-		Results:   results,
-		FileName:  lastSpreadsheet.FileName,
-		Timestamp: time.Now().Format("January 2, 2006 at 3:04 PM"),
+		OpName:      op,
+		Operation:   calc.Operation.Label,
+		Params:      describeParams(calc.Operation, calc.Params),
+		ParamValues: calc.Params,
+		Results:     results,
+		Comparisons: comparisons,
+		Warnings:    warnings,
+		Incomplete:  incomplete,
+		Filters:     calc.Filters,
+		RowsMatched: rowsMatched,
+		Groups:      groups,
+		Sources:     sources,
+		FileName:    data.FileName,
+		DatasetID:   id,
+		Timestamp:   time.Now().Format("January 2, 2006 at 3:04 PM"),
 	}
-
-	if err := resultTemplate.Execute(w, page); err != nil {
-		log.Printf("Template error: %v", err)
-		http.Error(w, "Failed to render results", http.StatusInternalServerError)
+	if rounded {
+		page.Rounding = calc.Rounding.Describe()
+	}
+	if len(incomplete) > 0 {
+		page.Budget = budget.String()
+	}
+	if groupCol != -1 {
+		page.GroupBy = data.Headers[groupCol]
 	}
-}
\ No newline at end of file
+	if sources != nil {
+		page.SourceCol = data.Headers[sourceCol]
+	}
+	if len(results) == 0 && len(incomplete) == 0 {
+		return page, errors.New("No valid calculations")
+	}
+	return page, nil
+}
@@ -0,0 +1,75 @@
+// headerstats.go
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// HeaderStats summarizes a numeric column for its header on the display
+// page, so broken columns stand out before anyone calculates with them.
+type HeaderStats struct {
+	Min       string
+	Max       string
+	Mean      string
+	Nulls     int
+	Excluded  int // present but unusable in calculations
+	Warnings  []string
+	Sparkline template.HTML
+}
+
+// Tooltip is the one-line form shown when hovering over the header.
+func (s HeaderStats) Tooltip() string {
+	parts := []string{"min " + s.Min, "max " + s.Max, "mean " + s.Mean, fmt.Sprintf("%d empty", s.Nulls)}
+	if s.Excluded > 0 {
+		parts = append(parts, fmt.Sprintf("%d skipped", s.Excluded))
+	}
+	return strings.Join(append(parts, s.Warnings...), " · ")
+}
+
+// formatStat rounds to cents for display; huge values switch to exponent
+// form since rounding them would overflow.
+func formatStat(v float64) string {
+	switch {
+	case math.IsNaN(v) || math.IsInf(v, 0):
+		return "out of range"
+	case math.Abs(v) >= 1e15:
+		return strconv.FormatFloat(v, 'g', 6, 64)
+	}
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
+
+// headerStats computes stats for each numeric column, keyed by column index,
+// from the column summaries.
+func headerStats(data Spreadsheet, prog *Progress) map[int]*HeaderStats {
+	out := make(map[int]*HeaderStats, len(data.NumericCols))
+	dateCol := -1
+	if dates := detectDateColumns(data); len(dates) > 0 {
+		dateCol = dates[0]
+	}
+	for _, col := range data.NumericCols {
+		d := columnSummary(data, col)
+		s := HeaderStats{Min: "–", Max: "–", Mean: "–", Nulls: d.Empty, Excluded: d.Excluded()}
+		if d.Count > 0 {
+			s.Min, s.Max, s.Mean = formatStat(d.Min), formatStat(d.Max), formatStat(d.Total()/float64(d.Count))
+			if d.Count > 1 && d.Min == d.Max {
+				s.Warnings = append(s.Warnings, "every value is the same")
+			}
+		} else {
+			s.Warnings = append(s.Warnings, "no usable numbers")
+		}
+		if d.Cells > 0 && d.Empty*2 > d.Cells {
+			s.Warnings = append(s.Warnings, "mostly empty")
+		}
+		if d.NonFinite > 0 {
+			s.Warnings = append(s.Warnings, fmt.Sprintf("%d NaN or infinite value(s)", d.NonFinite))
+		}
+		s.Sparkline = sparkline(data, col, dateCol)
+		out[col] = &s
+		prog.Add(len(data.Rows))
+	}
+	return out
+}
@@ -2,7 +2,17 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
 func formatFileSize(size int64) string {
@@ -16,4 +26,228 @@ func formatFileSize(size int64) string {
 		exp++
 	}
 	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
-}
\ No newline at end of file
+}
+
+func columnIndex(headers []string, name string) int {
+	for i, h := range headers {
+		if h == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// newColumnIDs returns the stable IDs for a dataset with n columns: "c1" for
+// the first column of the upload and so on. IDs are carried into derived
+// datasets and survive renames, so they keep pointing at the same data.
+func newColumnIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = "c" + strconv.Itoa(i+1)
+	}
+	return ids
+}
+
+// columnRef resolves a column ID or, failing that, a header name.
+func columnRef(data Spreadsheet, ref string) int {
+	for i, id := range data.ColumnIDs {
+		if id == ref && i < len(data.Headers) {
+			return i
+		}
+	}
+	return columnIndex(data.Headers, ref)
+}
+
+// ColumnMatch reports how a loosely matched column reference was resolved,
+// so scripts can see which column they actually got.
+type ColumnMatch struct {
+	Requested string `json:"requested"`
+	Column    string `json:"column"`
+	ID        string `json:"id,omitempty"`
+	By        string `json:"matched_by"` // id, exact, case or normalized
+}
+
+// Loose reports whether the reference only matched after folding case or
+// normalizing separators.
+func (m ColumnMatch) Loose() bool {
+	return m.By == "case" || m.By == "normalized"
+}
+
+// columnKey folds case and treats runs of spaces, underscores, hyphens and
+// dots as a single separator: "Total Amount" and "total_amount" agree.
+func columnKey(name string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return unicode.IsSpace(r) || r == '_' || r == '-' || r == '.'
+	}), " ")
+}
+
+// matchColumn resolves ref by ID or exact name and, when loose is set, then
+// by case-insensitive and finally normalized name. A loose reference that
+// fits more than one column is an error rather than a guess.
+func matchColumn(data Spreadsheet, ref string, loose bool) (int, ColumnMatch, error) {
+	m := ColumnMatch{Requested: ref}
+	found := func(col int, by string) (int, ColumnMatch, error) {
+		m.Column, m.By = data.Headers[col], by
+		if col < len(data.ColumnIDs) {
+			m.ID = data.ColumnIDs[col]
+		}
+		return col, m, nil
+	}
+	if col := columnRef(data, ref); col != -1 {
+		if col < len(data.ColumnIDs) && data.ColumnIDs[col] == ref {
+			return found(col, "id")
+		}
+		return found(col, "exact")
+	}
+	if loose {
+		for _, rule := range []struct {
+			by  string
+			key func(string) string
+		}{{"case", strings.ToLower}, {"normalized", columnKey}} {
+			var hits []string
+			col := -1
+			for i, h := range data.Headers {
+				if rule.key(h) == rule.key(ref) {
+					hits = append(hits, strconv.Quote(h))
+					col = i
+				}
+			}
+			if len(hits) == 1 {
+				return found(col, rule.by)
+			}
+			if len(hits) > 1 {
+				return -1, m, fmt.Errorf("column %q is ambiguous: it matches %s", ref, strings.Join(hits, ", "))
+			}
+		}
+	}
+	return -1, m, fmt.Errorf("unknown column %q", ref)
+}
+
+// parseMatchMode reads the API's "match" option: exact (the default) or loose.
+func parseMatchMode(mode string) (bool, error) {
+	switch mode {
+	case "", "exact":
+		return false, nil
+	case "loose":
+		return true, nil
+	}
+	return false, fmt.Errorf("match must be \"exact\" or \"loose\", not %q", mode)
+}
+
+func cellValue(row []string, col int) string {
+	if col < 0 || col >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[col])
+}
+
+// statusError is an error with the HTTP status to answer it with, for
+// code shared by HTML and API handlers.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+func (e *statusError) Unwrap() error { return e.err }
+
+func withStatus(status int, err error) error {
+	return &statusError{status: status, err: err}
+}
+
+// errorStatus is the status err carries, or fallback.
+func errorStatus(err error, fallback int) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.status
+	}
+	return fallback
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+var dateLayouts = []string{
+	"2006-01-02",
+	"2006/01/02",
+	"02/01/2006",
+	"2/1/2006",
+	"02-01-2006",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	time.RFC3339,
+	"02-Jan-2006",
+	"2 Jan 2006",
+	"2 January 2006",
+	"Jan 2, 2006",
+	"January 2, 2006",
+}
+
+// parseDate tries the date layouts we commonly see in uploads. Slash dates
+// are read day-first, matching South African regional settings.
+func parseDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// readJSONFile decodes path into v. A missing file leaves v untouched.
+func readJSONFile(path string, v interface{}) error {
+	if docs, name, ok := dataDocument(path); ok {
+		b, err := docs.ReadDocument(name)
+		if err == nil {
+			return json.Unmarshal(b, v)
+		}
+		if !errors.Is(err, errStateMissing) {
+			return err
+		}
+		// Not stored yet: start from the file, if there is one, so an
+		// existing DATA_DIR carries over.
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err == nil {
+		b, err = openAtRest(b)
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeJSONFile replaces path atomically so a crash never leaves a
+// half-written file behind. Files are sealed when encryption is on.
+func writeJSONFile(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if docs, name, ok := dataDocument(path); ok {
+		return docs.WriteDocument(name, b)
+	}
+	if b, err = sealAtRest(b); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,192 @@
+// idempotency.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idempotentResponse is a captured reply replayed for retries that carry the
+// same Idempotency-Key.
+type idempotentResponse struct {
+	fingerprint string
+	done        bool
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+}
+
+// idempotentMaxBody is the largest response kept for replay. Bigger ones
+// aren't kept, and a retry runs the handler again.
+const idempotentMaxBody = 1 << 20
+
+type IdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+}
+
+var idempotency = &IdempotencyStore{entries: make(map[string]*idempotentResponse)}
+
+// begin reserves key for a request. It returns the stored entry when the key
+// has been seen before, or nil if the caller should run the handler.
+func (s *IdempotencyStore) begin(key, fingerprint string) *idempotentResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, e := range s.entries {
+		if e.done && now.After(e.expires) {
+			delete(s.entries, k)
+		}
+	}
+	if e, ok := s.entries[key]; ok {
+		snapshot := *e
+		return &snapshot
+	}
+	s.entries[key] = &idempotentResponse{fingerprint: fingerprint}
+	return nil
+}
+
+func (s *IdempotencyStore) finish(key string, rec *captureWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	// Server errors aren't cached so the client can retry them.
+	if rec.status >= 500 || rec.overflow {
+		delete(s.entries, key)
+		return
+	}
+	e.done = true
+	e.status = rec.status
+	e.header = rec.Header().Clone()
+	e.body = rec.buf.Bytes()
+	e.expires = time.Now().Add(config.IdempotencyTTL)
+}
+
+// abandon releases a key whose handler never finished, e.g. after a panic.
+func (s *IdempotencyStore) abandon(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok && !e.done {
+		delete(s.entries, key)
+	}
+}
+
+// captureWriter passes the response through while keeping a copy of up to
+// idempotentMaxBody bytes.
+type captureWriter struct {
+	http.ResponseWriter
+	status   int
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (c *captureWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if !c.overflow && c.buf.Len()+len(p) <= idempotentMaxBody {
+		c.buf.Write(p)
+	} else {
+		c.overflow = true
+		c.buf = bytes.Buffer{}
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+// requestFingerprint hashes the body, ignoring the multipart boundary, which
+// clients pick at random on every attempt.
+func requestFingerprint(contentType string, body []byte) string {
+	if media, params, err := mime.ParseMediaType(contentType); err == nil && strings.HasPrefix(media, "multipart/") && params["boundary"] != "" {
+		body = bytes.ReplaceAll(body, []byte(params["boundary"]), nil)
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyScope names who a key belongs to, so two callers sending the
+// same key neither get each other's responses nor learn the key is in use:
+// the signed-in user, or the upload session when sign-on is off, and the
+// workspace they act in. Callers with neither have no scope, and their keys
+// are ignored.
+func idempotencyScope(r *http.Request) (string, bool) {
+	caller := ownerID(currentUser(r))
+	if caller == "" {
+		sid := sessionID(nil, r)
+		if sid == "" {
+			return "", false
+		}
+		caller = "session:" + sid
+	}
+	return caller + " " + currentTeam(r).ID, true
+}
+
+// idempotent wraps a handler that creates something. A request carrying an
+// Idempotency-Key gets the first response for that key replayed instead of
+// running again; reusing a key with a different body is rejected.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		scope, ok := idempotencyScope(r)
+		if key == "" || r.Method != http.MethodPost || !ok {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxFileSize+1<<20))
+		if err != nil {
+			http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(r.Header.Get("Content-Type"), body)
+		scoped := scope + " " + r.Method + " " + r.URL.Path + " " + key
+
+		if prev := idempotency.begin(scoped, fingerprint); prev != nil {
+			switch {
+			case prev.fingerprint != fingerprint:
+				http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+			case !prev.done:
+				http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+			default:
+				for k, v := range prev.header {
+					w.Header()[k] = v
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(prev.status)
+				w.Write(prev.body)
+			}
+			return
+		}
+
+		rec := &captureWriter{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if !completed {
+				idempotency.abandon(scoped)
+			}
+		}()
+		next(rec, r)
+		completed = true
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		idempotency.finish(scoped, rec)
+	}
+}
@@ -0,0 +1,61 @@
+// idempotency_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIdempotentReplay(t *testing.T) {
+	runs := 0
+	handler := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		size := 10
+		if r.URL.Query().Get("big") != "" {
+			size = idempotentMaxBody + 1
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(strings.Repeat("x", size)))
+	})
+	post := func(url, key, session string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", url, strings.NewReader("a=1"))
+		r.Header.Set("Idempotency-Key", key)
+		if session != "" {
+			r.AddCookie(&http.Cookie{Name: uploadsCookie, Value: session})
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		return rec
+	}
+
+	tests := []struct {
+		name       string
+		url        string
+		first, try string // the upload sessions of the first request and the retry
+		replayed   bool
+	}{
+		{"same session", "/upload", "s1", "s1", true},
+		{"another session", "/upload", "s1", "s2", false},
+		// Without a session anonymous callers can't be told apart.
+		{"no session", "/upload", "", "", false},
+		{"too big to keep", "/upload?big=1", "s1", "s1", false},
+	}
+	for _, tt := range tests {
+		runs = 0
+		key := newID()
+		first := post(tt.url, key, tt.first)
+		retry := post(tt.url, key, tt.try)
+		wantRuns := 2
+		if tt.replayed {
+			wantRuns = 1
+		}
+		if runs != wantRuns || (retry.Header().Get("Idempotent-Replayed") == "true") != tt.replayed {
+			t.Errorf("%s: ran %d times, replayed %q", tt.name, runs, retry.Header().Get("Idempotent-Replayed"))
+		}
+		if retry.Code != http.StatusCreated || retry.Body.Len() != first.Body.Len() {
+			t.Errorf("%s: retry got %d with %d bytes, first %d bytes", tt.name, retry.Code, retry.Body.Len(), first.Body.Len())
+		}
+	}
+}
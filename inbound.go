@@ -0,0 +1,366 @@
+// inbound.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Email-in: a mail provider's inbound webhook (Mailgun routes, SendGrid
+// Inbound Parse, Postmark, or anything that posts the raw message) delivers
+// mail sent to the configured address to /inbound/email/<token>. CSV and
+// Excel attachments are imported into config.Inbound.Team as if uploaded by
+// the sender, who gets a reply linking to each one.
+
+const maxInboundAttachments = 10
+
+// InboundResult is what became of one attachment.
+type InboundResult struct {
+	File    string `json:"file"`
+	Dataset string `json:"dataset,omitempty"`
+	Rows    int    `json:"rows,omitempty"`
+	Link    string `json:"link,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type inboundMessage struct {
+	from        string
+	subject     string
+	attachments []inboundAttachment
+}
+
+type inboundAttachment struct {
+	name string
+	data []byte
+}
+
+func isInboundAttachment(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv", ".xlsx", ".xls":
+		return true
+	}
+	return false
+}
+
+// senderAllowed checks the sender against config.Inbound.Senders, which
+// holds addresses and "@domain" entries. An empty list lets anyone in, so
+// the token is then the only protection.
+func senderAllowed(addr string) bool {
+	if len(config.Inbound.Senders) == 0 {
+		return true
+	}
+	addr = strings.ToLower(addr)
+	for _, s := range config.Inbound.Senders {
+		s = strings.ToLower(s)
+		if addr == s || strings.HasPrefix(s, "@") && strings.HasSuffix(addr, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// readInboundMessage accepts a provider's parsed form post, a form carrying
+// the raw message (SendGrid's "email", Mailgun's "body-mime"), or a raw
+// message as the request body.
+func readInboundMessage(r *http.Request) (inboundMessage, error) {
+	var msg inboundMessage
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data", "application/x-www-form-urlencoded":
+		if mediaType == "multipart/form-data" {
+			if err := r.ParseMultipartForm(MaxFileSize); err != nil {
+				return msg, err
+			}
+		} else if err := r.ParseForm(); err != nil {
+			return msg, err
+		}
+		for _, field := range []string{"email", "body-mime"} {
+			if raw := r.FormValue(field); raw != "" {
+				return parseRawMessage(strings.NewReader(raw))
+			}
+		}
+		msg.from = r.FormValue("sender")
+		if msg.from == "" {
+			msg.from = r.FormValue("from")
+		}
+		msg.subject = r.FormValue("subject")
+		if r.MultipartForm != nil {
+			for _, files := range r.MultipartForm.File {
+				for _, fh := range files {
+					f, err := fh.Open()
+					if err != nil {
+						return msg, err
+					}
+					b, err := io.ReadAll(io.LimitReader(f, MaxFileSize+1))
+					f.Close()
+					if err != nil {
+						return msg, err
+					}
+					msg.attachments = append(msg.attachments, inboundAttachment{name: fh.Filename, data: b})
+				}
+			}
+		}
+	default:
+		return parseRawMessage(r.Body)
+	}
+	if addr, err := mail.ParseAddress(msg.from); err == nil {
+		msg.from = addr.Address
+	}
+	return msg, nil
+}
+
+// parseRawMessage reads a MIME message, collecting every part with a file
+// name.
+func parseRawMessage(raw io.Reader) (inboundMessage, error) {
+	var msg inboundMessage
+	m, err := mail.ReadMessage(raw)
+	if err != nil {
+		return msg, fmt.Errorf("not an email message: %v", err)
+	}
+	dec := new(mime.WordDecoder)
+	if addr, err := mail.ParseAddress(m.Header.Get("From")); err == nil {
+		msg.from = addr.Address
+	}
+	msg.subject = m.Header.Get("Subject")
+	if s, err := dec.DecodeHeader(msg.subject); err == nil {
+		msg.subject = s
+	}
+	err = collectAttachments(&msg, textproto.MIMEHeader(m.Header), m.Body, 0)
+	return msg, err
+}
+
+func collectAttachments(msg *inboundMessage, header textproto.MIMEHeader, body io.Reader, depth int) error {
+	mediaType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth > 8 {
+			return nil
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := collectAttachments(msg, part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	name := ""
+	if _, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		name = dparams["filename"]
+	}
+	if name == "" {
+		name = params["name"]
+	}
+	if name == "" {
+		return nil
+	}
+	if s, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = s
+	}
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	b, err := io.ReadAll(io.LimitReader(body, MaxFileSize+1))
+	if err != nil {
+		return fmt.Errorf("attachment %s: %v", name, err)
+	}
+	msg.attachments = append(msg.attachments, inboundAttachment{name: filepath.Base(name), data: b})
+	return nil
+}
+
+// ingestAttachment imports one attachment into team the way an upload with
+// default options would be, owned by from and noted as arriving via.
+func ingestAttachment(a inboundAttachment, from, team, via string) (Spreadsheet, error) {
+	if len(a.data) > MaxFileSize {
+		return Spreadsheet{}, fmt.Errorf("larger than %s", formatFileSize(MaxFileSize))
+	}
+	data, err := readSpreadsheet(a.name, bytes.NewReader(a.data))
+	if err != nil {
+		return data, err
+	}
+	sum := sha256.Sum256(a.data)
+	data.FileName = a.name
+	data.UploadTime = time.Now()
+	data.FileSize = int64(len(a.data))
+	data.Checksum = hex.EncodeToString(sum[:])
+	if err := checkRowLimit(len(data.Rows)); err != nil {
+		return data, err
+	}
+	removeRepeatedHeaders(&data)
+	data.Team = team
+
+	var overrides map[int]string
+	if t, ok := selectMapping(data, "auto"); ok {
+		if overrides, err = applyMapping(&data, t); err != nil {
+			return data, fmt.Errorf("mapping: %v", err)
+		}
+		data.Notes = append(data.Notes, fmt.Sprintf("Applied mapping template %q", t.Name))
+	}
+	data.NumericCols = applyTypeOverrides(detectNumericColumns(data), overrides)
+	if len(data.NumericCols) == 0 {
+		return data, fmt.Errorf("no numeric columns found")
+	}
+	data.Detections = append(data.Detections, columnDetections(data, overrides)...)
+	data.Notes = append(data.Notes, via)
+	data.Owner = from
+	data, err = workspace.Add(data)
+	if err != nil {
+		return data, err
+	}
+	uploadLedger.Record(data.Owner, data.FileSize)
+	go checkAlerts(data, "upload")
+	return data, nil
+}
+
+func inboundBaseURL(r *http.Request) string {
+	if config.Inbound.BaseURL != "" {
+		return strings.TrimSuffix(config.Inbound.BaseURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// inboundEmailHandler takes a message from the mail provider. It answers 200
+// once the message is understood, even if no attachment could be imported,
+// so the provider doesn't retry; the sender hears about failures by reply.
+func inboundEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := config.Inbound.Token
+	if token == "" || subtle.ConstantTimeCompare([]byte(r.PathValue("token")), []byte(token)) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	msg, err := readInboundMessage(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if msg.from == "" || !senderAllowed(msg.from) {
+		// No reply: answering unknown senders only feeds spam.
+		log.Printf("Inbound email: ignored message from %q", msg.from)
+		writeAPIError(w, http.StatusForbidden, "Sender not allowed")
+		return
+	}
+
+	base := inboundBaseURL(r)
+	var results []InboundResult
+	for _, a := range msg.attachments {
+		if !isInboundAttachment(a.name) {
+			continue
+		}
+		res := InboundResult{File: a.name}
+		if len(results) == maxInboundAttachments {
+			res.Error = fmt.Sprintf("only the first %d attachments are imported", maxInboundAttachments)
+			results = append(results, res)
+			break
+		}
+		data, err := ingestAttachment(a, msg.from, config.Inbound.Team, "Emailed in by "+msg.from)
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Dataset, res.Rows = data.ID, len(data.Rows)
+			res.Link = base + "/display?dataset=" + data.ID
+		}
+		results = append(results, res)
+	}
+	log.Printf("Inbound email from %s: %d attachment(s) processed", msg.from, len(results))
+
+	if config.SMTP.Addr != "" {
+		go func() {
+			if err := deliverEmail(msg.from, inboundReplySubject(msg.subject), "text/plain; charset=utf-8", inboundReply(results)); err != nil {
+				log.Printf("Inbound email: reply to %s failed: %v", msg.from, err)
+			}
+		}()
+	}
+	if results == nil {
+		results = []InboundResult{}
+	}
+	writeAPIData(w, r, results)
+}
+
+func inboundReplySubject(subject string) string {
+	if subject == "" {
+		return "Your spreadsheet upload"
+	}
+	if strings.HasPrefix(strings.ToLower(subject), "re:") {
+		return subject
+	}
+	return "Re: " + subject
+}
+
+func inboundReply(results []InboundResult) []byte {
+	var b bytes.Buffer
+	if len(results) == 0 {
+		b.WriteString("No CSV or Excel attachments were found in your message, so nothing was imported.\n")
+		return b.Bytes()
+	}
+	for _, res := range results {
+		if res.Error != "" {
+			fmt.Fprintf(&b, "%s was not imported: %s\n\n", res.File, res.Error)
+			continue
+		}
+		fmt.Fprintf(&b, "%s was imported (%d rows):\n%s\n\n", res.File, res.Rows, res.Link)
+	}
+	return b.Bytes()
+}
+
+// showDatasetHandler opens a stored dataset on the display page, switching
+// to its workspace, which is where links in email replies point.
+func showDatasetHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("dataset")
+	if id == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	data, scoped, ok := datasetInItsTeam(r, id)
+	if !ok {
+		http.Error(w, "Dataset not found", http.StatusNotFound)
+		return
+	}
+	if t := currentTeam(scoped); t.ID != currentTeam(r).ID {
+		http.SetCookie(w, &http.Cookie{Name: teamCookie, Value: t.ID, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	}
+	renderDisplay(w, scoped, data)
+}
+
+// datasetInItsTeam fetches dataset id if the caller belongs to its
+// workspace, and returns r scoped to that workspace. Membership is checked
+// with the caller's account role: their role in the current workspace says
+// nothing about another one.
+func datasetInItsTeam(r *http.Request, id string) (Spreadsheet, *http.Request, bool) {
+	data, ok := workspace.Get(id)
+	if !ok {
+		return Spreadsheet{}, r, false
+	}
+	u := accountUser(r)
+	t, found := teams.Get(datasetTeam(data))
+	if !found || t.RoleOf(u) == "" {
+		return Spreadsheet{}, r, false
+	}
+	return data, withTeam(r, u, t), true
+}
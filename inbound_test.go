@@ -0,0 +1,76 @@
+// inbound_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// addTestTeams puts teams and one dataset in each into the in-memory
+// stores, removing them when the test ends.
+func addTestTeams(t *testing.T, list ...Team) map[string]string {
+	t.Helper()
+	datasets := make(map[string]string)
+	teams.mu.Lock()
+	workspace.mu.Lock()
+	for _, team := range list {
+		teams.teams[team.ID] = team
+		id := newID()
+		workspace.datasets[id] = Spreadsheet{ID: id, Team: team.ID, Headers: []string{"A"}}
+		datasets[team.ID] = id
+	}
+	workspace.mu.Unlock()
+	teams.mu.Unlock()
+	t.Cleanup(func() {
+		teams.mu.Lock()
+		workspace.mu.Lock()
+		for _, team := range list {
+			delete(teams.teams, team.ID)
+			delete(workspace.datasets, datasets[team.ID])
+		}
+		workspace.mu.Unlock()
+		teams.mu.Unlock()
+	})
+	return datasets
+}
+
+// A viewer who owns a workspace of their own is admin there, which must not
+// carry over to workspaces they only view or don't belong to.
+func TestShowDatasetUsesAccountRole(t *testing.T) {
+	viewer := &User{ID: "v1", Email: "viewer@example.com", Role: RoleViewer, Via: "oidc"}
+	datasets := addTestTeams(t,
+		Team{ID: "test-own", Members: map[string]string{"viewer@example.com": RoleAdmin}},
+		Team{ID: "test-viewed", Members: map[string]string{"viewer@example.com": RoleViewer, "boss@example.com": RoleAdmin}},
+		Team{ID: "test-other", Members: map[string]string{"boss@example.com": RoleAdmin}},
+	)
+	own, _ := teams.Get("test-own")
+	r := withTeam(httptest.NewRequest("GET", "/display", nil), viewer, own)
+	if currentUser(r).Role != RoleAdmin {
+		t.Fatalf("role in own workspace is %q", currentUser(r).Role)
+	}
+
+	if _, _, ok := datasetInItsTeam(r, datasets["test-other"]); ok {
+		t.Error("opened a dataset in a workspace the user isn't in")
+	}
+	rec := httptest.NewRecorder()
+	showDatasetHandler(rec, httptest.NewRequest("GET", "/display?dataset="+datasets["test-other"], nil).WithContext(r.Context()))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("showDatasetHandler answered %d, want 404", rec.Code)
+	}
+
+	data, scoped, ok := datasetInItsTeam(r, datasets["test-viewed"])
+	if !ok || data.ID != datasets["test-viewed"] {
+		t.Fatal("couldn't open a dataset in a workspace the user views")
+	}
+	if currentTeam(scoped).ID != "test-viewed" || currentUser(scoped).Role != RoleViewer {
+		t.Errorf("scoped to %s as %s, want test-viewed as viewer", currentTeam(scoped).ID, currentUser(scoped).Role)
+	}
+
+	if _, scoped, ok := datasetInItsTeam(r, datasets["test-own"]); !ok || currentUser(scoped).Role != RoleAdmin {
+		t.Error("couldn't open a dataset in the user's own workspace as admin")
+	}
+	if _, _, ok := datasetInItsTeam(r, "missing"); ok {
+		t.Error("opened a missing dataset")
+	}
+}
@@ -0,0 +1,95 @@
+// ingest.go
+package main
+
+import "strings"
+
+// rowIngest turns records from a csv.Reader with ReuseRecord set into the
+// rows a Spreadsheet keeps. Rows are carved from shared blocks rather than
+// allocated one by one, and values of columns with few distinct values
+// (regions, statuses, yes/no) are interned, so 100k rows of "Gauteng" are
+// one string rather than 100k copies pinning 100k lines in memory. A column
+// stops being interned once it passes internLimit distinct values. The
+// column summaries (see colstats.go) are built in the same pass.
+type rowIngest struct {
+	block     []string
+	interns   []map[string]string // by column; nil once the column has too many values
+	started   []bool
+	summaries []ColumnSummary
+}
+
+const (
+	internLimit = 256
+	blockCells  = 8192
+)
+
+// Row copies record, which the reader will overwrite, into a kept row.
+func (in *rowIngest) Row(record []string) []string {
+	n := len(record)
+	if len(in.block) < n {
+		size := blockCells
+		if n > size {
+			size = n
+		}
+		in.block = make([]string, size)
+	}
+	row := in.block[:n:n]
+	in.block = in.block[n:]
+	for i, v := range record {
+		row[i], _ = in.intern(i, v)
+		in.summaries[i].AddCell(v)
+	}
+	return row
+}
+
+// Project is Row for the columns in keep only.
+func (in *rowIngest) Project(record []string, keep []int) []string {
+	n := len(keep)
+	if len(in.block) < n {
+		in.block = make([]string, blockCells+n)
+	}
+	row := in.block[:n:n]
+	in.block = in.block[n:]
+	for i, c := range keep {
+		// Not interned values are cloned so the dropped columns don't keep
+		// the whole line alive.
+		v := cellValue(record, c)
+		if s, ok := in.intern(i, v); ok {
+			row[i] = s
+		} else {
+			row[i] = strings.Clone(v)
+		}
+		in.summaries[i].AddCell(v)
+	}
+	return row
+}
+
+// intern returns the shared copy of v, or v itself and false when col is
+// past internLimit.
+func (in *rowIngest) intern(col int, v string) (string, bool) {
+	for len(in.interns) <= col {
+		in.interns = append(in.interns, nil)
+		in.started = append(in.started, false)
+		in.summaries = append(in.summaries, ColumnSummary{})
+	}
+	if !in.started[col] {
+		in.started[col] = true
+		in.interns[col] = make(map[string]string)
+	}
+	m := in.interns[col]
+	if v == "" {
+		return "", true
+	}
+	if m == nil {
+		return v, false
+	}
+	if s, ok := m[v]; ok {
+		return s, true
+	}
+	if len(m) >= internLimit {
+		in.interns[col] = nil
+		return v, false
+	}
+	s := strings.Clone(v)
+	m[s] = s
+	return s, true
+}
@@ -0,0 +1,99 @@
+// lineage.go
+package main
+
+import (
+	"strings"
+)
+
+// ColumnLineage records where a column came from: the columns it was
+// computed from and the operation that produced it.
+type ColumnLineage struct {
+	Column    string   `json:"column"`
+	Sources   []string `json:"sources,omitempty"`
+	Operation string   `json:"operation"`
+	Detail    string   `json:"detail,omitempty"`
+}
+
+// withLineage returns list with l recorded, replacing any earlier entry for
+// the same column. The original slice is left untouched.
+func withLineage(list []ColumnLineage, l ColumnLineage) []ColumnLineage {
+	out := make([]ColumnLineage, 0, len(list)+1)
+	for _, e := range list {
+		if e.Column != l.Column {
+			out = append(out, e)
+		}
+	}
+	return append(out, l)
+}
+
+// renameLineage follows a column rename, so computed columns keep their
+// history and plain source columns remember their original name.
+func renameLineage(list []ColumnLineage, from, to string) []ColumnLineage {
+	if from == to {
+		return list
+	}
+	for _, e := range list {
+		if e.Column == from {
+			e.Column = to
+			e.Detail = strings.TrimPrefix(e.Detail+"; renamed from "+from, "; ")
+			return withLineage(list, e)
+		}
+	}
+	return withLineage(list, ColumnLineage{Column: to, Sources: []string{from}, Operation: "rename"})
+}
+
+// lineageFor returns lineage for every column of data. Columns without a
+// recorded history come straight from the source file.
+func lineageFor(data Spreadsheet) []ColumnLineage {
+	recorded := make(map[string]ColumnLineage, len(data.Lineage))
+	for _, e := range data.Lineage {
+		recorded[e.Column] = e
+	}
+	out := make([]ColumnLineage, len(data.Headers))
+	for i, h := range data.Headers {
+		if e, ok := recorded[h]; ok {
+			out[i] = e
+			continue
+		}
+		out[i] = ColumnLineage{Column: h, Sources: []string{h}, Operation: "source", Detail: data.FileName}
+	}
+	return out
+}
+
+func resultsLineage(page ResultPage) []ColumnLineage {
+	var cols []string
+	for _, res := range page.Results {
+		cols = append(cols, res.Col)
+	}
+	headers, _ := resultsTable(page)
+	return []ColumnLineage{
+		{Column: headers[0], Operation: "label", Detail: "source column name"},
+		{Column: headers[1], Sources: cols, Operation: page.OpName, Detail: page.Params},
+	}
+}
+
+var dictionaryHeaders = []string{"Column", "Type", "Derived From", "Operation", "Detail", "Note"}
+
+func dictionaryRow(l ColumnLineage, typ, note string) []string {
+	return []string{l.Column, typ, strings.Join(l.Sources, ", "), l.Operation, l.Detail, note}
+}
+
+// dataDictionary describes each column of data: its type, lineage and any
+// annotation.
+func dataDictionary(data Spreadsheet) ([]string, [][]string) {
+	profile := profileFor(data)
+	lineage := lineageFor(data)
+	rows := make([][]string, len(lineage))
+	for i, l := range lineage {
+		rows[i] = dictionaryRow(l, profile.Columns[i].Type, profile.Columns[i].Note)
+	}
+	return dictionaryHeaders, rows
+}
+
+func resultsDictionary(page ResultPage) ([]string, [][]string) {
+	lineage := resultsLineage(page)
+	return dictionaryHeaders, [][]string{
+		dictionaryRow(lineage[0], "text", ""),
+		dictionaryRow(lineage[1], "numeric", ""),
+	}
+}
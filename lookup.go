@@ -0,0 +1,289 @@
+// lookup.go
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxLookupEntries  = 10000
+	maxLookupFileSize = 1 << 20
+)
+
+// LookupTable maps codes to the values that replace or enrich them.
+type LookupTable struct {
+	Keys       []string // in pasted order
+	Values     map[string]string
+	IgnoreCase bool
+}
+
+func (t LookupTable) key(v string) string {
+	if t.IgnoreCase {
+		return strings.ToLower(v)
+	}
+	return v
+}
+
+func (t LookupTable) Lookup(v string) (string, bool) {
+	mapped, ok := t.Values[t.key(v)]
+	return mapped, ok
+}
+
+// Text renders the table as tab-separated lines, the form it is pasted in.
+func (t LookupTable) Text() string {
+	var b strings.Builder
+	for _, k := range t.Keys {
+		fmt.Fprintf(&b, "%s\t%s\n", k, t.Values[t.key(k)])
+	}
+	return b.String()
+}
+
+// parseLookupTable reads one code and value per line, separated by a tab,
+// "=" or a comma (CSV quoting is honoured). Blank lines are skipped and so is
+// the first line when header is set.
+func parseLookupTable(text string, header, ignoreCase bool) (LookupTable, error) {
+	t := LookupTable{Values: make(map[string]string), IgnoreCase: ignoreCase}
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	skipped := !header
+	for n, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if !skipped {
+			skipped = true
+			continue
+		}
+		var code, value string
+		switch {
+		case strings.Contains(line, "\t"):
+			code, value, _ = strings.Cut(line, "\t")
+		case strings.Contains(line, "=") && !strings.Contains(line, ","):
+			code, value, _ = strings.Cut(line, "=")
+		default:
+			fields, err := csv.NewReader(strings.NewReader(line)).Read()
+			if err != nil || len(fields) < 2 {
+				return t, fmt.Errorf("line %d: expected a code and a value, got %q", n+1, line)
+			}
+			code, value = fields[0], fields[1]
+		}
+		code, value = strings.TrimSpace(code), strings.TrimSpace(value)
+		if code == "" {
+			return t, fmt.Errorf("line %d has no code", n+1)
+		}
+		if prev, ok := t.Lookup(code); ok {
+			if prev != value {
+				return t, fmt.Errorf("%q maps to both %q and %q", code, prev, value)
+			}
+			continue
+		}
+		if len(t.Keys) == maxLookupEntries {
+			return t, fmt.Errorf("lookup tables are limited to %d entries", maxLookupEntries)
+		}
+		t.Keys = append(t.Keys, code)
+		t.Values[t.key(code)] = value
+	}
+	if len(t.Keys) == 0 {
+		return t, fmt.Errorf("the mapping is empty; paste one code and value per line")
+	}
+	return t, nil
+}
+
+// unmappedValues counts the distinct values in col that the table doesn't
+// cover, most frequent first.
+func unmappedValues(data Spreadsheet, col int, t LookupTable) ([]TextCount, int) {
+	counts := make(map[string]int)
+	mapped := 0
+	for _, row := range data.Rows {
+		v := cellValue(row, col)
+		if v == "" {
+			continue
+		}
+		if _, ok := t.Lookup(v); ok {
+			mapped++
+		} else {
+			counts[v]++
+		}
+	}
+	return topCounts(counts, len(counts)), mapped
+}
+
+// applyLookup maps col through t. With into empty the column is recoded in
+// place and unmapped values are kept; otherwise a new column named into is
+// added and unmapped rows are left blank.
+func applyLookup(data *Spreadsheet, col int, t LookupTable, into string) (int, error) {
+	source := data.Headers[col]
+	target := col
+	if into != "" {
+		if columnIndex(data.Headers, into) != -1 {
+			return 0, fmt.Errorf("column %q already exists", into)
+		}
+		target = len(data.Headers)
+		data.ColumnIDs = append(append([]string(nil), data.ColumnIDs...), nextColumnID(*data))
+		data.Headers = append(append([]string(nil), data.Headers...), into)
+	}
+	width := len(data.Headers)
+	rows := make([][]string, len(data.Rows))
+	mapped := 0
+	for i, row := range data.Rows {
+		out := make([]string, width)
+		copy(out, row)
+		v := cellValue(row, col)
+		if m, ok := t.Lookup(v); ok {
+			out[target] = m
+			mapped++
+		} else if target != col {
+			out[target] = ""
+		}
+		rows[i] = out
+	}
+	name := data.Headers[target]
+	data.Rows = rows
+	data.NumericCols = detectNumericColumns(*data)
+	data.Lineage = withLineage(data.Lineage, ColumnLineage{Column: name, Sources: []string{source}, Operation: "lookup",
+		Detail: fmt.Sprintf("%d-entry lookup table", len(t.Keys))})
+	mode := "replace"
+	if into != "" {
+		mode = "add"
+	}
+	data.Pipeline = appendStep(data.Pipeline, "lookup", map[string]string{
+		"column":  source,
+		"into":    name,
+		"mode":    mode,
+		"entries": strconv.Itoa(len(t.Keys)),
+	})
+	return mapped, nil
+}
+
+// lookupHandler recodes a column through a pasted or uploaded two-column
+// mapping. The first submission previews the result and lists the values the
+// mapping misses; "apply" changes the dataset.
+func lookupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseMultipartForm(maxLookupFileSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	data, ok := teamDataset(r, r.FormValue("dataset"))
+	if !ok {
+		http.Error(w, "Unknown dataset", http.StatusNotFound)
+		return
+	}
+	col := columnRef(data, r.FormValue("column"))
+	if col == -1 {
+		http.Error(w, "Unknown column", http.StatusBadRequest)
+		return
+	}
+	text := r.FormValue("mapping")
+	if file, _, err := r.FormFile("mapping_file"); err == nil {
+		defer file.Close()
+		b, err := io.ReadAll(io.LimitReader(file, maxLookupFileSize+1))
+		if err != nil || len(b) > maxLookupFileSize {
+			http.Error(w, "The mapping file must be under 1 MB", http.StatusBadRequest)
+			return
+		}
+		text = string(b)
+	}
+	header, ignoreCase := r.FormValue("header") == "1", r.FormValue("ignore_case") == "1"
+	table, err := parseLookupTable(text, header, ignoreCase)
+	if err != nil {
+		http.Error(w, "Mapping error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	into := ""
+	if r.FormValue("mode") == "add" {
+		if into = strings.TrimSpace(r.FormValue("into")); into == "" {
+			into = data.Headers[col] + " (mapped)"
+		}
+	}
+	unmapped, mapped := unmappedValues(data, col, table)
+
+	if r.FormValue("action") == "apply" {
+		if err := checkVersion(r, data); err != nil {
+			http.Error(w, err.Error(), updateErrorStatus(w, err))
+			return
+		}
+		if _, err := applyLookup(&data, col, table, into); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		note := fmt.Sprintf("Mapped %q through a %d-entry lookup (%d row(s) mapped", data.Headers[col], len(table.Keys), mapped)
+		if len(unmapped) > 0 {
+			note += fmt.Sprintf(", %d distinct value(s) unmapped", len(unmapped))
+		}
+		data.Notes = append(data.Notes, note+")")
+		if err := workspace.Update(&data); err != nil {
+			http.Error(w, err.Error(), updateErrorStatus(w, err))
+			return
+		}
+		renderDisplay(w, r, data)
+		return
+	}
+
+	unmappedRows := 0
+	for _, u := range unmapped {
+		unmappedRows += u.Count
+	}
+	outcome := fmt.Sprintf("%s will be recoded in place; unmapped values are kept as they are.", data.Headers[col])
+	if into != "" {
+		outcome = fmt.Sprintf("%s will be added next to %s; unmapped rows are left blank.", into, data.Headers[col])
+	}
+	summary := ReportSection{Title: "Summary", Notes: []string{
+		fmt.Sprintf("The mapping has %d entries and covers %d of %d non-blank row(s).", len(table.Keys), mapped, mapped+unmappedRows),
+		outcome,
+	}}
+	if into != "" && columnIndex(data.Headers, into) != -1 {
+		summary.Notes = append(summary.Notes, fmt.Sprintf("⚠️ A column named %q already exists; choose another name to add it.", into))
+	}
+	modeOptions := []FormOption{{Value: "replace", Label: "Replace values in " + data.Headers[col]}, {Value: "add", Label: "Add a new column"}}
+	if into != "" {
+		modeOptions[1].Selected = true
+	} else {
+		modeOptions[0].Selected = true
+	}
+	summary.Form = &ReportForm{Action: "/lookup", Submit: "✅ Apply Mapping", Fields: []FormField{
+		{Name: "dataset", Type: "hidden", Value: data.ID},
+		{Name: "version", Type: "hidden", Value: strconv.Itoa(data.Version)},
+		{Name: "column", Type: "hidden", Value: r.FormValue("column")},
+		{Name: "action", Type: "hidden", Value: "apply"},
+		{Name: "mapping", Label: "Mapping (code, tab, value)", Type: "textarea", Value: table.Text()},
+		{Name: "ignore_case", Label: "Ignore case when matching codes", Type: "checkbox", Checked: ignoreCase},
+		{Name: "mode", Label: "Apply as", Type: "select", Options: modeOptions},
+		{Name: "into", Label: "New column name", Value: into, Placeholder: data.Headers[col] + " (mapped)"},
+	}}
+
+	gaps := ReportSection{Title: "Unmapped Values", Headers: []string{data.Headers[col], "Rows"}}
+	for _, u := range unmapped {
+		gaps.Rows = append(gaps.Rows, []string{u.Text, strconv.Itoa(u.Count)})
+	}
+	if len(gaps.Rows) == 0 {
+		gaps.Notes = []string{"✅ Every value is covered by the mapping."}
+	} else {
+		gaps.Notes = []string{fmt.Sprintf("⚠️ %d distinct value(s) in %d row(s) have no entry.", len(unmapped), unmappedRows)}
+	}
+
+	used := make(map[string]int)
+	for _, row := range data.Rows {
+		if v := cellValue(row, col); v != "" {
+			if _, ok := table.Lookup(v); ok {
+				used[table.key(v)]++
+			}
+		}
+	}
+	entries := ReportSection{Title: "Mapping", Headers: []string{"Code", "Value", "Rows"}}
+	keys := append([]string(nil), table.Keys...)
+	sort.SliceStable(keys, func(i, j int) bool { return used[table.key(keys[i])] > used[table.key(keys[j])] })
+	for _, k := range keys {
+		entries.Rows = append(entries.Rows, []string{k, table.Values[table.key(k)], strconv.Itoa(used[table.key(k)])})
+	}
+	renderReport(w, ReportPage{Title: "Lookup for " + data.Headers[col], Subtitle: data.FileName, Sections: []ReportSection{summary, gaps, entries}})
+}
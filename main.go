@@ -17,11 +17,126 @@ func main() {
 
 	// App endpoints
 	http.HandleFunc("/", uploadHandler)
-	http.HandleFunc("/display", displayHandler)
-	http.HandleFunc("/calculate", calculateHandler)
+	http.HandleFunc("/display", limited("display", requireRole(RoleEditor, idempotent(displayHandler))))
+	http.HandleFunc("GET /display", limited("display", showDatasetHandler))
+	http.HandleFunc("GET /display/rows", limited("display", displayRowsHandler))
+	http.HandleFunc("GET /display/profile", limited("display", displayProfileHandler))
+	http.HandleFunc("/calculate", limited("calculate", calculateHandler))
+	http.HandleFunc("/duplicates", limited("duplicates", duplicatesHandler))
+	http.HandleFunc("GET /forecast", limited("forecast", forecastHandler))
+	http.HandleFunc("GET /decompose", limited("forecast", decomposeHandler))
+	http.HandleFunc("GET /cohorts", limited("cohorts", cohortHandler))
+	http.HandleFunc("GET /crosstab", limited("crosstab", crosstabHandler))
+	http.HandleFunc("GET /text", limited("text", textStatsHandler))
+	http.HandleFunc("GET /geo", limited("geo", geoHandler))
+	http.HandleFunc("/extract", limited("extract", requireRoleToModify(RoleEditor, extractHandler)))
+	http.HandleFunc("/replace", limited("display", requireRole(RoleEditor, idempotent(replaceHandler))))
+	http.HandleFunc("/lookup", limited("lookup", requireRole(RoleEditor, lookupHandler)))
+	http.HandleFunc("/convert", limited("convert", requireRole(RoleEditor, convertHandler)))
+	http.HandleFunc("/window", limited("window", requireRole(RoleEditor, windowHandler)))
+	http.HandleFunc("/quality", limited("quality", requireRoleToModify(RoleEditor, qualityHandler)))
+	http.HandleFunc("/rules", limited("quality", requireRoleToModify(RoleEditor, rulesHandler)))
+	http.HandleFunc("/sort", limited("sort", requireRole(RoleEditor, sortHandler)))
+	http.HandleFunc("/slice", limited("slice", requireRole(RoleEditor, sliceHandler)))
+	http.HandleFunc("/reshape", limited("slice", requireRole(RoleEditor, reshapeHandler)))
+	http.HandleFunc("/export", limited("export", exportHandler))
+	http.HandleFunc("/annotations", limited("annotations", requireRole(RoleEditor, annotateHandler)))
+	http.HandleFunc("/interpret", limited("interpret", requireRole(RoleEditor, interpretHandler)))
+	http.HandleFunc("/mappings", limited("mappings", requireRoleToModify(RoleEditor, mappingsHandler)))
 	http.HandleFunc("/api/validate", validateFileHandler)
+	http.HandleFunc("/api/operations", operationsAPIHandler)
+	http.HandleFunc("POST /api/v1/upload", limited("display", requireRole(RoleEditor, idempotent(uploadAPIHandler))))
+	http.HandleFunc("POST /api/v1/calculate", limited("calculate", calculateAPIHandler))
+	http.HandleFunc("GET /api/v1/results/{id}/export", limited("export", resultsExportAPIHandler))
+	http.HandleFunc("/api/v1/analyze", limited("analyze", idempotent(analyzeAPIHandler)))
+	http.HandleFunc("GET /api/v1/datasets", limited("datasets", listDatasetsAPIHandler))
+	http.HandleFunc("GET /api/v1/datasets/{id}", limited("datasets", datasetAPIHandler))
+	http.HandleFunc("DELETE /api/v1/datasets/{id}", limited("datasets", requireRole(RoleAdmin, deleteDatasetAPIHandler)))
+	http.HandleFunc("GET /api/v1/trash", limited("datasets", trashAPIHandler))
+	http.HandleFunc("POST /api/v1/trash/{id}/restore", limited("datasets", requireRole(RoleEditor, restoreAPIHandler)))
+	http.HandleFunc("DELETE /api/v1/trash/{id}", limited("datasets", requireRole(RoleAdmin, purgeAPIHandler)))
+	http.HandleFunc("POST /api/v1/datasets/{id}/replace", limited("display", requireRole(RoleEditor, idempotent(replaceDatasetAPIHandler))))
+	http.HandleFunc("GET /api/v1/datasets/{id}/rows", limited("datasets", datasetRowsAPIHandler))
+	http.HandleFunc("GET /api/v1/datasets/{id}/stream", limited("stream", datasetStreamAPIHandler))
+	http.HandleFunc("GET /api/v1/datasets/{id}/arrow", limited("export", datasetArrowAPIHandler))
+	http.HandleFunc("GET /api/v1/datasets/{id}/sqlite", limited("export", datasetSQLiteAPIHandler))
+	http.HandleFunc("GET /api/v1/datasets/{id}/columns/{name}/stats", limited("datasets", columnStatsAPIHandler))
+	http.HandleFunc("GET /api/v1/datasets/{id}/access", limited("datasets", accessLogAPIHandler))
+	http.HandleFunc("GET /api/v1/datasets/{id}/annotations", limited("datasets", annotationsAPIHandler))
+	http.HandleFunc("PUT /api/v1/datasets/{id}/annotations", limited("datasets", requireRole(RoleEditor, putAnnotationsAPIHandler)))
+	http.HandleFunc("POST /api/v1/mappings/{name}/dry-run", mappingDryRunAPIHandler)
+	http.HandleFunc("/api/v1/ask", limited("analyze", askAPIHandler))
+	http.HandleFunc("POST /api/v1/preview", limited("preview", requireRole(RoleEditor, previewAPIHandler)))
+	http.HandleFunc("POST /api/v1/validate/batch", limited("validate", batchValidateAPIHandler))
+	http.HandleFunc("/api/v1/workspaces", workspacesAPIHandler)
+	http.HandleFunc("GET /api/v1/workspaces/{ws}/datasets", limited("datasets", inTeam(listDatasetsAPIHandler)))
+	http.HandleFunc("GET /api/v1/workspaces/{ws}/datasets/{id}", limited("datasets", inTeam(datasetAPIHandler)))
+	http.HandleFunc("DELETE /api/v1/workspaces/{ws}/datasets/{id}", limited("datasets", inTeam(requireRole(RoleAdmin, deleteDatasetAPIHandler))))
+	http.HandleFunc("POST /api/v1/workspaces/{ws}/datasets/{id}/replace", limited("display", inTeam(requireRole(RoleEditor, idempotent(replaceDatasetAPIHandler)))))
+	http.HandleFunc("GET /api/v1/workspaces/{ws}/datasets/{id}/rows", limited("datasets", inTeam(datasetRowsAPIHandler)))
+	http.HandleFunc("GET /api/v1/workspaces/{ws}/datasets/{id}/stream", limited("stream", inTeam(datasetStreamAPIHandler)))
+	http.HandleFunc("GET /api/v1/workspaces/{ws}/datasets/{id}/arrow", limited("export", inTeam(datasetArrowAPIHandler)))
+	http.HandleFunc("GET /api/v1/workspaces/{ws}/datasets/{id}/sqlite", limited("export", inTeam(datasetSQLiteAPIHandler)))
+	http.HandleFunc("GET /api/v1/workspaces/{ws}/datasets/{id}/columns/{name}/stats", limited("datasets", inTeam(columnStatsAPIHandler)))
+	http.HandleFunc("GET /api/v1/workspaces/{ws}/datasets/{id}/access", limited("datasets", inTeam(accessLogAPIHandler)))
+	http.HandleFunc("GET /api/v1/workspaces/{ws}/datasets/{id}/annotations", limited("datasets", inTeam(annotationsAPIHandler)))
+	http.HandleFunc("PUT /api/v1/workspaces/{ws}/datasets/{id}/annotations", limited("datasets", inTeam(requireRole(RoleEditor, putAnnotationsAPIHandler))))
+	http.HandleFunc("GET /api/v1/workspaces/{ws}/trash", limited("datasets", inTeam(trashAPIHandler)))
+	http.HandleFunc("POST /api/v1/workspaces/{ws}/trash/{id}/restore", limited("datasets", inTeam(requireRole(RoleEditor, restoreAPIHandler))))
+	http.HandleFunc("DELETE /api/v1/workspaces/{ws}/trash/{id}", limited("datasets", inTeam(requireRole(RoleAdmin, purgeAPIHandler))))
+	http.HandleFunc("POST /api/v1/workspaces/{ws}/mappings/{name}/dry-run", inTeam(mappingDryRunAPIHandler))
+	http.HandleFunc("POST /api/v1/workspaces/{ws}/analyze", limited("analyze", inTeam(idempotent(analyzeAPIHandler))))
+	http.HandleFunc("/api/v1/workspaces/{ws}/ask", limited("analyze", inTeam(askAPIHandler)))
+	http.HandleFunc("POST /api/v1/workspaces/{ws}/validate/batch", limited("validate", inTeam(batchValidateAPIHandler)))
+	http.HandleFunc("/workspaces", teamsHandler)
+	http.HandleFunc("/dashboards", requireRoleToModify(RoleEditor, dashboardsHandler))
+	http.HandleFunc("/dashboards/{id}", requireRoleToModify(RoleEditor, dashboardHandler))
+	http.HandleFunc("POST /dashboards/pin", requireRole(RoleEditor, pinHandler))
+	http.HandleFunc("GET /shared/dashboards/{token}", limited("shared", sharedDashboardHandler))
+	http.HandleFunc("/shares", requireRoleToModify(RoleEditor, shareLinksHandler))
+	http.HandleFunc("GET /shared/datasets/{token}", limited("shared", sharedDatasetHandler))
+	http.HandleFunc("GET /shared/datasets/{token}/export", limited("export", sharedExportHandler))
+	http.HandleFunc("GET /shared/datasets/{token}/calculate", limited("shared", sharedCalculateHandler))
+	http.HandleFunc("GET /api/v1/shared/{token}", limited("shared", viaShareLink(datasetAPIHandler)))
+	http.HandleFunc("GET /api/v1/shared/{token}/rows", limited("shared", viaShareLink(datasetRowsAPIHandler)))
+	http.HandleFunc("GET /api/v1/shared/{token}/stream", limited("stream", viaShareLink(datasetStreamAPIHandler)))
+	http.HandleFunc("GET /api/v1/shared/{token}/arrow", limited("export", viaShareLink(datasetArrowAPIHandler)))
+	http.HandleFunc("GET /api/v1/shared/{token}/sqlite", limited("export", viaShareLink(datasetSQLiteAPIHandler)))
+	http.HandleFunc("GET /api/v1/shared/{token}/columns/{name}/stats", limited("shared", viaShareLink(columnStatsAPIHandler)))
+	http.HandleFunc("GET /api/v1/shared/{token}/calculate", limited("shared", viaShareLink(sharedCalculateAPIHandler)))
+	http.HandleFunc("/reports", requireRoleToModify(RoleEditor, reportsHandler))
+	http.HandleFunc("GET /reports/history", reportHistoryHandler)
+	http.HandleFunc("GET /reports/compare", reportCompareHandler)
+	http.HandleFunc("/alerts", requireRoleToModify(RoleEditor, alertsHandler))
+	http.HandleFunc("GET /alerts/history", alertHistoryHandler)
+	http.HandleFunc("/trash", requireRoleToModify(RoleEditor, trashHandler))
+	http.HandleFunc("GET /datasets/{id}/access", accessLogHandler)
+	http.HandleFunc("/api/v1/me", meAPIHandler)
+	http.HandleFunc("/api/v1/usage", usageAPIHandler)
+	http.HandleFunc("/admin/api-keys", requireRole(RoleAdmin, apiKeysHandler))
+	http.HandleFunc("/admin/bench", limited("bench", requireRole(RoleAdmin, benchHandler)))
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/auth/callback", oidcCallbackHandler)
+	http.HandleFunc("/logout", logoutHandler)
+	http.HandleFunc("POST /inbound/email/{token}", limited("inbound", inboundEmailHandler))
+	http.HandleFunc("POST /integrations/slack", limited("chat", slackCommandHandler))
+	http.HandleFunc("POST /integrations/teams", limited("chat", teamsWebhookHandler))
+	http.HandleFunc("GET /api/v1/automation/me", limited("automation", requireAPIKey(RoleViewer, automationMeAPIHandler)))
+	http.HandleFunc("POST /api/v1/automation/upload", limited("automation", requireAPIKey(RoleEditor, automationUploadAPIHandler)))
+	http.HandleFunc("GET /api/v1/automation/presets", limited("automation", requireAPIKey(RoleViewer, automationPresetsAPIHandler)))
+	http.HandleFunc("POST /api/v1/automation/presets/{preset}/run", limited("automation", requireAPIKey(RoleEditor, automationRunAPIHandler)))
+	http.HandleFunc("GET /api/v1/automation/presets/{preset}/latest", limited("automation", requireAPIKey(RoleViewer, automationLatestAPIHandler)))
+	http.HandleFunc("GET /api/v1/automation/results", limited("automation", requireAPIKey(RoleViewer, automationResultsAPIHandler)))
 	http.HandleFunc("/health", healthHandler)
 
-	fmt.Println("🚀 Server running on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
-}
\ No newline at end of file
+	go runSchedules()
+	if pg, ok := state.(*postgresState); ok {
+		go pg.cleanup()
+	}
+	if config.Watch.Dir != "" && config.Watch.Template != "" {
+		go runWatchFolder()
+	}
+
+	fmt.Printf("🚀 Server running on http://localhost%s\n", config.Addr)
+	log.Fatal(http.ListenAndServe(config.Addr, ipFilter(authenticate(http.DefaultServeMux))))
+}
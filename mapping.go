@@ -0,0 +1,470 @@
+// mapping.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MappingTemplate describes how to read a recurring file layout. It is
+// applied automatically when an upload's headers match MatchHeaders.
+type MappingTemplate struct {
+	Name          string              `json:"name"`
+	Team          string              `json:"team,omitempty"`
+	MatchHeaders  []string            `json:"match_headers"`
+	SkipRows      int                 `json:"skip_rows,omitempty"`
+	Rename        map[string]string   `json:"rename,omitempty"`
+	Aliases       map[string][]string `json:"aliases,omitempty"`        // template column -> names other files use for it
+	TypeOverrides map[string]string   `json:"type_overrides,omitempty"` // numeric, text or date
+	NullMarkers   []string            `json:"null_markers,omitempty"`
+	DateFormats   map[string]string   `json:"date_formats,omitempty"`
+	Rules         []ValidationRule    `json:"rules,omitempty"` // copied onto matching uploads
+	CreatedAt     time.Time           `json:"created_at"`
+}
+
+type MappingStore struct {
+	mu        sync.RWMutex
+	path      string
+	templates map[string]MappingTemplate
+}
+
+var mappings = newMappingStore(dataPath("mappings.json"))
+
+func newMappingStore(path string) *MappingStore {
+	s := &MappingStore{path: path, templates: make(map[string]MappingTemplate)}
+	s.load()
+	watchDataFile(path, s.load)
+	return s
+}
+
+// load reads the templates file, replacing what is in memory.
+func (s *MappingStore) load() {
+	var list []MappingTemplate
+	if err := readJSONFile(s.path, &list); err != nil {
+		log.Printf("Could not load mapping templates: %v", err)
+		return
+	}
+	templates := make(map[string]MappingTemplate)
+	for _, t := range list {
+		if t.Team == "" {
+			t.Team = defaultTeamID
+		}
+		templates[templateKey(t.Team, t.Name)] = t
+	}
+	s.mu.Lock()
+	s.templates = templates
+	s.mu.Unlock()
+}
+
+// Templates are scoped to a workspace, so two teams can use the same name.
+func templateKey(team, name string) string {
+	return team + "/" + name
+}
+
+func (s *MappingStore) List(team string) []MappingTemplate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]MappingTemplate, 0, len(s.templates))
+	for _, t := range s.templates {
+		if t.Team == team {
+			list = append(list, t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (s *MappingStore) Get(team, name string) (MappingTemplate, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.templates[templateKey(team, name)]
+	return t, ok
+}
+
+func (s *MappingStore) Save(t MappingTemplate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.templates[templateKey(t.Team, t.Name)] = t
+	return s.flush()
+}
+
+func (s *MappingStore) Delete(team, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.templates, templateKey(team, name))
+	return s.flush()
+}
+
+// flush must be called with the lock held.
+func (s *MappingStore) flush() error {
+	list := make([]MappingTemplate, 0, len(s.templates))
+	for _, t := range s.templates {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return templateKey(list[i].Team, list[i].Name) < templateKey(list[j].Team, list[j].Name)
+	})
+	return writeJSONFile(s.path, list)
+}
+
+func headerKey(h string) string {
+	return strings.ToLower(strings.TrimSpace(h))
+}
+
+// Matches reports whether data, after skipping the template's leading rows,
+// has exactly the template's headers (ignoring case and surrounding space),
+// allowing any header to be one of the column's aliases.
+func (t MappingTemplate) Matches(data Spreadsheet) bool {
+	headers := data.Headers
+	if t.SkipRows > 0 {
+		if t.SkipRows >= len(data.Rows)+1 {
+			return false
+		}
+		headers = dedupeHeaders(normalizeHeaders(data.Rows[t.SkipRows-1]))
+	}
+	if len(headers) != len(t.MatchHeaders) {
+		return false
+	}
+	for i := range headers {
+		if h, _ := t.canonicalHeader(headers[i]); headerKey(h) != headerKey(t.MatchHeaders[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// findMatchingTemplate returns the first stored template whose layout
+// matches the upload.
+func findMatchingTemplate(data Spreadsheet) (MappingTemplate, bool) {
+	for _, t := range mappings.List(datasetTeam(data)) {
+		if t.Matches(data) {
+			return t, true
+		}
+	}
+	return MappingTemplate{}, false
+}
+
+// selectMapping picks the template named by the upload form: "none" turns
+// mapping off, an empty value or "auto" picks the first matching template.
+func selectMapping(data Spreadsheet, choice string) (MappingTemplate, bool) {
+	switch choice {
+	case "none":
+		return MappingTemplate{}, false
+	case "", "auto":
+		return findMatchingTemplate(data)
+	}
+	return mappings.Get(datasetTeam(data), choice)
+}
+
+// applyMapping rewrites data according to t and returns the column type
+// overrides by index for numeric detection to honour.
+func applyMapping(data *Spreadsheet, t MappingTemplate) (map[int]string, error) {
+	// Any cell may change; the column summaries are made again when needed.
+	data.summaries = nil
+	if t.SkipRows > 0 {
+		if t.SkipRows > len(data.Rows) {
+			return nil, fmt.Errorf("template %q skips %d rows but the file has only %d", t.Name, t.SkipRows, len(data.Rows)+1)
+		}
+		data.Headers = dedupeHeaders(normalizeHeaders(data.Rows[t.SkipRows-1]))
+		data.Rows = data.Rows[t.SkipRows:]
+		removeRepeatedHeaders(data)
+	}
+	applyAliases(data, t)
+	data.Rules = t.Rules
+
+	nulls := make(map[string]bool, len(t.NullMarkers))
+	for _, m := range t.NullMarkers {
+		nulls[strings.ToLower(strings.TrimSpace(m))] = true
+	}
+
+	layouts := make(map[int]string)
+	for col, format := range t.DateFormats {
+		idx := columnIndex(data.Headers, col)
+		if idx == -1 {
+			return nil, fmt.Errorf("template %q: unknown date column %q", t.Name, col)
+		}
+		layouts[idx] = goDateLayout(format)
+	}
+
+	for _, row := range data.Rows {
+		for c := range row {
+			val := strings.TrimSpace(row[c])
+			if nulls[strings.ToLower(val)] {
+				row[c] = ""
+				continue
+			}
+			if layout, ok := layouts[c]; ok && val != "" {
+				if d, err := time.Parse(layout, val); err == nil {
+					row[c] = d.Format("2006-01-02")
+				}
+			}
+		}
+	}
+
+	overrides := make(map[int]string)
+	for col, typ := range t.TypeOverrides {
+		idx := columnIndex(data.Headers, col)
+		if idx == -1 {
+			return nil, fmt.Errorf("template %q: unknown column %q", t.Name, col)
+		}
+		overrides[idx] = typ
+	}
+
+	for from, to := range t.Rename {
+		if idx := columnIndex(data.Headers, from); idx != -1 && strings.TrimSpace(to) != "" {
+			data.Lineage = renameLineage(data.Lineage, data.Headers[idx], strings.TrimSpace(to))
+			data.Headers[idx] = strings.TrimSpace(to)
+		}
+	}
+	return overrides, nil
+}
+
+func applyTypeOverrides(numericCols []int, overrides map[int]string) []int {
+	if len(overrides) == 0 {
+		return numericCols
+	}
+	set := make(map[int]bool)
+	for _, col := range numericCols {
+		set[col] = true
+	}
+	for col, typ := range overrides {
+		switch typ {
+		case "numeric":
+			set[col] = true
+		case "text", "date":
+			delete(set, col)
+		}
+	}
+	cols := make([]int, 0, len(set))
+	for col := range set {
+		cols = append(cols, col)
+	}
+	sort.Ints(cols)
+	return cols
+}
+
+var dateTokenReplacer = strings.NewReplacer(
+	"yyyy", "2006", "yy", "06",
+	"mmmm", "January", "mmm", "Jan", "mm", "01",
+	"dd", "02",
+)
+
+// goDateLayout accepts either a Go layout or a spreadsheet-style pattern
+// such as dd/mm/yyyy.
+func goDateLayout(format string) string {
+	if strings.Contains(format, "2006") {
+		return format
+	}
+	return dateTokenReplacer.Replace(strings.ToLower(format))
+}
+
+// parseKeyValueLines reads "key = value" pairs, one per line.
+func parseKeyValueLines(text string) map[string]string {
+	out := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if key != "" {
+			out[key] = value
+		}
+	}
+	return out
+}
+
+func formatKeyValueLines(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s = %s\n", k, m[k])
+	}
+	return b.String()
+}
+
+func splitList(text string) []string {
+	var out []string
+	for _, part := range strings.Split(text, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func mappingsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderMappings(w, currentTeam(r).ID, r.URL.Query().Get("name"), activeDataset(r).Headers)
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			http.Error(w, "Template name is required", http.StatusBadRequest)
+			return
+		}
+		if r.FormValue("dry_run") == "1" {
+			t, ok := mappings.Get(currentTeam(r).ID, name)
+			if !ok {
+				http.Error(w, "Unknown template", http.StatusNotFound)
+				return
+			}
+			renderDryRun(w, dryRunAliases(t, splitList(r.FormValue("headers"))))
+			return
+		}
+		if r.FormValue("delete") == "1" {
+			if err := mappings.Delete(currentTeam(r).ID, name); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to delete template: %v", err), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/mappings", http.StatusSeeOther)
+			return
+		}
+
+		rules, err := parseRuleLines(r.FormValue("rules"), nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		skip, _ := strconv.Atoi(r.FormValue("skip_rows"))
+		if skip < 0 {
+			skip = 0
+		}
+		t := MappingTemplate{
+			Name:          name,
+			Team:          currentTeam(r).ID,
+			MatchHeaders:  splitList(r.FormValue("match_headers")),
+			SkipRows:      skip,
+			Rename:        parseKeyValueLines(r.FormValue("rename")),
+			Aliases:       parseAliasLines(r.FormValue("aliases")),
+			TypeOverrides: parseKeyValueLines(r.FormValue("type_overrides")),
+			NullMarkers:   splitList(r.FormValue("null_markers")),
+			DateFormats:   parseKeyValueLines(r.FormValue("date_formats")),
+			Rules:         rules,
+			CreatedAt:     time.Now(),
+		}
+		if len(t.MatchHeaders) == 0 {
+			http.Error(w, "Match headers are required", http.StatusBadRequest)
+			return
+		}
+		for col, typ := range t.TypeOverrides {
+			if typ != "numeric" && typ != "text" && typ != "date" {
+				http.Error(w, fmt.Sprintf("Invalid type %q for %s (use numeric, text or date)", typ, col), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := mappings.Save(t); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to save template: %v", err), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/mappings", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+func renderMappings(w http.ResponseWriter, team, editName string, active []string) {
+	list := ReportSection{
+		Title:   "Saved Templates",
+		Headers: []string{"Name", "Headers", "Skip Rows", "Renames", "Aliases", "Type Overrides", "Null Markers", "Date Formats", "Rules"},
+	}
+	var links []ReportLink
+	for _, t := range mappings.List(team) {
+		list.Rows = append(list.Rows, []string{
+			t.Name,
+			strings.Join(t.MatchHeaders, ", "),
+			strconv.Itoa(t.SkipRows),
+			strconv.Itoa(len(t.Rename)),
+			strconv.Itoa(len(t.Aliases)),
+			strconv.Itoa(len(t.TypeOverrides)),
+			strings.Join(t.NullMarkers, ", "),
+			strconv.Itoa(len(t.DateFormats)),
+			strconv.Itoa(len(t.Rules)),
+		})
+		links = append(links, ReportLink{Label: "✏️ " + t.Name, URL: "/mappings?name=" + url.QueryEscape(t.Name)})
+	}
+	list.Links = links
+
+	// Start a new template from the active dataset's layout, or edit one.
+	t, editing := mappings.Get(team, editName)
+	if !editing {
+		t.MatchHeaders = active
+	}
+	form := ReportSection{
+		Title: "Define Template",
+		Notes: []string{
+			"Match headers are compared after skipping rows, ignoring case.",
+			"Renames, type overrides (numeric, text or date) and date formats take one \"Column = value\" per line.",
+			"Aliases take one \"Column = other name, other name\" per line; matching headers are renamed to the column before anything else is applied.",
+			"Validation rules take one \"Name: expression\" per line and are checked on the Validation Rules page of every matching upload.",
+		},
+		Form: &ReportForm{
+			Action: "/mappings",
+			Submit: "💾 Save Template",
+			Fields: []FormField{
+				{Name: "name", Label: "Template name", Value: t.Name, Placeholder: "Vendor A monthly statement"},
+				{Name: "match_headers", Label: "Match headers (comma separated)", Value: strings.Join(t.MatchHeaders, ", ")},
+				{Name: "skip_rows", Label: "Rows to skip before the header", Type: "number", Value: strconv.Itoa(t.SkipRows)},
+				{Name: "rename", Label: "Rename columns", Type: "textarea", Value: formatKeyValueLines(t.Rename), Placeholder: "Amt = Amount"},
+				{Name: "aliases", Label: "Column aliases", Type: "textarea", Value: formatAliasLines(t.Aliases), Placeholder: "Revenue = Rev, Turnover, Sales (R)"},
+				{Name: "type_overrides", Label: "Type overrides", Type: "textarea", Value: formatKeyValueLines(t.TypeOverrides), Placeholder: "Account = text"},
+				{Name: "null_markers", Label: "Null markers (comma separated)", Value: strings.Join(t.NullMarkers, ", "), Placeholder: "N/A, -, NULL"},
+				{Name: "date_formats", Label: "Date formats", Type: "textarea", Value: formatKeyValueLines(t.DateFormats), Placeholder: "Posted = dd/mm/yyyy"},
+				{Name: "rules", Label: "Validation rules", Type: "textarea", Value: formatRuleLines(t.Rules), Placeholder: "Dates in order: EndDate >= StartDate"},
+			},
+		},
+	}
+	sections := []ReportSection{list, form}
+	if templates := mappings.List(team); len(templates) > 0 {
+		var options []FormOption
+		for _, tmpl := range templates {
+			options = append(options, FormOption{Value: tmpl.Name, Label: tmpl.Name, Selected: tmpl.Name == editName})
+		}
+		sections = append(sections, ReportSection{
+			Title: "Dry Run",
+			Notes: []string{"Check which template columns a file's headers resolve to, directly or by alias, without importing it."},
+			Form: &ReportForm{
+				Action: "/mappings",
+				Submit: "🧪 Dry Run",
+				Fields: []FormField{
+					{Name: "dry_run", Type: "hidden", Value: "1"},
+					{Name: "name", Label: "Template", Type: "select", Options: options},
+					{Name: "headers", Label: "Incoming headers (comma separated)", Value: strings.Join(active, ", ")},
+				},
+			},
+		})
+	}
+	if editing {
+		sections = append(sections, ReportSection{
+			Title: "Delete Template",
+			Form: &ReportForm{
+				Action: "/mappings",
+				Submit: "🗑️ Delete " + t.Name,
+				Fields: []FormField{
+					{Name: "name", Type: "hidden", Value: t.Name},
+					{Name: "delete", Type: "hidden", Value: "1"},
+				},
+			},
+		})
+	}
+	renderReport(w, ReportPage{
+		Title:    "Import Mapping Templates",
+		Subtitle: "Reusable settings for recurring vendor files",
+		Sections: sections,
+	})
+}
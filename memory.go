@@ -0,0 +1,149 @@
+// memory.go
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Before a file is parsed, checkMemoryBudget estimates what it will take in
+// memory and refuses it when that and what the process already holds would
+// pass config.MemoryBudget. An upload a few megabytes on disk can expand a
+// hundredfold once parsed (an xlsx is compressed XML), and refusing it with
+// a reason beats the process being killed for running out of memory.
+
+// memorySampleBytes is how much of a text file is read to estimate its rows.
+const memorySampleBytes = 256 << 10
+
+// parseOverhead covers the copies made while parsing and the profile built
+// afterwards, on top of the rows themselves.
+const parseOverhead = 3
+
+// opaqueExpansion is assumed for formats not sampled (xls, dBase, PDF,
+// SQLite): in-memory bytes per byte of file.
+const opaqueExpansion = 8
+
+type MemoryEstimate struct {
+	Rows    int // 0 when not sampled
+	Columns int
+	Bytes   int64
+}
+
+// rowBytes is a parsed row's size: its slice, a string header per cell and
+// the text itself.
+func rowBytes(cells int, text int) int64 {
+	return int64(24 + 16*cells + text)
+}
+
+// estimateMemory guesses the in-memory size of the file once parsed.
+func estimateMemory(name string, file io.ReaderAt, size int64) (MemoryEstimate, error) {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch {
+	case ext == ".csv" || isFixedWidthFile(name):
+		return estimateText(file, size)
+	case ext == ".xlsx" && !isCompoundFile(file):
+		return estimateXLSX(file, size)
+	}
+	return MemoryEstimate{Bytes: size * opaqueExpansion}, nil
+}
+
+// estimateText parses the start of the file as CSV and scales the rows it
+// found to the whole file.
+func estimateText(file io.ReaderAt, size int64) (MemoryEstimate, error) {
+	sample := make([]byte, memorySampleBytes)
+	n, err := file.ReadAt(sample, 0)
+	if err != nil && err != io.EOF {
+		return MemoryEstimate{}, err
+	}
+	sample = sample[:n]
+	truncated := int64(n) < size
+	reader := csv.NewReader(bytes.NewReader(sample))
+	reader.Comma = delimiterRune(sniffDelimiter(sample, truncated).Value)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	var rows, cells, text int
+	var consumed int64
+	for {
+		row, err := reader.Read()
+		if err != nil {
+			break // EOF, or a row cut off at the end of the sample
+		}
+		rows++
+		cells += len(row)
+		for _, cell := range row {
+			text += len(cell)
+		}
+		consumed = reader.InputOffset()
+	}
+	if rows == 0 || consumed == 0 {
+		return MemoryEstimate{Bytes: size * opaqueExpansion}, nil
+	}
+	total := rows
+	if truncated {
+		total = int(float64(rows) * float64(size) / float64(consumed))
+	}
+	perRow := float64(rowBytes(cells, text)) / float64(rows)
+	return MemoryEstimate{Rows: total, Columns: cells / rows, Bytes: int64(perRow*float64(total)) * parseOverhead}, nil
+}
+
+// estimateXLSX reads the sizes of the worksheets and shared strings from the
+// zip directory. Parsing holds the XML as well as the rows it becomes.
+func estimateXLSX(file io.ReaderAt, size int64) (MemoryEstimate, error) {
+	zr, err := zip.NewReader(file, size)
+	if err != nil {
+		return MemoryEstimate{Bytes: size * opaqueExpansion}, nil
+	}
+	var xml uint64
+	for _, f := range zr.File {
+		if strings.HasPrefix(f.Name, "xl/worksheets/") || f.Name == "xl/sharedStrings.xml" {
+			xml += f.UncompressedSize64
+		}
+	}
+	return MemoryEstimate{Bytes: int64(xml) * parseOverhead}, nil
+}
+
+func (e MemoryEstimate) String() string {
+	if e.Rows > 0 {
+		return fmt.Sprintf("about %s for roughly %d rows of %d columns", formatFileSize(e.Bytes), e.Rows, e.Columns)
+	}
+	return "about " + formatFileSize(e.Bytes)
+}
+
+// MemoryBudgetError is returned for a file too big to parse right now.
+type MemoryBudgetError struct {
+	Estimate MemoryEstimate
+	Free     int64
+}
+
+func (e *MemoryBudgetError) Error() string {
+	return fmt.Sprintf("this file would need %s once loaded, but only %s of the server's %s memory budget is free; "+
+		"split it into smaller files or upload only the columns you need", e.Estimate, formatFileSize(e.Free), formatFileSize(config.MemoryBudget))
+}
+
+// checkMemoryBudget returns a *MemoryBudgetError when the file shouldn't be
+// parsed. A budget of 0 turns the check off.
+func checkMemoryBudget(name string, file io.ReaderAt, size int64) error {
+	if config.MemoryBudget <= 0 {
+		return nil
+	}
+	est, err := estimateMemory(name, file, size)
+	if err != nil {
+		return err
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	free := config.MemoryBudget - int64(mem.HeapInuse)
+	if free < 0 {
+		free = 0
+	}
+	if est.Bytes > free {
+		return &MemoryBudgetError{Estimate: est, Free: free}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+// middleware.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RouteLimits bounds what a single route may consume so a burst on one
+// endpoint (usually uploads) can't starve the others.
+type RouteLimits struct {
+	MaxBody       int64
+	MaxConcurrent int
+	Timeout       time.Duration
+	Stream        bool // write straight to the client: no buffering and no Timeout
+	Queued        bool // counts against the caller's calculation slots (see calcqueue.go)
+}
+
+var defaultLimits = RouteLimits{MaxBody: 1 << 20, MaxConcurrent: 32, Timeout: 30 * time.Second}
+
+var routeLimits = map[string]RouteLimits{
+	"display":    {MaxBody: MaxFileSize + 1<<20, MaxConcurrent: 4, Timeout: 60 * time.Second},
+	"calculate":  {MaxBody: 1 << 20, MaxConcurrent: 16, Timeout: 30 * time.Second, Queued: true},
+	"analyze":    {MaxBody: 1 << 20, MaxConcurrent: 8, Timeout: 30 * time.Second, Queued: true},
+	"forecast":   {MaxBody: 1 << 20, MaxConcurrent: 32, Timeout: 30 * time.Second, Queued: true},
+	"cohorts":    {MaxBody: 1 << 20, MaxConcurrent: 32, Timeout: 30 * time.Second, Queued: true},
+	"crosstab":   {MaxBody: 1 << 20, MaxConcurrent: 32, Timeout: 30 * time.Second, Queued: true},
+	"export":     {MaxBody: 64 << 10, MaxConcurrent: 8, Timeout: 60 * time.Second},
+	"validate":   {MaxBody: MaxFileSize + 1<<20, MaxConcurrent: 2, Timeout: 120 * time.Second},
+	"preview":    {MaxBody: MaxFileSize + 1<<20, MaxConcurrent: 8, Timeout: 15 * time.Second},
+	"stream":     {MaxBody: 64 << 10, MaxConcurrent: 4, Stream: true},
+	"chat":       {MaxBody: 64 << 10, MaxConcurrent: 8, Timeout: 10 * time.Second},
+	"inbound":    {MaxBody: 2*MaxFileSize + 1<<20, MaxConcurrent: 2, Timeout: 120 * time.Second},
+	"automation": {MaxBody: 64 << 10, MaxConcurrent: 4, Timeout: 60 * time.Second},
+	"bench":      {MaxBody: 64 << 10, MaxConcurrent: 1, Timeout: 10 * time.Minute},
+}
+
+// limited applies the limits registered for name (or the defaults): bodies
+// over MaxBody get 413, requests beyond MaxConcurrent get 503 and handlers
+// that run past Timeout get 408. Stream routes hold their slot until the
+// client has everything or goes away. Queued routes first wait for one of
+// the caller's calculation slots.
+func limited(name string, next http.HandlerFunc) http.HandlerFunc {
+	lim, ok := routeLimits[name]
+	if !ok {
+		lim = defaultLimits
+	}
+	slots := make(chan struct{}, lim.MaxConcurrent)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > lim.MaxBody {
+			http.Error(w, fmt.Sprintf("Request body exceeds %s", formatFileSize(lim.MaxBody)), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if !allowRate(w, r, name) {
+			return
+		}
+		releaseCalc := func() {}
+		if lim.Queued {
+			var ok bool
+			if releaseCalc, ok = calcJobs.acquire(r); !ok {
+				refuseCalculation(w, r)
+				return
+			}
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			releaseCalc()
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Server busy, please retry shortly", http.StatusServiceUnavailable)
+			return
+		}
+		release := func() {
+			<-slots
+			releaseCalc()
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, lim.MaxBody)
+		if lim.Stream {
+			defer release()
+			next(w, r)
+			return
+		}
+		runWithTimeout(w, r, lim.Timeout, next, release)
+	}
+}
+
+// allowRate counts the request against the client's allowance for the
+// route this minute, answering 429 once it is used up. Counters live in the
+// state backend, so replicas share them. When the backend fails, requests
+// are let through rather than refused.
+func allowRate(w http.ResponseWriter, r *http.Request, name string) bool {
+	limit, ok := config.RateLimits[name]
+	if !ok {
+		limit = config.RateLimit
+	}
+	if limit <= 0 {
+		return true
+	}
+	client := clientKey(r)
+	now := time.Now()
+	window := now.Truncate(time.Minute)
+	n, err := state.Incr(fmt.Sprintf("rate/%s/%s/%d", name, client, window.Unix()), 2*time.Minute)
+	if err != nil {
+		log.Printf("Rate limit for %s unavailable: %v", name, err)
+		return true
+	}
+	remaining := int64(limit) - n
+	if remaining < 0 {
+		remaining = 0
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+	if n <= int64(limit) {
+		return true
+	}
+	retry := int(window.Add(time.Minute).Sub(now).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	msg := fmt.Sprintf("Rate limit of %d requests per minute exceeded; retry in %ds", limit, retry)
+	if isAPIPath(r.URL.Path) {
+		writeAPIError(w, http.StatusTooManyRequests, msg)
+	} else {
+		http.Error(w, msg, http.StatusTooManyRequests)
+	}
+	return false
+}
+
+// runWithTimeout buffers the handler's output and only sends it if the
+// handler finishes in time. release runs when the handler actually returns,
+// so a timed-out handler keeps holding its concurrency slot until it stops.
+func runWithTimeout(w http.ResponseWriter, r *http.Request, timeout time.Duration, next http.HandlerFunc, release func()) {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	tw := &timeoutWriter{header: make(http.Header)}
+	done := make(chan struct{})
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer release()
+		defer func() {
+			if p := recover(); p != nil {
+				panicked <- p
+			}
+		}()
+		next(tw, r.WithContext(ctx))
+		close(done)
+	}()
+
+	select {
+	case p := <-panicked:
+		panic(p)
+	case <-done:
+		tw.mu.Lock()
+		defer tw.mu.Unlock()
+		for k, v := range tw.header {
+			w.Header()[k] = v
+		}
+		if tw.status == 0 {
+			tw.status = http.StatusOK
+		}
+		w.WriteHeader(tw.status)
+		w.Write(tw.buf.Bytes())
+	case <-ctx.Done():
+		tw.mu.Lock()
+		tw.timedOut = true
+		tw.mu.Unlock()
+		if r.Context().Err() != nil {
+			return // client went away
+		}
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Request timed out after "+strconv.Itoa(int(timeout.Seconds()))+"s", http.StatusRequestTimeout)
+	}
+}
+
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	buf      bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.header }
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.status == 0 && !tw.timedOut {
+		tw.status = status
+	}
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.buf.Write(p)
+}
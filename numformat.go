@@ -0,0 +1,161 @@
+// numformat.go
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// NumberFormat describes number conventions an upload uses beyond what
+// strconv understands. Matching cells are rewritten to plain decimal text on
+// upload, so detection, calculations and exports all see ordinary numbers.
+type NumberFormat struct {
+	ParenNegatives bool // accounting style: (1,234.56)
+	TrailingMinus  bool // 1234.56-
+	UnitSuffixes   bool // engineering suffixes: 1.2k, 3M, 470n
+}
+
+func numberFormatFromForm(r *http.Request) NumberFormat {
+	var f NumberFormat
+	switch r.FormValue("negatives") {
+	case "parens":
+		f.ParenNegatives = true
+	case "trailing":
+		f.TrailingMinus = true
+	case "both":
+		f.ParenNegatives, f.TrailingMinus = true, true
+	}
+	f.UnitSuffixes = r.FormValue("suffixes") == "1"
+	return f
+}
+
+func (f NumberFormat) enabled() bool {
+	return f.ParenNegatives || f.TrailingMinus || f.UnitSuffixes
+}
+
+// magnitudePattern accepts unsigned numbers with optional comma grouping in
+// threes, as finance exports write them, and an optional exponent as lab
+// instruments write them.
+var magnitudePattern = regexp.MustCompile(`^(\d{1,3}(,\d{3})+|\d+)?(\.\d+)?([eE][+-]?\d+)?$`)
+
+// unitSuffixes are the SI prefixes instrument exports append to values, with
+// their power of ten. Case matters: "m" is milli and "M" is mega.
+var unitSuffixes = []struct {
+	suffix string
+	exp    int
+}{
+	{"T", 12}, {"G", 9}, {"M", 6}, {"k", 3}, {"K", 3},
+	{"m", -3}, {"µ", -6}, {"u", -6}, {"n", -9}, {"p", -12},
+}
+
+// scaleDecimal multiplies the decimal text s by 10^exp without going through
+// float64, so "0.07k" becomes "70" rather than "70.00000000000001".
+func scaleDecimal(s string, exp int) (string, bool) {
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		// big.Rat expands exponents exactly; keep them to what float64 can hold.
+		if e, err := strconv.Atoi(s[i+1:]); err != nil || e > 400 || e < -400 {
+			return "", false
+		}
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return "", false
+	}
+	if exp < 0 {
+		r.Quo(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-exp)), nil)))
+	} else {
+		r.Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil)))
+	}
+	for prec := 0; ; prec++ {
+		out := r.FloatString(prec)
+		if back, _ := new(big.Rat).SetString(out); back.Cmp(r) == 0 {
+			return out, true
+		}
+	}
+}
+
+// normalize returns s as plain decimal text when it is a number under f.
+func (f NumberFormat) normalize(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	// An ordinary leading sign is always allowed, so switching on one
+	// convention doesn't reject the plain negatives in the same column.
+	neg, signed := false, len(s) > 1 && (s[0] == '-' || s[0] == '+')
+	switch {
+	case signed:
+		neg, s = s[0] == '-', s[1:]
+	case f.ParenNegatives && len(s) > 2 && s[0] == '(' && s[len(s)-1] == ')':
+		neg, s = true, strings.TrimSpace(s[1:len(s)-1])
+	case f.TrailingMinus && len(s) > 1 && s[len(s)-1] == '-':
+		neg, s = true, strings.TrimSpace(s[:len(s)-1])
+	}
+	exp := 0
+	if f.UnitSuffixes {
+		for _, u := range unitSuffixes {
+			if strings.HasSuffix(s, u.suffix) {
+				s, exp = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.exp
+				break
+			}
+		}
+	}
+	if s == "" || s[0] == 'e' || s[0] == 'E' || !magnitudePattern.MatchString(s) {
+		return "", false
+	}
+	s = strings.ReplaceAll(s, ",", "")
+	if exp != 0 {
+		scaled, ok := scaleDecimal(s, exp)
+		if !ok {
+			return "", false
+		}
+		s = scaled
+	}
+	if neg {
+		s = "-" + s
+	}
+	return s, true
+}
+
+// normalizeNumbers rewrites cells written in f's conventions. A column is
+// only touched when the rewrite leaves it numeric, so text columns holding
+// things like "(see note)" or phone codes are left alone. It returns how many
+// cells changed.
+func normalizeNumbers(data *Spreadsheet, f NumberFormat) int {
+	if !f.enabled() {
+		return 0
+	}
+	changed := 0
+	for col := range data.Headers {
+		rewrites := make(map[int]string)
+		total, numeric := 0, 0
+		for i, row := range data.Rows {
+			val := cellValue(row, col)
+			if val == "" {
+				continue
+			}
+			total++
+			if _, err := strconv.ParseFloat(val, 64); err == nil {
+				numeric++
+				continue
+			}
+			if plain, ok := f.normalize(val); ok {
+				rewrites[i] = plain
+				numeric++
+			}
+		}
+		if len(rewrites) == 0 || float64(numeric)/float64(total) < 0.8 {
+			continue
+		}
+		for i, plain := range rewrites {
+			resummarizeCell(data, col, data.Rows[i][col], plain)
+			data.Rows[i][col] = plain
+		}
+		changed += len(rewrites)
+	}
+	if changed > 0 {
+		data.Notes = append(data.Notes, fmt.Sprintf("Converted %d accounting-style, grouped or unit-suffixed number(s) to plain decimals", changed))
+	}
+	return changed
+}
@@ -0,0 +1,33 @@
+// numformat_test.go
+package main
+
+import "testing"
+
+func TestNormalizeSigns(t *testing.T) {
+	paren, trailing, units := NumberFormat{ParenNegatives: true}, NumberFormat{TrailingMinus: true}, NumberFormat{UnitSuffixes: true}
+	tests := []struct {
+		f    NumberFormat
+		in   string
+		want string // "" when it isn't a number under f
+	}{
+		{paren, "-1,234.56", "-1234.56"},
+		{paren, "-3.4E-2", "-3.4E-2"},
+		{paren, "+7", "7"},
+		{paren, "(1,200)", "-1200"},
+		{paren, "(-5)", ""},
+		{paren, "-(5)", ""},
+		{trailing, "-1,234.56", "-1234.56"},
+		{trailing, "12.5-", "-12.5"},
+		{trailing, "-5-", ""},
+		{units, "-2k", "-2000"},
+		{units, "+3.5m", "0.0035"},
+		{units, "--5", ""},
+		{units, "-", ""},
+	}
+	for _, tt := range tests {
+		got, ok := tt.f.normalize(tt.in)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("%+v normalize(%q) = %q, %v; want %q", tt.f, tt.in, got, ok, tt.want)
+		}
+	}
+}
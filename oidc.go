@@ -0,0 +1,508 @@
+// oidc.go
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+	Issuer                string `json:"issuer"`
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+var (
+	providerMu sync.Mutex
+	provider   *oidcProvider
+	oidcClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// getProvider loads the issuer's discovery document on first use.
+func getProvider() (*oidcProvider, error) {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	if provider != nil {
+		return provider, nil
+	}
+	resp, err := oidcClient.Get(config.OIDC.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery: %s", resp.Status)
+	}
+	p := &oidcProvider{}
+	if err := json.NewDecoder(resp.Body).Decode(p); err != nil {
+		return nil, fmt.Errorf("discovery: %v", err)
+	}
+	if p.Issuer != config.OIDC.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match configured %q", p.Issuer, config.OIDC.Issuer)
+	}
+	provider = p
+	return p, nil
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// key returns the signing key for kid, refetching the JWKS when the kid is
+// unknown (keys rotate) but no more than once a minute.
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.fetched) < time.Minute && p.keys != nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	resp, err := oidcClient.Get(p.JWKSURI)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: %v", err)
+	}
+	defer resp.Body.Close()
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("jwks: %v", err)
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	p.fetched = time.Now()
+	for _, jwk := range set.Keys {
+		if k, err := jwk.publicKey(); err == nil {
+			p.keys[jwk.Kid] = k
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	dec := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := dec.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := dec.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of
+// an ID token and returns its claims.
+func (p *oidcProvider) verifyIDToken(token, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	dec := base64.RawURLEncoding
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	raw, err := dec.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+	sig, err := dec.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature")
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if err := verifyJWS(header.Alg, key, signed, sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if raw, err = dec.DecodeString(parts[1]); err != nil || json.Unmarshal(raw, &claims) != nil {
+		return nil, fmt.Errorf("malformed claims")
+	}
+	if iss, _ := claims["iss"].(string); iss != p.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if !audienceContains(claims["aud"], config.OIDC.ClientID) {
+		return nil, fmt.Errorf("token not issued for this client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().After(time.Unix(int64(exp), 0).Add(time.Minute)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, fmt.Errorf("nonce mismatch")
+	}
+	return claims, nil
+}
+
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		case "PS":
+			return rsa.VerifyPSS(k, hash, digest, sig, nil)
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] == "ES" {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			if len(sig) != 2*size {
+				return fmt.Errorf("bad signature length")
+			}
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+			return fmt.Errorf("invalid signature")
+		}
+	}
+	return fmt.Errorf("algorithm %s does not match key type", alg)
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, v := range a {
+			if s, _ := v.(string); s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loginState travels in a short-lived HMAC-signed cookie between /login and
+// the callback.
+type loginState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Next     string `json:"r"`
+	Expires  int64  `json:"e"`
+}
+
+const stateCookie = "dr_oidc"
+
+var loginKey struct {
+	mu  sync.Mutex
+	key []byte
+}
+
+// stateKey is the key login state is signed with. A login can start on one
+// replica and come back to another, so they all need the same key:
+// SESSION_SECRET when it's set, or one derived from the OIDC client secret,
+// or with a shared backend a random key kept there. A single process can
+// make up its own.
+func stateKey() ([]byte, error) {
+	loginKey.mu.Lock()
+	defer loginKey.mu.Unlock()
+	if loginKey.key != nil {
+		return loginKey.key, nil
+	}
+	var key []byte
+	switch secret := envOr("SESSION_SECRET", ""); {
+	case secret != "":
+		key = []byte(secret)
+	case config.OIDC.ClientSecret != "":
+		mac := hmac.New(sha256.New, []byte(config.OIDC.ClientSecret))
+		mac.Write([]byte("clientweb login state"))
+		key = mac.Sum(nil)
+	case stateShared:
+		var err error
+		if key, err = sharedStateKey(); err != nil {
+			return nil, fmt.Errorf("could not read the login state key: %w", err)
+		}
+	default:
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	loginKey.key = key
+	return key, nil
+}
+
+// sharedStateKey returns the key kept in shared state, making it if no
+// replica has yet.
+func sharedStateKey() ([]byte, error) {
+	unlock, err := lockShared("oidc/state-key", sharedLockTTL, sharedLockWait)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	var key []byte
+	err = getSealedJSON("oidc/state-key", &key)
+	if !errors.Is(err, errStateMissing) {
+		return key, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, setSealedJSON("oidc/state-key", key, 0)
+}
+
+func signState(st loginState) (string, error) {
+	key, err := stateKey()
+	if err != nil {
+		return "", err
+	}
+	payload, _ := json.Marshal(st)
+	enc := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(enc))
+	return enc + "." + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func readState(value string) (loginState, bool) {
+	var st loginState
+	enc, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return st, false
+	}
+	key, err := stateKey()
+	if err != nil {
+		log.Printf("Sign-in state not checked: %v", err)
+		return st, false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(enc))
+	if !hmac.Equal([]byte(sig), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return st, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || json.Unmarshal(payload, &st) != nil || time.Now().Unix() > st.Expires {
+		return st, false
+	}
+	return st, true
+}
+
+func secureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" && inNets(resolvePeerIP(r), config.TrustedProxies)
+}
+
+// safeNext only allows local redirects after login.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if !authEnabled() {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	p, err := getProvider()
+	if err != nil {
+		http.Error(w, "Sign-in is unavailable: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	st := loginState{
+		State:    newID() + newID(),
+		Nonce:    newID() + newID(),
+		Verifier: newID() + newID() + newID() + newID(),
+		Next:     safeNext(r.URL.Query().Get("next")),
+		Expires:  time.Now().Add(10 * time.Minute).Unix(),
+	}
+	signed, err := signState(st)
+	if err != nil {
+		http.Error(w, "Sign-in is unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: stateCookie, Value: signed, Path: "/auth/callback",
+		HttpOnly: true, Secure: secureRequest(r), SameSite: http.SameSiteLaxMode, MaxAge: 600,
+	})
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {config.OIDC.ClientID},
+		"redirect_uri":          {config.OIDC.RedirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := getProvider()
+	if err != nil {
+		http.Error(w, "Sign-in is unavailable: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	c, err := r.Cookie(stateCookie)
+	if err != nil {
+		http.Error(w, "Sign-in session expired, please try again", http.StatusBadRequest)
+		return
+	}
+	st, ok := readState(c.Value)
+	if !ok || st.State != r.URL.Query().Get("state") {
+		http.Error(w, "Sign-in state mismatch, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/auth/callback", MaxAge: -1})
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "Sign-in failed: "+e+" "+r.URL.Query().Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {r.URL.Query().Get("code")},
+		"redirect_uri":  {config.OIDC.RedirectURL},
+		"client_id":     {config.OIDC.ClientID},
+		"client_secret": {config.OIDC.ClientSecret},
+		"code_verifier": {st.Verifier},
+	}
+	resp, err := oidcClient.PostForm(p.TokenEndpoint, form)
+	if err != nil {
+		http.Error(w, "Token exchange failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, "Token exchange failed: "+resp.Status, http.StatusBadGateway)
+		return
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil || tokens.IDToken == "" {
+		http.Error(w, "Token exchange returned no ID token", http.StatusBadGateway)
+		return
+	}
+	claims, err := p.verifyIDToken(tokens.IDToken, st.Nonce)
+	if err != nil {
+		http.Error(w, "Invalid ID token: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	user := &User{Via: "oidc"}
+	user.ID, _ = claims["sub"].(string)
+	user.Email, _ = claims["email"].(string)
+	user.Name, _ = claims["name"].(string)
+	if list, ok := claims[config.OIDC.GroupsClaim].([]interface{}); ok {
+		for _, g := range list {
+			if s, ok := g.(string); ok {
+				user.Groups = append(user.Groups, s)
+			}
+		}
+	}
+	user.Role = roleForGroups(user.Groups)
+
+	http.SetCookie(w, &http.Cookie{
+		Name: sessionCookie, Value: sessions.Create(user), Path: "/",
+		HttpOnly: true, Secure: secureRequest(r), SameSite: http.SameSiteLaxMode,
+		MaxAge: int(config.OIDC.SessionTTL.Seconds()),
+	})
+	http.Redirect(w, r, st.Next, http.StatusSeeOther)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		sessions.Delete(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	if !authEnabled() {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if p, err := getProvider(); err == nil && p.EndSessionEndpoint != "" {
+		http.Redirect(w, r, p.EndSessionEndpoint, http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
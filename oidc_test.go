@@ -0,0 +1,39 @@
+// oidc_test.go
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newReplica forgets the login state key, as another process would start.
+func newReplica() {
+	loginKey.mu.Lock()
+	loginKey.key = nil
+	loginKey.mu.Unlock()
+}
+
+// A login can start on one replica and finish on another.
+func TestLoginStateAcrossReplicas(t *testing.T) {
+	t.Setenv("SESSION_SECRET", "")
+	saved := config
+	t.Cleanup(func() { config = saved; newReplica() })
+	st := loginState{State: "abc", Expires: time.Now().Add(time.Minute).Unix()}
+
+	for _, secret := range []string{"client-secret", ""} {
+		config.OIDC.ClientSecret = secret
+		useSharedState(t)
+		newReplica()
+		signed, err := signState(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newReplica()
+		if got, ok := readState(signed); !ok || got.State != "abc" {
+			t.Errorf("client secret %q: another replica read %+v, %v", secret, got, ok)
+		}
+		if _, ok := readState(signed[1:]); ok {
+			t.Errorf("client secret %q: read a changed state", secret)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// operations.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ParamSpec declares one input an operation accepts. The calculate form
+// renders an input per spec and the API validates "params" against it.
+type ParamSpec struct {
+	Name    string  `json:"name"`
+	Label   string  `json:"label"`
+	Type    string  `json:"type"` // number or integer
+	Default float64 `json:"default"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+}
+
+type OpParams map[string]float64
+
+type Operation struct {
+	Name        string                                            `json:"name"`
+	Label       string                                            `json:"label"`
+	Icon        string                                            `json:"icon"`
+	Description string                                            `json:"description"`
+	Params      []ParamSpec                                       `json:"params,omitempty"`
+	Compute     func(vals []float64, p OpParams) (float64, error) `json:"-"`
+}
+
+func noParams(f func([]float64) float64) func([]float64, OpParams) (float64, error) {
+	return func(vals []float64, _ OpParams) (float64, error) { return f(vals), nil }
+}
+
+var operations = []Operation{
+	{Name: "sum", Label: "Sum", Icon: "➕", Description: "Add all values", Compute: noParams(sum)},
+	{Name: "average", Label: "Average", Icon: "📊", Description: "Mean of values", Compute: noParams(avg)},
+	{Name: "min", Label: "Minimum", Icon: "🔽", Description: "Smallest value", Compute: noParams(min)},
+	{Name: "max", Label: "Maximum", Icon: "🔼", Description: "Largest value", Compute: noParams(max)},
+	{Name: "median", Label: "Median", Icon: "📏", Description: "Middle value", Compute: noParams(median)},
+	{Name: "std", Label: "Std Dev", Icon: "±", Description: "Standard deviation", Compute: noParams(std)},
+	{Name: "count", Label: "Count", Icon: "🔢", Description: "Number of values", Compute: noParams(func(vals []float64) float64 {
+		return float64(len(vals))
+	})},
+	{
+		Name: "percentile", Label: "Percentile", Icon: "📐", Description: "Value below which p% fall",
+		Params: []ParamSpec{{Name: "p", Label: "Percentile (p)", Type: "number", Default: 90, Min: 0, Max: 100}},
+		Compute: func(vals []float64, p OpParams) (float64, error) {
+			return percentile(vals, p["p"]), nil
+		},
+	},
+	{
+		Name: "trimmed_mean", Label: "Trimmed Mean", Icon: "✂️", Description: "Mean without the extremes",
+		Params: []ParamSpec{{Name: "trim", Label: "Trim % from each end", Type: "number", Default: 10, Min: 0, Max: 49}},
+		Compute: func(vals []float64, p OpParams) (float64, error) {
+			return trimmedMean(vals, p["trim"])
+		},
+	},
+}
+
+func lookupOperation(name string) (Operation, bool) {
+	for _, op := range operations {
+		if op.Name == name {
+			return op, true
+		}
+	}
+	return Operation{}, false
+}
+
+// ResolveParams fills defaults and checks every supplied value against the
+// operation's declared parameters. Unknown names are rejected so typos in
+// API calls don't silently fall back to defaults.
+func (op Operation) ResolveParams(raw map[string]string) (OpParams, error) {
+	params := make(OpParams, len(op.Params))
+	known := make(map[string]bool, len(op.Params))
+	for _, spec := range op.Params {
+		known[spec.Name] = true
+		params[spec.Name] = spec.Default
+		text := strings.TrimSpace(raw[spec.Name])
+		if text == "" {
+			continue
+		}
+		// ParseFloat takes "NaN" and "Inf", and NaN slips past the range
+		// check below.
+		v, err := strconv.ParseFloat(text, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%s: %q is not a number", spec.Name, text)
+		}
+		if spec.Type == "integer" && v != math.Trunc(v) {
+			return nil, fmt.Errorf("%s must be a whole number", spec.Name)
+		}
+		if v < spec.Min || v > spec.Max {
+			return nil, fmt.Errorf("%s must be between %g and %g", spec.Name, spec.Min, spec.Max)
+		}
+		params[spec.Name] = v
+	}
+	for name := range raw {
+		if !known[name] {
+			return nil, fmt.Errorf("operation %s has no parameter %q", op.Name, name)
+		}
+	}
+	return params, nil
+}
+
+// formParams collects "param.<op>.<name>" fields for op from a submitted form.
+func formParams(op Operation, form map[string][]string) map[string]string {
+	raw := make(map[string]string)
+	for _, spec := range op.Params {
+		if v := form["param."+op.Name+"."+spec.Name]; len(v) > 0 {
+			raw[spec.Name] = v[0]
+		}
+	}
+	return raw
+}
+
+// jsonParams converts an API "params" object, accepting numbers or strings.
+func jsonParams(in map[string]json.RawMessage) (map[string]string, error) {
+	raw := make(map[string]string, len(in))
+	for name, msg := range in {
+		var num float64
+		if err := json.Unmarshal(msg, &num); err == nil {
+			raw[name] = strconv.FormatFloat(num, 'f', -1, 64)
+			continue
+		}
+		var text string
+		if err := json.Unmarshal(msg, &text); err != nil {
+			return nil, fmt.Errorf("parameter %q must be a number", name)
+		}
+		raw[name] = text
+	}
+	return raw, nil
+}
+
+// describeParams renders params for result headings, e.g. "p=95".
+func describeParams(op Operation, p OpParams) string {
+	var parts []string
+	for _, spec := range op.Params {
+		parts = append(parts, fmt.Sprintf("%s=%g", spec.Name, p[spec.Name]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// percentile interpolates linearly between closest ranks.
+func percentile(vals []float64, p float64) float64 {
+	return percentileSorted(sortedCopy(vals), p)
+}
+
+func percentileSorted(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	frac := rank - float64(lo)
+	return sorted[lo] + (sorted[hi]-sorted[lo])*frac
+}
+
+func trimmedMean(vals []float64, trimPct float64) (float64, error) {
+	sorted := sortedCopy(vals)
+	k := int(math.Floor(float64(len(sorted)) * trimPct / 100))
+	kept := sorted[k : len(sorted)-k]
+	if len(kept) == 0 {
+		return 0, fmt.Errorf("trimming %g%% leaves no values", trimPct)
+	}
+	return avg(kept), nil
+}
+
+func operationsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIData(w, r, operations)
+}
@@ -0,0 +1,48 @@
+// operations_test.go
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestResolveParams(t *testing.T) {
+	percentile, _ := lookupOperation("percentile")
+	tests := []struct {
+		p    string
+		want string // the resolved p, or "error"
+	}{
+		{"", "90"},
+		{" 25 ", "25"},
+		{"0", "0"},
+		{"100", "100"},
+		{"99.5", "99.5"},
+		{"-1", "error"},
+		{"100.01", "error"},
+		{"ten", "error"},
+		{"NaN", "error"},
+		{"nan", "error"},
+		{"Inf", "error"},
+		{"+Inf", "error"},
+		{"-Infinity", "error"},
+		{"1e400", "error"},
+	}
+	for _, tt := range tests {
+		params, err := percentile.ResolveParams(map[string]string{"p": tt.p})
+		got := "error"
+		if err == nil {
+			got = fmt.Sprint(params["p"])
+		}
+		if got != tt.want {
+			t.Errorf("p=%q resolved to %s, want %s", tt.p, got, tt.want)
+		}
+	}
+
+	trimmed, _ := lookupOperation("trimmed_mean")
+	if _, err := trimmed.ResolveParams(map[string]string{"trim": "NaN"}); err == nil {
+		t.Error("trim=NaN was accepted")
+	}
+	if _, err := trimmed.ResolveParams(map[string]string{"tirm": "5"}); err == nil {
+		t.Error("an unknown parameter was accepted")
+	}
+}
@@ -0,0 +1,236 @@
+// parsepreview.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Separator styles a column's numbers can be read in. The empty style keeps
+// cells as they were uploaded.
+const (
+	styleGrouping     = "grouping"      // 1,234.56
+	styleDecimalComma = "decimal_comma" // 1.234,56 or 1 234,56
+)
+
+var (
+	groupedPattern      = regexp.MustCompile(`^[-+]?\d{1,3}(,\d{3})+(\.\d+)?$`)
+	decimalCommaPattern = regexp.MustCompile(`^[-+]?(\d{1,3}([. ]\d{3})+|\d+)(,\d+)?$`)
+)
+
+func styleLabel(style string) string {
+	switch style {
+	case styleGrouping:
+		return "comma thousands (1,234.56)"
+	case styleDecimalComma:
+		return "decimal comma (1.234,56)"
+	}
+	return "as uploaded"
+}
+
+// readSeparated returns s as plain decimal text when it is a number written
+// in style. Plain numbers are read as they are in either style.
+func readSeparated(s, style string) (string, bool) {
+	s = strings.TrimSpace(s)
+	switch {
+	case style == styleGrouping && groupedPattern.MatchString(s):
+		return strings.ReplaceAll(s, ",", ""), true
+	case style == styleDecimalComma && decimalCommaPattern.MatchString(s):
+		return strings.NewReplacer(".", "", " ", "", ",", ".").Replace(s), true
+	}
+	if parsesFloat(s) {
+		return s, true
+	}
+	return "", false
+}
+
+// Reinterpretation remembers the style a column was re-read in along with
+// its cells as uploaded, so the choice can be changed again later.
+type Reinterpretation struct {
+	Style string   `json:"style"`
+	Cells []string `json:"cells"`
+}
+
+// PreviewSample shows how one cell reads in each style; an empty reading
+// means the style doesn't see a number there.
+type PreviewSample struct {
+	Raw          string
+	Grouping     string
+	DecimalComma string
+}
+
+// ParsePreview summarizes a column whose values read differently depending
+// on which character is the decimal separator.
+type ParsePreview struct {
+	Column       string
+	ID           string
+	Style        string
+	StyleLabel   string
+	Samples      []PreviewSample
+	Grouping     int // cells read as numbers with comma thousands
+	DecimalComma int // cells read as numbers with a decimal comma
+	Total        int
+}
+
+const maxPreviewSamples = 3
+
+// uploadedCells returns col's cells as they were uploaded, before any
+// reinterpretation.
+func uploadedCells(data Spreadsheet, col int) []string {
+	if col < len(data.ColumnIDs) {
+		if re, ok := data.Reinterpreted[data.ColumnIDs[col]]; ok && len(re.Cells) == len(data.Rows) {
+			return re.Cells
+		}
+	}
+	cells := make([]string, len(data.Rows))
+	for i, row := range data.Rows {
+		cells[i] = cellValue(row, col)
+	}
+	return cells
+}
+
+// parsePreviews returns a preview for every column holding at least one
+// value that reads differently in the two styles.
+func parsePreviews(data Spreadsheet) []ParsePreview {
+	var out []ParsePreview
+	for col, header := range data.Headers {
+		p := ParsePreview{Column: header}
+		if col < len(data.ColumnIDs) {
+			p.ID = data.ColumnIDs[col]
+			p.Style = data.Reinterpreted[p.ID].Style
+		}
+		p.StyleLabel = styleLabel(p.Style)
+		seen := make(map[string]bool)
+		ambiguous := false
+		for _, cell := range uploadedCells(data, col) {
+			if cell == "" {
+				continue
+			}
+			p.Total++
+			g, gok := readSeparated(cell, styleGrouping)
+			d, dok := readSeparated(cell, styleDecimalComma)
+			if gok {
+				p.Grouping++
+			}
+			if dok {
+				p.DecimalComma++
+			}
+			if gok == dok && g == d {
+				continue
+			}
+			ambiguous = true
+			if !seen[cell] && len(p.Samples) < maxPreviewSamples {
+				seen[cell] = true
+				p.Samples = append(p.Samples, PreviewSample{Raw: cell, Grouping: g, DecimalComma: d})
+			}
+		}
+		if ambiguous {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// reinterpretColumn re-reads col's uploaded cells in style and returns how
+// many cells changed. Rewritten rows are copied, since rows are shared with
+// datasets derived from this one.
+func reinterpretColumn(data *Spreadsheet, col int, style string) int {
+	id := data.ColumnIDs[col]
+	cells := uploadedCells(*data, col)
+	rows := make([][]string, len(data.Rows))
+	copy(rows, data.Rows)
+	changed := 0
+	for i, cell := range cells {
+		val := cell
+		if style != "" {
+			if plain, ok := readSeparated(cell, style); ok {
+				val = plain
+			}
+		}
+		if cellValue(rows[i], col) == val {
+			continue
+		}
+		row := append([]string(nil), rows[i]...)
+		for len(row) <= col {
+			row = append(row, "")
+		}
+		row[col] = val
+		rows[i] = row
+		changed++
+	}
+	data.Rows = rows
+
+	re := make(map[string]Reinterpretation, len(data.Reinterpreted)+1)
+	for k, v := range data.Reinterpreted {
+		re[k] = v
+	}
+	if style == "" {
+		delete(re, id)
+	} else {
+		re[id] = Reinterpretation{Style: style, Cells: cells}
+	}
+	data.Reinterpreted = re
+	if len(re) == 0 {
+		data.Reinterpreted = nil
+	}
+
+	numeric := make([]int, 0, len(data.NumericCols)+1)
+	for _, c := range data.NumericCols {
+		if c != col {
+			numeric = append(numeric, c)
+		}
+	}
+	if isColumnNumeric(*data, col) {
+		numeric = append(numeric, col)
+		sort.Ints(numeric)
+	}
+	data.NumericCols = numeric
+	return changed
+}
+
+// interpretHandler switches how a column's numbers are read from the
+// display page's parse preview.
+func interpretHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	data, ok := teamDataset(r, r.FormValue("dataset"))
+	if !ok {
+		http.Error(w, "Unknown dataset", http.StatusNotFound)
+		return
+	}
+	if err := checkVersion(r, data); err != nil {
+		http.Error(w, err.Error(), updateErrorStatus(w, err))
+		return
+	}
+	style := r.FormValue("style")
+	if style != "" && style != styleGrouping && style != styleDecimalComma {
+		http.Error(w, fmt.Sprintf("Unknown number style %q", style), http.StatusBadRequest)
+		return
+	}
+	col := columnRef(data, r.FormValue("column"))
+	if col == -1 || col >= len(data.ColumnIDs) {
+		http.Error(w, "Unknown column", http.StatusBadRequest)
+		return
+	}
+	changed := reinterpretColumn(&data, col, style)
+	data.Pipeline = appendStep(data.Pipeline, "interpret_numbers", map[string]string{
+		"column": data.Headers[col],
+		"style":  styleLabel(style),
+	})
+	data.Notes = append(data.Notes, fmt.Sprintf("Read %q as %s (%d cell(s) changed)", data.Headers[col], styleLabel(style), changed))
+	if err := workspace.Update(&data); err != nil {
+		http.Error(w, err.Error(), updateErrorStatus(w, err))
+		return
+	}
+	go checkAlerts(data, "reinterpret")
+	renderDisplay(w, r, data)
+}
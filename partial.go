@@ -0,0 +1,28 @@
+// partial.go
+package main
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// Pages are built from named blocks ({{define "dataTable"}}) whose names
+// match the id of the element they render into. The page script marks its
+// background requests with HX-Request and names the element it will replace
+// in HX-Target; such a request gets just that block back instead of the
+// whole page.
+func partialTarget(r *http.Request) string {
+	if r.Header.Get("HX-Request") != "true" {
+		return ""
+	}
+	return r.Header.Get("HX-Target")
+}
+
+// renderPage executes tmpl, or only the block a partial request asked for.
+func renderPage(w http.ResponseWriter, r *http.Request, tmpl *template.Template, data interface{}) error {
+	if name := partialTarget(r); name != "" && tmpl.Lookup(name) != nil {
+		w.Header().Set("Vary", "HX-Request, HX-Target")
+		return tmpl.ExecuteTemplate(w, name, data)
+	}
+	return tmpl.Execute(w, data)
+}
@@ -0,0 +1,1193 @@
+// pdf.go
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rc4"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/ascii85"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// PDFs are read just far enough to get the text off each page along with
+// where it sits: the objects, the page tree, the fonts needed to turn
+// character codes into text, and the content stream operators that place
+// it. pdftable.go lines that text up into tables. There's no OCR, so
+// scanned statements have nothing to offer.
+
+type pdfName string
+
+type pdfKeyword string
+
+type pdfRef struct{ num, gen int }
+
+type pdfDict map[pdfName]interface{}
+
+type pdfStream struct {
+	dict pdfDict
+	raw  []byte
+	ref  pdfRef // the object it came from, which keys its decryption
+}
+
+var errPDFSyntax = errors.New("malformed PDF")
+
+type pdfLexer struct {
+	b   []byte
+	pos int
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+func isPDFDelim(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) != -1
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.b) {
+		switch c := l.b[l.pos]; {
+		case c == '%':
+			for l.pos < len(l.b) && l.b[l.pos] != '\n' && l.b[l.pos] != '\r' {
+				l.pos++
+			}
+		case isPDFSpace(c):
+			l.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (l *pdfLexer) word() string {
+	start := l.pos
+	for l.pos < len(l.b) && !isPDFSpace(l.b[l.pos]) && !isPDFDelim(l.b[l.pos]) {
+		l.pos++
+	}
+	return string(l.b[start:l.pos])
+}
+
+// next reads one object or keyword, returning io.EOF at the end. Numbers
+// come back as float64 and strings as their raw bytes in a string.
+func (l *pdfLexer) next() (interface{}, error) {
+	l.skipSpace()
+	if l.pos >= len(l.b) {
+		return nil, io.EOF
+	}
+	switch c := l.b[l.pos]; c {
+	case '/':
+		l.pos++
+		name := l.word()
+		if strings.Contains(name, "#") {
+			var b strings.Builder
+			for i := 0; i < len(name); i++ {
+				if name[i] == '#' && i+2 < len(name) {
+					if v, err := strconv.ParseUint(name[i+1:i+3], 16, 8); err == nil {
+						b.WriteByte(byte(v))
+						i += 2
+						continue
+					}
+				}
+				b.WriteByte(name[i])
+			}
+			name = b.String()
+		}
+		return pdfName(name), nil
+	case '(':
+		return l.literalString()
+	case '<':
+		if l.pos+1 < len(l.b) && l.b[l.pos+1] == '<' {
+			l.pos += 2
+			return l.dict()
+		}
+		return l.hexString()
+	case '[':
+		l.pos++
+		arr := []interface{}{}
+		for {
+			l.skipSpace()
+			if l.pos >= len(l.b) {
+				return nil, errPDFSyntax
+			}
+			if l.b[l.pos] == ']' {
+				l.pos++
+				return arr, nil
+			}
+			v, err := l.value()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+	case ']', ')', '>', '{', '}':
+		l.pos++
+		if c == '>' && l.pos < len(l.b) && l.b[l.pos] == '>' {
+			l.pos++
+			return pdfKeyword(">>"), nil
+		}
+		return pdfKeyword(string(c)), nil
+	}
+	word := l.word()
+	if word == "" {
+		l.pos++
+		return nil, errPDFSyntax
+	}
+	if c := word[0]; c >= '0' && c <= '9' || c == '-' || c == '+' || c == '.' {
+		if f, err := strconv.ParseFloat(word, 64); err == nil {
+			return f, nil
+		}
+		return 0.0, nil // a malformed number, as readers treat it
+	}
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	return pdfKeyword(word), nil
+}
+
+// value reads an object, taking "n g R" as a reference.
+func (l *pdfLexer) value() (interface{}, error) {
+	v, err := l.next()
+	if err != nil {
+		return nil, err
+	}
+	num, ok := v.(float64)
+	if !ok || num != math.Trunc(num) || num < 0 {
+		return v, nil
+	}
+	save := l.pos
+	if gen, err := l.next(); err == nil {
+		if g, ok := gen.(float64); ok && g == math.Trunc(g) {
+			if r, err := l.next(); err == nil && r == pdfKeyword("R") {
+				return pdfRef{int(num), int(g)}, nil
+			}
+		}
+	}
+	l.pos = save
+	return v, nil
+}
+
+func (l *pdfLexer) dict() (pdfDict, error) {
+	d := pdfDict{}
+	for {
+		key, err := l.next()
+		if err != nil {
+			return nil, errPDFSyntax
+		}
+		if key == pdfKeyword(">>") {
+			return d, nil
+		}
+		name, ok := key.(pdfName)
+		if !ok {
+			continue // skip junk rather than give up on the file
+		}
+		v, err := l.value()
+		if err != nil {
+			return nil, err
+		}
+		if v == pdfKeyword(">>") {
+			return d, nil
+		}
+		d[name] = v
+	}
+}
+
+func (l *pdfLexer) literalString() (string, error) {
+	l.pos++ // (
+	var b []byte
+	depth := 1
+	for l.pos < len(l.b) {
+		c := l.b[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return string(b), nil
+			}
+		case '\\':
+			if l.pos >= len(l.b) {
+				return "", errPDFSyntax
+			}
+			c = l.b[l.pos]
+			l.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r', '\n':
+				if c == '\r' && l.pos < len(l.b) && l.b[l.pos] == '\n' {
+					l.pos++
+				}
+				continue // a line continuation
+			default:
+				if c >= '0' && c <= '7' {
+					v := int(c - '0')
+					for i := 0; i < 2 && l.pos < len(l.b) && l.b[l.pos] >= '0' && l.b[l.pos] <= '7'; i++ {
+						v = v*8 + int(l.b[l.pos]-'0')
+						l.pos++
+					}
+					c = byte(v)
+				}
+			}
+		}
+		b = append(b, c)
+	}
+	return "", errPDFSyntax
+}
+
+func (l *pdfLexer) hexString() (string, error) {
+	l.pos++ // <
+	var digits []byte
+	for l.pos < len(l.b) && l.b[l.pos] != '>' {
+		if c := l.b[l.pos]; !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+		l.pos++
+	}
+	l.pos++
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	b, err := hex.DecodeString(string(digits))
+	if err != nil {
+		return "", errPDFSyntax
+	}
+	return string(b), nil
+}
+
+type pdfDoc struct {
+	objects map[int]interface{}
+	trailer pdfDict
+	crypt   *pdfCrypt
+	fonts   map[pdfRef]*pdfFont
+	decoded int64 // bytes inflated so far, across every stream
+}
+
+// pdfMaxDecoded caps what a document's streams may inflate to in all.
+// checkMemoryBudget allows opaqueExpansion bytes per byte of PDF, and a few
+// kilobytes of deflated zeros could otherwise decode to gigabytes.
+const pdfMaxDecoded = opaqueExpansion * MaxFileSize
+
+var errPDFExpands = fmt.Errorf("the PDF's compressed content expands to more than %s, which is too much to read", formatFileSize(pdfMaxDecoded))
+
+var pdfObjHeader = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+// openPDF finds every object by scanning for "n g obj" rather than trusting
+// the cross-reference table, which is often wrong in generated statements.
+// Later objects replace earlier ones, as incremental updates intend.
+func openPDF(b []byte) (*pdfDoc, error) {
+	head := b
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	if !bytes.Contains(head, []byte("%PDF-")) {
+		return nil, fmt.Errorf("not a PDF file")
+	}
+	doc := &pdfDoc{objects: make(map[int]interface{}), fonts: make(map[pdfRef]*pdfFont)}
+	var objStreams []*pdfStream
+	for pos := 0; pos < len(b); {
+		loc := pdfObjHeader.FindSubmatchIndex(b[pos:])
+		if loc == nil {
+			break
+		}
+		num, _ := strconv.Atoi(string(b[pos+loc[2] : pos+loc[3]]))
+		gen, _ := strconv.Atoi(string(b[pos+loc[4] : pos+loc[5]]))
+		l := &pdfLexer{b: b, pos: pos + loc[1]}
+		pos += loc[1]
+		v, err := l.value()
+		if err != nil {
+			continue
+		}
+		pos = l.pos
+		if d, ok := v.(pdfDict); ok {
+			if d["Type"] == pdfName("XRef") {
+				doc.trailer = d
+			}
+			l.skipSpace()
+			if bytes.HasPrefix(b[l.pos:], []byte("stream")) {
+				start := l.pos + len("stream")
+				if start < len(b) && b[start] == '\r' {
+					start++
+				}
+				if start < len(b) && b[start] == '\n' {
+					start++
+				}
+				end := -1
+				if n, ok := d["Length"].(float64); ok && n >= 0 && start+int(n) <= len(b) &&
+					bytes.HasPrefix(bytes.TrimLeft(b[start+int(n):], " \t\r\n"), []byte("endstream")) {
+					end = start + int(n)
+				}
+				if end == -1 {
+					i := bytes.Index(b[start:], []byte("endstream"))
+					if i == -1 {
+						continue
+					}
+					end = start + i
+					if end > start && b[end-1] == '\n' {
+						end--
+					}
+					if end > start && b[end-1] == '\r' {
+						end--
+					}
+				}
+				s := &pdfStream{dict: d, raw: b[start:end], ref: pdfRef{num, gen}}
+				if d["Type"] == pdfName("ObjStm") {
+					objStreams = append(objStreams, s)
+				}
+				v = s
+				pos = end
+			}
+		}
+		doc.objects[num] = v
+	}
+	if i := bytes.LastIndex(b, []byte("trailer")); i != -1 {
+		l := &pdfLexer{b: b, pos: i + len("trailer")}
+		if v, err := l.next(); err == nil {
+			if d, ok := v.(pdfDict); ok && (doc.trailer == nil || d["Root"] != nil) {
+				doc.trailer = d
+			}
+		}
+	}
+	if doc.trailer == nil {
+		doc.trailer = pdfDict{}
+	}
+	if enc := doc.dict(doc.trailer["Encrypt"]); enc != nil {
+		var id []byte
+		if ids := doc.array(doc.trailer["ID"]); len(ids) > 0 {
+			s, _ := ids[0].(string)
+			id = []byte(s)
+		}
+		crypt, err := newPDFCrypt(enc, id)
+		if err != nil {
+			return nil, err
+		}
+		doc.crypt = crypt
+	}
+
+	// Objects packed into object streams; a direct object of the same
+	// number wins.
+	packed := make(map[int]interface{})
+	for _, s := range objStreams {
+		data, err := doc.decode(s)
+		if err != nil {
+			continue
+		}
+		n, _ := s.dict["N"].(float64)
+		first, _ := s.dict["First"].(float64)
+		l := &pdfLexer{b: data}
+		type entry struct{ num, off int }
+		var entries []entry
+		for i := 0; i < int(n); i++ {
+			num, err1 := l.next()
+			off, err2 := l.next()
+			nf, ok1 := num.(float64)
+			of, ok2 := off.(float64)
+			if err1 != nil || err2 != nil || !ok1 || !ok2 {
+				break
+			}
+			entries = append(entries, entry{int(nf), int(of)})
+		}
+		for _, e := range entries {
+			pos := int(first) + e.off
+			if pos < 0 || pos >= len(data) {
+				continue
+			}
+			l := &pdfLexer{b: data, pos: pos}
+			if v, err := l.value(); err == nil {
+				packed[e.num] = v
+			}
+		}
+	}
+	for num, v := range packed {
+		if _, ok := doc.objects[num]; !ok {
+			doc.objects[num] = v
+		}
+	}
+	return doc, nil
+}
+
+func (doc *pdfDoc) resolve(v interface{}) interface{} {
+	for i := 0; i < 16; i++ {
+		ref, ok := v.(pdfRef)
+		if !ok {
+			return v
+		}
+		v = doc.objects[ref.num]
+	}
+	return nil
+}
+
+func (doc *pdfDoc) dict(v interface{}) pdfDict {
+	switch v := doc.resolve(v).(type) {
+	case pdfDict:
+		return v
+	case *pdfStream:
+		return v.dict
+	}
+	return nil
+}
+
+func (doc *pdfDoc) array(v interface{}) []interface{} {
+	a, _ := doc.resolve(v).([]interface{})
+	return a
+}
+
+func (doc *pdfDoc) number(v interface{}, fallback float64) float64 {
+	if f, ok := doc.resolve(v).(float64); ok {
+		return f
+	}
+	return fallback
+}
+
+func (doc *pdfDoc) stream(v interface{}) *pdfStream {
+	s, _ := doc.resolve(v).(*pdfStream)
+	return s
+}
+
+// decode decrypts a stream and undoes its filters.
+func (doc *pdfDoc) decode(s *pdfStream) ([]byte, error) {
+	data := s.raw
+	if doc.crypt != nil && s.dict["Type"] != pdfName("XRef") && !doc.crypt.identity {
+		var err error
+		if data, err = doc.crypt.decrypt(data, s.ref); err != nil {
+			return nil, err
+		}
+	}
+	var filters []interface{}
+	switch f := doc.resolve(s.dict["Filter"]).(type) {
+	case pdfName:
+		filters = []interface{}{f}
+	case []interface{}:
+		filters = f
+	}
+	for _, f := range filters {
+		switch doc.resolve(f) {
+		case pdfName("FlateDecode"), pdfName("Fl"):
+			r, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			// Keep what inflated even if the checksum is off, as viewers do.
+			out, err := io.ReadAll(io.LimitReader(r, pdfMaxDecoded-doc.decoded+1))
+			if doc.decoded += int64(len(out)); doc.decoded > pdfMaxDecoded {
+				return nil, errPDFExpands
+			}
+			if err != nil && len(out) == 0 {
+				return nil, err
+			}
+			data = out
+		case pdfName("ASCIIHexDecode"), pdfName("AHx"):
+			l := &pdfLexer{b: append([]byte("<"), data...)}
+			s, err := l.hexString()
+			if err != nil {
+				return nil, err
+			}
+			data = []byte(s)
+		case pdfName("ASCII85Decode"), pdfName("A85"):
+			src := bytes.TrimSpace(data)
+			src = bytes.TrimSuffix(src, []byte("~>"))
+			src = bytes.TrimPrefix(src, []byte("<~"))
+			out := make([]byte, 4*len(src))
+			n, _, err := ascii85.Decode(out, src, true)
+			if err != nil {
+				return nil, err
+			}
+			data = out[:n]
+		default:
+			return nil, fmt.Errorf("unsupported filter %v", f)
+		}
+	}
+	return data, nil
+}
+
+// pdfCrypt decrypts documents under the standard security handler, as far
+// as that's possible without a password: owner-password-only protection,
+// which is how most statements stop editing or printing.
+type pdfCrypt struct {
+	key      []byte
+	aes      bool
+	aes256   bool // one key for every object
+	identity bool // streams aren't encrypted
+}
+
+var pdfPasswordPad = []byte("\x28\xBF\x4E\x5E\x4E\x75\x8A\x41\x64\x00\x4E\x56\xFF\xFA\x01\x08\x2E\x2E\x00\xB6\xD0\x68\x3E\x80\x2F\x0C\xA9\xFE\x64\x53\x69\x7A")
+
+var errPDFPassword = errors.New("this PDF needs a password to open; save a copy without one and upload that")
+
+func newPDFCrypt(enc pdfDict, id []byte) (*pdfCrypt, error) {
+	if enc["Filter"] != pdfName("Standard") {
+		return nil, fmt.Errorf("this PDF is encrypted with %v, which isn't supported", enc["Filter"])
+	}
+	v, _ := enc["V"].(float64)
+	r, _ := enc["R"].(float64)
+	o, _ := enc["O"].(string)
+	u, _ := enc["U"].(string)
+	c := &pdfCrypt{}
+	if v >= 4 {
+		filter := pdfName("StdCF")
+		if f, ok := enc["StmF"].(pdfName); ok {
+			filter = f
+		}
+		if filter == "Identity" {
+			c.identity = true
+			return c, nil
+		}
+		cf, _ := enc["CF"].(pdfDict)
+		std, _ := cf[filter].(pdfDict)
+		switch std["CFM"] {
+		case pdfName("AESV2"):
+			c.aes = true
+		case pdfName("AESV3"):
+			c.aes, c.aes256 = true, true
+		}
+	}
+
+	if r >= 5 {
+		ue, _ := enc["UE"].(string)
+		if len(u) < 48 || len(ue) < 32 {
+			return nil, errPDFSyntax
+		}
+		hash := func(salt string) []byte {
+			if r == 5 {
+				sum := sha256.Sum256([]byte(salt))
+				return sum[:]
+			}
+			return pdfHash2B([]byte(salt))
+		}
+		if !bytes.Equal(hash(u[32:40]), []byte(u[:32])) {
+			return nil, errPDFPassword
+		}
+		block, err := aes.NewCipher(hash(u[40:48]))
+		if err != nil {
+			return nil, err
+		}
+		c.key = make([]byte, 32)
+		cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(c.key, []byte(ue[:32]))
+		c.aes, c.aes256 = true, true
+		return c, nil
+	}
+
+	n := 5
+	if length, ok := enc["Length"].(float64); ok && r >= 3 {
+		n = int(length) / 8
+	}
+	if c.aes {
+		n = 16
+	}
+	if n < 5 || n > 16 || len(o) < 32 || len(u) < 16 {
+		return nil, errPDFSyntax
+	}
+	p, _ := enc["P"].(float64)
+	h := md5.New()
+	h.Write(pdfPasswordPad)
+	h.Write([]byte(o[:32]))
+	binary.Write(h, binary.LittleEndian, uint32(int32(p)))
+	h.Write(id)
+	if r >= 4 && enc["EncryptMetadata"] == false {
+		h.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF})
+	}
+	key := h.Sum(nil)[:n]
+	if r >= 3 {
+		for i := 0; i < 50; i++ {
+			sum := md5.Sum(key)
+			key = sum[:n]
+		}
+	}
+	c.key = key
+
+	// Check the empty user password actually opens it.
+	if r == 2 {
+		check := make([]byte, 32)
+		rc, _ := rc4.NewCipher(key)
+		rc.XORKeyStream(check, pdfPasswordPad)
+		if !bytes.Equal(check, []byte(u[:32])) {
+			return nil, errPDFPassword
+		}
+		return c, nil
+	}
+	sum := md5.Sum(append(append([]byte{}, pdfPasswordPad...), id...))
+	check := sum[:]
+	for i := 0; i < 20; i++ {
+		k := make([]byte, len(key))
+		for j := range key {
+			k[j] = key[j] ^ byte(i)
+		}
+		rc, _ := rc4.NewCipher(k)
+		rc.XORKeyStream(check, check)
+	}
+	if !bytes.Equal(check, []byte(u[:16])) {
+		return nil, errPDFPassword
+	}
+	return c, nil
+}
+
+// pdfHash2B is the AES-256 (revision 6) password hash, for the empty
+// password.
+func pdfHash2B(salt []byte) []byte {
+	sum := sha256.Sum256(salt)
+	k := sum[:]
+	for i := 0; ; i++ {
+		k1 := bytes.Repeat(k, 64)
+		block, _ := aes.NewCipher(k[:16])
+		e := make([]byte, len(k1))
+		cipher.NewCBCEncrypter(block, k[16:32]).CryptBlocks(e, k1)
+		mod := 0
+		for _, b := range e[:16] {
+			mod += int(b)
+		}
+		switch mod % 3 {
+		case 0:
+			s := sha256.Sum256(e)
+			k = s[:]
+		case 1:
+			s := sha512.Sum384(e)
+			k = s[:]
+		default:
+			s := sha512.Sum512(e)
+			k = s[:]
+		}
+		if i >= 63 && int(e[len(e)-1]) <= i-31 {
+			return k[:32]
+		}
+	}
+}
+
+func (c *pdfCrypt) decrypt(data []byte, ref pdfRef) ([]byte, error) {
+	key := c.key
+	if !c.aes256 {
+		h := md5.New()
+		h.Write(c.key)
+		h.Write([]byte{byte(ref.num), byte(ref.num >> 8), byte(ref.num >> 16), byte(ref.gen), byte(ref.gen >> 8)})
+		if c.aes {
+			h.Write([]byte("sAlT"))
+		}
+		n := len(c.key) + 5
+		if n > 16 {
+			n = 16
+		}
+		key = h.Sum(nil)[:n]
+	}
+	if !c.aes {
+		out := make([]byte, len(data))
+		rc, _ := rc4.NewCipher(key)
+		rc.XORKeyStream(out, data)
+		return out, nil
+	}
+	if len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		return nil, errPDFSyntax
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(out, data[aes.BlockSize:])
+	if pad := int(out[len(out)-1]); pad >= 1 && pad <= aes.BlockSize {
+		out = out[:len(out)-pad]
+	}
+	return out, nil
+}
+
+type pdfPage struct {
+	number    int
+	resources pdfDict
+	contents  []byte
+}
+
+// pages walks the page tree in order.
+func (doc *pdfDoc) pages() []pdfPage {
+	root := doc.dict(doc.trailer["Root"])
+	if root == nil {
+		for _, v := range doc.objects {
+			if d, ok := v.(pdfDict); ok && d["Type"] == pdfName("Catalog") {
+				root = d
+				break
+			}
+		}
+	}
+	var pages []pdfPage
+	seen := make(map[pdfRef]bool)
+	var walk func(node interface{}, resources pdfDict, depth int)
+	walk = func(node interface{}, resources pdfDict, depth int) {
+		if ref, ok := node.(pdfRef); ok {
+			if seen[ref] {
+				return
+			}
+			seen[ref] = true
+		}
+		d := doc.dict(node)
+		if d == nil || depth > 64 {
+			return
+		}
+		if res := doc.dict(d["Resources"]); res != nil {
+			resources = res
+		}
+		if kids := doc.array(d["Kids"]); d["Type"] != pdfName("Page") && kids != nil {
+			for _, kid := range kids {
+				walk(kid, resources, depth+1)
+			}
+			return
+		}
+		page := pdfPage{number: len(pages) + 1, resources: resources}
+		contents := doc.resolve(d["Contents"])
+		if arr, ok := contents.([]interface{}); ok {
+			for _, c := range arr {
+				if s := doc.stream(c); s != nil {
+					if data, err := doc.decode(s); err == nil {
+						page.contents = append(append(page.contents, data...), '\n')
+					}
+				}
+			}
+		} else if s, ok := contents.(*pdfStream); ok {
+			page.contents, _ = doc.decode(s)
+		}
+		pages = append(pages, page)
+	}
+	if root != nil {
+		walk(root["Pages"], nil, 0)
+	}
+	return pages
+}
+
+// pdfFont turns a font's character codes into text and widths.
+type pdfFont struct {
+	twoByte      bool
+	toUnicode    map[int]string
+	encoding     [256]string
+	widths       map[int]float64 // thousandths of the font size
+	defaultWidth float64
+}
+
+var pdfGlyphNames = map[string]string{
+	"space": " ", "exclam": "!", "quotedbl": "\"", "numbersign": "#", "dollar": "$", "percent": "%",
+	"ampersand": "&", "quotesingle": "'", "quoteright": "’", "quoteleft": "‘", "parenleft": "(",
+	"parenright": ")", "asterisk": "*", "plus": "+", "comma": ",", "hyphen": "-", "minus": "−",
+	"period": ".", "slash": "/", "zero": "0", "one": "1", "two": "2", "three": "3", "four": "4",
+	"five": "5", "six": "6", "seven": "7", "eight": "8", "nine": "9", "colon": ":", "semicolon": ";",
+	"less": "<", "equal": "=", "greater": ">", "question": "?", "at": "@", "bracketleft": "[",
+	"backslash": "\\", "bracketright": "]", "underscore": "_", "braceleft": "{", "bar": "|",
+	"braceright": "}", "endash": "–", "emdash": "—", "Euro": "€", "sterling": "£", "yen": "¥",
+	"cent": "¢", "degree": "°", "bullet": "•", "fi": "fi", "fl": "fl", "quotedblleft": "“",
+	"quotedblright": "”", "ellipsis": "…", "nbspace": " ", "section": "§", "copyright": "©",
+	"registered": "®", "eacute": "é", "egrave": "è", "aacute": "á", "agrave": "à", "udieresis": "ü",
+	"odieresis": "ö", "adieresis": "ä", "ccedilla": "ç", "germandbls": "ß",
+}
+
+func pdfGlyphText(name string) string {
+	if s, ok := pdfGlyphNames[name]; ok {
+		return s
+	}
+	if len(name) == 1 {
+		return name
+	}
+	for _, prefix := range []string{"uni", "u"} {
+		if hexPart := strings.TrimPrefix(name, prefix); hexPart != name && len(hexPart) >= 4 && len(hexPart) <= 6 {
+			if v, err := strconv.ParseUint(hexPart[:4], 16, 32); err == nil && prefix == "uni" {
+				return string(rune(v))
+			}
+			if v, err := strconv.ParseUint(hexPart, 16, 32); err == nil {
+				return string(rune(v))
+			}
+		}
+	}
+	return ""
+}
+
+func (doc *pdfDoc) font(v interface{}) *pdfFont {
+	ref, isRef := v.(pdfRef)
+	if f, ok := doc.fonts[ref]; isRef && ok {
+		return f
+	}
+	d := doc.dict(v)
+	f := &pdfFont{widths: make(map[int]float64), defaultWidth: 500}
+	if isRef {
+		doc.fonts[ref] = f
+	}
+	if d == nil {
+		return f
+	}
+	scale := 1.0
+	if d["Subtype"] == pdfName("Type3") {
+		if m := doc.array(d["FontMatrix"]); len(m) > 0 {
+			scale = doc.number(m[0], 0.001) * 1000
+		}
+	}
+	if d["Subtype"] == pdfName("Type0") {
+		f.twoByte = true
+		f.defaultWidth = 1000
+		if desc := doc.array(d["DescendantFonts"]); len(desc) > 0 {
+			cid := doc.dict(desc[0])
+			f.defaultWidth = doc.number(cid["DW"], 1000)
+			w := doc.array(cid["W"])
+			for i := 0; i+1 < len(w); {
+				first := int(doc.number(w[i], 0))
+				if list := doc.array(w[i+1]); list != nil {
+					for j, width := range list {
+						f.widths[first+j] = doc.number(width, f.defaultWidth)
+					}
+					i += 2
+					continue
+				}
+				if i+2 >= len(w) {
+					break
+				}
+				last, width := int(doc.number(w[i+1], 0)), doc.number(w[i+2], f.defaultWidth)
+				for c := first; c <= last && c-first < 65536; c++ {
+					f.widths[c] = width
+				}
+				i += 3
+			}
+		}
+	} else {
+		base := charmap.Windows1252
+		enc := doc.resolve(d["Encoding"])
+		encDict, _ := enc.(pdfDict)
+		if enc == pdfName("MacRomanEncoding") || encDict["BaseEncoding"] == pdfName("MacRomanEncoding") {
+			base = charmap.Macintosh
+		}
+		for c := 0; c < 256; c++ {
+			if r := base.DecodeByte(byte(c)); r != 0xFFFD {
+				f.encoding[c] = string(r)
+			}
+		}
+		code := 0
+		for _, item := range doc.array(encDict["Differences"]) {
+			switch item := item.(type) {
+			case float64:
+				code = int(item)
+			case pdfName:
+				if code >= 0 && code < 256 {
+					if s := pdfGlyphText(string(item)); s != "" {
+						f.encoding[code] = s
+					}
+				}
+				code++
+			}
+		}
+		if desc := doc.dict(d["FontDescriptor"]); desc != nil {
+			f.defaultWidth = doc.number(desc["MissingWidth"], f.defaultWidth)
+		}
+		if base, _ := d["BaseFont"].(pdfName); strings.Contains(string(base), "Courier") {
+			f.defaultWidth = 600
+		}
+		first := int(doc.number(d["FirstChar"], 0))
+		for i, w := range doc.array(d["Widths"]) {
+			f.widths[first+i] = doc.number(w, f.defaultWidth) * scale
+		}
+	}
+	if s := doc.stream(d["ToUnicode"]); s != nil {
+		if data, err := doc.decode(s); err == nil {
+			f.toUnicode = parseToUnicode(data)
+		}
+	}
+	return f
+}
+
+// parseToUnicode reads the bfchar and bfrange mappings of a ToUnicode CMap.
+func parseToUnicode(data []byte) map[int]string {
+	m := make(map[int]string)
+	code := func(v interface{}) int {
+		s, _ := v.(string)
+		n := 0
+		for i := 0; i < len(s); i++ {
+			n = n<<8 | int(s[i])
+		}
+		return n
+	}
+	text := func(v interface{}) string {
+		s, _ := v.(string)
+		units := make([]uint16, len(s)/2)
+		for i := range units {
+			units[i] = uint16(s[2*i])<<8 | uint16(s[2*i+1])
+		}
+		return string(utf16.Decode(units))
+	}
+	l := &pdfLexer{b: data}
+	var operands []interface{}
+	for {
+		v, err := l.value()
+		if err != nil {
+			break
+		}
+		kw, ok := v.(pdfKeyword)
+		if !ok {
+			operands = append(operands, v)
+			continue
+		}
+		switch kw {
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				m[code(operands[i])] = text(operands[i+1])
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				lo, hi := code(operands[i]), code(operands[i+1])
+				if hi-lo > 65535 {
+					continue
+				}
+				if list, ok := operands[i+2].([]interface{}); ok {
+					for j, dst := range list {
+						m[lo+j] = text(dst)
+					}
+					continue
+				}
+				dst := []rune(text(operands[i+2]))
+				if len(dst) == 0 {
+					continue
+				}
+				for c := lo; c <= hi; c++ {
+					out := append([]rune{}, dst...)
+					out[len(out)-1] += rune(c - lo)
+					m[c] = string(out)
+				}
+			}
+		}
+		operands = operands[:0]
+	}
+	return m
+}
+
+// codes splits a shown string into character codes.
+func (f *pdfFont) codes(s string) []int {
+	var codes []int
+	if f.twoByte {
+		for i := 0; i+1 < len(s); i += 2 {
+			codes = append(codes, int(s[i])<<8|int(s[i+1]))
+		}
+		return codes
+	}
+	for i := 0; i < len(s); i++ {
+		codes = append(codes, int(s[i]))
+	}
+	return codes
+}
+
+func (f *pdfFont) text(code int) string {
+	if s, ok := f.toUnicode[code]; ok {
+		return s
+	}
+	if f.twoByte {
+		return string(rune(code)) // Identity without a ToUnicode map: a guess
+	}
+	return f.encoding[code&0xFF]
+}
+
+func (f *pdfFont) width(code int) float64 {
+	if w, ok := f.widths[code]; ok {
+		return w
+	}
+	return f.defaultWidth
+}
+
+// pdfMatrix is [a b c d e f], mapping (x, y) to (ax+cy+e, bx+dy+f).
+type pdfMatrix [6]float64
+
+var pdfIdentity = pdfMatrix{1, 0, 0, 1, 0, 0}
+
+func (m pdfMatrix) mul(n pdfMatrix) pdfMatrix {
+	return pdfMatrix{
+		m[0]*n[0] + m[1]*n[2], m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2], m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4], m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+// pdfGlyph is one character as placed on the page: its baseline start and
+// end in page space, its size, and how wide a space is in its font.
+type pdfGlyph struct {
+	x, end, y, size, space float64
+	text                   string
+}
+
+type pdfGraphicsState struct {
+	ctm                                            pdfMatrix
+	font                                           *pdfFont
+	fontSize, charSpace, wordSpace, scale, leading float64
+	rise                                           float64
+}
+
+// glyphs runs a page's content stream and collects the text it draws.
+func (doc *pdfDoc) glyphs(page pdfPage) []pdfGlyph {
+	var out []pdfGlyph
+	doc.run(page.contents, page.resources, pdfIdentity, &out, 0)
+	return out
+}
+
+func (doc *pdfDoc) run(content []byte, resources pdfDict, ctm pdfMatrix, out *[]pdfGlyph, depth int) {
+	gs := pdfGraphicsState{ctm: ctm, font: &pdfFont{defaultWidth: 500}, scale: 100}
+	var stack []pdfGraphicsState
+	var tm, tlm pdfMatrix
+	fonts := doc.dict(resources["Font"])
+	xobjects := doc.dict(resources["XObject"])
+	num := func(ops []interface{}, i int) float64 {
+		if i < len(ops) {
+			f, _ := ops[i].(float64)
+			return f
+		}
+		return 0
+	}
+	show := func(s string) {
+		f, th := gs.font, gs.scale/100
+		for _, code := range f.codes(s) {
+			w := f.width(code) / 1000
+			trm := pdfMatrix{gs.fontSize * th, 0, 0, gs.fontSize, 0, gs.rise}.mul(tm).mul(gs.ctm)
+			// Upright text only; rotated labels don't belong to table rows.
+			if text := f.text(code); text != "" && trm[0] > 0 && math.Abs(trm[1]) < 0.01*trm[0] && math.Abs(trm[2]) < 0.01*trm[0] {
+				space := 0.0
+				if !f.twoByte {
+					space = f.width(32) / 1000 * trm[0]
+				}
+				*out = append(*out, pdfGlyph{x: trm[4], end: trm[4] + w*trm[0], y: trm[5], size: math.Hypot(trm[2], trm[3]), space: space, text: text})
+			}
+			tx := w*gs.fontSize + gs.charSpace
+			if code == 32 && !f.twoByte {
+				tx += gs.wordSpace
+			}
+			tm = pdfMatrix{1, 0, 0, 1, tx * th, 0}.mul(tm)
+		}
+	}
+	nextLine := func(tx, ty float64) {
+		tlm = pdfMatrix{1, 0, 0, 1, tx, ty}.mul(tlm)
+		tm = tlm
+	}
+
+	l := &pdfLexer{b: content}
+	var ops []interface{}
+	for {
+		v, err := l.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			ops = ops[:0]
+			continue
+		}
+		kw, ok := v.(pdfKeyword)
+		if !ok {
+			ops = append(ops, v)
+			continue
+		}
+		switch kw {
+		case "q":
+			stack = append(stack, gs)
+		case "Q":
+			if len(stack) > 0 {
+				gs = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+		case "cm":
+			gs.ctm = pdfMatrix{num(ops, 0), num(ops, 1), num(ops, 2), num(ops, 3), num(ops, 4), num(ops, 5)}.mul(gs.ctm)
+		case "BT":
+			tm, tlm = pdfIdentity, pdfIdentity
+		case "Tf":
+			if len(ops) >= 2 {
+				name, _ := ops[0].(pdfName)
+				gs.font = doc.font(fonts[name])
+				gs.fontSize = num(ops, 1)
+			}
+		case "Tc":
+			gs.charSpace = num(ops, 0)
+		case "Tw":
+			gs.wordSpace = num(ops, 0)
+		case "Tz":
+			gs.scale = num(ops, 0)
+		case "TL":
+			gs.leading = num(ops, 0)
+		case "Ts":
+			gs.rise = num(ops, 0)
+		case "Td":
+			nextLine(num(ops, 0), num(ops, 1))
+		case "TD":
+			gs.leading = -num(ops, 1)
+			nextLine(num(ops, 0), num(ops, 1))
+		case "Tm":
+			tlm = pdfMatrix{num(ops, 0), num(ops, 1), num(ops, 2), num(ops, 3), num(ops, 4), num(ops, 5)}
+			tm = tlm
+		case "T*":
+			nextLine(0, -gs.leading)
+		case "Tj", "'", "\"":
+			if kw == "\"" && len(ops) == 3 {
+				gs.wordSpace, gs.charSpace = num(ops, 0), num(ops, 1)
+			}
+			if kw != "Tj" {
+				nextLine(0, -gs.leading)
+			}
+			if len(ops) > 0 {
+				s, _ := ops[len(ops)-1].(string)
+				show(s)
+			}
+		case "TJ":
+			if len(ops) > 0 {
+				items, _ := ops[0].([]interface{})
+				for _, item := range items {
+					switch item := item.(type) {
+					case string:
+						show(item)
+					case float64:
+						tm = pdfMatrix{1, 0, 0, 1, -item / 1000 * gs.fontSize * gs.scale / 100, 0}.mul(tm)
+					}
+				}
+			}
+		case "Do":
+			if len(ops) > 0 && depth < 8 {
+				name, _ := ops[0].(pdfName)
+				if s := doc.stream(xobjects[name]); s != nil && s.dict["Subtype"] == pdfName("Form") {
+					if data, err := doc.decode(s); err == nil {
+						m := pdfIdentity
+						if a := doc.array(s.dict["Matrix"]); len(a) == 6 {
+							for i := range m {
+								m[i] = doc.number(a[i], m[i])
+							}
+						}
+						res := doc.dict(s.dict["Resources"])
+						if res == nil {
+							res = resources
+						}
+						doc.run(data, res, m.mul(gs.ctm), out, depth+1)
+					}
+				}
+			}
+		case "BI":
+			// Skip an inline image's data, which isn't made of tokens.
+			if i := bytes.Index(l.b[l.pos:], []byte("ID")); i != -1 {
+				l.pos += i + 2
+				for j := l.pos; j+2 <= len(l.b); j++ {
+					if l.b[j] == 'E' && l.b[j+1] == 'I' && isPDFSpace(l.b[j-1]) && (j+2 == len(l.b) || isPDFSpace(l.b[j+2])) {
+						l.pos = j + 2
+						break
+					}
+				}
+			}
+		}
+		ops = ops[:0]
+	}
+}
@@ -0,0 +1,102 @@
+// pdf_test.go
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func deflate(b []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+// deflatedZeros is n zero bytes deflated, without holding them all at once.
+func deflatedZeros(n int) []byte {
+	var buf bytes.Buffer
+	w, _ := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	chunk := make([]byte, 1<<20)
+	for ; n > len(chunk); n -= len(chunk) {
+		w.Write(chunk)
+	}
+	w.Write(chunk[:n])
+	w.Close()
+	return buf.Bytes()
+}
+
+// pdfStreamObj is a stream object's text with the given filter.
+func pdfStreamObj(num int, filter string, data []byte) string {
+	return fmt.Sprintf("%d 0 obj\n<< /Length %d /Filter %s >>\nstream\n%s\nendstream\nendobj\n", num, len(data), filter, data)
+}
+
+// testPDF is a document with a page for each content stream.
+func testPDF(filter string, contents ...[]byte) []byte {
+	var kids, objs strings.Builder
+	for i, c := range contents {
+		page, stream := 3+2*i, 4+2*i
+		fmt.Fprintf(&kids, "%d 0 R ", page)
+		fmt.Fprintf(&objs, "%d 0 obj\n<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents %d 0 R >>\nendobj\n", page, stream)
+		objs.WriteString(pdfStreamObj(stream, filter, c))
+	}
+	return []byte(fmt.Sprintf("%%PDF-1.4\n1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n"+
+		"2 0 obj\n<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n%strailer\n<< /Root 1 0 R >>\n%%%%EOF\n",
+		kids.String(), len(contents), objs.String()))
+}
+
+func TestPDFDecodeFilters(t *testing.T) {
+	text := []byte("BT /F1 12 Tf 72 720 Td (Amount) Tj ET")
+	doc := &pdfDoc{objects: map[int]interface{}{}}
+	for filter, raw := range map[string][]byte{
+		"/FlateDecode":                     deflate(text),
+		"[/FlateDecode /FlateDecode]":      deflate(deflate(text)),
+		"[/ASCIIHexDecode /FlateDecode]":   []byte(fmt.Sprintf("%x>", deflate(text))),
+		"[/ASCII85Decode /ASCIIHexDecode]": []byte("<~1bggB1c%;~>"), // "414243>"
+	} {
+		doc.decoded = 0
+		l := &pdfLexer{b: []byte(filter)}
+		f, err := l.value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := doc.decode(&pdfStream{dict: pdfDict{"Filter": f}, raw: raw})
+		want := text
+		if strings.HasPrefix(filter, "[/ASCII85") {
+			want = []byte("ABC")
+		}
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: %q, %v", filter, got, err)
+		}
+	}
+}
+
+// A few kilobytes of deflated zeros mustn't be inflated past the limit,
+// whether in one stream, through chained filters or across several.
+func TestPDFInflateLimit(t *testing.T) {
+	over := deflatedZeros(pdfMaxDecoded + 1)
+	third := deflatedZeros(pdfMaxDecoded/3 + 1)
+	for name, file := range map[string][]byte{
+		"one stream": testPDF("/FlateDecode", over),
+		"chained":    testPDF("[/FlateDecode /FlateDecode]", deflate(over)),
+		"in total":   testPDF("/FlateDecode", third, third, third),
+	} {
+		if len(file) > MaxFileSize {
+			t.Fatalf("%s: the test file is %d bytes", name, len(file))
+		}
+		if _, _, err := processPDF(bytes.NewReader(file), "", 100); !errors.Is(err, errPDFExpands) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+
+	// Under the limit, the same streams are read: they hold no text.
+	file := testPDF("/FlateDecode", third, third)
+	if _, _, err := processPDF(bytes.NewReader(file), "", 100); err == nil || errors.Is(err, errPDFExpands) {
+		t.Errorf("two thirds of the limit: got %v", err)
+	}
+}
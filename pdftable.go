@@ -0,0 +1,461 @@
+// pdftable.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Turning a PDF page's text back into tables: glyphs on the same baseline
+// make a line, wide gaps split a line into chunks, and runs of lines with
+// several chunks make a table whose columns are where those chunks sit.
+// Rows that don't fit the columns are kept but reported, since a statement
+// that's been read wrongly is worse than one that can't be read.
+
+// PDFRowIssue is a row that didn't line up with its table's columns.
+type PDFRowIssue struct {
+	Row    int    `json:"row"` // 1-based, among the table's data rows
+	Page   int    `json:"page"`
+	Reason string `json:"reason"`
+	Text   string `json:"text"`
+}
+
+// PDFTableInfo describes a table found in a PDF.
+type PDFTableInfo struct {
+	Name    string        `json:"name"` // "Page 2", "Page 2, table 2" or "Pages 2–4"
+	Pages   []int         `json:"pages"`
+	Columns int           `json:"columns"`
+	Rows    int           `json:"rows"`
+	Flagged []PDFRowIssue `json:"flagged,omitempty"`
+
+	headers []string
+	rows    [][]string
+}
+
+type pdfChunk struct {
+	x0, x1 float64
+	text   string
+}
+
+type pdfLine struct {
+	y, size float64
+	chunks  []pdfChunk
+}
+
+func (l pdfLine) text() string {
+	parts := make([]string, len(l.chunks))
+	for i, c := range l.chunks {
+		parts[i] = c.text
+	}
+	return strings.Join(parts, "  ")
+}
+
+// pdfLines groups a page's glyphs into lines, top to bottom, each split into
+// chunks wherever the gap is too wide to be a space between words.
+func pdfLines(glyphs []pdfGlyph) []pdfLine {
+	var kept []pdfGlyph
+	seen := make(map[[3]int]bool) // overprinted text, as used for fake bold
+	for _, g := range glyphs {
+		if strings.TrimSpace(g.text) == "" || g.size <= 0 {
+			continue
+		}
+		key := [3]int{int(math.Round(g.x * 2)), int(math.Round(g.y * 2)), len(g.text)}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		kept = append(kept, g)
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].y > kept[j].y })
+
+	var lines []pdfLine
+	var group []pdfGlyph
+	flush := func() {
+		if len(group) == 0 {
+			return
+		}
+		sort.SliceStable(group, func(i, j int) bool { return group[i].x < group[j].x })
+		line := pdfLine{y: group[0].y}
+		var chunk *pdfChunk
+		prevEnd, prevSpace := 0.0, 0.0
+		for _, g := range group {
+			line.size = math.Max(line.size, g.size)
+			gap := g.x - prevEnd
+			split := math.Max(0.5*g.size, 1.6*math.Max(prevSpace, g.space))
+			switch {
+			case chunk == nil || gap > split:
+				line.chunks = append(line.chunks, pdfChunk{x0: g.x, x1: g.end, text: g.text})
+				chunk = &line.chunks[len(line.chunks)-1]
+			default:
+				if gap > 0.12*g.size {
+					chunk.text += " "
+				}
+				chunk.text += g.text
+				chunk.x1 = math.Max(chunk.x1, g.end)
+			}
+			prevEnd, prevSpace = g.end, g.space
+		}
+		lines = append(lines, line)
+		group = group[:0]
+	}
+	for _, g := range kept {
+		if len(group) > 0 && math.Abs(group[0].y-g.y) > 0.35*math.Max(group[0].size, g.size) {
+			flush()
+		}
+		group = append(group, g)
+	}
+	flush()
+	return lines
+}
+
+// pdfBlocks finds the runs of lines that look like a table: at least three
+// lines of two or more chunks, with single-chunk lines allowed between them
+// as wrapped text, and no gap bigger than a couple of lines.
+func pdfBlocks(lines []pdfLine) [][]pdfLine {
+	var blocks [][]pdfLine
+	var block []pdfLine
+	end := func() {
+		for len(block) > 0 && len(block[len(block)-1].chunks) < 2 {
+			block = block[:len(block)-1]
+		}
+		multi := 0
+		for _, l := range block {
+			if len(l.chunks) >= 2 {
+				multi++
+			}
+		}
+		if multi >= 3 {
+			blocks = append(blocks, block)
+		}
+		block = nil
+	}
+	for _, l := range lines {
+		if len(block) > 0 {
+			prev := block[len(block)-1]
+			if prev.y-l.y > 2.5*math.Max(prev.size, l.size) {
+				end()
+			}
+		}
+		if len(block) == 0 && len(l.chunks) < 2 {
+			continue
+		}
+		block = append(block, l)
+	}
+	end()
+	return blocks
+}
+
+func pdfOverlap(a0, a1, b0, b1 float64) float64 {
+	return math.Min(a1, b1) - math.Max(a0, b0)
+}
+
+// pdfColumns places a block's columns. The lines with the most chunks go
+// first, so the header usually lays them all out; a chunk that overlaps two
+// columns already placed is text running over and doesn't join them.
+func pdfColumns(block []pdfLine) [][2]float64 {
+	var multi []pdfLine
+	for _, l := range block {
+		if len(l.chunks) >= 2 {
+			multi = append(multi, l)
+		}
+	}
+	sort.SliceStable(multi, func(i, j int) bool { return len(multi[i].chunks) > len(multi[j].chunks) })
+	var cols [][2]float64
+	for _, l := range multi {
+		for _, c := range l.chunks {
+			hit := -1
+			hits := 0
+			for i, col := range cols {
+				if pdfOverlap(c.x0, c.x1, col[0], col[1]) > 0 {
+					hit = i
+					hits++
+				}
+			}
+			switch hits {
+			case 0:
+				cols = append(cols, [2]float64{c.x0, c.x1})
+			case 1:
+				cols[hit] = [2]float64{math.Min(cols[hit][0], c.x0), math.Max(cols[hit][1], c.x1)}
+			}
+		}
+	}
+	sort.Slice(cols, func(i, j int) bool { return cols[i][0] < cols[j][0] })
+
+	// Neighbours that never both have a value on one line are one column
+	// whose header and values are aligned differently.
+	for i := 0; i+1 < len(cols); {
+		both := false
+		for _, l := range multi {
+			a, b := false, false
+			for _, c := range l.chunks {
+				switch pdfColumnOf(cols, c) {
+				case i:
+					a = true
+				case i + 1:
+					b = true
+				}
+			}
+			if a && b {
+				both = true
+				break
+			}
+		}
+		if both {
+			i++
+			continue
+		}
+		cols[i][1] = math.Max(cols[i][1], cols[i+1][1])
+		cols = append(cols[:i+1], cols[i+2:]...)
+	}
+	return cols
+}
+
+// pdfColumnOf is the column a chunk overlaps most, or failing that the
+// nearest one.
+func pdfColumnOf(cols [][2]float64, c pdfChunk) int {
+	best, bestOverlap := -1, 0.0
+	for i, col := range cols {
+		if o := pdfOverlap(c.x0, c.x1, col[0], col[1]); o > bestOverlap {
+			best, bestOverlap = i, o
+		}
+	}
+	if best != -1 {
+		return best
+	}
+	bestDist := math.Inf(1)
+	for i, col := range cols {
+		if d := math.Min(math.Abs(c.x0-col[1]), math.Abs(col[0]-c.x1)); d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return best
+}
+
+var pdfValuePattern = regexp.MustCompile(`^[-+(]?[^\sA-Za-z\d]?\s?\d`)
+
+func looksLikeValue(s string) bool {
+	_, isDate := parseDate(s)
+	return isDate || pdfValuePattern.MatchString(s)
+}
+
+// pdfTable lays a block's lines out as rows.
+func pdfTable(block []pdfLine, page int) PDFTableInfo {
+	cols := pdfColumns(block)
+	t := PDFTableInfo{Pages: []int{page}, Columns: len(cols)}
+	type pending struct {
+		row    []string
+		issues []string
+		text   string
+	}
+	var rows []pending
+	for _, l := range block {
+		row := make([]string, len(cols))
+		var issues []string
+		for _, c := range l.chunks {
+			col := pdfColumnOf(cols, c)
+			spans := 0
+			for _, other := range cols {
+				if pdfOverlap(c.x0, c.x1, other[0], other[1]) > 0.5 {
+					spans++
+				}
+			}
+			switch {
+			case spans > 1:
+				issues = append(issues, "spans columns")
+			case pdfOverlap(c.x0, c.x1, cols[col][0], cols[col][1]) <= 0:
+				issues = append(issues, "between columns")
+			}
+			if row[col] != "" {
+				issues = append(issues, "two values in one column")
+				row[col] += " "
+			}
+			row[col] += c.text
+		}
+		// A lone chunk past the first column is text wrapped from the row
+		// above.
+		if len(l.chunks) == 1 && len(rows) > 0 && pdfColumnOf(cols, l.chunks[0]) > 0 && len(issues) == 0 {
+			prev := &rows[len(rows)-1]
+			for i, v := range row {
+				if v != "" {
+					if prev.row[i] != "" {
+						prev.row[i] += " "
+					}
+					prev.row[i] += v
+				}
+			}
+			prev.text += " / " + l.text()
+			continue
+		}
+		rows = append(rows, pending{row: row, issues: issues, text: l.text()})
+	}
+
+	header := make([]string, len(cols))
+	if len(rows) > 0 {
+		isHeader := true
+		for _, v := range rows[0].row {
+			if looksLikeValue(v) {
+				isHeader = false
+				break
+			}
+		}
+		if isHeader {
+			header = rows[0].row
+			rows = rows[1:]
+		}
+	}
+	t.headers = header
+	for _, p := range rows {
+		t.rows = append(t.rows, p.row)
+		if len(p.issues) > 0 {
+			reasons := make([]string, 0, len(p.issues))
+			for _, r := range p.issues {
+				if !slices.Contains(reasons, r) {
+					reasons = append(reasons, r)
+				}
+			}
+			t.Flagged = append(t.Flagged, PDFRowIssue{Row: len(t.rows), Page: page, Reason: strings.Join(reasons, ", "), Text: p.text})
+		}
+	}
+	return t
+}
+
+func (t PDFTableInfo) hasHeader() bool {
+	return strings.Join(t.headers, "") != ""
+}
+
+// pdfTables finds the tables on every page, joining a table that carries on
+// over a page break: the next page's first table repeats its header, or has
+// none and the same number of columns.
+func pdfTables(doc *pdfDoc) ([]PDFTableInfo, bool) {
+	var tables []PDFTableInfo
+	anyText := false
+	for _, page := range doc.pages() {
+		glyphs := doc.glyphs(page)
+		if len(glyphs) > 0 {
+			anyText = true
+		}
+		blocks := pdfBlocks(pdfLines(glyphs))
+		for i, block := range blocks {
+			t := pdfTable(block, page.number)
+			if i == 0 && len(tables) > 0 {
+				prev := &tables[len(tables)-1]
+				last := prev.Pages[len(prev.Pages)-1]
+				sameHeader := t.hasHeader() && strings.Join(t.headers, "\x00") == strings.Join(prev.headers, "\x00")
+				continues := !t.hasHeader() && t.Columns == prev.Columns
+				if last == page.number-1 && (sameHeader || continues) {
+					for _, issue := range t.Flagged {
+						issue.Row += len(prev.rows)
+						prev.Flagged = append(prev.Flagged, issue)
+					}
+					prev.rows = append(prev.rows, t.rows...)
+					prev.Pages = append(prev.Pages, page.number)
+					continue
+				}
+			}
+			tables = append(tables, t)
+		}
+	}
+
+	perPage := make(map[int]int)
+	for _, t := range tables {
+		perPage[t.Pages[0]]++
+	}
+	counted := make(map[int]int)
+	for i := range tables {
+		t := &tables[i]
+		first := t.Pages[0]
+		counted[first]++
+		switch {
+		case len(t.Pages) > 1:
+			t.Name = fmt.Sprintf("Pages %d–%d", first, t.Pages[len(t.Pages)-1])
+		case perPage[first] > 1:
+			t.Name = fmt.Sprintf("Page %d, table %d", first, counted[first])
+		default:
+			t.Name = fmt.Sprintf("Page %d", first)
+		}
+		t.Rows = len(t.rows)
+	}
+	return tables, anyText
+}
+
+func largestPDFTable(tables []PDFTableInfo) PDFTableInfo {
+	table := tables[0]
+	for _, t := range tables[1:] {
+		if t.Rows > table.Rows {
+			table = t
+		}
+	}
+	return table
+}
+
+// processPDF imports one table from a text-based PDF, the one called name or
+// else the biggest, reading at most limit rows of it. It also returns every
+// table found, for choosing between them.
+func processPDF(file io.Reader, name string, limit int) (Spreadsheet, []PDFTableInfo, error) {
+	var data Spreadsheet
+	b, err := io.ReadAll(io.LimitReader(file, MaxFileSize+1))
+	if err != nil {
+		return data, nil, err
+	}
+	doc, err := openPDF(b)
+	if err != nil {
+		return data, nil, err
+	}
+	tables, anyText := pdfTables(doc)
+	// Streams that failed to decode are skipped as unreadable, which would
+	// hide why the rest of the document is missing.
+	if doc.decoded > pdfMaxDecoded {
+		return data, nil, errPDFExpands
+	}
+	if !anyText {
+		return data, nil, fmt.Errorf("the PDF has no text to read; scanned documents aren't supported")
+	}
+	if len(tables) == 0 {
+		return data, nil, fmt.Errorf("no tables found in the PDF's text")
+	}
+
+	table := largestPDFTable(tables)
+	if name != "" {
+		found := false
+		for _, t := range tables {
+			if t.Name == name {
+				table, found = t, true
+				break
+			}
+		}
+		if !found {
+			names := make([]string, len(tables))
+			for i, t := range tables {
+				names[i] = t.Name
+			}
+			return data, tables, fmt.Errorf("no table %q; the PDF has %s", name, strings.Join(names, ", "))
+		}
+	}
+
+	data.Headers = dedupeHeaders(normalizeHeaders(table.headers))
+	data.Rows = table.rows
+	if len(data.Rows) > limit {
+		data.Rows = data.Rows[:limit]
+	}
+	if len(tables) > 1 {
+		data.Notes = append(data.Notes, fmt.Sprintf("Imported the table on %s, one of %d found in the PDF", strings.ToLower(table.Name[:1])+table.Name[1:], len(tables)))
+	}
+	data.Notes = append(data.Notes, fmt.Sprintf("%d of %d rows lined up cleanly with the columns", table.Rows-len(table.Flagged), table.Rows))
+	if len(table.Flagged) > 0 {
+		rows := make([]string, 0, 10)
+		for _, issue := range table.Flagged {
+			if len(rows) == 10 {
+				rows = append(rows, "…")
+				break
+			}
+			rows = append(rows, fmt.Sprint(issue.Row))
+		}
+		data.Notes = append(data.Notes, "Check rows "+strings.Join(rows, ", ")+" against the PDF")
+	}
+	return data, tables, nil
+}
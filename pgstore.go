@@ -0,0 +1,537 @@
+// pgstore.go
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// postgresState is the StateBackend for postgres:// URLs, for deployments
+// that run one managed database rather than a shared volume. Besides the
+// keys, locks and counters every backend has, it stores datasets in their
+// own table (see pgDatasets), keeps the JSON files under DATA_DIR as rows of
+// documents and records changes to datasets in audit_log. The schema is
+// created and upgraded by pgMigrations when a replica starts.
+type postgresState struct {
+	db *pgDB
+}
+
+// pgMigrations are applied in order, each once, recorded by index in
+// schema_migrations. Only ever append to this list.
+var pgMigrations = []string{
+	`CREATE TABLE kv (
+		key        text PRIMARY KEY,
+		value      bytea NOT NULL,
+		expires_at timestamptz
+	);
+	CREATE TABLE counters (
+		key        text PRIMARY KEY,
+		n          bigint NOT NULL,
+		expires_at timestamptz NOT NULL
+	);
+	CREATE TABLE documents (
+		name       text PRIMARY KEY,
+		body       jsonb NOT NULL,
+		updated_at timestamptz NOT NULL
+	);`,
+
+	`CREATE TABLE datasets (
+		id           text PRIMARY KEY,
+		position     bigint NOT NULL,
+		team         text NOT NULL DEFAULT '',
+		owner        text NOT NULL DEFAULT '',
+		file_name    text NOT NULL DEFAULT '',
+		uploaded_at  timestamptz,
+		row_count    integer NOT NULL DEFAULT 0,
+		column_count integer NOT NULL DEFAULT 0,
+		version      integer NOT NULL DEFAULT 0,
+		size_bytes   bigint NOT NULL DEFAULT 0,
+		checksum     text NOT NULL DEFAULT '',
+		data         bytea,
+		blob_ref     text,
+		deleted_at   timestamptz,
+		deleted_by   text NOT NULL DEFAULT '',
+		purge_at     timestamptz,
+		updated_at   timestamptz NOT NULL
+	);
+	CREATE INDEX datasets_live ON datasets (position) WHERE deleted_at IS NULL;
+	CREATE INDEX datasets_team ON datasets (team);`,
+
+	`CREATE TABLE audit_log (
+		id      bigserial PRIMARY KEY,
+		at      timestamptz NOT NULL,
+		actor   text NOT NULL DEFAULT '',
+		action  text NOT NULL,
+		dataset text NOT NULL DEFAULT '',
+		detail  text NOT NULL DEFAULT ''
+	);
+	CREATE INDEX audit_log_dataset ON audit_log (dataset, at);`,
+
+	`CREATE VIEW presets AS
+	SELECT r->>'id' AS id, r->>'name' AS name, r->>'team' AS team,
+		r->>'source' AS source, r->>'operation' AS operation,
+		r->>'interval' AS interval, r->'columns' AS columns, r
+	FROM documents, jsonb_array_elements(documents.body->'reports') AS r
+	WHERE documents.name = 'schedules.json';`,
+}
+
+// pgMigrationLock keys the advisory lock replicas take while migrating.
+const pgMigrationLock = 72120988
+
+// pgInlineLimit is the largest compressed dataset kept in its row when
+// BLOB_DIR is set; bigger ones are written there as files.
+const pgInlineLimit = 1 << 20
+
+func newPostgresState(spec string) (*postgresState, error) {
+	db, err := openPG(spec)
+	if err != nil {
+		return nil, err
+	}
+	s := &postgresState{db: db}
+	if err := s.migrate(); err != nil {
+		return nil, fmt.Errorf("migrating: %w", err)
+	}
+	return s, nil
+}
+
+func (s *postgresState) migrate() error {
+	return s.db.Tx(func(tx pgTx) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(" + strconv.Itoa(pgMigrationLock) + ")"); err != nil {
+			return err
+		}
+		if err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    integer PRIMARY KEY,
+			applied_at timestamptz NOT NULL
+		)`); err != nil {
+			return err
+		}
+		rows, err := tx.Query("SELECT coalesce(max(version), 0) FROM schema_migrations")
+		if err != nil {
+			return err
+		}
+		applied := int(pgInt(rows[0][0]))
+		for i := applied; i < len(pgMigrations); i++ {
+			for _, stmt := range strings.Split(pgMigrations[i], ";") {
+				if strings.TrimSpace(stmt) == "" {
+					continue
+				}
+				if err := tx.Exec(stmt); err != nil {
+					return fmt.Errorf("migration %d: %w", i+1, err)
+				}
+			}
+			if err := tx.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)", i+1, time.Now()); err != nil {
+				return err
+			}
+			log.Printf("Applied Postgres migration %d", i+1)
+		}
+		return nil
+	})
+}
+
+// cleanup drops expired keys and counters and purges datasets whose time in
+// the trash has run out. main starts it, not newPostgresState, since purging
+// clears the access log, which is itself read through the state backend.
+func (s *postgresState) cleanup() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		if _, err := s.db.Exec("DELETE FROM kv WHERE expires_at <= $1", now); err != nil {
+			log.Printf("Postgres cleanup: %v", err)
+			continue
+		}
+		s.db.Exec("DELETE FROM counters WHERE expires_at <= $1", now)
+		rows, err := s.db.Query("SELECT id FROM datasets WHERE purge_at <= $1", now)
+		if err != nil {
+			log.Printf("Postgres cleanup: %v", err)
+			continue
+		}
+		for _, row := range rows {
+			if err := (pgDatasets{s.db}).Purge(string(row[0])); err != nil {
+				log.Printf("Could not purge dataset %s: %v", row[0], err)
+				continue
+			}
+			accessLog.Forget(string(row[0]))
+		}
+	}
+}
+
+func pgExpiry(ttl time.Duration) interface{} {
+	if ttl <= 0 {
+		return nil
+	}
+	return time.Now().Add(ttl)
+}
+
+func (s *postgresState) Get(key string) ([]byte, error) {
+	rows, err := s.db.Query("SELECT value FROM kv WHERE key = $1 AND (expires_at IS NULL OR expires_at > $2)", key, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errStateMissing
+	}
+	return pgBytes(rows[0][0])
+}
+
+func (s *postgresState) Set(key string, value []byte, ttl time.Duration) error {
+	_, err := s.db.Exec(`INSERT INTO kv (key, value, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at`,
+		key, value, pgExpiry(ttl))
+	return err
+}
+
+func (s *postgresState) Delete(key string) error {
+	_, err := s.db.Exec("DELETE FROM kv WHERE key = $1", key)
+	return err
+}
+
+func (s *postgresState) Keys(prefix string) ([]string, error) {
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+	rows, err := s.db.Query(`SELECT key FROM kv WHERE key LIKE $1 ESCAPE '\' AND (expires_at IS NULL OR expires_at > $2)`, pattern, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(rows))
+	for i, row := range rows {
+		keys[i] = string(row[0])
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *postgresState) Acquire(key, token string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	now := time.Now()
+	rows, err := s.db.Query(`INSERT INTO kv (key, value, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at
+		WHERE kv.value = excluded.value OR kv.expires_at <= $4
+		RETURNING key`, key, []byte(token), now.Add(ttl), now)
+	return len(rows) == 1, err
+}
+
+func (s *postgresState) Release(key, token string) error {
+	_, err := s.db.Exec("DELETE FROM kv WHERE key = $1 AND value = $2", key, []byte(token))
+	return err
+}
+
+func (s *postgresState) Incr(key string, ttl time.Duration) (int64, error) {
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	now := time.Now()
+	rows, err := s.db.Query(`INSERT INTO counters (key, n, expires_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			n = CASE WHEN counters.expires_at <= $3 THEN 1 ELSE counters.n + 1 END,
+			expires_at = CASE WHEN counters.expires_at <= $3 THEN excluded.expires_at ELSE counters.expires_at END
+		RETURNING n`, key, now.Add(ttl), now)
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, fmt.Errorf("postgres: no count returned for %s", key)
+	}
+	return pgInt(rows[0][0]), nil
+}
+
+func (s *postgresState) ReadDocument(name string) ([]byte, error) {
+	rows, err := s.db.Query("SELECT body FROM documents WHERE name = $1", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errStateMissing
+	}
+	return rows[0][0], nil
+}
+
+func (s *postgresState) WriteDocument(name string, body []byte) error {
+	// jsonb goes as text: its binary form has a version byte in front.
+	_, err := s.db.Exec(`INSERT INTO documents (name, body, updated_at) VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO UPDATE SET body = excluded.body, updated_at = excluded.updated_at`,
+		name, string(body), time.Now())
+	return err
+}
+
+func (s *postgresState) DocumentUpdated(name string) (time.Time, error) {
+	rows, err := s.db.Query("SELECT updated_at FROM documents WHERE name = $1", name)
+	if err != nil || len(rows) == 0 {
+		return time.Time{}, err
+	}
+	return pgTime(rows[0][0]), nil
+}
+
+func (s *postgresState) Datasets() DatasetStore {
+	return pgDatasets{s.db}
+}
+
+// pgDatasets keeps each dataset as a row of datasets: the metadata in
+// columns for querying from outside, the dataset itself as gzipped JSON,
+// sealed when encryption is on, either inline or, past pgInlineLimit with BLOB_DIR set, in a file the row
+// refers to by name. Deleting only marks a row; purging removes it.
+type pgDatasets struct {
+	db *pgDB
+}
+
+func pgAudit(tx pgTx, actor, action, dataset, detail string) error {
+	return tx.Exec("INSERT INTO audit_log (at, actor, action, dataset, detail) VALUES ($1, $2, $3, $4, $5)",
+		time.Now(), actor, action, dataset, detail)
+}
+
+// encode compresses data and decides where it goes: it returns the bytes
+// for the data column, or a blob name once the file is written.
+func (pgDatasets) encode(data Spreadsheet) ([]byte, interface{}, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(data); err != nil {
+		return nil, nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, nil, err
+	}
+	sealed, err := sealAtRest(buf.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.BlobDir == "" || len(sealed) <= pgInlineLimit {
+		return sealed, nil, nil
+	}
+	name := fmt.Sprintf("%s-%d.json.gz", data.ID, data.Version)
+	path := filepath.Join(config.BlobDir, name)
+	if err := os.MkdirAll(config.BlobDir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(path+".tmp", sealed, 0o644); err != nil {
+		return nil, nil, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return nil, nil, err
+	}
+	return nil, name, nil
+}
+
+func (pgDatasets) decode(inline, blobRef []byte) (Spreadsheet, error) {
+	var data Spreadsheet
+	var raw []byte
+	var err error
+	if blobRef != nil {
+		raw, err = os.ReadFile(filepath.Join(config.BlobDir, string(blobRef)))
+	} else {
+		raw, err = pgBytes(inline)
+	}
+	if err == nil {
+		raw, err = openAtRest(raw)
+	}
+	if err != nil {
+		return data, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return data, err
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		return data, err
+	}
+	return data, json.Unmarshal(b, &data)
+}
+
+func removeBlob(ref []byte) {
+	if ref == nil {
+		return
+	}
+	if err := os.Remove(filepath.Join(config.BlobDir, string(ref))); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Could not remove blob %s: %v", ref, err)
+	}
+}
+
+func (s pgDatasets) IDs() ([]string, error) {
+	rows, err := s.db.Query("SELECT id FROM datasets WHERE deleted_at IS NULL ORDER BY position")
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(rows))
+	for i, row := range rows {
+		ids[i] = string(row[0])
+	}
+	return ids, nil
+}
+
+func (s pgDatasets) Version(id string) (int, error) {
+	rows, err := s.db.Query("SELECT version FROM datasets WHERE id = $1 AND deleted_at IS NULL", id)
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, errStateMissing
+	}
+	return int(pgInt(rows[0][0])), nil
+}
+
+func (s pgDatasets) Load(id string) (Spreadsheet, error) {
+	rows, err := s.db.Query("SELECT data, blob_ref FROM datasets WHERE id = $1 AND deleted_at IS NULL", id)
+	if err != nil {
+		return Spreadsheet{}, err
+	}
+	if len(rows) == 0 {
+		return Spreadsheet{}, errStateMissing
+	}
+	return s.decode(rows[0][0], rows[0][1])
+}
+
+func (s pgDatasets) Add(data Spreadsheet) error {
+	inline, blob, err := s.encode(data)
+	if err != nil {
+		return err
+	}
+	return s.db.Tx(func(tx pgTx) error {
+		err := tx.Exec(`INSERT INTO datasets (id, position, team, owner, file_name, uploaded_at, row_count,
+			column_count, version, size_bytes, checksum, data, blob_ref, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+			data.ID, time.Now().UnixNano(), data.Team, data.Owner, data.FileName, data.UploadTime,
+			len(data.Rows), len(data.Headers), data.Version, data.FileSize, data.Checksum, pgData(inline), blob, time.Now())
+		if err != nil {
+			return err
+		}
+		return pgAudit(tx, data.Owner, "create", data.ID, data.FileName)
+	})
+}
+
+// pgData keeps a nil slice NULL rather than an empty bytea.
+func pgData(b []byte) interface{} {
+	if b == nil {
+		return nil
+	}
+	return b
+}
+
+func (s pgDatasets) Save(data Spreadsheet) error {
+	inline, blob, err := s.encode(data)
+	if err != nil {
+		return err
+	}
+	var old []byte
+	err = s.db.Tx(func(tx pgTx) error {
+		rows, err := tx.Query("SELECT blob_ref FROM datasets WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", data.ID)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return errStateMissing
+		}
+		old = rows[0][0]
+		err = tx.Exec(`UPDATE datasets SET team = $2, owner = $3, file_name = $4, row_count = $5, column_count = $6,
+			version = $7, size_bytes = $8, checksum = $9, data = $10, blob_ref = $11, updated_at = $12
+			WHERE id = $1`,
+			data.ID, data.Team, data.Owner, data.FileName, len(data.Rows), len(data.Headers),
+			data.Version, data.FileSize, data.Checksum, pgData(inline), blob, time.Now())
+		if err != nil {
+			return err
+		}
+		return pgAudit(tx, "", "update", data.ID, "version "+strconv.Itoa(data.Version))
+	})
+	if err != nil {
+		if name, ok := blob.(string); ok {
+			removeBlob([]byte(name))
+		}
+		return err
+	}
+	if name, _ := blob.(string); string(old) != name {
+		removeBlob(old)
+	}
+	return nil
+}
+
+func (s pgDatasets) Trash(t TrashedDataset) error {
+	return s.db.Tx(func(tx pgTx) error {
+		rows, err := tx.Query(`UPDATE datasets SET deleted_at = $2, deleted_by = $3, purge_at = $4, updated_at = $2
+			WHERE id = $1 AND deleted_at IS NULL RETURNING id`, t.Data.ID, t.DeletedAt, t.DeletedBy, t.PurgeAt())
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return errStateMissing
+		}
+		return pgAudit(tx, t.DeletedBy, "delete", t.Data.ID, "")
+	})
+}
+
+// pgTrashedColumns selects what a TrashedDataset needs. Position counts the
+// live datasets before it, as kvDatasets records it.
+const pgTrashedColumns = `data, blob_ref, deleted_at, deleted_by,
+	(SELECT count(*) FROM datasets live WHERE live.deleted_at IS NULL AND live.position < datasets.position)`
+
+func (s pgDatasets) trashed(row [][]byte) (TrashedDataset, error) {
+	data, err := s.decode(row[0], row[1])
+	return TrashedDataset{Data: data, DeletedAt: pgTime(row[2]), DeletedBy: string(row[3]), Position: int(pgInt(row[4]))}, err
+}
+
+func (s pgDatasets) Trashed(id string) (TrashedDataset, error) {
+	rows, err := s.db.Query("SELECT "+pgTrashedColumns+" FROM datasets WHERE id = $1 AND deleted_at IS NOT NULL", id)
+	if err != nil {
+		return TrashedDataset{}, err
+	}
+	if len(rows) == 0 {
+		return TrashedDataset{}, errStateMissing
+	}
+	return s.trashed(rows[0])
+}
+
+func (s pgDatasets) TrashList() ([]TrashedDataset, error) {
+	rows, err := s.db.Query("SELECT " + pgTrashedColumns + " FROM datasets WHERE deleted_at IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	list := make([]TrashedDataset, 0, len(rows))
+	for _, row := range rows {
+		if t, err := s.trashed(row); err == nil {
+			list = append(list, t)
+		}
+	}
+	return list, nil
+}
+
+// Restore clears the deletion; the row kept its position all along.
+func (s pgDatasets) Restore(t TrashedDataset) error {
+	return s.db.Tx(func(tx pgTx) error {
+		rows, err := tx.Query(`UPDATE datasets SET deleted_at = NULL, deleted_by = '', purge_at = NULL, updated_at = $2
+			WHERE id = $1 AND deleted_at IS NOT NULL RETURNING id`, t.Data.ID, time.Now())
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return errStateMissing
+		}
+		return pgAudit(tx, "", "restore", t.Data.ID, "")
+	})
+}
+
+func (s pgDatasets) Purge(id string) error {
+	var ref []byte
+	err := s.db.Tx(func(tx pgTx) error {
+		rows, err := tx.Query("DELETE FROM datasets WHERE id = $1 AND deleted_at IS NOT NULL RETURNING blob_ref", id)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return errStateMissing
+		}
+		ref = rows[0][0]
+		return pgAudit(tx, "", "purge", id, "")
+	})
+	if err == nil {
+		removeBlob(ref)
+	}
+	return err
+}
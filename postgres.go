@@ -0,0 +1,565 @@
+// postgres.go
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal PostgreSQL client for protocol 3.0
+// (https://www.postgresql.org/docs/current/protocol.html), like the Redis
+// one: cleartext, MD5 and SCRAM-SHA-256 passwords, TLS as libpq's sslmode
+// describes it, and the extended protocol for statements, with parameters. Values come back as text;
+// parameters go as text too, except []byte, which is sent binary.
+
+type pgConfig struct {
+	addr     string
+	host     string
+	user     string
+	password string
+	database string
+	sslmode  string
+}
+
+func parsePGURL(spec string) (pgConfig, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return pgConfig{}, err
+	}
+	cfg := pgConfig{host: u.Hostname(), addr: u.Host, database: strings.TrimPrefix(u.Path, "/"), sslmode: u.Query().Get("sslmode")}
+	if cfg.host == "" {
+		cfg.host = "localhost"
+	}
+	if u.Port() == "" {
+		cfg.addr = net.JoinHostPort(cfg.host, "5432")
+	}
+	if u.User != nil {
+		cfg.user = u.User.Username()
+		cfg.password, _ = u.User.Password()
+	}
+	if cfg.user == "" {
+		return cfg, fmt.Errorf("postgres URL needs a user")
+	}
+	if cfg.database == "" {
+		cfg.database = cfg.user
+	}
+	switch cfg.sslmode {
+	case "":
+		cfg.sslmode = "prefer"
+	case "disable", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		return cfg, fmt.Errorf("unsupported sslmode %q", cfg.sslmode)
+	}
+	return cfg, nil
+}
+
+type pgError struct {
+	Code    string
+	Message string
+	Detail  string
+}
+
+func (e *pgError) Error() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("postgres: %s (%s): %s", e.Message, e.Code, e.Detail)
+	}
+	return fmt.Sprintf("postgres: %s (%s)", e.Message, e.Code)
+}
+
+type pgConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// pgDB is a small pool of connections.
+type pgDB struct {
+	cfg  pgConfig
+	mu   sync.Mutex
+	idle []*pgConn
+}
+
+const pgMaxIdle = 8
+
+func openPG(spec string) (*pgDB, error) {
+	cfg, err := parsePGURL(spec)
+	if err != nil {
+		return nil, err
+	}
+	db := &pgDB{cfg: cfg}
+	c, err := db.get()
+	if err != nil {
+		return nil, err
+	}
+	db.put(c)
+	return db, nil
+}
+
+func (db *pgDB) get() (*pgConn, error) {
+	db.mu.Lock()
+	if n := len(db.idle); n > 0 {
+		c := db.idle[n-1]
+		db.idle = db.idle[:n-1]
+		db.mu.Unlock()
+		return c, nil
+	}
+	db.mu.Unlock()
+	return dialPG(db.cfg)
+}
+
+func (db *pgDB) put(c *pgConn) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(db.idle) >= pgMaxIdle {
+		c.close()
+		return
+	}
+	db.idle = append(db.idle, c)
+}
+
+// release returns c to the pool unless err says the connection broke; a
+// server-side error leaves it ready for the next statement.
+func (db *pgDB) release(c *pgConn, err error) {
+	var perr *pgError
+	if err != nil && !errors.As(err, &perr) {
+		c.conn.Close()
+		return
+	}
+	db.put(c)
+}
+
+// Query runs a statement and returns its rows, each a list of column values
+// in text form, nil for NULL.
+func (db *pgDB) Query(query string, args ...interface{}) ([][][]byte, error) {
+	c, err := db.get()
+	if err != nil {
+		return nil, err
+	}
+	rows, _, err := c.extended(query, args)
+	db.release(c, err)
+	return rows, err
+}
+
+// Exec runs a statement and returns the number of rows it affected.
+func (db *pgDB) Exec(query string, args ...interface{}) (int64, error) {
+	c, err := db.get()
+	if err != nil {
+		return 0, err
+	}
+	_, tag, err := c.extended(query, args)
+	db.release(c, err)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := strconv.ParseInt(tag[strings.LastIndex(tag, " ")+1:], 10, 64)
+	return n, nil
+}
+
+// pgTx runs statements on the connection holding a transaction open.
+type pgTx struct{ c *pgConn }
+
+func (tx pgTx) Query(query string, args ...interface{}) ([][][]byte, error) {
+	rows, _, err := tx.c.extended(query, args)
+	return rows, err
+}
+
+func (tx pgTx) Exec(query string, args ...interface{}) error {
+	_, _, err := tx.c.extended(query, args)
+	return err
+}
+
+// Tx runs fn inside BEGIN and COMMIT, rolling back if it fails.
+func (db *pgDB) Tx(fn func(tx pgTx) error) error {
+	c, err := db.get()
+	if err != nil {
+		return err
+	}
+	tx := pgTx{c}
+	if err = tx.Exec("BEGIN"); err == nil {
+		if err = fn(tx); err == nil {
+			err = tx.Exec("COMMIT")
+		} else if rerr := tx.Exec("ROLLBACK"); rerr != nil {
+			err = rerr
+		}
+	}
+	db.release(c, err)
+	return err
+}
+
+func dialPG(cfg pgConfig) (*pgConn, error) {
+	conn, err := net.DialTimeout("tcp", cfg.addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if cfg.sslmode != "disable" {
+		if conn, err = pgStartTLS(conn, cfg); err != nil {
+			return nil, err
+		}
+	}
+	c := &pgConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	var startup []byte
+	startup = binary.BigEndian.AppendUint32(startup, 196608) // protocol 3.0
+	for _, kv := range [][2]string{{"user", cfg.user}, {"database", cfg.database}, {"application_name", "clientweb"}, {"client_encoding", "UTF8"}, {"TimeZone", "UTC"}} {
+		startup = append(startup, kv[0]+"\x00"+kv[1]+"\x00"...)
+	}
+	startup = append(startup, 0)
+	c.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(startup)+4)))
+	c.w.Write(startup)
+	if err := c.w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := c.authenticate(cfg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, _, err := c.results(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// pgStartTLS asks the server for TLS. Like libpq, "prefer" and "require"
+// encrypt without checking the certificate; "verify-ca" and "verify-full"
+// check it.
+func pgStartTLS(conn net.Conn, cfg pgConfig) (net.Conn, error) {
+	conn.Write([]byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f})
+	var answer [1]byte
+	if _, err := io.ReadFull(conn, answer[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if answer[0] != 'S' {
+		if cfg.sslmode == "prefer" {
+			return conn, nil
+		}
+		conn.Close()
+		return nil, fmt.Errorf("postgres: server does not support TLS (sslmode=%s)", cfg.sslmode)
+	}
+	tc := &tls.Config{ServerName: cfg.host, InsecureSkipVerify: cfg.sslmode == "prefer" || cfg.sslmode == "require"}
+	tconn := tls.Client(conn, tc)
+	if err := tconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tconn, nil
+}
+
+func (c *pgConn) close() {
+	c.msg('X', nil)
+	c.w.Flush()
+	c.conn.Close()
+}
+
+func (c *pgConn) msg(typ byte, payload []byte) {
+	c.w.WriteByte(typ)
+	c.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(payload)+4)))
+	c.w.Write(payload)
+}
+
+func (c *pgConn) read() (byte, []byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(head[1:])
+	if n < 4 || n > 1<<30 {
+		return 0, nil, fmt.Errorf("postgres: bad message length %d", n)
+	}
+	body := make([]byte, n-4)
+	_, err := io.ReadFull(c.r, body)
+	return head[0], body, err
+}
+
+func parsePGError(body []byte) *pgError {
+	e := &pgError{}
+	for len(body) > 1 {
+		field := body[0]
+		end := strings.IndexByte(string(body[1:]), 0)
+		if end < 0 {
+			break
+		}
+		value := string(body[1 : 1+end])
+		body = body[2+end:]
+		switch field {
+		case 'C':
+			e.Code = value
+		case 'M':
+			e.Message = value
+		case 'D':
+			e.Detail = value
+		}
+	}
+	return e
+}
+
+func (c *pgConn) authenticate(cfg pgConfig) error {
+	var scram *pgSCRAM
+	for {
+		typ, body, err := c.read()
+		if err != nil {
+			return err
+		}
+		if typ == 'E' {
+			return parsePGError(body)
+		}
+		if typ != 'R' || len(body) < 4 {
+			return fmt.Errorf("postgres: unexpected message %q during authentication", typ)
+		}
+		switch code := binary.BigEndian.Uint32(body); code {
+		case 0:
+			return nil
+		case 3:
+			c.msg('p', []byte(cfg.password+"\x00"))
+		case 5:
+			inner := md5.Sum([]byte(cfg.password + cfg.user))
+			outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), body[4:8]...))
+			c.msg('p', []byte("md5"+hex.EncodeToString(outer[:])+"\x00"))
+		case 10:
+			if !strings.Contains(string(body[4:]), "SCRAM-SHA-256\x00") {
+				return fmt.Errorf("postgres: no supported SASL mechanism")
+			}
+			scram = newPGSCRAM(cfg.password)
+			first := scram.clientFirst()
+			payload := append([]byte("SCRAM-SHA-256\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(first)))...)
+			c.msg('p', append(payload, first...))
+		case 11:
+			if scram == nil {
+				return fmt.Errorf("postgres: unexpected SASL continuation")
+			}
+			final, err := scram.clientFinal(string(body[4:]))
+			if err != nil {
+				return err
+			}
+			c.msg('p', []byte(final))
+		case 12:
+			if scram == nil || !scram.verifyServer(string(body[4:])) {
+				return fmt.Errorf("postgres: server signature mismatch")
+			}
+			continue
+		default:
+			return fmt.Errorf("postgres: unsupported authentication method %d", code)
+		}
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// pgSCRAM runs the client side of SCRAM-SHA-256 (RFC 5802, RFC 7677).
+type pgSCRAM struct {
+	password    string
+	nonce       string
+	clientBare  string
+	authMessage string
+	saltedPass  []byte
+}
+
+func newPGSCRAM(password string) *pgSCRAM {
+	return &pgSCRAM{password: password, nonce: base64.RawStdEncoding.EncodeToString([]byte(newID() + newID()))}
+}
+
+func (s *pgSCRAM) clientFirst() string {
+	s.clientBare = "n=,r=" + s.nonce
+	return "n,," + s.clientBare
+}
+
+func pgHMAC(key []byte, msg string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(msg))
+	return m.Sum(nil)
+}
+
+func (s *pgSCRAM) clientFinal(serverFirst string) (string, error) {
+	var nonce, salt string
+	iter := 0
+	for _, attr := range strings.Split(serverFirst, ",") {
+		if len(attr) < 2 {
+			continue
+		}
+		switch attr[:2] {
+		case "r=":
+			nonce = attr[2:]
+		case "s=":
+			salt = attr[2:]
+		case "i=":
+			iter, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	rawSalt, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || !strings.HasPrefix(nonce, s.nonce) || iter <= 0 {
+		return "", fmt.Errorf("postgres: bad SCRAM challenge")
+	}
+	if s.saltedPass, err = pbkdf2.Key(sha256.New, s.password, rawSalt, iter, 32); err != nil {
+		return "", err
+	}
+	withoutProof := "c=biws,r=" + nonce
+	s.authMessage = s.clientBare + "," + serverFirst + "," + withoutProof
+	clientKey := pgHMAC(s.saltedPass, "Client Key")
+	stored := sha256.Sum256(clientKey)
+	signature := pgHMAC(stored[:], s.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (s *pgSCRAM) verifyServer(serverFinal string) bool {
+	want := pgHMAC(pgHMAC(s.saltedPass, "Server Key"), s.authMessage)
+	got, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(serverFinal), "v="))
+	return err == nil && hmac.Equal(got, want)
+}
+
+// extended runs one statement with parameters through Parse, Bind, Execute
+// and Sync.
+func (c *pgConn) extended(query string, args []interface{}) ([][][]byte, string, error) {
+	c.conn.SetDeadline(time.Now().Add(60 * time.Second))
+	c.msg('P', append([]byte("\x00"+query+"\x00"), 0, 0))
+
+	bind := []byte("\x00\x00")
+	bind = binary.BigEndian.AppendUint16(bind, uint16(len(args)))
+	for _, a := range args {
+		format := uint16(0)
+		if _, ok := a.([]byte); ok {
+			format = 1
+		}
+		bind = binary.BigEndian.AppendUint16(bind, format)
+	}
+	bind = binary.BigEndian.AppendUint16(bind, uint16(len(args)))
+	for _, a := range args {
+		v, null := pgParam(a)
+		if null {
+			bind = binary.BigEndian.AppendUint32(bind, 0xFFFFFFFF)
+			continue
+		}
+		bind = binary.BigEndian.AppendUint32(bind, uint32(len(v)))
+		bind = append(bind, v...)
+	}
+	bind = binary.BigEndian.AppendUint16(bind, 0) // all results as text
+	c.msg('B', bind)
+	c.msg('E', []byte{0, 0, 0, 0, 0})
+	c.msg('S', nil)
+	if err := c.w.Flush(); err != nil {
+		return nil, "", err
+	}
+	return c.results()
+}
+
+func pgParam(a interface{}) ([]byte, bool) {
+	switch v := a.(type) {
+	case nil:
+		return nil, true
+	case []byte:
+		return v, false
+	case string:
+		return []byte(v), false
+	case int:
+		return []byte(strconv.Itoa(v)), false
+	case int64:
+		return []byte(strconv.FormatInt(v, 10)), false
+	case bool:
+		return []byte(strconv.FormatBool(v)), false
+	case time.Time:
+		if v.IsZero() {
+			return nil, true
+		}
+		return []byte(v.UTC().Format(pgTimeLayout)), false
+	}
+	return []byte(fmt.Sprint(a)), false
+}
+
+// results reads replies up to ReadyForQuery, keeping the rows and the last
+// command tag. An error is returned only once the connection is ready again.
+func (c *pgConn) results() ([][][]byte, string, error) {
+	var rows [][][]byte
+	var tag string
+	var perr *pgError
+	for {
+		typ, body, err := c.read()
+		if err != nil {
+			return nil, "", err
+		}
+		switch typ {
+		case 'D':
+			if len(body) < 2 {
+				return nil, "", fmt.Errorf("postgres: short data row")
+			}
+			n := int(binary.BigEndian.Uint16(body))
+			row := make([][]byte, n)
+			p := body[2:]
+			for i := 0; i < n; i++ {
+				if len(p) < 4 {
+					return nil, "", fmt.Errorf("postgres: short data row")
+				}
+				size := int32(binary.BigEndian.Uint32(p))
+				p = p[4:]
+				if size < 0 {
+					continue
+				}
+				if int(size) > len(p) {
+					return nil, "", fmt.Errorf("postgres: short data row")
+				}
+				row[i] = append([]byte{}, p[:size]...)
+				p = p[size:]
+			}
+			rows = append(rows, row)
+		case 'C':
+			tag = strings.TrimRight(string(body), "\x00")
+		case 'E':
+			if perr == nil {
+				perr = parsePGError(body)
+			}
+		case 'Z':
+			if perr != nil {
+				return nil, "", perr
+			}
+			return rows, tag, nil
+		}
+		// ParseComplete, BindComplete, RowDescription, notices and
+		// parameter changes need no answer.
+	}
+}
+
+const pgTimeLayout = "2006-01-02 15:04:05.000000-07:00"
+
+// pgTime reads a timestamptz in text form; the zero time for NULL.
+func pgTime(v []byte) time.Time {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999Z07", "2006-01-02 15:04:05.999999Z07:00", time.RFC3339Nano} {
+		if t, err := time.Parse(layout, string(v)); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// pgBytes decodes a bytea in the hex text form ("\x0a1b...").
+func pgBytes(v []byte) ([]byte, error) {
+	if len(v) >= 2 && v[0] == '\\' && v[1] == 'x' {
+		return hex.DecodeString(string(v[2:]))
+	}
+	return v, nil
+}
+
+func pgInt(v []byte) int64 {
+	n, _ := strconv.ParseInt(string(v), 10, 64)
+	return n
+}
@@ -0,0 +1,274 @@
+// postgres_test.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fixtures are protocol 3.0 messages written out from the message
+// formats in the PostgreSQL docs: a type byte, then a length that counts
+// itself but not the type.
+
+func testPGConn(replies string) (*pgConn, *bytes.Buffer) {
+	var out bytes.Buffer
+	return &pgConn{conn: nopConn{}, r: bufio.NewReader(strings.NewReader(replies)), w: bufio.NewWriter(&out)}, &out
+}
+
+// pgRows formats rows with their values quoted, so NULL and "" differ.
+func pgRows(rows [][][]byte) string {
+	var b strings.Builder
+	for _, row := range rows {
+		b.WriteString("[")
+		for i, v := range row {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			if v == nil {
+				b.WriteString("NULL")
+			} else {
+				fmt.Fprintf(&b, "%q", v)
+			}
+		}
+		b.WriteString("]")
+	}
+	return b.String()
+}
+
+const pgSelectReplies = "1\x00\x00\x00\x04" + // ParseComplete
+	"2\x00\x00\x00\x04" + // BindComplete
+	"T\x00\x00\x00\x1a\x00\x01a\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x19\xff\xff\xff\xff\xff\xff\x00\x00" + // RowDescription: a text column
+	"D\x00\x00\x00\x11\x00\x02\x00\x00\x00\x03abc\xff\xff\xff\xff" +
+	"N\x00\x00\x00\x05\x00" + // an empty NoticeResponse
+	"D\x00\x00\x00\x0f\x00\x02\x00\x00\x00\x00\x00\x00\x00\x01x" +
+	"C\x00\x00\x00\x0dSELECT 2\x00" +
+	"Z\x00\x00\x00\x05I"
+
+func TestPGExtended(t *testing.T) {
+	c, out := testPGConn(pgSelectReplies)
+	rows, tag, err := c.extended("SELECT $1, $2, $3, $4", []interface{}{"é", nil, []byte{0, 0xff}, int64(-5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "P\x00\x00\x00\x1d\x00SELECT $1, $2, $3, $4\x00\x00\x00" +
+		"B\x00\x00\x00\x2a\x00\x00" +
+		"\x00\x04\x00\x00\x00\x00\x00\x01\x00\x00" + // parameter formats: []byte is binary
+		"\x00\x04\x00\x00\x00\x02é\xff\xff\xff\xff\x00\x00\x00\x02\x00\xff\x00\x00\x00\x02-5" +
+		"\x00\x00" + // results as text
+		"E\x00\x00\x00\x09\x00\x00\x00\x00\x00" +
+		"S\x00\x00\x00\x04"
+	if out.String() != want {
+		t.Errorf("sent\n%q\nwant\n%q", out.String(), want)
+	}
+	if got := pgRows(rows); got != `["abc" NULL]["" "x"]` || tag != "SELECT 2" {
+		t.Errorf("rows %s, tag %q", got, tag)
+	}
+}
+
+func TestPGResultsError(t *testing.T) {
+	errorReply := "E\x00\x00\x00\x46SERROR\x00C23505\x00Mduplicate key value\x00DKey (id)=(1) already exists.\x00\x00" +
+		"E\x00\x00\x00\x13SERROR\x00Cother\x00\x00" + // only the first error is kept
+		"Z\x00\x00\x00\x05E"
+	c, _ := testPGConn(errorReply + pgSelectReplies)
+	_, _, err := c.results()
+	var perr *pgError
+	if !errors.As(err, &perr) || *perr != (pgError{Code: "23505", Message: "duplicate key value", Detail: "Key (id)=(1) already exists."}) {
+		t.Fatalf("got %#v", err)
+	}
+	// The connection is ready for the next statement.
+	if rows, _, err := c.results(); err != nil || len(rows) != 2 {
+		t.Errorf("next results: %d rows, %v", len(rows), err)
+	}
+
+	for name, reply := range map[string]string{
+		"short row":      "D\x00\x00\x00\x0a\x00\x02\x00\x00\x00\x00Z\x00\x00\x00\x05I",
+		"value too long": "D\x00\x00\x00\x0d\x00\x01\x00\x00\x00\x09abcZ\x00\x00\x00\x05I",
+		"bad length":     "C\x00\x00\x00\x02",
+		"truncated":      "C\x00\x00\x00\x0dSELECT",
+		"no ready":       "C\x00\x00\x00\x0dSELECT 2\x00",
+	} {
+		c, _ := testPGConn(reply)
+		if _, _, err := c.results(); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+}
+
+func TestPGAuthenticate(t *testing.T) {
+	cfg := pgConfig{user: "app", password: "s3cret"}
+	tests := []struct {
+		name, replies, sent string
+	}{
+		{"trust", "R\x00\x00\x00\x08\x00\x00\x00\x00", ""},
+		{"cleartext", "R\x00\x00\x00\x08\x00\x00\x00\x03R\x00\x00\x00\x08\x00\x00\x00\x00", "p\x00\x00\x00\x0bs3cret\x00"},
+		// md5(md5("s3cret" + "app") in hex + salt), worked out independently
+		{"md5", "R\x00\x00\x00\x0c\x00\x00\x00\x05\x01\x02\x03\x04R\x00\x00\x00\x08\x00\x00\x00\x00",
+			"p\x00\x00\x00\x28md51460f94130eb931937bbd6439ee8ab57\x00"},
+	}
+	for _, tt := range tests {
+		c, out := testPGConn(tt.replies)
+		if err := c.authenticate(cfg); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if out.String() != tt.sent {
+			t.Errorf("%s: sent %q, want %q", tt.name, out.String(), tt.sent)
+		}
+	}
+
+	for name, reply := range map[string]string{
+		"rejected":   "E\x00\x00\x00\x21SFATAL\x00C28P01\x00Mbad password\x00\x00",
+		"kerberos":   "R\x00\x00\x00\x08\x00\x00\x00\x02",
+		"no SCRAM":   "R\x00\x00\x00\x15\x00\x00\x00\x0aSCRAM-SHA-1\x00\x00",
+		"early SASL": "R\x00\x00\x00\x0c\x00\x00\x00\x0br=x\x00",
+		"not auth":   "Z\x00\x00\x00\x05I",
+	} {
+		c, _ := testPGConn(reply)
+		if err := c.authenticate(cfg); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+}
+
+// The SCRAM exchange uses RFC 7677's nonces, salt and password; the proof
+// and server signature differ from the RFC's because PostgreSQL has the
+// client send an empty user name, so they were worked out independently.
+func TestPGSCRAM(t *testing.T) {
+	s := &pgSCRAM{password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	if got := s.clientFirst(); got != "n,,n=,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Errorf("client-first %q", got)
+	}
+	serverFirst := "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	final, err := s.clientFinal(serverFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=qvT2SWdEH5Q06albL+hjSYuUhCG7VndFyzIb7CK4n9k="; final != want {
+		t.Errorf("client-final %q, want %q", final, want)
+	}
+	if !s.verifyServer("v=3HO6Qt1M4MKJrmlKaoOqLAI0/0TV0HZe7J9H3MBtSOg=") {
+		t.Error("the server's signature wasn't accepted")
+	}
+	if s.verifyServer("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=") {
+		t.Error("a wrong signature was accepted")
+	}
+
+	for _, bad := range []string{
+		"r=someoneElse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"r=rOprNGfwEbeRWgbNEkqOx,s=!!,i=4096",
+		"r=rOprNGfwEbeRWgbNEkqOx,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0",
+	} {
+		if _, err := s.clientFinal(bad); err == nil {
+			t.Errorf("%q: want an error", bad)
+		}
+	}
+}
+
+func TestParsePGURL(t *testing.T) {
+	tests := []struct {
+		spec, want string
+	}{
+		{"postgres://app:pw@db.internal/clients", "{db.internal:5432 db.internal app pw clients prefer}"},
+		{"postgres://app@10.0.0.5:6432?sslmode=verify-full", "{10.0.0.5:6432 10.0.0.5 app  app verify-full}"},
+		{"postgres://app@[::1]:5433/x?sslmode=disable", "{[::1]:5433 ::1 app  x disable}"},
+		{"postgres://app@/x", "{localhost:5432 localhost app  x prefer}"},
+	}
+	for _, tt := range tests {
+		cfg, err := parsePGURL(tt.spec)
+		if got := fmt.Sprint(cfg); err != nil || got != tt.want {
+			t.Errorf("%s: %s, %v; want %s", tt.spec, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"postgres://db.internal/x", "postgres://app@db/x?sslmode=allow", "postgres://app@db/%zz"} {
+		if _, err := parsePGURL(bad); err == nil {
+			t.Errorf("%s: want an error", bad)
+		}
+	}
+}
+
+// readPGMessage reads a message the way a server does; typ is 0 for the
+// untyped startup and SSL request messages.
+func readPGMessage(r io.Reader, typed bool) (byte, []byte, error) {
+	var typ [1]byte
+	if typed {
+		if _, err := io.ReadFull(r, typ[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(size[:])-4)
+	_, err := io.ReadFull(r, body)
+	return typ[0], body, err
+}
+
+// TestPGDial runs a session against a server that declines TLS, asks for
+// an MD5 password and answers one statement.
+func TestPGDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can't listen:", err)
+	}
+	defer ln.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- func() error {
+			conn, err := ln.Accept()
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			expect := func(typed bool, want string) error {
+				typ, body, err := readPGMessage(conn, typed)
+				if got := string(append([]byte{typ}, body...)); err != nil || got != want {
+					return fmt.Errorf("got %q, %v; want %q", got, err, want)
+				}
+				return nil
+			}
+			if err := expect(false, "\x00\x04\xd2\x16\x2f"); err != nil {
+				return fmt.Errorf("SSL request: %v", err)
+			}
+			io.WriteString(conn, "N")
+			if err := expect(false, "\x00\x00\x03\x00\x00user\x00app\x00database\x00clients\x00application_name\x00clientweb\x00"+
+				"client_encoding\x00UTF8\x00TimeZone\x00UTC\x00\x00"); err != nil {
+				return fmt.Errorf("startup: %v", err)
+			}
+			io.WriteString(conn, "R\x00\x00\x00\x0c\x00\x00\x00\x05\x01\x02\x03\x04")
+			if err := expect(true, "pmd51460f94130eb931937bbd6439ee8ab57\x00"); err != nil {
+				return fmt.Errorf("password: %v", err)
+			}
+			io.WriteString(conn, "R\x00\x00\x00\x08\x00\x00\x00\x00"+
+				"S\x00\x00\x00\x18server_version\x0017.2\x00"+
+				"K\x00\x00\x00\x0c\x00\x00\x30\x39\x00\x00\x00\x07"+
+				"Z\x00\x00\x00\x05I")
+			for _, typ := range "PBES" {
+				if got, _, err := readPGMessage(conn, true); err != nil || got != byte(typ) {
+					return fmt.Errorf("got %q, %v; want %c", got, err, typ)
+				}
+			}
+			io.WriteString(conn, "1\x00\x00\x00\x042\x00\x00\x00\x04C\x00\x00\x00\x0dDELETE 3\x00Z\x00\x00\x00\x05I")
+			return expect(true, "X")
+		}()
+	}()
+
+	db, err := openPG("postgres://app:s3cret@" + ln.Addr().String() + "/clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.Exec("DELETE FROM state WHERE expires_at < now()"); err != nil || n != 3 {
+		t.Errorf("Exec = %d, %v", n, err)
+	}
+	db.idle[0].close()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
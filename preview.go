@@ -0,0 +1,272 @@
+// preview.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	defaultPreviewRows = 20
+	maxPreviewRows     = 200
+)
+
+// UploadPreview is the start of a file as an upload with the same options
+// would read it, so the options can be settled before the whole file is
+// ingested.
+type UploadPreview struct {
+	File       string            `json:"file"`
+	Format     string            `json:"format"` // csv, xlsx, xls, sqlite, dbf, fixed or pdf
+	Delimiter  string            `json:"delimiter,omitempty"`
+	Encoding   string            `json:"encoding,omitempty"`
+	Widths     string            `json:"widths,omitempty"`     // fixed-width column widths, given or detected
+	Tables     []SQLiteTableInfo `json:"tables,omitempty"`     // a database's tables
+	PDFTables  []PDFTableInfo    `json:"pdf_tables,omitempty"` // the tables found in a PDF
+	TableName  string            `json:"table,omitempty"`      // the one previewed
+	Headers    []string          `json:"headers"`
+	Types      []string          `json:"types"` // number, date, text or empty, guessed from the sample
+	Rows       [][]string        `json:"rows"`
+	More       bool              `json:"more"` // the file has rows beyond the sample
+	Notes      []string          `json:"notes,omitempty"`
+	Detections DetectionReport   `json:"detections,omitempty"` // how the sample was read, with confidence and evidence
+}
+
+func (p UploadPreview) Table() ([]string, [][]string) {
+	return p.Headers, p.Rows
+}
+
+// guessTypes types each column of a sample the way an upload detects them.
+func guessTypes(sample Spreadsheet) []string {
+	types := make([]string, len(sample.Headers))
+	for i := range types {
+		types[i] = "empty"
+		for _, row := range sample.Rows {
+			if cellValue(row, i) != "" {
+				types[i] = "text"
+				break
+			}
+		}
+	}
+	for _, col := range detectDateColumns(sample) {
+		types[col] = "date"
+	}
+	for _, col := range detectNumericColumns(sample) {
+		types[col] = "number"
+	}
+	return types
+}
+
+// previewCSV reads the header and at most n rows.
+func previewCSV(file io.Reader, opts CSVOptions, n int) (UploadPreview, error) {
+	preview := UploadPreview{Format: "csv"}
+	reader, opts, err := newCSVReader(file, opts)
+	if err != nil {
+		return preview, err
+	}
+	preview.Delimiter, preview.Encoding = opts.Delimiter, opts.Encoding
+	preview.Detections = opts.Detected
+	header, err := reader.Read()
+	if err == io.EOF {
+		return preview, fmt.Errorf("empty CSV")
+	}
+	if err != nil {
+		return preview, err
+	}
+	preview.Headers = dedupeHeaders(normalizeHeaders(header))
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return preview, err
+		}
+		if len(preview.Rows) == n {
+			preview.More = true
+			break
+		}
+		preview.Rows = append(preview.Rows, row)
+	}
+	return preview, nil
+}
+
+// previewExcel streams the first sheet's header rows and at most n rows
+// after them. Hidden rows, merged cells and formulas are only dealt with on
+// import.
+func previewExcel(file io.Reader, opts ExcelOptions, n int) (UploadPreview, error) {
+	preview := UploadPreview{Format: "xlsx"}
+	f, err := excelize.OpenReader(file)
+	if err != nil {
+		return preview, err
+	}
+	defer f.Close()
+	sheet := f.GetSheetName(0)
+	if sheet == "" {
+		return preview, fmt.Errorf("no sheets")
+	}
+	rows, err := f.Rows(sheet)
+	if err != nil {
+		return preview, err
+	}
+	defer rows.Close()
+	headerRows := opts.HeaderRows
+	if headerRows <= 0 {
+		headerRows = 1
+		preview.Notes = append(preview.Notes, "Header rows are detected from merged cells on import; the preview assumes one, so set the header rows if there are more")
+	}
+	var header [][]string
+	for rows.Next() {
+		row, err := rows.Columns()
+		if err != nil {
+			return preview, err
+		}
+		if len(header) < headerRows {
+			header = append(header, row)
+			continue
+		}
+		if len(preview.Rows) == n {
+			preview.More = true
+			break
+		}
+		preview.Rows = append(preview.Rows, row)
+	}
+	if len(header) == 0 {
+		return preview, fmt.Errorf("empty Excel")
+	}
+	if len(header) > 1 {
+		preview.Headers = dedupeHeaders(flattenHeaderRows(header))
+	} else {
+		preview.Headers = dedupeHeaders(normalizeHeaders(header[0]))
+	}
+	preview.Notes = append(preview.Notes, "Hidden rows and merged cells aren't applied in the preview")
+	return preview, nil
+}
+
+// previewAPIHandler parses only the start of an uploaded file, taking the
+// same options as /display plus "rows", and reports what an upload would
+// make of it: the headers, sample rows, guessed column types and, for CSV,
+// the delimiter and encoding detected when left unset.
+func previewAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(MaxFileSize); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Expected a multipart upload")
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Attach the file as \"file\"")
+		return
+	}
+	defer file.Close()
+	n := defaultPreviewRows
+	if v := r.FormValue("rows"); v != "" {
+		if n, err = strconv.Atoi(v); err != nil || n < 1 || n > maxPreviewRows {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("rows must be between 1 and %d", maxPreviewRows))
+			return
+		}
+	}
+
+	var preview UploadPreview
+	switch strings.ToLower(filepath.Ext(header.Filename)) {
+	case ".csv":
+		opts, err := csvOptionsFromForm(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		preview, err = previewCSV(file, opts, n)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("CSV error: %v", err))
+			return
+		}
+	case ".xlsx", ".xls":
+		if isCompoundFile(file) {
+			// The legacy format has no streaming reader; it's read whole.
+			data, err := processXLS(file)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Excel error: %v", err))
+				return
+			}
+			preview = UploadPreview{Format: "xls", Headers: data.Headers, Rows: data.Rows, More: len(data.Rows) > n}
+			if preview.More {
+				preview.Rows = preview.Rows[:n]
+			}
+			break
+		}
+		headerRows, _ := strconv.Atoi(r.FormValue("header_rows"))
+		preview, err = previewExcel(file, ExcelOptions{HeaderRows: headerRows}, n)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Excel error: %v", err))
+			return
+		}
+	case ".dbf":
+		data, err := processDBF(file, n+1)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("dBase error: %v", err))
+			return
+		}
+		preview = UploadPreview{Format: "dbf", Headers: data.Headers, Rows: data.Rows, More: len(data.Rows) > n, Notes: data.Notes}
+		if preview.More {
+			preview.Rows = preview.Rows[:n]
+		}
+	case ".txt", ".prn", ".fwf", ".dat":
+		opts, err := fixedWidthOptionsFromForm(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		data, opts, err := processFixedWidth(file, opts, n+1)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Fixed-width error: %v", err))
+			return
+		}
+		preview = UploadPreview{Format: "fixed", Encoding: opts.Encoding, Widths: formatWidths(opts.Widths), Headers: data.Headers, Rows: data.Rows, More: len(data.Rows) > n,
+			Detections: data.Detections}
+		if preview.More {
+			preview.Rows = preview.Rows[:n]
+		}
+	case ".db", ".sqlite", ".sqlite3", ".duckdb":
+		data, tables, err := processSQLite(file, r.FormValue("table"), n+1)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Database error: %v", err))
+			return
+		}
+		preview = UploadPreview{Format: "sqlite", Headers: data.Headers, Rows: data.Rows, More: len(data.Rows) > n, Notes: data.Notes, Tables: tables}
+		preview.TableName = r.FormValue("table")
+		if preview.TableName == "" {
+			preview.TableName = tables[0].Name
+		}
+		if preview.More {
+			preview.Rows = preview.Rows[:n]
+		}
+	case ".pdf":
+		data, tables, err := processPDF(file, r.FormValue("table"), n+1)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("PDF error: %v", err))
+			return
+		}
+		preview = UploadPreview{Format: "pdf", Headers: data.Headers, Rows: data.Rows, More: len(data.Rows) > n, Notes: data.Notes, PDFTables: tables}
+		preview.TableName = r.FormValue("table")
+		if preview.TableName == "" {
+			preview.TableName = largestPDFTable(tables).Name
+		}
+		if preview.More {
+			preview.Rows = preview.Rows[:n]
+		}
+	default:
+		writeAPIError(w, http.StatusBadRequest, "Invalid file type")
+		return
+	}
+	preview.File = header.Filename
+	sample := Spreadsheet{Headers: preview.Headers, Rows: preview.Rows}
+	normalizeNumbers(&sample, numberFormatFromForm(r))
+	preview.Types = guessTypes(sample)
+	sample.NumericCols = detectNumericColumns(sample)
+	preview.Detections = append(preview.Detections, columnDetections(sample, nil)...)
+	writeAPIData(w, r, preview)
+}
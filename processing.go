@@ -2,39 +2,69 @@
 package main
 
 import (
-    "encoding/csv"
     "github.com/xuri/excelize/v2"
     "io"
+    "sort"
     "strings"
     "strconv"
     "fmt"
 )
 
-func processCSV(file io.Reader) (Spreadsheet, error) {
+func processCSV(file io.Reader, opts CSVOptions) (Spreadsheet, error) {
     var data Spreadsheet
-    reader := csv.NewReader(file)
-    reader.FieldsPerRecord = -1
-    rows, err := reader.ReadAll()
+    reader, opts, err := newCSVReader(file, opts)
     if err != nil {
         return data, err
     }
-    if len(rows) == 0 {
+    reader.ReuseRecord = true
+    var ingest rowIngest
+    header, err := reader.Read()
+    if err == io.EOF {
         return data, fmt.Errorf("empty CSV")
     }
-    headers := make([]string, len(rows[0]))
-    for i, h := range rows[0] {
-        h = strings.TrimSpace(h)
-        if h == "" {
-            h = fmt.Sprintf("Column_%d", i+1)
+    if err != nil {
+        return data, err
+    }
+    data.Headers = dedupeHeaders(normalizeHeaders(header))
+    keep, err := opts.Columns.indexes(data.Headers)
+    if err != nil {
+        return data, err
+    }
+    for {
+        row, err := reader.Read()
+        if err == io.EOF {
+            break
         }
-        headers[i] = h
+        if err != nil {
+            return data, err
+        }
+        if keep != nil {
+            row = ingest.Project(row, keep)
+        } else {
+            row = ingest.Row(row)
+        }
+        data.Rows = append(data.Rows, row)
+    }
+    if keep != nil {
+        data.Notes = append(data.Notes, opts.Columns.note(len(keep), len(data.Headers)))
+        data.Headers = projectRow(data.Headers, keep)
+    }
+    data.summaries = ingestSummaries(ingest.summaries, len(data.Headers), len(data.Rows))
+    data.Detections = opts.Detected
+    if opts.Delimiter != "comma" || opts.Encoding != "utf-8" {
+        data.Notes = append(data.Notes, fmt.Sprintf("Read as %s-delimited %s", opts.Delimiter, opts.Encoding))
     }
-    data.Headers = headers
-    data.Rows = rows[1:]
     return data, nil
 }
 
-func processExcel(file io.Reader) (Spreadsheet, error) {
+type ExcelOptions struct {
+    HeaderRows    int  // 0 detects the header depth from merged cells
+    IncludeHidden bool // keep hidden and filtered-out rows and columns
+    EvaluateFormulas bool // recalculate formula cells instead of trusting cached values
+    Annotations      bool // add companion columns for cell comments and hyperlinks
+}
+
+func processExcel(file io.Reader, opts ExcelOptions) (Spreadsheet, error) {
     var data Spreadsheet
     f, err := excelize.OpenReader(file)
     if err != nil {
@@ -52,17 +82,399 @@ func processExcel(file io.Reader) (Spreadsheet, error) {
     if len(rows) == 0 {
         return data, fmt.Errorf("empty Excel")
     }
-    headers := make([]string, len(rows[0]))
-    for i, h := range rows[0] {
+    merges, err := f.GetMergeCells(sheet)
+    if err != nil {
+        return data, err
+    }
+    formulaCols, err := readFormulaCells(f, sheet, rows, opts.EvaluateFormulas, &data)
+    if err != nil {
+        return data, err
+    }
+    if opts.Annotations {
+        rows, err = addAnnotationColumns(f, sheet, rows, &data)
+        if err != nil {
+            return data, err
+        }
+    }
+    rows = fillMergedCells(rows, merges)
+    if !opts.IncludeHidden {
+        var hiddenCols map[int]bool
+        rows, hiddenCols, err = dropHiddenCells(f, sheet, rows, &data)
+        if err != nil {
+            return data, err
+        }
+        if len(rows) == 0 {
+            return data, fmt.Errorf("every row in the sheet is hidden")
+        }
+        formulaCols = shiftColumns(formulaCols, hiddenCols)
+    }
+    data.FormulaCols = formulaCols
+
+    headerRows := opts.HeaderRows
+    if headerRows <= 0 {
+        headerRows = detectHeaderRows(merges)
+    }
+    if headerRows > len(rows) {
+        headerRows = len(rows)
+    }
+    if headerRows > 1 {
+        data.Headers = dedupeHeaders(flattenHeaderRows(rows[:headerRows]))
+        data.Notes = append(data.Notes, fmt.Sprintf("Combined %d header rows into single column names", headerRows))
+    } else {
+        data.Headers = dedupeHeaders(normalizeHeaders(rows[0]))
+    }
+    data.Rows = rows[headerRows:]
+    return data, nil
+}
+
+// fillMergedCells copies each merged range's value into every cell it
+// covers, so merged headers and grouped labels aren't read as blanks.
+func fillMergedCells(rows [][]string, merges []excelize.MergeCell) [][]string {
+    for _, m := range merges {
+        startCol, startRow, err := excelize.CellNameToCoordinates(m.GetStartAxis())
+        if err != nil {
+            continue
+        }
+        endCol, endRow, err := excelize.CellNameToCoordinates(m.GetEndAxis())
+        if err != nil {
+            continue
+        }
+        value := m.GetCellValue()
+        for r := startRow - 1; r < endRow && r < len(rows); r++ {
+            for len(rows[r]) < endCol {
+                rows[r] = append(rows[r], "")
+            }
+            for c := startCol - 1; c < endCol; c++ {
+                rows[r][c] = value
+            }
+        }
+    }
+    return rows
+}
+
+// dropHiddenCells removes rows and columns hidden in the workbook. Rows
+// hidden by an auto-filter count as hidden, so filtered-out data is dropped
+// the same way.
+func dropHiddenCells(f *excelize.File, sheet string, rows [][]string, data *Spreadsheet) ([][]string, map[int]bool, error) {
+    var kept [][]string
+    hiddenRows := 0
+    for i, row := range rows {
+        visible, err := f.GetRowVisible(sheet, i+1)
+        if err != nil {
+            return nil, nil, err
+        }
+        if !visible {
+            hiddenRows++
+            continue
+        }
+        kept = append(kept, row)
+    }
+
+    width := 0
+    for _, row := range kept {
+        if len(row) > width {
+            width = len(row)
+        }
+    }
+    hidden := make(map[int]bool)
+    var hiddenNames []string
+    for c := 1; c <= width; c++ {
+        name, _ := excelize.ColumnNumberToName(c)
+        visible, err := f.GetColVisible(sheet, name)
+        if err != nil {
+            return nil, nil, err
+        }
+        if !visible {
+            hidden[c-1] = true
+            hiddenNames = append(hiddenNames, name)
+        }
+    }
+    if len(hidden) > 0 {
+        for i, row := range kept {
+            trimmed := make([]string, 0, len(row))
+            for c, v := range row {
+                if !hidden[c] {
+                    trimmed = append(trimmed, v)
+                }
+            }
+            kept[i] = trimmed
+        }
+    }
+
+    filtered := false
+    for _, dn := range f.GetDefinedName() {
+        if dn.Name == "_xlnm._FilterDatabase" && (dn.Scope == sheet || dn.Scope == "Workbook") {
+            filtered = true
+        }
+    }
+    if hiddenRows > 0 {
+        note := fmt.Sprintf("Excluded %d hidden row(s)", hiddenRows)
+        if filtered {
+            note += " (the sheet has an active auto-filter)"
+        }
+        data.Notes = append(data.Notes, note)
+    }
+    if len(hiddenNames) > 0 {
+        data.Notes = append(data.Notes, fmt.Sprintf("Excluded %d hidden column(s): %s", len(hiddenNames), strings.Join(hiddenNames, ", ")))
+    }
+    return kept, hidden, nil
+}
+
+// readFormulaCells finds the columns holding formulas. Normally the cached
+// results Excel saved with the file are kept; with evaluate set each formula
+// is recalculated, falling back to the cached value when that fails.
+func readFormulaCells(f *excelize.File, sheet string, rows [][]string, evaluate bool, data *Spreadsheet) ([]int, error) {
+    counts := make(map[int]int)
+    failed := 0
+    for r, row := range rows {
+        for c := range row {
+            cell, err := excelize.CoordinatesToCellName(c+1, r+1)
+            if err != nil {
+                return nil, err
+            }
+            formula, err := f.GetCellFormula(sheet, cell)
+            if err != nil {
+                return nil, err
+            }
+            if formula == "" {
+                continue
+            }
+            counts[c]++
+            if !evaluate {
+                continue
+            }
+            if value, err := f.CalcCellValue(sheet, cell); err == nil {
+                row[c] = value
+            } else {
+                failed++
+            }
+        }
+    }
+    cols := make([]int, 0, len(counts))
+    for c := range counts {
+        cols = append(cols, c)
+    }
+    sort.Ints(cols)
+    if len(cols) > 0 {
+        mode := "cached values used"
+        if evaluate {
+            mode = "recalculated"
+        }
+        data.Notes = append(data.Notes, fmt.Sprintf("%d column(s) contain formulas (%s)", len(cols), mode))
+    }
+    if failed > 0 {
+        data.Notes = append(data.Notes, fmt.Sprintf("%d formula(s) could not be evaluated; their cached values were kept", failed))
+    }
+    return cols, nil
+}
+
+// addAnnotationColumns appends "<Header> (Comment)" and "<Header> (Link)"
+// columns for every column carrying cell comments or hyperlinks, so notes
+// auditors left in the workbook travel with the data.
+func addAnnotationColumns(f *excelize.File, sheet string, rows [][]string, data *Spreadsheet) ([][]string, error) {
+    comments, err := f.GetComments(sheet)
+    if err != nil {
+        return nil, err
+    }
+    width := 0
+    for _, row := range rows {
+        if len(row) > width {
+            width = len(row)
+        }
+    }
+
+    type annotation struct{ comments, links map[int]string }
+    byCol := make(map[int]*annotation)
+    get := func(c int) *annotation {
+        if byCol[c] == nil {
+            byCol[c] = &annotation{comments: map[int]string{}, links: map[int]string{}}
+        }
+        return byCol[c]
+    }
+
+    for _, cm := range comments {
+        c, r, err := excelize.CellNameToCoordinates(cm.Cell)
+        if err != nil || r > len(rows) {
+            continue
+        }
+        text := cm.Text
+        if text == "" {
+            var b strings.Builder
+            for _, run := range cm.Paragraph {
+                b.WriteString(run.Text)
+            }
+            text = b.String()
+        }
+        text = strings.TrimSpace(text)
+        if cm.Author != "" && !strings.HasPrefix(text, cm.Author) {
+            text = cm.Author + ": " + text
+        }
+        get(c - 1).comments[r-1] = text
+    }
+    for r, row := range rows {
+        for c := range row {
+            cell, err := excelize.CoordinatesToCellName(c+1, r+1)
+            if err != nil {
+                return nil, err
+            }
+            ok, target, err := f.GetCellHyperLink(sheet, cell)
+            if err != nil {
+                return nil, err
+            }
+            if ok && target != "" {
+                get(c).links[r] = target
+            }
+        }
+    }
+    if len(byCol) == 0 {
+        return rows, nil
+    }
+
+    cols := make([]int, 0, len(byCol))
+    for c := range byCol {
+        cols = append(cols, c)
+    }
+    sort.Ints(cols)
+    for r := range rows {
+        for len(rows[r]) < width {
+            rows[r] = append(rows[r], "")
+        }
+    }
+    added := 0
+    for _, c := range cols {
+        a := byCol[c]
+        name := cellValue(rows[0], c)
+        if name == "" {
+            name = fmt.Sprintf("Column_%d", c+1)
+        }
+        for _, kind := range []struct {
+            suffix string
+            op     string
+            values map[int]string
+        }{{" (Comment)", "cell_comments", a.comments}, {" (Link)", "hyperlinks", a.links}} {
+            if len(kind.values) == 0 {
+                continue
+            }
+            added++
+            data.Lineage = withLineage(data.Lineage, ColumnLineage{Column: name + kind.suffix, Sources: []string{name}, Operation: kind.op})
+            for r := range rows {
+                value := kind.values[r]
+                if r == 0 {
+                    value = name + kind.suffix
+                }
+                rows[r] = append(rows[r], value)
+            }
+        }
+    }
+    data.Notes = append(data.Notes, fmt.Sprintf("Added %d companion column(s) for cell comments and hyperlinks", added))
+    return rows, nil
+}
+
+// shiftColumns re-indexes cols after the columns in removed are dropped.
+func shiftColumns(cols []int, removed map[int]bool) []int {
+    if len(removed) == 0 {
+        return cols
+    }
+    var out []int
+    for _, c := range cols {
+        if removed[c] {
+            continue
+        }
+        shift := 0
+        for r := range removed {
+            if r < c {
+                shift++
+            }
+        }
+        out = append(out, c-shift)
+    }
+    return out
+}
+
+// detectHeaderRows infers the header depth: a merge in the first row that
+// spans several columns is a group label sitting above a row of sub-headers,
+// and a vertical merge from the first row shows how deep the header goes.
+func detectHeaderRows(merges []excelize.MergeCell) int {
+    depth := 1
+    for _, m := range merges {
+        startCol, startRow, err := excelize.CellNameToCoordinates(m.GetStartAxis())
+        if err != nil || startRow != 1 {
+            continue
+        }
+        endCol, endRow, err := excelize.CellNameToCoordinates(m.GetEndAxis())
+        if err != nil {
+            continue
+        }
+        if endRow > depth {
+            depth = endRow
+        }
+        if endCol > startCol && depth < 2 {
+            depth = 2
+        }
+    }
+    return depth
+}
+
+// flattenHeaderRows combines stacked header cells into names such as
+// "Q1 / Revenue", skipping blanks and repeats from vertical merges.
+func flattenHeaderRows(headerRows [][]string) []string {
+    width := 0
+    for _, row := range headerRows {
+        if len(row) > width {
+            width = len(row)
+        }
+    }
+    headers := make([]string, width)
+    for c := 0; c < width; c++ {
+        var parts []string
+        for _, row := range headerRows {
+            part := cellValue(row, c)
+            if part == "" || (len(parts) > 0 && parts[len(parts)-1] == part) {
+                continue
+            }
+            parts = append(parts, part)
+        }
+        headers[c] = strings.Join(parts, " / ")
+    }
+    return normalizeHeaders(headers)
+}
+
+// dedupeHeaders suffixes repeated names in column order: "Amount",
+// "Amount (2)", "Amount (3)".
+func dedupeHeaders(headers []string) []string {
+    seen := make(map[string]bool, len(headers))
+    for _, h := range headers {
+        seen[strings.ToLower(h)] = true
+    }
+    counts := make(map[string]int, len(headers))
+    out := make([]string, len(headers))
+    for i, h := range headers {
+        key := strings.ToLower(h)
+        counts[key]++
+        if counts[key] == 1 {
+            out[i] = h
+            continue
+        }
+        name := fmt.Sprintf("%s (%d)", h, counts[key])
+        for n := counts[key]; seen[strings.ToLower(name)]; n++ {
+            name = fmt.Sprintf("%s (%d)", h, n+1)
+        }
+        seen[strings.ToLower(name)] = true
+        out[i] = name
+    }
+    return out
+}
+
+func normalizeHeaders(row []string) []string {
+    headers := make([]string, len(row))
+    for i, h := range row {
         h = strings.TrimSpace(h)
         if h == "" {
             h = fmt.Sprintf("Column_%d", i+1)
         }
         headers[i] = h
     }
-    data.Headers = headers
-    data.Rows = rows[1:]
-    return data, nil
+    return headers
 }
 
 func detectNumericColumns(data Spreadsheet) []int {
@@ -78,6 +490,9 @@ func detectNumericColumns(data Spreadsheet) []int {
 func isColumnNumeric(data Spreadsheet, colIndex int) bool {
     numericCount := 0
     totalCount := 0
+    // Once more than a fifth of all rows aren't numbers the column can't
+    // reach the threshold, however the rest turn out.
+    giveUp := len(data.Rows) / 5
     for _, row := range data.Rows {
         if colIndex >= len(row) {
             continue
@@ -87,12 +502,100 @@ func isColumnNumeric(data Spreadsheet, colIndex int) bool {
             continue
         }
         totalCount++
+        if !mayBeNumber(val) {
+            if totalCount-numericCount > giveUp {
+                return false
+            }
+            continue
+        }
         if _, err := strconv.ParseFloat(val, 64); err == nil {
             numericCount++
+        } else if totalCount-numericCount > giveUp {
+            return false
         }
     }
     if totalCount == 0 {
         return false
     }
     return float64(numericCount)/float64(totalCount) >= 0.8
-}
\ No newline at end of file
+}
+func detectDateColumns(data Spreadsheet) []int {
+    var dateCols []int
+    for col := range data.Headers {
+        if isColumnDate(data, col) {
+            dateCols = append(dateCols, col)
+        }
+    }
+    return dateCols
+}
+
+func isColumnDate(data Spreadsheet, colIndex int) bool {
+    dateCount := 0
+    totalCount := 0
+    for _, row := range data.Rows {
+        val := cellValue(row, colIndex)
+        if val == "" {
+            continue
+        }
+        totalCount++
+        if _, ok := parseDate(val); ok {
+            dateCount++
+        }
+    }
+    if totalCount == 0 {
+        return false
+    }
+    return float64(dateCount)/float64(totalCount) >= 0.8
+}
+
+// removeRepeatedHeaders drops interior rows that repeat the header row, as
+// left behind by concatenated exports, and notes how many were removed.
+func removeRepeatedHeaders(data *Spreadsheet) int {
+    var rows [][]string
+    removed := 0
+    for i, row := range data.Rows {
+        if isHeaderRow(data.Headers, row) {
+            unsummarizeRow(data, row)
+            if removed == 0 {
+                rows = append(make([][]string, 0, len(data.Rows)-1), data.Rows[:i]...)
+            }
+            removed++
+            continue
+        }
+        if removed > 0 {
+            rows = append(rows, row)
+        }
+    }
+    if removed > 0 {
+        data.Rows = rows
+        data.Notes = append(data.Notes, fmt.Sprintf("Removed %d repeated header row(s) found inside the data", removed))
+    }
+    return removed
+}
+
+func isHeaderRow(headers []string, row []string) bool {
+    // Almost every row differs in its first cell, so check that before
+    // building the normalized copy.
+    if len(headers) > 0 {
+        first := strings.TrimSpace(cellValue(row, 0))
+        if first == "" {
+            first = "Column_1"
+        }
+        if !strings.EqualFold(first, headers[0]) {
+            return false
+        }
+    }
+    for i := len(headers); i < len(row); i++ {
+        if strings.TrimSpace(row[i]) != "" {
+            return false
+        }
+    }
+    padded := make([]string, len(headers))
+    copy(padded, row)
+    for i, h := range dedupeHeaders(normalizeHeaders(padded)) {
+        if !strings.EqualFold(h, headers[i]) {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,164 @@
+// profile.go
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+type ColumnProfile struct {
+	ID       string   `json:"id,omitempty"`
+	Name     string   `json:"name"`
+	Index    int      `json:"index"`
+	Type     string   `json:"type"`
+	Count    int      `json:"count"`
+	Nulls    int      `json:"nulls"`
+	Distinct int      `json:"distinct"`
+	Formulas bool     `json:"has_formulas,omitempty"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	Mean     *float64 `json:"mean,omitempty"`
+	Std      *float64 `json:"std,omitempty"`
+	Note     string   `json:"note,omitempty"`
+	Geo      string   `json:"geo,omitempty"` // province or country
+}
+
+type DataProfile struct {
+	Rows    int             `json:"rows"`
+	Note    string          `json:"note,omitempty"`
+	Columns []ColumnProfile `json:"columns"`
+}
+
+func profileDataset(data Spreadsheet, prog *Progress) DataProfile {
+	numeric := make(map[int]bool)
+	for _, col := range data.NumericCols {
+		numeric[col] = true
+	}
+	dates := make(map[int]bool)
+	for _, col := range detectDateColumns(data) {
+		dates[col] = true
+	}
+
+	formulas := make(map[int]bool)
+	for _, col := range data.FormulaCols {
+		formulas[col] = true
+	}
+
+	profile := DataProfile{Rows: len(data.Rows), Note: data.Annotations.Dataset}
+	for col, name := range data.Headers {
+		p := ColumnProfile{Name: name, Index: col, Type: "text", Formulas: formulas[col], Note: data.Annotations.Columns[name]}
+		if col < len(data.ColumnIDs) {
+			p.ID = data.ColumnIDs[col]
+		}
+		seen := make(map[string]bool)
+		for _, row := range data.Rows {
+			val := cellValue(row, col)
+			if val == "" {
+				p.Nulls++
+				continue
+			}
+			p.Count++
+			seen[val] = true
+		}
+		p.Distinct = len(seen)
+		switch {
+		case p.Count == 0:
+			p.Type = "empty"
+		case numeric[col]:
+			p.Type = "numeric"
+		case dates[col]:
+			p.Type = "date"
+		default:
+			p.Geo = detectGeoKind(seen)
+		}
+		if numeric[col] {
+			if s := columnSummary(data, col); s.Count > 0 {
+				p.Min = finitePtr(s.Min)
+				p.Max = finitePtr(s.Max)
+				p.Mean = finitePtr(s.Total() / float64(s.Count))
+				p.Std = finitePtr(s.Std())
+			}
+		}
+		profile.Columns = append(profile.Columns, p)
+		prog.Add(len(data.Rows))
+	}
+	return profile
+}
+
+func finitePtr(v float64) *float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	return &v
+}
+
+type HistogramBin struct {
+	Low   float64 `json:"low"`
+	High  float64 `json:"high"`
+	Count int     `json:"count"`
+}
+
+type ColumnStats struct {
+	ColumnProfile
+	Median      *float64            `json:"median,omitempty"`
+	Percentiles map[string]*float64 `json:"percentiles,omitempty"`
+	Histogram   []HistogramBin      `json:"histogram,omitempty"`
+	Matched     *ColumnMatch        `json:"matched,omitempty"`
+}
+
+var statsPercentiles = []float64{1, 5, 25, 50, 75, 95, 99}
+
+func columnStats(data Spreadsheet, col, bins int) ColumnStats {
+	stats := ColumnStats{ColumnProfile: profileFor(data).Columns[col]}
+	if stats.Type != "numeric" {
+		return stats
+	}
+	values := storedValues(data, col)
+	if len(values) == 0 {
+		return stats
+	}
+	sorted := sortedCopy(values)
+	stats.Median = finitePtr(medianSorted(sorted))
+	stats.Percentiles = make(map[string]*float64, len(statsPercentiles))
+	for _, p := range statsPercentiles {
+		stats.Percentiles["p"+strconv.FormatFloat(p, 'f', -1, 64)] = finitePtr(percentileSorted(sorted, p))
+	}
+	stats.Histogram = histogram(values, bins)
+	return stats
+}
+
+// histogram splits [min, max] into equal-width bins; the last bin is closed
+// so the maximum is counted.
+func histogram(values []float64, bins int) []HistogramBin {
+	lo, hi := min(values), max(values)
+	if math.IsInf(lo, 0) || math.IsInf(hi, 0) || math.IsNaN(lo) || math.IsNaN(hi) {
+		return nil
+	}
+	if lo == hi {
+		return []HistogramBin{{Low: lo, High: hi, Count: len(values)}}
+	}
+	width := (hi - lo) / float64(bins)
+	out := make([]HistogramBin, bins)
+	for i := range out {
+		out[i].Low = lo + float64(i)*width
+		out[i].High = lo + float64(i+1)*width
+	}
+	out[bins-1].High = hi
+	for _, v := range values {
+		i := int((v - lo) / width)
+		if i >= bins {
+			i = bins - 1
+		}
+		out[i].Count++
+	}
+	return out
+}
+
+// Table exposes the histogram, which is the tabular part of the stats.
+func (s ColumnStats) Table() ([]string, [][]string) {
+	rows := make([][]string, len(s.Histogram))
+	for i, b := range s.Histogram {
+		rows[i] = []string{strconv.FormatFloat(b.Low, 'f', -1, 64), strconv.FormatFloat(b.High, 'f', -1, 64), strconv.Itoa(b.Count)}
+	}
+	return []string{"low", "high", "count"}, rows
+}
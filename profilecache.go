@@ -0,0 +1,151 @@
+// profilecache.go
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// CachedProfile is everything derived from a dataset for display: its
+// column profile and the stats shown in the table headers.
+type CachedProfile struct {
+	Version     int
+	Profile     DataProfile
+	HeaderStats map[int]*HeaderStats
+}
+
+// ProfileCache keeps the latest profile of each dataset. In-place edits
+// recompute it in the background, so the request that made the edit doesn't
+// wait on a full pass over the data; until then the dataset's profile is
+// reported as updating.
+type ProfileCache struct {
+	mu      sync.Mutex
+	entries map[string]CachedProfile
+	pending map[string]int       // newest version being computed, by dataset ID
+	running map[string]*Progress // of that computation
+}
+
+var profiles = &ProfileCache{entries: make(map[string]CachedProfile), pending: make(map[string]int), running: make(map[string]*Progress)}
+
+// computeProfile makes one pass over the rows per column for the profile
+// and another per numeric column for the header stats; prog counts both.
+func computeProfile(data Spreadsheet, prog *Progress) CachedProfile {
+	return CachedProfile{Version: data.Version, Profile: profileDataset(data, prog), HeaderStats: headerStats(data, prog)}
+}
+
+// Refresh starts recomputing data's profile in the background.
+func (c *ProfileCache) Refresh(data Spreadsheet) {
+	prog := newProgress(len(data.Rows), int64(len(data.Rows))*int64(len(data.Headers)+len(data.NumericCols)))
+	c.mu.Lock()
+	c.pending[data.ID] = data.Version
+	c.running[data.ID] = prog
+	c.mu.Unlock()
+	go func() { c.store(data.ID, computeProfile(data, prog)) }()
+}
+
+// Progress reports how far the refresh of dataset id has got, while one is
+// running.
+func (c *ProfileCache) Progress(id string) (ProgressStatus, bool) {
+	c.mu.Lock()
+	prog, ok := c.running[id]
+	c.mu.Unlock()
+	if !ok {
+		return ProgressStatus{}, false
+	}
+	return prog.Status(), true
+}
+
+// store keeps p unless a newer version is already cached.
+func (c *ProfileCache) store(id string, p CachedProfile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cur, ok := c.entries[id]; ok && cur.Version > p.Version {
+		return
+	}
+	c.entries[id] = p
+	if v, ok := c.pending[id]; ok && v <= p.Version {
+		delete(c.pending, id)
+		delete(c.running, id)
+	}
+}
+
+// Lookup returns the newest profile cached for data and whether it matches
+// data's version. It only falls behind while a refresh for data's version is
+// still running; otherwise a missing or stale profile is computed now.
+func (c *ProfileCache) Lookup(data Spreadsheet) (CachedProfile, bool) {
+	c.mu.Lock()
+	p, cached := c.entries[data.ID]
+	v, pending := c.pending[data.ID]
+	c.mu.Unlock()
+	if cached && p.Version == data.Version {
+		return p, true
+	}
+	if cached && pending && v >= data.Version {
+		return p, false
+	}
+	p = computeProfile(data, nil)
+	c.store(data.ID, p)
+	return p, true
+}
+
+func (c *ProfileCache) Forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+	delete(c.pending, id)
+	delete(c.running, id)
+}
+
+// profileFor returns data's up-to-date profile, computing it now rather than
+// waiting for a background refresh.
+func profileFor(data Spreadsheet) DataProfile {
+	if p, current := profiles.Lookup(data); current {
+		return p.Profile
+	}
+	return profileDataset(data, nil)
+}
+
+// headerStatsFor returns data's header stats, or false while they're being
+// recomputed after a change.
+func headerStatsFor(data Spreadsheet) (map[int]*HeaderStats, bool) {
+	p, current := profiles.Lookup(data)
+	if !current {
+		return nil, false
+	}
+	return p.HeaderStats, true
+}
+
+// displayProfileHandler answers the display page's poll after a change:
+// 202 with how far it has got while the profile is still updating (204 when
+// that isn't known), then the table header with fresh stats.
+func displayProfileHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := teamDataset(r, r.URL.Query().Get("dataset"))
+	if !ok {
+		http.Error(w, "Unknown dataset", http.StatusNotFound)
+		return
+	}
+	if v := r.URL.Query().Get("version"); v != "" && v != strconv.Itoa(data.Version) {
+		http.Error(w, (&VersionConflict{Current: data.Version}).Error(), http.StatusConflict)
+		return
+	}
+	stats, ready := headerStatsFor(data)
+	if !ready {
+		p, ok := profiles.Progress(data.ID)
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(p.String()))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	head := DisplayData{Headers: data.Headers, NumericCols: data.NumericCols, FormulaCols: data.FormulaCols,
+		Annotations: data.Annotations, HeaderStats: stats}
+	if err := displayTemplate.ExecuteTemplate(w, "tableHead", head); err != nil {
+		log.Printf("Template error: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+// progress.go
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Progress counts how far a background job over a dataset has got. The job
+// declares its work up front in whatever units suit it and adds to Done as
+// it goes; Status reports that as a share of the dataset's rows. A nil
+// *Progress ignores everything, for callers nobody is watching.
+type Progress struct {
+	done    atomic.Int64
+	total   int64
+	rows    int
+	started time.Time
+}
+
+func newProgress(rows int, total int64) *Progress {
+	return &Progress{total: total, rows: rows, started: time.Now()}
+}
+
+func (p *Progress) Add(n int) {
+	if p != nil {
+		p.done.Add(int64(n))
+	}
+}
+
+// ProgressStatus is a snapshot of a Progress. ETA comes from the throughput
+// so far and is left out until there is some.
+type ProgressStatus struct {
+	RowsProcessed int       `json:"rows_processed"`
+	RowsTotal     int       `json:"rows_total"`
+	Percent       float64   `json:"percent"`
+	ETASeconds    *float64  `json:"eta_seconds,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+}
+
+func (p *Progress) Status() ProgressStatus {
+	s := ProgressStatus{RowsTotal: p.rows, StartedAt: p.started}
+	done := p.done.Load()
+	if p.total <= 0 {
+		return s
+	}
+	if done > p.total {
+		done = p.total
+	}
+	frac := float64(done) / float64(p.total)
+	s.RowsProcessed = int(math.Round(frac * float64(p.rows)))
+	s.Percent = math.Round(frac*1000) / 10
+	if elapsed := time.Since(p.started).Seconds(); done > 0 && elapsed > 0 {
+		eta := math.Ceil(float64(p.total-done) / (float64(done) / elapsed))
+		s.ETASeconds = &eta
+	}
+	return s
+}
+
+func (s ProgressStatus) String() string {
+	msg := fmt.Sprintf("%.0f%% · %d of %d rows", s.Percent, s.RowsProcessed, s.RowsTotal)
+	if s.ETASeconds != nil {
+		msg += " · about " + (time.Duration(*s.ETASeconds) * time.Second).String() + " left"
+	}
+	return msg
+}
@@ -0,0 +1,84 @@
+// projection.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// columnProjection names the columns of a file to load, as headers read by
+// the upload. Empty loads every column.
+type columnProjection []string
+
+func columnsFromForm(r *http.Request) columnProjection {
+	var p columnProjection
+	for _, name := range r.Form["columns"] {
+		if name = strings.TrimSpace(name); name != "" {
+			p = append(p, name)
+		}
+	}
+	return p
+}
+
+// indexes resolves the projection against headers, in file order. nil means
+// every column is kept.
+func (p columnProjection) indexes(headers []string) ([]int, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	wanted := make(map[string]bool, len(p))
+	for _, name := range p {
+		if columnIndex(headers, name) == -1 {
+			return nil, fmt.Errorf("no column named %q", name)
+		}
+		wanted[name] = true
+	}
+	var keep []int
+	for i, h := range headers {
+		if wanted[h] {
+			keep = append(keep, i)
+		}
+	}
+	if len(keep) == len(headers) {
+		return nil, nil
+	}
+	return keep, nil
+}
+
+func (p columnProjection) note(kept, total int) string {
+	return fmt.Sprintf("Loaded %d of %d columns", kept, total)
+}
+
+// projectRow copies the kept cells. They're cloned because a CSV reader's
+// fields share one string per line, which would otherwise stay in memory
+// whole.
+func projectRow(row []string, keep []int) []string {
+	out := make([]string, len(keep))
+	for i, c := range keep {
+		out[i] = strings.Clone(cellValue(row, c))
+	}
+	return out
+}
+
+// apply drops the columns outside the projection from a parsed sheet.
+func (p columnProjection) apply(data *Spreadsheet) error {
+	keep, err := p.indexes(data.Headers)
+	if err != nil || keep == nil {
+		return err
+	}
+	removed := make(map[int]bool, len(data.Headers)-len(keep))
+	for i := range data.Headers {
+		removed[i] = true
+	}
+	for _, c := range keep {
+		delete(removed, c)
+	}
+	for i, row := range data.Rows {
+		data.Rows[i] = projectRow(row, keep)
+	}
+	data.FormulaCols = shiftColumns(data.FormulaCols, removed)
+	data.Notes = append(data.Notes, p.note(len(keep), len(data.Headers)))
+	data.Headers = projectRow(data.Headers, keep)
+	return nil
+}
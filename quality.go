@@ -0,0 +1,314 @@
+// quality.go
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxFailingRows = 50
+
+// Validator checks one kind of identifier. Validators are assigned to
+// columns by ID in Spreadsheet.Validators.
+type Validator struct {
+	Name  string
+	Label string
+	Check func(string) bool
+}
+
+var validators = []Validator{
+	{Name: "email", Label: "Email address", Check: validEmail},
+	{Name: "e164", Label: "Phone (E.164)", Check: validE164},
+	{Name: "za_phone", Label: "Phone (South Africa)", Check: validZAPhone},
+	{Name: "za_id", Label: "SA ID number", Check: validZAID},
+	{Name: "iban", Label: "IBAN", Check: validIBAN},
+}
+
+func lookupValidator(name string) (Validator, bool) {
+	for _, v := range validators {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Validator{}, false
+}
+
+var (
+	emailPattern = regexp.MustCompile(`^[^\s@]+@[^\s@.]+(\.[^\s@.]+)+$`)
+	e164Pattern  = regexp.MustCompile(`^\+[1-9]\d{6,14}$`)
+	zaPhone      = regexp.MustCompile(`^(0|\+?27)[1-9]\d{8}$`)
+	ibanPattern  = regexp.MustCompile(`^[A-Z]{2}\d{2}[A-Z0-9]{11,30}$`)
+)
+
+// phoneDigits drops the separators people type in phone numbers.
+func phoneDigits(s string) string {
+	return strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "").Replace(s)
+}
+
+func validEmail(s string) bool {
+	return len(s) <= 254 && emailPattern.MatchString(s)
+}
+
+func validE164(s string) bool {
+	return e164Pattern.MatchString(phoneDigits(s))
+}
+
+func validZAPhone(s string) bool {
+	return zaPhone.MatchString(phoneDigits(s))
+}
+
+// validZAID checks a 13-digit SA ID number: a real YYMMDD birth date, a
+// citizenship digit of 0 or 1 and the Luhn check digit.
+func validZAID(s string) bool {
+	s = strings.ReplaceAll(s, " ", "")
+	if len(s) != 13 {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	if _, err := time.Parse("060102", s[:6]); err != nil {
+		return false
+	}
+	if s[10] != '0' && s[10] != '1' {
+		return false
+	}
+	sum := 0
+	for i := 0; i < 13; i++ {
+		d := int(s[12-i] - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// validIBAN applies the ISO 13616 mod-97 check.
+func validIBAN(s string) bool {
+	s = strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+	if !ibanPattern.MatchString(s) {
+		return false
+	}
+	var digits strings.Builder
+	for _, r := range s[4:] + s[:4] {
+		if r >= 'A' && r <= 'Z' {
+			digits.WriteString(strconv.Itoa(int(r-'A') + 10))
+		} else {
+			digits.WriteRune(r)
+		}
+	}
+	n, ok := new(big.Int).SetString(digits.String(), 10)
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+type FailingCell struct {
+	Row   int // 1-based, as on the display page
+	Value string
+}
+
+// ColumnValidity is how many non-blank cells of a column pass a validator.
+type ColumnValidity struct {
+	Checked int
+	Valid   int
+	Failing []FailingCell // the first maxFailingRows, unless all is set
+}
+
+func (v ColumnValidity) Percent() float64 {
+	if v.Checked == 0 {
+		return 100
+	}
+	return float64(v.Valid) * 100 / float64(v.Checked)
+}
+
+func checkColumn(data Spreadsheet, col int, check func(string) bool, all bool) ColumnValidity {
+	var v ColumnValidity
+	for i, row := range data.Rows {
+		val := cellValue(row, col)
+		if val == "" {
+			continue
+		}
+		v.Checked++
+		if check(val) {
+			v.Valid++
+		} else if all || len(v.Failing) < maxFailingRows {
+			v.Failing = append(v.Failing, FailingCell{Row: i + 1, Value: val})
+		}
+	}
+	return v
+}
+
+// suggestValidator returns the validator that at least 90% of a column's
+// values pass, if any.
+func suggestValidator(data Spreadsheet, col int) (Validator, bool) {
+	for _, vd := range validators {
+		if v := checkColumn(data, col, vd.Check, false); v.Checked > 0 && v.Percent() >= 90 {
+			return vd, true
+		}
+	}
+	return Validator{}, false
+}
+
+// qualityHandler is the data-quality report: completeness of every column
+// and, for columns with a validator, how many values are valid and which
+// rows fail. POST assigns or clears a column's validator.
+func qualityHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	data := activeDataset(r)
+	if id := r.FormValue("dataset"); id != "" {
+		var ok bool
+		if data, ok = teamDataset(r, id); !ok {
+			http.Error(w, "Unknown dataset", http.StatusNotFound)
+			return
+		}
+	}
+	if len(data.Headers) == 0 {
+		http.Error(w, "No dataset loaded", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if err := checkVersion(r, data); err != nil {
+			http.Error(w, err.Error(), updateErrorStatus(w, err))
+			return
+		}
+		col := columnRef(data, r.FormValue("column"))
+		if col == -1 || col >= len(data.ColumnIDs) {
+			http.Error(w, "Unknown column", http.StatusBadRequest)
+			return
+		}
+		name := r.FormValue("validator")
+		if _, ok := lookupValidator(name); name != "" && !ok {
+			http.Error(w, fmt.Sprintf("Unknown validator %q", name), http.StatusBadRequest)
+			return
+		}
+		assigned := make(map[string]string, len(data.Validators)+1)
+		for k, v := range data.Validators {
+			assigned[k] = v
+		}
+		if name == "" {
+			delete(assigned, data.ColumnIDs[col])
+		} else {
+			assigned[data.ColumnIDs[col]] = name
+		}
+		data.Validators = assigned
+		if err := workspace.Update(&data); err != nil {
+			http.Error(w, err.Error(), updateErrorStatus(w, err))
+			return
+		}
+		http.Redirect(w, r, "/quality?dataset="+url.QueryEscape(data.ID), http.StatusSeeOther)
+		return
+	}
+
+	validatorFor := func(col int) (Validator, bool) {
+		if col >= len(data.ColumnIDs) {
+			return Validator{}, false
+		}
+		return lookupValidator(data.Validators[data.ColumnIDs[col]])
+	}
+
+	if ref := r.FormValue("failing"); ref != "" {
+		col := columnRef(data, ref)
+		vd, ok := validatorFor(col)
+		if col == -1 || !ok {
+			http.Error(w, "That column has no validator", http.StatusBadRequest)
+			return
+		}
+		v := checkColumn(data, col, vd.Check, true)
+		rows := make([][]string, len(v.Failing))
+		for i, f := range v.Failing {
+			rows[i] = []string{strconv.Itoa(f.Row), f.Value}
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_invalid_%s.csv"`, exportBaseName(data.FileName), vd.Name))
+		writeCSV(w, []string{"Row", data.Headers[col]}, rows)
+		return
+	}
+
+	profile := profileFor(data)
+	overview := ReportSection{Title: "Columns", Headers: []string{"Column", "Type", "Filled", "Distinct", "Validator", "Valid", "Failing"}}
+	var details []ReportSection
+	for col, p := range profile.Columns {
+		filled := "–"
+		if profile.Rows > 0 {
+			filled = formatStat(float64(p.Count)*100/float64(profile.Rows)) + "%"
+		}
+		row := []string{p.Name, p.Type, filled, strconv.Itoa(p.Distinct), "", "", ""}
+		vd, ok := validatorFor(col)
+		if !ok {
+			if p.Type == "text" {
+				if s, found := suggestValidator(data, col); found {
+					row[4] = "Suggested: " + s.Label
+				}
+			}
+			overview.Rows = append(overview.Rows, row)
+			continue
+		}
+		v := checkColumn(data, col, vd.Check, false)
+		failing := v.Checked - v.Valid
+		row[4], row[5], row[6] = vd.Label, formatStat(v.Percent())+"%", strconv.Itoa(failing)
+		overview.Rows = append(overview.Rows, row)
+
+		section := ReportSection{Title: fmt.Sprintf("%s (%s)", p.Name, vd.Label)}
+		if failing == 0 {
+			section.Notes = []string{fmt.Sprintf("✅ All %d value(s) are valid.", v.Checked)}
+		} else {
+			section.Notes = []string{fmt.Sprintf("⚠️ %d of %d value(s) fail.", failing, v.Checked)}
+			if failing > len(v.Failing) {
+				section.Notes = append(section.Notes, fmt.Sprintf("Showing the first %d; export the full list below.", len(v.Failing)))
+			}
+			section.Headers = []string{"Row", p.Name}
+			for _, f := range v.Failing {
+				section.Rows = append(section.Rows, []string{strconv.Itoa(f.Row), f.Value})
+			}
+			q := url.Values{"dataset": {data.ID}, "failing": {p.ID}}
+			section.Links = []ReportLink{{Label: "📊 Export Failing Rows (CSV)", URL: "/quality?" + q.Encode()}}
+		}
+		details = append(details, section)
+	}
+
+	columnOptions := make([]FormOption, len(data.Headers))
+	for i, h := range data.Headers {
+		columnOptions[i] = FormOption{Value: data.ColumnIDs[i], Label: h}
+	}
+	validatorOptions := []FormOption{{Value: "", Label: "None"}}
+	for _, vd := range validators {
+		validatorOptions = append(validatorOptions, FormOption{Value: vd.Name, Label: vd.Label})
+	}
+	assign := ReportSection{Title: "Assign a Validator", Form: &ReportForm{Action: "/quality", Submit: "Save", Fields: []FormField{
+		{Name: "dataset", Type: "hidden", Value: data.ID},
+		{Name: "version", Type: "hidden", Value: strconv.Itoa(data.Version)},
+		{Name: "column", Label: "Column", Type: "select", Options: columnOptions},
+		{Name: "validator", Label: "Validator", Type: "select", Options: validatorOptions},
+	}}}
+	sections := append([]ReportSection{overview}, details...)
+	rules := ReportSection{Title: "Validation Rules", Links: []ReportLink{{Label: "📐 Edit and Run Rules", URL: "/rules?dataset=" + url.QueryEscape(data.ID)}}}
+	if len(data.Rules) == 0 {
+		rules.Notes = []string{"No row-level rules are defined for this dataset."}
+	} else {
+		rules.Headers = []string{"Rule", "Violations"}
+		for _, rule := range data.Rules {
+			res := runRule(data, rule, false)
+			count := strconv.Itoa(res.Violated)
+			if res.Err != nil {
+				count = "⚠️ " + res.Err.Error()
+			}
+			rules.Rows = append(rules.Rows, []string{rule.Name, count})
+		}
+	}
+	sections = append(sections, rules)
+	renderReport(w, ReportPage{Title: "Data Quality", Subtitle: data.FileName, Sections: append(sections, assign)})
+}
@@ -0,0 +1,159 @@
+// quota.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// UploadTotals is the lifetime upload accounting for one owner. Unlike the
+// quota usage it doesn't go down when datasets are removed.
+type UploadTotals struct {
+	Uploads    int       `json:"uploads"`
+	Bytes      int64     `json:"bytes"`
+	LastUpload time.Time `json:"last_upload"`
+}
+
+type UploadLedger struct {
+	mu     sync.Mutex
+	path   string
+	totals map[string]UploadTotals
+}
+
+var uploadLedger = newUploadLedger(dataPath("uploads.json"))
+
+func newUploadLedger(path string) *UploadLedger {
+	l := &UploadLedger{path: path, totals: make(map[string]UploadTotals)}
+	l.load()
+	watchDataFile(path, l.load)
+	return l
+}
+
+// load reads the accounting file, replacing what is in memory.
+func (l *UploadLedger) load() {
+	totals := make(map[string]UploadTotals)
+	if err := readJSONFile(l.path, &totals); err != nil {
+		log.Printf("Could not load upload accounting: %v", err)
+		return
+	}
+	l.mu.Lock()
+	l.totals = totals
+	l.mu.Unlock()
+}
+
+func (l *UploadLedger) Record(owner string, size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := l.totals[owner]
+	t.Uploads++
+	t.Bytes += size
+	t.LastUpload = time.Now()
+	l.totals[owner] = t
+	if err := writeJSONFile(l.path, l.totals); err != nil {
+		log.Printf("Could not save upload accounting: %v", err)
+	}
+}
+
+func (l *UploadLedger) Get(owner string) UploadTotals {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.totals[owner]
+}
+
+type QuotaUsage struct {
+	Datasets    int          `json:"datasets"`
+	Bytes       int64        `json:"bytes"`
+	MaxDatasets int          `json:"max_datasets,omitempty"`
+	MaxBytes    int64        `json:"max_bytes,omitempty"`
+	Lifetime    UploadTotals `json:"lifetime"`
+}
+
+func (u QuotaUsage) String() string {
+	datasets := fmt.Sprintf("%d datasets", u.Datasets)
+	if u.MaxDatasets > 0 {
+		datasets = fmt.Sprintf("%d of %d datasets", u.Datasets, u.MaxDatasets)
+	}
+	bytes := formatFileSize(u.Bytes)
+	if u.MaxBytes > 0 {
+		bytes += " of " + formatFileSize(u.MaxBytes)
+	}
+	return datasets + ", " + bytes + " used"
+}
+
+// datasetBytes estimates the memory a dataset occupies, which is what the
+// byte quota limits. Derived datasets count too since they hold copies.
+func datasetBytes(data Spreadsheet) int64 {
+	var n int64
+	for _, h := range data.Headers {
+		n += int64(len(h))
+	}
+	for _, row := range data.Rows {
+		for _, cell := range row {
+			n += int64(len(cell))
+		}
+	}
+	return n
+}
+
+// DatasetUsage is what one owner's datasets take up. The workspace keeps a
+// running total per owner, so checking the quota doesn't size every dataset.
+type DatasetUsage struct {
+	Datasets int   `json:"datasets"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// plus returns u with data added, or taken away when n is -1.
+func (u DatasetUsage) plus(n int, data Spreadsheet) DatasetUsage {
+	u.Datasets += n
+	u.Bytes += int64(n) * datasetBytes(data)
+	return u
+}
+
+func quotaUsage(owner string, used DatasetUsage) QuotaUsage {
+	return QuotaUsage{
+		Datasets:    used.Datasets,
+		Bytes:       used.Bytes,
+		MaxDatasets: config.QuotaDatasets,
+		MaxBytes:    config.QuotaBytes,
+		Lifetime:    uploadLedger.Get(owner),
+	}
+}
+
+func usageFor(owner string) QuotaUsage {
+	return quotaUsage(owner, workspace.Usage(owner))
+}
+
+// errOverQuota is wrapped by the errors checkQuota and checkGrowth return.
+var errOverQuota = errors.New("quota exceeded")
+
+// checkQuota reports whether data fits in what its owner has left, given
+// what they use now. Workspace.Add calls it and stores data in one step, so
+// two uploads can't both take the last of the quota. The error carries the
+// current usage so the user knows where they stand.
+func checkQuota(used DatasetUsage, data Spreadsheet) error {
+	u := quotaUsage(data.Owner, used)
+	if u.MaxDatasets > 0 && u.Datasets+1 > u.MaxDatasets {
+		return fmt.Errorf("dataset %w (%s)", errOverQuota, u)
+	}
+	if size := datasetBytes(data); u.MaxBytes > 0 && u.Bytes+size > u.MaxBytes {
+		return fmt.Errorf("storage %w: this dataset needs %s (%s)", errOverQuota, formatFileSize(size), u)
+	}
+	return nil
+}
+
+// checkGrowth is checkQuota for adding size bytes to one of owner's
+// datasets.
+func checkGrowth(owner string, size int64) error {
+	if u := usageFor(owner); u.MaxBytes > 0 && u.Bytes+size > u.MaxBytes {
+		return fmt.Errorf("storage %w: the new rows need %s (%s)", errOverQuota, formatFileSize(size), u)
+	}
+	return nil
+}
+
+func usageAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIData(w, r, usageFor(ownerID(currentUser(r))))
+}
@@ -0,0 +1,149 @@
+// quota_test.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// useQuota sets the quota limits for the rest of the test.
+func useQuota(t *testing.T, datasets int, bytes int64) {
+	saved := config
+	config.QuotaDatasets, config.QuotaBytes = datasets, bytes
+	t.Cleanup(func() { config = saved })
+}
+
+// useSharedState gives the test an empty shared backend, as several
+// replicas would see it.
+func useSharedState(t *testing.T) {
+	savedState, savedShared := state, stateShared
+	state, stateShared = newMemoryState(), true
+	t.Cleanup(func() { state, stateShared = savedState, savedShared })
+}
+
+// addConcurrently adds a dataset for owner n times at once, spread over the
+// given workspaces, and returns how many were stored.
+func addConcurrently(t *testing.T, n int, owner string, replicas ...*Workspace) int {
+	t.Helper()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stored := 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(ws *Workspace) {
+			defer wg.Done()
+			_, err := ws.Add(Spreadsheet{Owner: owner, Headers: []string{"A"}, Rows: [][]string{{"12345"}}})
+			if err != nil && !errors.Is(err, errOverQuota) {
+				t.Error(err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				stored++
+			}
+		}(replicas[i%len(replicas)])
+	}
+	wg.Wait()
+	return stored
+}
+
+func TestQuotaConcurrentUploads(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		t.Run(fmt.Sprintf("shared=%v", shared), func(t *testing.T) {
+			useQuota(t, 3, 0)
+			replicas := []*Workspace{newWorkspace()}
+			if shared {
+				useSharedState(t)
+				replicas = append(replicas, newWorkspace())
+			}
+			if n := addConcurrently(t, 12, "a@example.com", replicas...); n != 3 {
+				t.Errorf("stored %d datasets with a quota of 3", n)
+			}
+			for _, ws := range replicas {
+				if u := ws.Usage("a@example.com"); u != (DatasetUsage{Datasets: 3, Bytes: 18}) {
+					t.Errorf("usage is %+v", u)
+				}
+			}
+		})
+	}
+}
+
+// The running totals follow datasets through updates, the trash and
+// restores, the same as counting them would.
+func TestQuotaRunningTotals(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		t.Run(fmt.Sprintf("shared=%v", shared), func(t *testing.T) {
+			useQuota(t, 0, 20)
+			if shared {
+				useSharedState(t)
+			}
+			ws := newWorkspace()
+			check := func(step string, want DatasetUsage) {
+				t.Helper()
+				var counted DatasetUsage
+				for _, data := range ws.List() {
+					if data.Owner == "a@example.com" {
+						counted = counted.plus(1, data)
+					}
+				}
+				if u := ws.Usage("a@example.com"); u != want || counted != want {
+					t.Errorf("after %s: usage %+v, counted %+v, want %+v", step, u, counted, want)
+				}
+			}
+
+			first, err := ws.Add(Spreadsheet{Owner: "a@example.com", Headers: []string{"A"}, Rows: [][]string{{"123"}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ws.Add(Spreadsheet{Owner: "b@example.com", Headers: []string{"B"}, Rows: [][]string{{"1"}}}); err != nil {
+				t.Fatal(err)
+			}
+			check("adding", DatasetUsage{Datasets: 1, Bytes: 4})
+
+			first.Rows = append(first.Rows, []string{"4567"})
+			if err := ws.Update(&first); err != nil {
+				t.Fatal(err)
+			}
+			check("growing", DatasetUsage{Datasets: 1, Bytes: 8})
+
+			_, err = ws.Add(Spreadsheet{Owner: "a@example.com", Headers: []string{"C"}, Rows: [][]string{{"12345678901234"}}})
+			if !errors.Is(err, errOverQuota) {
+				t.Errorf("15 bytes more with 8 of 20 used: %v", err)
+			}
+			check("a rejected upload", DatasetUsage{Datasets: 1, Bytes: 8})
+
+			if !ws.Delete(first.ID, "a@example.com") {
+				t.Fatal("couldn't delete")
+			}
+			check("deleting", DatasetUsage{})
+			if _, ok := ws.Restore(first.ID); !ok {
+				t.Fatal("couldn't restore")
+			}
+			check("restoring", DatasetUsage{Datasets: 1, Bytes: 8})
+			if u := ws.Usage("b@example.com"); u != (DatasetUsage{Datasets: 1, Bytes: 2}) {
+				t.Errorf("the other owner's usage is %+v", u)
+			}
+		})
+	}
+}
+
+// Datasets stored before the totals were kept are counted once.
+func TestQuotaSharedTotalsCounted(t *testing.T) {
+	useQuota(t, 2, 0)
+	useSharedState(t)
+	ws := newWorkspace()
+	if _, err := ws.Add(Spreadsheet{Owner: "a@example.com", Headers: []string{"A"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Delete("usage"); err != nil {
+		t.Fatal(err)
+	}
+	if u := ws.Usage("a@example.com"); u.Datasets != 1 {
+		t.Errorf("counted %+v", u)
+	}
+	if n := addConcurrently(t, 4, "a@example.com", ws); n != 1 {
+		t.Errorf("stored %d more with 1 of 2 used", n)
+	}
+}
@@ -0,0 +1,301 @@
+// redis.go
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisState is the StateBackend for redis:// URLs. It speaks just enough
+// RESP for the handful of commands the backend needs.
+type redisState struct {
+	addr     string
+	tls      bool
+	password string
+	username string
+	db       int
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+const redisMaxIdle = 8
+
+// Release only deletes the lock if the caller still holds it, Acquire
+// extends a lock its holder asks for again and Incr sets the expiry only on
+// a new counter; each must be atomic, hence Lua.
+const (
+	redisAcquireScript = `if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then return 1 end
+if redis.call("GET", KEYS[1]) == ARGV[1] then redis.call("PEXPIRE", KEYS[1], ARGV[2]) return 1 end
+return 0`
+	redisIncrScript = `local n = redis.call("INCR", KEYS[1])
+if n == 1 then redis.call("PEXPIRE", KEYS[1], ARGV[1]) end
+return n`
+	redisReleaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end
+return 0`
+)
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func newRedisState(spec string) (*redisState, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	s := &redisState{addr: u.Host, tls: u.Scheme == "rediss"}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("bad database number %q", db)
+		}
+	}
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	s.put(c)
+	return s, nil
+}
+
+func (s *redisState) dial() (*redisConn, error) {
+	var conn net.Conn
+	var err error
+	d := &net.Dialer{Timeout: 5 * time.Second}
+	if s.tls {
+		host, _, _ := net.SplitHostPort(s.addr)
+		conn, err = tls.DialWithDialer(d, "tcp", s.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = d.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if s.password != "" {
+		args := []string{"AUTH", s.password}
+		if s.username != "" {
+			args = []string{"AUTH", s.username, s.password}
+		}
+		if _, err := c.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(s.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (s *redisState) get() (*redisConn, error) {
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		c := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return c, nil
+	}
+	s.mu.Unlock()
+	return s.dial()
+}
+
+func (s *redisState) put(c *redisConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.idle) >= redisMaxIdle {
+		c.conn.Close()
+		return
+	}
+	s.idle = append(s.idle, c)
+}
+
+// do runs one command. Connections that fail at the network level are
+// dropped; a command error from the server leaves the connection usable.
+func (s *redisState) do(args ...string) (interface{}, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		c.conn.Close()
+		return nil, err
+	}
+	s.put(c)
+	return reply, err
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read parses one reply: strings and bulk strings come back as []byte (nil
+// for a null), integers as int64 and arrays as []interface{}.
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		if string(b[n:]) != "\r\n" {
+			return nil, fmt.Errorf("redis: bulk reply longer than its length")
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func redisTTL(ttl time.Duration) []string {
+	if ttl <= 0 {
+		return nil
+	}
+	return []string{"PX", strconv.FormatInt(ttl.Milliseconds(), 10)}
+}
+
+func (s *redisState) Get(key string) ([]byte, error) {
+	reply, err := s.do("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	b, _ := reply.([]byte)
+	if b == nil {
+		return nil, errStateMissing
+	}
+	return b, nil
+}
+
+func (s *redisState) Set(key string, value []byte, ttl time.Duration) error {
+	_, err := s.do(append([]string{"SET", key, string(value)}, redisTTL(ttl)...)...)
+	return err
+}
+
+func (s *redisState) Delete(key string) error {
+	_, err := s.do("DEL", key)
+	return err
+}
+
+func (s *redisState) Keys(prefix string) ([]string, error) {
+	pattern := strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`).Replace(prefix) + "*"
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := s.do("SCAN", cursor, "MATCH", pattern, "COUNT", "500")
+		if err != nil {
+			return nil, err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return nil, fmt.Errorf("redis: unexpected SCAN reply")
+		}
+		next, _ := parts[0].([]byte)
+		batch, _ := parts[1].([]interface{})
+		for _, k := range batch {
+			if b, ok := k.([]byte); ok {
+				keys = append(keys, string(b))
+			}
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			break
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *redisState) Acquire(key, token string, ttl time.Duration) (bool, error) {
+	ms := ttl.Milliseconds()
+	if ms <= 0 {
+		ms = int64(time.Hour / time.Millisecond)
+	}
+	reply, err := s.do("EVAL", redisAcquireScript, "1", key, token, strconv.FormatInt(ms, 10))
+	if err != nil {
+		return false, err
+	}
+	n, _ := reply.(int64)
+	return n == 1, nil
+}
+
+func (s *redisState) Incr(key string, ttl time.Duration) (int64, error) {
+	ms := ttl.Milliseconds()
+	if ms <= 0 {
+		ms = int64(time.Hour / time.Millisecond)
+	}
+	reply, err := s.do("EVAL", redisIncrScript, "1", key, strconv.FormatInt(ms, 10))
+	if err != nil {
+		return 0, err
+	}
+	n, _ := reply.(int64)
+	return n, nil
+}
+
+func (s *redisState) Release(key, token string) error {
+	_, err := s.do("EVAL", redisReleaseScript, "1", key, token)
+	return err
+}
@@ -0,0 +1,221 @@
+// redis_test.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// nopConn is a net.Conn that a test reads and writes through buffers.
+type nopConn struct{ net.Conn }
+
+func (nopConn) SetDeadline(time.Time) error { return nil }
+
+func TestRedisEncode(t *testing.T) {
+	var out bytes.Buffer
+	c := &redisConn{conn: nopConn{}, r: bufio.NewReader(strings.NewReader("+OK\r\n")), w: bufio.NewWriter(&out)}
+	// Values are binary-safe: CRLF and non-ASCII bytes go through as is.
+	if _, err := c.do("SET", "k", "a\r\nb\x00é", "PX", "1500"); err != nil {
+		t.Fatal(err)
+	}
+	want := "*5\r\n$3\r\nSET\r\n$1\r\nk\r\n$7\r\na\r\nb\x00é\r\n$2\r\nPX\r\n$4\r\n1500\r\n"
+	if out.String() != want {
+		t.Errorf("sent %q, want %q", out.String(), want)
+	}
+}
+
+func TestRedisDecode(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  string // as respValue formats it
+	}{
+		{"+OK\r\n", `"OK"`},
+		{":42\r\n", "42"},
+		{":-7\r\n", "-7"},
+		{"$5\r\nhe\r\nl\r\n", `"he\r\nl"`},
+		{"$0\r\n\r\n", `""`},
+		{"$-1\r\n", "<nil>"},
+		{"*-1\r\n", "<nil>"},
+		{"*0\r\n", "[]"},
+		{"*2\r\n$1\r\n7\r\n*2\r\n$3\r\nabc\r\n:1\r\n", `["7" ["abc" 1]]`},
+	}
+	for _, tt := range tests {
+		c := &redisConn{r: bufio.NewReader(strings.NewReader(tt.reply + "+next\r\n"))}
+		v, err := c.read()
+		if err != nil {
+			t.Errorf("%q: %v", tt.reply, err)
+			continue
+		}
+		if got := respValue(v); got != tt.want {
+			t.Errorf("%q read as %s, want %s", tt.reply, respValue(v), tt.want)
+		}
+		// The whole reply was consumed and nothing more.
+		if next, err := c.read(); err != nil || string(next.([]byte)) != "next" {
+			t.Errorf("%q: the following reply read as %q, %v", tt.reply, next, err)
+		}
+	}
+
+	c := &redisConn{r: bufio.NewReader(strings.NewReader("-WRONGTYPE Operation against a key\r\n"))}
+	var rerr redisError
+	if _, err := c.read(); !errors.As(err, &rerr) || string(rerr) != "WRONGTYPE Operation against a key" {
+		t.Errorf("error reply read as %v", err)
+	}
+	for _, bad := range []string{"$5\r\nabc\r\n", "$3\r\nabcd\r\n", "*2\r\n:1\r\n", "?x\r\n", "\r\n", ":x\r\n", ""} {
+		c := &redisConn{r: bufio.NewReader(strings.NewReader(bad))}
+		if v, err := c.read(); err == nil {
+			t.Errorf("%q read as %q, want an error", bad, v)
+		}
+	}
+}
+
+// respValue formats a reply with its strings quoted, so "1" and 1 differ.
+func respValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "<nil>"
+	case []byte:
+		return strconv.Quote(string(v))
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = respValue(item)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	return fmt.Sprint(v)
+}
+
+// fakeRedis serves RESP on a local port, answering each command with
+// reply(args); the function it returns lists the commands sent so far.
+func fakeRedis(t *testing.T, reply func(args []string) string) (string, func() [][]string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can't listen:", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	var got [][]string
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readRESPCommand(r)
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					got = append(got, args)
+					mu.Unlock()
+					io.WriteString(conn, reply(args))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(got)
+	}
+}
+
+// readRESPCommand parses a command the way a server does.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	if line[0] != '*' || err != nil {
+		return nil, fmt.Errorf("bad command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+		if line[0] != '$' || err != nil {
+			return nil, fmt.Errorf("bad argument %q", line)
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func TestRedisState(t *testing.T) {
+	addr, sent := fakeRedis(t, func(args []string) string {
+		switch strings.Join(args[:2], " ") {
+		case "GET missing":
+			return "$-1\r\n"
+		case "GET k":
+			return "$3\r\nv\r\n\r\n"
+		case "SCAN 0":
+			return "*2\r\n$2\r\n17\r\n*2\r\n$3\r\na*2\r\n$3\r\na*1\r\n"
+		case "SCAN 17":
+			return "*2\r\n$1\r\n0\r\n*1\r\n$3\r\na*0\r\n"
+		case "EVAL " + redisIncrScript:
+			return ":3\r\n"
+		}
+		return "+OK\r\n"
+	})
+	s, err := newRedisState("redis://app:s3cret@" + addr + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("missing"); !errors.Is(err, errStateMissing) {
+		t.Errorf("Get(missing) = %v, want errStateMissing", err)
+	}
+	if v, err := s.Get("k"); err != nil || string(v) != "v\r\n" {
+		t.Errorf("Get(k) = %q, %v", v, err)
+	}
+	if err := s.Set("k", []byte("v"), 90*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := s.Keys("a*")
+	if err != nil || strings.Join(keys, " ") != "a*0 a*1 a*2" {
+		t.Errorf("Keys = %q, %v", keys, err)
+	}
+	if n, err := s.Incr("hits", time.Minute); err != nil || n != 3 {
+		t.Errorf("Incr = %d, %v", n, err)
+	}
+
+	var log []string
+	for _, args := range sent() {
+		if args[0] == "EVAL" {
+			args = append([]string{"EVAL", "<script>"}, args[2:]...)
+		}
+		log = append(log, strings.Join(args, " "))
+	}
+	want := []string{
+		"AUTH app s3cret", "SELECT 2",
+		"GET missing", "GET k",
+		"SET k v PX 90000",
+		`SCAN 0 MATCH a\** COUNT 500`, `SCAN 17 MATCH a\** COUNT 500`,
+		"EVAL <script> 1 hits 60000",
+	}
+	if strings.Join(log, "\n") != strings.Join(want, "\n") {
+		t.Errorf("sent\n%s\nwant\n%s", strings.Join(log, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,357 @@
+// replace.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Replacing a dataset is the monthly refresh: the new file is stored as a
+// new upload under the old one's file name, so the scheduled reports,
+// dashboard widgets and alerts that follow that name use it from then on,
+// and the old upload stays as the version before it. The new file's columns
+// are matched to the old ones first, keeping their column IDs, and what
+// changed is reported along with the presets the change breaks.
+
+// replacedShown is how many earlier versions the display page links to.
+const replacedShown = 5
+
+// A ColumnChange is one difference between the old and the new columns.
+type ColumnChange struct {
+	Change string `json:"change"`        // added, removed, renamed or retyped
+	Column string `json:"column"`        // the new name; the old one for removed columns
+	Was    string `json:"was,omitempty"` // the old name, or the old type when retyped
+	Now    string `json:"now,omitempty"` // the new type when retyped
+}
+
+func (c ColumnChange) String() string {
+	switch c.Change {
+	case "added":
+		return fmt.Sprintf("%q was added", c.Column)
+	case "removed":
+		return fmt.Sprintf("%q was removed", c.Column)
+	case "renamed":
+		return fmt.Sprintf("%q was renamed to %q", c.Was, c.Column)
+	}
+	return fmt.Sprintf("%q changed from %s to %s", c.Column, c.Was, c.Now)
+}
+
+// A PresetCheck says whether a saved preset that follows the file's name
+// still finds numeric columns it needs in the new file.
+type PresetCheck struct {
+	Kind       string   `json:"kind"` // scheduled report, dashboard or alert
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Compatible bool     `json:"compatible"`
+	Problems   []string `json:"problems,omitempty"`
+}
+
+// SchemaDrift is how a replacement differs from the upload it replaces.
+type SchemaDrift struct {
+	Replaces   string         `json:"replaces"`
+	FileName   string         `json:"file_name"` // as uploaded; the dataset keeps the old name
+	RowsBefore int            `json:"rows_before"`
+	RowsAfter  int            `json:"rows_after"`
+	Changes    []ColumnChange `json:"changes"`
+	Presets    []PresetCheck  `json:"presets"`
+}
+
+// Broken counts the presets the replacement breaks.
+func (d SchemaDrift) Broken() int {
+	n := 0
+	for _, p := range d.Presets {
+		if !p.Compatible {
+			n++
+		}
+	}
+	return n
+}
+
+// columnTypes returns each column's detected type: number, date, text or
+// empty.
+func columnTypes(data Spreadsheet) []string {
+	types := make([]string, len(data.Headers))
+	for col, header := range data.Headers {
+		types[col] = typeDetection(data, col, header).Value
+	}
+	return types
+}
+
+// compareColumns matches data's columns to old's: by name, then by name
+// ignoring case and separators, and finally a column left over on both
+// sides at the same position with the same type, which is taken as renamed.
+// It returns the changes and data's column IDs, old's for matched columns.
+func compareColumns(old, data Spreadsheet) ([]ColumnChange, []string) {
+	oldTypes, newTypes := columnTypes(old), columnTypes(data)
+	match := make([]int, len(data.Headers)) // old column by new column, or -1
+	for i := range match {
+		match[i] = -1
+	}
+	used := make([]bool, len(old.Headers))
+	pass := func(same func(o, n int) bool) {
+		for n := range data.Headers {
+			if match[n] != -1 {
+				continue
+			}
+			for o := range old.Headers {
+				if !used[o] && same(o, n) {
+					match[n], used[o] = o, true
+					break
+				}
+			}
+		}
+	}
+	pass(func(o, n int) bool { return old.Headers[o] == data.Headers[n] })
+	pass(func(o, n int) bool { return columnKey(old.Headers[o]) == columnKey(data.Headers[n]) })
+	pass(func(o, n int) bool { return o == n && oldTypes[o] == newTypes[n] })
+
+	changes := []ColumnChange{}
+	ids := make([]string, len(data.Headers))
+	taken := Spreadsheet{ColumnIDs: slices.Clone(old.ColumnIDs)}
+	for n, o := range match {
+		if o != -1 {
+			ids[n] = columnID(old, o)
+		}
+		if ids[n] == "" {
+			ids[n] = nextColumnID(taken)
+			taken.ColumnIDs = append(taken.ColumnIDs, ids[n])
+		}
+		if o == -1 {
+			changes = append(changes, ColumnChange{Change: "added", Column: data.Headers[n]})
+			continue
+		}
+		if old.Headers[o] != data.Headers[n] {
+			changes = append(changes, ColumnChange{Change: "renamed", Column: data.Headers[n], Was: old.Headers[o]})
+		}
+		if was, now := oldTypes[o], newTypes[n]; was != now && was != "empty" && now != "empty" {
+			changes = append(changes, ColumnChange{Change: "retyped", Column: data.Headers[n], Was: was, Now: now})
+		}
+	}
+	for o, ok := range used {
+		if !ok {
+			changes = append(changes, ColumnChange{Change: "removed", Column: old.Headers[o]})
+		}
+	}
+	return changes, ids
+}
+
+// checkPresets checks the team's presets that follow old's file name against
+// data's columns. They find columns by exact name and calculate with them.
+func checkPresets(old, data Spreadsheet, changes []ColumnChange) []PresetCheck {
+	team, source := datasetTeam(old), old.FileName
+	renamed := make(map[string]string)
+	for _, c := range changes {
+		if c.Change == "renamed" {
+			renamed[c.Was] = c.Column
+		}
+	}
+	checks := []PresetCheck{}
+	add := func(kind, id, name string, columns []string) {
+		check := PresetCheck{Kind: kind, ID: id, Name: name}
+		for _, column := range columns {
+			col := columnIndex(data.Headers, column)
+			switch {
+			case col == -1 && renamed[column] != "":
+				check.Problems = append(check.Problems, fmt.Sprintf("%q is now called %q", column, renamed[column]))
+			case col == -1:
+				check.Problems = append(check.Problems, fmt.Sprintf("no %q column", column))
+			case !slices.Contains(data.NumericCols, col):
+				check.Problems = append(check.Problems, fmt.Sprintf("%q isn't numeric", column))
+			}
+		}
+		check.Compatible = len(check.Problems) == 0
+		checks = append(checks, check)
+	}
+	for _, rep := range schedules.List(team) {
+		if rep.Source == source {
+			add("scheduled report", rep.ID, rep.Name, rep.Columns)
+		}
+	}
+	for _, d := range dashboards.List(team) {
+		var columns []string
+		for _, w := range d.Widgets {
+			if w.Source == source && !slices.Contains(columns, w.Column) {
+				columns = append(columns, w.Column)
+			}
+		}
+		if len(columns) > 0 {
+			add("dashboard", d.ID, d.Name, columns)
+		}
+	}
+	for _, rule := range alerts.ForSource(team, source) {
+		add("alert", rule.ID, rule.Name, []string{rule.Column})
+	}
+	return checks
+}
+
+// readReplacement reads the file in a parsed multipart request as the next
+// upload of old, without storing it, and works out what it changes.
+func readReplacement(r *http.Request, old Spreadsheet) (Spreadsheet, SchemaDrift, error) {
+	if old.ParentID != "" {
+		return Spreadsheet{}, SchemaDrift{}, errors.New("Only uploads can be replaced, not datasets derived from them")
+	}
+	data, err := readUpload(r)
+	if err != nil {
+		return Spreadsheet{}, SchemaDrift{}, err
+	}
+	changes, ids := compareColumns(old, data)
+	drift := SchemaDrift{
+		Replaces:   old.ID,
+		FileName:   data.FileName,
+		RowsBefore: len(old.Rows),
+		RowsAfter:  len(data.Rows),
+		Changes:    changes,
+	}
+	data.ColumnIDs = ids
+	drift.Presets = checkPresets(old, data, changes)
+	if data.FileName != old.FileName {
+		data.Notes = append(data.Notes, fmt.Sprintf("Uploaded as %s to replace %s", data.FileName, old.FileName))
+		data.FileName = old.FileName
+	}
+	data.Drift = &drift
+	return data, drift, nil
+}
+
+// versions returns the uploads data replaced, newest first, and the one
+// that replaced it, if any, as far as they are in the request's workspace.
+func versions(r *http.Request, data Spreadsheet) (older []DatasetSummary, newer *DatasetSummary) {
+	for prev := data; prev.Drift != nil && len(older) < replacedShown; {
+		var ok bool
+		if prev, ok = teamDataset(r, prev.Drift.Replaces); !ok {
+			break
+		}
+		older = append(older, summarizeDataset(prev))
+	}
+	team := datasetTeam(data)
+	for _, d := range workspace.List() {
+		if d.Drift != nil && d.Drift.Replaces == data.ID && datasetTeam(d) == team {
+			s := summarizeDataset(d)
+			return older, &s
+		}
+	}
+	return older, nil
+}
+
+// replaceHandler replaces the dataset field's upload with the uploaded file.
+// With action=check it only reports what the replacement would change.
+func replaceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseMultipartForm(MaxFileSize); err != nil {
+		http.Error(w, "File too large", http.StatusBadRequest)
+		return
+	}
+	old, ok := teamDataset(r, r.FormValue("dataset"))
+	if !ok {
+		http.Error(w, "Unknown dataset", http.StatusNotFound)
+		return
+	}
+	data, drift, err := readReplacement(r, old)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	if r.FormValue("action") == "check" {
+		renderReport(w, driftReport(old, drift))
+		return
+	}
+	data, err = storeUpload(r, data)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	renderDisplay(w, r, data)
+}
+
+func driftReport(old Spreadsheet, drift SchemaDrift) ReportPage {
+	summary := ReportSection{
+		Title: "Summary",
+		Notes: []string{
+			fmt.Sprintf("%s uploaded %s has %d rows; %s has %d.", old.FileName, old.UploadTime.Format("2006-01-02 15:04"), drift.RowsBefore, drift.FileName, drift.RowsAfter),
+		},
+		Links: []ReportLink{{Label: "Back to " + old.FileName, URL: "/display?dataset=" + old.ID}},
+	}
+	changes := ReportSection{Title: "Column Changes", Headers: []string{"Change", "Column", "Detail"}}
+	for _, c := range drift.Changes {
+		changes.Rows = append(changes.Rows, []string{c.Change, c.Column, c.String()})
+	}
+	if len(drift.Changes) == 0 {
+		changes.Notes = []string{"The new file has the same columns, with the same types."}
+	}
+	presets := ReportSection{Title: "Saved Presets", Headers: []string{"Kind", "Name", "Status"}}
+	for _, p := range drift.Presets {
+		status := "✅ Compatible"
+		if !p.Compatible {
+			status = "⚠️ " + strings.Join(p.Problems, "; ")
+		}
+		presets.Rows = append(presets.Rows, []string{p.Kind, p.Name, status})
+	}
+	switch n := drift.Broken(); {
+	case len(drift.Presets) == 0:
+		presets.Notes = []string{"No scheduled reports, dashboards or alerts follow " + old.FileName + "."}
+	case n > 0:
+		presets.Notes = []string{strconv.Itoa(n) + " of them will not find their columns once the file is replaced."}
+	}
+	replace := ReportSection{
+		Title: "Replace",
+		Notes: []string{"Choose the file again to replace " + old.FileName + " with it."},
+		Form: &ReportForm{
+			Action:    "/replace",
+			Method:    "post",
+			Submit:    "🔁 Replace",
+			Multipart: true,
+			Fields: []FormField{
+				{Name: "dataset", Type: "hidden", Value: old.ID},
+				{Name: "action", Type: "hidden", Value: "replace"},
+				{Name: "file", Label: "File", Type: "file"},
+			},
+		},
+	}
+	return ReportPage{
+		Title:    "Replace " + old.FileName,
+		Subtitle: "What changes if " + drift.FileName + " replaces it",
+		Sections: []ReportSection{summary, changes, presets, replace},
+	}
+}
+
+// ReplacedDataset is the API's answer to a replacement: the new upload,
+// unless it was a dry run, and what changed.
+type ReplacedDataset struct {
+	File  *UploadedFile `json:"file,omitempty"`
+	Drift SchemaDrift   `json:"drift"`
+}
+
+// replaceDatasetAPIHandler replaces an upload with a multipart file. With
+// dry_run=1 it only reports the drift.
+func replaceDatasetAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(MaxFileSize); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Expected a multipart upload of at most "+formatFileSize(MaxFileSize))
+		return
+	}
+	old, ok := teamDataset(r, r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Unknown dataset")
+		return
+	}
+	data, drift, err := readReplacement(r, old)
+	if err != nil {
+		writeAPIError(w, errorStatus(err, http.StatusBadRequest), err.Error())
+		return
+	}
+	if dry, _ := strconv.ParseBool(r.FormValue("dry_run")); dry {
+		writeAPIData(w, r, ReplacedDataset{Drift: drift})
+		return
+	}
+	if data, err = storeUpload(r, data); err != nil {
+		writeAPIError(w, errorStatus(err, http.StatusBadRequest), err.Error())
+		return
+	}
+	file := uploadedFile(data)
+	writeAPIData(w, r, ReplacedDataset{File: &file, Drift: drift})
+}
@@ -0,0 +1,241 @@
+// reshape.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const maxPivotColumns = 200
+
+// reshapeDataset starts a derived dataset with new headers. Columns kept from
+// the parent hold on to their IDs; the rest get fresh ones.
+func reshapeDataset(parent Spreadsheet, headers []string, rows [][]string) Spreadsheet {
+	derived := deriveDataset(parent, rows)
+	derived.Headers = headers
+	derived.ColumnIDs = make([]string, len(headers))
+	used := Spreadsheet{ColumnIDs: append([]string(nil), parent.ColumnIDs...)}
+	for i, h := range headers {
+		if col := columnIndex(parent.Headers, h); col != -1 && col < len(parent.ColumnIDs) {
+			derived.ColumnIDs[i] = parent.ColumnIDs[col]
+			continue
+		}
+		derived.ColumnIDs[i] = nextColumnID(used)
+		used.ColumnIDs = append(used.ColumnIDs, derived.ColumnIDs[i])
+	}
+	derived.FormulaCols = nil
+	derived.NumericCols = detectNumericColumns(derived)
+	return derived
+}
+
+// meltColumns turns wide data into long: every row becomes one row per
+// column in valueCols, holding the column's name in varName and its cell in
+// valueName. The other columns are repeated on each row.
+func meltColumns(data Spreadsheet, valueCols []int, varName, valueName string, dropBlank bool) (Spreadsheet, error) {
+	varName, valueName = strings.TrimSpace(varName), strings.TrimSpace(valueName)
+	if len(valueCols) == 0 {
+		return Spreadsheet{}, fmt.Errorf("choose the columns to melt")
+	}
+	if varName == "" || valueName == "" || varName == valueName {
+		return Spreadsheet{}, fmt.Errorf("the name and value columns need two different names")
+	}
+	melted := make(map[int]bool, len(valueCols))
+	for _, c := range valueCols {
+		melted[c] = true
+	}
+	var idCols []int
+	var headers, sources []string
+	for i, h := range data.Headers {
+		if melted[i] {
+			sources = append(sources, h)
+			continue
+		}
+		if h == varName || h == valueName {
+			return Spreadsheet{}, fmt.Errorf("column %q already exists", h)
+		}
+		idCols = append(idCols, i)
+		headers = append(headers, h)
+	}
+	headers = append(headers, varName, valueName)
+
+	var rows [][]string
+	for _, row := range data.Rows {
+		for _, c := range valueCols {
+			v := cellValue(row, c)
+			if dropBlank && v == "" {
+				continue
+			}
+			out := make([]string, 0, len(headers))
+			for _, id := range idCols {
+				out = append(out, cellValue(row, id))
+			}
+			rows = append(rows, append(out, data.Headers[c], v))
+		}
+		if len(rows) > config.MaxRows {
+			return Spreadsheet{}, fmt.Errorf("melting would produce more than %d rows", config.MaxRows)
+		}
+	}
+	if len(rows) == 0 {
+		return Spreadsheet{}, fmt.Errorf("there are no values to melt")
+	}
+
+	derived := reshapeDataset(data, headers, rows)
+	derived.Derivation = fmt.Sprintf("Melted %s into %s/%s", strings.Join(sources, ", "), varName, valueName)
+	derived.Lineage = withLineage(derived.Lineage, ColumnLineage{Column: varName, Sources: sources, Operation: "melt", Detail: "column names"})
+	derived.Lineage = withLineage(derived.Lineage, ColumnLineage{Column: valueName, Sources: sources, Operation: "melt", Detail: "column values"})
+	derived.Pipeline = appendStep(data.Pipeline, "melt", map[string]string{
+		"columns": strings.Join(sources, ","),
+		"name":    varName,
+		"value":   valueName,
+	})
+	return derived, nil
+}
+
+// pivotWider is the reverse of meltColumns: each distinct value of keyCol
+// becomes a column holding valueCol, with one row per combination of the
+// remaining columns. Two rows landing in the same cell is an error rather
+// than a silent overwrite.
+func pivotWider(data Spreadsheet, keyCol, valueCol int) (Spreadsheet, error) {
+	if keyCol == valueCol {
+		return Spreadsheet{}, fmt.Errorf("the name and value columns must differ")
+	}
+	var idCols []int
+	var headers []string
+	for i, h := range data.Headers {
+		if i != keyCol && i != valueCol {
+			idCols = append(idCols, i)
+			headers = append(headers, h)
+		}
+	}
+	idWidth := len(headers)
+
+	keyIndex := make(map[string]int)
+	rowIndex := make(map[string]int)
+	var rows [][]string
+	var filled []map[int]bool
+	skipped := 0
+	for _, row := range data.Rows {
+		key := cellValue(row, keyCol)
+		if key == "" {
+			skipped++
+			continue
+		}
+		k, ok := keyIndex[key]
+		if !ok {
+			if len(keyIndex) == maxPivotColumns {
+				return Spreadsheet{}, fmt.Errorf("%s has more than %d distinct values", data.Headers[keyCol], maxPivotColumns)
+			}
+			if columnIndex(headers[:idWidth], key) != -1 {
+				return Spreadsheet{}, fmt.Errorf("value %q clashes with an existing column", key)
+			}
+			k = len(keyIndex)
+			keyIndex[key] = k
+			headers = append(headers, key)
+		}
+		id := make([]string, len(idCols))
+		for i, c := range idCols {
+			id[i] = cellValue(row, c)
+		}
+		idKey := strings.Join(id, "\x00")
+		r, ok := rowIndex[idKey]
+		if !ok {
+			r = len(rows)
+			rowIndex[idKey] = r
+			rows = append(rows, id)
+			filled = append(filled, make(map[int]bool))
+		}
+		if filled[r][k] {
+			return Spreadsheet{}, fmt.Errorf("more than one row has %s = %q for the same %s", data.Headers[keyCol], key, strings.Join(headers[:idWidth], ", "))
+		}
+		filled[r][k] = true
+		for len(rows[r]) < idWidth+k+1 {
+			rows[r] = append(rows[r], "")
+		}
+		rows[r][idWidth+k] = cellValue(row, valueCol)
+	}
+	if len(rows) == 0 {
+		return Spreadsheet{}, fmt.Errorf("%s has no values to spread into columns", data.Headers[keyCol])
+	}
+	for i := range rows {
+		for len(rows[i]) < len(headers) {
+			rows[i] = append(rows[i], "")
+		}
+	}
+
+	derived := reshapeDataset(data, headers, rows)
+	keyName, valueName := data.Headers[keyCol], data.Headers[valueCol]
+	derived.Derivation = fmt.Sprintf("%s spread across %s", valueName, keyName)
+	for _, h := range headers[idWidth:] {
+		derived.Lineage = withLineage(derived.Lineage, ColumnLineage{Column: h, Sources: []string{valueName, keyName},
+			Operation: "pivot_wider", Detail: fmt.Sprintf("%s where %s = %s", valueName, keyName, h)})
+	}
+	if skipped > 0 {
+		derived.Notes = append(derived.Notes, fmt.Sprintf("Skipped %d row(s) with a blank %s", skipped, keyName))
+	}
+	derived.Pipeline = appendStep(data.Pipeline, "pivot_wider", map[string]string{
+		"names":  keyName,
+		"values": valueName,
+	})
+	return derived, nil
+}
+
+// reshapeHandler melts or widens a dataset into a new derived dataset.
+func reshapeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	data, ok := teamDataset(r, r.FormValue("dataset"))
+	if !ok {
+		http.Error(w, "Unknown dataset", http.StatusNotFound)
+		return
+	}
+
+	var derived Spreadsheet
+	var err error
+	switch r.FormValue("mode") {
+	case "melt":
+		var cols []int
+		for _, ref := range r.Form["melt_cols"] {
+			col := columnRef(data, ref)
+			if col == -1 {
+				http.Error(w, "Unknown column", http.StatusBadRequest)
+				return
+			}
+			cols = append(cols, col)
+		}
+		derived, err = meltColumns(data, cols, r.FormValue("name"), r.FormValue("value"), r.FormValue("drop_blank") != "")
+	case "wider":
+		keyCol, valueCol := columnRef(data, r.FormValue("names_from")), columnRef(data, r.FormValue("values_from"))
+		if keyCol == -1 || valueCol == -1 {
+			http.Error(w, "Unknown column", http.StatusBadRequest)
+			return
+		}
+		derived, err = pivotWider(data, keyCol, valueCol)
+	default:
+		http.Error(w, "Invalid reshape mode", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Reshape error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	derived.Owner = ownerID(currentUser(r))
+	derived, err = workspace.Add(derived)
+	if errors.Is(err, errOverQuota) {
+		http.Error(w, "Reshape rejected: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Reshape not saved: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderDisplay(w, r, derived)
+}
@@ -0,0 +1,81 @@
+// rowwindow.go
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// displayWindow is how many rows the display page renders at once. The rest
+// are fetched from /display/rows as the table scrolls, so a large dataset
+// never arrives as one huge page.
+const (
+	displayWindow    = 200
+	maxDisplayWindow = 1000
+)
+
+// RowWindow is the run of rows starting at Anchor, the 0-based index of its
+// first row within the dataset.
+type RowWindow struct {
+	Anchor      int
+	End         int
+	Size        int
+	Total       int
+	Rows        [][]string
+	NumericCols []int
+}
+
+func rowWindow(data Spreadsheet, anchor, size int) RowWindow {
+	total := len(data.Rows)
+	if anchor > total {
+		anchor = total
+	}
+	end := anchor + size
+	if end > total {
+		end = total
+	}
+	return RowWindow{
+		Anchor:      anchor,
+		End:         end,
+		Size:        size,
+		Total:       total,
+		Rows:        data.Rows[anchor:end],
+		NumericCols: data.NumericCols,
+	}
+}
+
+// displayRowsHandler renders the table rows for one window as an HTML
+// fragment. The window's bounds are sent as headers for the page script.
+func displayRowsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	data, ok := teamDataset(r, q.Get("dataset"))
+	if !ok {
+		http.Error(w, "Unknown dataset", http.StatusNotFound)
+		return
+	}
+	if datasetTier(data) != TierInteractive {
+		http.Error(w, tierNote(data), http.StatusConflict)
+		return
+	}
+	anchor, err := strconv.Atoi(q.Get("anchor"))
+	if err != nil || anchor < 0 {
+		http.Error(w, "anchor must be a non-negative row index", http.StatusBadRequest)
+		return
+	}
+	size := displayWindow
+	if v := q.Get("size"); v != "" {
+		if size, err = strconv.Atoi(v); err != nil || size < 1 || size > maxDisplayWindow {
+			http.Error(w, "size must be between 1 and "+strconv.Itoa(maxDisplayWindow), http.StatusBadRequest)
+			return
+		}
+	}
+	win := rowWindow(data, anchor, size)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Window-Anchor", strconv.Itoa(win.Anchor))
+	w.Header().Set("X-Window-End", strconv.Itoa(win.End))
+	w.Header().Set("X-Window-Total", strconv.Itoa(win.Total))
+	if err := displayTemplate.ExecuteTemplate(w, "rows", win); err != nil {
+		log.Printf("Template error: %v", err)
+	}
+}
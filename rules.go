@@ -0,0 +1,237 @@
+// rules.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const maxRuleViolationRows = 50
+
+// ValidationRule is a row-level check written in the expression language.
+// A row violates the rule when the expression isn't true for it, which
+// includes rows where a referenced cell is blank.
+type ValidationRule struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+}
+
+// parseRuleLines reads one rule per line as "Name: expression". A line
+// without a name, or whose text before the colon is itself quoted, is
+// taken as a bare expression named after itself.
+func parseRuleLines(text string, headers []string) ([]ValidationRule, error) {
+	var rules []ValidationRule
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		rule := ValidationRule{Name: line, Expr: line}
+		if name, expr, ok := strings.Cut(line, ":"); ok && !strings.ContainsAny(name, "\"'`[") {
+			rule = ValidationRule{Name: strings.TrimSpace(name), Expr: strings.TrimSpace(expr)}
+		}
+		if headers != nil {
+			if _, err := compileExpr(rule.Expr, headers); err != nil {
+				return nil, fmt.Errorf("rule %q: %v", rule.Name, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func formatRuleLines(rules []ValidationRule) string {
+	var b strings.Builder
+	for _, r := range rules {
+		if r.Name == r.Expr {
+			fmt.Fprintln(&b, r.Expr)
+		} else {
+			fmt.Fprintf(&b, "%s: %s\n", r.Name, r.Expr)
+		}
+	}
+	return b.String()
+}
+
+type RuleResult struct {
+	Rule       ValidationRule
+	Err        error // the rule doesn't compile against this dataset
+	Columns    []string
+	Checked    int
+	Violations []int // row indexes, capped unless all rows were asked for
+	Violated   int
+}
+
+func runRule(data Spreadsheet, rule ValidationRule, all bool) RuleResult {
+	res := RuleResult{Rule: rule}
+	expr, err := compileExpr(rule.Expr, data.Headers)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	res.Columns = expr.Columns
+	res.Checked = len(data.Rows)
+	for i, row := range data.Rows {
+		if expr.Match(row) {
+			continue
+		}
+		res.Violated++
+		if all || len(res.Violations) < maxRuleViolationRows {
+			res.Violations = append(res.Violations, i)
+		}
+	}
+	return res
+}
+
+// violationRows lists each violating row with the columns the rule reads.
+func (res RuleResult) violationRows(data Spreadsheet) ([]string, [][]string) {
+	headers := append([]string{"Row"}, res.Columns...)
+	cols := make([]int, len(res.Columns))
+	for i, c := range res.Columns {
+		cols[i] = columnIndex(data.Headers, c)
+	}
+	rows := make([][]string, len(res.Violations))
+	for i, r := range res.Violations {
+		row := []string{strconv.Itoa(r + 1)}
+		for _, c := range cols {
+			row = append(row, cellValue(data.Rows[r], c))
+		}
+		rows[i] = row
+	}
+	return headers, rows
+}
+
+// rulesHandler runs a dataset's validation rules and lists violations. POST
+// replaces the rules or saves them into a mapping template, so files that
+// match the template are checked against the same contract.
+func rulesHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	data := activeDataset(r)
+	if id := r.FormValue("dataset"); id != "" {
+		var ok bool
+		if data, ok = teamDataset(r, id); !ok {
+			http.Error(w, "Unknown dataset", http.StatusNotFound)
+			return
+		}
+	}
+	if len(data.Headers) == 0 {
+		http.Error(w, "No dataset loaded", http.StatusBadRequest)
+		return
+	}
+	back := "/rules?dataset=" + url.QueryEscape(data.ID)
+
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "save":
+			if err := checkVersion(r, data); err != nil {
+				http.Error(w, err.Error(), updateErrorStatus(w, err))
+				return
+			}
+			rules, err := parseRuleLines(r.FormValue("rules"), data.Headers)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data.Rules = rules
+			if err := workspace.Update(&data); err != nil {
+				http.Error(w, err.Error(), updateErrorStatus(w, err))
+				return
+			}
+		case "template":
+			t, ok := mappings.Get(currentTeam(r).ID, r.FormValue("template"))
+			if !ok {
+				http.Error(w, "Unknown template", http.StatusNotFound)
+				return
+			}
+			t.Rules = data.Rules
+			if err := mappings.Save(t); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to save template: %v", err), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	if name := r.FormValue("violations"); name != "" {
+		for _, rule := range data.Rules {
+			if rule.Name != name {
+				continue
+			}
+			res := runRule(data, rule, true)
+			if res.Err != nil {
+				http.Error(w, res.Err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			headers, rows := res.violationRows(data)
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_violations.csv"`, exportBaseName(data.FileName)))
+			writeCSV(w, headers, rows)
+			return
+		}
+		http.Error(w, "Unknown rule", http.StatusNotFound)
+		return
+	}
+
+	summary := ReportSection{Title: "Rules", Headers: []string{"Rule", "Expression", "Rows Checked", "Violations", "Passing"}}
+	var details []ReportSection
+	for _, rule := range data.Rules {
+		res := runRule(data, rule, false)
+		if res.Err != nil {
+			summary.Rows = append(summary.Rows, []string{rule.Name, rule.Expr, "–", "–", "⚠️ " + res.Err.Error()})
+			continue
+		}
+		passing := "–"
+		if res.Checked > 0 {
+			passing = formatStat(float64(res.Checked-res.Violated)*100/float64(res.Checked)) + "%"
+		}
+		summary.Rows = append(summary.Rows, []string{rule.Name, rule.Expr, strconv.Itoa(res.Checked), strconv.Itoa(res.Violated), passing})
+		if res.Violated == 0 {
+			continue
+		}
+		section := ReportSection{Title: "Violations of " + rule.Name}
+		section.Headers, section.Rows = res.violationRows(data)
+		section.Notes = []string{fmt.Sprintf("⚠️ %d row(s) fail %s.", res.Violated, rule.Expr)}
+		if res.Violated > len(res.Violations) {
+			section.Notes = append(section.Notes, fmt.Sprintf("Showing the first %d; export the full list below.", len(res.Violations)))
+		}
+		q := url.Values{"dataset": {data.ID}, "violations": {rule.Name}}
+		section.Links = []ReportLink{{Label: "📊 Export Violations (CSV)", URL: "/rules?" + q.Encode()}}
+		details = append(details, section)
+	}
+	if len(data.Rules) == 0 {
+		summary.Notes = []string{"No rules yet. Add one per line below."}
+	}
+
+	edit := ReportSection{Title: "Edit Rules",
+		Notes: []string{"One rule per line as \"Name: expression\", e.g. Dates in order: EndDate >= StartDate. A row fails when the expression isn't true, including when a cell it reads is blank."},
+		Form: &ReportForm{Action: "/rules", Submit: "💾 Save Rules", Fields: []FormField{
+			{Name: "dataset", Type: "hidden", Value: data.ID},
+			{Name: "version", Type: "hidden", Value: strconv.Itoa(data.Version)},
+			{Name: "action", Type: "hidden", Value: "save"},
+			{Name: "rules", Label: "Rules", Type: "textarea", Value: formatRuleLines(data.Rules), Placeholder: "Positive or refund: Amount > 0 OR Status == \"Refund\""},
+		}}}
+	sections := append(append([]ReportSection{summary}, details...), edit)
+	if templates := mappings.List(currentTeam(r).ID); len(templates) > 0 && len(data.Rules) > 0 {
+		var options []FormOption
+		for _, t := range templates {
+			options = append(options, FormOption{Value: t.Name, Label: t.Name, Selected: t.Matches(data)})
+		}
+		sections = append(sections, ReportSection{Title: "Save to a Template",
+			Notes: []string{"The template's rules are replaced and copied onto every upload it applies to."},
+			Form: &ReportForm{Action: "/rules", Submit: "📐 Save to Template", Fields: []FormField{
+				{Name: "dataset", Type: "hidden", Value: data.ID},
+				{Name: "action", Type: "hidden", Value: "template"},
+				{Name: "template", Label: "Template", Type: "select", Options: options},
+			}}})
+	}
+	renderReport(w, ReportPage{Title: "Validation Rules", Subtitle: data.FileName, Sections: sections})
+}
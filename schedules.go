@@ -0,0 +1,522 @@
+// schedules.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scheduleIntervals are the cadences a report can run on.
+var scheduleIntervals = map[string]time.Duration{
+	"hourly": time.Hour,
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// reportFormats maps an export format to the content type it is sent as.
+var reportFormats = map[string]string{
+	"csv":      "text/csv; charset=utf-8",
+	"markdown": "text/markdown; charset=utf-8",
+	"html":     "text/html; charset=utf-8",
+}
+
+const maxReportRuns = 500
+
+// ScheduledReport runs a calculation against the latest upload of Source and
+// delivers the results in Format every Interval.
+type ScheduledReport struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Team      string    `json:"team"`
+	Owner     string    `json:"owner,omitempty"`
+	Source    string    `json:"source"`
+	Operation string    `json:"operation"`
+	Columns   []string  `json:"columns"`
+	Params    OpParams  `json:"params,omitempty"`
+	Format    string    `json:"format"`
+	Interval  string    `json:"interval"`
+	Delivery  Delivery  `json:"delivery"`
+	NextRun   time.Time `json:"next_run"`
+	Paused    bool      `json:"paused,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ReportRun struct {
+	Report  string    `json:"report"`
+	Name    string    `json:"name"`
+	Team    string    `json:"team"`
+	At      time.Time `json:"at"`
+	Trigger string    `json:"trigger"` // schedule, manual or automation
+	Status  string    `json:"status"`  // success or failed
+	Detail  string    `json:"detail"`
+	Bytes   int       `json:"bytes"`
+
+	// What a successful run calculated, so its results can be fetched later.
+	Dataset  string             `json:"dataset,omitempty"`
+	FileName string             `json:"file_name,omitempty"`
+	Rows     int                `json:"rows,omitempty"`
+	Values   map[string]float64 `json:"values,omitempty"` // by column
+}
+
+func (run *ReportRun) recordOutcome(out reportOutcome) {
+	run.Dataset, run.FileName, run.Rows = out.Data.ID, out.Data.FileName, len(out.Data.Rows)
+	run.Values = make(map[string]float64, len(out.Results))
+	for _, res := range out.Results {
+		if !math.IsNaN(res.Value) && !math.IsInf(res.Value, 0) {
+			run.Values[res.Col] = res.Value
+		}
+	}
+}
+
+type ReportStore struct {
+	mu      sync.RWMutex
+	path    string
+	reports map[string]ScheduledReport
+	runs    []ReportRun // oldest first, capped at maxReportRuns
+}
+
+type reportStoreFile struct {
+	Reports []ScheduledReport `json:"reports"`
+	Runs    []ReportRun       `json:"runs"`
+}
+
+var schedules = newReportStore(dataPath("schedules.json"))
+
+func newReportStore(path string) *ReportStore {
+	s := &ReportStore{path: path, reports: make(map[string]ScheduledReport)}
+	s.load()
+	watchDataFile(path, s.load)
+	return s
+}
+
+// load reads the reports file, replacing what is in memory.
+func (s *ReportStore) load() {
+	var file reportStoreFile
+	if err := readJSONFile(s.path, &file); err != nil {
+		log.Printf("Could not load scheduled reports: %v", err)
+		return
+	}
+	reports := make(map[string]ScheduledReport)
+	for _, rep := range file.Reports {
+		reports[rep.ID] = rep
+	}
+	s.mu.Lock()
+	s.reports, s.runs = reports, file.Runs
+	s.mu.Unlock()
+}
+
+func (s *ReportStore) List(team string) []ScheduledReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []ScheduledReport
+	for _, rep := range s.reports {
+		if rep.Team == team {
+			list = append(list, rep)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (s *ReportStore) Get(id string) (ScheduledReport, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rep, ok := s.reports[id]
+	return rep, ok
+}
+
+func (s *ReportStore) Save(rep ScheduledReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reports[rep.ID] = rep
+	return s.flush()
+}
+
+func (s *ReportStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.reports, id)
+	return s.flush()
+}
+
+// Claim returns the unpaused reports due at now and moves each one's NextRun
+// past now, so a slow delivery is never picked up twice. Runs missed while
+// the server was down are skipped rather than replayed.
+func (s *ReportStore) Claim(now time.Time) []ScheduledReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []ScheduledReport
+	for id, rep := range s.reports {
+		if rep.Paused || rep.NextRun.After(now) {
+			continue
+		}
+		due = append(due, rep)
+		every := scheduleIntervals[rep.Interval]
+		if every <= 0 {
+			every = 24 * time.Hour
+		}
+		for !rep.NextRun.After(now) {
+			rep.NextRun = rep.NextRun.Add(every)
+		}
+		s.reports[id] = rep
+	}
+	if len(due) > 0 {
+		if err := s.flush(); err != nil {
+			log.Printf("Could not save scheduled reports: %v", err)
+		}
+	}
+	return due
+}
+
+func (s *ReportStore) Record(run ReportRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs = append(s.runs, run)
+	if len(s.runs) > maxReportRuns {
+		s.runs = s.runs[len(s.runs)-maxReportRuns:]
+	}
+	return s.flush()
+}
+
+// Runs returns the team's run history, newest first. An empty report ID
+// returns runs of every report.
+func (s *ReportStore) Runs(team, report string) []ReportRun {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []ReportRun
+	for i := len(s.runs) - 1; i >= 0; i-- {
+		run := s.runs[i]
+		if run.Team == team && (report == "" || run.Report == report) {
+			list = append(list, run)
+		}
+	}
+	return list
+}
+
+// flush must be called with the lock held.
+func (s *ReportStore) flush() error {
+	file := reportStoreFile{Reports: make([]ScheduledReport, 0, len(s.reports)), Runs: s.runs}
+	for _, rep := range s.reports {
+		file.Reports = append(file.Reports, rep)
+	}
+	sort.Slice(file.Reports, func(i, j int) bool { return file.Reports[i].ID < file.Reports[j].ID })
+	return writeJSONFile(s.path, file)
+}
+
+// reportOutcome is a report's calculation against the latest upload of its
+// source. Columns that could not be calculated are listed in Skipped.
+type reportOutcome struct {
+	Data    Spreadsheet
+	Op      Operation
+	Results []CalculationResult
+	Skipped []string
+}
+
+func calculateReport(rep ScheduledReport) (reportOutcome, error) {
+	var out reportOutcome
+	data, ok := latestUpload(rep.Team, rep.Source)
+	if !ok {
+		return out, fmt.Errorf("no upload of %s is available", rep.Source)
+	}
+	op, ok := lookupOperation(rep.Operation)
+	if !ok {
+		return out, fmt.Errorf("unknown operation %q", rep.Operation)
+	}
+	out.Data, out.Op = data, op
+	out.Results, out.Skipped = reportResults(rep, data)
+	if len(out.Results) == 0 {
+		return out, fmt.Errorf("no valid calculations (%s)", strings.Join(out.Skipped, "; "))
+	}
+	return out, nil
+}
+
+// renderScheduledReport calculates rep and renders the results in its
+// format.
+func renderScheduledReport(rep ScheduledReport) (body []byte, subject string, out reportOutcome, err error) {
+	out, err = calculateReport(rep)
+	if err != nil {
+		return nil, "", out, err
+	}
+	data, op := out.Data, out.Op
+	page := ResultPage{
+		OpName:      op.Name,
+		Operation:   op.Label,
+		Params:      describeParams(op, rep.Params),
+		ParamValues: rep.Params,
+		FileName:    data.FileName,
+		Timestamp:   time.Now().Format("2006-01-02 15:04:05"),
+		Results:     out.Results,
+	}
+	headers, rows := resultsTable(page)
+	var buf bytes.Buffer
+	switch rep.Format {
+	case "markdown":
+		writeMarkdownTable(&buf, headers, rows)
+	case "html":
+		writeHTMLTable(&buf, headers, rows)
+	default:
+		if err := writeCSV(&buf, headers, rows); err != nil {
+			return nil, "", out, err
+		}
+	}
+	return buf.Bytes(), fmt.Sprintf("%s: %s of %s uploaded %s", rep.Name, op.Label, data.FileName, data.UploadTime.Format("2006-01-02 15:04")), out, nil
+}
+
+// reportResults runs rep's calculation on each of its columns in data. Columns
+// that are missing or can't be calculated are reported in skipped.
+func reportResults(rep ScheduledReport, data Spreadsheet) (results []CalculationResult, skipped []string) {
+	for _, name := range rep.Columns {
+		col := columnIndex(data.Headers, name)
+		if col == -1 {
+			skipped = append(skipped, fmt.Sprintf("%s: no such column", name))
+			continue
+		}
+		value, err := memoizedCalculation(data, col, rep.Operation, rep.Params)
+		if err != nil {
+			skipped = append(skipped, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		results = append(results, CalculationResult{Col: name, Value: value})
+	}
+	return results, skipped
+}
+
+// runScheduledReport renders and delivers rep, recording the outcome in the
+// run history.
+func runScheduledReport(rep ScheduledReport, trigger string) ReportRun {
+	run := ReportRun{Report: rep.ID, Name: rep.Name, Team: rep.Team, At: time.Now(), Trigger: trigger, Status: "failed"}
+	body, subject, out, err := renderScheduledReport(rep)
+	if err == nil {
+		err = deliver(rep.Delivery, subject, reportFormats[rep.Format], body)
+	}
+	if err != nil {
+		run.Detail = err.Error()
+	} else {
+		run.Status, run.Bytes = "success", len(body)
+		run.Detail = "Delivered to " + rep.Delivery.String()
+		if len(out.Skipped) > 0 {
+			run.Detail += "; skipped " + strings.Join(out.Skipped, "; ")
+		}
+		run.recordOutcome(out)
+	}
+	if err := schedules.Record(run); err != nil {
+		log.Printf("Could not record report run: %v", err)
+	}
+	return run
+}
+
+// runSchedules checks for due reports and alert rules once a minute for as
+// long as the server runs. With several replicas only the one holding the
+// lease does, so nothing is delivered twice.
+func runSchedules() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if !isLeader("schedules", 3*time.Minute) {
+			continue
+		}
+		for _, rep := range schedules.Claim(now) {
+			if run := runScheduledReport(rep, "schedule"); run.Status != "success" {
+				log.Printf("Scheduled report %q failed: %s", rep.Name, run.Detail)
+			}
+		}
+		checkScheduledAlerts(now)
+	}
+}
+
+// scheduledReportFromForm validates the new-report form.
+func scheduledReportFromForm(r *http.Request) (ScheduledReport, error) {
+	rep := ScheduledReport{
+		Name:      strings.TrimSpace(r.FormValue("name")),
+		Source:    strings.TrimSpace(r.FormValue("source")),
+		Operation: r.FormValue("operation"),
+		Columns:   splitList(r.FormValue("columns")),
+		Format:    r.FormValue("format"),
+		Interval:  r.FormValue("interval"),
+		Delivery:  Delivery{Kind: r.FormValue("delivery"), Target: strings.TrimSpace(r.FormValue("target"))},
+	}
+	if rep.Name == "" || rep.Source == "" || len(rep.Columns) == 0 {
+		return rep, fmt.Errorf("name, source file and at least one column are required")
+	}
+	op, ok := lookupOperation(rep.Operation)
+	if !ok {
+		return rep, fmt.Errorf("unsupported operation")
+	}
+	params, err := op.ResolveParams(parseKeyValueLines(r.FormValue("params")))
+	if err != nil {
+		return rep, fmt.Errorf("invalid parameters: %v", err)
+	}
+	rep.Params = params
+	if _, ok := reportFormats[rep.Format]; !ok {
+		return rep, fmt.Errorf("unsupported format %q", rep.Format)
+	}
+	every, ok := scheduleIntervals[rep.Interval]
+	if !ok {
+		return rep, fmt.Errorf("unsupported interval %q", rep.Interval)
+	}
+	if err := rep.Delivery.validate(); err != nil {
+		return rep, err
+	}
+	rep.CreatedAt = time.Now()
+	rep.NextRun = rep.CreatedAt.Add(every)
+	return rep, nil
+}
+
+// reportsHandler lists the team's scheduled reports and creates, runs,
+// pauses and deletes them.
+func reportsHandler(w http.ResponseWriter, r *http.Request) {
+	team := currentTeam(r).ID
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		switch r.FormValue("action") {
+		case "create":
+			rep, err := scheduledReportFromForm(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rep.ID, rep.Team, rep.Owner = newID(), team, ownerID(currentUser(r))
+			if err := schedules.Save(rep); err != nil {
+				http.Error(w, fmt.Sprintf("Could not save report: %v", err), http.StatusInternalServerError)
+				return
+			}
+		case "run", "pause", "resume", "delete":
+			rep, ok := schedules.Get(r.FormValue("report"))
+			if !ok || rep.Team != team {
+				http.Error(w, "Unknown report", http.StatusNotFound)
+				return
+			}
+			var err error
+			switch r.FormValue("action") {
+			case "run":
+				runScheduledReport(rep, "manual")
+				http.Redirect(w, r, "/reports/history?report="+rep.ID, http.StatusSeeOther)
+				return
+			case "pause":
+				rep.Paused = true
+				err = schedules.Save(rep)
+			case "resume":
+				rep.Paused = false
+				if now := time.Now(); rep.NextRun.Before(now) {
+					rep.NextRun = now.Add(scheduleIntervals[rep.Interval])
+				}
+				err = schedules.Save(rep)
+			default:
+				err = schedules.Delete(rep.ID)
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Could not save report: %v", err), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "Invalid action", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/reports", http.StatusSeeOther)
+		return
+	}
+
+	section := ReportSection{Title: "Scheduled Reports", Headers: []string{"Name", "Source", "Calculation", "Format", "Every", "Delivery", "Next Run"}}
+	var options []FormOption
+	for _, rep := range schedules.List(team) {
+		calc := rep.Operation + " of " + strings.Join(rep.Columns, ", ")
+		if op, ok := lookupOperation(rep.Operation); ok {
+			calc = op.Label + " of " + strings.Join(rep.Columns, ", ")
+			if p := describeParams(op, rep.Params); p != "" {
+				calc += " (" + p + ")"
+			}
+		}
+		next := rep.NextRun.Format("2006-01-02 15:04")
+		if rep.Paused {
+			next = "paused"
+		}
+		section.Rows = append(section.Rows, []string{rep.Name, rep.Source, calc, rep.Format, rep.Interval, rep.Delivery.String(), next})
+		section.Links = append(section.Links, ReportLink{Label: "🕘 " + rep.Name + " history", URL: "/reports/history?report=" + rep.ID})
+		section.Links = append(section.Links, ReportLink{Label: "⚖️ Compare " + rep.Name + " runs", URL: "/reports/compare?report=" + rep.ID})
+		options = append(options, FormOption{Value: rep.ID, Label: rep.Name})
+	}
+	if len(section.Rows) == 0 {
+		section.Notes = []string{"No reports are scheduled yet."}
+	}
+	section.Links = append(section.Links, ReportLink{Label: "📜 All runs", URL: "/reports/history"})
+	sections := []ReportSection{section}
+	if currentUser(r).HasRole(RoleEditor) {
+		var opOptions []FormOption
+		for _, op := range operations {
+			opOptions = append(opOptions, FormOption{Value: op.Name, Label: op.Icon + " " + op.Label})
+		}
+		notes := []string{"Each run uses the latest upload of the source file in this workspace. S3 delivery takes a presigned PUT URL."}
+		if config.SMTP.Addr == "" {
+			notes = append(notes, "Email delivery is unavailable until the server sets SMTP_ADDR and SMTP_FROM.")
+		}
+		sections = append(sections, ReportSection{Title: "New Scheduled Report", Notes: notes, Form: &ReportForm{Action: "/reports", Submit: "➕ Schedule", Fields: []FormField{
+			{Name: "action", Type: "hidden", Value: "create"},
+			{Name: "name", Label: "Name", Placeholder: "e.g. Weekly revenue"},
+			{Name: "source", Label: "Source file", Placeholder: "e.g. sales.csv"},
+			{Name: "operation", Label: "Operation", Type: "select", Options: opOptions},
+			{Name: "columns", Label: "Columns", Placeholder: "comma separated, e.g. Revenue, Units"},
+			{Name: "params", Label: "Parameters", Type: "textarea", Placeholder: "one per line, e.g. p=95"},
+			{Name: "format", Label: "Format", Type: "select", Options: []FormOption{
+				{Value: "csv", Label: "CSV"}, {Value: "markdown", Label: "Markdown"}, {Value: "html", Label: "HTML table"},
+			}},
+			{Name: "interval", Label: "Every", Type: "select", Options: []FormOption{
+				{Value: "hourly", Label: "Hour"}, {Value: "daily", Label: "Day", Selected: true}, {Value: "weekly", Label: "Week"},
+			}},
+			{Name: "delivery", Label: "Deliver by", Type: "select", Options: []FormOption{
+				{Value: "email", Label: "📧 Email"}, {Value: "webhook", Label: "🪝 Webhook"}, {Value: "s3", Label: "🪣 S3"},
+			}},
+			{Name: "target", Label: "Deliver to", Placeholder: "email address or URL"},
+		}}})
+		if len(options) > 0 {
+			sections = append(sections, ReportSection{Title: "Manage", Form: &ReportForm{Action: "/reports", Submit: "Apply", Fields: []FormField{
+				{Name: "report", Label: "Report", Type: "select", Options: options},
+				{Name: "action", Label: "Action", Type: "select", Options: []FormOption{
+					{Value: "run", Label: "▶️ Run now"},
+					{Value: "pause", Label: "⏸️ Pause"},
+					{Value: "resume", Label: "⏯️ Resume"},
+					{Value: "delete", Label: "🗑️ Delete"},
+				}},
+			}}})
+		}
+	}
+	renderReport(w, ReportPage{Title: "Scheduled Reports", Subtitle: currentTeam(r).Name, Sections: sections})
+}
+
+// reportHistoryHandler shows the team's report runs, optionally for one
+// report.
+func reportHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	team := currentTeam(r).ID
+	id := r.URL.Query().Get("report")
+	title := "All Reports"
+	if id != "" {
+		rep, ok := schedules.Get(id)
+		if !ok || rep.Team != team {
+			http.Error(w, "Unknown report", http.StatusNotFound)
+			return
+		}
+		title = rep.Name
+	}
+	section := ReportSection{Title: "Runs", Headers: []string{"When", "Report", "Trigger", "Status", "Size", "Detail"}}
+	for _, run := range schedules.Runs(team, id) {
+		status := "✅ success"
+		if run.Status != "success" {
+			status = "❌ failed"
+		}
+		section.Rows = append(section.Rows, []string{run.At.Format("2006-01-02 15:04:05"), run.Name, run.Trigger, status, fmt.Sprintf("%d bytes", run.Bytes), run.Detail})
+	}
+	if len(section.Rows) == 0 {
+		section.Notes = []string{"No runs yet."}
+	}
+	section.Links = []ReportLink{{Label: "⬅️ Scheduled reports", URL: "/reports"}}
+	renderReport(w, ReportPage{Title: "Run History", Subtitle: title, Sections: []ReportSection{section}})
+}
@@ -0,0 +1,179 @@
+// segments.go
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type SegmentStats struct {
+	Filter string
+	N      int
+	Mean   float64
+	Median float64
+	Std    float64
+}
+
+// SegmentComparison compares one column between the rows matching two
+// filters with Welch's t-test, which doesn't assume equal variances.
+type SegmentComparison struct {
+	Column string
+	A, B   SegmentStats
+	Diff   float64 // B mean − A mean
+	Lift   float64 // Diff as a percentage of A's mean; NaN when A's mean is 0
+	T      float64
+	DF     float64
+	P      float64 // two-sided; NaN when the test can't be run
+}
+
+func (c SegmentComparison) Significant() bool { return c.P < 0.05 }
+
+// Summary is the one-line verdict shown under the comparison table.
+func (c SegmentComparison) Summary() string {
+	parts := []string{"Difference (B − A) " + formatStat(c.Diff)}
+	if !math.IsNaN(c.Lift) {
+		parts = append(parts, fmt.Sprintf("lift %+.2f%%", c.Lift))
+	}
+	switch {
+	case math.IsNaN(c.P):
+		parts = append(parts, "not enough values for a significance test (each segment needs 2 with some spread)")
+	case c.Significant():
+		parts = append(parts, fmt.Sprintf("Welch t = %.3f, df = %.1f, p = %.4f: significant at 5%%", c.T, c.DF, c.P))
+	default:
+		parts = append(parts, fmt.Sprintf("Welch t = %.3f, df = %.1f, p = %.4f: not significant at 5%%", c.T, c.DF, c.P))
+	}
+	return strings.Join(parts, " · ")
+}
+
+var simpleSegmentPattern = regexp.MustCompile(`^\s*([^=!<>]+?)\s*(!=|==|=)\s*(.+?)\s*$`)
+
+// compileSegment compiles a segment filter. Besides full filter expressions
+// it accepts the shorthand Region=West, quoting the value when it isn't
+// already an expression.
+func compileSegment(filter string, headers []string) (*Expr, error) {
+	expr, err := compileExpr(filter, headers)
+	if err == nil {
+		return expr, nil
+	}
+	m := simpleSegmentPattern.FindStringSubmatch(filter)
+	if m == nil || columnIndex(headers, m[1]) == -1 {
+		return nil, err
+	}
+	op := m[2]
+	if op == "=" {
+		op = "=="
+	}
+	value := strings.Trim(m[3], `"'`)
+	if _, perr := strconv.ParseFloat(value, 64); perr != nil {
+		value = strconv.Quote(value)
+	}
+	return compileExpr(exprColumn(m[1])+" "+op+" "+value, headers)
+}
+
+func segmentStats(data Spreadsheet, col int, filter string) (SegmentStats, []float64, error) {
+	s := SegmentStats{Filter: filter}
+	expr, err := compileSegment(filter, data.Headers)
+	if err != nil {
+		return s, nil, fmt.Errorf("segment %q: %v", filter, err)
+	}
+	var values []float64
+	for _, row := range data.Rows {
+		if !expr.Match(row) {
+			continue
+		}
+		if v, ok := parseFinite(cellValue(row, col)); ok {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return s, nil, fmt.Errorf("segment %q has no numbers in %s", filter, data.Headers[col])
+	}
+	s.N, s.Mean, s.Median, s.Std = len(values), avg(values), median(values), std(values)
+	return s, values, nil
+}
+
+func compareSegments(data Spreadsheet, col int, filterA, filterB string) (SegmentComparison, error) {
+	c := SegmentComparison{Column: data.Headers[col], Lift: math.NaN(), T: math.NaN(), DF: math.NaN(), P: math.NaN()}
+	var err error
+	if c.A, _, err = segmentStats(data, col, filterA); err != nil {
+		return c, err
+	}
+	if c.B, _, err = segmentStats(data, col, filterB); err != nil {
+		return c, err
+	}
+	c.Diff = c.B.Mean - c.A.Mean
+	if c.A.Mean != 0 {
+		c.Lift = c.Diff / math.Abs(c.A.Mean) * 100
+	}
+	if c.A.N < 2 || c.B.N < 2 {
+		return c, nil
+	}
+	va, vb := c.A.Std*c.A.Std/float64(c.A.N), c.B.Std*c.B.Std/float64(c.B.N)
+	if va+vb == 0 {
+		return c, nil
+	}
+	c.T = c.Diff / math.Sqrt(va+vb)
+	c.DF = (va + vb) * (va + vb) / (va*va/float64(c.A.N-1) + vb*vb/float64(c.B.N-1))
+	c.P = studentTwoSided(c.T, c.DF)
+	return c, nil
+}
+
+// studentTwoSided is P(|T| > |t|) for Student's t with df degrees of
+// freedom, via the regularized incomplete beta function.
+func studentTwoSided(t, df float64) float64 {
+	return incompleteBeta(df/2, 0.5, df/(df+t*t))
+}
+
+// incompleteBeta is the regularized incomplete beta function I_x(a, b),
+// evaluated with the continued fraction from Numerical Recipes.
+func incompleteBeta(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	la, _ := math.Lgamma(a + b)
+	lb, _ := math.Lgamma(a)
+	lc, _ := math.Lgamma(b)
+	front := math.Exp(la - lb - lc + a*math.Log(x) + b*math.Log(1-x))
+	if x < (a+1)/(a+b+2) {
+		return front * betaFraction(a, b, x) / a
+	}
+	return 1 - front*betaFraction(b, a, 1-x)/b
+}
+
+func betaFraction(a, b, x float64) float64 {
+	const tiny = 1e-300
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= 300; m++ {
+		fm := float64(m)
+		for _, num := range []float64{
+			fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm)),
+			-(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1)),
+		} {
+			d = 1 + num*d
+			if math.Abs(d) < tiny {
+				d = tiny
+			}
+			c = 1 + num/c
+			if math.Abs(c) < tiny {
+				c = tiny
+			}
+			d = 1 / d
+			h *= d * c
+		}
+		if math.Abs(d*c-1) < 1e-12 {
+			break
+		}
+	}
+	return h
+}
@@ -0,0 +1,56 @@
+// segments_test.go
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// segmentData has a Group column naming the segment and a Value column.
+func segmentData(a, b []float64) Spreadsheet {
+	data := Spreadsheet{Headers: []string{"Group", "Value"}}
+	for _, v := range a {
+		data.Rows = append(data.Rows, []string{"a", strconv.FormatFloat(v, 'g', -1, 64)})
+	}
+	for _, v := range b {
+		data.Rows = append(data.Rows, []string{"b", strconv.FormatFloat(v, 'g', -1, 64)})
+	}
+	return data
+}
+
+func TestCompareSegmentsWelch(t *testing.T) {
+	tests := []struct {
+		name      string
+		a, b      []float64
+		t, df, p  float64
+		tolerance float64 // for p, and ten times it for t and df
+	}{
+		// R's t.test(extra ~ group, data = sleep), with the groups swapped:
+		// t = -1.8608, df = 17.776, p-value = 0.07939.
+		{"sleep", []float64{0.7, -1.6, -0.2, -1.2, -0.1, 3.4, 3.7, 0.8, 0.0, 2.0},
+			[]float64{1.9, 0.8, 1.1, 0.1, -0.1, 4.4, 5.5, 1.6, 4.6, 3.4},
+			1.8608, 17.776, 0.07939, 1e-4},
+		// The first example in the Wikipedia article on Welch's t-test.
+		{"wikipedia", []float64{27.5, 21.0, 19.0, 23.6, 17.0, 17.9, 16.9, 20.1, 21.9, 22.6, 23.1, 19.6, 19.0, 21.7, 21.4},
+			[]float64{27.1, 22.0, 20.8, 23.4, 23.4, 23.5, 25.8, 22.0, 24.8, 20.2, 21.9, 22.1, 22.9, 20.5, 24.4},
+			2.46, 24.99, 0.021, 5e-3},
+	}
+	for _, tt := range tests {
+		c, err := compareSegments(segmentData(tt.a, tt.b), 1, "Group=a", "Group=b")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if math.Abs(c.T-tt.t) > tt.tolerance*10 || math.Abs(c.DF-tt.df) > tt.tolerance*10 || math.Abs(c.P-tt.p) > tt.tolerance {
+			t.Errorf("%s: t = %.4f, df = %.3f, p = %.5f; want %v, %v, %v", tt.name, c.T, c.DF, c.P, tt.t, tt.df, tt.p)
+		}
+	}
+
+	// Without two values with some spread in each segment there's no test.
+	for name, b := range map[string][]float64{"one value": {5}, "no spread": {5, 5, 5}} {
+		c, err := compareSegments(segmentData([]float64{5, 5}, b), 1, "Group=a", "Group=b")
+		if err != nil || !math.IsNaN(c.P) || c.Significant() {
+			t.Errorf("%s: p = %v, %v", name, c.P, err)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+// sharedworkspace.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// With a shared state backend the workspace keeps datasets in a
+// DatasetStore, so a dataset uploaded through one replica can be read,
+// changed or deleted through another. The local maps become a cache, checked
+// against the stored version before use. Changes to the order take the
+// "datasets" lock and updates take "dataset/<id>", so two replicas never
+// interleave. The "usage" key holds each owner's quota usage; it's only
+// changed under the "datasets" lock, so an upload is checked against the
+// quota and counted in one step.
+
+const (
+	sharedLockTTL  = 30 * time.Second
+	sharedLockWait = 10 * time.Second
+)
+
+// DatasetStore is where a shared workspace keeps datasets and its trash.
+// Missing datasets are reported as errStateMissing.
+type DatasetStore interface {
+	IDs() ([]string, error) // in registration order
+	Version(id string) (int, error)
+	Load(id string) (Spreadsheet, error)
+	Add(data Spreadsheet) error
+	Save(data Spreadsheet) error // replaces a stored dataset
+	Trash(t TrashedDataset) error
+	Trashed(id string) (TrashedDataset, error)
+	TrashList() ([]TrashedDataset, error)
+	Restore(t TrashedDataset) error // puts t.Data back at t.Position
+	Purge(id string) error
+}
+
+// datasetStoreProvider is implemented by backends with their own way of
+// storing datasets; the others get kvDatasets.
+type datasetStoreProvider interface {
+	Datasets() DatasetStore
+}
+
+var sharedDatasets = func() DatasetStore {
+	if p, ok := state.(datasetStoreProvider); ok {
+		return p.Datasets()
+	}
+	return kvDatasets{}
+}()
+
+func (ws *Workspace) cache(data Spreadsheet) {
+	ws.mu.Lock()
+	ws.datasets[data.ID] = data
+	ws.mu.Unlock()
+}
+
+func (ws *Workspace) uncache(id string) {
+	ws.mu.Lock()
+	delete(ws.datasets, id)
+	ws.mu.Unlock()
+}
+
+func (ws *Workspace) sharedAdd(data Spreadsheet) (Spreadsheet, error) {
+	unlock, err := lockShared("datasets", sharedLockTTL, sharedLockWait)
+	if err != nil {
+		return Spreadsheet{}, fmt.Errorf("could not lock the dataset list: %w", err)
+	}
+	defer unlock()
+	usage, err := ws.sharedUsageAll()
+	if err != nil {
+		return Spreadsheet{}, fmt.Errorf("could not read the quota usage: %w", err)
+	}
+	if err := checkQuota(usage[data.Owner], data); err != nil {
+		columnSummaries.Forget(data.ID)
+		return Spreadsheet{}, err
+	}
+	if err := sharedDatasets.Add(data); err != nil {
+		return Spreadsheet{}, fmt.Errorf("could not save dataset %s: %w", data.ID, err)
+	}
+	usage[data.Owner] = usage[data.Owner].plus(1, data)
+	saveSharedUsage(usage)
+	ws.cache(data)
+	return data, nil
+}
+
+// sharedUsage is Usage with a shared backend.
+func (ws *Workspace) sharedUsage(owner string) DatasetUsage {
+	usage, err := ws.sharedUsageAll()
+	if err != nil {
+		log.Printf("Could not read the quota usage: %v", err)
+	}
+	return usage[owner]
+}
+
+// sharedUsageAll reads every owner's usage. Until the totals are first
+// stored, or after saveSharedUsage gave up on them, they're counted from
+// the datasets.
+func (ws *Workspace) sharedUsageAll() (map[string]DatasetUsage, error) {
+	usage := make(map[string]DatasetUsage)
+	err := getStateJSON("usage", &usage)
+	if !errors.Is(err, errStateMissing) {
+		return usage, err
+	}
+	for _, data := range ws.sharedList() {
+		usage[data.Owner] = usage[data.Owner].plus(1, data)
+	}
+	return usage, nil
+}
+
+// saveSharedUsage stores the totals after a change to the datasets, with the
+// "datasets" lock held. The change has already been made, so if the totals
+// can't be saved they're removed, to be counted again when next read.
+func saveSharedUsage(usage map[string]DatasetUsage) {
+	for owner, used := range usage {
+		if used.Datasets == 0 {
+			delete(usage, owner)
+		}
+	}
+	err := setStateJSON("usage", usage, 0)
+	if err == nil {
+		return
+	}
+	log.Printf("Could not save the quota usage: %v", err)
+	if err := state.Delete("usage"); err != nil {
+		log.Printf("Could not reset the quota usage: %v", err)
+	}
+}
+
+// sharedGet returns the cached copy while its version is current, fetching
+// the dataset again once another replica has changed it.
+func (ws *Workspace) sharedGet(id string) (Spreadsheet, bool) {
+	version, err := sharedDatasets.Version(id)
+	if err != nil {
+		if !errors.Is(err, errStateMissing) {
+			log.Printf("Could not read dataset %s: %v", id, err)
+		}
+		ws.uncache(id)
+		return Spreadsheet{}, false
+	}
+	ws.mu.RLock()
+	cached, ok := ws.datasets[id]
+	ws.mu.RUnlock()
+	if ok && cached.Version == version {
+		return cached, true
+	}
+	data, err := sharedDatasets.Load(id)
+	if err != nil {
+		if !errors.Is(err, errStateMissing) {
+			log.Printf("Could not read dataset %s: %v", id, err)
+		}
+		return Spreadsheet{}, false
+	}
+	ws.cache(data)
+	return data, true
+}
+
+func (ws *Workspace) sharedList() []Spreadsheet {
+	ids, err := sharedDatasets.IDs()
+	if err != nil {
+		log.Printf("Could not read the dataset list: %v", err)
+	}
+	list := make([]Spreadsheet, 0, len(ids))
+	for _, id := range ids {
+		if data, ok := ws.sharedGet(id); ok {
+			list = append(list, data)
+		}
+	}
+	return list
+}
+
+func (ws *Workspace) sharedUpdate(data *Spreadsheet) error {
+	unlock, err := lockShared("dataset/"+data.ID, sharedLockTTL, sharedLockWait)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	stored, ok := ws.sharedGet(data.ID)
+	if !ok {
+		return errUnknownDataset
+	}
+	if stored.Version != data.Version {
+		return &VersionConflict{Current: stored.Version}
+	}
+	// A change in size changes the usage, which needs the "datasets" lock too.
+	var usage map[string]DatasetUsage
+	if datasetBytes(stored) != datasetBytes(*data) || stored.Owner != data.Owner {
+		unlock, err := lockShared("datasets", sharedLockTTL, sharedLockWait)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		if usage, err = ws.sharedUsageAll(); err != nil {
+			return err
+		}
+	}
+	data.Version++
+	if err := sharedDatasets.Save(*data); err != nil {
+		data.Version--
+		return err
+	}
+	if usage != nil {
+		usage[stored.Owner] = usage[stored.Owner].plus(-1, stored)
+		usage[data.Owner] = usage[data.Owner].plus(1, *data)
+		saveSharedUsage(usage)
+	}
+	ws.cache(*data)
+	columnSummaries.Carry(stored, *data)
+	profiles.Refresh(*data)
+	return nil
+}
+
+func (ws *Workspace) sharedDelete(id, by string) bool {
+	unlock, err := lockShared("datasets", sharedLockTTL, sharedLockWait)
+	if err != nil {
+		log.Printf("Could not lock the dataset list: %v", err)
+		return false
+	}
+	defer unlock()
+	data, ok := ws.sharedGet(id)
+	if !ok {
+		return false
+	}
+	usage, err := ws.sharedUsageAll()
+	if err != nil {
+		log.Printf("Could not read the quota usage: %v", err)
+		return false
+	}
+	t := TrashedDataset{Data: data, DeletedAt: time.Now(), DeletedBy: by}
+	if err := sharedDatasets.Trash(t); err != nil {
+		log.Printf("Could not move dataset %s to the trash: %v", id, err)
+		return false
+	}
+	usage[data.Owner] = usage[data.Owner].plus(-1, data)
+	saveSharedUsage(usage)
+	ws.uncache(id)
+	profiles.Forget(id)
+	parsedColumns.Forget(id)
+	columnSummaries.Forget(id)
+	return true
+}
+
+func (ws *Workspace) sharedGetTrashed(id string) (TrashedDataset, bool) {
+	t, err := sharedDatasets.Trashed(id)
+	if err != nil {
+		if !errors.Is(err, errStateMissing) {
+			log.Printf("Could not read trashed dataset %s: %v", id, err)
+		}
+		return t, false
+	}
+	return t, true
+}
+
+func (ws *Workspace) sharedRestore(id string) (Spreadsheet, bool) {
+	unlock, err := lockShared("datasets", sharedLockTTL, sharedLockWait)
+	if err != nil {
+		log.Printf("Could not lock the dataset list: %v", err)
+		return Spreadsheet{}, false
+	}
+	defer unlock()
+	t, ok := ws.sharedGetTrashed(id)
+	if !ok {
+		return Spreadsheet{}, false
+	}
+	usage, err := ws.sharedUsageAll()
+	if err != nil {
+		log.Printf("Could not read the quota usage: %v", err)
+		return Spreadsheet{}, false
+	}
+	if err := sharedDatasets.Restore(t); err != nil {
+		log.Printf("Could not restore dataset %s: %v", id, err)
+		return Spreadsheet{}, false
+	}
+	usage[t.Data.Owner] = usage[t.Data.Owner].plus(1, t.Data)
+	saveSharedUsage(usage)
+	ws.cache(t.Data)
+	return t.Data, true
+}
+
+func (ws *Workspace) sharedPurge(id string) bool {
+	if _, ok := ws.sharedGetTrashed(id); !ok {
+		return false
+	}
+	if err := sharedDatasets.Purge(id); err != nil {
+		log.Printf("Could not purge dataset %s: %v", id, err)
+		return false
+	}
+	accessLog.Forget(id)
+	return true
+}
+
+func (ws *Workspace) sharedTrash() []TrashedDataset {
+	list, err := sharedDatasets.TrashList()
+	if err != nil {
+		log.Printf("Could not list the trash: %v", err)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeletedAt.After(list[j].DeletedAt) })
+	return list
+}
+
+// kvDatasets keeps datasets as plain keys in the state backend:
+//
+//	datasets          registration order, as a JSON list of IDs
+//	dataset/<id>      the dataset as JSON, sealed when encryption is on
+//	dsversion/<id>    its version, cheap to check before trusting a cache
+//	trash/<id>        a TrashedDataset, expiring when its restore window ends
+//
+// Callers hold the "datasets" lock around changes to the order.
+type kvDatasets struct{}
+
+func (kvDatasets) IDs() ([]string, error) {
+	var order []string
+	if err := getStateJSON("datasets", &order); err != nil && !errors.Is(err, errStateMissing) {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (kvDatasets) Version(id string) (int, error) {
+	b, err := state.Get("dsversion/" + id)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(b))
+}
+
+func (kvDatasets) Load(id string) (Spreadsheet, error) {
+	var data Spreadsheet
+	err := getSealedJSON("dataset/"+id, &data)
+	return data, err
+}
+
+func (kvDatasets) Save(data Spreadsheet) error {
+	if err := setSealedJSON("dataset/"+data.ID, data, 0); err != nil {
+		return err
+	}
+	return state.Set("dsversion/"+data.ID, []byte(strconv.Itoa(data.Version)), 0)
+}
+
+func (s kvDatasets) Add(data Spreadsheet) error {
+	if err := s.Save(data); err != nil {
+		return err
+	}
+	order, err := s.IDs()
+	if err != nil {
+		return err
+	}
+	return setStateJSON("datasets", append(order, data.ID), 0)
+}
+
+func (s kvDatasets) Trash(t TrashedDataset) error {
+	order, err := s.IDs()
+	if err != nil {
+		return err
+	}
+	t.Position = len(order)
+	for i, existing := range order {
+		if existing == t.Data.ID {
+			t.Position = i
+			order = append(order[:i], order[i+1:]...)
+			break
+		}
+	}
+	if err := setSealedJSON("trash/"+t.Data.ID, t, time.Until(t.PurgeAt())); err != nil {
+		return err
+	}
+	if err := setStateJSON("datasets", order, 0); err != nil {
+		return err
+	}
+	if err := state.Delete("dataset/" + t.Data.ID); err != nil {
+		return err
+	}
+	return state.Delete("dsversion/" + t.Data.ID)
+}
+
+func (kvDatasets) Trashed(id string) (TrashedDataset, error) {
+	var t TrashedDataset
+	err := getSealedJSON("trash/"+id, &t)
+	return t, err
+}
+
+func (s kvDatasets) TrashList() ([]TrashedDataset, error) {
+	keys, err := state.Keys("trash/")
+	if err != nil {
+		return nil, err
+	}
+	list := make([]TrashedDataset, 0, len(keys))
+	for _, key := range keys {
+		if t, err := s.Trashed(key[len("trash/"):]); err == nil {
+			list = append(list, t)
+		}
+	}
+	return list, nil
+}
+
+func (s kvDatasets) Restore(t TrashedDataset) error {
+	if err := s.Save(t.Data); err != nil {
+		return err
+	}
+	order, err := s.IDs()
+	if err != nil {
+		return err
+	}
+	pos := t.Position
+	if pos > len(order) {
+		pos = len(order)
+	}
+	order = append(order[:pos], append([]string{t.Data.ID}, order[pos:]...)...)
+	if err := setStateJSON("datasets", order, 0); err != nil {
+		return err
+	}
+	return state.Delete("trash/" + t.Data.ID)
+}
+
+func (kvDatasets) Purge(id string) error {
+	return state.Delete("trash/" + id)
+}
@@ -0,0 +1,518 @@
+// sharelinks.go
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShareLink lets anyone holding its token see one dataset without signing
+// in, minus the columns its policy redacts. Columns are kept by ID, so a
+// rename doesn't reveal a hidden column. With Mode "show" only the listed
+// columns are visible, which also keeps columns added later out of sight;
+// with "hide" everything but the listed columns is.
+type ShareLink struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"token"`
+	Dataset   string    `json:"dataset"`
+	Team      string    `json:"team"`
+	Owner     string    `json:"owner,omitempty"`
+	Mode      string    `json:"mode"` // hide or show
+	Columns   []string  `json:"columns"`
+	Names     []string  `json:"names"` // the columns as named when the link was made
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (l ShareLink) URL() string {
+	return "/shared/datasets/" + l.Token
+}
+
+func (l ShareLink) Policy() string {
+	if l.Mode == "show" {
+		return "only " + strings.Join(l.Names, ", ")
+	}
+	if len(l.Names) == 0 {
+		return "every column"
+	}
+	return "all but " + strings.Join(l.Names, ", ")
+}
+
+// visible reports which of data's columns the link lets through.
+func (l ShareLink) visible(data Spreadsheet) []int {
+	listed := make(map[string]bool, len(l.Columns))
+	for _, c := range l.Columns {
+		listed[c] = true
+	}
+	var keep []int
+	for i, h := range data.Headers {
+		id := h
+		if i < len(data.ColumnIDs) && data.ColumnIDs[i] != "" {
+			id = data.ColumnIDs[i]
+		}
+		if listed[id] == (l.Mode == "show") {
+			keep = append(keep, i)
+		}
+	}
+	return keep
+}
+
+type ShareLinkStore struct {
+	mu    sync.RWMutex
+	path  string
+	links map[string]ShareLink
+}
+
+var shareLinks = newShareLinkStore(dataPath("share_links.json"))
+
+func newShareLinkStore(path string) *ShareLinkStore {
+	s := &ShareLinkStore{path: path, links: make(map[string]ShareLink)}
+	s.load()
+	watchDataFile(path, s.load)
+	return s
+}
+
+// load reads the share links file, replacing what is in memory.
+func (s *ShareLinkStore) load() {
+	var list []ShareLink
+	if err := readJSONFile(s.path, &list); err != nil {
+		log.Printf("Could not load share links: %v", err)
+		return
+	}
+	links := make(map[string]ShareLink)
+	for _, l := range list {
+		links[l.ID] = l
+	}
+	s.mu.Lock()
+	s.links = links
+	s.mu.Unlock()
+}
+
+func (s *ShareLinkStore) List(team string) []ShareLink {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []ShareLink
+	for _, l := range s.links {
+		if l.Team == team {
+			list = append(list, l)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+func (s *ShareLinkStore) Get(id string) (ShareLink, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l, ok := s.links[id]
+	return l, ok
+}
+
+func (s *ShareLinkStore) ByToken(token string) (ShareLink, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, l := range s.links {
+		if subtle.ConstantTimeCompare([]byte(l.Token), []byte(token)) == 1 {
+			return l, true
+		}
+	}
+	return ShareLink{}, false
+}
+
+func (s *ShareLinkStore) Save(l ShareLink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.links[l.ID] = l
+	return s.flush()
+}
+
+func (s *ShareLinkStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.links, id)
+	return s.flush()
+}
+
+// flush must be called with the lock held.
+func (s *ShareLinkStore) flush() error {
+	list := make([]ShareLink, 0, len(s.links))
+	for _, l := range s.links {
+		list = append(list, l)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return writeJSONFile(s.path, list)
+}
+
+// redactDataset copies what a share link may show of data. The copy takes
+// the link's ID, so profiles and memoized results of the redacted columns
+// are kept apart from the full dataset's. History that could name or
+// describe hidden columns (pipeline, notes, rules, checksum) is left out.
+func redactDataset(data Spreadsheet, l ShareLink) Spreadsheet {
+	keep := l.visible(data)
+	removed := make(map[int]bool, len(data.Headers)-len(keep))
+	for i := range data.Headers {
+		removed[i] = true
+	}
+	for _, c := range keep {
+		delete(removed, c)
+	}
+	out := Spreadsheet{
+		ID:          l.ID,
+		Headers:     projectRow(data.Headers, keep),
+		Rows:        make([][]string, len(data.Rows)),
+		NumericCols: shiftColumns(data.NumericCols, removed),
+		FormulaCols: shiftColumns(data.FormulaCols, removed),
+		FileName:    data.FileName,
+		UploadTime:  data.UploadTime,
+		Team:        data.Team,
+		Version:     data.Version,
+	}
+	if len(data.ColumnIDs) == len(data.Headers) {
+		out.ColumnIDs = projectRow(data.ColumnIDs, keep)
+	}
+	for i, row := range data.Rows {
+		out.Rows[i] = projectRow(row, keep)
+	}
+	shown := make(map[string]bool, 2*len(keep))
+	for i, h := range out.Headers {
+		shown[h] = true
+		if i < len(out.ColumnIDs) {
+			shown[out.ColumnIDs[i]] = true
+		}
+	}
+	out.Annotations.Dataset = data.Annotations.Dataset
+	for col, note := range data.Annotations.Columns {
+		if shown[col] {
+			out.Annotations = out.Annotations.With(col, note)
+		}
+	}
+	for _, e := range data.Lineage {
+		if !shown[e.Column] {
+			continue
+		}
+		ok := true
+		for _, src := range e.Sources {
+			ok = ok && shown[src]
+		}
+		if ok {
+			out.Lineage = append(out.Lineage, e)
+		}
+	}
+	for id, re := range data.Reinterpreted {
+		if shown[id] {
+			if out.Reinterpreted == nil {
+				out.Reinterpreted = make(map[string]Reinterpretation)
+			}
+			out.Reinterpreted[id] = re
+		}
+	}
+	for id, v := range data.Validators {
+		if shown[id] {
+			if out.Validators == nil {
+				out.Validators = make(map[string]string)
+			}
+			out.Validators[id] = v
+		}
+	}
+	return out
+}
+
+// sharedDataset resolves a share token to the redacted dataset it shows.
+func sharedDataset(token string) (ShareLink, Spreadsheet, bool) {
+	l, ok := shareLinks.ByToken(token)
+	if !ok {
+		return l, Spreadsheet{}, false
+	}
+	data, ok := workspace.Get(l.Dataset)
+	if !ok || datasetTeam(data) != l.Team {
+		return l, Spreadsheet{}, false
+	}
+	return l, redactDataset(data, l), true
+}
+
+type (
+	sharedDatasetKey struct{}
+	shareLinkKey     struct{}
+)
+
+// viaShareLink serves a dataset API handler for a share token: the handler
+// sees the redacted dataset under {id}, and teamDataset returns nothing
+// else.
+func viaShareLink(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l, data, ok := sharedDataset(r.PathValue("token"))
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "Unknown or revoked link")
+			return
+		}
+		ctx := context.WithValue(r.Context(), sharedDatasetKey{}, data)
+		r = r.WithContext(context.WithValue(ctx, shareLinkKey{}, l))
+		r.SetPathValue("id", data.ID)
+		next(w, r)
+	}
+}
+
+// shareLinksHandler lists the team's dataset share links and creates and
+// revokes them.
+func shareLinksHandler(w http.ResponseWriter, r *http.Request) {
+	team := currentTeam(r).ID
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		switch r.FormValue("action") {
+		case "create":
+			data, ok := teamDataset(r, r.FormValue("dataset"))
+			if !ok {
+				http.Error(w, "Unknown dataset", http.StatusNotFound)
+				return
+			}
+			l := ShareLink{ID: newID(), Token: newID() + newID(), Dataset: data.ID, Team: team, Owner: ownerID(currentUser(r)), Mode: r.FormValue("mode"), CreatedAt: time.Now()}
+			if l.Mode != "show" {
+				l.Mode = "hide"
+			}
+			for _, name := range strings.Split(r.FormValue("columns"), ",") {
+				if name = strings.TrimSpace(name); name == "" {
+					continue
+				}
+				col := columnIndex(data.Headers, name)
+				if col == -1 {
+					http.Error(w, fmt.Sprintf("No column named %q", name), http.StatusBadRequest)
+					return
+				}
+				id := data.Headers[col]
+				if col < len(data.ColumnIDs) && data.ColumnIDs[col] != "" {
+					id = data.ColumnIDs[col]
+				}
+				l.Columns = append(l.Columns, id)
+				l.Names = append(l.Names, data.Headers[col])
+			}
+			if l.Mode == "show" && len(l.Columns) == 0 {
+				http.Error(w, "Name at least one column to show", http.StatusBadRequest)
+				return
+			}
+			if err := shareLinks.Save(l); err != nil {
+				http.Error(w, fmt.Sprintf("Could not save share link: %v", err), http.StatusInternalServerError)
+				return
+			}
+		case "revoke":
+			l, ok := shareLinks.Get(r.FormValue("link"))
+			if !ok || l.Team != team {
+				http.Error(w, "Unknown share link", http.StatusNotFound)
+				return
+			}
+			if err := shareLinks.Delete(l.ID); err != nil {
+				http.Error(w, fmt.Sprintf("Could not revoke share link: %v", err), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "Invalid action", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/shares", http.StatusSeeOther)
+		return
+	}
+
+	section := ReportSection{Title: "Dataset Share Links", Headers: []string{"Dataset", "Visible Columns", "Created", "Link"}}
+	var linkOptions []FormOption
+	for _, l := range shareLinks.List(team) {
+		name := l.Dataset
+		if data, ok := workspace.Get(l.Dataset); ok {
+			name = data.FileName
+		}
+		section.Rows = append(section.Rows, []string{name, l.Policy(), l.CreatedAt.Format("2006-01-02"), l.URL()})
+		linkOptions = append(linkOptions, FormOption{Value: l.ID, Label: name + " (" + l.Policy() + ")"})
+	}
+	if len(section.Rows) == 0 {
+		section.Notes = []string{"No datasets are shared."}
+	}
+	sections := []ReportSection{section}
+	if currentUser(r).HasRole(RoleEditor) {
+		var datasets []FormOption
+		for _, data := range workspace.List() {
+			if datasetTeam(data) == team {
+				datasets = append(datasets, FormOption{Value: data.ID, Label: data.FileName + " (" + strings.Join(data.Headers, ", ") + ")"})
+			}
+		}
+		if len(datasets) > 0 {
+			sections = append(sections, ReportSection{Title: "Share a Dataset", Notes: []string{
+				"Anyone with the link can view, export and calculate on the dataset without signing in, but never sees the redacted columns.",
+			}, Form: &ReportForm{Action: "/shares", Submit: "🔗 Create link", Fields: []FormField{
+				{Name: "action", Type: "hidden", Value: "create"},
+				{Name: "dataset", Label: "Dataset", Type: "select", Options: datasets},
+				{Name: "mode", Label: "Policy", Type: "select", Options: []FormOption{
+					{Value: "hide", Label: "Hide these columns"},
+					{Value: "show", Label: "Show only these columns"},
+				}},
+				{Name: "columns", Label: "Columns", Placeholder: "e.g. Salary, ID Number"},
+			}}})
+		}
+		if len(linkOptions) > 0 {
+			sections = append(sections, ReportSection{Title: "Revoke", Form: &ReportForm{Action: "/shares", Submit: "🚫 Revoke", Fields: []FormField{
+				{Name: "action", Type: "hidden", Value: "revoke"},
+				{Name: "link", Label: "Link", Type: "select", Options: linkOptions},
+			}}})
+		}
+	}
+	renderReport(w, ReportPage{Title: "Share Links", Subtitle: currentTeam(r).Name, Sections: sections})
+}
+
+const sharedPreviewRows = 50
+
+// sharedDatasetHandler shows a shared dataset to anyone holding the token,
+// with its exports and a calculation form. It is reachable without signing
+// in.
+func sharedDatasetHandler(w http.ResponseWriter, r *http.Request) {
+	l, data, ok := sharedDataset(r.PathValue("token"))
+	if !ok {
+		http.Error(w, "Unknown or revoked link", http.StatusNotFound)
+		return
+	}
+	accessLog.RecordShare(r, l, "view")
+	preview := ReportSection{Title: "Data", Headers: data.Headers, Rows: data.Rows}
+	preview.Notes = []string{fmt.Sprintf("%d rows, %d columns", len(data.Rows), len(data.Headers))}
+	if len(data.Rows) > sharedPreviewRows {
+		preview.Rows = data.Rows[:sharedPreviewRows]
+		preview.Notes[0] += fmt.Sprintf("; the first %d are shown here, exports have them all", sharedPreviewRows)
+	}
+	if data.Annotations.Dataset != "" {
+		preview.Notes = append(preview.Notes, data.Annotations.Dataset)
+	}
+	exports := ReportSection{Title: "Export"}
+	for _, f := range []struct{ format, label string }{{"csv", "CSV"}, {"xlsx", "Excel"}, {"tsv", "TSV"}, {"arrow", "Arrow"}} {
+		exports.Links = append(exports.Links, ReportLink{Label: "⬇️ " + f.label, URL: l.URL() + "/export?format=" + f.format})
+	}
+	sections := []ReportSection{preview, exports}
+	var columns []FormOption
+	for _, c := range data.NumericCols {
+		columns = append(columns, FormOption{Value: data.Headers[c], Label: data.Headers[c]})
+	}
+	if len(columns) > 0 {
+		ops := make([]FormOption, len(operations))
+		for i, op := range operations {
+			ops[i] = FormOption{Value: op.Name, Label: op.Icon + " " + op.Label}
+		}
+		sections = append(sections, ReportSection{Title: "Calculate", Form: &ReportForm{Action: l.URL() + "/calculate", Method: "get", Submit: "Calculate", Fields: []FormField{
+			{Name: "column", Label: "Column", Type: "select", Options: columns},
+			{Name: "operation", Label: "Operation", Type: "select", Options: ops},
+		}}})
+	}
+	renderReport(w, ReportPage{Title: data.FileName, Subtitle: "Shared dataset", Sections: sections})
+}
+
+func sharedExportHandler(w http.ResponseWriter, r *http.Request) {
+	l, data, ok := sharedDataset(r.PathValue("token"))
+	if !ok {
+		http.Error(w, "Unknown or revoked link", http.StatusNotFound)
+		return
+	}
+	accessLog.RecordShare(r, l, "export as "+exportLabel(r.URL.Query().Get("format")))
+	base := exportBaseName(data.FileName)
+	attach := func(ext string) {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, base, ext))
+	}
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		attach("csv")
+		if err := writeCSV(w, data.Headers, data.Rows); err != nil {
+			log.Printf("Export error: %v", err)
+		}
+	case "tsv":
+		w.Header().Set("Content-Type", "text/tab-separated-values; charset=utf-8")
+		attach("tsv")
+		writeTSV(w, data.Headers, data.Rows)
+	case "arrow", "feather":
+		w.Header().Set("Content-Type", mimeArrow)
+		attach(format)
+		if err := writeArrowFile(w, data); err != nil {
+			log.Printf("Export error: %v", err)
+		}
+	case "xlsx":
+		f, err := buildStyledXLSX(data, ResultPage{}, XLSXOptions{})
+		if err != nil {
+			log.Printf("Export error: %v", err)
+			http.Error(w, "Failed to build workbook", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		attach("xlsx")
+		if _, err := f.WriteTo(w); err != nil {
+			log.Printf("Export error: %v", err)
+		}
+	default:
+		http.Error(w, "Unsupported export format", http.StatusBadRequest)
+	}
+}
+
+// sharedCalculation runs one operation on a column of a shared dataset,
+// from the query string: column, operation and the operation's parameters
+// by name.
+func sharedCalculation(r *http.Request, data Spreadsheet) (Operation, float64, error) {
+	op, ok := lookupOperation(r.URL.Query().Get("operation"))
+	if !ok {
+		return op, 0, fmt.Errorf("unknown operation")
+	}
+	col := columnIndex(data.Headers, r.URL.Query().Get("column"))
+	if col == -1 {
+		return op, 0, fmt.Errorf("unknown column")
+	}
+	raw := make(map[string]string)
+	for _, spec := range op.Params {
+		if v := r.URL.Query().Get(spec.Name); v != "" {
+			raw[spec.Name] = v
+		}
+	}
+	params, err := op.ResolveParams(raw)
+	if err != nil {
+		return op, 0, err
+	}
+	v, err := memoizedCalculation(data, col, op.Name, params)
+	return op, v, err
+}
+
+func sharedCalculateHandler(w http.ResponseWriter, r *http.Request) {
+	l, data, ok := sharedDataset(r.PathValue("token"))
+	if !ok {
+		http.Error(w, "Unknown or revoked link", http.StatusNotFound)
+		return
+	}
+	op, v, err := sharedCalculation(r, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	accessLog.RecordShare(r, l, op.Label+" of "+r.URL.Query().Get("column"))
+	column := r.URL.Query().Get("column")
+	renderReport(w, ReportPage{Title: data.FileName, Subtitle: "Shared dataset", Sections: []ReportSection{{
+		Title:   op.Label + " of " + column,
+		Headers: []string{"Value", "Rows"},
+		Rows:    [][]string{{formatStat(v), strconv.Itoa(len(data.Rows))}},
+		Links:   []ReportLink{{Label: "← Back", URL: l.URL()}},
+	}}})
+}
+
+func sharedCalculateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	data := r.Context().Value(sharedDatasetKey{}).(Spreadsheet)
+	op, v, err := sharedCalculation(r, data)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	accessLog.Record(r, data.ID, "api", op.Label+" of "+r.URL.Query().Get("column"))
+	writeAPIData(w, r, map[string]interface{}{
+		"column":    r.URL.Query().Get("column"),
+		"operation": op.Name,
+		"value":     v,
+		"rows":      len(data.Rows),
+	})
+}
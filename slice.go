@@ -0,0 +1,140 @@
+// slice.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// sliceRows returns the rows between from and to, both 1-based and inclusive.
+func sliceRows(data Spreadsheet, from, to int) (Spreadsheet, error) {
+	if from < 1 || to < from {
+		return Spreadsheet{}, fmt.Errorf("invalid row range %d-%d", from, to)
+	}
+	if from > len(data.Rows) {
+		return Spreadsheet{}, fmt.Errorf("row %d is past the end of the data (%d rows)", from, len(data.Rows))
+	}
+	if to > len(data.Rows) {
+		to = len(data.Rows)
+	}
+	derived := deriveDataset(data, data.Rows[from-1:to])
+	derived.Derivation = fmt.Sprintf("Rows %d–%d", from, to)
+	derived.Pipeline = appendStep(data.Pipeline, "slice_rows", map[string]string{
+		"from": strconv.Itoa(from),
+		"to":   strconv.Itoa(to),
+	})
+	return derived, nil
+}
+
+// sliceDates keeps the rows whose date in col falls within [start, end].
+// Rows with a missing or unreadable date are dropped.
+func sliceDates(data Spreadsheet, col int, start, end time.Time) (Spreadsheet, error) {
+	if end.Before(start) {
+		return Spreadsheet{}, fmt.Errorf("end date is before start date")
+	}
+	var rows [][]string
+	for _, row := range data.Rows {
+		t, ok := parseDate(cellValue(row, col))
+		if !ok || t.Before(start) || t.After(end) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return Spreadsheet{}, fmt.Errorf("no rows fall within the date window")
+	}
+	derived := deriveDataset(data, rows)
+	derived.Derivation = fmt.Sprintf("%s from %s to %s", data.Headers[col], start.Format("2006-01-02"), end.Format("2006-01-02"))
+	derived.Pipeline = appendStep(data.Pipeline, "slice_dates", map[string]string{
+		"column": data.Headers[col],
+		"start":  start.Format("2006-01-02"),
+		"end":    end.Format("2006-01-02"),
+	})
+	return derived, nil
+}
+
+func deriveDataset(parent Spreadsheet, rows [][]string) Spreadsheet {
+	derived := Spreadsheet{
+		ParentID:    parent.ID,
+		Headers:     parent.Headers,
+		ColumnIDs:   parent.ColumnIDs,
+		Rows:        make([][]string, len(rows)),
+		FileName:    parent.FileName,
+		UploadTime:  parent.UploadTime,
+		FileSize:    parent.FileSize,
+		FormulaCols: parent.FormulaCols,
+		Checksum:    parent.Checksum,
+		Team:        parent.Team,
+		Annotations: parent.Annotations,
+		Validators:  parent.Validators,
+		Rules:       parent.Rules,
+		Lineage:     parent.Lineage,
+	}
+	copy(derived.Rows, rows)
+	derived.NumericCols = parent.NumericCols
+	return derived
+}
+
+func sliceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	source, ok := sessionDataset(r)
+	if !ok {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var derived Spreadsheet
+	var err error
+	switch r.FormValue("mode") {
+	case "rows":
+		from, errFrom := strconv.Atoi(r.FormValue("from"))
+		to, errTo := strconv.Atoi(r.FormValue("to"))
+		if errFrom != nil || errTo != nil {
+			http.Error(w, "Invalid row range", http.StatusBadRequest)
+			return
+		}
+		derived, err = sliceRows(source, from, to)
+	case "dates":
+		col := columnIndex(source.Headers, r.FormValue("date_col"))
+		if col == -1 {
+			http.Error(w, "Unknown date column", http.StatusBadRequest)
+			return
+		}
+		start, errStart := time.Parse("2006-01-02", r.FormValue("start"))
+		end, errEnd := time.Parse("2006-01-02", r.FormValue("end"))
+		if errStart != nil || errEnd != nil {
+			http.Error(w, "Invalid date window", http.StatusBadRequest)
+			return
+		}
+		derived, err = sliceDates(source, col, start, end)
+	default:
+		http.Error(w, "Invalid slice mode", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Slice error: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	derived.Owner = ownerID(currentUser(r))
+	derived, err = workspace.Add(derived)
+	if errors.Is(err, errOverQuota) {
+		http.Error(w, "Slice rejected: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Slice not saved: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderDisplay(w, r, derived)
+}
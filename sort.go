@@ -0,0 +1,169 @@
+// sort.go
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type SortKey struct {
+	Col  int
+	Desc bool
+}
+
+// sortRows orders the rows by the given keys. Empty cells are treated as
+// nulls and placed first or last regardless of each key's direction.
+// Uploaded cells kept for reinterpreted columns follow their rows.
+func sortRows(data *Spreadsheet, keys []SortKey, nullsFirst bool) {
+	order := make([]int, len(data.Rows))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		ri, rj := data.Rows[order[i]], data.Rows[order[j]]
+		for _, k := range keys {
+			a, b := cellValue(ri, k.Col), cellValue(rj, k.Col)
+			if a == "" || b == "" {
+				if a == b {
+					continue
+				}
+				return (a == "") == nullsFirst
+			}
+			c := compareCells(a, b)
+			if c == 0 {
+				continue
+			}
+			if k.Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+	rows := make([][]string, len(order))
+	for i, o := range order {
+		rows[i] = data.Rows[o]
+	}
+	data.Rows = rows
+	if len(data.Reinterpreted) == 0 {
+		return
+	}
+	re := make(map[string]Reinterpretation, len(data.Reinterpreted))
+	for id, v := range data.Reinterpreted {
+		if len(v.Cells) == len(order) {
+			cells := make([]string, len(order))
+			for i, o := range order {
+				cells[i] = v.Cells[o]
+			}
+			v.Cells = cells
+		}
+		re[id] = v
+	}
+	data.Reinterpreted = re
+}
+
+// compareCells puts numbers before text, comparing numbers numerically and
+// text case-insensitively. Ranking the two apart keeps the order consistent
+// in mixed columns, where comparing each pair by whatever both happen to be
+// would let "2" < "10" < "1a" < "2" go round in a circle.
+func compareCells(a, b string) int {
+	fa, numA := sortNumber(a)
+	fb, numB := sortNumber(b)
+	switch {
+	case numA && numB:
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case numA:
+		return -1
+	case numB:
+		return 1
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+// sortNumber parses a cell that sorts as a number. NaN sorts as text, since
+// it isn't less than, greater than or equal to anything.
+func sortNumber(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil && !math.IsNaN(f)
+}
+
+func parseSortKeys(headers []string, cols, dirs []string) ([]SortKey, error) {
+	var keys []SortKey
+	for i, name := range cols {
+		if name == "" {
+			continue
+		}
+		col := columnIndex(headers, name)
+		if col == -1 {
+			return nil, fmt.Errorf("unknown column: %s", name)
+		}
+		desc := i < len(dirs) && dirs[i] == "desc"
+		keys = append(keys, SortKey{Col: col, Desc: desc})
+	}
+	return keys, nil
+}
+
+func sortParams(headers []string, keys []SortKey, nullsFirst bool) map[string]string {
+	var parts []string
+	for _, k := range keys {
+		dir := "asc"
+		if k.Desc {
+			dir = "desc"
+		}
+		parts = append(parts, headers[k.Col]+" "+dir)
+	}
+	nulls := "last"
+	if nullsFirst {
+		nulls = "first"
+	}
+	return map[string]string{"keys": strings.Join(parts, ", "), "nulls": nulls}
+}
+
+func sortHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	data, ok := sessionDataset(r)
+	if !ok {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	keys, err := parseSortKeys(data.Headers, r.Form["sort_col"], r.Form["sort_dir"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Sort error: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(keys) == 0 {
+		http.Error(w, "No sort columns selected", http.StatusBadRequest)
+		return
+	}
+
+	if err := checkVersion(r, data); err != nil {
+		http.Error(w, err.Error(), updateErrorStatus(w, err))
+		return
+	}
+	nullsFirst := r.FormValue("nulls") == "first"
+	sortRows(&data, keys, nullsFirst)
+	data.Pipeline = appendStep(data.Pipeline, "sort", sortParams(data.Headers, keys, nullsFirst))
+	if err := workspace.Update(&data); err != nil {
+		http.Error(w, err.Error(), updateErrorStatus(w, err))
+		return
+	}
+	renderDisplay(w, r, data)
+}
@@ -0,0 +1,41 @@
+// sort_test.go
+package main
+
+import "testing"
+
+// compareCells must be a consistent order over mixed columns, or sorting
+// depends on the input order.
+func TestCompareCellsTransitive(t *testing.T) {
+	cells := []string{"2", "10", "1a", "b", "B", "-3.5", "1e2", "NaN", "abc", "0"}
+	for _, a := range cells {
+		if c := compareCells(a, a); c != 0 {
+			t.Errorf("compareCells(%q, %q) = %d", a, a, c)
+		}
+		for _, b := range cells {
+			if compareCells(a, b) != -compareCells(b, a) {
+				t.Errorf("compareCells(%q, %q) isn't the reverse of (%q, %q)", a, b, b, a)
+			}
+			for _, c := range cells {
+				if compareCells(a, b) < 0 && compareCells(b, c) < 0 && compareCells(a, c) >= 0 {
+					t.Errorf("%q < %q < %q but not %q < %q", a, b, c, a, c)
+				}
+			}
+		}
+	}
+}
+
+func TestSortRowsMixed(t *testing.T) {
+	want := []string{"-3.5", "2", "10", "1a", "b"}
+	for _, start := range [][]string{{"1a", "10", "2", "b", "-3.5"}, {"b", "2", "-3.5", "1a", "10"}} {
+		data := Spreadsheet{Headers: []string{"Code"}}
+		for _, v := range start {
+			data.Rows = append(data.Rows, []string{v})
+		}
+		sortRows(&data, []SortKey{{Col: 0}}, false)
+		for i, row := range data.Rows {
+			if row[0] != want[i] {
+				t.Fatalf("sorted %v to %v, want %v", start, data.Rows, want)
+			}
+		}
+	}
+}
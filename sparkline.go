@@ -0,0 +1,110 @@
+// sparkline.go
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sparkWidth  = 80
+	sparkHeight = 20
+	sparkBins   = 12
+	sparkPoints = 40
+)
+
+// sparkline draws a numeric column as a small inline SVG: its trend over
+// dateCol when the dataset has a date column (dateCol >= 0), otherwise the
+// distribution of its values. It returns "" when there is nothing to draw.
+func sparkline(data Spreadsheet, col, dateCol int) template.HTML {
+	if dateCol >= 0 {
+		if points := trendPoints(data, col, dateCol); len(points) > 1 {
+			return trendSVG(points, fmt.Sprintf("%s by %s", data.Headers[col], data.Headers[dateCol]))
+		}
+	}
+	values := storedValues(data, col)
+	if len(values) == 0 {
+		return ""
+	}
+	return distributionSVG(histogram(values, sparkBins), "Distribution of "+data.Headers[col])
+}
+
+// trendPoints orders col's values by date and averages them down to at most
+// sparkPoints points. Rows without both a date and a number are skipped.
+func trendPoints(data Spreadsheet, col, dateCol int) []float64 {
+	type point struct {
+		at    time.Time
+		value float64
+	}
+	var points []point
+	for _, row := range data.Rows {
+		at, ok := parseDate(cellValue(row, dateCol))
+		if !ok {
+			continue
+		}
+		if v, ok := parseFinite(cellValue(row, col)); ok {
+			points = append(points, point{at, v})
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].at.Before(points[j].at) })
+	n := len(points)
+	if n > sparkPoints {
+		n = sparkPoints
+	}
+	out := make([]float64, n)
+	for i := range out {
+		lo, hi := i*len(points)/n, (i+1)*len(points)/n
+		sum := 0.0
+		for _, p := range points[lo:hi] {
+			sum += p.value
+		}
+		out[i] = sum / float64(hi-lo)
+	}
+	return out
+}
+
+func trendSVG(points []float64, title string) template.HTML {
+	lo, hi := min(points), max(points)
+	coords := make([]string, len(points))
+	for i, v := range points {
+		x := float64(i) * sparkWidth / float64(len(points)-1)
+		coords[i] = fmt.Sprintf("%.1f,%.1f", x, sparkY(v, lo, hi))
+	}
+	return sparkSVG(title, fmt.Sprintf(`<polyline points="%s" fill="none" stroke="#667eea" stroke-width="1.5" vector-effect="non-scaling-stroke"/>`, strings.Join(coords, " ")))
+}
+
+func distributionSVG(bins []HistogramBin, title string) template.HTML {
+	if len(bins) == 0 {
+		return ""
+	}
+	most := 0
+	for _, b := range bins {
+		if b.Count > most {
+			most = b.Count
+		}
+	}
+	width := float64(sparkWidth) / float64(len(bins))
+	var bars strings.Builder
+	for i, b := range bins {
+		h := float64(b.Count) * sparkHeight / float64(most)
+		fmt.Fprintf(&bars, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="#667eea"/>`, float64(i)*width, sparkHeight-h, width-1, h)
+	}
+	return sparkSVG(title, bars.String())
+}
+
+// sparkY maps v into the drawing's height, keeping a pixel of margin so the
+// line isn't clipped. A flat series is drawn across the middle.
+func sparkY(v, lo, hi float64) float64 {
+	if hi == lo {
+		return sparkHeight / 2
+	}
+	return 1 + (hi-v)/(hi-lo)*(sparkHeight-2)
+}
+
+func sparkSVG(title, body string) template.HTML {
+	return template.HTML(fmt.Sprintf(`<svg class="sparkline" width="%d" height="%d" viewBox="0 0 %d %d" preserveAspectRatio="none" role="img"><title>%s</title>%s</svg>`,
+		sparkWidth, sparkHeight, sparkWidth, sparkHeight, template.HTMLEscapeString(title), body))
+}
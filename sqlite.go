@@ -0,0 +1,623 @@
+// sqlite.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A SQLite database file written directly in the on-disk format (see
+// https://www.sqlite.org/fileformat.html), like the Arrow export: every
+// table and index is a b-tree built bottom-up from already sorted cells.
+
+const (
+	sqlitePageSize = 4096
+	sqliteVersion  = 3045001 // the library version recorded in the header
+
+	sqlitePageIndexInterior = 0x02
+	sqlitePageTableInterior = 0x05
+	sqlitePageIndexLeaf     = 0x0A
+	sqlitePageTableLeaf     = 0x0D
+)
+
+// SQLiteTable is one table to export. Index names the columns to index.
+type SQLiteTable struct {
+	Name  string
+	Data  Spreadsheet
+	Index []int
+}
+
+// sqliteKeyColumns suggests the columns worth an index: those that identify
+// every row, holding distinct, non-blank, non-fractional values.
+func sqliteKeyColumns(data Spreadsheet, types []int) []int {
+	var keys []int
+	for c, typ := range types {
+		if typ == storeFloat || len(data.Rows) == 0 {
+			continue
+		}
+		seen := make(map[string]bool, len(data.Rows))
+		unique := true
+		for _, row := range data.Rows {
+			v := strings.TrimSpace(cellValue(row, c))
+			if v == "" || seen[v] {
+				unique = false
+				break
+			}
+			seen[v] = true
+		}
+		if unique {
+			keys = append(keys, c)
+		}
+	}
+	return keys
+}
+
+func sqliteQuote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+var sqliteDeclaredTypes = map[int]string{
+	storeText:     "TEXT",
+	storeInt:      "INTEGER",
+	storeFloat:    "REAL",
+	storeDate:     "DATE",
+	storeDateTime: "DATETIME",
+}
+
+// sqliteValue converts a cell to what's stored for its column type: nil,
+// int64, float64 or string. Dates are stored as ISO 8601 text, which is
+// what SQLite's date functions read.
+func sqliteValue(v string, typ int) interface{} {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil
+	}
+	switch typ {
+	case storeInt:
+		i, _ := strconv.ParseInt(v, 10, 64)
+		return i
+	case storeFloat:
+		f, _ := parseFinite(v)
+		return f
+	case storeDate:
+		t, _ := parseDate(v)
+		return t.Format("2006-01-02")
+	case storeDateTime:
+		t, _ := parseDate(v)
+		return t.UTC().Format("2006-01-02 15:04:05")
+	}
+	return v
+}
+
+// writeSQLite writes tables as a SQLite database file.
+func writeSQLite(w io.Writer, tables []SQLiteTable) error {
+	db := &sqliteFile{}
+	db.alloc() // page 1 holds the header and the schema table
+	var schema [][]interface{}
+	indexNames := make(map[string]bool)
+	for _, t := range tables {
+		types := storageTypes(t.Data)
+		cols := make([]string, len(t.Data.Headers))
+		for i, h := range t.Data.Headers {
+			cols[i] = sqliteQuote(h) + " " + sqliteDeclaredTypes[types[i]]
+		}
+		records := make([][]interface{}, len(t.Data.Rows))
+		for i, row := range t.Data.Rows {
+			rec := make([]interface{}, len(t.Data.Headers))
+			for c, typ := range types {
+				rec[c] = sqliteValue(cellValue(row, c), typ)
+			}
+			records[i] = rec
+		}
+		root := db.tableTree(records, 0)
+		schema = append(schema, []interface{}{"table", t.Name, t.Name, int64(root),
+			fmt.Sprintf("CREATE TABLE %s (%s)", sqliteQuote(t.Name), strings.Join(cols, ", "))})
+
+		for _, c := range t.Index {
+			name := t.Name + "_" + t.Data.Headers[c]
+			for n := 2; indexNames[strings.ToLower(name)]; n++ {
+				name = fmt.Sprintf("%s_%s_%d", t.Name, t.Data.Headers[c], n)
+			}
+			indexNames[strings.ToLower(name)] = true
+			keys := make([][]interface{}, len(records))
+			for i, rec := range records {
+				keys[i] = []interface{}{rec[c], int64(i + 1)}
+			}
+			sort.SliceStable(keys, func(i, j int) bool { return sqliteCompare(keys[i][0], keys[j][0]) < 0 })
+			root := db.indexTree(keys)
+			schema = append(schema, []interface{}{"index", name, t.Name, int64(root),
+				fmt.Sprintf("CREATE INDEX %s ON %s (%s)", sqliteQuote(name), sqliteQuote(t.Name), sqliteQuote(t.Data.Headers[c]))})
+		}
+	}
+	db.tableTree(schema, 1)
+
+	h := db.pages[0]
+	copy(h, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(h[16:], sqlitePageSize)
+	h[18], h[19] = 1, 1                   // legacy journal mode
+	h[21], h[22], h[23] = 64, 32, 32      // payload fractions, fixed by the format
+	binary.BigEndian.PutUint32(h[24:], 1) // change counter
+	binary.BigEndian.PutUint32(h[28:], uint32(len(db.pages)))
+	binary.BigEndian.PutUint32(h[40:], 1) // schema cookie
+	binary.BigEndian.PutUint32(h[44:], 4) // schema format
+	binary.BigEndian.PutUint32(h[56:], 1) // UTF-8
+	binary.BigEndian.PutUint32(h[92:], 1) // the page count is valid for change 1
+	binary.BigEndian.PutUint32(h[96:], sqliteVersion)
+	for _, p := range db.pages {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteCompare orders index keys as SQLite's BINARY collation does: NULL,
+// then numbers, then text by bytes.
+func sqliteCompare(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int64, float64:
+			return 1
+		}
+		return 2
+	}
+	if ra, rb := rank(a), rank(b); ra != rb || ra == 0 {
+		return ra - rb
+	}
+	if s, ok := a.(string); ok {
+		return strings.Compare(s, b.(string))
+	}
+	num := func(v interface{}) float64 {
+		if i, ok := v.(int64); ok {
+			return float64(i)
+		}
+		return v.(float64)
+	}
+	ia, aInt := a.(int64)
+	ib, bInt := b.(int64)
+	switch {
+	case aInt && bInt && ia < ib, num(a) < num(b):
+		return -1
+	case aInt && bInt && ia > ib, num(a) > num(b):
+		return 1
+	}
+	return 0
+}
+
+type sqliteFile struct {
+	pages [][]byte
+}
+
+func (db *sqliteFile) alloc() int {
+	db.pages = append(db.pages, make([]byte, sqlitePageSize))
+	return len(db.pages)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	if v > 1<<56-1 {
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+	var buf [8]byte
+	n := 0
+	for {
+		buf[n] = byte(v & 0x7f)
+		n++
+		if v >>= 7; v == 0 {
+			break
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		if i > 0 {
+			buf[i] |= 0x80
+		}
+		b = append(b, buf[i])
+	}
+	return b
+}
+
+func varintLen(v uint64) int {
+	return len(appendVarint(nil, v))
+}
+
+// encodeRecord encodes values in the record format: a header of serial
+// types, then the values.
+func encodeRecord(values []interface{}) []byte {
+	var types, body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			types = appendVarint(types, 0)
+		case int64:
+			switch {
+			case v == 0:
+				types = appendVarint(types, 8)
+			case v == 1:
+				types = appendVarint(types, 9)
+			default:
+				sizes := []struct {
+					serial uint64
+					bytes  int
+				}{{1, 1}, {2, 2}, {3, 3}, {4, 4}, {5, 6}, {6, 8}}
+				for _, s := range sizes {
+					limit := int64(1) << (8*s.bytes - 1)
+					if s.bytes == 8 || -limit <= v && v < limit {
+						types = appendVarint(types, s.serial)
+						for i := s.bytes - 1; i >= 0; i-- {
+							body = append(body, byte(v>>(8*i)))
+						}
+						break
+					}
+				}
+			}
+		case float64:
+			types = appendVarint(types, 7)
+			body = binary.BigEndian.AppendUint64(body, math.Float64bits(v))
+		case string:
+			types = appendVarint(types, uint64(13+2*len(v)))
+			body = append(body, v...)
+		}
+	}
+	size := len(types) + 1
+	for varintLen(uint64(size)) != size-len(types) {
+		size++
+	}
+	rec := appendVarint(nil, uint64(size))
+	rec = append(rec, types...)
+	return append(rec, body...)
+}
+
+// localSize is how much of a payload stays in its cell on pages with
+// usable bytes; the rest goes to overflow pages.
+func localSize(payload, usable int, tableLeaf bool) int {
+	maxLocal := (usable-12)*64/255 - 23
+	if tableLeaf {
+		maxLocal = usable - 35
+	}
+	minLocal := (usable-12)*32/255 - 23
+	if payload <= maxLocal {
+		return payload
+	}
+	if k := minLocal + (payload-minLocal)%(usable-4); k <= maxLocal {
+		return k
+	}
+	return minLocal
+}
+
+// spill moves what doesn't fit in a cell onto a chain of overflow pages and
+// returns the part that stays, followed by the first overflow page number.
+func (db *sqliteFile) spill(payload []byte, tableLeaf bool) []byte {
+	local := localSize(len(payload), sqlitePageSize, tableLeaf)
+	if local == len(payload) {
+		return payload
+	}
+	out := append([]byte(nil), payload[:local]...)
+	prev := -1
+	for rest := payload[local:]; len(rest) > 0; {
+		pg := db.alloc()
+		if prev == -1 {
+			out = binary.BigEndian.AppendUint32(out, uint32(pg))
+		} else {
+			binary.BigEndian.PutUint32(db.pages[prev-1], uint32(pg))
+		}
+		n := copy(db.pages[pg-1][4:], rest)
+		rest = rest[n:]
+		prev = pg
+	}
+	return out
+}
+
+func cellSize(payload int, tableLeaf bool) int {
+	n := localSize(payload, sqlitePageSize, tableLeaf)
+	if n < payload {
+		n += 4
+	}
+	return n
+}
+
+// pageCapacity is the room for cells and their pointers on a page.
+func pageCapacity(pgno int, interior bool) int {
+	room := sqlitePageSize - 8
+	if interior {
+		room -= 4
+	}
+	if pgno == 1 {
+		room -= 100
+	}
+	return room
+}
+
+// writePage lays out a b-tree page: the header, the cell pointers and the
+// cells packed against the end of the page.
+func (db *sqliteFile) writePage(pgno int, kind byte, cells [][]byte, right int) {
+	p := db.pages[pgno-1]
+	off := 0
+	if pgno == 1 {
+		off = 100
+	}
+	header := 8
+	p[off] = kind
+	if kind == sqlitePageIndexInterior || kind == sqlitePageTableInterior {
+		header = 12
+		binary.BigEndian.PutUint32(p[off+8:], uint32(right))
+	}
+	binary.BigEndian.PutUint16(p[off+3:], uint16(len(cells)))
+	end := sqlitePageSize
+	for i, c := range cells {
+		end -= len(c)
+		copy(p[end:], c)
+		binary.BigEndian.PutUint16(p[off+header+2*i:], uint16(end))
+	}
+	binary.BigEndian.PutUint16(p[off+5:], uint16(end))
+}
+
+// place writes a page at root when root is set and this is the top of the
+// tree, or on a new page otherwise.
+func (db *sqliteFile) place(root int, kind byte, cells [][]byte, right int) int {
+	if root == 0 {
+		root = db.alloc()
+	}
+	db.writePage(root, kind, cells, right)
+	return root
+}
+
+// fits reports whether cells fit on page pgno.
+func fits(cells [][]byte, pgno int, interior bool) bool {
+	size := 0
+	for _, c := range cells {
+		size += len(c) + 2
+	}
+	return size <= pageCapacity(pgno, interior)
+}
+
+// tableTree writes records with rowids 1, 2, ... as a table b-tree and
+// returns its root page: root when set, otherwise a new page.
+func (db *sqliteFile) tableTree(records [][]interface{}, root int) int {
+	type child struct {
+		page   int
+		maxKey int64
+	}
+	// Leaves first. Cells are only spilled once their page is decided, so
+	// overflow pages aren't allocated twice.
+	var leaves [][]int
+	var current []int
+	room := pageCapacity(2, false)
+	encoded := make([][]byte, len(records))
+	for i, rec := range records {
+		encoded[i] = encodeRecord(rec)
+		size := varintLen(uint64(len(encoded[i]))) + varintLen(uint64(i+1)) + cellSize(len(encoded[i]), true) + 2
+		if size > room && len(current) > 0 {
+			leaves = append(leaves, current)
+			current, room = nil, pageCapacity(2, false)
+		}
+		current = append(current, i)
+		room -= size
+	}
+	leaves = append(leaves, current)
+	leafCells := func(rows []int) [][]byte {
+		cells := make([][]byte, 0, len(rows))
+		for _, i := range rows {
+			c := appendVarint(nil, uint64(len(encoded[i])))
+			c = appendVarint(c, uint64(i+1))
+			cells = append(cells, append(c, db.spill(encoded[i], true)...))
+		}
+		return cells
+	}
+	if len(leaves) == 1 && root != 0 {
+		if cells := leafCells(leaves[0]); fits(cells, root, false) {
+			return db.place(root, sqlitePageTableLeaf, cells, 0)
+		} else if len(cells) > 1 {
+			// Page 1 is smaller than the rest; split it in two.
+			half := len(leaves[0]) / 2
+			leaves = [][]int{leaves[0][:half], leaves[0][half:]}
+		}
+	}
+	if len(records) == 0 && root == 0 {
+		return db.place(0, sqlitePageTableLeaf, nil, 0)
+	}
+	var children []child
+	for _, rows := range leaves {
+		page := db.place(0, sqlitePageTableLeaf, leafCells(rows), 0)
+		children = append(children, child{page, int64(rows[len(rows)-1] + 1)})
+	}
+
+	for {
+		cellFor := func(c child) []byte {
+			return appendVarint(binary.BigEndian.AppendUint32(nil, uint32(c.page)), uint64(c.maxKey))
+		}
+		if root != 0 || len(children) > 1 {
+			var cells [][]byte
+			for _, c := range children[:len(children)-1] {
+				cells = append(cells, cellFor(c))
+			}
+			top := root
+			if top == 0 {
+				top = 2 // any page but the first has the same room
+			}
+			if fits(cells, top, true) {
+				return db.place(root, sqlitePageTableInterior, cells, children[len(children)-1].page)
+			}
+		} else {
+			return children[0].page
+		}
+		groups := groupChildren(len(children), func(i int) int { return len(cellFor(children[i])) + 2 }, pageCapacity(2, true))
+		var parents []child
+		for _, g := range groups {
+			var cells [][]byte
+			for _, c := range children[g[0] : g[1]-1] {
+				cells = append(cells, cellFor(c))
+			}
+			last := children[g[1]-1]
+			parents = append(parents, child{db.place(0, sqlitePageTableInterior, cells, last.page), last.maxKey})
+		}
+		children = parents
+	}
+}
+
+// groupChildren splits n children into runs for interior pages of the
+// given room. Every run but the last child of each becomes a cell; the last
+// is the right-most pointer. Runs have at least two children.
+func groupChildren(n int, size func(i int) int, room int) [][2]int {
+	var groups [][2]int
+	start, used := 0, 0
+	for i := 0; i < n; i++ {
+		if i > start && used+size(i) > room {
+			groups = append(groups, [2]int{start, i + 1})
+			start, used = i+1, 0
+			continue
+		}
+		used += size(i)
+	}
+	if start < n {
+		groups = append(groups, [2]int{start, n})
+	}
+	if last := len(groups) - 1; last > 0 && groups[last][1]-groups[last][0] < 2 {
+		groups[last-1][1]--
+		groups[last][0]--
+	}
+	return groups
+}
+
+// indexTree writes sorted index keys as an index b-tree and returns its
+// root page. In an index b-tree every key is stored once: the keys between
+// one page and the next move up to their parent as separators.
+func (db *sqliteFile) indexTree(keys [][]interface{}) int {
+	encoded := make([][]byte, len(keys))
+	sizes := make([]int, len(keys))
+	for i, k := range keys {
+		encoded[i] = encodeRecord(k)
+		sizes[i] = varintLen(uint64(len(encoded[i]))) + cellSize(len(encoded[i]), false) + 2
+	}
+	payload := func(i int) []byte {
+		return append(appendVarint(nil, uint64(len(encoded[i]))), db.spill(encoded[i], false)...)
+	}
+
+	// Split keys into leaves separated by single keys.
+	var leaves [][2]int
+	var separators []int
+	start, used := 0, 0
+	room := pageCapacity(2, false)
+	for i := 0; i < len(keys); i++ {
+		if used+sizes[i] <= room || i == start {
+			used += sizes[i]
+			continue
+		}
+		// keys[i] separates this leaf from the next; the next must not be
+		// empty, so with nothing after it the leaf gives up its last key.
+		end := i
+		if i == len(keys)-1 {
+			end = i - 1
+		}
+		leaves = append(leaves, [2]int{start, end})
+		separators = append(separators, end)
+		start, used = end+1, 0
+		i = end
+	}
+	leaves = append(leaves, [2]int{start, len(keys)})
+
+	children := make([]int, len(leaves))
+	for i, l := range leaves {
+		var cells [][]byte
+		for k := l[0]; k < l[1]; k++ {
+			cells = append(cells, payload(k))
+		}
+		children[i] = db.place(0, sqlitePageIndexLeaf, cells, 0)
+	}
+	for len(children) > 1 {
+		var parents, promoted []int
+		start, used := 0, 0
+		room := pageCapacity(2, true)
+		flush := func(end int) {
+			var cells [][]byte
+			for c := start; c < end; c++ {
+				cells = append(cells, append(binary.BigEndian.AppendUint32(nil, uint32(children[c])), payload(separators[c])...))
+			}
+			parents = append(parents, db.place(0, sqlitePageIndexInterior, cells, children[end]))
+		}
+		for c := 0; c < len(separators); c++ {
+			size := 4 + sizes[separators[c]]
+			if used+size <= room || c == start {
+				used += size
+				continue
+			}
+			end := c
+			if c == len(separators)-1 {
+				end = c - 1
+			}
+			flush(end)
+			promoted = append(promoted, separators[end])
+			start, used = end+1, 0
+			c = end
+		}
+		flush(len(separators))
+		children, separators = parents, promoted
+	}
+	return children[0]
+}
+
+// sqliteTables gathers what an export holds: the dataset, indexed on the
+// columns named by index (or its key columns when none are), and the last
+// results when asked for.
+func sqliteTables(r *http.Request, data Spreadsheet, results *ResultPage) ([]SQLiteTable, error) {
+	table := SQLiteTable{Name: "data", Data: data}
+	if refs := r.URL.Query()["index"]; len(refs) > 0 {
+		for _, ref := range refs {
+			col := columnRef(data, ref)
+			if col == -1 {
+				return nil, fmt.Errorf("unknown column %q", ref)
+			}
+			table.Index = append(table.Index, col)
+		}
+	} else {
+		table.Index = sqliteKeyColumns(data, storageTypes(data))
+	}
+	tables := []SQLiteTable{table}
+	if results != nil {
+		headers, rows := resultsTable(*results)
+		tables = append(tables, SQLiteTable{Name: "results", Data: Spreadsheet{Headers: headers, Rows: rows}})
+	}
+	return tables, nil
+}
+
+// datasetSQLiteAPIHandler serves a dataset as a SQLite database file.
+func datasetSQLiteAPIHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := teamDataset(r, r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Unknown dataset")
+		return
+	}
+	tables, err := sqliteTables(r, data, nil)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeSQLite(&buf, tables); err != nil {
+		log.Printf("SQLite export error: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to build database")
+		return
+	}
+	accessLog.Record(r, data.ID, "export", "sqlite")
+	w.Header().Set("Content-Type", mimeSQLite)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.sqlite"`, exportBaseName(data.FileName)))
+	w.Header().Set("ETag", strconv.Quote(strconv.Itoa(data.Version)))
+	w.Write(buf.Bytes())
+}
+
+const mimeSQLite = "application/vnd.sqlite3"
@@ -0,0 +1,134 @@
+// sqlite_test.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sqliteTestData has a column of each storage type, blanks, quotes and text
+// long enough to spill onto overflow pages at every length around a page.
+func sqliteTestData(rows int) Spreadsheet {
+	data := Spreadsheet{Headers: []string{"ID", "Amount", "Name", `Say "hi"`, "Day", "Note"}}
+	for i := range rows {
+		amount := fmt.Sprintf("%d.%02d", i*7, i%100)
+		if i%11 == 0 {
+			amount = ""
+		}
+		note := strings.Repeat("ü", i%50)
+		if i%97 == 0 {
+			note = strings.Repeat("x", 3900+i%700)
+		}
+		data.Rows = append(data.Rows, []string{
+			fmt.Sprint(i + 1), amount, fmt.Sprintf("name %d", i%13),
+			`a "quoted", value`, fmt.Sprintf("2024-%02d-%02d", i%12+1, i%28+1), note,
+		})
+	}
+	return data
+}
+
+// sqliteRoundTrip is what a column's cells read back as: what the export
+// stores for them, formatted the way the import formats stored values.
+func sqliteRoundTrip(data Spreadsheet) [][]string {
+	types := storageTypes(data)
+	out := make([][]string, len(data.Rows))
+	for i, row := range data.Rows {
+		out[i] = make([]string, len(data.Headers))
+		for c, typ := range types {
+			out[i][c] = sqliteCell(sqliteValue(cellValue(row, c), typ))
+		}
+	}
+	return out
+}
+
+func writeTestSQLite(t *testing.T, tables []SQLiteTable) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeSQLite(&buf, tables); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len()%sqlitePageSize != 0 {
+		t.Fatalf("file is %d bytes, not whole pages", buf.Len())
+	}
+	return buf.Bytes()
+}
+
+func TestSQLiteRoundTrip(t *testing.T) {
+	for _, rows := range []int{0, 1, 3, 500, 5000} {
+		data := sqliteTestData(rows)
+		file := writeTestSQLite(t, []SQLiteTable{{Name: "data", Data: data, Index: []int{0}}})
+		got, tables, err := processSQLite(bytes.NewReader(file), "", rows+1)
+		if err != nil {
+			t.Fatalf("%d rows: %v", rows, err)
+		}
+		if len(tables) != 1 || tables[0].Rows != rows {
+			t.Fatalf("%d rows: tables = %+v", rows, tables)
+		}
+		if strings.Join(got.Headers, "|") != strings.Join(data.Headers, "|") {
+			t.Errorf("%d rows: headers = %q", rows, got.Headers)
+		}
+		want := sqliteRoundTrip(data)
+		if len(got.Rows) != len(want) {
+			t.Fatalf("%d rows: read back %d", rows, len(got.Rows))
+		}
+		for i := range want {
+			for c := range want[i] {
+				if got.Rows[i][c] != want[i][c] {
+					t.Fatalf("%d rows: row %d column %d = %.40q, want %.40q", rows, i, c, got.Rows[i][c], want[i][c])
+				}
+			}
+		}
+	}
+}
+
+func TestSQLiteSeveralTables(t *testing.T) {
+	results := Spreadsheet{Headers: []string{"Column", "Sum"}, Rows: [][]string{{"Sales", "650.5"}, {"Units", "26"}}}
+	file := writeTestSQLite(t, []SQLiteTable{
+		{Name: "data", Data: sqliteTestData(300), Index: []int{0, 2}},
+		{Name: "results", Data: results},
+	})
+	got, tables, err := processSQLite(bytes.NewReader(file), "results", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 2 || tables[0].Rows != 300 || tables[1].Rows != 2 {
+		t.Fatalf("tables = %+v", tables)
+	}
+	if len(got.Rows) != 2 || got.Rows[0][1] != "650.5" || got.Rows[1][1] != "26" {
+		t.Errorf("results = %q", got.Rows)
+	}
+}
+
+// The real library checks what the import doesn't read, such as the
+// indexes, when it is installed.
+func TestSQLiteIntegrity(t *testing.T) {
+	bin, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 isn't installed")
+	}
+	for _, rows := range []int{0, 5000} {
+		path := filepath.Join(t.TempDir(), "export.sqlite")
+		file := writeTestSQLite(t, []SQLiteTable{{Name: "data", Data: sqliteTestData(rows), Index: []int{0, 2, 4}}})
+		if err := os.WriteFile(path, file, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command(bin, path, "PRAGMA integrity_check; SELECT count(*) FROM data INDEXED BY data_Name WHERE Name = 'name 3';").CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		want := 0
+		for i := range rows {
+			if i%13 == 3 {
+				want++
+			}
+		}
+		if got := strings.Fields(string(out)); len(got) != 2 || got[0] != "ok" || got[1] != fmt.Sprint(want) {
+			t.Fatalf("%d rows: sqlite3 says %q, want ok and %d matching", rows, out, want)
+		}
+	}
+}
@@ -0,0 +1,536 @@
+// sqliteimport.go
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Uploaded SQLite databases are read straight from the file format, the
+// other way round from sqlite.go: walk sqlite_master for the tables, then a
+// table's b-tree for its rows.
+
+var databaseExts = []string{".db", ".sqlite", ".sqlite3", ".duckdb"}
+
+func isDatabaseFile(filename string) bool {
+	for _, ext := range databaseExts {
+		if strings.HasSuffix(strings.ToLower(filename), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+var errStopScan = errors.New("stop scan")
+
+// SQLiteTableInfo describes a table an uploaded database offers.
+type SQLiteTableInfo struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	Rows    int      `json:"rows"`
+
+	root     int
+	rowidCol int // the INTEGER PRIMARY KEY column, stored as the rowid; -1 if none
+}
+
+type sqliteDB struct {
+	file     io.ReaderAt
+	pageSize int
+	usable   int
+	encoding uint32
+	visited  map[int]bool
+}
+
+func openSQLite(file io.ReaderAt) (*sqliteDB, error) {
+	header := make([]byte, 100)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("not a database file")
+	}
+	if string(header[8:12]) == "DUCK" {
+		return nil, fmt.Errorf("DuckDB files can't be read directly; in DuckDB, run COPY <table> TO 'table.csv' and upload the CSV, or ATTACH a SQLite file and copy the table into it")
+	}
+	if string(header[:16]) != "SQLite format 3\x00" {
+		return nil, fmt.Errorf("not a SQLite database")
+	}
+	db := &sqliteDB{file: file, pageSize: int(binary.BigEndian.Uint16(header[16:])), encoding: binary.BigEndian.Uint32(header[56:])}
+	if db.pageSize == 1 {
+		db.pageSize = 65536
+	}
+	db.usable = db.pageSize - int(header[20])
+	if db.pageSize < 512 || db.pageSize&(db.pageSize-1) != 0 || db.usable < 480 {
+		return nil, fmt.Errorf("corrupt database header")
+	}
+	return db, nil
+}
+
+func (db *sqliteDB) page(pgno int) ([]byte, error) {
+	if pgno < 1 {
+		return nil, fmt.Errorf("corrupt database: bad page number %d", pgno)
+	}
+	p := make([]byte, db.pageSize)
+	if _, err := db.file.ReadAt(p, int64(pgno-1)*int64(db.pageSize)); err != nil {
+		return nil, fmt.Errorf("corrupt database: page %d is missing", pgno)
+	}
+	return p, nil
+}
+
+func readVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8 && i < len(b); i++ {
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	if len(b) < 9 {
+		return 0, 0
+	}
+	return v<<8 | uint64(b[8]), 9
+}
+
+// scan calls visit with the rowid and record of every row in the table
+// b-tree rooted at pgno, in rowid order. visit returns errStopScan to stop.
+func (db *sqliteDB) scan(pgno int, visit func(rowid int64, record []byte) error) error {
+	db.visited = make(map[int]bool)
+	err := db.scanPage(pgno, visit, nil)
+	if err == errStopScan {
+		return nil
+	}
+	return err
+}
+
+// scanPage walks a table b-tree page. With visit nil it only counts rows.
+func (db *sqliteDB) scanPage(pgno int, visit func(rowid int64, record []byte) error, count *int) error {
+	if db.visited[pgno] {
+		return fmt.Errorf("corrupt database: page %d is linked twice", pgno)
+	}
+	db.visited[pgno] = true
+	p, err := db.page(pgno)
+	if err != nil {
+		return err
+	}
+	off := 0
+	if pgno == 1 {
+		off = 100
+	}
+	cells := int(binary.BigEndian.Uint16(p[off+3:]))
+	switch p[off] {
+	case sqlitePageTableInterior:
+		if off+12+2*cells > len(p) {
+			return fmt.Errorf("corrupt database: page %d", pgno)
+		}
+		for i := 0; i < cells; i++ {
+			ptr := int(binary.BigEndian.Uint16(p[off+12+2*i:]))
+			if ptr+4 > len(p) {
+				return fmt.Errorf("corrupt database: page %d", pgno)
+			}
+			if err := db.scanPage(int(binary.BigEndian.Uint32(p[ptr:])), visit, count); err != nil {
+				return err
+			}
+		}
+		return db.scanPage(int(binary.BigEndian.Uint32(p[off+8:])), visit, count)
+	case sqlitePageTableLeaf:
+		if visit == nil {
+			*count += cells
+			return nil
+		}
+		if off+8+2*cells > len(p) {
+			return fmt.Errorf("corrupt database: page %d", pgno)
+		}
+		for i := 0; i < cells; i++ {
+			ptr := int(binary.BigEndian.Uint16(p[off+8+2*i:]))
+			if ptr >= len(p) {
+				return fmt.Errorf("corrupt database: page %d", pgno)
+			}
+			size, n := readVarint(p[ptr:])
+			rowid, m := readVarint(p[ptr+n:])
+			if n == 0 || m == 0 {
+				return fmt.Errorf("corrupt database: page %d", pgno)
+			}
+			record, err := db.payload(p[ptr+n+m:], size)
+			if err != nil {
+				return err
+			}
+			if err := visit(int64(rowid), record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("corrupt database: page %d isn't a table page", pgno)
+}
+
+// payload gathers a cell's payload of declared bytes, following its
+// overflow pages. The size is checked before it becomes an int, where a
+// large varint would turn negative.
+func (db *sqliteDB) payload(cell []byte, declared uint64) ([]byte, error) {
+	if declared > MaxFileSize {
+		return nil, fmt.Errorf("corrupt database: oversized cell")
+	}
+	size := int(declared)
+	local := localSize(size, db.usable, true)
+	if local > len(cell) {
+		return nil, fmt.Errorf("corrupt database: oversized cell")
+	}
+	out := append(make([]byte, 0, size), cell[:local]...)
+	if local == size {
+		return out, nil
+	}
+	if local+4 > len(cell) {
+		return nil, fmt.Errorf("corrupt database: oversized cell")
+	}
+	next := int(binary.BigEndian.Uint32(cell[local:]))
+	for len(out) < size {
+		if db.visited[next] {
+			return nil, fmt.Errorf("corrupt database: page %d is linked twice", next)
+		}
+		db.visited[next] = true
+		p, err := db.page(next)
+		if err != nil {
+			return nil, err
+		}
+		n := db.usable - 4
+		if rest := size - len(out); rest < n {
+			n = rest
+		}
+		out = append(out, p[4:4+n]...)
+		next = int(binary.BigEndian.Uint32(p))
+	}
+	return out, nil
+}
+
+// decodeRecord returns a record's values as nil, int64, float64, string or
+// []byte.
+func (db *sqliteDB) decodeRecord(record []byte) ([]interface{}, error) {
+	corrupt := fmt.Errorf("corrupt database: bad record")
+	headerSize, n := readVarint(record)
+	if n == 0 || headerSize > uint64(len(record)) {
+		return nil, corrupt
+	}
+	body := record[headerSize:]
+	var values []interface{}
+	for pos := n; pos < int(headerSize); {
+		serial, m := readVarint(record[pos:int(headerSize)])
+		if m == 0 {
+			return nil, corrupt
+		}
+		pos += m
+		size := 0
+		switch {
+		case serial >= 12:
+			size = int((serial - 12) / 2)
+		case serial >= 1 && serial <= 4:
+			size = int(serial)
+		case serial == 5:
+			size = 6
+		case serial == 6 || serial == 7:
+			size = 8
+		}
+		if size > len(body) {
+			return nil, corrupt
+		}
+		v := body[:size]
+		body = body[size:]
+		switch {
+		case serial == 0:
+			values = append(values, nil)
+		case serial <= 6:
+			i := int64(int8(v[0]))
+			for _, b := range v[1:] {
+				i = i<<8 | int64(b)
+			}
+			values = append(values, i)
+		case serial == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(v)))
+		case serial == 8 || serial == 9:
+			values = append(values, int64(serial-8))
+		case serial >= 12 && serial%2 == 0:
+			values = append(values, v)
+		case serial >= 13:
+			values = append(values, db.text(v))
+		default:
+			return nil, corrupt
+		}
+	}
+	return values, nil
+}
+
+// text decodes a TEXT value in the database's encoding.
+func (db *sqliteDB) text(b []byte) string {
+	if db.encoding != 2 && db.encoding != 3 {
+		return string(b)
+	}
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		if db.encoding == 2 {
+			units[i] = binary.LittleEndian.Uint16(b[2*i:])
+		} else {
+			units[i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// tables lists the ordinary tables, leaving out SQLite's own, and says why
+// any others can't be read.
+func (db *sqliteDB) tables() ([]SQLiteTableInfo, []string, error) {
+	var tables []SQLiteTableInfo
+	var problems []string
+	err := db.scan(1, func(_ int64, record []byte) error {
+		values, err := db.decodeRecord(record)
+		if err != nil {
+			return err
+		}
+		if len(values) < 5 || values[0] != "table" {
+			return nil
+		}
+		name, _ := values[1].(string)
+		root, _ := values[3].(int64)
+		sql, _ := values[4].(string)
+		if strings.HasPrefix(name, "sqlite_") || root == 0 {
+			return nil // internal or virtual
+		}
+		cols, rowidCol, err := sqliteTableColumns(sql)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s (%v)", name, err))
+			return nil
+		}
+		tables = append(tables, SQLiteTableInfo{Name: name, Columns: cols, root: int(root), rowidCol: rowidCol})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range tables {
+		db.visited = make(map[int]bool)
+		if err := db.scanPage(tables[i].root, nil, &tables[i].Rows); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(tables) == 0 {
+		if len(problems) > 0 {
+			return nil, nil, fmt.Errorf("no table can be imported: %s", strings.Join(problems, "; "))
+		}
+		return nil, nil, fmt.Errorf("the database has no tables")
+	}
+	return tables, problems, nil
+}
+
+// sqliteTableColumns reads the column names from a CREATE TABLE statement,
+// and which column, if any, is an alias for the rowid.
+func sqliteTableColumns(sql string) ([]string, int, error) {
+	defs, rest := splitSQLDefinitions(sql)
+	if defs == nil {
+		return nil, -1, fmt.Errorf("unreadable schema")
+	}
+	if strings.Contains(strings.ToUpper(rest), "WITHOUT ROWID") {
+		return nil, -1, fmt.Errorf("WITHOUT ROWID tables aren't supported")
+	}
+	var cols, types []string
+	rowidCol, pkCols := -1, []string(nil)
+	for _, def := range defs {
+		if def == "" {
+			continue
+		}
+		name, rest := sqlIdentifier(def)
+		words := strings.Fields(strings.ToUpper(rest))
+		if !strings.ContainsRune("\"'`[", rune(def[0])) {
+			switch strings.ToUpper(name) {
+			case "CONSTRAINT", "UNIQUE", "CHECK", "FOREIGN":
+				continue
+			case "PRIMARY":
+				// PRIMARY KEY (col), which makes an INTEGER col the rowid
+				if open := strings.Index(rest, "("); open != -1 {
+					for _, part := range strings.Split(strings.TrimSuffix(strings.TrimSpace(rest[open+1:]), ")"), ",") {
+						col, _ := sqlIdentifier(strings.TrimSpace(part))
+						pkCols = append(pkCols, col)
+					}
+				}
+				continue
+			}
+		}
+		upper := " " + strings.Join(words, " ") + " "
+		if strings.Contains(upper, " GENERATED ") || strings.Contains(upper, " AS (") || strings.Contains(upper, " AS(") {
+			return nil, -1, fmt.Errorf("generated columns aren't supported")
+		}
+		typ := ""
+		if len(words) > 0 {
+			typ = words[0]
+		}
+		if typ == "INTEGER" && strings.HasPrefix(upper, " INTEGER PRIMARY KEY ") && !strings.HasPrefix(upper, " INTEGER PRIMARY KEY DESC ") {
+			rowidCol = len(cols)
+		}
+		cols, types = append(cols, name), append(types, typ)
+	}
+	if len(pkCols) == 1 && rowidCol == -1 {
+		for i, col := range cols {
+			if strings.EqualFold(col, pkCols[0]) && types[i] == "INTEGER" {
+				rowidCol = i
+			}
+		}
+	}
+	if len(cols) == 0 {
+		return nil, -1, fmt.Errorf("unreadable schema")
+	}
+	return cols, rowidCol, nil
+}
+
+// splitSQLDefinitions splits the parenthesised list of a CREATE TABLE
+// statement at its top-level commas, and returns what follows it.
+func splitSQLDefinitions(sql string) ([]string, string) {
+	var defs []string
+	depth, start := 0, -1
+	for i := 0; i < len(sql); i++ {
+		switch c := sql[i]; c {
+		case '"', '\'', '`', '[':
+			end := byte(c)
+			if c == '[' {
+				end = ']'
+			}
+			j := strings.IndexByte(sql[i+1:], end)
+			if j == -1 {
+				return nil, ""
+			}
+			i += j + 1
+		case '(':
+			depth++
+			if depth == 1 {
+				start = i + 1
+			}
+		case ')':
+			depth--
+			if depth == 0 {
+				if def := strings.TrimSpace(sql[start:i]); def != "" {
+					defs = append(defs, def)
+				}
+				return defs, sql[i+1:]
+			}
+		case ',':
+			if depth == 1 {
+				defs = append(defs, strings.TrimSpace(sql[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return nil, ""
+}
+
+// sqlIdentifier reads the identifier at the start of s, unquoting it, and
+// returns it with the rest of s.
+func sqlIdentifier(s string) (string, string) {
+	if s == "" {
+		return "", ""
+	}
+	if open := s[0]; open == '"' || open == '\'' || open == '`' || open == '[' {
+		end := open
+		if open == '[' {
+			end = ']'
+		}
+		var name strings.Builder
+		for i := 1; i < len(s); i++ {
+			if s[i] != end {
+				name.WriteByte(s[i])
+				continue
+			}
+			if end != ']' && i+1 < len(s) && s[i+1] == end {
+				name.WriteByte(end) // doubled quote
+				i++
+				continue
+			}
+			return name.String(), s[i+1:]
+		}
+		return name.String(), ""
+	}
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '('
+	})
+	if end == -1 {
+		return s, ""
+	}
+	return s[:end], s[end:]
+}
+
+// sqliteCell formats a value for a spreadsheet cell. BLOBs come out as hex.
+func sqliteCell(v interface{}) string {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	case []byte:
+		return hex.EncodeToString(v)
+	}
+	return ""
+}
+
+// processSQLite reads at most limit rows of the named table, or of the
+// first table when name is empty, along with the list of tables.
+func processSQLite(file io.ReaderAt, name string, limit int) (Spreadsheet, []SQLiteTableInfo, error) {
+	var data Spreadsheet
+	db, err := openSQLite(file)
+	if err != nil {
+		return data, nil, err
+	}
+	tables, skipped, err := db.tables()
+	if err != nil {
+		return data, nil, err
+	}
+	table := tables[0]
+	if name != "" {
+		found := false
+		for _, t := range tables {
+			if t.Name == name {
+				table, found = t, true
+				break
+			}
+		}
+		if !found {
+			names := make([]string, len(tables))
+			for i, t := range tables {
+				names[i] = t.Name
+			}
+			return data, tables, fmt.Errorf("no table %q; the database has %s", name, strings.Join(names, ", "))
+		}
+	}
+
+	data.Headers = dedupeHeaders(normalizeHeaders(table.Columns))
+	err = db.scan(table.root, func(rowid int64, record []byte) error {
+		if len(data.Rows) == limit {
+			return errStopScan
+		}
+		values, err := db.decodeRecord(record)
+		if err != nil {
+			return err
+		}
+		row := make([]string, len(table.Columns))
+		for i := range row {
+			if i < len(values) {
+				row[i] = sqliteCell(values[i])
+			}
+		}
+		if table.rowidCol != -1 {
+			row[table.rowidCol] = strconv.FormatInt(rowid, 10)
+		}
+		data.Rows = append(data.Rows, row)
+		return nil
+	})
+	if err != nil {
+		return data, tables, err
+	}
+	if len(tables) > 1 {
+		data.Notes = append(data.Notes, fmt.Sprintf("Imported table %q, one of %d in the database", table.Name, len(tables)))
+	}
+	if len(skipped) > 0 {
+		data.Notes = append(data.Notes, "Can't import "+strings.Join(skipped, "; "))
+	}
+	return data, tables, nil
+}
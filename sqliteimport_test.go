@@ -0,0 +1,163 @@
+// sqliteimport_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testdata/import.sqlite was written by SQLite itself, with 512-byte pages
+// so a few hundred rows need interior pages and overflow chains:
+//
+//	PRAGMA page_size = 512;
+//	CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT, score REAL, photo BLOB, bio TEXT, n INTEGER);
+//	WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < 300)
+//	INSERT INTO people SELECT i, 'name ' || i, i * 1.5, CASE WHEN i % 7 = 0 THEN NULL ELSE x'00ff10' END,
+//	  printf('%.*c', CASE WHEN i % 50 = 1 THEN i * 7 + 600 ELSE i % 20 END, 'b'),
+//	  CASE i % 12 WHEN 0 THEN 0 WHEN 1 THEN 1 WHEN 2 THEN -1 WHEN 3 THEN 127 WHEN 4 THEN -129 WHEN 5 THEN 32768
+//	    WHEN 6 THEN 8388608 WHEN 7 THEN 2147483648 WHEN 8 THEN 1099511627776 WHEN 9 THEN 140737488355328
+//	    WHEN 10 THEN -9223372036854775808 ELSE NULL END
+//	FROM seq;
+//	DELETE FROM people WHERE id % 10 = 0;
+//	CREATE INDEX people_name ON people (name);
+//	CREATE TABLE "odd ""name""" (code INTEGER, label TEXT, PRIMARY KEY (code));
+//	INSERT INTO "odd ""name""" VALUES (5, 'five'), (9, 'nine');
+//	CREATE TABLE keyed (k TEXT PRIMARY KEY, v) WITHOUT ROWID;
+//	INSERT INTO keyed VALUES ('a', 1);
+//
+// testdata/utf16.sqlite is the same with PRAGMA encoding = 'UTF-16le':
+//
+//	CREATE TABLE words (word TEXT, meaning TEXT);
+//	INSERT INTO words VALUES ('Ñandú', 'rhea'), ('日本', 'Japan'), ('🙂', 'smile');
+
+func readTestFile(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// peopleRow is row i of the people table as the import should read it.
+func peopleRow(i int) []string {
+	photo := "00ff10"
+	if i%7 == 0 {
+		photo = ""
+	}
+	bio := i % 20
+	if i%50 == 1 {
+		bio = i*7 + 600
+	}
+	n := []string{"0", "1", "-1", "127", "-129", "32768", "8388608", "2147483648", "1099511627776",
+		"140737488355328", "-9223372036854775808", ""}[i%12]
+	score := fmt.Sprint(float64(i) * 1.5)
+	return []string{fmt.Sprint(i), fmt.Sprint("name ", i), score, photo, strings.Repeat("b", bio), n}
+}
+
+func TestSQLiteImport(t *testing.T) {
+	file := readTestFile(t, "import.sqlite")
+	data, tables, err := processSQLite(bytes.NewReader(file), "", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, tbl := range tables {
+		names = append(names, fmt.Sprintf("%s:%d", tbl.Name, tbl.Rows))
+	}
+	if got := strings.Join(names, " "); got != `people:270 odd "name":2` {
+		t.Errorf("tables = %s", got)
+	}
+	if got := strings.Join(data.Headers, ","); got != "id,name,score,photo,bio,n" {
+		t.Errorf("headers = %s", got)
+	}
+	var want [][]string
+	for i := 1; i <= 300; i++ {
+		if i%10 != 0 {
+			want = append(want, peopleRow(i))
+		}
+	}
+	if len(data.Rows) != len(want) {
+		t.Fatalf("read %d rows, want %d", len(data.Rows), len(want))
+	}
+	for r := range want {
+		if strings.Join(data.Rows[r], "|") != strings.Join(want[r], "|") {
+			t.Fatalf("row %d = %.80q, want %.80q", r, data.Rows[r], want[r])
+		}
+	}
+	if notes := strings.Join(data.Notes, "; "); !strings.Contains(notes, "keyed (WITHOUT ROWID tables aren't supported)") {
+		t.Errorf("notes = %s", notes)
+	}
+}
+
+func TestSQLiteImportTable(t *testing.T) {
+	file := readTestFile(t, "import.sqlite")
+	data, _, err := processSQLite(bytes.NewReader(file), `odd "name"`, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// code is the rowid through the table's PRIMARY KEY clause.
+	if got := fmt.Sprint(data.Headers, data.Rows); got != "[code label] [[5 five] [9 nine]]" {
+		t.Errorf("got %s", got)
+	}
+	if _, _, err := processSQLite(bytes.NewReader(file), "missing", 1000); err == nil {
+		t.Error("want an error for a missing table")
+	}
+	data, _, err = processSQLite(bytes.NewReader(file), "people", 25)
+	if err != nil || len(data.Rows) != 25 {
+		t.Errorf("with a limit of 25 read %d rows, %v", len(data.Rows), err)
+	}
+}
+
+func TestSQLiteImportUTF16(t *testing.T) {
+	data, _, err := processSQLite(bytes.NewReader(readTestFile(t, "utf16.sqlite")), "", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(data.Rows); got != "[[Ñandú rhea] [日本 Japan] [🙂 smile]]" {
+		t.Errorf("rows = %s", got)
+	}
+}
+
+func TestSQLiteImportCorrupt(t *testing.T) {
+	good := readTestFile(t, "import.sqlite")
+	damage := map[string]func(b []byte) []byte{
+		"not sqlite": func(b []byte) []byte { return append([]byte("SQLite format 2\x00"), b[16:]...) },
+		"bad page size": func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[16:], 300)
+			return b
+		},
+		"truncated": func(b []byte) []byte { return b[:len(b)/2] },
+		// people's root, page 2, is an interior page; point its right-most
+		// child back at itself.
+		"cycle": func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[512+8:], 2)
+			return b
+		},
+		"bad child": func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[512+8:], 1<<20)
+			return b
+		},
+		// The first row's payload length becomes the largest 9-byte varint,
+		// which is negative as an int.
+		"huge payload": func(b []byte) []byte {
+			page := b[512:1024]
+			for page[0] == 0x05 { // interior: follow the first child
+				child := int(binary.BigEndian.Uint32(page[binary.BigEndian.Uint16(page[12:]):]))
+				page = b[(child-1)*512 : child*512]
+			}
+			copy(page[binary.BigEndian.Uint16(page[8:]):], bytes.Repeat([]byte{0xFF}, 9))
+			return b
+		},
+	}
+	for name, fn := range damage {
+		file := fn(bytes.Clone(good))
+		if _, _, err := processSQLite(bytes.NewReader(file), "people", 1000); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+// state.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replicas share sessions, datasets, the current dataset, locks, memoized
+// calculations and rate-limit counters through a StateBackend, picked by
+// STATE_BACKEND:
+//
+//	memory (default)         this process only
+//	file:///path or /path    a directory every replica mounts (NFS, EFS, ...)
+//	redis://[:pw@]host[:port][/db]
+//	postgres://user:pw@host[:port]/db[?sslmode=...]
+//
+// Everything else (workspaces, reports, alerts, keys, mappings, dashboards,
+// upload accounting) already lives in files under DATA_DIR; with a shared
+// backend, point DATA_DIR at the same volume and each replica reloads those
+// files when another one changes them. Postgres keeps those files itself, as
+// a documentStore.
+
+var errStateMissing = errors.New("no such key")
+
+type StateBackend interface {
+	Get(key string) ([]byte, error)                        // errStateMissing when absent or expired
+	Set(key string, value []byte, ttl time.Duration) error // 0 keeps it forever
+	Delete(key string) error
+	Keys(prefix string) ([]string, error)
+	// Acquire takes key for token, or extends it when token already holds
+	// it. It reports false when someone else does.
+	Acquire(key, token string, ttl time.Duration) (bool, error)
+	Release(key, token string) error
+	// Incr adds one to a counter and returns the new count. A counter
+	// that doesn't exist starts at zero and expires after ttl.
+	Incr(key string, ttl time.Duration) (int64, error)
+}
+
+var state, stateShared = openStateBackend(config.StateBackend)
+
+func openStateBackend(spec string) (StateBackend, bool) {
+	switch {
+	case spec == "memory":
+		return newMemoryState(), false
+	case strings.HasPrefix(spec, "redis://"), strings.HasPrefix(spec, "rediss://"):
+		b, err := newRedisState(spec)
+		if err != nil {
+			log.Fatalf("STATE_BACKEND: %v", err)
+		}
+		return b, true
+	case strings.HasPrefix(spec, "postgres://"), strings.HasPrefix(spec, "postgresql://"):
+		b, err := newPostgresState(spec)
+		if err != nil {
+			log.Fatalf("STATE_BACKEND: %v", err)
+		}
+		return b, true
+	case strings.HasPrefix(spec, "file://"), strings.HasPrefix(spec, "/"):
+		dir := spec
+		if u, err := url.Parse(spec); err == nil && u.Scheme == "file" {
+			dir = u.Path
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			log.Fatalf("STATE_BACKEND: %v", err)
+		}
+		return &dirState{dir: dir}, true
+	}
+	log.Fatalf("STATE_BACKEND: unsupported backend %q", spec)
+	return nil, false
+}
+
+// lockShared takes the named lock, waiting up to wait for it. The lock
+// expires after ttl should the holder die. Release it with the returned func.
+func lockShared(name string, ttl, wait time.Duration) (func(), error) {
+	token := newID()
+	deadline := time.Now().Add(wait)
+	for delay := 5 * time.Millisecond; ; delay *= 2 {
+		ok, err := state.Acquire("lock/"+name, token, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return func() {
+				if err := state.Release("lock/"+name, token); err != nil {
+					log.Printf("Could not release lock %s: %v", name, err)
+				}
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is locked by another request; try again", name)
+		}
+		if delay > 200*time.Millisecond {
+			delay = 200 * time.Millisecond
+		}
+		time.Sleep(delay)
+	}
+}
+
+// instanceID names this process when it holds a lease.
+var instanceID = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), newID())
+}()
+
+// isLeader reports whether this replica holds the lease for a background
+// job, taking or renewing it as a side effect. Call it at least every ttl/2.
+func isLeader(job string, ttl time.Duration) bool {
+	ok, err := state.Acquire("leader/"+job, instanceID, ttl)
+	if err != nil {
+		log.Printf("Could not check the %s lease: %v", job, err)
+		return false
+	}
+	return ok
+}
+
+// getStateJSON and setStateJSON store JSON values.
+func getStateJSON(key string, v interface{}) error {
+	b, err := state.Get(key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func setStateJSON(key string, v interface{}, ttl time.Duration) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return state.Set(key, b, ttl)
+}
+
+// memoryState is the single-process backend.
+type memoryState struct {
+	mu     sync.Mutex
+	values map[string]memoryValue
+	sets   int
+}
+
+type memoryValue struct {
+	data    []byte
+	expires time.Time
+}
+
+func (v memoryValue) expired(now time.Time) bool {
+	return !v.expires.IsZero() && now.After(v.expires)
+}
+
+func newMemoryState() *memoryState {
+	return &memoryState{values: make(map[string]memoryValue)}
+}
+
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+func (m *memoryState) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.values[key]
+	if !ok || v.expired(time.Now()) {
+		delete(m.values, key)
+		return nil, errStateMissing
+	}
+	return v.data, nil
+}
+
+func (m *memoryState) Set(key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = memoryValue{data: value, expires: expiry(ttl)}
+	m.sweep()
+	return nil
+}
+
+// sweep drops expired values every so often, since cache entries and
+// counters are mostly never read again. It must be called with the lock held.
+func (m *memoryState) sweep() {
+	if m.sets++; m.sets < 1000 {
+		return
+	}
+	m.sets = 0
+	now := time.Now()
+	for k, v := range m.values {
+		if v.expired(now) {
+			delete(m.values, k)
+		}
+	}
+}
+
+func (m *memoryState) Incr(key string, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.values[key]
+	var n int64
+	if ok && !v.expired(time.Now()) {
+		n, _ = strconv.ParseInt(string(v.data), 10, 64)
+	} else {
+		v = memoryValue{expires: expiry(ttl)}
+		m.sweep()
+	}
+	n++
+	v.data = []byte(strconv.FormatInt(n, 10))
+	m.values[key] = v
+	return n, nil
+}
+
+func (m *memoryState) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, key)
+	return nil
+}
+
+func (m *memoryState) Keys(prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var keys []string
+	for k, v := range m.values {
+		if v.expired(now) {
+			delete(m.values, k)
+		} else if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *memoryState) Acquire(key, token string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok := m.values[key]; ok && !v.expired(time.Now()) && string(v.data) != token {
+		return false, nil
+	}
+	m.values[key] = memoryValue{data: []byte(token), expires: expiry(ttl)}
+	return true, nil
+}
+
+func (m *memoryState) Release(key, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok := m.values[key]; ok && string(v.data) == token {
+		delete(m.values, key)
+	}
+	return nil
+}
+
+// dirState keeps one file per key in a shared directory. Expiry is stored in
+// the file's modification time, which every replica sees the same way; locks
+// rely on O_EXCL, which NFSv3 and later honour.
+type dirState struct {
+	dir string
+}
+
+func (d *dirState) path(key string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(key))
+}
+
+func (d *dirState) expired(info os.FileInfo) bool {
+	mt := info.ModTime()
+	return mt.Year() > 2000 && time.Now().After(mt)
+}
+
+func (d *dirState) Get(key string) ([]byte, error) {
+	p := d.path(key)
+	info, err := os.Stat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errStateMissing
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d.expired(info) {
+		os.Remove(p)
+		return nil, errStateMissing
+	}
+	b, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errStateMissing
+	}
+	return b, err
+}
+
+// setExpiry stamps the expiry on a file; files that never expire get a 1970
+// timestamp.
+func (d *dirState) setExpiry(p string, ttl time.Duration) error {
+	at := time.Unix(0, 0)
+	if ttl > 0 {
+		at = time.Now().Add(ttl)
+	}
+	return os.Chtimes(p, at, at)
+}
+
+func (d *dirState) Set(key string, value []byte, ttl time.Duration) error {
+	p := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp := p + "." + newID() + ".tmp"
+	if err := os.WriteFile(tmp, value, 0o644); err != nil {
+		return err
+	}
+	if err := d.setExpiry(tmp, ttl); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (d *dirState) Delete(key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d *dirState) Keys(prefix string) ([]string, error) {
+	var keys []string
+	root := d.path(prefix[:strings.LastIndex(prefix, "/")+1])
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+		rel, _ := filepath.Rel(d.dir, p)
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		if d.expired(info) {
+			os.Remove(p)
+			return nil
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (d *dirState) Acquire(key, token string, ttl time.Duration) (bool, error) {
+	p := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return false, err
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			_, err = f.WriteString(token)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				err = d.setExpiry(p, ttl)
+			}
+			if err != nil {
+				os.Remove(p)
+				return false, err
+			}
+			return true, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return false, err
+		}
+		held, err := d.Get(key)
+		if errors.Is(err, errStateMissing) {
+			continue // expired or just released: try again
+		}
+		if err != nil {
+			return false, err
+		}
+		if string(held) != token {
+			return false, nil
+		}
+		return true, d.setExpiry(p, ttl)
+	}
+	return false, nil
+}
+
+// Incr serializes on a lock file, as a shared directory has no atomic
+// read-modify-write.
+func (d *dirState) Incr(key string, ttl time.Duration) (int64, error) {
+	token := newID()
+	for i := 0; ; i++ {
+		ok, err := d.Acquire(key+".lock", token, 5*time.Second)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			break
+		}
+		if i == 200 {
+			return 0, fmt.Errorf("counter %s is locked", key)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	defer d.Release(key+".lock", token)
+	var n int64
+	p := d.path(key)
+	b, err := d.Get(key)
+	switch {
+	case err == nil:
+		n, _ = strconv.ParseInt(string(b), 10, 64)
+	case !errors.Is(err, errStateMissing):
+		return 0, err
+	}
+	n++
+	if n == 1 {
+		return n, d.Set(key, []byte("1"), ttl)
+	}
+	// Keep the expiry the counter started with.
+	info, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.WriteFile(p, []byte(strconv.FormatInt(n, 10)), 0o644); err != nil {
+		return 0, err
+	}
+	return n, os.Chtimes(p, info.ModTime(), info.ModTime())
+}
+
+func (d *dirState) Release(key, token string) error {
+	held, err := d.Get(key)
+	if errors.Is(err, errStateMissing) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if string(held) != token {
+		return nil
+	}
+	return d.Delete(key)
+}
+
+// watchDataFile calls reload whenever another replica rewrites path. It does
+// nothing unless the state backend is shared.
+func watchDataFile(path string, reload func()) {
+	if !stateShared {
+		return
+	}
+	go func() {
+		last := dataModTime(path)
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if mt := dataModTime(path); !mt.Equal(last) {
+				last = mt
+				reload()
+			}
+		}
+	}()
+}
+
+func dataModTime(path string) time.Time {
+	if docs, name, ok := dataDocument(path); ok {
+		t, err := docs.DocumentUpdated(name)
+		if err != nil {
+			log.Printf("Could not check %s: %v", name, err)
+		}
+		return t
+	}
+	return fileModTime(path)
+}
+
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// documentStore is implemented by backends that keep the JSON files under
+// DATA_DIR themselves; readJSONFile and writeJSONFile go through it.
+type documentStore interface {
+	ReadDocument(name string) ([]byte, error) // errStateMissing when absent
+	WriteDocument(name string, body []byte) error
+	DocumentUpdated(name string) (time.Time, error)
+}
+
+// dataDocument names the document for a path under DATA_DIR, if the state
+// backend keeps documents.
+func dataDocument(path string) (documentStore, string, bool) {
+	docs, ok := state.(documentStore)
+	if !ok {
+		return nil, "", false
+	}
+	rel, err := filepath.Rel(config.DataDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, "", false
+	}
+	return docs, filepath.ToSlash(rel), true
+}
@@ -0,0 +1,100 @@
+// stream.go
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const streamFlushRows = 500
+
+// datasetStreamAPIHandler writes every row of a dataset as CSV or NDJSON
+// (one object per row, keyed by header), flushing every streamFlushRows
+// rows so the response goes out chunked instead of being built in memory.
+// The rows are those of the version current when the request started.
+func datasetStreamAPIHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := teamDataset(r, r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Unknown dataset")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	var writeRow func(row []string) error
+	flushFormat := func() {}
+	out := bufio.NewWriter(w)
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, exportBaseName(data.FileName)))
+		cw := csv.NewWriter(out)
+		cells := make([]string, len(data.Headers))
+		writeRow = func(row []string) error {
+			for i := range cells {
+				cells[i] = cellValue(row, i)
+			}
+			return cw.Write(cells)
+		}
+		flushFormat = cw.Flush
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		keys := make([][]byte, len(data.Headers))
+		for i, h := range data.Headers {
+			keys[i], _ = json.Marshal(h)
+		}
+		writeRow = func(row []string) error {
+			out.WriteByte('{')
+			for i, key := range keys {
+				if i > 0 {
+					out.WriteByte(',')
+				}
+				value, _ := json.Marshal(cellValue(row, i))
+				out.Write(key)
+				out.WriteByte(':')
+				out.Write(value)
+			}
+			_, err := out.WriteString("}\n")
+			return err
+		}
+	default:
+		writeAPIError(w, http.StatusBadRequest, "format must be csv or ndjson")
+		return
+	}
+	accessLog.Record(r, data.ID, "export", "stream as "+format)
+	w.Header().Set("ETag", strconv.Quote(strconv.Itoa(data.Version)))
+	w.Header().Set("X-Total-Rows", strconv.Itoa(len(data.Rows)))
+
+	flusher := http.NewResponseController(w)
+	flush := func() error {
+		flushFormat()
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		if err := flusher.Flush(); err != nil && err != http.ErrNotSupported {
+			return err
+		}
+		return r.Context().Err()
+	}
+	if format == "csv" {
+		if err := writeRow(data.Headers); err != nil {
+			return
+		}
+	}
+	for i, row := range data.Rows {
+		if err := writeRow(row); err != nil {
+			return
+		}
+		if (i+1)%streamFlushRows == 0 {
+			if err := flush(); err != nil {
+				return // client went away
+			}
+		}
+	}
+	flush()
+}
@@ -0,0 +1,376 @@
+// teams.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Team is a shared workspace: datasets and mapping templates belong to one,
+// and members hold a viewer, editor or admin role in it. The UI and API call
+// teams "workspaces"; in code that name is taken by the dataset registry.
+type Team struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Members   map[string]string `json:"members"` // owner ID -> role
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// defaultTeamID is the shared workspace every signed-in user can see, with
+// their sign-on role. Data from before teams existed lives here.
+const defaultTeamID = "default"
+
+type TeamStore struct {
+	mu    sync.RWMutex
+	path  string
+	teams map[string]Team
+}
+
+var teams = newTeamStore(dataPath("teams.json"))
+
+func newTeamStore(path string) *TeamStore {
+	s := &TeamStore{path: path, teams: make(map[string]Team)}
+	s.load()
+	watchDataFile(path, s.load)
+	return s
+}
+
+// load reads the workspaces file, replacing what is in memory. The shared
+// workspace always exists.
+func (s *TeamStore) load() {
+	var list []Team
+	if err := readJSONFile(s.path, &list); err != nil {
+		log.Printf("Could not load workspaces: %v", err)
+		if _, ok := s.Get(defaultTeamID); ok {
+			return
+		}
+	}
+	teams := make(map[string]Team)
+	for _, t := range list {
+		teams[t.ID] = t
+	}
+	if _, ok := teams[defaultTeamID]; !ok {
+		teams[defaultTeamID] = Team{ID: defaultTeamID, Name: "Shared", Members: map[string]string{}}
+	}
+	s.mu.Lock()
+	s.teams = teams
+	s.mu.Unlock()
+}
+
+func (s *TeamStore) Get(id string) (Team, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.teams[id]
+	return t, ok
+}
+
+func (s *TeamStore) Save(t Team) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.teams[t.ID] = t
+	return s.flush()
+}
+
+// flush must be called with the lock held.
+func (s *TeamStore) flush() error {
+	list := make([]Team, 0, len(s.teams))
+	for _, t := range s.teams {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return writeJSONFile(s.path, list)
+}
+
+// RoleOf returns u's role in team t, or "" if u is not a member. API keys
+// never exceed the role they were issued with.
+func (t Team) RoleOf(u *User) string {
+	if u == nil {
+		return ""
+	}
+	var role string
+	switch {
+	case u.Via == "anonymous":
+		return RoleAdmin
+	case u.Via == "oidc" && u.Role == RoleAdmin:
+		return RoleAdmin
+	case t.ID == defaultTeamID:
+		role = u.Role
+	default:
+		role = t.Members[ownerID(u)]
+	}
+	if u.Via == "apikey" && roleRank[role] > roleRank[u.Role] {
+		role = u.Role
+	}
+	return role
+}
+
+// ForUser lists the teams u belongs to, the shared one first.
+func (s *TeamStore) ForUser(u *User) []Team {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []Team
+	for _, t := range s.teams {
+		if t.RoleOf(u) != "" {
+			list = append(list, t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if (list[i].ID == defaultTeamID) != (list[j].ID == defaultTeamID) {
+			return list[i].ID == defaultTeamID
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+type teamKey struct{}
+
+const teamCookie = "dr_workspace"
+
+// currentTeam is the workspace the request acts in.
+func currentTeam(r *http.Request) Team {
+	if t, ok := r.Context().Value(teamKey{}).(Team); ok {
+		return t
+	}
+	t, _ := teams.Get(defaultTeamID)
+	return t
+}
+
+// withTeam scopes r to team t, replacing the user's role with their role in
+// that team so requireRole checks the right thing.
+func withTeam(r *http.Request, u *User, t Team) *http.Request {
+	scoped := *u
+	scoped.Role = t.RoleOf(u)
+	ctx := context.WithValue(r.Context(), userKey{}, &scoped)
+	ctx = context.WithValue(ctx, baseUserKey{}, u)
+	return r.WithContext(context.WithValue(ctx, teamKey{}, t))
+}
+
+type baseUserKey struct{}
+
+// accountUser is the caller with their sign-on role, before any workspace
+// scoping; membership checks start from this.
+func accountUser(r *http.Request) *User {
+	if u, ok := r.Context().Value(baseUserKey{}).(*User); ok {
+		return u
+	}
+	return currentUser(r)
+}
+
+// selectTeam picks the workspace from the X-Workspace header or the switcher
+// cookie. An explicit header the user can't use is an error; a stale cookie
+// just falls back to the shared workspace.
+func selectTeam(r *http.Request, u *User) (Team, error) {
+	if id := r.Header.Get("X-Workspace"); id != "" {
+		t, ok := teams.Get(id)
+		if !ok || t.RoleOf(u) == "" {
+			return Team{}, fmt.Errorf("no access to workspace %q", id)
+		}
+		return t, nil
+	}
+	if c, err := r.Cookie(teamCookie); err == nil {
+		if t, ok := teams.Get(c.Value); ok && t.RoleOf(u) != "" {
+			return t, nil
+		}
+	}
+	t, _ := teams.Get(defaultTeamID)
+	return t, nil
+}
+
+// inTeam serves workspace-scoped API routes (/api/v1/workspaces/{ws}/...).
+func inTeam(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := accountUser(r)
+		t, ok := teams.Get(r.PathValue("ws"))
+		if !ok || t.RoleOf(u) == "" {
+			writeAPIError(w, http.StatusNotFound, "Unknown workspace")
+			return
+		}
+		next(w, withTeam(r, u, t))
+	}
+}
+
+// teamDataset fetches a dataset visible in the request's workspace. Through
+// a share link, only the link's redacted dataset is.
+func teamDataset(r *http.Request, id string) (Spreadsheet, bool) {
+	if shared, ok := r.Context().Value(sharedDatasetKey{}).(Spreadsheet); ok {
+		return shared, shared.ID == id
+	}
+	data, ok := workspace.Get(id)
+	if !ok || datasetTeam(data) != currentTeam(r).ID {
+		return Spreadsheet{}, false
+	}
+	return data, true
+}
+
+// activeDataset is the dataset the request's upload session last showed on
+// the display page in the request's workspace (see uploads.go).
+func activeDataset(r *http.Request) Spreadsheet {
+	return uploads.Current(r)
+}
+
+func datasetTeam(data Spreadsheet) string {
+	if data.Team == "" {
+		return defaultTeamID
+	}
+	return data.Team
+}
+
+type TeamSummary struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Role    string `json:"role"`
+	Members int    `json:"members"`
+	Current bool   `json:"current"`
+}
+
+func teamSummaries(r *http.Request) []TeamSummary {
+	u := accountUser(r)
+	current := currentTeam(r).ID
+	var list []TeamSummary
+	for _, t := range teams.ForUser(u) {
+		list = append(list, TeamSummary{ID: t.ID, Name: t.Name, Role: t.RoleOf(u), Members: len(t.Members), Current: t.ID == current})
+	}
+	return list
+}
+
+func createTeam(u *User, name string) (Team, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Team{}, fmt.Errorf("a workspace name is required")
+	}
+	owner := ownerID(u)
+	t := Team{ID: newID(), Name: name, Members: map[string]string{}, CreatedAt: time.Now()}
+	if owner != "" {
+		t.Members[owner] = RoleAdmin
+	}
+	return t, teams.Save(t)
+}
+
+func workspacesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		t, err := createTeam(currentUser(r), req.Name)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeAPIData(w, r, t)
+		return
+	}
+	writeAPIData(w, r, teamSummaries(r))
+}
+
+// teamsHandler is the workspace page: switch, create, and manage members.
+func teamsHandler(w http.ResponseWriter, r *http.Request) {
+	u := accountUser(r)
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		switch r.FormValue("action") {
+		case "switch":
+			t, ok := teams.Get(r.FormValue("workspace"))
+			if !ok || t.RoleOf(u) == "" {
+				http.Error(w, "Unknown workspace", http.StatusNotFound)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: teamCookie, Value: t.ID, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+			http.Redirect(w, r, safeNext(r.FormValue("next")), http.StatusSeeOther)
+			return
+		case "create":
+			t, err := createTeam(u, r.FormValue("name"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: teamCookie, Value: t.ID, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		case "member":
+			t := currentTeam(r)
+			if t.RoleOf(u) != RoleAdmin || t.ID == defaultTeamID {
+				http.Error(w, "Only workspace admins can manage members", http.StatusForbidden)
+				return
+			}
+			member := strings.TrimSpace(r.FormValue("member"))
+			role := r.FormValue("role")
+			if member == "" {
+				http.Error(w, "Member is required", http.StatusBadRequest)
+				return
+			}
+			if role == "remove" {
+				delete(t.Members, member)
+			} else if validRole(role) {
+				t.Members[member] = role
+			} else {
+				http.Error(w, "Invalid role", http.StatusBadRequest)
+				return
+			}
+			if err := teams.Save(t); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to save workspace: %v", err), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "Invalid action", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/workspaces", http.StatusSeeOther)
+		return
+	}
+
+	current := currentTeam(r)
+	list := ReportSection{Title: "Your Workspaces", Headers: []string{"Workspace", "Your Role", "Members", ""}}
+	var options []FormOption
+	for _, t := range teamSummaries(r) {
+		marker := ""
+		if t.Current {
+			marker = "✔ current"
+		}
+		list.Rows = append(list.Rows, []string{t.Name, t.Role, fmt.Sprint(t.Members), marker})
+		options = append(options, FormOption{Value: t.ID, Label: t.Name, Selected: t.Current})
+	}
+	sections := []ReportSection{
+		list,
+		{Title: "Switch Workspace", Form: &ReportForm{Action: "/workspaces", Submit: "🔀 Switch", Fields: []FormField{
+			{Name: "action", Type: "hidden", Value: "switch"},
+			{Name: "next", Type: "hidden", Value: "/"},
+			{Name: "workspace", Label: "Workspace", Type: "select", Options: options},
+		}}},
+		{Title: "New Workspace", Form: &ReportForm{Action: "/workspaces", Submit: "➕ Create", Fields: []FormField{
+			{Name: "action", Type: "hidden", Value: "create"},
+			{Name: "name", Label: "Name", Placeholder: "Finance team"},
+		}}},
+	}
+	if current.ID != defaultTeamID && current.RoleOf(u) == RoleAdmin {
+		members := ReportSection{Title: "Members of " + current.Name, Headers: []string{"Member", "Role"}}
+		ids := make([]string, 0, len(current.Members))
+		for id := range current.Members {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			members.Rows = append(members.Rows, []string{id, current.Members[id]})
+		}
+		roleOptions := []FormOption{{Value: RoleViewer, Label: "viewer", Selected: true}, {Value: RoleEditor, Label: "editor"}, {Value: RoleAdmin, Label: "admin"}, {Value: "remove", Label: "remove from workspace"}}
+		members.Form = &ReportForm{Action: "/workspaces", Submit: "👥 Update Member", Fields: []FormField{
+			{Name: "action", Type: "hidden", Value: "member"},
+			{Name: "member", Label: "Member email", Placeholder: "someone@example.com"},
+			{Name: "role", Label: "Role", Type: "select", Options: roleOptions},
+		}}
+		sections = append(sections, members)
+	}
+	renderReport(w, ReportPage{Title: "Workspaces", Subtitle: "Current: " + current.Name, Sections: sections})
+}
@@ -8,6 +8,14 @@ import (
 
 var templateFuncs = template.FuncMap{
 	"add": func(a, b int) int { return a + b },
+	"sub": func(a, b int) int { return a - b },
+	"seq": func(n int) []int {
+		s := make([]int, n)
+		for i := range s {
+			s[i] = i
+		}
+		return s
+	},
 	"contains": func(slice []int, item int) bool {
 		for _, s := range slice {
 			if s == item {
@@ -35,4 +43,5 @@ var templateFuncs = template.FuncMap{
 
 var uploadTemplate = template.Must(template.New("upload.html").Funcs(templateFuncs).ParseFiles("upload.html"))
 var displayTemplate = template.Must(template.New("display.html").Funcs(templateFuncs).ParseFiles("display.html"))
-var resultTemplate = template.Must(template.New("results.html").Funcs(templateFuncs).ParseFiles("results.html"))
\ No newline at end of file
+var resultTemplate = template.Must(template.New("results.html").Funcs(templateFuncs).ParseFiles("results.html"))
+var reportTemplate = template.Must(template.New("report.html").Funcs(templateFuncs).ParseFiles("report.html"))
\ No newline at end of file
@@ -0,0 +1,223 @@
+// textstats.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	textTopN          = 20
+	maxTextPatternLen = 200
+)
+
+// TextStats profiles a column as text, whatever its type.
+type TextStats struct {
+	Values      int // non-blank cells
+	Blank       int
+	Whitespace  int // cells holding only spaces or tabs
+	Distinct    int
+	MinLength   int
+	MaxLength   int
+	MeanLength  float64
+	Longest     string
+	Tokens      []TextCount
+	Prefixes    []TextCount
+	Suffixes    []TextCount
+	Shapes      []TextCount
+	RegexCount  int
+	RegexSample []string
+}
+
+type TextCount struct {
+	Text  string
+	Count int
+}
+
+var textTokenPattern = regexp.MustCompile(`[\p{L}\p{N}]+(?:['’][\p{L}]+)?`)
+
+// textShape replaces digits with 9 and letters with A (a for lower case), so
+// reference numbers like INV-00123 and INV-00456 share the shape AAA-99999.
+func textShape(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsDigit(r):
+			return '9'
+		case unicode.IsUpper(r):
+			return 'A'
+		case unicode.IsLetter(r):
+			return 'a'
+		}
+		return r
+	}, s)
+}
+
+func topCounts(counts map[string]int, n int) []TextCount {
+	list := make([]TextCount, 0, len(counts))
+	for text, count := range counts {
+		list = append(list, TextCount{text, count})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Text < list[j].Text
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// textStats profiles col. affix is the prefix and suffix length; re, when
+// set, is counted against every non-blank value.
+func textStats(data Spreadsheet, col, affix int, re *regexp.Regexp) TextStats {
+	var s TextStats
+	tokens, prefixes, suffixes, shapes := map[string]int{}, map[string]int{}, map[string]int{}, map[string]int{}
+	distinct := map[string]bool{}
+	totalLen := 0
+	for _, row := range data.Rows {
+		raw := ""
+		if col < len(row) {
+			raw = row[col]
+		}
+		v := strings.TrimSpace(raw)
+		switch {
+		case raw == "":
+			s.Blank++
+			continue
+		case v == "":
+			s.Whitespace++
+			continue
+		}
+		s.Values++
+		distinct[v] = true
+		n := utf8.RuneCountInString(v)
+		totalLen += n
+		if s.Values == 1 || n < s.MinLength {
+			s.MinLength = n
+		}
+		if n > s.MaxLength {
+			s.MaxLength, s.Longest = n, v
+		}
+		for _, tok := range textTokenPattern.FindAllString(strings.ToLower(v), -1) {
+			tokens[tok]++
+		}
+		runes := []rune(v)
+		if len(runes) >= affix {
+			prefixes[string(runes[:affix])]++
+			suffixes[string(runes[len(runes)-affix:])]++
+		}
+		shapes[textShape(v)]++
+		if re != nil && re.MatchString(v) {
+			s.RegexCount++
+			if len(s.RegexSample) < 5 {
+				s.RegexSample = append(s.RegexSample, v)
+			}
+		}
+	}
+	s.Distinct = len(distinct)
+	if s.Values > 0 {
+		s.MeanLength = float64(totalLen) / float64(s.Values)
+	}
+	s.Tokens = topCounts(tokens, textTopN)
+	s.Prefixes = topCounts(prefixes, textTopN)
+	s.Suffixes = topCounts(suffixes, textTopN)
+	s.Shapes = topCounts(shapes, textTopN)
+	return s
+}
+
+func textCountSection(title, label string, counts []TextCount, of int) ReportSection {
+	section := ReportSection{Title: title, Headers: []string{label, "Count", "Share"}}
+	for _, c := range counts {
+		share := "–"
+		if of > 0 {
+			share = formatStat(float64(c.Count)*100/float64(of)) + "%"
+		}
+		section.Rows = append(section.Rows, []string{c.Text, strconv.Itoa(c.Count), share})
+	}
+	if len(counts) == 0 {
+		section.Notes = []string{"Nothing to show."}
+	}
+	return section
+}
+
+// textStatsHandler reports length, token, prefix/suffix and pattern
+// statistics for one column treated as text.
+func textStatsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	data := activeDataset(r)
+	if id := q.Get("dataset"); id != "" {
+		var ok bool
+		if data, ok = teamDataset(r, id); !ok {
+			http.Error(w, "Unknown dataset", http.StatusNotFound)
+			return
+		}
+	}
+	if len(data.Headers) == 0 {
+		http.Error(w, "No dataset loaded", http.StatusBadRequest)
+		return
+	}
+	col := columnRef(data, q.Get("column"))
+	if col == -1 {
+		http.Error(w, "Unknown column", http.StatusBadRequest)
+		return
+	}
+	affix := 3
+	if v := q.Get("affix"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 20 {
+			http.Error(w, "affix must be between 1 and 20 characters", http.StatusBadRequest)
+			return
+		}
+		affix = n
+	}
+	var re *regexp.Regexp
+	if pattern := q.Get("regex"); pattern != "" {
+		if len(pattern) > maxTextPatternLen {
+			http.Error(w, fmt.Sprintf("regex must be at most %d characters", maxTextPatternLen), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid regex: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s := textStats(data, col, affix, re)
+	summary := ReportSection{Title: "Summary", Headers: []string{"Measure", "Value"}, Rows: [][]string{
+		{"Non-blank values", strconv.Itoa(s.Values)},
+		{"Blank cells", strconv.Itoa(s.Blank)},
+		{"Whitespace-only cells", strconv.Itoa(s.Whitespace)},
+		{"Distinct values", strconv.Itoa(s.Distinct)},
+		{"Average length", fmt.Sprintf("%.1f", s.MeanLength)},
+		{"Shortest length", strconv.Itoa(s.MinLength)},
+		{"Longest length", strconv.Itoa(s.MaxLength)},
+		{"Longest value", s.Longest},
+	}}
+	sections := []ReportSection{summary}
+	if re != nil {
+		match := ReportSection{Title: "Regex Matches", Notes: []string{fmt.Sprintf("%d of %d value(s) match %s.", s.RegexCount, s.Values, re.String())}}
+		for _, v := range s.RegexSample {
+			match.Rows = append(match.Rows, []string{v})
+		}
+		if len(match.Rows) > 0 {
+			match.Headers = []string{"Example"}
+		}
+		sections = append(sections, match)
+	}
+	sections = append(sections,
+		textCountSection("Most Common Tokens", "Token", s.Tokens, 0),
+		textCountSection("Patterns", "Shape (9 = digit, A/a = letter)", s.Shapes, s.Values),
+		textCountSection(fmt.Sprintf("Common %d-Character Prefixes", affix), "Prefix", s.Prefixes, s.Values),
+		textCountSection(fmt.Sprintf("Common %d-Character Suffixes", affix), "Suffix", s.Suffixes, s.Values),
+	)
+	renderReport(w, ReportPage{Title: "Text Profile of " + data.Headers[col], Subtitle: data.FileName, Sections: sections})
+}
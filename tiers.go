@@ -0,0 +1,51 @@
+// tiers.go
+package main
+
+import "fmt"
+
+// A dataset's tier follows from its row count. Up to config.InteractiveRows
+// it is interactive: the table is shown and scrolled. Above that, up to the
+// hard cap config.MaxRows, it is analysis-only: profiles, calculations and
+// exports work as usual, but the page shows no table rows and the row
+// window isn't served. Files past the cap are refused.
+type RowTier string
+
+const (
+	TierInteractive RowTier = "interactive"
+	TierAnalysis    RowTier = "analysis-only"
+)
+
+func rowTier(rows int) RowTier {
+	if config.InteractiveRows > 0 && rows > config.InteractiveRows {
+		return TierAnalysis
+	}
+	return TierInteractive
+}
+
+func datasetTier(data Spreadsheet) RowTier {
+	return rowTier(len(data.Rows))
+}
+
+// checkRowLimit refuses a dataset past the hard cap.
+func checkRowLimit(rows int) error {
+	if rows > config.MaxRows {
+		return fmt.Errorf("too many rows (> %d); files up to %d rows are interactive and up to %d can be analysed without the table",
+			config.MaxRows, config.InteractiveRows, config.MaxRows)
+	}
+	return nil
+}
+
+// parseRowLimit is what parsers are asked to stop at: one past the cap, so
+// checkRowLimit can tell a file that reached it from one that went over.
+func parseRowLimit() int {
+	return config.MaxRows + 1
+}
+
+// tierNote explains an analysis-only dataset to the user, or is empty.
+func tierNote(data Spreadsheet) string {
+	if datasetTier(data) != TierAnalysis {
+		return ""
+	}
+	return fmt.Sprintf("Analysis-only mode: %d rows is over the %d shown as a table. Column profiles, calculations and exports cover every row; "+
+		"filter or slice the data to %d rows or fewer to browse it.", len(data.Rows), config.InteractiveRows, config.InteractiveRows)
+}
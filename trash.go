@@ -0,0 +1,163 @@
+// trash.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type TrashEntry struct {
+	DatasetSummary
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy string    `json:"deleted_by,omitempty"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+// teamTrash lists the trashed datasets belonging to the request's workspace.
+func teamTrash(r *http.Request) []TrashedDataset {
+	team := currentTeam(r).ID
+	var list []TrashedDataset
+	for _, t := range workspace.Trash() {
+		if datasetTeam(t.Data) == team {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+func trashedInTeam(r *http.Request, id string) bool {
+	t, ok := workspace.GetTrashed(id)
+	return ok && datasetTeam(t.Data) == currentTeam(r).ID
+}
+
+// trashDataset soft-deletes id if it belongs to the request's workspace.
+func trashDataset(r *http.Request, id string) bool {
+	if _, ok := teamDataset(r, id); !ok || !workspace.Delete(id, ownerID(currentUser(r))) {
+		return false
+	}
+	return true
+}
+
+func deleteDatasetAPIHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !trashDataset(r, id) {
+		writeAPIError(w, http.StatusNotFound, "Unknown dataset")
+		return
+	}
+	t, _ := workspace.GetTrashed(id)
+	writeAPIData(w, r, map[string]interface{}{"trashed": id, "purge_at": t.PurgeAt()})
+}
+
+func trashAPIHandler(w http.ResponseWriter, r *http.Request) {
+	list := []TrashEntry{}
+	for _, t := range teamTrash(r) {
+		list = append(list, TrashEntry{DatasetSummary: summarizeDataset(t.Data), DeletedAt: t.DeletedAt, DeletedBy: t.DeletedBy, PurgeAt: t.PurgeAt()})
+	}
+	writeAPIData(w, r, list)
+}
+
+func restoreAPIHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !trashedInTeam(r, id) {
+		writeAPIError(w, http.StatusNotFound, "Not in trash")
+		return
+	}
+	data, _ := workspace.Restore(id)
+	writeAPIData(w, r, summarizeDataset(data))
+}
+
+func purgeAPIHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !trashedInTeam(r, id) || !workspace.Purge(id) {
+		writeAPIError(w, http.StatusNotFound, "Not in trash")
+		return
+	}
+	writeAPIData(w, r, map[string]string{"purged": id})
+}
+
+// trashHandler is the HTML trash page. Posting action=delete moves a
+// dataset to the trash; restore and purge act on trashed ones.
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		id := r.FormValue("dataset")
+		switch r.FormValue("action") {
+		case "delete":
+			if !currentUser(r).HasRole(RoleAdmin) {
+				http.Error(w, "This action requires the admin role", http.StatusForbidden)
+				return
+			}
+			if !trashDataset(r, id) {
+				http.Error(w, "Unknown dataset", http.StatusNotFound)
+				return
+			}
+		case "restore":
+			if !trashedInTeam(r, id) {
+				http.Error(w, "Not in trash", http.StatusNotFound)
+				return
+			}
+			data, _ := workspace.Restore(id)
+			renderDisplay(w, r, data)
+			return
+		case "purge":
+			if !currentUser(r).HasRole(RoleAdmin) {
+				http.Error(w, "This action requires the admin role", http.StatusForbidden)
+				return
+			}
+			if !trashedInTeam(r, id) || !workspace.Purge(id) {
+				http.Error(w, "Not in trash", http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, "Invalid action", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/trash", http.StatusSeeOther)
+		return
+	}
+
+	list := teamTrash(r)
+	section := ReportSection{
+		Title:   "Trash",
+		Headers: []string{"File", "Rows", "Deleted", "Deleted By", "Purged On", "ID"},
+		Notes:   []string{fmt.Sprintf("Deleted datasets can be restored for %d days.", int(config.TrashRetention.Hours()/24))},
+	}
+	var options []FormOption
+	for _, t := range list {
+		name := t.Data.FileName
+		if t.Data.Derivation != "" {
+			name += " (" + t.Data.Derivation + ")"
+		}
+		section.Rows = append(section.Rows, []string{
+			name,
+			fmt.Sprint(len(t.Data.Rows)),
+			t.DeletedAt.Format("2006-01-02 15:04"),
+			t.DeletedBy,
+			t.PurgeAt().Format("2006-01-02"),
+			t.Data.ID,
+		})
+		options = append(options, FormOption{Value: t.Data.ID, Label: name + " · deleted " + t.DeletedAt.Format("2006-01-02 15:04")})
+	}
+	sections := []ReportSection{section}
+	if len(options) > 0 {
+		sections = append(sections,
+			ReportSection{Title: "Restore", Form: &ReportForm{Action: "/trash", Submit: "♻️ Restore", Fields: []FormField{
+				{Name: "action", Type: "hidden", Value: "restore"},
+				{Name: "dataset", Label: "Dataset", Type: "select", Options: options},
+			}}},
+		)
+		if currentUser(r).HasRole(RoleAdmin) {
+			sections = append(sections,
+				ReportSection{Title: "Delete Permanently", Form: &ReportForm{Action: "/trash", Submit: "🗑️ Purge Now", Fields: []FormField{
+					{Name: "action", Type: "hidden", Value: "purge"},
+					{Name: "dataset", Label: "Dataset", Type: "select", Options: options},
+				}}},
+			)
+		}
+	}
+	renderReport(w, ReportPage{Title: "Trash", Subtitle: currentTeam(r).Name, Sections: sections})
+}
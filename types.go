@@ -1,40 +1,165 @@
 // types.go
 package main
 
-import "time"
+import (
+	"html/template"
+	"time"
+)
 
 type Spreadsheet struct {
-	Headers     []string
-	Rows        [][]string
-	NumericCols []int
-	FileName    string
-	UploadTime  time.Time
-	FileSize    int64
+	ID            string
+	ParentID      string
+	Derivation    string
+	Headers       []string
+	ColumnIDs     []string
+	Rows          [][]string
+	NumericCols   []int
+	FormulaCols   []int
+	FileName      string
+	UploadTime    time.Time
+	FileSize      int64
+	Checksum      string
+	Owner         string
+	Team          string
+	Pipeline      []TransformStep
+	Notes         []string
+	Annotations   Annotations
+	Lineage       []ColumnLineage
+	Reinterpreted map[string]Reinterpretation // by column ID
+	Validators    map[string]string           // validator name by column ID
+	Rules         []ValidationRule
+	Detections    DetectionReport // what was guessed while reading the file
+	Version       int             // bumped on every in-place change
+	Drift         *SchemaDrift    // set when the upload replaced another (see replace.go)
+
+	summaries []*ColumnSummary // made while parsing, until the dataset is stored (see colstats.go)
+}
+
+// TransformStep records one operation applied to a dataset after upload,
+// so exports can describe how the data was produced.
+type TransformStep struct {
+	Op     string            `json:"op"`
+	Params map[string]string `json:"params,omitempty"`
+	At     time.Time         `json:"at"`
+}
+
+type UploadPage struct {
+	Mappings   []MappingTemplate
+	User       *User
+	Usage      QuotaUsage
+	Workspaces []TeamSummary
+	Uploads    []DatasetSummary // the workspace's uploads, newest first, to append to
 }
 
 type DisplayData struct {
-	Headers     []string
-	Rows        [][]string
-	NumericCols []int
-	FileName    string
-	FileSize    string
-	RowCount    int
+	DatasetID        string
+	Derivation       string
+	Notes            []string
+	Annotations      Annotations
+	Headers          []string
+	ColumnIDs        []string
+	Window           RowWindow
+	NumericCols      []int
+	CategoricalCols  []int // the columns a calculation can be grouped by
+	FormulaCols      []int
+	Operations       []Operation
+	Conversions      []UnitConversion
+	RoundingPolicies []FormOption
+	Version          int
+	FileName         string
+	FileSize         string
+	RowCount         int
+	Tier             RowTier
+	Detections       DetectionReport
+	TierNote         string // why the table isn't shown, for analysis-only datasets
+	ParsePreviews    []ParsePreview
+	HeaderStats      map[int]*HeaderStats // by column index, numeric columns only
+	ProfileUpdating  bool                 // HeaderStats are being recomputed after a change
+	ProfileProgress  string               // how far that has got
+	RecentAccess     []AccessEvent        // only for the dataset's owner and admins
+	ShowAccess       bool
+	RecentUploads    []DatasetSummary // the upload session's other datasets, newest first
+	Replaced         []DatasetSummary // the uploads this one replaced, newest first
+	ReplacedBy       *DatasetSummary  // the upload that replaced this one
+	Drift            *SchemaDrift     // how this upload differs from the one it replaced
 }
 
 type CalculationResult struct {
-	Col   string
-	Value float64
+	Col         string
+	Value       float64
+	Exact       string // decimal-mode result at the column's precision
+	Diagnostics ColumnDiagnostics
 }
 
 type ResultPage struct {
-	Operation string
-	Results   []CalculationResult
-	FileName  string
-	Timestamp string
+	OpName      string
+	Operation   string
+	Params      string
+	ParamValues OpParams
+	Results     []CalculationResult
+	Comparisons []SegmentComparison
+	Warnings    []string
+	Incomplete  []string // columns not calculated before the time budget ran out
+	Budget      string
+	Rounding    string // how exact decimal results were rounded, if any were
+	Filters     []string
+	RowsMatched int    // rows left by the filters
+	GroupBy     string // the column Groups are by
+	Groups      []GroupResult
+	Sources     []GroupResult // by the file each row was appended from, for appended datasets
+	SourceCol   string
+	FileName    string
+	DatasetID   string
+	Timestamp   string
+}
+
+type ReportLink struct {
+	Label string
+	URL   string
+}
+
+type FormOption struct {
+	Value    string
+	Label    string
+	Selected bool
+}
+
+type FormField struct {
+	Name        string
+	Label       string
+	Type        string // text, number, date, textarea, select, checkbox, hidden, file
+	Value       string
+	Placeholder string
+	Checked     bool
+	Options     []FormOption
+}
+
+type ReportForm struct {
+	Action    string
+	Method    string
+	Submit    string
+	Multipart bool
+	Fields    []FormField
+}
+
+type ReportSection struct {
+	Title   string
+	Notes   []string
+	Headers []string
+	Rows    [][]string
+	Links   []ReportLink
+	Form    *ReportForm
+	Figure  template.HTML // trusted markup such as a generated SVG chart
+}
+
+type ReportPage struct {
+	Title    string
+	Subtitle string
+	Sections []ReportSection
 }
 
 type APIResponse struct {
 	Success bool        `json:"success"`
 	Data    interface{} `json:"data,omitempty"`
 	Error   string      `json:"error,omitempty"`
-}
\ No newline at end of file
+}
@@ -0,0 +1,267 @@
+// uploads.go
+package main
+
+import (
+	"container/list"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The display page and the forms on it work on "the current dataset". Each
+// browser gets its own upload session, named by the dr_uploads cookie, that
+// remembers the datasets it uploaded or opened most recently (newest first)
+// and its latest calculation, which the results page exports. Forms also
+// send the dataset they were rendered for as the dataset field, which wins
+// over the session, so two tabs on different uploads don't cross.
+//
+// Sessions expire config.UploadTTL after last use, and the least recently
+// used are evicted once the results they hold pass config.UploadMemory. The
+// datasets themselves live in the workspace; a session only names them.
+// With a shared state backend the names are written through so any replica
+// can serve the next request; results stay with the replica that made them.
+
+const uploadsCookie = "dr_uploads"
+
+// An UploadRef names a dataset a session has worked on.
+type UploadRef struct {
+	ID   string    `json:"id"`
+	Used time.Time `json:"used"`
+}
+
+type uploadSession struct {
+	id     string
+	refs   []UploadRef
+	result ResultPage
+	size   int64
+	used   time.Time
+}
+
+type UploadStore struct {
+	mu       sync.Mutex
+	sessions map[string]*list.Element
+	order    *list.List // of *uploadSession, most recently used first
+	size     int64
+}
+
+var uploads = &UploadStore{sessions: make(map[string]*list.Element), order: list.New()}
+
+// sessionID returns the request's upload session, starting one (and setting
+// its cookie on w) if there is none and w is given.
+func sessionID(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(uploadsCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	if w == nil {
+		return ""
+	}
+	id := newID() + newID()
+	http.SetCookie(w, &http.Cookie{
+		Name: uploadsCookie, Value: id, Path: "/",
+		HttpOnly: true, Secure: secureRequest(r), SameSite: http.SameSiteLaxMode,
+	})
+	// Later lookups in this request see the new session too.
+	r.AddCookie(&http.Cookie{Name: uploadsCookie, Value: id})
+	return id
+}
+
+// lockSession takes the lock and returns sid's session, marked used, or nil
+// if there is none and create isn't set. The lock is held on return either
+// way. On a miss the session's refs are loaded from shared state with the
+// lock released, so a slow backend doesn't hold up every other session.
+func (st *UploadStore) lockSession(sid string, create bool) *uploadSession {
+	st.mu.Lock()
+	if s := st.cached(sid); s != nil {
+		return s
+	}
+	var refs []UploadRef
+	if stateShared {
+		st.mu.Unlock()
+		if err := getStateJSON("uploads/"+sid, &refs); err != nil && !errors.Is(err, errStateMissing) {
+			log.Printf("Could not read upload session: %v", err)
+		}
+		st.mu.Lock()
+		// Another request for the session may have loaded it meanwhile.
+		if s := st.cached(sid); s != nil {
+			return s
+		}
+	}
+	if !create && len(refs) == 0 {
+		return nil
+	}
+	s := &uploadSession{id: sid, refs: refs, used: time.Now()}
+	st.sessions[sid] = st.order.PushFront(s)
+	st.resize(s, sessionBytes(s))
+	return s
+}
+
+// cached returns sid's session from memory, marked used, or nil. The lock
+// must be held.
+func (st *UploadStore) cached(sid string) *uploadSession {
+	now := time.Now()
+	st.expire(now)
+	el, ok := st.sessions[sid]
+	if !ok {
+		return nil
+	}
+	st.order.MoveToFront(el)
+	s := el.Value.(*uploadSession)
+	s.used = now
+	return s
+}
+
+// expire drops the sessions unused for config.UploadTTL.
+func (st *UploadStore) expire(now time.Time) {
+	for el := st.order.Back(); el != nil; el = st.order.Back() {
+		if s := el.Value.(*uploadSession); now.Sub(s.used) < config.UploadTTL {
+			return
+		}
+		st.remove(el)
+	}
+}
+
+func (st *UploadStore) remove(el *list.Element) {
+	s := st.order.Remove(el).(*uploadSession)
+	delete(st.sessions, s.id)
+	st.size -= s.size
+}
+
+// resize records s's new size and evicts the least recently used other
+// sessions until the store fits config.UploadMemory.
+func (st *UploadStore) resize(s *uploadSession, size int64) {
+	st.size += size - s.size
+	s.size = size
+	for st.size > config.UploadMemory {
+		el := st.order.Back()
+		if el.Value.(*uploadSession) == s {
+			return
+		}
+		st.remove(el)
+	}
+}
+
+// Remember makes data the session's current dataset.
+func (st *UploadStore) Remember(w http.ResponseWriter, r *http.Request, data Spreadsheet) {
+	if data.ID == "" {
+		return
+	}
+	sid := sessionID(w, r)
+	s := st.lockSession(sid, true)
+	now := time.Now()
+	refs := []UploadRef{{ID: data.ID, Used: now}}
+	for _, ref := range s.refs {
+		if ref.ID != data.ID && now.Sub(ref.Used) < config.UploadTTL && len(refs) < config.UploadsPerSession {
+			refs = append(refs, ref)
+		}
+	}
+	s.refs = refs
+	st.resize(s, sessionBytes(s))
+	st.mu.Unlock()
+	if stateShared {
+		if err := setStateJSON("uploads/"+sid, refs, config.UploadTTL); err != nil {
+			log.Printf("Could not share upload session: %v", err)
+		}
+	}
+}
+
+// refs returns the request's session's live refs, newest first.
+func (st *UploadStore) refs(r *http.Request) []UploadRef {
+	sid := sessionID(nil, r)
+	if sid == "" {
+		return nil
+	}
+	s := st.lockSession(sid, false)
+	defer st.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	return slices.DeleteFunc(slices.Clone(s.refs), func(ref UploadRef) bool {
+		return time.Since(ref.Used) >= config.UploadTTL
+	})
+}
+
+// Recent returns the datasets the session worked on, newest first, that are
+// still in the request's workspace.
+func (st *UploadStore) Recent(r *http.Request) []Spreadsheet {
+	var out []Spreadsheet
+	for _, ref := range st.refs(r) {
+		if data, ok := teamDataset(r, ref.ID); ok {
+			out = append(out, data)
+		}
+	}
+	return out
+}
+
+// Current is the session's newest dataset in the request's workspace, or an
+// empty one.
+func (st *UploadStore) Current(r *http.Request) Spreadsheet {
+	for _, ref := range st.refs(r) {
+		if data, ok := teamDataset(r, ref.ID); ok {
+			return data
+		}
+	}
+	return Spreadsheet{}
+}
+
+// Result is the session's latest calculation, or an empty page.
+func (st *UploadStore) Result(r *http.Request) ResultPage {
+	sid := sessionID(nil, r)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if el, ok := st.sessions[sid]; ok && sid != "" {
+		return el.Value.(*uploadSession).result
+	}
+	return ResultPage{}
+}
+
+func (st *UploadStore) SetResult(w http.ResponseWriter, r *http.Request, page ResultPage) {
+	sid := sessionID(w, r)
+	s := st.lockSession(sid, true)
+	defer st.mu.Unlock()
+	s.result = page
+	st.resize(s, sessionBytes(s))
+}
+
+// sessionBytes estimates what a session holds in memory.
+func sessionBytes(s *uploadSession) int64 {
+	n := int64(128 + 64*len(s.refs))
+	p := s.result
+	n += int64(len(p.OpName) + len(p.Operation) + len(p.Params) + len(p.FileName) + len(p.Timestamp) + len(p.Budget) + len(p.Rounding))
+	n += int64(64 * len(p.ParamValues))
+	for _, res := range p.Results {
+		n += int64(128 + len(res.Col) + len(res.Exact))
+		for _, ex := range res.Diagnostics.Examples {
+			n += int64(32 + len(ex.Value) + len(ex.Reason))
+		}
+	}
+	n += int64(256 * len(p.Comparisons))
+	for _, w := range p.Warnings {
+		n += int64(16 + len(w))
+	}
+	for _, c := range p.Incomplete {
+		n += int64(16 + len(c))
+	}
+	for _, f := range p.Filters {
+		n += int64(16 + len(f))
+	}
+	for _, g := range slices.Concat(p.Groups, p.Sources) {
+		n += int64(64 + len(g.Key) + 48*len(g.Cells))
+		for _, c := range g.Cells {
+			n += int64(len(c.Exact) + len(c.Err))
+		}
+	}
+	return n
+}
+
+// sessionDataset is the dataset a form or link works on: the one named by
+// its dataset field if it sent one, otherwise the session's current dataset.
+func sessionDataset(r *http.Request) (Spreadsheet, bool) {
+	if id := r.FormValue("dataset"); id != "" {
+		return teamDataset(r, id)
+	}
+	data := uploads.Current(r)
+	return data, len(data.Headers) > 0
+}
@@ -0,0 +1,273 @@
+// window.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxWindowOffset = 366
+
+var windowLabels = map[string]string{
+	"lag":   "Lag",
+	"lead":  "Lead",
+	"diff":  "Difference",
+	"share": "% of Total",
+}
+
+// WindowSpec describes a column computed over ordered rows. Rows are taken
+// in Order (or as they appear when Order is -1), separately for each value
+// of Partition when it isn't -1. share ignores N and Order.
+type WindowSpec struct {
+	Kind      string // lag, lead, diff or share
+	Col       int
+	N         int
+	Partition int
+	Order     int
+}
+
+func (s WindowSpec) Describe(data Spreadsheet) string {
+	if s.Kind == "share" {
+		if s.Partition >= 0 {
+			return fmt.Sprintf("%% of %s subtotal by %s", data.Headers[s.Col], data.Headers[s.Partition])
+		}
+		return fmt.Sprintf("%% of %s total", data.Headers[s.Col])
+	}
+	d := fmt.Sprintf("%s(%s, %d)", s.Kind, data.Headers[s.Col], s.N)
+	if s.Partition >= 0 {
+		d += " by " + data.Headers[s.Partition]
+	}
+	if s.Order >= 0 {
+		d += " ordered by " + data.Headers[s.Order]
+	}
+	return d
+}
+
+// compareOrder sorts dates chronologically, before everything else, which
+// is sorted the way sortRows does.
+func compareOrder(a, b string) int {
+	ta, dateA := parseDate(a)
+	tb, dateB := parseDate(b)
+	switch {
+	case dateA && dateB:
+		return ta.Compare(tb)
+	case dateA:
+		return -1
+	case dateB:
+		return 1
+	}
+	return compareCells(a, b)
+}
+
+// windowPartitions returns the row indexes of each partition in window
+// order. Rows with a blank order value go last.
+func windowPartitions(data Spreadsheet, partition, order int) [][]int {
+	index := make(map[string]int)
+	var parts [][]int
+	for i, row := range data.Rows {
+		key := ""
+		if partition >= 0 {
+			key = cellValue(row, partition)
+		}
+		p, ok := index[key]
+		if !ok {
+			p = len(parts)
+			index[key] = p
+			parts = append(parts, nil)
+		}
+		parts[p] = append(parts[p], i)
+	}
+	if order >= 0 {
+		for _, rows := range parts {
+			sort.SliceStable(rows, func(i, j int) bool {
+				a, b := cellValue(data.Rows[rows[i]], order), cellValue(data.Rows[rows[j]], order)
+				if a == "" || b == "" {
+					return a != "" && b == ""
+				}
+				return compareOrder(a, b) < 0
+			})
+		}
+	}
+	return parts
+}
+
+// windowColumn appends a column computed by spec. lag and lead copy the value
+// N rows before or after; diff subtracts the value N rows before and is blank
+// unless both are numbers. It returns how many cells were filled.
+func windowColumn(data *Spreadsheet, spec WindowSpec, name string) (int, error) {
+	if _, ok := windowLabels[spec.Kind]; !ok {
+		return 0, fmt.Errorf("unknown window function %q", spec.Kind)
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, fmt.Errorf("the new column needs a name")
+	}
+	if columnIndex(data.Headers, name) != -1 {
+		return 0, fmt.Errorf("column %q already exists", name)
+	}
+	if spec.Kind == "share" {
+		spec.N, spec.Order = 0, -1
+	} else if spec.N < 1 || spec.N > maxWindowOffset {
+		return 0, fmt.Errorf("the offset must be between 1 and %d", maxWindowOffset)
+	}
+	width := len(data.Headers)
+	values := make([]string, len(data.Rows))
+	filled := 0
+	for _, rows := range windowPartitions(*data, spec.Partition, spec.Order) {
+		if spec.Kind == "share" {
+			filled += shareOfTotal(*data, spec.Col, rows, values)
+			continue
+		}
+		for pos, r := range rows {
+			other := pos - spec.N
+			if spec.Kind == "lead" {
+				other = pos + spec.N
+			}
+			if other < 0 || other >= len(rows) {
+				continue
+			}
+			v := cellValue(data.Rows[rows[other]], spec.Col)
+			if spec.Kind == "diff" {
+				cur, ok1 := parseFinite(cellValue(data.Rows[r], spec.Col))
+				prev, ok2 := parseFinite(v)
+				if !ok1 || !ok2 {
+					continue
+				}
+				v = formatComputed(cur - prev)
+			}
+			if v != "" {
+				values[r] = v
+				filled++
+			}
+		}
+	}
+	rows := make([][]string, len(data.Rows))
+	for i, row := range data.Rows {
+		out := make([]string, width+1)
+		copy(out, row)
+		out[width] = values[i]
+		rows[i] = out
+	}
+
+	detail := spec.Describe(*data)
+	sources := []string{data.Headers[spec.Col]}
+	step := map[string]string{
+		"function": spec.Kind,
+		"column":   data.Headers[spec.Col],
+		"into":     name,
+	}
+	if spec.N > 0 {
+		step["n"] = strconv.Itoa(spec.N)
+	}
+	if spec.Partition >= 0 {
+		sources = append(sources, data.Headers[spec.Partition])
+		step["partition"] = data.Headers[spec.Partition]
+	}
+	if spec.Order >= 0 {
+		sources = append(sources, data.Headers[spec.Order])
+		step["order"] = data.Headers[spec.Order]
+	}
+	data.ColumnIDs = append(append([]string(nil), data.ColumnIDs...), nextColumnID(*data))
+	data.Headers = append(append([]string(nil), data.Headers...), name)
+	data.Rows = rows
+	data.NumericCols = detectNumericColumns(*data)
+	data.Lineage = withLineage(data.Lineage, ColumnLineage{Column: name, Sources: sources, Operation: spec.Kind, Detail: detail})
+	data.Pipeline = appendStep(data.Pipeline, "window", step)
+	data.Notes = append(data.Notes, fmt.Sprintf("Added %q: %s (%d of %d rows filled)", name, detail, filled, len(rows)))
+	return filled, nil
+}
+
+// shareOfTotal fills values for rows with each number in col as a percentage
+// of the rows' total. Rows that aren't numbers, or whose total is zero, stay
+// blank. It returns how many were filled.
+func shareOfTotal(data Spreadsheet, col int, rows []int, values []string) int {
+	total := 0.0
+	for _, r := range rows {
+		if v, ok := parseFinite(cellValue(data.Rows[r], col)); ok {
+			total += v
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	filled := 0
+	for _, r := range rows {
+		if v, ok := parseFinite(cellValue(data.Rows[r], col)); ok {
+			values[r] = formatComputed(v * 100 / total)
+			filled++
+		}
+	}
+	return filled
+}
+
+// windowHandler adds a lag, lead, difference or share column from the
+// display page.
+func windowHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	data, ok := teamDataset(r, r.FormValue("dataset"))
+	if !ok {
+		http.Error(w, "Unknown dataset", http.StatusNotFound)
+		return
+	}
+	if err := checkVersion(r, data); err != nil {
+		http.Error(w, err.Error(), updateErrorStatus(w, err))
+		return
+	}
+	// optional resolves a column that may be left unset, giving -1.
+	optional := func(param string) (int, bool) {
+		ref := r.FormValue(param)
+		if ref == "" {
+			return -1, true
+		}
+		col := columnRef(data, ref)
+		return col, col != -1
+	}
+	spec := WindowSpec{Kind: r.FormValue("function"), Col: columnRef(data, r.FormValue("column"))}
+	var partitionOK, orderOK bool
+	spec.Partition, partitionOK = optional("partition")
+	spec.Order, orderOK = optional("order")
+	if spec.Col == -1 || !partitionOK || !orderOK {
+		http.Error(w, "Unknown column", http.StatusBadRequest)
+		return
+	}
+	spec.N = 1
+	if v := strings.TrimSpace(r.FormValue("n")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "The offset must be a whole number", http.StatusBadRequest)
+			return
+		}
+		spec.N = n
+	}
+	name := strings.TrimSpace(r.FormValue("into"))
+	if name == "" {
+		switch label := windowLabels[spec.Kind]; {
+		case spec.Kind == "share" && spec.Partition >= 0:
+			name = fmt.Sprintf("%s %% of %s", data.Headers[spec.Col], data.Headers[spec.Partition])
+		case spec.Kind == "share":
+			name = data.Headers[spec.Col] + " " + label
+		case label != "":
+			name = fmt.Sprintf("%s %s (%d)", data.Headers[spec.Col], label, spec.N)
+		}
+	}
+
+	if _, err := windowColumn(&data, spec, name); err != nil {
+		http.Error(w, "Window error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := workspace.Update(&data); err != nil {
+		http.Error(w, err.Error(), updateErrorStatus(w, err))
+		return
+	}
+	renderDisplay(w, r, data)
+}
@@ -0,0 +1,290 @@
+// workspace.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Workspace keeps every dataset produced during the session: uploads and the
+// datasets derived from them.
+type Workspace struct {
+	mu       sync.RWMutex
+	datasets map[string]Spreadsheet
+	order    []string
+	trash    map[string]TrashedDataset
+	usage    map[string]DatasetUsage // by owner, for the quota
+}
+
+// TrashedDataset is a deleted dataset kept until its restore window ends.
+type TrashedDataset struct {
+	Data      Spreadsheet
+	DeletedAt time.Time
+	DeletedBy string
+	Position  int // index in order at deletion, so a restore keeps the listing stable
+}
+
+func (t TrashedDataset) PurgeAt() time.Time {
+	return t.DeletedAt.Add(config.TrashRetention)
+}
+
+var workspace = newWorkspace()
+
+func newWorkspace() *Workspace {
+	return &Workspace{datasets: make(map[string]Spreadsheet), trash: make(map[string]TrashedDataset), usage: make(map[string]DatasetUsage)}
+}
+
+// Add registers data under a fresh ID and returns the stored copy, unless
+// it would put its owner over their quota.
+func (ws *Workspace) Add(data Spreadsheet) (Spreadsheet, error) {
+	data.ID = newID()
+	data.Version = 1
+	if len(data.ColumnIDs) != len(data.Headers) {
+		data.ColumnIDs = newColumnIDs(len(data.Headers))
+	}
+	columnSummaries.Seed(data)
+	data.summaries = nil
+	if stateShared {
+		return ws.sharedAdd(data)
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if err := checkQuota(ws.usage[data.Owner], data); err != nil {
+		columnSummaries.Forget(data.ID)
+		return Spreadsheet{}, err
+	}
+	ws.datasets[data.ID] = data
+	ws.order = append(ws.order, data.ID)
+	ws.count(1, data)
+	return data, nil
+}
+
+// count adds data to its owner's usage, or takes it away when n is -1. The
+// lock must be held.
+func (ws *Workspace) count(n int, data Spreadsheet) {
+	used := ws.usage[data.Owner].plus(n, data)
+	if used.Datasets == 0 {
+		delete(ws.usage, data.Owner)
+	} else {
+		ws.usage[data.Owner] = used
+	}
+}
+
+// Usage is what owner's datasets take up, not counting the trash.
+func (ws *Workspace) Usage(owner string) DatasetUsage {
+	if stateShared {
+		return ws.sharedUsage(owner)
+	}
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	return ws.usage[owner]
+}
+
+// appendStep returns the pipeline with step added, leaving the original
+// slice untouched so derived datasets don't share history with their parent.
+func appendStep(pipeline []TransformStep, op string, params map[string]string) []TransformStep {
+	out := make([]TransformStep, len(pipeline), len(pipeline)+1)
+	copy(out, pipeline)
+	return append(out, TransformStep{Op: op, Params: params, At: time.Now()})
+}
+
+func (ws *Workspace) Get(id string) (Spreadsheet, bool) {
+	if stateShared {
+		return ws.sharedGet(id)
+	}
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	data, ok := ws.datasets[id]
+	return data, ok
+}
+
+// List returns the datasets in registration order.
+func (ws *Workspace) List() []Spreadsheet {
+	if stateShared {
+		return ws.sharedList()
+	}
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	list := make([]Spreadsheet, 0, len(ws.order))
+	for _, id := range ws.order {
+		list = append(list, ws.datasets[id])
+	}
+	return list
+}
+
+// Delete moves a dataset to the trash. It can be restored until
+// config.TrashRetention has passed.
+func (ws *Workspace) Delete(id, by string) bool {
+	if stateShared {
+		return ws.sharedDelete(id, by)
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	data, ok := ws.datasets[id]
+	if !ok {
+		return false
+	}
+	delete(ws.datasets, id)
+	ws.count(-1, data)
+	profiles.Forget(id)
+	parsedColumns.Forget(id)
+	columnSummaries.Forget(id)
+	pos := len(ws.order)
+	for i, existing := range ws.order {
+		if existing == id {
+			pos = i
+			ws.order = append(ws.order[:i], ws.order[i+1:]...)
+			break
+		}
+	}
+	ws.trash[id] = TrashedDataset{Data: data, DeletedAt: time.Now(), DeletedBy: by, Position: pos}
+	return true
+}
+
+// Restore brings a trashed dataset back under its original ID.
+func (ws *Workspace) Restore(id string) (Spreadsheet, bool) {
+	if stateShared {
+		return ws.sharedRestore(id)
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.purgeExpired()
+	t, ok := ws.trash[id]
+	if !ok {
+		return Spreadsheet{}, false
+	}
+	delete(ws.trash, id)
+	ws.datasets[id] = t.Data
+	ws.count(1, t.Data)
+	pos := t.Position
+	if pos > len(ws.order) {
+		pos = len(ws.order)
+	}
+	ws.order = append(ws.order[:pos], append([]string{id}, ws.order[pos:]...)...)
+	return t.Data, true
+}
+
+// Purge destroys a trashed dataset immediately.
+func (ws *Workspace) Purge(id string) bool {
+	if stateShared {
+		return ws.sharedPurge(id)
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if _, ok := ws.trash[id]; !ok {
+		return false
+	}
+	delete(ws.trash, id)
+	accessLog.Forget(id)
+	return true
+}
+
+func (ws *Workspace) Trash() []TrashedDataset {
+	if stateShared {
+		return ws.sharedTrash()
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.purgeExpired()
+	list := make([]TrashedDataset, 0, len(ws.trash))
+	for _, t := range ws.trash {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeletedAt.After(list[j].DeletedAt) })
+	return list
+}
+
+func (ws *Workspace) GetTrashed(id string) (TrashedDataset, bool) {
+	if stateShared {
+		return ws.sharedGetTrashed(id)
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.purgeExpired()
+	t, ok := ws.trash[id]
+	return t, ok
+}
+
+// purgeExpired must be called with the lock held.
+func (ws *Workspace) purgeExpired() {
+	now := time.Now()
+	for id, t := range ws.trash {
+		if now.After(t.PurgeAt()) {
+			delete(ws.trash, id)
+			accessLog.Forget(id)
+		}
+	}
+}
+
+var errUnknownDataset = errors.New("unknown dataset")
+
+// VersionConflict means a dataset changed after the caller read it.
+type VersionConflict struct {
+	Current int
+}
+
+func (e *VersionConflict) Error() string {
+	return fmt.Sprintf("the dataset was changed by someone else (now version %d); refresh and try again", e.Current)
+}
+
+// Update replaces a registered dataset in place, keeping its position. data
+// must still carry the version it was read at; on success it is bumped to
+// the stored version and its profile is recomputed in the background.
+func (ws *Workspace) Update(data *Spreadsheet) error {
+	if stateShared {
+		return ws.sharedUpdate(data)
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	stored, ok := ws.datasets[data.ID]
+	if !ok {
+		return errUnknownDataset
+	}
+	if stored.Version != data.Version {
+		return &VersionConflict{Current: stored.Version}
+	}
+	data.Version++
+	ws.datasets[data.ID] = *data
+	ws.count(-1, stored)
+	ws.count(1, *data)
+	columnSummaries.Carry(stored, *data)
+	profiles.Refresh(*data)
+	return nil
+}
+
+// checkVersion compares the version a client last saw, sent as an If-Match
+// header or a version form field, with the dataset's. Clients that send
+// neither aren't checked.
+func checkVersion(r *http.Request, data Spreadsheet) error {
+	v := strings.Trim(strings.TrimPrefix(r.Header.Get("If-Match"), "W/"), `"`)
+	if v == "" {
+		v = r.FormValue("version")
+	}
+	if v == "" {
+		return nil
+	}
+	if n, err := strconv.Atoi(v); err != nil || n != data.Version {
+		return &VersionConflict{Current: data.Version}
+	}
+	return nil
+}
+
+// updateErrorStatus picks the status for a failed checkVersion or Update and,
+// for a conflict, sends the current version as the ETag.
+func updateErrorStatus(w http.ResponseWriter, err error) int {
+	var conflict *VersionConflict
+	switch {
+	case errors.As(err, &conflict):
+		w.Header().Set("ETag", strconv.Quote(strconv.Itoa(conflict.Current)))
+		return http.StatusConflict
+	case errors.Is(err, errUnknownDataset):
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,542 @@
+// xls.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/richardlehane/mscfb"
+)
+
+// Legacy .xls files are OLE compound documents holding a BIFF record stream.
+// excelize only understands OOXML, so BIFF8 (Excel 97-2003) workbooks are
+// read here directly.
+
+var cfbSignature = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+const (
+	biffFormula    = 0x0006
+	biffEOF        = 0x000A
+	biffDateMode   = 0x0022
+	biffContinue   = 0x003C
+	biffBoundSheet = 0x0085
+	biffMulRK      = 0x00BD
+	biffXF         = 0x00E0
+	biffSST        = 0x00FC
+	biffLabelSST   = 0x00FD
+	biffNumber     = 0x0203
+	biffLabel      = 0x0204
+	biffBoolErr    = 0x0205
+	biffString     = 0x0207
+	biffRK         = 0x027E
+	biffFormat     = 0x041E
+	biffBOF        = 0x0809
+)
+
+func isCompoundFile(r io.ReaderAt) bool {
+	head := make([]byte, len(cfbSignature))
+	if _, err := r.ReadAt(head, 0); err != nil {
+		return false
+	}
+	return bytes.Equal(head, cfbSignature)
+}
+
+// readerSize finds the length of an upload, which is an *os.File or a
+// section of memory depending on its size.
+func readerSize(r io.ReaderAt) (int64, error) {
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size(), nil
+	case io.Seeker:
+		pos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		size, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		_, err = r.Seek(pos, io.SeekStart)
+		return size, err
+	}
+	return 0, errors.New("can't tell the file's size")
+}
+
+// checkCFBHeader checks the counts in a compound file header against the
+// file's size before mscfb sizes its tables from them: it trusts them, and a
+// damaged header can make it allocate gigabytes. See [MS-CFB] 2.2.
+func checkCFBHeader(file io.ReaderAt, size int64) error {
+	head := make([]byte, 512)
+	if _, err := file.ReadAt(head, 0); err != nil {
+		return errors.New("truncated header")
+	}
+	version := binary.LittleEndian.Uint16(head[26:])
+	shift := binary.LittleEndian.Uint16(head[30:])
+	if !(version == 3 && shift == 9 || version == 4 && shift == 12) {
+		return fmt.Errorf("version %d with sector shift %d", version, shift)
+	}
+	if binary.LittleEndian.Uint16(head[32:]) != 6 || binary.LittleEndian.Uint32(head[56:]) != 4096 {
+		return errors.New("bad mini stream parameters")
+	}
+	sector := int64(1) << shift
+	sectors := (size + sector - 1) / sector // the header's sector included
+	dirSectors := binary.LittleEndian.Uint32(head[40:])
+	if version == 3 && dirSectors != 0 {
+		return errors.New("directory sector count set in a version 3 file")
+	}
+	for _, count := range []struct {
+		name string
+		n    uint32
+	}{
+		{"directory", dirSectors},
+		{"FAT", binary.LittleEndian.Uint32(head[44:])},
+		{"mini FAT", binary.LittleEndian.Uint32(head[64:])},
+		{"DIFAT", binary.LittleEndian.Uint32(head[72:])},
+	} {
+		if int64(count.n) >= sectors {
+			return fmt.Errorf("%d %s sectors in a file of %d", count.n, count.name, sectors)
+		}
+	}
+	// The root entry, first in the directory, holds the mini stream.
+	root := make([]byte, 128)
+	dir := int64(binary.LittleEndian.Uint32(head[48:]))
+	if _, err := file.ReadAt(root, (dir+1)*sector); err != nil {
+		return errors.New("directory is outside the file")
+	}
+	if miniStream := binary.LittleEndian.Uint64(root[120:]); miniStream > uint64(size) {
+		return fmt.Errorf("a %d-byte mini stream in a %d-byte file", miniStream, size)
+	}
+	return nil
+}
+
+func processXLS(file io.ReaderAt) (Spreadsheet, error) {
+	var data Spreadsheet
+	size, err := readerSize(file)
+	if err != nil {
+		return data, err
+	}
+	if err := checkCFBHeader(file, size); err != nil {
+		return data, fmt.Errorf("not a valid .xls file: %v", err)
+	}
+	doc, err := mscfb.New(file)
+	if err != nil {
+		return data, fmt.Errorf("not a valid .xls file: %v", err)
+	}
+	var stream []byte
+	for entry, err := doc.Next(); err == nil; entry, err = doc.Next() {
+		switch entry.Name {
+		case "Workbook":
+			if entry.Size > size {
+				return data, fmt.Errorf("not a valid .xls file: a %d-byte workbook in a %d-byte file", entry.Size, size)
+			}
+			stream, err = io.ReadAll(entry)
+			if err != nil {
+				return data, err
+			}
+		case "Book":
+			return data, fmt.Errorf("this is an Excel 5.0/95 workbook, which is not supported; open it in Excel and save it as .xlsx")
+		case "EncryptedPackage":
+			return data, fmt.Errorf("this workbook is password-protected; remove the password and save it again before uploading")
+		}
+		if stream != nil {
+			break
+		}
+	}
+	if stream == nil {
+		return data, fmt.Errorf("no workbook stream found; the file may not be an Excel workbook")
+	}
+
+	rows, err := readBIFFSheet(stream)
+	if err != nil {
+		return data, err
+	}
+	if len(rows) == 0 {
+		return data, fmt.Errorf("empty Excel")
+	}
+	data.Headers = dedupeHeaders(normalizeHeaders(rows[0]))
+	data.Rows = rows[1:]
+	return data, nil
+}
+
+type biffRecord struct {
+	typ  uint16
+	body []byte
+}
+
+func readBIFFRecords(stream []byte, offset int) ([]biffRecord, error) {
+	var records []biffRecord
+	for pos := offset; pos+4 <= len(stream); {
+		typ := binary.LittleEndian.Uint16(stream[pos:])
+		size := int(binary.LittleEndian.Uint16(stream[pos+2:]))
+		pos += 4
+		if pos+size > len(stream) {
+			return records, errors.New("truncated BIFF record")
+		}
+		records = append(records, biffRecord{typ, stream[pos : pos+size]})
+		pos += size
+		if typ == biffEOF {
+			break
+		}
+	}
+	return records, nil
+}
+
+// readBIFFSheet returns the cells of the first worksheet as text rows.
+func readBIFFSheet(stream []byte) ([][]string, error) {
+	globals, err := readBIFFRecords(stream, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(globals) == 0 || globals[0].typ != biffBOF || len(globals[0].body) < 2 {
+		return nil, errors.New("missing BIFF header")
+	}
+	if version := binary.LittleEndian.Uint16(globals[0].body); version != 0x0600 {
+		return nil, fmt.Errorf("unsupported BIFF version 0x%04x; save the file as .xlsx", version)
+	}
+
+	var (
+		sst         []string
+		xfFormats   []uint16
+		formats     = make(map[uint16]string)
+		date1904    bool
+		sheetOffset = -1
+	)
+	for i := 0; i < len(globals); i++ {
+		rec := globals[i]
+		switch rec.typ {
+		case biffSST:
+			segments := [][]byte{rec.body}
+			for i+1 < len(globals) && globals[i+1].typ == biffContinue {
+				i++
+				segments = append(segments, globals[i].body)
+			}
+			sst, err = readSST(segments)
+			if err != nil {
+				return nil, err
+			}
+		case biffXF:
+			if len(rec.body) >= 4 {
+				xfFormats = append(xfFormats, binary.LittleEndian.Uint16(rec.body[2:]))
+			}
+		case biffFormat:
+			if len(rec.body) > 2 {
+				s, _ := readXLString(rec.body[2:])
+				formats[binary.LittleEndian.Uint16(rec.body)] = s
+			}
+		case biffDateMode:
+			date1904 = len(rec.body) >= 2 && binary.LittleEndian.Uint16(rec.body) == 1
+		case biffBoundSheet:
+			// Only worksheets (type 0) are read; charts and macro sheets are skipped.
+			if sheetOffset == -1 && len(rec.body) >= 6 && rec.body[5] == 0 {
+				sheetOffset = int(binary.LittleEndian.Uint32(rec.body))
+			}
+		}
+	}
+	if sheetOffset == -1 {
+		return nil, errors.New("no sheets")
+	}
+
+	isDate := func(xf uint16) bool {
+		if int(xf) >= len(xfFormats) {
+			return false
+		}
+		return isDateFormat(xfFormats[xf], formats[xfFormats[xf]])
+	}
+	formatNumber := func(xf uint16, v float64) string {
+		if isDate(xf) {
+			return excelSerialToString(v, date1904)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	sheet, err := readBIFFRecords(stream, sheetOffset)
+	if err != nil {
+		return nil, err
+	}
+	cells := make(map[[2]int]string)
+	maxRow, maxCol := -1, -1
+	set := func(row, col uint16, v string) {
+		cells[[2]int{int(row), int(col)}] = v
+		if int(row) > maxRow {
+			maxRow = int(row)
+		}
+		if int(col) > maxCol {
+			maxCol = int(col)
+		}
+	}
+
+	for i, rec := range sheet {
+		b := rec.body
+		if len(b) < 6 {
+			continue
+		}
+		row, col, xf := binary.LittleEndian.Uint16(b), binary.LittleEndian.Uint16(b[2:]), binary.LittleEndian.Uint16(b[4:])
+		switch rec.typ {
+		case biffLabelSST:
+			if len(b) >= 10 {
+				if idx := int(binary.LittleEndian.Uint32(b[6:])); idx < len(sst) {
+					set(row, col, sst[idx])
+				}
+			}
+		case biffLabel:
+			s, _ := readXLString(b[6:])
+			set(row, col, s)
+		case biffNumber:
+			if len(b) >= 14 {
+				set(row, col, formatNumber(xf, math.Float64frombits(binary.LittleEndian.Uint64(b[6:]))))
+			}
+		case biffRK:
+			if len(b) >= 10 {
+				set(row, col, formatNumber(xf, decodeRK(binary.LittleEndian.Uint32(b[6:]))))
+			}
+		case biffMulRK:
+			// row, first col, then (xf, rk) pairs, then the last col
+			for off, c := 4, col; off+6 <= len(b)-2; off, c = off+6, c+1 {
+				cellXF := binary.LittleEndian.Uint16(b[off:])
+				set(row, c, formatNumber(cellXF, decodeRK(binary.LittleEndian.Uint32(b[off+2:]))))
+			}
+		case biffBoolErr:
+			if len(b) >= 8 && b[7] == 0 {
+				set(row, col, strings.ToUpper(strconv.FormatBool(b[6] != 0)))
+			}
+		case biffFormula:
+			if len(b) < 14 {
+				continue
+			}
+			result := b[6:14]
+			if result[6] != 0xFF || result[7] != 0xFF {
+				set(row, col, formatNumber(xf, math.Float64frombits(binary.LittleEndian.Uint64(result))))
+				continue
+			}
+			switch result[0] {
+			case 0: // string result in the following STRING record
+				if i+1 < len(sheet) && sheet[i+1].typ == biffString {
+					s, _ := readXLString(sheet[i+1].body)
+					set(row, col, s)
+				}
+			case 1:
+				set(row, col, strings.ToUpper(strconv.FormatBool(result[2] != 0)))
+			}
+		}
+	}
+
+	rows := make([][]string, maxRow+1)
+	for r := range rows {
+		width := 0
+		for c := maxCol; c >= 0; c-- {
+			if _, ok := cells[[2]int{r, c}]; ok {
+				width = c + 1
+				break
+			}
+		}
+		rows[r] = make([]string, width)
+		for c := 0; c < width; c++ {
+			rows[r][c] = cells[[2]int{r, c}]
+		}
+	}
+	return rows, nil
+}
+
+func decodeRK(rk uint32) float64 {
+	var v float64
+	if rk&0x02 != 0 {
+		v = float64(int32(rk) >> 2)
+	} else {
+		v = math.Float64frombits(uint64(rk&0xFFFFFFFC) << 32)
+	}
+	if rk&0x01 != 0 {
+		v /= 100
+	}
+	return v
+}
+
+// readXLString decodes a BIFF8 XLUnicodeString (16-bit length, flags, chars).
+func readXLString(b []byte) (string, int) {
+	if len(b) < 3 {
+		return "", len(b)
+	}
+	n := int(binary.LittleEndian.Uint16(b))
+	high := b[2]&0x01 != 0
+	pos := 3
+	units := make([]uint16, 0, n)
+	for i := 0; i < n; i++ {
+		if high {
+			if pos+2 > len(b) {
+				break
+			}
+			units = append(units, binary.LittleEndian.Uint16(b[pos:]))
+			pos += 2
+		} else {
+			if pos >= len(b) {
+				break
+			}
+			units = append(units, uint16(b[pos]))
+			pos++
+		}
+	}
+	return string(utf16.Decode(units)), pos
+}
+
+// sstReader walks the shared string table, which Excel splits across
+// CONTINUE records. A string's characters may straddle a record boundary, in
+// which case the next record begins with a fresh option-flags byte.
+type sstReader struct {
+	segs [][]byte
+	seg  int
+	off  int
+}
+
+func (s *sstReader) next() (byte, error) {
+	for s.seg < len(s.segs) && s.off >= len(s.segs[s.seg]) {
+		s.seg++
+		s.off = 0
+	}
+	if s.seg >= len(s.segs) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := s.segs[s.seg][s.off]
+	s.off++
+	return b, nil
+}
+
+func (s *sstReader) uint(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		b, err := s.next()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint32(b) << (8 * i)
+	}
+	return v, nil
+}
+
+// remaining is how many bytes are left to read.
+func (s *sstReader) remaining() int {
+	n := 0
+	for i := s.seg; i < len(s.segs); i++ {
+		n += len(s.segs[i])
+	}
+	return n - s.off
+}
+
+func (s *sstReader) skip(n int) error {
+	for ; n > 0; n-- {
+		if _, err := s.next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSST(segments [][]byte) ([]string, error) {
+	s := &sstReader{segs: segments}
+	if _, err := s.uint(4); err != nil { // total references
+		return nil, err
+	}
+	unique, err := s.uint(4)
+	if err != nil {
+		return nil, err
+	}
+	// The count comes from the file, so it sizes the slice only as far as
+	// the table's bytes allow; each string takes at least 3.
+	capacity := s.remaining() / 3
+	if int64(unique) < int64(capacity) {
+		capacity = int(unique)
+	}
+	strs := make([]string, 0, capacity)
+	for i := uint32(0); i < unique; i++ {
+		cch, err := s.uint(2)
+		if err != nil {
+			return strs, nil
+		}
+		flags, err := s.next()
+		if err != nil {
+			return nil, err
+		}
+		var runs, extLen uint32
+		if flags&0x08 != 0 {
+			if runs, err = s.uint(2); err != nil {
+				return nil, err
+			}
+		}
+		if flags&0x04 != 0 {
+			if extLen, err = s.uint(4); err != nil {
+				return nil, err
+			}
+		}
+		high := flags&0x01 != 0
+		units := make([]uint16, 0, cch)
+		for c := uint32(0); c < cch; c++ {
+			if s.seg < len(s.segs) && s.off >= len(s.segs[s.seg]) && s.seg+1 < len(s.segs) {
+				s.seg++
+				s.off = 0
+				f, err := s.next()
+				if err != nil {
+					return nil, err
+				}
+				high = f&0x01 != 0
+			}
+			width := 1
+			if high {
+				width = 2
+			}
+			u, err := s.uint(width)
+			if err != nil {
+				return nil, err
+			}
+			units = append(units, uint16(u))
+		}
+		strs = append(strs, string(utf16.Decode(units)))
+		if err := s.skip(int(runs)*4 + int(extLen)); err != nil {
+			return nil, err
+		}
+	}
+	return strs, nil
+}
+
+func isDateFormat(id uint16, format string) bool {
+	switch {
+	case id >= 14 && id <= 22, id >= 45 && id <= 47:
+		return true
+	case format == "":
+		return false
+	}
+	var plain strings.Builder
+	inQuote, inBracket := false, false
+	for _, r := range strings.ToLower(format) {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+		case r == '[' && !inQuote:
+			inBracket = true
+		case r == ']' && !inQuote:
+			inBracket = false
+		case !inQuote && !inBracket:
+			plain.WriteRune(r)
+		}
+	}
+	return strings.ContainsAny(plain.String(), "dyhs")
+}
+
+func excelSerialToString(serial float64, date1904 bool) string {
+	base := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	if date1904 {
+		base = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	days := math.Floor(serial)
+	secs := math.Round((serial - days) * 86400)
+	t := base.AddDate(0, 0, int(days)).Add(time.Duration(secs) * time.Second)
+	if secs == 0 {
+		return t.Format("2006-01-02")
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,361 @@
+// xls_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// The fixtures are BIFF8 record streams assembled from the [MS-XLS] record
+// layouts, wrapped in a minimal compound file from [MS-CFB].
+
+func biffRec(typ uint16, body ...[]byte) []byte {
+	b := bytes.Join(body, nil)
+	out := binary.LittleEndian.AppendUint16(nil, typ)
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(b)))
+	return append(out, b...)
+}
+
+func le16(v uint16) []byte { return binary.LittleEndian.AppendUint16(nil, v) }
+func le32(v uint32) []byte { return binary.LittleEndian.AppendUint32(nil, v) }
+func le64(v float64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, math.Float64bits(v))
+}
+
+// xlChars is a string's characters, compressed to one byte each when they
+// all fit, with the flags byte that says which.
+func xlChars(s string) (byte, []byte) {
+	units := utf16.Encode([]rune(s))
+	high := false
+	for _, u := range units {
+		high = high || u > 0xFF
+	}
+	var b []byte
+	for _, u := range units {
+		if high {
+			b = binary.LittleEndian.AppendUint16(b, u)
+		} else {
+			b = append(b, byte(u))
+		}
+	}
+	if high {
+		return 1, b
+	}
+	return 0, b
+}
+
+// xlString is an XLUnicodeString: 16-bit length, flags, characters.
+func xlString(s string) []byte {
+	flags, chars := xlChars(s)
+	return append(append(le16(uint16(len(utf16.Encode([]rune(s))))), flags), chars...)
+}
+
+func biffBOFRec(kind uint16) []byte {
+	return biffRec(biffBOF, le16(0x0600), le16(kind), make([]byte, 12))
+}
+
+func cellHead(row, col, xf uint16) []byte {
+	return bytes.Join([][]byte{le16(row), le16(col), le16(xf)}, nil)
+}
+
+func rkInt(v int32) []byte        { return le32(uint32(v)<<2 | 0x02) }
+func rkCents(v int32) []byte      { return le32(uint32(v)<<2 | 0x03) }
+func rkFloat(v float64) []byte    { return le32(uint32(math.Float64bits(v) >> 32)) }
+func formulaNum(v float64) []byte { return le64(v) }
+
+// formulaOther is a FORMULA result that isn't a number: its last two bytes
+// are 0xFFFF and the first says what it is.
+func formulaOther(kind, value byte) []byte {
+	return []byte{kind, 0, value, 0, 0, 0, 0xFF, 0xFF}
+}
+
+// xlsWorkbook is a workbook stream: globals (which must leave room for the
+// BOUNDSHEET offsets to be patched in), then the sheets in order.
+type xlsWorkbook struct {
+	date1904 bool
+	sst      [][]byte // SST body, then its CONTINUE bodies
+	sheets   []xlsSheet
+}
+
+type xlsSheet struct {
+	kind  byte // 0 worksheet, 2 chart
+	cells [][]byte
+}
+
+func (wb xlsWorkbook) stream() []byte {
+	var globals []byte
+	globals = append(globals, biffBOFRec(0x0005)...)
+	if wb.date1904 {
+		globals = append(globals, biffRec(biffDateMode, le16(1))...)
+	}
+	globals = append(globals, biffRec(biffFormat, le16(164), xlString("yyyy-mm-dd hh:mm"))...)
+	globals = append(globals, biffRec(biffFormat, le16(165), xlString(`"Days: "0.00`))...)
+	globals = append(globals, biffRec(biffFormat, le16(166), xlString(`[Red]0.00`))...)
+	// XF 0 is General, then a built-in date, the custom formats in order
+	for _, format := range []uint16{0, 14, 164, 165, 166} {
+		globals = append(globals, biffRec(biffXF, le16(0), le16(format), make([]byte, 16))...)
+	}
+	var sheetRecs []int // where each BOUNDSHEET's offset goes
+	for i, s := range wb.sheets {
+		sheetRecs = append(sheetRecs, len(globals)+4)
+		globals = append(globals, biffRec(biffBoundSheet, le32(0), []byte{0, s.kind}, []byte{byte(len(fmt.Sprint(i))), 0}, []byte(fmt.Sprint(i)))...)
+	}
+	if len(wb.sst) > 0 {
+		globals = append(globals, biffRec(biffSST, wb.sst[0])...)
+		for _, c := range wb.sst[1:] {
+			globals = append(globals, biffRec(biffContinue, c)...)
+		}
+	}
+	globals = append(globals, biffRec(biffEOF)...)
+
+	out := globals
+	for i, s := range wb.sheets {
+		binary.LittleEndian.PutUint32(out[sheetRecs[i]:], uint32(len(out)))
+		out = append(out, biffBOFRec(0x0010)...)
+		for _, c := range s.cells {
+			out = append(out, c...)
+		}
+		out = append(out, biffRec(biffEOF)...)
+	}
+	return out
+}
+
+// sstBody starts an SST of n unique strings.
+func sstBody(n uint32, strs ...[]byte) []byte {
+	return bytes.Join(append([][]byte{le32(n), le32(n)}, strs...), nil)
+}
+
+func testWorkbook() xlsWorkbook {
+	// "Long text" is split across a CONTINUE that switches it from
+	// one-byte to two-byte characters, as Excel does when the rest of a
+	// string needs them; the CONTINUE starts with a fresh flags byte.
+	_, head := xlChars("Long ")
+	_, tail := xlChars("日本語")
+	split := append(append(le16(8), 0), head...)
+	// A rich-text string: two formatting runs after the characters.
+	rich := append(append(le16(4), 0x08), le16(2)...)
+	rich = append(append(rich, "Bold"...), make([]byte, 8)...)
+	// An extended (phonetic) string: 3 bytes of extension data.
+	ext := append(append(le16(3), 0x04), le32(3)...)
+	ext = append(append(ext, "Ext"...), 1, 2, 3)
+	sst := [][]byte{
+		sstBody(7, xlString("Name"), xlString("Amount"), xlString("Ünïcödé"), xlString("日本"), rich, ext, split),
+		append([]byte{1}, tail...),
+	}
+
+	return xlsWorkbook{sst: sst, sheets: []xlsSheet{
+		{kind: 2}, // a chart sheet comes first and is skipped
+		{kind: 0, cells: [][]byte{
+			biffRec(biffLabelSST, cellHead(0, 0, 0), le32(0)),
+			biffRec(biffLabelSST, cellHead(0, 1, 0), le32(1)),
+			biffRec(biffLabel, cellHead(0, 2, 0), xlString("When")),
+			biffRec(biffLabel, cellHead(0, 3, 0), xlString("Flag")),
+
+			biffRec(biffLabelSST, cellHead(1, 0, 0), le32(3)),
+			biffRec(biffNumber, cellHead(1, 1, 3), le64(1234.5)),
+			biffRec(biffRK, cellHead(1, 2, 1), rkInt(45000)),
+			biffRec(biffBoolErr, cellHead(1, 3, 0), []byte{1, 0}),
+
+			biffRec(biffLabelSST, cellHead(2, 0, 0), le32(6)),
+			biffRec(biffRK, cellHead(2, 1, 4), rkCents(-123)),
+			biffRec(biffNumber, cellHead(2, 2, 2), le64(45000.5)),
+			biffRec(biffBoolErr, cellHead(2, 3, 0), []byte{0x07, 1}), // #DIV/0!
+
+			biffRec(biffLabelSST, cellHead(3, 0, 0), le32(2)),
+			biffRec(biffMulRK, le16(3), le16(1), le16(0), rkInt(-2), le16(0), rkFloat(0.5), le16(2)),
+
+			biffRec(biffLabelSST, cellHead(4, 0, 0), le32(4)),
+			biffRec(biffFormula, cellHead(4, 1, 0), formulaNum(7.25), make([]byte, 6)),
+			biffRec(biffFormula, cellHead(4, 2, 0), formulaOther(0, 0), make([]byte, 6)),
+			biffRec(biffString, xlString("text result")),
+			biffRec(biffFormula, cellHead(4, 3, 0), formulaOther(1, 1), make([]byte, 6)),
+
+			biffRec(biffLabelSST, cellHead(5, 0, 0), le32(5)),
+			biffRec(biffLabel, cellHead(7, 1, 0), xlString("sparse")),
+		}},
+		{kind: 0, cells: [][]byte{biffRec(biffLabel, cellHead(0, 0, 0), xlString("second sheet"))}},
+	}}
+}
+
+// compoundFile wraps a stream named name in a version 3 compound file: the
+// header, one FAT sector, one directory sector, then the stream's sectors.
+// Streams under 4096 bytes would go in the mini stream, so it pads them.
+func compoundFile(name string, stream []byte) []byte {
+	const sector = 512
+	const endOfChain, free, noStream, fatSect = 0xFFFFFFFE, 0xFFFFFFFF, 0xFFFFFFFF, 0xFFFFFFFD
+	if len(stream) < 4096 {
+		stream = append(stream, make([]byte, 4096-len(stream))...)
+	}
+	size := len(stream)
+	stream = append(stream, make([]byte, (sector-len(stream)%sector)%sector)...)
+	dataSectors := len(stream) / sector
+
+	header := make([]byte, sector)
+	copy(header, cfbSignature)
+	binary.LittleEndian.PutUint16(header[24:], 0x003E)
+	binary.LittleEndian.PutUint16(header[26:], 3)
+	binary.LittleEndian.PutUint16(header[28:], 0xFFFE)
+	binary.LittleEndian.PutUint16(header[30:], 9)
+	binary.LittleEndian.PutUint16(header[32:], 6)
+	binary.LittleEndian.PutUint32(header[44:], 1)    // FAT sectors
+	binary.LittleEndian.PutUint32(header[48:], 1)    // first directory sector
+	binary.LittleEndian.PutUint32(header[56:], 4096) // mini stream cutoff
+	binary.LittleEndian.PutUint32(header[60:], endOfChain)
+	binary.LittleEndian.PutUint32(header[68:], endOfChain)
+	binary.LittleEndian.PutUint32(header[76:], 0) // the FAT is sector 0
+	for i := 1; i < 109; i++ {
+		binary.LittleEndian.PutUint32(header[76+4*i:], free)
+	}
+
+	fat := make([]byte, sector)
+	for i := range sector / 4 {
+		next := uint32(free)
+		switch {
+		case i == 0:
+			next = fatSect
+		case i == 1, i == 1+dataSectors:
+			next = endOfChain
+		case i < 1+dataSectors:
+			next = uint32(i + 1)
+		}
+		binary.LittleEndian.PutUint32(fat[4*i:], next)
+	}
+
+	dir := make([]byte, sector)
+	entry := func(i int, name string, typ byte, child, start uint32, size int) {
+		e := dir[128*i:]
+		units := utf16.Encode([]rune(name))
+		for j, u := range units {
+			binary.LittleEndian.PutUint16(e[2*j:], u)
+		}
+		binary.LittleEndian.PutUint16(e[64:], uint16(2*len(units)+2))
+		e[66], e[67] = typ, 1
+		binary.LittleEndian.PutUint32(e[68:], noStream)
+		binary.LittleEndian.PutUint32(e[72:], noStream)
+		binary.LittleEndian.PutUint32(e[76:], child)
+		binary.LittleEndian.PutUint32(e[116:], start)
+		binary.LittleEndian.PutUint32(e[120:], uint32(size))
+	}
+	entry(0, "Root Entry", 5, 1, endOfChain, 0)
+	entry(1, name, 2, noStream, 2, size)
+	for i := 2; i < 4; i++ {
+		entry(i, "", 0, noStream, 0, 0)
+	}
+	return bytes.Join([][]byte{header, fat, dir, stream}, nil)
+}
+
+func TestProcessXLS(t *testing.T) {
+	file := compoundFile("Workbook", testWorkbook().stream())
+	if !isCompoundFile(bytes.NewReader(file)) {
+		t.Fatal("not recognised as a compound file")
+	}
+	data, err := processXLS(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(data.Headers, "|"); got != "Name|Amount|When|Flag" {
+		t.Errorf("headers = %s", got)
+	}
+	want := [][]string{
+		{"日本", "1234.5", "2023-03-15", "TRUE"},
+		{"Long 日本語", "-1.23", "2023-03-15 12:00:00"}, // errors are left blank
+		{"Ünïcödé", "-2", "0.5"},
+		{"Bold", "7.25", "text result", "TRUE"},
+		{"Ext"},
+		{},
+		{"", "sparse"},
+	}
+	if got, w := fmt.Sprintf("%q", data.Rows), fmt.Sprintf("%q", want); got != w {
+		t.Errorf("rows =\n%s\nwant\n%s", got, w)
+	}
+}
+
+func TestXLSDate1904(t *testing.T) {
+	wb := xlsWorkbook{date1904: true, sheets: []xlsSheet{{cells: [][]byte{
+		biffRec(biffLabel, cellHead(0, 0, 0), xlString("Day")),
+		biffRec(biffRK, cellHead(1, 0, 1), rkInt(0)),
+		biffRec(biffRK, cellHead(2, 0, 1), rkInt(366)),
+	}}}}
+	rows, err := readBIFFSheet(wb.stream())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(rows); got != "[[Day] [1904-01-01] [1905-01-01]]" {
+		t.Errorf("rows = %s", got)
+	}
+}
+
+func TestXLSRejects(t *testing.T) {
+	good := testWorkbook().stream()
+	biff5 := bytes.Clone(good)
+	binary.LittleEndian.PutUint16(biff5[4:], 0x0500)
+	chartsOnly := xlsWorkbook{sheets: []xlsSheet{{kind: 2}}}.stream()
+	// Cut off in the middle of the worksheet's last record.
+	truncated := good[:bytes.Index(good, []byte("sparse"))]
+
+	for name, stream := range map[string][]byte{"BIFF5": biff5, "charts only": chartsOnly, "truncated": truncated, "empty": nil} {
+		if _, err := readBIFFSheet(stream); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+	for name, file := range map[string][]byte{
+		"Excel 95":  compoundFile("Book", good),
+		"encrypted": compoundFile("EncryptedPackage", good),
+		"no stream": compoundFile("WordDocument", good),
+	} {
+		if _, err := processXLS(bytes.NewReader(file)); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+}
+
+// A damaged header mustn't reach mscfb, which sizes its tables from the
+// header's counts; each of these made it allocate gigabytes.
+func TestXLSCorruptHeader(t *testing.T) {
+	good := compoundFile("Workbook", testWorkbook().stream())
+	const dir = 2 * 512 // the header, then the FAT sector
+	damage := map[string]func(b []byte){
+		"directory sectors": func(b []byte) { binary.LittleEndian.PutUint32(b[40:], 0x7FFFFFFF) },
+		"directory sectors v4": func(b []byte) {
+			binary.LittleEndian.PutUint16(b[26:], 4)
+			binary.LittleEndian.PutUint16(b[30:], 12)
+			binary.LittleEndian.PutUint32(b[40:], 0xFFFFFFF0)
+		},
+		"FAT sectors":       func(b []byte) { binary.LittleEndian.PutUint32(b[44:], 0xFFFFFFF0) },
+		"mini FAT sectors":  func(b []byte) { binary.LittleEndian.PutUint32(b[64:], 0x40000000) },
+		"DIFAT sectors":     func(b []byte) { binary.LittleEndian.PutUint32(b[72:], 0x00FFFFFF) },
+		"sector shift":      func(b []byte) { binary.LittleEndian.PutUint16(b[30:], 30) },
+		"mini sector shift": func(b []byte) { binary.LittleEndian.PutUint16(b[32:], 20) },
+		"mini stream size":  func(b []byte) { binary.LittleEndian.PutUint64(b[dir+120:], 1<<40) },
+		"directory outside": func(b []byte) { binary.LittleEndian.PutUint32(b[48:], 0x00FFFFFF) },
+		"workbook size":     func(b []byte) { binary.LittleEndian.PutUint32(b[dir+128+120:], 0xFFFFFFF0) },
+	}
+	for name, fn := range damage {
+		file := bytes.Clone(good)
+		fn(file)
+		if _, err := processXLS(bytes.NewReader(file)); err == nil || !strings.Contains(err.Error(), "not a valid .xls file") {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+	for _, n := range []int{100, 600} {
+		if _, err := processXLS(bytes.NewReader(good[:n])); err == nil {
+			t.Errorf("first %d bytes: want an error", n)
+		}
+	}
+}
+
+// The SST's string count comes from the file too.
+func TestXLSHugeSSTCount(t *testing.T) {
+	wb := testWorkbook()
+	wb.sst = [][]byte{sstBody(0xFFFFFFFF, xlString("Name"), xlString("Amount"))}
+	wb.sheets = []xlsSheet{{cells: [][]byte{biffRec(biffLabelSST, cellHead(0, 0, 0), le32(1))}}}
+	rows, err := readBIFFSheet(wb.stream())
+	if err != nil || fmt.Sprint(rows) != "[[Amount]]" {
+		t.Errorf("rows = %v, %v", rows, err)
+	}
+}